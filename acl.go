@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+)
+
+// ACLの動作
+const (
+	aclAllow = "allow" // 転送する（以降の規則は見ない）
+	aclDeny  = "deny"  // 破棄する（以降の規則は見ない）
+	aclLog   = "log"   // ログに記録して次の規則へ進む
+)
+
+// aclLogInterval は規則ごとにログを出力する最小間隔（超過分は数えるだけ）
+const aclLogInterval = time.Second
+
+// ACLConfigは内側フレームのL2/L3アクセス制御の設定を保持する
+type ACLConfig struct {
+	Default string          `yaml:"default"` // どの規則にも一致しないフレームの動作（allow, deny、既定allow）
+	Rules   []ACLRuleConfig `yaml:"rules"`   // 記載順に評価する規則（空で無効）
+}
+
+// ACLRuleConfigはACLの1規則を保持する（指定した条件をすべて満たすフレームに一致、未指定の条件は問わない）
+type ACLRuleConfig struct {
+	Action    string `yaml:"action"`     // allow, deny, log
+	Direction string `yaml:"direction"`  // 適用する方向（tx, rx, both）
+	SrcMAC    string `yaml:"src_mac"`    // 送信元MAC
+	DstMAC    string `yaml:"dst_mac"`    // 宛先MAC（broadcast, multicast も指定可）
+	EtherType int    `yaml:"ether_type"` // VLANタグの内側のEtherType（0で問わない）
+	VLAN      int    `yaml:"vlan"`       // 最外側のVLAN ID（0で問わない、-1でタグなしのみ）
+	SrcNet    string `yaml:"src_net"`    // 内側IPの送信元アドレス範囲（CIDR）
+	DstNet    string `yaml:"dst_net"`    // 内側IPの宛先アドレス範囲（CIDR）
+}
+
+// aclRuleは検証済みのACLの1規則
+type aclRule struct {
+	index     int
+	action    string
+	dirs      [2]bool
+	srcMAC    net.HardwareAddr
+	dstMAC    net.HardwareAddr
+	dstGroup  string // broadcast, multicast（dstMACの代わり）
+	etherType uint16
+	vlan      int
+	srcNet    netip.Prefix
+	dstNet    netip.Prefix
+
+	hits    atomic.Uint64
+	lastLog atomic.Int64 // 最後にログを出力した時刻(UnixNano)
+}
+
+// aclFilterは設定した規則で内側フレームを許可・破棄するフィルタ
+//
+// ブリッジのファイアウォール（ebtables・nftables bridge）を使わずに、トンネルの入口で最低限のL2ポリシーを適用する。
+type aclFilter struct {
+	rules       []*aclRule
+	defaultDeny bool
+
+	dropped       [2]atomic.Uint64 // 方向ごとの破棄数
+	defaultHits   [2]atomic.Uint64 // 方向ごとのどの規則にも一致しなかったフレーム数
+	logSuppressed atomic.Uint64    // 出力間隔のため省略したログの数
+}
+
+// newACLFilter はACL設定からフィルタを生成する関数（規則がなければnilを返す）
+func newACLFilter(cfg ACLConfig) (*aclFilter, error) {
+	f := &aclFilter{}
+	switch cfg.Default {
+	case "", aclAllow:
+	case aclDeny:
+		f.defaultDeny = true
+	default:
+		return nil, fmt.Errorf("default: unknown action %q (allow, deny)", cfg.Default)
+	}
+	if len(cfg.Rules) == 0 {
+		if f.defaultDeny {
+			return nil, fmt.Errorf("default: deny without rules drops every frame")
+		}
+		return nil, nil
+	}
+
+	for i, rc := range cfg.Rules {
+		r, err := parseACLRule(i, rc)
+		if err != nil {
+			return nil, fmt.Errorf("rules[%d]: %w", i, err)
+		}
+		f.rules = append(f.rules, r)
+	}
+	def := aclAllow
+	if f.defaultDeny {
+		def = aclDeny
+	}
+	logf("[INFO]", "ACL enabled: %d rules (default %s)", len(f.rules), def)
+	return f, nil
+}
+
+// parseACLRule は1規則の設定を検証する関数
+func parseACLRule(index int, rc ACLRuleConfig) (*aclRule, error) {
+	r := &aclRule{index: index, action: rc.Action, vlan: rc.VLAN}
+	switch rc.Action {
+	case aclAllow, aclDeny, aclLog:
+	default:
+		return nil, fmt.Errorf("unknown action %q (allow, deny, log)", rc.Action)
+	}
+	tx, rx, ok := parseDirections(rc.Direction)
+	if !ok {
+		return nil, fmt.Errorf("invalid direction %q", rc.Direction)
+	}
+	r.dirs = [2]bool{DirTX: tx, DirRX: rx}
+
+	var err error
+	if rc.SrcMAC != "" {
+		if r.srcMAC, err = net.ParseMAC(rc.SrcMAC); err != nil || len(r.srcMAC) != 6 {
+			return nil, fmt.Errorf("src_mac: invalid MAC %q", rc.SrcMAC)
+		}
+	}
+	switch rc.DstMAC {
+	case "":
+	case "broadcast", "multicast":
+		r.dstGroup = rc.DstMAC
+	default:
+		if r.dstMAC, err = net.ParseMAC(rc.DstMAC); err != nil || len(r.dstMAC) != 6 {
+			return nil, fmt.Errorf("dst_mac: invalid MAC %q", rc.DstMAC)
+		}
+	}
+	if rc.EtherType != 0 {
+		if rc.EtherType < 0x0600 || rc.EtherType > 0xFFFF {
+			return nil, fmt.Errorf("ether_type: 0x%04x is not an EtherType (0x0600-0xffff)", rc.EtherType)
+		}
+		r.etherType = uint16(rc.EtherType)
+	}
+	if rc.VLAN < -1 || rc.VLAN > 4094 {
+		return nil, fmt.Errorf("invalid VLAN ID %d", rc.VLAN)
+	}
+	if rc.SrcNet != "" {
+		if r.srcNet, err = netip.ParsePrefix(rc.SrcNet); err != nil {
+			return nil, fmt.Errorf("src_net: %w", err)
+		}
+		r.srcNet = r.srcNet.Masked()
+	}
+	if rc.DstNet != "" {
+		if r.dstNet, err = netip.ParsePrefix(rc.DstNet); err != nil {
+			return nil, fmt.Errorf("dst_net: %w", err)
+		}
+		r.dstNet = r.dstNet.Masked()
+	}
+	if rc.Action == aclLog && rc.SrcMAC == "" && rc.DstMAC == "" && rc.EtherType == 0 && rc.VLAN == 0 && rc.SrcNet == "" && rc.DstNet == "" {
+		return nil, fmt.Errorf("log without match conditions would log every frame")
+	}
+	return r, nil
+}
+
+// match はフレームが規則の条件をすべて満たすか判定する関数
+func (r *aclRule) match(f *frameFields) bool {
+	if r.srcMAC != nil && !bytes.Equal(f.src, r.srcMAC) {
+		return false
+	}
+	if r.dstMAC != nil && !bytes.Equal(f.dst, r.dstMAC) {
+		return false
+	}
+	switch r.dstGroup {
+	case "broadcast":
+		if !bytes.Equal(f.dst, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}) {
+			return false
+		}
+	case "multicast":
+		if f.dst[0]&0x01 == 0 {
+			return false
+		}
+	}
+	if r.etherType != 0 && f.etherType != r.etherType {
+		return false
+	}
+	switch {
+	case r.vlan == -1 && len(f.vlans) != 0:
+		return false
+	case r.vlan > 0 && (len(f.vlans) == 0 || f.vlans[0] != uint16(r.vlan)):
+		return false
+	}
+	// アドレス範囲を指定した規則はIPv4/IPv6以外や別のファミリのパケットには一致しない
+	if r.srcNet.IsValid() && !r.srcNet.Contains(f.srcIP.Unmap()) {
+		return false
+	}
+	if r.dstNet.IsValid() && !r.dstNet.Contains(f.dstIP.Unmap()) {
+		return false
+	}
+	return true
+}
+
+// Filter は規則を記載順に評価し、最初に一致したallow・denyの規則に従う
+func (f *aclFilter) Filter(dir Direction, frame []byte) ([]byte, Verdict) {
+	fields, ok := parseFrameFields(frame)
+	if !ok {
+		return frame, VerdictPass
+	}
+	for _, r := range f.rules {
+		if !r.dirs[dir] || !r.match(fields) {
+			continue
+		}
+		r.hits.Add(1)
+		switch r.action {
+		case aclAllow:
+			return frame, VerdictPass
+		case aclDeny:
+			f.dropped[dir].Add(1)
+			return nil, VerdictDrop
+		case aclLog:
+			f.log(r, dir, fields)
+		}
+	}
+	f.defaultHits[dir].Add(1)
+	if f.defaultDeny {
+		f.dropped[dir].Add(1)
+		return nil, VerdictDrop
+	}
+	return frame, VerdictPass
+}
+
+// log はlog規則に一致したフレームを規則ごとに出力間隔を空けて記録する関数
+func (f *aclFilter) log(r *aclRule, dir Direction, fields *frameFields) {
+	now := time.Now().UnixNano()
+	last := r.lastLog.Load()
+	if now-last < int64(aclLogInterval) || !r.lastLog.CompareAndSwap(last, now) {
+		f.logSuppressed.Add(1)
+		return
+	}
+	msg := fmt.Sprintf("ACL rule %d (%s): %s > %s ethertype 0x%04x", r.index, dir, fields.src, fields.dst, fields.etherType)
+	if len(fields.vlans) > 0 {
+		msg += fmt.Sprintf(" vlan %d", fields.vlans[0])
+	}
+	if fields.srcIP.IsValid() {
+		msg += fmt.Sprintf(" %s > %s proto %d", fields.srcIP, fields.dstIP, fields.proto)
+	}
+	logf("[INFO]", "%s", msg)
+}
+
+// Counters は方向ごとの破棄数と規則ごとの一致数を返す
+func (f *aclFilter) Counters() map[string]uint64 {
+	counters := map[string]uint64{
+		"acl_tx_dropped":     f.dropped[DirTX].Load(),
+		"acl_rx_dropped":     f.dropped[DirRX].Load(),
+		"acl_tx_default":     f.defaultHits[DirTX].Load(),
+		"acl_rx_default":     f.defaultHits[DirRX].Load(),
+		"acl_log_suppressed": f.logSuppressed.Load(),
+	}
+	for _, r := range f.rules {
+		counters[fmt.Sprintf("acl_rule%d_hits", r.index)] = r.hits.Load()
+	}
+	return counters
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+// pinThread はLinux以外では未対応
+func pinThread(cpu int) error {
+	return fmt.Errorf("not supported on this platform")
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// アラート関連の定数定義
+const (
+	alertDefaultInterval = 10 * time.Second // 評価間隔の既定値
+	alertHookTimeout     = 10 * time.Second // フックスクリプトのタイムアウト
+)
+
+// AlertConfigはしきい値アラートの設定を保持する
+type AlertConfig struct {
+	Interval string      `yaml:"interval"` // 評価間隔
+	Rules    []AlertRule `yaml:"rules"`    // アラートルール
+}
+
+// AlertRuleはしきい値アラート1件分の設定
+//
+// metricには次のいずれかを指定する。
+//   - drop_rate: フィルタチェーンで破棄したフレーム数（毎秒）
+//   - keepalive_loss: キープアライブ応答の連続欠落数（全ピアの最大値）
+//   - queue_depth: 送受信キューの滞留数（大きい方）
+//   - それ以外: 同名カウンタの増加量（毎秒）
+type AlertRule struct {
+	Name      string  `yaml:"name"`      // ルール名（イベントに含める）
+	Metric    string  `yaml:"metric"`    // 監視する値
+	Threshold float64 `yaml:"threshold"` // この値を超えたら発報
+	Hook      string  `yaml:"hook"`      // 実行するスクリプト（イベントJSONを標準入力に渡す）
+	Webhook   string  `yaml:"webhook"`   // イベントJSONをPOSTするURL
+}
+
+// AlertEventはフック・Webhookへ渡すイベント
+type AlertEvent struct {
+	Event     string            `json:"event"` // "alert_firing" または "alert_resolved"
+	Rule      string            `json:"rule"`
+	Metric    string            `json:"metric"`
+	Value     float64           `json:"value"`
+	Threshold float64           `json:"threshold"`
+	Peer      string            `json:"peer,omitempty"` // keepalive_lossで最大値となったピア
+	Tap       string            `json:"tap"`
+	Tenant    string            `json:"tenant,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Time      int64             `json:"time"`
+}
+
+// alerterはルールを定期評価し、しきい値を跨いだときにイベントを送る
+type alerter struct {
+	t        *Tunnel
+	interval time.Duration
+	rules    []AlertRule
+	firing   []bool
+}
+
+// newAlerter はアラート設定を検証して評価器を生成する関数
+func newAlerter(t *Tunnel, cfg AlertConfig) (*alerter, error) {
+	a := &alerter{
+		t:        t,
+		interval: alertDefaultInterval,
+		rules:    cfg.Rules,
+		firing:   make([]bool, len(cfg.Rules)),
+	}
+	if cfg.Interval != "" {
+		iv, err := time.ParseDuration(cfg.Interval)
+		if err != nil {
+			return nil, err
+		}
+		if iv <= 0 {
+			return nil, fmt.Errorf("interval must be positive")
+		}
+		a.interval = iv
+	}
+
+	for i, r := range a.rules {
+		if r.Metric == "" {
+			return nil, fmt.Errorf("alerts.rules[%d]: metric is required", i)
+		}
+		if r.Hook == "" && r.Webhook == "" {
+			return nil, fmt.Errorf("alerts.rules[%d]: hook or webhook is required", i)
+		}
+		if r.Name == "" {
+			a.rules[i].Name = r.Metric
+		}
+		if r.Metric == "keepalive_loss" && t.cfg.KeepaliveInterval == "off" {
+			logf("[WARN]", "Alert %q uses keepalive_loss but keepalive is off", a.rules[i].Name)
+		}
+	}
+	return a, nil
+}
+
+// keepaliveLoss は応答が途絶えてからの送信間隔数が最大のピアとその数を返す関数
+func (t *Tunnel) keepaliveLoss(now time.Time) (string, float64) {
+	if t.keepaliveInterval == 0 {
+		return "", 0
+	}
+	host, loss := "", 0.0
+	for _, peer := range t.peers {
+		p := peer.active.Load()
+		// 適応制御で省略した分は、データの受信を応答とみなして数えない
+		missed := float64(now.Sub(time.Unix(0, max(p.lastRecv.Load(), p.lastData.Load()))) / t.keepaliveInterval)
+		if missed > loss {
+			host, loss = peer.Host, missed
+		}
+	}
+	return host, loss
+}
+
+// run は評価間隔ごとに全ルールを評価する関数
+func (a *alerter) run() {
+	logf("[INFO]", "Alerting enabled (%d rules, interval %v)", len(a.rules), a.interval)
+
+	prev := a.t.counters()
+	last := time.Now()
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		cur := a.t.counters()
+		elapsed := now.Sub(last).Seconds()
+		rate := func(name string) float64 {
+			if cur[name] < prev[name] || elapsed <= 0 {
+				return 0
+			}
+			return float64(cur[name]-prev[name]) / elapsed
+		}
+
+		for i, r := range a.rules {
+			var value float64
+			var peer string
+			switch r.Metric {
+			case "drop_rate":
+				value = rate("tx_dropped") + rate("rx_dropped")
+			case "keepalive_loss":
+				peer, value = a.t.keepaliveLoss(now)
+			case "queue_depth":
+				value = float64(max(cur["tx_queue"], cur["rx_queue"]))
+			default:
+				value = rate(r.Metric)
+			}
+
+			firing := value > r.Threshold
+			if firing == a.firing[i] {
+				continue
+			}
+			a.firing[i] = firing
+
+			ev := AlertEvent{
+				Event:     "alert_resolved",
+				Rule:      r.Name,
+				Metric:    r.Metric,
+				Value:     value,
+				Threshold: r.Threshold,
+				Peer:      peer,
+				Tap:       a.t.cfg.TapName,
+				Tenant:    a.t.cfg.Tenant,
+				Labels:    a.t.cfg.Labels,
+				Time:      now.Unix(),
+			}
+			if firing {
+				ev.Event = "alert_firing"
+				logf("[WARN]", "Alert %s firing: %s=%.2f > %.2f", r.Name, r.Metric, value, r.Threshold)
+			} else {
+				logf("[RESET]", "Alert %s resolved: %s=%.2f", r.Name, r.Metric, value)
+			}
+			go a.notify(r, ev)
+		}
+		prev, last = cur, now
+	}
+}
+
+// notify はイベントをフックスクリプトとWebhookへ送る関数
+func (a *alerter) notify(r AlertRule, ev AlertEvent) {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+
+	if r.Hook != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), alertHookTimeout)
+		cmd := exec.CommandContext(ctx, r.Hook)
+		cmd.Stdin = bytes.NewReader(payload)
+		cmd.Env = append(os.Environ(),
+			"ETHERIP_EVENT="+ev.Event,
+			"ETHERIP_RULE="+ev.Rule,
+			"ETHERIP_METRIC="+ev.Metric,
+			fmt.Sprintf("ETHERIP_VALUE=%g", ev.Value),
+			fmt.Sprintf("ETHERIP_THRESHOLD=%g", ev.Threshold),
+			"ETHERIP_PEER="+ev.Peer,
+			"ETHERIP_TAP="+ev.Tap,
+			"ETHERIP_TENANT="+ev.Tenant,
+		)
+		cmd.Env = append(cmd.Env, labelEnv(ev.Labels)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			logf("[WARN]", "Alert hook %s failed: %v %s", r.Hook, err, strings.TrimSpace(string(out)))
+		}
+		cancel()
+	}
+
+	if r.Webhook != "" {
+		wh := WebhookConfig{URL: r.Webhook, Retries: webhookDefaultRetries}
+		if err := postWebhook(wh, ev.Event, payload); err != nil {
+			logf("[WARN]", "Alert webhook %s failed: %v", r.Webhook, err)
+		}
+	}
+}
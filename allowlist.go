@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// AllowlistConfigは宛先のアドレス以外に受け入れる外側パケットの送信元を保持する
+//
+// 設定するとピアが1台でも未知の送信元を受け入れなくなり、roaming時の移動先もこの範囲に限る。
+type AllowlistConfig struct {
+	Peers      map[string][]string `yaml:"peers"`       // 宛先ホストごとに受け入れる送信元の範囲（CIDRまたはIP、DDNSで移動するプレフィックス等）
+	DNSRecords bool                `yaml:"dns_records"` // 宛先の名前解決で返った全てのアドレスを受け入れる（DNSラウンドロビン）
+}
+
+// enabled は許可リストが設定されているかを返す関数
+func (c AllowlistConfig) enabled() bool {
+	return len(c.Peers) > 0 || c.DNSRecords
+}
+
+// peerAllowlistは宛先の経路と一致しない送信元を、許可した範囲・名前解決の結果からピアへ対応付ける
+type peerAllowlist struct {
+	prefixes   map[string][]*net.IPNet // 宛先ホスト → 受け入れる送信元の範囲
+	dnsRecords bool
+
+	byPrefix atomic.Uint64 // 範囲に一致して受け入れた数
+	byRecord atomic.Uint64 // 名前解決の結果に一致して受け入れた数
+	rejected atomic.Uint64 // どのピアにも一致せず破棄した数
+}
+
+// parseAllowSource はCIDRまたはIPアドレスを範囲として解析する関数
+func parseAllowSource(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		if v4 := ip.To4(); v4 != nil {
+			return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+// newPeerAllowlist は設定から許可リストを生成する関数（未設定ならnilを返す）
+func newPeerAllowlist(cfg AllowlistConfig) (*peerAllowlist, error) {
+	if !cfg.enabled() {
+		return nil, nil
+	}
+	a := &peerAllowlist{prefixes: make(map[string][]*net.IPNet), dnsRecords: cfg.DNSRecords}
+	for host, sources := range cfg.Peers {
+		for _, s := range sources {
+			n, err := parseAllowSource(s)
+			if err != nil {
+				return nil, fmt.Errorf("peers[%s]: %w", host, err)
+			}
+			a.prefixes[host] = append(a.prefixes[host], n)
+		}
+	}
+	return a, nil
+}
+
+// lookup は送信元を許可しているピアと、そのアドレスファミリの経路を返す関数（なければnil）
+func (a *peerAllowlist) lookup(peers []*Peer, src net.IP, version int) (*Peer, *Path) {
+	for _, peer := range peers {
+		for _, p := range peer.paths {
+			if p.Version != version {
+				continue
+			}
+			if a.dnsRecords && p.hasRecord(src) {
+				a.byRecord.Add(1)
+				return peer, p
+			}
+			for _, n := range a.prefixes[p.Host] {
+				if n.Contains(src) {
+					a.byPrefix.Add(1)
+					return peer, p
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+// sources は許可している送信元（範囲と名前解決の結果）をファミリごとに返す関数（ファイアウォールのルール用）
+func (a *peerAllowlist) sources(peers []*Peer) (v4, v6 []*net.IPNet) {
+	add := func(n *net.IPNet) {
+		if n.IP.To4() != nil {
+			v4 = append(v4, n)
+		} else {
+			v6 = append(v6, n)
+		}
+	}
+	for _, peer := range peers {
+		for _, p := range peer.paths {
+			for _, n := range a.prefixes[p.Host] {
+				if (n.IP.To4() != nil) == (p.Version == 4) {
+					add(n)
+				}
+			}
+			if !a.dnsRecords {
+				continue
+			}
+			if records := p.records.Load(); records != nil {
+				for _, ip := range *records {
+					n, _ := parseAllowSource(ip.String())
+					add(n)
+				}
+			}
+		}
+	}
+	return v4, v6
+}
+
+// Counters は許可リストによる受け入れ・破棄数を返す
+func (a *peerAllowlist) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"rx_allowlist_prefix":   a.byPrefix.Load(),
+		"rx_allowlist_record":   a.byRecord.Load(),
+		"rx_allowlist_rejected": a.rejected.Load(),
+	}
+}
+
+// hasRecord は送信元が宛先の名前解決で返ったアドレスのいずれかかを返す関数
+func (p *Path) hasRecord(ip net.IP) bool {
+	records := p.records.Load()
+	if records == nil {
+		return false
+	}
+	for _, r := range *records {
+		if r.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
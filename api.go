@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// APITokenは制御APIのトークンと参照可能なテナントを保持する
+type APIToken struct {
+	Token  string `yaml:"token"`  // Authorization: Bearer で渡すトークン
+	Tenant string `yaml:"tenant"` // 参照できるテナント（"*"で全テナント）
+}
+
+// listenAPI は"unix:/path"ならUnixソケット、それ以外はTCPでlistenする関数
+//
+// 無停止の再起動では引き継ぎ元の待ち受けソケットをそのまま使い、接続を受け付けられない間を作らない。
+func listenAPI(addr string) (net.Listener, error) {
+	ln, err := inheritedListener("listen:" + addr)
+	if ln == nil && err == nil {
+		ln, err = listenAPIAddr(addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch l := ln.(type) {
+	case *net.TCPListener:
+		offerHandover("listen:"+addr, l)
+	case *net.UnixListener:
+		// 引き継ぎ元が閉じてもソケットのファイルを消さない（停止時は次の起動で作り直す）
+		l.SetUnlinkOnClose(false)
+		offerHandover("listen:"+addr, l)
+	}
+	return ln, nil
+}
+
+// listenAPIAddr は待ち受けソケットを新たに開く関数
+func listenAPIAddr(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		os.Remove(path)
+		ln, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		os.Chmod(path, 0600)
+		return ln, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// writeJSON はJSONレスポンスを書き出す関数
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// tokenTenant はリクエストのトークンに対応するテナントを返す関数（該当なしはfalse）
+func tokenTenant(tokens []APIToken, r *http.Request) (string, bool) {
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", false
+	}
+	for _, tok := range tokens {
+		if subtle.ConstantTimeCompare([]byte(given), []byte(tok.Token)) == 1 {
+			return tok.Tenant, true
+		}
+	}
+	return "", false
+}
+
+// TunnelInfoは/tunnelsで返すトンネルの概要
+type TunnelInfo struct {
+	Tap    string            `json:"tap"`
+	Tenant string            `json:"tenant,omitempty"`
+	Domain string            `json:"domain"` // 所属するブロードキャストドメイン
+	Labels map[string]string `json:"labels,omitempty"`
+	MTU    int               `json:"mtu"`
+	Speed  int               `json:"link_speed_mbps,omitempty"` // link_speed設定時のみ
+	Peers  []PeerStatus      `json:"peers"`
+
+	FrameSizes map[string]HistogramSnapshot `json:"frame_sizes,omitempty"` // 方向別のフレーム長（telemetry.frame_sizes有効時のみ）
+}
+
+// apiServerは制御APIで参照できるトンネル一覧とトークンを保持する
+type apiServer struct {
+	tunnels []*Tunnel
+	tokens  []APIToken
+}
+
+// visible はリクエストのトークンで参照できるトンネルを返す（認証失敗時はfalse）
+//
+// トークンが設定されていなければ全トンネルを返す。
+func (s *apiServer) visible(w http.ResponseWriter, r *http.Request) ([]*Tunnel, bool) {
+	if len(s.tokens) == 0 {
+		return s.tunnels, true
+	}
+	tenant, ok := tokenTenant(s.tokens, r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	var list []*Tunnel
+	for _, t := range s.tunnels {
+		if tenant == "*" || tenant == t.cfg.Tenant {
+			list = append(list, t)
+		}
+	}
+	return list, true
+}
+
+// tunnelFor はパスで指定された（省略時は唯一参照できる）トンネルを返す
+//
+// 他テナントのトンネルには存在自体を見せないよう404を返す。
+func (s *apiServer) tunnelFor(w http.ResponseWriter, r *http.Request) *Tunnel {
+	list, ok := s.visible(w, r)
+	if !ok {
+		return nil
+	}
+	if tap := r.PathValue("tap"); tap != "" {
+		for _, t := range list {
+			if t.cfg.TapName == tap {
+				return t
+			}
+		}
+		http.NotFound(w, r)
+		return nil
+	}
+	switch len(list) {
+	case 0:
+		http.NotFound(w, r)
+		return nil
+	case 1:
+		return list[0]
+	}
+	http.Error(w, "multiple tunnels; use /tunnels/{tap}"+r.URL.Path, http.StatusBadRequest)
+	return nil
+}
+
+// handle はトンネル単位のエンドポイントを /name と /tunnels/{tap}/name に登録する
+func (s *apiServer) handle(mux *http.ServeMux, name string, fn func(w http.ResponseWriter, t *Tunnel)) {
+	s.handleRequest(mux, name, func(w http.ResponseWriter, _ *http.Request, t *Tunnel) { fn(w, t) })
+}
+
+// handleRequest はリクエストの内容（メソッド・クエリ）を参照するトンネル単位のエンドポイントを登録する
+func (s *apiServer) handleRequest(mux *http.ServeMux, name string, fn func(w http.ResponseWriter, r *http.Request, t *Tunnel)) {
+	h := func(w http.ResponseWriter, r *http.Request) {
+		if t := s.tunnelFor(w, r); t != nil {
+			w.Header().Set("X-EtherIP-Tenant", t.cfg.Tenant)
+			fn(w, r, t)
+		}
+	}
+	mux.HandleFunc("/"+name, h)
+	mux.HandleFunc("/tunnels/{tap}/"+name, h)
+}
+
+// startAPI は制御APIのHTTPサーバを起動する関数
+func startAPI(addr string, tokens []APIToken, tunnels []*Tunnel) error {
+	ln, err := listenAPI(addr)
+	if err != nil {
+		logf("[ERROR]", "Failed to listen API on %s: %v", addr, err)
+		return err
+	}
+
+	s := &apiServer{tunnels: tunnels, tokens: tokens}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tunnels", func(w http.ResponseWriter, r *http.Request) {
+		list, ok := s.visible(w, r)
+		if !ok {
+			return
+		}
+		infos := []TunnelInfo{}
+		for _, t := range list {
+			infos = append(infos, TunnelInfo{Tap: t.cfg.TapName, Tenant: t.cfg.Tenant, Domain: t.cfg.domainName(), Labels: t.cfg.Labels, MTU: t.cfg.MTU, Speed: t.linkSpeed, Peers: t.peerStatus(), FrameSizes: t.telemetry.FrameSizes()})
+		}
+		writeJSON(w, infos)
+	})
+	mux.HandleFunc("/domains", s.handleDomains)
+	s.handle(mux, "counters", func(w http.ResponseWriter, t *Tunnel) {
+		writeJSON(w, t.counters())
+	})
+	s.handle(mux, "stats", func(w http.ResponseWriter, t *Tunnel) {
+		writeJSON(w, t.trafficBreakdown())
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if list, ok := s.visible(w, r); ok {
+			writeMetrics(w, list)
+		}
+	})
+	s.handle(mux, "sla", func(w http.ResponseWriter, t *Tunnel) {
+		if t.peers[0].sla == nil {
+			http.Error(w, "SLA tracking requires keepalive", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, t.slaReports())
+	})
+	s.handle(mux, "flows", func(w http.ResponseWriter, t *Tunnel) {
+		if t.telemetry == nil || t.telemetry.flows == nil {
+			http.Error(w, "flow table is disabled (telemetry.flows)", http.StatusNotFound)
+			return
+		}
+		flows := t.telemetry.Flows()
+		for i := range flows {
+			flows[i].Labels = t.cfg.Labels
+		}
+		writeJSON(w, flows)
+	})
+	s.handle(mux, "fdb", func(w http.ResponseWriter, t *Tunnel) {
+		if t.fdb == nil {
+			http.Error(w, "FDB is used only with multiple peers", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, t.fdb.Entries())
+	})
+	s.handleRequest(mux, "capture", func(w http.ResponseWriter, r *http.Request, t *Tunnel) {
+		if t.capture == nil {
+			http.Error(w, "capture is disabled (capture.dir)", http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			if cs := t.capture.session.Load(); cs != nil {
+				writeJSON(w, cs.Status())
+				return
+			}
+			http.Error(w, "no capture running", http.StatusNotFound)
+		case http.MethodPost:
+			cs, err := t.capture.start(r.URL.Query())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeJSON(w, cs.Status())
+		case http.MethodDelete:
+			if cs := t.capture.stop(nil); cs != nil {
+				writeJSON(w, cs.Status())
+				return
+			}
+			http.Error(w, "no capture running", http.StatusNotFound)
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	s.handleRequest(mux, "mac_limit", func(w http.ResponseWriter, r *http.Request, t *Tunnel) {
+		if t.macLimit == nil {
+			http.Error(w, "per-MAC limit is disabled (mac_limit.pps)", http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, t.macLimit.Penalties())
+		case http.MethodDelete:
+			mac, err := net.ParseMAC(r.URL.Query().Get("mac"))
+			if err != nil {
+				http.Error(w, "mac: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !t.macLimit.release(mac) {
+				http.Error(w, "not blocked", http.StatusNotFound)
+				return
+			}
+			writeJSON(w, t.macLimit.Penalties())
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	s.handleRequest(mux, "trace", func(w http.ResponseWriter, r *http.Request, t *Tunnel) {
+		switch r.Method {
+		case http.MethodGet:
+			if ts := t.trace.session.Load(); ts != nil {
+				writeJSON(w, ts.Status())
+				return
+			}
+			http.Error(w, "no trace has run", http.StatusNotFound)
+		case http.MethodPost:
+			ts, err := t.trace.start(r.URL.Query())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeJSON(w, ts.Status())
+		case http.MethodDelete:
+			if ts := t.trace.stop(); ts != nil {
+				writeJSON(w, ts.Status())
+				return
+			}
+			http.Error(w, "no trace running", http.StatusNotFound)
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	s.handleRequest(mux, "migration", func(w http.ResponseWriter, r *http.Request, t *Tunnel) {
+		t.handleMigration(w, r)
+	})
+	s.handleRequest(mux, "history", handleHistory)
+	mux.HandleFunc("/log", s.handleLog)
+	mux.HandleFunc("/config/diff", func(w http.ResponseWriter, r *http.Request) {
+		list, ok := s.visible(w, r)
+		if !ok {
+			return
+		}
+		configMu.Lock()
+		diff := lastDiff
+		configMu.Unlock()
+		if diff == nil {
+			http.Error(w, "no reload since startup", http.StatusNotFound)
+			return
+		}
+
+		// 参照できるトンネルの差分だけを返す
+		filtered := *diff
+		filtered.Changes = []ConfigChange{}
+		for _, c := range diff.Changes {
+			for _, t := range list {
+				if strings.HasPrefix(c.Path, t.cfg.TapName+".") {
+					filtered.Changes = append(filtered.Changes, c)
+					break
+				}
+			}
+		}
+		writeJSON(w, filtered)
+	})
+
+	if len(tokens) > 0 {
+		logf("[INFO]", "API token authentication enabled (%d tokens)", len(tokens))
+	}
+	logf("[INFO]", "API listening on %s", addr)
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			logf("[ERROR]", "API server: %v", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ペイロード認証関連の定数定義
+//
+// 認証有効時はEtherIPパケットの末尾に シーケンス番号(u64) + 送信時刻(u64, UnixNano) +
+// HMAC-SHA256の先頭16バイト を付ける。HMACはEtherIPヘッダからシーケンス番号・時刻までを対象とする。
+const (
+	authTagLen          = 16
+	authTrailerLen      = 8 + 8 + authTagLen
+	authMinKeyLen       = 16
+	authDefaultMaxSkew  = 30 * time.Second // 送信時刻と受信時刻の差の許容値
+	authReplayWindow    = 64               // 順序の入れ替わりを許容するシーケンス番号の幅
+	authMaxReplayWindow = 4096             // replay_windowの上限
+)
+
+// AuthConfigは事前共有鍵によるEtherIPペイロード認証の設定を保持する（両端で同じ設定が必要）
+type AuthConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Key     string `yaml:"key"`      // 事前共有鍵（16文字以上）
+	KeyEnv  string `yaml:"key_env"`  // 鍵を読み取る環境変数名（keyより優先）
+	MaxSkew string `yaml:"max_skew"` // 送信時刻のずれの許容値
+
+	ReplayWindow int                       `yaml:"replay_window"` // 順序の入れ替わりを許容するシーケンス番号の幅（0で64）
+	Peers        map[string]AuthPeerConfig `yaml:"peers"`         // 宛先ホストごとのmax_skew・replay_windowの上書き（時計のずれやすい機器向け）
+}
+
+// AuthPeerConfigは宛先ホストごとに上書きするリプレイ検出の設定を保持する（省略した項目はauthの値）
+type AuthPeerConfig struct {
+	MaxSkew      string `yaml:"max_skew"`      // 送信時刻のずれの許容値
+	ReplayWindow int    `yaml:"replay_window"` // 順序の入れ替わりを許容するシーケンス番号の幅
+}
+
+// authPolicyは対向ごとに適用するリプレイ検出の設定
+type authPolicy struct {
+	maxSkew time.Duration
+	window  int
+}
+
+// replayWindowは受信済みシーケンス番号を記録するスライディングウィンドウ
+type replayWindow struct {
+	mu     sync.Mutex
+	top    uint64   // 受信した最大のシーケンス番号
+	size   uint64   // ウィンドウの幅（0でauthReplayWindow）
+	bitmap []uint64 // top から size 個前までの受信済みビット（topが最下位ビット）
+}
+
+// replayVerdictはシーケンス番号をウィンドウと照合した結果
+type replayVerdict int
+
+const (
+	replayInOrder   replayVerdict = iota // これまでの最大より新しい
+	replayReordered                      // ウィンドウ内で未受信（順序の入れ替わり）
+	replayDuplicate                      // ウィンドウ内で受信済み
+	replayStale                          // ウィンドウより古い
+)
+
+// accept はシーケンス番号が未受信かつウィンドウ内であれば記録してtrueを返す
+func (w *replayWindow) accept(seq uint64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.update(seq) <= replayReordered
+}
+
+// width はウィンドウの幅を返す関数
+func (w *replayWindow) width() uint64 {
+	if w.size == 0 {
+		return authReplayWindow
+	}
+	return w.size
+}
+
+// reset はウィンドウをseqのみ受信済みの状態にする関数（w.muを保持して呼ぶ）
+func (w *replayWindow) reset(seq uint64) {
+	if w.bitmap == nil {
+		w.bitmap = make([]uint64, (w.width()+63)/64)
+	}
+	clear(w.bitmap)
+	w.top = seq
+	w.bitmap[0] = 1
+}
+
+// update はシーケンス番号を照合し、未受信であれば記録する関数（w.muを保持して呼ぶ）
+func (w *replayWindow) update(seq uint64) replayVerdict {
+	size := w.width()
+	switch {
+	case w.bitmap == nil || seq-w.top >= size && seq > w.top:
+		w.reset(seq)
+		return replayInOrder
+	case seq > w.top:
+		w.shift(seq - w.top)
+		w.top = seq
+		w.bitmap[0] |= 1
+		return replayInOrder
+	case w.top-seq >= size:
+		return replayStale
+	}
+	off := w.top - seq
+	word, bit := &w.bitmap[off/64], uint64(1)<<(off%64)
+	if *word&bit != 0 {
+		return replayDuplicate
+	}
+	*word |= bit
+	return replayReordered
+}
+
+// shift はビット列をn（ウィンドウの幅未満）だけ古い側へずらす関数
+func (w *replayWindow) shift(n uint64) {
+	words, bits := int(n/64), n%64
+	for i := len(w.bitmap) - 1; i >= 0; i-- {
+		var v uint64
+		if j := i - words; j >= 0 {
+			v = w.bitmap[j] << bits
+			if bits > 0 && j > 0 {
+				v |= w.bitmap[j-1] >> (64 - bits)
+			}
+		}
+		w.bitmap[i] = v
+	}
+}
+
+// authenticatorはEtherIPパケットへのHMAC付与と受信時の検証を行う
+type authenticator struct {
+	key     *secret               // ロック済みのメモリに置いた鍵
+	policy  authPolicy            // 既定のリプレイ検出の設定
+	peers   map[string]authPolicy // 宛先ホストごとの設定（auth.peers）
+	seq     atomic.Uint64         // 送信シーケンス番号
+	windows sync.Map              // 宛先ホスト → *authWindow
+
+	short    atomic.Uint64 // 認証トレーラより短いパケット
+	failed   atomic.Uint64 // HMACが一致しなかったパケット
+	stale    atomic.Uint64 // 送信時刻が許容範囲外のパケット
+	replayed atomic.Uint64 // 受信済みまたはウィンドウより古いシーケンス番号のパケット
+}
+
+// newAuthenticator は認証設定から認証器を生成する関数（無効ならnilを返す）
+func newAuthenticator(cfg AuthConfig) (*authenticator, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	key := cfg.Key
+	if cfg.KeyEnv != "" {
+		if key = os.Getenv(cfg.KeyEnv); key == "" {
+			return nil, fmt.Errorf("environment variable %s is empty", cfg.KeyEnv)
+		}
+	}
+	if len(key) < authMinKeyLen {
+		return nil, fmt.Errorf("key must be at least %d characters", authMinKeyLen)
+	}
+
+	a := &authenticator{policy: authPolicy{maxSkew: authDefaultMaxSkew, window: authReplayWindow}}
+	var err error
+	if a.policy, err = parseAuthPolicy(a.policy, cfg.MaxSkew, cfg.ReplayWindow); err != nil {
+		return nil, err
+	}
+	for host, pc := range cfg.Peers {
+		policy, err := parseAuthPolicy(a.policy, pc.MaxSkew, pc.ReplayWindow)
+		if err != nil {
+			return nil, fmt.Errorf("peers[%s]: %w", host, err)
+		}
+		if a.peers == nil {
+			a.peers = make(map[string]authPolicy)
+		}
+		a.peers[host] = policy
+	}
+	a.key = newSecret(keyBytes(key))
+
+	// 再起動後も以前より大きい番号から始まるよう、起動時刻を初期値とする
+	a.seq.Store(uint64(time.Now().UnixNano()))
+	return a, nil
+}
+
+// parseAuthPolicy はmax_skew・replay_windowを検証し、省略した項目はbaseの値としたものを返す関数
+func parseAuthPolicy(base authPolicy, maxSkew string, window int) (authPolicy, error) {
+	if maxSkew != "" {
+		d, err := time.ParseDuration(maxSkew)
+		if err != nil {
+			return base, err
+		}
+		if d <= 0 {
+			return base, errors.New("max_skew must be positive")
+		}
+		base.maxSkew = d
+	}
+	switch {
+	case window < 0 || window > authMaxReplayWindow:
+		return base, fmt.Errorf("replay_window %d out of range (1-%d)", window, authMaxReplayWindow)
+	case window > 0:
+		base.window = window
+	}
+	return base, nil
+}
+
+// authWindowは対向ごとのリプレイ検出の設定と受信ウィンドウ
+type authWindow struct {
+	replayWindow
+	maxSkew time.Duration
+}
+
+// window は経路の対向の受信ウィンドウを返す関数（初回は宛先ホストの設定で作る）
+//
+// 対向は1つの送信シーケンス番号をアドレスファミリによらず使うため、IPv4・IPv6の経路でウィンドウを共有し、
+// 一方の経路で受け入れたパケットを他方の経路へ再送されても検出する。予備の宛先（standby）は別の機器のため分ける。
+func (a *authenticator) window(p *Path) *authWindow {
+	if w, ok := a.windows.Load(p.Host); ok {
+		return w.(*authWindow)
+	}
+	policy, ok := a.peers[p.Host]
+	if !ok {
+		policy = a.policy
+	}
+	w := &authWindow{replayWindow: replayWindow{size: uint64(policy.window)}, maxSkew: policy.maxSkew}
+	v, _ := a.windows.LoadOrStore(p.Host, w)
+	return v.(*authWindow)
+}
+
+// overhead は認証によって増える外側パケットのバイト数を返す（無効時は0）
+func (a *authenticator) overhead() int {
+	if a == nil {
+		return 0
+	}
+	return authTrailerLen
+}
+
+// tag はHMACを計算してdstへ追加する関数
+func (a *authenticator) tag(dst, data []byte) []byte {
+	var sum [sha256.Size]byte
+	return append(dst, a.key.sum(sum[:0], data)[:authTagLen]...)
+}
+
+// seal はEtherIPパケットの末尾にシーケンス番号・送信時刻・HMACを付ける関数
+func (a *authenticator) seal(packet []byte) []byte {
+	packet = binary.BigEndian.AppendUint64(packet, a.seq.Add(1))
+	packet = binary.BigEndian.AppendUint64(packet, uint64(time.Now().UnixNano()))
+	return a.tag(packet, packet)
+}
+
+// open は受信パケットの認証トレーラを検証し、トレーラを除いた長さを返す関数
+//
+// HMACを確認してから時刻とシーケンス番号を見るため、偽造パケットでウィンドウが進むことはない。
+func (a *authenticator) open(p *Path, packet []byte) (int, bool) {
+	n := len(packet) - authTrailerLen
+	if n < etherIPHeaderLen {
+		a.short.Add(1)
+		return 0, false
+	}
+	signed := packet[:len(packet)-authTagLen]
+	var buf [authTagLen]byte
+	if !hmac.Equal(a.tag(buf[:0], signed), packet[len(signed):]) {
+		a.failed.Add(1)
+		return 0, false
+	}
+
+	seq := binary.BigEndian.Uint64(packet[n : n+8])
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(packet[n+8:n+16])))
+	w := a.window(p)
+	if skew := time.Since(sent); skew > w.maxSkew || skew < -w.maxSkew {
+		a.stale.Add(1)
+		return 0, false
+	}
+	if !w.accept(seq) {
+		a.replayed.Add(1)
+		return 0, false
+	}
+	return n, true
+}
+
+// Counters は認証に失敗した受信パケットのカウンタを返す
+func (a *authenticator) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"rx_auth_short":    a.short.Load(),
+		"rx_auth_failed":   a.failed.Load(),
+		"rx_auth_stale":    a.stale.Load(),
+		"rx_auth_replayed": a.replayed.Load(),
+	}
+}
+
+// seal は有効な場合に送信経路pのパケットへシーケンス番号のサブヘッダと認証トレーラを付ける関数
+//
+// サブヘッダを先に付けるため、認証有効時はシーケンス番号もHMACの対象となる。
+// シーケンス番号は経路ごとのため、複数の経路へ送るパケットは経路ごとに付ける。
+func (t *Tunnel) seal(p *Path, packet []byte) []byte {
+	if t.seq != nil {
+		packet = t.seq.stamp(p, packet)
+	}
+	if t.auth == nil {
+		return packet
+	}
+	return t.auth.seal(packet)
+}
+
+// sealOverhead はsealとカプセル化によって増える外側パケットのバイト数を返す関数
+func (t *Tunnel) sealOverhead() int {
+	return t.seq.overhead() + t.auth.overhead() + t.socks[0].Encap.overhead()
+}
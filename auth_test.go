@@ -0,0 +1,67 @@
+package main
+
+import "testing"
+
+func TestReplayWindow(t *testing.T) {
+	type step struct {
+		seq  uint64
+		want replayVerdict
+	}
+	tests := []struct {
+		name  string
+		size  uint64
+		steps []step
+	}{
+		{"in order", 64, []step{{1, replayInOrder}, {2, replayInOrder}, {3, replayInOrder}}},
+		{"reordered", 64, []step{{1, replayInOrder}, {4, replayInOrder}, {3, replayReordered}, {2, replayReordered}, {5, replayInOrder}}},
+		{"duplicate", 64, []step{{1, replayInOrder}, {2, replayInOrder}, {2, replayDuplicate}, {1, replayDuplicate}}},
+		{"stale", 64, []step{{1, replayInOrder}, {65, replayInOrder}, {2, replayReordered}, {1, replayStale}}},
+		{"jump beyond window", 64, []step{{1, replayInOrder}, {2, replayInOrder}, {200, replayInOrder}, {2, replayStale}, {137, replayReordered}}},
+		// 複数ワードのビット列をワード境界をまたいでずらす
+		{"shift across words", 256, []step{{10, replayInOrder}, {11, replayInOrder}, {80, replayInOrder}, {11, replayDuplicate},
+			{12, replayReordered}, {210, replayInOrder}, {11, replayDuplicate}, {80, replayDuplicate}, {79, replayReordered}, {265, replayInOrder}, {10, replayDuplicate}, {9, replayStale}}},
+		{"default width", 0, []step{{1, replayInOrder}, {authReplayWindow, replayInOrder}, {1, replayDuplicate}, {authReplayWindow + 1, replayInOrder}, {1, replayStale}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &replayWindow{size: tt.size}
+			for i, s := range tt.steps {
+				if got := w.update(s.seq); got != s.want {
+					t.Fatalf("step %d: update(%d) = %d, want %d", i, s.seq, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthReplayAcrossPaths(t *testing.T) {
+	a, err := newAuthenticator(AuthConfig{Enabled: true, Key: "0123456789abcdef"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v4, v6, standby := &Path{Version: 4, Host: "a"}, &Path{Version: 6, Host: "a"}, &Path{Version: 4, Host: "b"}
+	sealed := a.seal(buildEtherIPPacket(make([]byte, 14)))
+	open := func(p *Path) bool {
+		_, ok := a.open(p, append([]byte(nil), sealed...))
+		return ok
+	}
+
+	steps := []struct {
+		name string
+		p    *Path
+		want bool
+	}{
+		{"first on IPv4", v4, true},
+		{"replayed on IPv4", v4, false},
+		{"replayed on IPv6 of the same host", v6, false},
+		{"standby host has its own window", standby, true},
+	}
+	for _, st := range steps {
+		if got := open(st.p); got != st.want {
+			t.Errorf("%s: open() = %v, want %v", st.name, got, st.want)
+		}
+	}
+	if got := a.replayed.Load(); got != 2 {
+		t.Errorf("replayed = %d, want 2", got)
+	}
+}
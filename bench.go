@@ -0,0 +1,602 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ベンチマーク関連の定数定義
+const (
+	benchDefaultDuration = 5 * time.Second
+	benchDrain           = 500 * time.Millisecond // 送信を止めてから受信を待つ時間
+	benchIdle            = 3 * time.Second        // -listenで最後の受信からこの時間で終了
+	benchLoopbackA       = "127.0.0.1"            // loopbackの送信側
+	benchLoopbackB       = "127.0.0.2"            // loopbackの受信側
+)
+
+// BenchResultは計測1回分の結果
+type BenchResult struct {
+	Phase          string  `json:"phase"`  // encap, decap, tx, rx
+	Frames         uint64  `json:"frames"` // 処理した内側フレーム数
+	Bytes          uint64  `json:"bytes"`  // 内側フレームの合計バイト数
+	Seconds        float64 `json:"seconds"`
+	PPS            float64 `json:"pps"`
+	Mbps           float64 `json:"mbps"`                   // 内側フレームのスループット
+	NsPerFrame     float64 `json:"ns_per_frame,omitempty"` // 1フレームあたりのCPU時間（memoryのみ、並列数で割らない実時間×並列数）
+	AllocsPerFrame float64 `json:"allocs_per_frame"`       // 1フレームあたりのヒープ確保回数（loopbackでは送受信の合計をtxに載せる）
+	AllocBytes     float64 `json:"alloc_bytes_per_frame"`  // 1フレームあたりのヒープ確保バイト数
+	Dropped        uint64  `json:"dropped,omitempty"`      // 検証・フィルタで破棄した数
+	Lost           uint64  `json:"lost,omitempty"`         // 送信したが受信しなかった数（loopbackのみ）
+	Outer          uint64  `json:"outer_bytes,omitempty"`  // 外側パケット（IPヘッダを除く）の合計バイト数
+}
+
+// BenchOutputは"bench -json"で出力する結果
+type BenchOutput struct {
+	Schema    int           `json:"schema"`
+	Mode      string        `json:"mode"`     // memory, loopback, peer, listen
+	Settings  string        `json:"settings"` // 計測したデータパスの設定
+	FrameSize int           `json:"frame_size"`
+	Flows     int           `json:"flows"`
+	Parallel  int           `json:"parallel"`
+	Results   []BenchResult `json:"results"`
+}
+
+// benchMeter は計測区間のフレーム数・バイト数とヒープ確保を数える
+type benchMeter struct {
+	frames, bytes, dropped, outer atomic.Uint64
+
+	start time.Time
+	mem   runtime.MemStats
+	phase string
+}
+
+// begin は計測を始める関数
+func (m *benchMeter) begin(phase string) {
+	m.phase = phase
+	runtime.GC()
+	runtime.ReadMemStats(&m.mem)
+	m.start = time.Now()
+}
+
+// end は計測を終えて結果を返す関数
+func (m *benchMeter) end() BenchResult {
+	elapsed := time.Since(m.start).Seconds()
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	r := BenchResult{
+		Phase:   m.phase,
+		Frames:  m.frames.Load(),
+		Bytes:   m.bytes.Load(),
+		Seconds: elapsed,
+		Dropped: m.dropped.Load(),
+		Outer:   m.outer.Load(),
+	}
+	if r.Frames > 0 {
+		r.AllocsPerFrame = float64(after.Mallocs-m.mem.Mallocs) / float64(r.Frames)
+		r.AllocBytes = float64(after.TotalAlloc-m.mem.TotalAlloc) / float64(r.Frames)
+	}
+	if elapsed > 0 {
+		r.PPS = float64(r.Frames) / elapsed
+		r.Mbps = float64(r.Bytes) * 8 / elapsed / 1e6
+	}
+	return r
+}
+
+// newBenchTunnel は設定のデータパス（カプセル化・圧縮・認証・シーケンス番号・ループガード・受信検証）だけを持つトンネルを生成する関数
+//
+// TAP・フィルタ・ピアは作らない。connがnilならソケットを使わないメモリ上の計測用。
+func newBenchTunnel(cfg *Config, conn *net.IPConn, version int) (*Tunnel, error) {
+	if err := checkEncap(cfg); err != nil {
+		return nil, fmt.Errorf("encap: %w", err)
+	}
+	encap, err := newEncapsulation(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("encap: %w", err)
+	}
+	buffers, err := resolveBuffers(cfg.Buffers, cfg.MTU)
+	if err != nil {
+		return nil, fmt.Errorf("buffers: %w", err)
+	}
+	sock := &Socket{Version: version, Conn: conn, Encap: encap}
+	workers := workerSizing{sendWorkers: 1, recvWorkers: 1, sendQueue: 1, recvQueue: 1}
+	t := newTunnel(cfg, nil, []*Socket{sock}, nil, workers, buffers)
+	if t.comp, err = newCompressor(cfg.Compression); err != nil {
+		return nil, fmt.Errorf("compression: %w", err)
+	}
+	if t.auth, err = newAuthenticator(cfg.Auth); err != nil {
+		return nil, fmt.Errorf("auth: %w", err)
+	}
+	t.seq = newSequencer(cfg.Sequence)
+	if t.header, err = newHeaderChecker(cfg.HeaderMode, t.comp != nil, t.seq != nil, false); err != nil {
+		return nil, fmt.Errorf("header_mode: %w", err)
+	}
+	if t.rxCheck, err = newRxValidator(cfg.RxValidation); err != nil {
+		return nil, fmt.Errorf("rx_validation: %w", err)
+	}
+	if t.loopGuard, err = newLoopGuard(cfg.LoopGuard); err != nil {
+		return nil, fmt.Errorf("loop_guard: %w", err)
+	}
+	return t, nil
+}
+
+// benchPath は認証・シーケンス番号の受信ウィンドウを分けるための経路を生成する関数（並列の計測ごとに1つ）
+func (t *Tunnel) benchPath() *Path {
+	return &Path{Version: t.socks[0].Version, Conn: t.socks[0].Conn, encap: t.socks[0].Encap, sock: t.socks[0]}
+}
+
+// benchSettings は計測したデータパスの設定を表示用にまとめる関数
+func (t *Tunnel) benchSettings() string {
+	c := t.localCapabilities()
+	parts := []string{"encap " + c.Encap, fmt.Sprintf("mtu %d", c.MTU)}
+	if c.Compression != "" {
+		parts = append(parts, "compression "+c.Compression)
+	}
+	if c.Auth {
+		parts = append(parts, "auth")
+	}
+	if c.Sequence {
+		parts = append(parts, "sequence")
+	}
+	if c.LoopGuard {
+		parts = append(parts, "loop_guard")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// encapFrame はforwardと同じ手順で内側フレームを送信用の外側パケット（IPヘッダより後ろ）にする関数
+func (t *Tunnel) encapFrame(frame []byte) ([]byte, bool) {
+	frame, ok := t.process(DirTX, frame)
+	if !ok {
+		return nil, false
+	}
+	var packet []byte
+	if t.comp != nil {
+		packet = t.comp.encode(frame)
+	} else {
+		packet = buildEtherIPPacket(frame)
+	}
+	return t.socks[0].Encap.wrap(t.seal(t.peers[0].active.Load(), packet)), true
+}
+
+// decapPacket はreceiveと受信ワーカーと同じ手順で外側パケットを検証し、TAPへ渡す内側フレームの長さを返す関数（破棄なら0）
+//
+// bufはその場で書き換える。plainは圧縮フレームの展開先。
+func (t *Tunnel) decapPacket(p *Path, buf []byte, n int, plain []byte) int {
+	n, ok := t.socks[0].Encap.unwrap(buf, n)
+	if !ok {
+		return 0
+	}
+	alg, ok := t.header.Check(buf[:n])
+	if !ok {
+		return 0
+	}
+	if t.auth != nil {
+		if n, ok = t.auth.open(p, buf[:n]); !ok {
+			return 0
+		}
+	}
+	if t.seq != nil {
+		if n, ok = t.seq.open(p, buf[:n]); !ok {
+			return 0
+		}
+	}
+	frame := buf[etherIPHeaderLen:n]
+	if alg != 0 {
+		var err error
+		if frame, err = t.comp.decode(alg, frame, plain); err != nil {
+			return 0
+		}
+	}
+	if frame, ok = t.process(DirRX, frame); !ok || !t.rxCheck.valid(frame) {
+		return 0
+	}
+	return len(frame)
+}
+
+// benchFrames はフローごとに送信元MAC・IPアドレス・UDPポートを変えたIPv4/UDPフレームを生成する関数
+//
+// compressibleならペイロードを同じ文字列の繰り返しにする（既定は乱数で圧縮が効かない最悪値）。
+func benchFrames(size, flows int, compressible bool) [][]byte {
+	rng := rand.New(rand.NewSource(1))
+	frames := make([][]byte, flows)
+	for i := range frames {
+		f := make([]byte, size)
+		copy(f[0:6], []byte{0x02, 0x42, 0x45, 0x4e, 0x43, 0x48})
+		copy(f[6:12], []byte{0x02, 0x42, 0x00, 0x00, byte(i >> 8), byte(i)})
+		binary.BigEndian.PutUint16(f[12:14], 0x0800)
+
+		ip := f[14:34]
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:4], uint16(size-14))
+		ip[8] = 64
+		ip[9] = 17 // UDP
+		copy(ip[12:16], []byte{198, 18, byte(i >> 8), byte(i)})
+		copy(ip[16:20], []byte{198, 19, 0, 1})
+		binary.BigEndian.PutUint16(ip[10:12], ipv4Checksum(ip))
+
+		udp := f[34:42]
+		binary.BigEndian.PutUint16(udp[0:2], uint16(10000+i))
+		binary.BigEndian.PutUint16(udp[2:4], 9)
+		binary.BigEndian.PutUint16(udp[4:6], uint16(size-34))
+
+		payload := f[42:]
+		if compressible {
+			for j := range payload {
+				payload[j] = "etherip benchmark "[j%18]
+			}
+		} else {
+			rng.Read(payload)
+		}
+		frames[i] = f
+	}
+	return frames
+}
+
+// benchMemory はソケットを使わずにカプセル化と検証・展開のCPU時間を計測する関数
+//
+// 前半で送信側の処理だけを、後半で送信側と受信側を続けて行い、その差を受信側の時間とする。
+func benchMemory(cfg *Config, frames [][]byte, parallel int, d time.Duration) (string, []BenchResult, error) {
+	tx, err := newBenchTunnel(cfg, nil, cfg.Version)
+	if err != nil {
+		return "", nil, err
+	}
+	rx, err := newBenchTunnel(cfg, nil, cfg.Version)
+	if err != nil {
+		return "", nil, err
+	}
+
+	run := func(m *benchMeter, decap bool) {
+		var stop atomic.Bool
+		var wg sync.WaitGroup
+		for w := 0; w < parallel; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				p := rx.benchPath()
+				buf := make([]byte, rx.rxBufs.size)
+				plain := make([]byte, rx.plainBufs.size)
+				var frames64, bytes64, outer64, dropped64 uint64
+				for i := w; !stop.Load(); i++ {
+					frame := frames[i%len(frames)]
+					packet, ok := tx.encapFrame(frame)
+					if !ok {
+						dropped64++
+						continue
+					}
+					outer64 += uint64(len(packet))
+					if decap && rx.decapPacket(p, buf, copy(buf, packet), plain) == 0 {
+						dropped64++
+						continue
+					}
+					frames64++
+					bytes64 += uint64(len(frame))
+				}
+				m.frames.Add(frames64)
+				m.bytes.Add(bytes64)
+				m.outer.Add(outer64)
+				m.dropped.Add(dropped64)
+			}(w)
+		}
+		time.Sleep(d / 2)
+		stop.Store(true)
+		wg.Wait()
+	}
+
+	var enc, both benchMeter
+	enc.begin("encap")
+	run(&enc, false)
+	encap := enc.end()
+	both.begin("encap+decap")
+	run(&both, true)
+	total := both.end()
+
+	if encap.Frames > 0 {
+		encap.NsPerFrame = encap.Seconds * 1e9 * float64(parallel) / float64(encap.Frames)
+	}
+	decap := total
+	decap.Phase = "decap"
+	if total.Frames > 0 {
+		total.NsPerFrame = total.Seconds * 1e9 * float64(parallel) / float64(total.Frames)
+		decap.NsPerFrame = max(total.NsPerFrame-encap.NsPerFrame, 0)
+		decap.AllocsPerFrame = max(total.AllocsPerFrame-encap.AllocsPerFrame, 0)
+		decap.AllocBytes = max(total.AllocBytes-encap.AllocBytes, 0)
+		decap.PPS = 1e9 * float64(parallel) / max(decap.NsPerFrame, 1)
+		decap.Mbps = decap.PPS * float64(total.Bytes) / float64(total.Frames) * 8 / 1e6
+		decap.Seconds, decap.Outer = total.Seconds, 0
+	}
+	return tx.benchSettings(), []BenchResult{encap, decap, total}, nil
+}
+
+// benchSend はd の間フレームを外側パケットにして宛先へ送り続ける関数
+func benchSend(t *Tunnel, conn *net.IPConn, dst net.IP, frames [][]byte, parallel int, d time.Duration, m *benchMeter) {
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	addr := &net.IPAddr{IP: dst}
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; !stop.Load(); i++ {
+				frame := frames[i%len(frames)]
+				packet, ok := t.encapFrame(frame)
+				if !ok {
+					m.dropped.Add(1)
+					continue
+				}
+				if _, err := conn.WriteTo(packet, addr); err != nil {
+					// 送信バッファが溢れた分は数えずに続ける（受信側との差が損失になる）
+					continue
+				}
+				m.frames.Add(1)
+				m.bytes.Add(uint64(len(frame)))
+				m.outer.Add(uint64(len(packet)))
+			}
+		}(w)
+	}
+	time.Sleep(d)
+	stop.Store(true)
+	wg.Wait()
+}
+
+// benchReceive は受信した外側パケットを検証・展開して数える関数（connを閉じるまで続ける）
+//
+// first・lastには最初・最後に受信した時刻（UnixNano）を記録する。
+func benchReceive(t *Tunnel, m *benchMeter, first, last *atomic.Int64) {
+	s := t.socks[0]
+	p := t.benchPath()
+	buf := make([]byte, t.rxBufs.size)
+	plain := make([]byte, t.plainBufs.size)
+	oob := make([]byte, 64)
+	for {
+		n, _, _, err := s.read(buf, oob)
+		if err != nil {
+			return
+		}
+		if n == 0 {
+			continue
+		}
+		now := time.Now().UnixNano()
+		first.CompareAndSwap(0, now)
+		last.Store(now)
+		m.outer.Add(uint64(n))
+		if size := t.decapPacket(p, buf, n, plain); size > 0 {
+			m.frames.Add(1)
+			m.bytes.Add(uint64(size))
+		} else {
+			m.dropped.Add(1)
+		}
+	}
+}
+
+// benchLoopback は127.0.0.1から127.0.0.2へRAWソケットで送り、カーネルの送受信を含めて計測する関数
+func benchLoopback(cfg *Config, frames [][]byte, parallel int, d time.Duration) (string, []BenchResult, error) {
+	encap, err := newEncapsulation(cfg)
+	if err != nil {
+		return "", nil, err
+	}
+	proto := fmt.Sprintf("ip4:%d", encap.protocol())
+	connA, err := net.ListenIP(proto, &net.IPAddr{IP: net.ParseIP(benchLoopbackA)})
+	if err != nil {
+		return "", nil, fmt.Errorf("RAW socket (root required): %w", err)
+	}
+	defer connA.Close()
+	connB, err := net.ListenIP(proto, &net.IPAddr{IP: net.ParseIP(benchLoopbackB)})
+	if err != nil {
+		return "", nil, fmt.Errorf("RAW socket on %s: %w", benchLoopbackB, err)
+	}
+	connB.SetReadBuffer(8 << 20)
+
+	tx, err := newBenchTunnel(cfg, connA, 4)
+	if err != nil {
+		connB.Close()
+		return "", nil, err
+	}
+	rx, err := newBenchTunnel(cfg, connB, 4)
+	if err != nil {
+		connB.Close()
+		return "", nil, err
+	}
+
+	var sent, recv benchMeter
+	var first, last atomic.Int64
+	done := make(chan struct{})
+	recv.begin("rx")
+	go func() {
+		benchReceive(rx, &recv, &first, &last)
+		close(done)
+	}()
+	sent.begin("tx")
+	benchSend(tx, connA, net.ParseIP(benchLoopbackB), frames, parallel, d, &sent)
+	txResult := sent.end()
+	time.Sleep(benchDrain)
+	connB.Close()
+	<-done
+	rxResult := recv.end()
+	// ヒープ確保は送受信を同時に行うプロセス全体の値のため、送信側の行にだけ載せる
+	rxResult.AllocsPerFrame, rxResult.AllocBytes = 0, 0
+	rxResult.Seconds = txResult.Seconds
+	if rxResult.Seconds > 0 {
+		rxResult.PPS = float64(rxResult.Frames) / rxResult.Seconds
+		rxResult.Mbps = float64(rxResult.Bytes) * 8 / rxResult.Seconds / 1e6
+	}
+	if received := rxResult.Frames + rxResult.Dropped; txResult.Frames > received {
+		rxResult.Lost = txResult.Frames - received
+	}
+	return tx.benchSettings(), []BenchResult{txResult, rxResult}, nil
+}
+
+// benchPeer は別ホストで"bench -listen"を動かしている宛先へ送り続ける関数（送信側の結果のみ）
+func benchPeer(cfg *Config, host string, frames [][]byte, parallel int, d time.Duration) (string, []BenchResult, error) {
+	dst, err := resolveDst(host, cfg.Version)
+	if err != nil {
+		return "", nil, err
+	}
+	encap, err := newEncapsulation(cfg)
+	if err != nil {
+		return "", nil, err
+	}
+	conn, err := net.ListenIP(fmt.Sprintf("ip%d:%d", cfg.Version, encap.protocol()), nil)
+	if err != nil {
+		return "", nil, fmt.Errorf("RAW socket (root required): %w", err)
+	}
+	defer conn.Close()
+	tx, err := newBenchTunnel(cfg, conn, cfg.Version)
+	if err != nil {
+		return "", nil, err
+	}
+	var sent benchMeter
+	sent.begin("tx")
+	benchSend(tx, conn, dst, frames, parallel, d, &sent)
+	return tx.benchSettings(), []BenchResult{sent.end()}, nil
+}
+
+// benchListen は"bench -peer"から届くパケットを受信し、最後の受信からbenchIdle経過で結果を返す関数
+func benchListen(cfg *Config) (string, []BenchResult, error) {
+	encap, err := newEncapsulation(cfg)
+	if err != nil {
+		return "", nil, err
+	}
+	conn, err := net.ListenIP(fmt.Sprintf("ip%d:%d", cfg.Version, encap.protocol()), nil)
+	if err != nil {
+		return "", nil, fmt.Errorf("RAW socket (root required): %w", err)
+	}
+	conn.SetReadBuffer(8 << 20)
+	rx, err := newBenchTunnel(cfg, conn, cfg.Version)
+	if err != nil {
+		conn.Close()
+		return "", nil, err
+	}
+	fmt.Fprintf(os.Stderr, "listening for IPv%d protocol %d (waiting for etherip bench -peer)\n", cfg.Version, encap.protocol())
+
+	var recv benchMeter
+	var first, last atomic.Int64
+	done := make(chan struct{})
+	recv.begin("rx")
+	go func() {
+		benchReceive(rx, &recv, &first, &last)
+		close(done)
+	}()
+	for {
+		time.Sleep(time.Second)
+		if l := last.Load(); l != 0 && time.Since(time.Unix(0, l)) > benchIdle {
+			break
+		}
+	}
+	conn.Close()
+	<-done
+	r := recv.end()
+	// 待ち時間を除いた最初から最後の受信までを計測区間とする
+	r.Seconds = time.Duration(last.Load() - first.Load()).Seconds()
+	if r.Seconds > 0 {
+		r.PPS = float64(r.Frames) / r.Seconds
+		r.Mbps = float64(r.Bytes) * 8 / r.Seconds / 1e6
+	}
+	return rx.benchSettings(), []BenchResult{r}, nil
+}
+
+// runBench は"bench"サブコマンドを実行し、設定のデータパスの性能を計測する関数
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	path := fs.String("c", "config.yaml", "設定ファイルのパス（先頭のトンネルのデータパスの設定を使う）")
+	duration := fs.Duration("d", benchDefaultDuration, "計測時間")
+	size := fs.Int("size", 0, "内側フレームのバイト数（0でmtu+14）")
+	flows := fs.Int("flows", 64, "送信元を変えるフロー数")
+	parallel := fs.Int("parallel", 1, "送信・処理を並列に行うgoroutine数")
+	compressible := fs.Bool("compressible", false, "ペイロードを圧縮が効く繰り返しにする（既定は乱数）")
+	loopback := fs.Bool("loopback", false, "127.0.0.1 → 127.0.0.2 のRAWソケットで送受信する（root必須）")
+	peer := fs.String("peer", "", "別ホストで bench -listen を動かしている宛先へ送る（root必須）")
+	listen := fs.Bool("listen", false, "bench -peer から届くパケットを受信して計測する（root必須）")
+	asJSON := fs.Bool("json", false, "JSONで出力する")
+	fs.Parse(args)
+	if *asJSON {
+		logOutput = os.Stderr
+	}
+
+	fail := func(format string, a ...interface{}) int {
+		fmt.Fprintf(os.Stderr, "ERROR: "+format+"\n", a...)
+		return 1
+	}
+	cfgs, err := loadConfigs(*path)
+	if err != nil {
+		return fail("%v", err)
+	}
+	cfg := cfgs[0]
+	if *size == 0 {
+		*size = cfg.MTU + 14
+	}
+	if *size < 64 || *size > cfg.MTU+14+8 {
+		return fail("-size %d out of range (64-%d for mtu %d)", *size, cfg.MTU+14+8, cfg.MTU)
+	}
+	if *flows < 1 || *flows > 65535 || *parallel < 1 {
+		return fail("-flows must be 1-65535 and -parallel at least 1")
+	}
+
+	// 動作中のデーモンが同じプロトコルのパケットを受け取り、TAPへ書き込むのを防ぐ
+	mode := "memory"
+	switch {
+	case *listen && *peer != "" || (*listen || *peer != "") && *loopback:
+		return fail("-loopback, -peer and -listen cannot be combined")
+	case *loopback:
+		mode = "loopback"
+	case *peer != "":
+		mode = "peer"
+	case *listen:
+		mode = "listen"
+	}
+	if mode != "memory" && cfg.PIDFile != "" {
+		if pid, held := lockHolder(cfg.PIDFile); held {
+			return fail("etherip is running (pid %s); stop it before a %s benchmark or run without -loopback/-peer/-listen", pid, mode)
+		}
+	}
+
+	frames := benchFrames(*size, *flows, *compressible)
+	var settings string
+	var results []BenchResult
+	switch mode {
+	case "loopback":
+		settings, results, err = benchLoopback(cfg, frames, *parallel, *duration)
+	case "peer":
+		settings, results, err = benchPeer(cfg, *peer, frames, *parallel, *duration)
+	case "listen":
+		settings, results, err = benchListen(cfg)
+	default:
+		settings, results, err = benchMemory(cfg, frames, *parallel, *duration)
+	}
+	if err != nil {
+		return fail("%v", err)
+	}
+
+	if *asJSON {
+		printJSON(BenchOutput{Schema: cliSchemaVersion, Mode: mode, Settings: settings, FrameSize: *size, Flows: *flows, Parallel: *parallel, Results: results})
+		return 0
+	}
+	if mode == "listen" {
+		fmt.Printf("%s benchmark: %s\n", mode, settings)
+	} else {
+		fmt.Printf("%s benchmark: %s, %d-byte frames, %d flows, parallel %d\n", mode, settings, *size, *flows, *parallel)
+	}
+	for _, r := range results {
+		fmt.Printf("  %-12s %10.0f pps %10.1f Mbit/s", r.Phase, r.PPS, r.Mbps)
+		if r.NsPerFrame > 0 {
+			fmt.Printf(" %8.0f ns/frame", r.NsPerFrame)
+		}
+		fmt.Printf(" %6.2f allocs/frame %8.0f B/frame", r.AllocsPerFrame, r.AllocBytes)
+		if r.Dropped > 0 {
+			fmt.Printf("  %d dropped", r.Dropped)
+		}
+		if r.Lost > 0 {
+			fmt.Printf("  %d lost", r.Lost)
+		}
+		fmt.Println()
+	}
+	return 0
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// BGP関連の定数定義
+const (
+	bgpPort            = "179"
+	bgpHeaderLen       = 19
+	bgpMaxMessage      = 4096
+	bgpHoldTime        = 90 // 提案するホールドタイム（秒）
+	bgpASTrans         = 23456
+	bgpMsgOpen         = 1
+	bgpMsgUpdate       = 2
+	bgpMsgNotification = 3
+	bgpMsgKeepalive    = 4
+
+	bgpAttrOrigin      = 1
+	bgpAttrASPath      = 2
+	bgpAttrLocalPref   = 5
+	bgpAttrExtCommunty = 16
+	bgpAttrMPReach     = 14
+	bgpAttrMPUnreach   = 15
+
+	bgpRetryMin = 5 * time.Second
+	bgpRetryMax = time.Minute
+)
+
+// bgpFamilyはMP-BGPのアドレスファミリ（AFI/SAFI）
+type bgpFamily struct {
+	afi  uint16
+	safi byte
+}
+
+// bgpNeighborはBGPネイバーとの接続設定を保持する（EVPN・経路監視で共有）
+type bgpNeighbor struct {
+	addr     string
+	localAS  uint32
+	peerAS   uint32
+	routerID net.IP
+	families []bgpFamily // OPENで広告するアドレスファミリ（ネイバーはいずれかに対応している必要がある）
+}
+
+// newBGPNeighbor はネイバー設定を検証する関数（peerASが0ならiBGP、routerIDが空ならfallbackIDを使う）
+func newBGPNeighbor(neighbor string, localAS, peerAS uint32, routerID string, fallbackID net.IP, families ...bgpFamily) (bgpNeighbor, error) {
+	n := bgpNeighbor{
+		addr:     withDefaultPort(neighbor, bgpPort),
+		localAS:  localAS,
+		peerAS:   peerAS,
+		families: families,
+	}
+	if n.localAS == 0 {
+		return n, errors.New("local_as is required")
+	}
+	if n.peerAS == 0 {
+		n.peerAS = n.localAS
+	}
+	if routerID != "" {
+		if n.routerID = net.ParseIP(routerID).To4(); n.routerID == nil {
+			return n, fmt.Errorf("invalid router_id %q", routerID)
+		}
+	} else if n.routerID = fallbackID.To4(); n.routerID == nil {
+		return n, errors.New("router_id is required without an IPv4 source address")
+	}
+	return n, nil
+}
+
+// bgpMessage はBGPメッセージを組み立てる関数
+func bgpMessage(msgType byte, body []byte) []byte {
+	msg := make([]byte, 16, bgpHeaderLen+len(body))
+	for i := range msg {
+		msg[i] = 0xFF
+	}
+	msg = binary.BigEndian.AppendUint16(msg, uint16(bgpHeaderLen+len(body)))
+	msg = append(msg, msgType)
+	return append(msg, body...)
+}
+
+// readBGPMessage はBGPメッセージを1つ読み取る関数
+func readBGPMessage(r io.Reader) (byte, []byte, error) {
+	var hdr [bgpHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	length := int(binary.BigEndian.Uint16(hdr[16:18]))
+	if length < bgpHeaderLen || length > bgpMaxMessage {
+		return 0, nil, fmt.Errorf("invalid BGP message length %d", length)
+	}
+	body := make([]byte, length-bgpHeaderLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return hdr[18], body, nil
+}
+
+// appendAttr はパス属性を追加する関数（長さに応じて拡張長フラグを付ける）
+func appendAttr(b []byte, flags, code byte, value []byte) []byte {
+	if len(value) > 255 {
+		b = append(b, flags|0x10, code)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	} else {
+		b = append(b, flags, code, byte(len(value)))
+	}
+	return append(b, value...)
+}
+
+// splitUpdate はUPDATEを取り消し経路・パス属性・NLRI（いずれもIPv4ユニキャスト部分）に分ける関数
+func splitUpdate(body []byte) (withdrawn, attrs, nlri []byte, err error) {
+	if len(body) < 4 {
+		return nil, nil, nil, errors.New("short UPDATE")
+	}
+	wlen := int(binary.BigEndian.Uint16(body[0:2]))
+	if len(body) < 4+wlen {
+		return nil, nil, nil, errors.New("short UPDATE")
+	}
+	alen := int(binary.BigEndian.Uint16(body[2+wlen : 4+wlen]))
+	if len(body) < 4+wlen+alen {
+		return nil, nil, nil, errors.New("short UPDATE")
+	}
+	return body[2 : 2+wlen], body[4+wlen : 4+wlen+alen], body[4+wlen+alen:], nil
+}
+
+// walkAttrs はパス属性を順に取り出してfnへ渡す関数
+func walkAttrs(attrs []byte, fn func(code byte, value []byte)) error {
+	for len(attrs) >= 3 {
+		flags, code := attrs[0], attrs[1]
+		hlen, vlen := 3, int(attrs[2])
+		if flags&0x10 != 0 {
+			if len(attrs) < 4 {
+				break
+			}
+			hlen, vlen = 4, int(binary.BigEndian.Uint16(attrs[2:4]))
+		}
+		if len(attrs) < hlen+vlen {
+			return errors.New("truncated path attribute")
+		}
+		fn(code, attrs[hlen:hlen+vlen])
+		attrs = attrs[hlen+vlen:]
+	}
+	return nil
+}
+
+// openMessage はアドレスファミリと4オクテットASの能力を付けたOPENを組み立てる関数
+func (n *bgpNeighbor) openMessage() []byte {
+	myAS := n.localAS
+	if myAS > 0xFFFF {
+		myAS = bgpASTrans
+	}
+	var caps []byte
+	for _, f := range n.families {
+		caps = append(caps, 1, 4) // Multiprotocol Extensions
+		caps = binary.BigEndian.AppendUint16(caps, f.afi)
+		caps = append(caps, 0, f.safi)
+	}
+	caps = append(caps, 65, 4) // 4-octet AS
+	caps = binary.BigEndian.AppendUint32(caps, n.localAS)
+
+	body := []byte{4}
+	body = binary.BigEndian.AppendUint16(body, uint16(myAS))
+	body = binary.BigEndian.AppendUint16(body, bgpHoldTime)
+	body = append(body, n.routerID...)
+	body = append(body, byte(2+len(caps)), 2, byte(len(caps)))
+	return bgpMessage(bgpMsgOpen, append(body, caps...))
+}
+
+// parseOpen はネイバーのOPENを検証し、ホールドタイムを返す関数
+func (n *bgpNeighbor) parseOpen(body []byte) (time.Duration, error) {
+	if len(body) < 10 || body[0] != 4 {
+		return 0, errors.New("unsupported BGP version")
+	}
+	hold := min(binary.BigEndian.Uint16(body[3:5]), bgpHoldTime)
+	as4, family := false, false
+	params := body[10:]
+	if int(body[9]) < len(params) {
+		params = params[:body[9]]
+	}
+	for len(params) >= 2 {
+		ptype, plen := params[0], int(params[1])
+		if len(params) < 2+plen {
+			break
+		}
+		if ptype == 2 {
+			caps := params[2 : 2+plen]
+			for len(caps) >= 2 {
+				code, clen := caps[0], int(caps[1])
+				if len(caps) < 2+clen {
+					break
+				}
+				v := caps[2 : 2+clen]
+				switch {
+				case code == 65 && clen == 4:
+					as4 = true
+					if as := binary.BigEndian.Uint32(v); as != n.peerAS {
+						return 0, fmt.Errorf("peer AS %d does not match peer_as %d", as, n.peerAS)
+					}
+				case code == 1 && clen == 4:
+					for _, f := range n.families {
+						if binary.BigEndian.Uint16(v[0:2]) == f.afi && v[3] == f.safi {
+							family = true
+						}
+					}
+				}
+				caps = caps[2+clen:]
+			}
+		}
+		params = params[2+plen:]
+	}
+	if !as4 {
+		return 0, errors.New("neighbor does not support 4-octet AS numbers")
+	}
+	if !family {
+		return 0, errors.New("neighbor does not support the required address family")
+	}
+	return time.Duration(hold) * time.Second, nil
+}
+
+// dial はネイバーへ接続してOPENを交換し、確立したセッションとホールドタイムを返す関数
+func (n *bgpNeighbor) dial() (net.Conn, *bufio.Reader, time.Duration, error) {
+	conn, err := net.DialTimeout("tcp", n.addr, 10*time.Second)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	r := bufio.NewReader(conn)
+	fail := func(err error) (net.Conn, *bufio.Reader, time.Duration, error) {
+		conn.Close()
+		return nil, nil, 0, err
+	}
+
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if _, err := conn.Write(n.openMessage()); err != nil {
+		return fail(err)
+	}
+	msgType, body, err := readBGPMessage(r)
+	if err != nil {
+		return fail(err)
+	}
+	if msgType == bgpMsgNotification && len(body) >= 2 {
+		return fail(fmt.Errorf("NOTIFICATION code %d/%d", body[0], body[1]))
+	}
+	if msgType != bgpMsgOpen {
+		return fail(fmt.Errorf("unexpected message type %d", msgType))
+	}
+	hold, err := n.parseOpen(body)
+	if err != nil {
+		conn.Write(bgpMessage(bgpMsgNotification, []byte{2, 0})) // OPEN Message Error
+		return fail(err)
+	}
+	if _, err := conn.Write(bgpMessage(bgpMsgKeepalive, nil)); err != nil {
+		return fail(err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, r, hold, nil
+}
+
+// bgpKeepalive はdoneが閉じられるまでホールドタイムの1/3ごとにKEEPALIVEを送る関数
+func bgpKeepalive(hold time.Duration, done <-chan struct{}, send func([]byte) error) {
+	if hold == 0 {
+		return
+	}
+	ticker := time.NewTicker(hold / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			send(bgpMessage(bgpMsgKeepalive, nil))
+		}
+	}
+}
+
+// bgpReadLoop はセッションが切れるまでメッセージを読み、UPDATEをonUpdateへ渡す関数
+func bgpReadLoop(conn net.Conn, r *bufio.Reader, hold time.Duration, onUpdate func(body []byte) error) error {
+	for {
+		if hold > 0 {
+			conn.SetReadDeadline(time.Now().Add(hold))
+		}
+		msgType, body, err := readBGPMessage(r)
+		if err != nil {
+			return err
+		}
+		switch msgType {
+		case bgpMsgUpdate:
+			if err := onUpdate(body); err != nil {
+				conn.Write(bgpMessage(bgpMsgNotification, []byte{3, 0})) // UPDATE Message Error
+				return err
+			}
+		case bgpMsgNotification:
+			if len(body) >= 2 {
+				return fmt.Errorf("NOTIFICATION code %d/%d", body[0], body[1])
+			}
+			return errors.New("NOTIFICATION")
+		}
+	}
+}
+
+// run はsessionを繰り返し呼び、切断時は間隔を延ばしながら再接続する関数
+func (n *bgpNeighbor) run(name string, session func() error) {
+	backoff := bgpRetryMin
+	for {
+		start := time.Now()
+		err := session()
+		logf("[WARN]", "%s session with %s down: %v", name, n.addr, err)
+		if time.Since(start) > bgpRetryMax {
+			backoff = bgpRetryMin
+		}
+		time.Sleep(backoff)
+		backoff = min(backoff*2, bgpRetryMax)
+	}
+}
@@ -0,0 +1,268 @@
+// SPDX-License-Identifier: (GPL-2.0 OR MIT)
+//
+// EtherIP（RFC 3378）のカプセル化・カプセル化解除をtc（clsact）で行うeBPFプログラム
+//
+// tc/encap: TAPのegress（ブリッジ → TAP）に付け、内側フレームに外側Ethernet・IP・EtherIPヘッダを付けて物理インターフェースへ送る
+// tc/decap: src_ifaceのingressに付け、ピアからのEtherIPパケットのヘッダを外してTAPのingress（TAP → ブリッジ）へ渡す
+//
+// 宛先・送信元・インターフェースはデーモンがピン留めしたマップへ書き込む（制御プレーンはデーモン）。
+// 処理できないパケット（経路・近隣が未解決、MTU超過、OAM、IPオプション・拡張ヘッダ付き）はそのまま通し、デーモンが扱う。
+//
+// ビルド: clang -O2 -g -target bpf -c etherip_tc.c -o etherip_tc.o
+
+#include <linux/bpf.h>
+#include <linux/if_ether.h>
+#include <linux/in.h>
+#include <linux/ip.h>
+#include <linux/ipv6.h>
+#include <linux/pkt_cls.h>
+#include <bpf/bpf_endian.h>
+#include <bpf/bpf_helpers.h>
+
+#define ETHERIP_PROTO   97
+#define ETHERIP_HDR_LEN 2
+#define OAM_ETHERTYPE   0x88B5
+#define DEFAULT_TTL     64
+#define AF_INET         2
+#define AF_INET6        10
+
+// 送信設定（キー: TAPのifindex）
+struct tx_cfg {
+	__u32 oif;    // src_ifaceのifindex（経路検索の出力インターフェース）
+	__u8 family;  // 4 or 6
+	__u8 ttl;     // 0で64
+	__u8 tos;     // 外側ヘッダのDSCP（ToS・Traffic Class）
+	__u8 pad;
+	__u8 saddr[16]; // IPv4は先頭4バイト
+	__u8 daddr[16];
+};
+
+// 受信の照合キー（ピアのアドレスと自身のアドレス）
+struct rx_key {
+	__u8 family;
+	__u8 pad[3];
+	__u8 saddr[16];
+	__u8 daddr[16];
+};
+
+// 受信設定
+struct rx_cfg {
+	__u32 tap; // 渡し先のTAPのifindex
+};
+
+// TAPごとの統計（キー: TAPのifindex）
+struct stats {
+	__u64 tx_packets;
+	__u64 tx_bytes;
+	__u64 tx_fallback; // デーモンへ任せた送信フレーム数
+	__u64 rx_packets;
+	__u64 rx_bytes;
+	__u64 rx_passed; // OAM等でデーモンへ渡した受信パケット数
+};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 256);
+	__type(key, __u32);
+	__type(value, struct tx_cfg);
+	__uint(pinning, LIBBPF_PIN_BY_NAME);
+} etherip_tx SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 256);
+	__type(key, struct rx_key);
+	__type(value, struct rx_cfg);
+	__uint(pinning, LIBBPF_PIN_BY_NAME);
+} etherip_rx SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 256);
+	__type(key, __u32);
+	__type(value, struct stats);
+	__uint(pinning, LIBBPF_PIN_BY_NAME);
+} etherip_stats SEC(".maps");
+
+static __always_inline struct stats *stats_of(__u32 tap)
+{
+	struct stats *st = bpf_map_lookup_elem(&etherip_stats, &tap);
+	if (st)
+		return st;
+	struct stats zero = {};
+	bpf_map_update_elem(&etherip_stats, &tap, &zero, BPF_NOEXIST);
+	return bpf_map_lookup_elem(&etherip_stats, &tap);
+}
+
+static __always_inline __u16 ipv4_csum(struct iphdr *ip)
+{
+	__u16 *p = (__u16 *)ip;
+	__u32 sum = 0;
+#pragma unroll
+	for (int i = 0; i < (int)sizeof(*ip) / 2; i++)
+		sum += p[i];
+	sum = (sum & 0xFFFF) + (sum >> 16);
+	sum = (sum & 0xFFFF) + (sum >> 16);
+	return ~sum;
+}
+
+SEC("tc/encap")
+int etherip_encap(struct __sk_buff *skb)
+{
+	__u32 tap = skb->ifindex;
+	struct tx_cfg *cfg = bpf_map_lookup_elem(&etherip_tx, &tap);
+	if (!cfg)
+		return TC_ACT_OK;
+	struct stats *st = stats_of(tap);
+	__u32 inner = skb->len;
+	__u32 iphl = cfg->family == 4 ? sizeof(struct iphdr) : sizeof(struct ipv6hdr);
+
+	// 次ホップのMACと出力インターフェース、MTUを確かめる（未解決・超過はデーモンの送信に任せる）
+	struct bpf_fib_lookup fib = {};
+	fib.ifindex = cfg->oif;
+	fib.tot_len = inner + iphl + ETHERIP_HDR_LEN;
+	if (cfg->family == 4) {
+		fib.family = AF_INET;
+		__builtin_memcpy(&fib.ipv4_src, cfg->saddr, 4);
+		__builtin_memcpy(&fib.ipv4_dst, cfg->daddr, 4);
+	} else {
+		fib.family = AF_INET6;
+		__builtin_memcpy(fib.ipv6_src, cfg->saddr, 16);
+		__builtin_memcpy(fib.ipv6_dst, cfg->daddr, 16);
+	}
+	if (bpf_fib_lookup(skb, &fib, sizeof(fib), BPF_FIB_LOOKUP_OUTPUT) != BPF_FIB_LKUP_RET_SUCCESS)
+		goto fallback;
+
+	__u8 ttl = cfg->ttl ? cfg->ttl : DEFAULT_TTL;
+	if (cfg->family == 4) {
+		struct {
+			struct ethhdr eth;
+			struct iphdr ip;
+			__u8 etherip[ETHERIP_HDR_LEN];
+		} __attribute__((packed)) hdr = {};
+		__builtin_memcpy(hdr.eth.h_dest, fib.dmac, ETH_ALEN);
+		__builtin_memcpy(hdr.eth.h_source, fib.smac, ETH_ALEN);
+		hdr.eth.h_proto = bpf_htons(ETH_P_IP);
+		hdr.ip.version = 4;
+		hdr.ip.ihl = 5;
+		hdr.ip.tos = cfg->tos;
+		hdr.ip.tot_len = bpf_htons(inner + sizeof(hdr.ip) + ETHERIP_HDR_LEN);
+		hdr.ip.frag_off = bpf_htons(0x4000); // DF（MTU超過はデーモンへ任せるため断片化しない）
+		hdr.ip.ttl = ttl;
+		hdr.ip.protocol = ETHERIP_PROTO;
+		__builtin_memcpy(&hdr.ip.saddr, cfg->saddr, 4);
+		__builtin_memcpy(&hdr.ip.daddr, cfg->daddr, 4);
+		hdr.ip.check = ipv4_csum(&hdr.ip);
+		hdr.etherip[0] = 0x30;
+		if (bpf_skb_change_head(skb, sizeof(hdr), 0))
+			goto fallback;
+		if (bpf_skb_store_bytes(skb, 0, &hdr, sizeof(hdr), 0))
+			return TC_ACT_SHOT;
+	} else {
+		struct {
+			struct ethhdr eth;
+			struct ipv6hdr ip;
+			__u8 etherip[ETHERIP_HDR_LEN];
+		} __attribute__((packed)) hdr = {};
+		__builtin_memcpy(hdr.eth.h_dest, fib.dmac, ETH_ALEN);
+		__builtin_memcpy(hdr.eth.h_source, fib.smac, ETH_ALEN);
+		hdr.eth.h_proto = bpf_htons(ETH_P_IPV6);
+		hdr.ip.version = 6;
+		hdr.ip.priority = cfg->tos >> 4;
+		hdr.ip.flow_lbl[0] = (cfg->tos & 0x0F) << 4;
+		hdr.ip.payload_len = bpf_htons(inner + ETHERIP_HDR_LEN);
+		hdr.ip.nexthdr = ETHERIP_PROTO;
+		hdr.ip.hop_limit = ttl;
+		__builtin_memcpy(&hdr.ip.saddr, cfg->saddr, 16);
+		__builtin_memcpy(&hdr.ip.daddr, cfg->daddr, 16);
+		hdr.etherip[0] = 0x30;
+		if (bpf_skb_change_head(skb, sizeof(hdr), 0))
+			goto fallback;
+		if (bpf_skb_store_bytes(skb, 0, &hdr, sizeof(hdr), 0))
+			return TC_ACT_SHOT;
+	}
+
+	if (st) {
+		__sync_fetch_and_add(&st->tx_packets, 1);
+		__sync_fetch_and_add(&st->tx_bytes, inner);
+	}
+	return bpf_redirect(fib.ifindex, 0);
+
+fallback:
+	if (st)
+		__sync_fetch_and_add(&st->tx_fallback, 1);
+	return TC_ACT_OK;
+}
+
+SEC("tc/decap")
+int etherip_decap(struct __sk_buff *skb)
+{
+	void *data = (void *)(long)skb->data;
+	void *end = (void *)(long)skb->data_end;
+	struct ethhdr *eth = data;
+	if ((void *)(eth + 1) > end)
+		return TC_ACT_OK;
+
+	struct rx_key key = {};
+	__u32 iphl;
+	if (eth->h_proto == bpf_htons(ETH_P_IP)) {
+		struct iphdr *ip = (void *)(eth + 1);
+		if ((void *)(ip + 1) > end)
+			return TC_ACT_OK;
+		// IPオプション付き・フラグメントはカーネルとデーモンに任せる
+		if (ip->protocol != ETHERIP_PROTO || ip->ihl != 5 || (ip->frag_off & bpf_htons(0x3FFF)))
+			return TC_ACT_OK;
+		key.family = 4;
+		__builtin_memcpy(key.saddr, &ip->saddr, 4);
+		__builtin_memcpy(key.daddr, &ip->daddr, 4);
+		iphl = sizeof(*ip);
+	} else if (eth->h_proto == bpf_htons(ETH_P_IPV6)) {
+		struct ipv6hdr *ip = (void *)(eth + 1);
+		if ((void *)(ip + 1) > end)
+			return TC_ACT_OK;
+		// 拡張ヘッダ付きはカーネルとデーモンに任せる
+		if (ip->nexthdr != ETHERIP_PROTO)
+			return TC_ACT_OK;
+		key.family = 6;
+		__builtin_memcpy(key.saddr, &ip->saddr, 16);
+		__builtin_memcpy(key.daddr, &ip->daddr, 16);
+		iphl = sizeof(*ip);
+	} else {
+		return TC_ACT_OK;
+	}
+
+	struct rx_cfg *cfg = bpf_map_lookup_elem(&etherip_rx, &key);
+	if (!cfg)
+		return TC_ACT_OK;
+	__u32 tap = cfg->tap;
+	struct stats *st = stats_of(tap);
+
+	// EtherIPヘッダ（バージョン3、予約0）と内側Ethernetヘッダ
+	__u8 eip[ETHERIP_HDR_LEN];
+	struct ethhdr inner;
+	if (bpf_skb_load_bytes(skb, ETH_HLEN + iphl, eip, sizeof(eip)) ||
+	    bpf_skb_load_bytes(skb, ETH_HLEN + iphl + ETHERIP_HDR_LEN, &inner, sizeof(inner)))
+		return TC_ACT_OK;
+	// 圧縮・認証等の拡張ヘッダ付きとOAMはデーモンが扱う
+	if (eip[0] != 0x30 || eip[1] != 0 || inner.h_proto == bpf_htons(OAM_ETHERTYPE)) {
+		if (st)
+			__sync_fetch_and_add(&st->rx_passed, 1);
+		return TC_ACT_OK;
+	}
+
+	// 外側IP・EtherIP・内側Ethernetヘッダを外し、外側Ethernetヘッダの位置へ内側Ethernetヘッダを書き戻す
+	__u32 strip = iphl + ETHERIP_HDR_LEN + ETH_HLEN;
+	__u32 len = skb->len - strip;
+	if (bpf_skb_adjust_room(skb, -(__s32)strip, BPF_ADJ_ROOM_MAC, 0))
+		return TC_ACT_OK;
+	if (bpf_skb_store_bytes(skb, 0, &inner, sizeof(inner), 0))
+		return TC_ACT_SHOT;
+
+	if (st) {
+		__sync_fetch_and_add(&st->rx_packets, 1);
+		__sync_fetch_and_add(&st->rx_bytes, len);
+	}
+	return bpf_redirect(tap, BPF_F_INGRESS);
+}
+
+char _license[] SEC("license") = "Dual MIT/GPL";
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// ブリッジ自動作成関連の定数定義
+const (
+	bridgeMinForwardDelay = 2 * time.Second  // STP有効時のforward_delayの下限（カーネルの制約）
+	bridgeMaxForwardDelay = 30 * time.Second // STP有効時のforward_delayの上限
+)
+
+// BridgeConfigはbr_nameのブリッジが存在しない場合の作成と終了時の後片付けの設定を保持する
+type BridgeConfig struct {
+	Create       bool   `yaml:"create"`        // 存在しなければ作成する（falseなら起動失敗）
+	STP          bool   `yaml:"stp"`           // 作成時にSTPを有効にする
+	ForwardDelay string `yaml:"forward_delay"` // 作成時のforward_delay（省略時はカーネルの既定値）
+	OnExit       string `yaml:"on_exit"`       // 終了時の処理（keep, detach, delete）
+}
+
+// bridgeSetupは検証済みのブリッジ設定
+type bridgeSetup struct {
+	create       bool
+	stp          bool
+	forwardDelay time.Duration // 0ならカーネルの既定値
+	onExit       string
+}
+
+// parseBridgeConfig はブリッジ設定を検証する関数
+func parseBridgeConfig(cfg BridgeConfig) (bridgeSetup, error) {
+	b := bridgeSetup{create: cfg.Create, stp: cfg.STP, onExit: cfg.OnExit}
+	switch b.onExit {
+	case "":
+		b.onExit = "keep"
+	case "keep", "detach", "delete":
+	default:
+		return b, fmt.Errorf("unknown on_exit %q (keep, detach, delete)", cfg.OnExit)
+	}
+	if cfg.ForwardDelay != "" {
+		d, err := time.ParseDuration(cfg.ForwardDelay)
+		if err != nil {
+			return b, fmt.Errorf("forward_delay: %w", err)
+		}
+		if d < 0 || (b.stp && (d < bridgeMinForwardDelay || d > bridgeMaxForwardDelay)) {
+			return b, fmt.Errorf("forward_delay %v out of range (%v-%v with stp)", d, bridgeMinForwardDelay, bridgeMaxForwardDelay)
+		}
+		b.forwardDelay = d
+	}
+	return b, nil
+}
+
+// ensureBridge はbr_nameのブリッジを確認し、必要なら作成して終了時の後片付けを登録する関数
+func ensureBridge(cfg *Config) error {
+	b, err := parseBridgeConfig(cfg.Bridge)
+	if err != nil {
+		return err
+	}
+
+	created := false
+	switch {
+	case isBridge(cfg.BrName):
+		// 無停止の再起動では、引き継ぎ元が作成したブリッジの削除を引き継ぐ
+		created = inheritedCreated(cfg.BrName)
+	case ifaceExists(cfg.BrName):
+		return fmt.Errorf("%s exists but is not a bridge", cfg.BrName)
+	case !b.create:
+		return fmt.Errorf("bridge %s does not exist (set bridge.create to create it)", cfg.BrName)
+	default:
+		if err := createBridge(cfg.BrName, b); err != nil {
+			return err
+		}
+		created = true
+		logf("[INFO]", "Bridge %s created (stp=%v)", cfg.BrName, b.stp)
+	}
+
+	switch b.onExit {
+	case "detach":
+		registerShutdown(func() { detachFromBridge(cfg.TapName, cfg.BrName) })
+	case "delete":
+		if !created {
+			logf("[WARN]", "bridge.on_exit is delete but %s already existed; it will be kept", cfg.BrName)
+			registerShutdown(func() { detachFromBridge(cfg.TapName, cfg.BrName) })
+			break
+		}
+		markCreated(cfg.BrName)
+		registerShutdown(func() {
+			if err := deleteBridge(cfg.BrName); err != nil {
+				logf("[WARN]", "Failed to delete bridge %s: %v", cfg.BrName, err)
+				return
+			}
+			logf("[INFO]", "Bridge %s deleted", cfg.BrName)
+		})
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// バッファ関連の定数定義
+const (
+	// bufferHeadroom はMTUに足すバッファの余裕
+	//
+	// Ethernetヘッダ（14）とVLANタグ2段（8）、フィルタによるVLANタグ・ホップタグの挿入（8）、
+	// 受信時の外側IPv4ヘッダ（最大60）、EtherIP・GRE・L2TPv3ヘッダ、auth・sequenceの追加分を収める。
+	bufferHeadroom = 256
+
+	maxBufferOutstanding = 1 << 20 // max_outstanding・preallocの上限
+)
+
+// queue_fullの設定値
+const (
+	queueFullBlock = "block" // キューが空くまで読み取りを待つ（TAP・ソケットのバッファへ背圧をかける）
+	queueFullDrop  = "drop"  // 読み取ったフレームを破棄して数える（読み取りを止めない）
+	queueFullPace  = "pace"  // 送信キューが埋まる前にTAPの読み取りを止め、TAPのインターフェースのドロップとして数えさせる（受信はblock）
+)
+
+// BufferConfigは送受信バッファの大きさ・確保数とキューが満杯のときの動作の設定を保持する
+type BufferConfig struct {
+	Size           int    `yaml:"size"`            // 1バッファのバイト数（0でMTU+256）
+	Prealloc       int    `yaml:"prealloc"`        // 方向ごとに起動時に確保し、GCで解放せず保持するバッファ数
+	MaxOutstanding int    `yaml:"max_outstanding"` // 方向ごとの使用中バッファ数の上限（0で無制限、到達時は返却されるまで読み取りを待つ）
+	QueueFull      string `yaml:"queue_full"`      // 送受信キューが満杯のとき（block, drop, pace、空でblock）
+	PaceThreshold  int    `yaml:"pace_threshold"`  // queue_full: paceで読み取りを止める送信キューの使用率（%、0で75）
+}
+
+// bufferSizingは検証済みのバッファ設定
+type bufferSizing struct {
+	size           int
+	prealloc       int
+	maxOutstanding int
+	dropOnFull     bool
+	paceReads      bool
+	paceThreshold  int
+}
+
+// resolveBuffers はバッファ設定を検証し、未指定の大きさをMTUから決める関数
+func resolveBuffers(cfg BufferConfig, mtu int) (bufferSizing, error) {
+	least := mtu + bufferHeadroom
+	s := bufferSizing{size: cfg.Size, prealloc: cfg.Prealloc, maxOutstanding: cfg.MaxOutstanding}
+	if s.size == 0 {
+		s.size = least
+	}
+	if s.size < least || s.size > bufferSize {
+		return bufferSizing{}, fmt.Errorf("size %d out of range (%d-%d for mtu %d)", s.size, least, bufferSize, mtu)
+	}
+	for name, v := range map[string]int{"prealloc": s.prealloc, "max_outstanding": s.maxOutstanding} {
+		if v < 0 || v > maxBufferOutstanding {
+			return bufferSizing{}, fmt.Errorf("%s %d out of range (0-%d)", name, v, maxBufferOutstanding)
+		}
+	}
+	if s.maxOutstanding > 0 && s.prealloc > s.maxOutstanding {
+		return bufferSizing{}, fmt.Errorf("prealloc %d exceeds max_outstanding %d", s.prealloc, s.maxOutstanding)
+	}
+	switch cfg.QueueFull {
+	case "", queueFullBlock:
+	case queueFullDrop:
+		s.dropOnFull = true
+	case queueFullPace:
+		s.paceReads = true
+	default:
+		return bufferSizing{}, fmt.Errorf("unknown queue_full %q (block, drop or pace)", cfg.QueueFull)
+	}
+	if cfg.PaceThreshold < 0 || cfg.PaceThreshold > 100 {
+		return bufferSizing{}, fmt.Errorf("pace_threshold %d out of range (0-100)", cfg.PaceThreshold)
+	}
+	s.paceThreshold = cfg.PaceThreshold
+	return s, nil
+}
+
+// queueFull はqueue_fullの設定値を返す関数
+func (s bufferSizing) queueFull() string {
+	switch {
+	case s.dropOnFull:
+		return queueFullDrop
+	case s.paceReads:
+		return queueFullPace
+	}
+	return queueFullBlock
+}
+
+// bufferPoolは1方向分の送受信バッファを再利用する
+//
+// preallocの分は専用の保持領域に置いてGCで解放されないようにし、それを超える分はsync.Poolで再利用する。
+type bufferPool struct {
+	dir     Direction
+	size    int
+	reserve chan []byte   // 確保済みで保持するバッファ（preallocの分）
+	sem     chan struct{} // 使用中のバッファ数の上限（無制限ならnil）
+	pool    sync.Pool
+
+	inUse      atomic.Int64
+	allocated  atomic.Uint64 // 新たに確保した数
+	waits      atomic.Uint64 // max_outstandingに達して待った回数
+	queueDrops atomic.Uint64 // queue_full: dropでキューに入れずに破棄した数
+}
+
+// newBufferPool はバッファのプールを生成し、preallocの分を確保する関数
+func newBufferPool(dir Direction, s bufferSizing) *bufferPool {
+	p := &bufferPool{dir: dir, size: s.size, reserve: make(chan []byte, s.prealloc)}
+	if s.maxOutstanding > 0 {
+		p.sem = make(chan struct{}, s.maxOutstanding)
+	}
+	for range s.prealloc {
+		p.reserve <- make([]byte, s.size)
+	}
+	p.allocated.Store(uint64(s.prealloc))
+	return p
+}
+
+// get はバッファを1つ取り出す関数（max_outstandingに達していれば返却されるまで待つ）
+func (p *bufferPool) get() []byte {
+	if p.sem != nil {
+		select {
+		case p.sem <- struct{}{}:
+		default:
+			p.waits.Add(1)
+			p.sem <- struct{}{}
+		}
+	}
+	p.inUse.Add(1)
+	select {
+	case b := <-p.reserve:
+		return b
+	default:
+	}
+	if b, ok := p.pool.Get().([]byte); ok {
+		return b
+	}
+	p.allocated.Add(1)
+	return make([]byte, p.size)
+}
+
+// put はバッファを返却する関数
+func (p *bufferPool) put(b []byte) {
+	p.inUse.Add(-1)
+	if p.sem != nil {
+		<-p.sem
+	}
+	select {
+	case p.reserve <- b:
+	default:
+		p.pool.Put(b)
+	}
+}
+
+// bytes は使用中と保持領域のバッファのバイト数を返す関数（sync.Pool内の未使用分は含まない）
+func (p *bufferPool) bytes() uint64 {
+	return uint64(max(p.inUse.Load(), 0)+int64(len(p.reserve))) * uint64(p.size)
+}
+
+// Counters はバッファの大きさ・使用数・確保数を返す関数
+func (p *bufferPool) Counters() map[string]uint64 {
+	d := p.dir.String()
+	return map[string]uint64{
+		d + "_buffer_size":       uint64(p.size),
+		d + "_buffers_in_use":    uint64(max(p.inUse.Load(), 0)),
+		d + "_buffers_allocated": p.allocated.Load(),
+		d + "_buffer_bytes":      p.bytes(),
+		d + "_buffer_waits":      p.waits.Load(),
+		d + "_queue_full_drops":  p.queueDrops.Load(),
+	}
+}
+
+// enqueue はパケットをキューへ入れる関数（queue_full: dropでキューが満杯なら破棄してバッファを返す）
+func (t *Tunnel) enqueue(ch chan<- Packet, pkt Packet) {
+	if !t.buffers.dropOnFull {
+		ch <- pkt
+		return
+	}
+	select {
+	case ch <- pkt:
+	default:
+		pkt.Pool.queueDrops.Add(1)
+		pkt.Pool.put(pkt.Data)
+	}
+}
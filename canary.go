@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// カナリアフレーム関連の定数定義
+const (
+	canaryDefaultInterval = 30 * time.Second // 送信間隔の既定値
+	canaryDefaultSize     = 512              // 検査用ペイロード長の既定値（バイト）
+	canaryMinSize         = 16
+	canaryHeaderLen       = 12 // シーケンス番号(4) + 送信時刻(8)
+)
+
+// CanaryConfigはカナリアフレームによる転送経路の完全性検査の設定を保持する
+type CanaryConfig struct {
+	Enabled  bool   `yaml:"enabled"`  // カナリアフレームを送信する
+	Interval string `yaml:"interval"` // 送信間隔
+	Size     int    `yaml:"size"`     // 検査用ペイロード長（バイト、MTU-20以下）
+}
+
+// canaryProbeは応答待ちのカナリアフレーム
+type canaryProbe struct {
+	path *Path
+	body []byte
+}
+
+// canaryCheckerは既知のペイロードをピアに折り返させ、カプセル化→ネットワーク→非カプセル化の往復で
+// ビット単位で一致するかを確認する（壊れた中間装置による気付かれない破損の検出）
+type canaryChecker struct {
+	t        *Tunnel
+	interval time.Duration
+	size     int
+
+	mu      sync.Mutex
+	pending map[uint32]canaryProbe // 応答待ちのカナリア（次の送信時に未応答なら損失）
+	seq     uint32
+
+	sent      atomic.Uint64 // 送信したカナリア数
+	ok        atomic.Uint64 // 一致した応答数
+	corrupted atomic.Uint64 // 内容が一致しなかった応答数
+	bitErrors atomic.Uint64 // 不一致だったビット数の累計
+	lost      atomic.Uint64 // 次の送信までに応答のなかった数
+}
+
+// parseCanaryConfig はカナリアの送信間隔とペイロード長を検証する関数
+func parseCanaryConfig(cfg CanaryConfig, mtu int) (time.Duration, int, error) {
+	interval := canaryDefaultInterval
+	if cfg.Interval != "" {
+		d, err := time.ParseDuration(cfg.Interval)
+		if err != nil {
+			return 0, 0, fmt.Errorf("interval: %w", err)
+		}
+		if d <= 0 {
+			return 0, 0, fmt.Errorf("interval must be positive")
+		}
+		interval = d
+	}
+
+	// OAMヘッダ(8) + シーケンス番号・時刻(12) を含めて内側フレームがMTUに収まる長さとする
+	limit := mtu - 8 - canaryHeaderLen
+	size := cfg.Size
+	if size == 0 {
+		size = min(canaryDefaultSize, limit)
+	}
+	if size < canaryMinSize || size > limit {
+		return 0, 0, fmt.Errorf("size %d out of range (%d-%d for mtu %d)", size, canaryMinSize, limit, mtu)
+	}
+	return interval, size, nil
+}
+
+// newCanaryChecker はカナリア検査を生成する関数
+func newCanaryChecker(t *Tunnel, cfg CanaryConfig) (*canaryChecker, error) {
+	interval, size, err := parseCanaryConfig(cfg, t.cfg.MTU)
+	if err != nil {
+		return nil, err
+	}
+	return &canaryChecker{
+		t:        t,
+		interval: interval,
+		size:     size,
+		pending:  make(map[uint32]canaryProbe),
+	}, nil
+}
+
+// canaryPayload はシーケンス番号から検査用の既知パターンを生成する関数
+//
+// 固着ビットやバイトずれも検出できるよう、疑似乱数・全0・全1・0x55/0xAA交互・連番を順に使う。
+func canaryPayload(seq uint32, size int) []byte {
+	b := make([]byte, size)
+	switch seq % 5 {
+	case 0:
+		x := seq | 1
+		for i := range b {
+			x ^= x << 13
+			x ^= x >> 17
+			x ^= x << 5
+			b[i] = byte(x)
+		}
+	case 1: // 全0
+	case 2:
+		for i := range b {
+			b[i] = 0xFF
+		}
+	case 3:
+		for i := range b {
+			b[i] = 0x55 << (i & 1)
+		}
+	case 4:
+		for i := range b {
+			b[i] = byte(i)
+		}
+	}
+	return b
+}
+
+// run は送信間隔ごとに前回の未応答を損失として数え、全ピアの生きている経路へカナリアを送る関数
+func (c *canaryChecker) run() {
+	logf("[INFO]", "Canary integrity check enabled (interval %v, %d bytes)", c.interval, c.size)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		c.mu.Lock()
+		for seq, probe := range c.pending {
+			c.lost.Add(1)
+			logf("[WARN]", "Canary %d to %s (%s) was not echoed", seq, probe.path.Host, probe.path.Dst.Load().(net.IP))
+			delete(c.pending, seq)
+		}
+		c.mu.Unlock()
+
+		for _, peer := range c.t.peers {
+			for _, p := range peer.paths {
+				if p.up.Load() {
+					c.send(p, now)
+				}
+			}
+		}
+	}
+}
+
+// send は1経路へカナリアを送信する関数
+func (c *canaryChecker) send(p *Path, now time.Time) {
+	c.mu.Lock()
+	c.seq++
+	seq := c.seq
+	body := make([]byte, canaryHeaderLen, canaryHeaderLen+c.size)
+	binary.BigEndian.PutUint32(body[0:4], seq)
+	binary.BigEndian.PutUint64(body[4:12], uint64(now.UnixNano()))
+	body = append(body, canaryPayload(seq, c.size)...)
+	c.pending[seq] = canaryProbe{path: p, body: body}
+	c.mu.Unlock()
+
+	packet := c.t.seal(p, buildEtherIPPacket(buildOAMFrame(c.t.mac, oamCanaryRequest, body)))
+	if err := p.write(packet, c.t.qos.oob(p.Version, -1)); err != nil {
+		c.mu.Lock()
+		delete(c.pending, seq)
+		c.mu.Unlock()
+		return
+	}
+	c.sent.Add(1)
+}
+
+// verify は折り返されたカナリアを送信内容とビット単位で比較する関数
+func (c *canaryChecker) verify(peer *Peer, p *Path, body []byte) {
+	if len(body) < 4 {
+		return
+	}
+	seq := binary.BigEndian.Uint32(body[0:4])
+	c.mu.Lock()
+	probe, ok := c.pending[seq]
+	if ok {
+		delete(c.pending, seq)
+	}
+	c.mu.Unlock()
+	// シーケンス番号が壊れた応答・遅れた応答は照合できないため、損失として数える
+	if !ok {
+		return
+	}
+	if bytes.Equal(body, probe.body) {
+		c.ok.Add(1)
+		return
+	}
+
+	n := min(len(body), len(probe.body))
+	first, diff := -1, 0
+	for i := 0; i < n; i++ {
+		if d := bits.OnesCount8(body[i] ^ probe.body[i]); d > 0 {
+			if first < 0 {
+				first = i
+			}
+			diff += d
+		}
+	}
+	c.corrupted.Add(1)
+	c.bitErrors.Add(uint64(diff))
+	var detail string
+	switch {
+	case len(body) != len(probe.body) && diff == 0:
+		detail = fmt.Sprintf("length %d, expected %d", len(body), len(probe.body))
+	case len(body) != len(probe.body):
+		detail = fmt.Sprintf("length %d, expected %d; %d bits differ, first at offset %d", len(body), len(probe.body), diff, first)
+	default:
+		detail = fmt.Sprintf("%d bits differ, first at offset %d", diff, first)
+	}
+	if p != probe.path {
+		detail += fmt.Sprintf(" (echoed from %s)", p.Dst.Load().(net.IP))
+	}
+	logf("[ERROR]", "Canary %d via %s (%s) came back corrupted: %s", seq, probe.path.Host, probe.path.Dst.Load().(net.IP), detail)
+	c.t.events.emit("corruption", peer.Host, detail)
+}
+
+// Counters はカナリアの送信数・一致数・破損数・損失数を返す
+func (c *canaryChecker) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"canary_sent":       c.sent.Load(),
+		"canary_ok":         c.ok.Load(),
+		"canary_corrupted":  c.corrupted.Load(),
+		"canary_bit_errors": c.bitErrors.Load(),
+		"canary_lost":       c.lost.Load(),
+	}
+}
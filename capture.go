@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// パケットキャプチャ関連の定数定義
+const (
+	captureDefaultCount = 10000                  // 記録するフレーム数の既定値
+	captureFIFORetry    = 200 * time.Millisecond // 名前付きパイプの読み手を待つ間隔
+	pcapMagicNano       = 0xA1B23C4D             // ナノ秒精度のpcap
+	pcapSnapLen         = 65535
+	pcapLinkEthernet    = 1   // 内側のEthernetフレーム
+	pcapLinkRaw         = 101 // 外側のIPパケット（IPv4/IPv6）
+)
+
+// CaptureConfigは制御APIから開始するパケットキャプチャの設定を保持する
+type CaptureConfig struct {
+	Dir string `yaml:"dir"` // pcap・名前付きパイプの置き場所（このディレクトリ直下のみ書き込み可、空で無効）
+}
+
+// CaptureStatusは/captureで返すキャプチャの状態
+type CaptureStatus struct {
+	File      string `json:"file"`
+	Filter    string `json:"filter,omitempty"`
+	Outer     bool   `json:"outer"`     // 外側のIPパケット（EtherIPヘッダ付き）を記録
+	Direction string `json:"direction"` // tx, rx, both
+	Limit     uint64 `json:"limit"`
+	Captured  uint64 `json:"captured"`
+	Waiting   bool   `json:"waiting_for_reader,omitempty"` // 名前付きパイプの読み手待ち
+	Started   int64  `json:"started"`
+	Active    bool   `json:"active"`
+}
+
+// captureSessionは実行中のキャプチャ1件分の状態
+type captureSession struct {
+	status CaptureStatus
+	tx, rx bool
+	live   bool // 名前付きパイプへの出力（1件ごとにフラッシュ）
+	match  captureFilter
+
+	mu     sync.Mutex
+	file   *os.File
+	w      *bufio.Writer // nilなら読み手待ち
+	closed bool
+
+	captured atomic.Uint64
+}
+
+// capturerはトンネルのフレームをpcap形式で記録する（フィルタチェーンの末尾で内側フレームを観測）
+type capturer struct {
+	dir     string
+	session atomic.Pointer[captureSession]
+	total   atomic.Uint64 // 全キャプチャで記録したフレーム数
+}
+
+// newCapturer はキャプチャ機能を生成する関数（dirが空ならnilを返す）
+func newCapturer(cfg CaptureConfig) *capturer {
+	if cfg.Dir == "" {
+		return nil
+	}
+	return &capturer{dir: cfg.Dir}
+}
+
+// capturePath はファイル名を検証して出力先のパスを返す関数（dir直下の通常ファイルか名前付きパイプのみ）
+func (c *capturer) capturePath(name string) (string, bool, error) {
+	if name == "" || filepath.Base(name) != name || strings.HasPrefix(name, ".") {
+		return "", false, fmt.Errorf("file must be a plain file name in %s", c.dir)
+	}
+	path := filepath.Join(c.dir, name)
+	fi, err := os.Lstat(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return path, false, nil
+	case err != nil:
+		return "", false, err
+	case fi.Mode()&os.ModeNamedPipe != 0:
+		return path, true, nil
+	case !fi.Mode().IsRegular():
+		return "", false, fmt.Errorf("%s is not a regular file or named pipe", path)
+	}
+	return path, false, nil
+}
+
+// start はクエリ（file, filter, count, outer, direction）で指定されたキャプチャを開始する関数
+func (c *capturer) start(q url.Values) (*captureSession, error) {
+	path, fifo, err := c.capturePath(q.Get("file"))
+	if err != nil {
+		return nil, err
+	}
+	s := &captureSession{status: CaptureStatus{
+		File:      path,
+		Filter:    q.Get("filter"),
+		Direction: q.Get("direction"),
+		Limit:     captureDefaultCount,
+		Started:   time.Now().Unix(),
+		Active:    true,
+	}}
+	if s.match, err = compileCaptureFilter(s.status.Filter); err != nil {
+		return nil, fmt.Errorf("filter: %w", err)
+	}
+	var ok bool
+	if s.tx, s.rx, ok = parseDirections(s.status.Direction); !ok {
+		return nil, fmt.Errorf("direction: invalid %q", s.status.Direction)
+	}
+	if s.status.Direction == "" {
+		s.status.Direction = "both"
+	}
+	if v := q.Get("count"); v != "" {
+		if s.status.Limit, err = strconv.ParseUint(v, 10, 64); err != nil || s.status.Limit == 0 {
+			return nil, fmt.Errorf("count: invalid %q", v)
+		}
+	}
+	if v := q.Get("outer"); v != "" {
+		if s.status.Outer, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("outer: invalid %q", v)
+		}
+	}
+
+	s.live, s.status.Waiting = fifo, fifo
+	if !c.session.CompareAndSwap(nil, s) {
+		return nil, errors.New("a capture is already running")
+	}
+	if fifo {
+		go c.openFIFO(s, path)
+	} else {
+		f, err := openCaptureFile(path)
+		if err != nil {
+			c.session.Store(nil)
+			return nil, err
+		}
+		s.open(f)
+	}
+	logf("[INFO]", "Capture started: %s (filter %q, direction %s, outer %v, limit %d)", path, s.status.Filter, s.status.Direction, s.status.Outer, s.status.Limit)
+	return s, nil
+}
+
+// openCaptureFile は出力先の通常ファイルを作成し、既にあれば空にして開く関数
+//
+// 確認から開くまでの間にシンボリックリンク等へ置き換えられても辿らないよう、新規はO_EXCL、既存はO_NOFOLLOWで開き、
+// 開いたものが通常ファイルかを確かめてから空にする。
+func openCaptureFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|oNoFollow, 0600)
+	if !errors.Is(err, os.ErrExist) {
+		return f, err
+	}
+	if f, err = os.OpenFile(path, os.O_WRONLY|oNoFollow|syscall.O_NONBLOCK, 0); err != nil {
+		return nil, err
+	}
+	if fi, err := f.Stat(); err != nil || !fi.Mode().IsRegular() {
+		f.Close()
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// openFIFO は名前付きパイプに読み手（Wireshark等）が接続するまで待って書き込みを開始する関数
+func (c *capturer) openFIFO(s *captureSession, path string) {
+	for c.session.Load() == s {
+		f, err := os.OpenFile(path, os.O_WRONLY|oNoFollow|syscall.O_NONBLOCK, 0)
+		if errors.Is(err, syscall.ENXIO) {
+			time.Sleep(captureFIFORetry)
+			continue
+		}
+		if err == nil {
+			// 確認した後に名前付きパイプ以外へ置き換えられていれば書き込まない
+			if fi, statErr := f.Stat(); statErr != nil || fi.Mode()&os.ModeNamedPipe == 0 {
+				f.Close()
+				err = fmt.Errorf("%s is no longer a named pipe", path)
+			}
+		}
+		if err != nil {
+			logf("[WARN]", "Capture %s: %v", path, err)
+			c.stop(s)
+			return
+		}
+		s.open(f)
+		logf("[INFO]", "Capture reader connected to %s", path)
+		return
+	}
+}
+
+// open はpcapのファイルヘッダを書き込んで記録を開始する関数
+func (s *captureSession) open(f *os.File) {
+	link := uint32(pcapLinkEthernet)
+	if s.status.Outer {
+		link = pcapLinkRaw
+	}
+	hdr := pcapFileHeader(link)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		f.Close()
+		return
+	}
+	s.file = f
+	s.w = bufio.NewWriter(f)
+	s.w.Write(hdr)
+	s.status.Waiting = false
+}
+
+// pcapFileHeader はpcap（ナノ秒精度、リトルエンディアン）のファイルヘッダを返す関数
+func pcapFileHeader(link uint32) []byte {
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:4], pcapMagicNano)
+	binary.LittleEndian.PutUint16(hdr[4:6], 2)
+	binary.LittleEndian.PutUint16(hdr[6:8], 4)
+	binary.LittleEndian.PutUint32(hdr[16:20], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:24], link)
+	return hdr
+}
+
+// pcapRecordHeader はlenバイトのデータを記録するレコードヘッダを返す関数（snaplenを超える分は切り詰める）
+func pcapRecordHeader(ts time.Time, length int) [16]byte {
+	var rec [16]byte
+	binary.LittleEndian.PutUint32(rec[0:4], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:8], uint32(ts.Nanosecond()))
+	binary.LittleEndian.PutUint32(rec[8:12], uint32(min(length, pcapSnapLen)))
+	binary.LittleEndian.PutUint32(rec[12:16], uint32(length))
+	return rec
+}
+
+// stop は指定したキャプチャ（nilなら実行中のもの）を終了し、最終状態を返す関数
+func (c *capturer) stop(s *captureSession) *captureSession {
+	if s == nil {
+		s = c.session.Load()
+	}
+	if s == nil || !c.session.CompareAndSwap(s, nil) {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.status.Active = false
+	if s.w != nil {
+		s.w.Flush()
+		s.file.Close()
+	}
+	logf("[INFO]", "Capture stopped: %s (%d frames)", s.status.File, s.captured.Load())
+	return s
+}
+
+// Status はキャプチャの状態を返す
+func (s *captureSession) Status() CaptureStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.status
+	st.Captured = s.captured.Load()
+	return st
+}
+
+// record は方向とフィルタに一致したフレームを1件記録する関数（上限に達したら終了する）
+func (c *capturer) record(s *captureSession, dir Direction, frame, data []byte) {
+	if (dir == DirTX && !s.tx) || (dir == DirRX && !s.rx) {
+		return
+	}
+	if s.match != nil {
+		f, ok := parseFrameFields(frame)
+		if !ok || !s.match(f) {
+			return
+		}
+	}
+
+	rec := pcapRecordHeader(time.Now(), len(data))
+
+	s.mu.Lock()
+	if s.w == nil || s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.w.Write(rec[:])
+	_, err := s.w.Write(data[:min(len(data), pcapSnapLen)])
+	if err == nil && s.live {
+		err = s.w.Flush()
+	}
+	s.mu.Unlock()
+	if err != nil {
+		logf("[WARN]", "Capture %s: %v", s.status.File, err)
+		c.stop(s)
+		return
+	}
+	c.total.Add(1)
+	if s.captured.Add(1) >= s.status.Limit {
+		c.stop(s)
+	}
+}
+
+// Filter は内側のフレームを記録して常に通過させる
+func (c *capturer) Filter(dir Direction, frame []byte) ([]byte, Verdict) {
+	if s := c.session.Load(); s != nil && !s.status.Outer {
+		c.record(s, dir, frame, frame)
+	}
+	return frame, VerdictPass
+}
+
+// outer は外側のパケット（EtherIPヘッダ以降）にIPヘッダを補って記録する関数
+//
+// 圧縮フレームは内側を判定できないため、フィルタ指定時は記録しない。
+func (c *capturer) outer(dir Direction, src, dst net.IP, packet []byte) {
+	if c == nil {
+		return
+	}
+	s := c.session.Load()
+	if s == nil || !s.status.Outer {
+		return
+	}
+	frame, _ := etherIPPayload(packet)
+	c.record(s, dir, frame, outerIPPacket(src, dst, etherIPProto, packet))
+}
+
+// outerIPPacket は記録用にカプセル化したパケットへ外側のIPヘッダ（protoはIPプロトコル番号）を付ける関数
+func outerIPPacket(src, dst net.IP, proto int, payload []byte) []byte {
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		b := make([]byte, 20, 20+len(payload))
+		b[0] = 0x45
+		binary.BigEndian.PutUint16(b[2:4], uint16(20+len(payload)))
+		b[8] = 64
+		b[9] = byte(proto)
+		copy(b[12:16], src4)
+		copy(b[16:20], dst4)
+		binary.BigEndian.PutUint16(b[10:12], ipv4Checksum(b))
+		return append(b, payload...)
+	}
+	b := make([]byte, 40, 40+len(payload))
+	b[0] = 0x60
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(payload)))
+	b[6] = byte(proto)
+	b[7] = 64
+	copy(b[8:24], src.To16())
+	copy(b[24:40], dst.To16())
+	return append(b, payload...)
+}
+
+// Counters はキャプチャで記録したフレーム数を返す
+func (c *capturer) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"capture_frames": c.total.Load(),
+	}
+}
@@ -0,0 +1,6 @@
+//go:build !unix
+
+package main
+
+// oNoFollow はO_NOFOLLOWのないプラットフォームでは0（種類は開いた後にStatで確かめる）
+const oNoFollow = 0
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenCaptureFile(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, path string)
+		ok    bool
+	}{
+		{"new file", func(t *testing.T, path string) {}, true},
+		{"existing file is truncated", func(t *testing.T, path string) {
+			if err := os.WriteFile(path, []byte("old capture"), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"symlink", func(t *testing.T, path string) {
+			target := filepath.Join(filepath.Dir(path), "target")
+			if err := os.WriteFile(target, []byte("keep"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink(target, path); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"dangling symlink", func(t *testing.T, path string) {
+			if err := os.Symlink(filepath.Join(filepath.Dir(path), "missing"), path); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"directory", func(t *testing.T, path string) {
+			if err := os.Mkdir(path, 0700); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "out.pcap")
+			tt.setup(t, path)
+			f, err := openCaptureFile(path)
+			if (err == nil) != tt.ok {
+				t.Fatalf("openCaptureFile() error = %v, want ok %v", err, tt.ok)
+			}
+			if err == nil {
+				fi, _ := f.Stat()
+				f.Close()
+				if fi.Size() != 0 {
+					t.Errorf("size = %d, want 0", fi.Size())
+				}
+			}
+			// シンボリックリンクの先は変更しない
+			if b, err := os.ReadFile(filepath.Join(dir, "target")); err == nil && string(b) != "keep" {
+				t.Errorf("symlink target changed to %q", b)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "missing")); err == nil {
+				t.Error("dangling symlink target was created")
+			}
+		})
+	}
+}
@@ -0,0 +1,8 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// oNoFollow は末尾がシンボリックリンクなら開かないopenのフラグ
+const oNoFollow = syscall.O_NOFOLLOW
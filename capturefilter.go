@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// frameFieldsはキャプチャフィルタの判定に使うフレームの各フィールド
+type frameFields struct {
+	src, dst         net.HardwareAddr
+	vlans            []uint16
+	etherType        uint16     // VLANタグを読み飛ばしたEtherType
+	srcIP, dstIP     netip.Addr // IPv4/IPv6以外は無効値
+	proto            byte       // IPプロトコル番号（IPv6は最初の次ヘッダ）
+	srcPort, dstPort uint16
+	hasPorts         bool // TCP/UDPで先頭フラグメント
+}
+
+// captureFilterはフレームを記録するかどうかの判定関数
+type captureFilter func(f *frameFields) bool
+
+// parseFrameFields はフレームからフィルタ判定用のフィールドを取り出す関数
+func parseFrameFields(frame []byte) (*frameFields, bool) {
+	if len(frame) < 14 {
+		return nil, false
+	}
+	f := &frameFields{dst: frame[0:6], src: frame[6:12]}
+	off := 12
+	f.etherType = binary.BigEndian.Uint16(frame[off:])
+	for (f.etherType == tpid8021Q || f.etherType == tpid8021AD) && len(frame) >= off+vlanTagLen+2 {
+		f.vlans = append(f.vlans, binary.BigEndian.Uint16(frame[off+2:])&0x0FFF)
+		off += vlanTagLen
+		f.etherType = binary.BigEndian.Uint16(frame[off:])
+	}
+	ip := frame[off+2:]
+
+	var l4 []byte
+	switch {
+	case f.etherType == 0x0800 && len(ip) >= 20:
+		ihl := int(ip[0]&0x0F) * 4
+		f.srcIP = netip.AddrFrom4([4]byte(ip[12:16]))
+		f.dstIP = netip.AddrFrom4([4]byte(ip[16:20]))
+		f.proto = ip[9]
+		if binary.BigEndian.Uint16(ip[6:8])&0x1FFF == 0 && ihl >= 20 && len(ip) >= ihl {
+			l4 = ip[ihl:]
+		}
+	case f.etherType == 0x86DD && len(ip) >= 40:
+		f.srcIP = netip.AddrFrom16([16]byte(ip[8:24]))
+		f.dstIP = netip.AddrFrom16([16]byte(ip[24:40]))
+		f.proto = ip[6]
+		l4 = ip[40:]
+	}
+	if (f.proto == 6 || f.proto == 17) && len(l4) >= 4 {
+		f.srcPort = binary.BigEndian.Uint16(l4[0:2])
+		f.dstPort = binary.BigEndian.Uint16(l4[2:4])
+		f.hasPorts = true
+	}
+	return f, true
+}
+
+// compileCaptureFilter はtcpdump風のフィルタ式を判定関数に変換する関数（空なら全フレームを記録するnil）
+//
+// 対応する式（and/&&, or/||, not/!, 括弧で組み合わせ）:
+//
+//	ether host|src|dst MAC, ether proto N, vlan [N], arp, ip, ip6,
+//	tcp, udp, icmp, icmp6, proto N, [src|dst] host ADDR, [src|dst] net CIDR, [src|dst] port N
+func compileCaptureFilter(expr string) (captureFilter, error) {
+	p := &filterParser{tokens: tokenizeFilter(expr)}
+	if len(p.tokens) == 0 {
+		return nil, nil
+	}
+	fn, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return fn, nil
+}
+
+// tokenizeFilter はフィルタ式を空白と括弧で字句に分ける関数
+func tokenizeFilter(expr string) []string {
+	expr = strings.NewReplacer("(", " ( ", ")", " ) ", "!", " ! ", "&&", " && ", "||", " || ").Replace(expr)
+	return strings.Fields(expr)
+}
+
+// filterParserはフィルタ式の再帰下降パーサ
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+// next は次の字句を読み進める関数（末尾なら空文字列）
+func (p *filterParser) next() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	p.pos++
+	return p.tokens[p.pos-1]
+}
+
+// peek は次の字句を読み進めずに返す関数
+func (p *filterParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+// parseOr は or で結ばれた式を読む関数
+func (p *filterParser) parseOr() (captureFilter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" || p.peek() == "||" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(f *frameFields) bool { return l(f) || right(f) }
+	}
+	return left, nil
+}
+
+// parseAnd は and で結ばれた式を読む関数
+func (p *filterParser) parseAnd() (captureFilter, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" || p.peek() == "&&" {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(f *frameFields) bool { return l(f) && right(f) }
+	}
+	return left, nil
+}
+
+// parseNot は否定と括弧を読む関数
+func (p *filterParser) parseNot() (captureFilter, error) {
+	switch p.peek() {
+	case "not", "!":
+		p.next()
+		fn, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(f *frameFields) bool { return !fn(f) }, nil
+	case "(":
+		p.next()
+		fn, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return fn, nil
+	}
+	return p.parsePrimitive()
+}
+
+// parsePrimitive は個々の条件を読む関数
+func (p *filterParser) parsePrimitive() (captureFilter, error) {
+	tok := p.next()
+	switch tok {
+	case "":
+		return nil, fmt.Errorf("unexpected end of filter")
+	case "ether":
+		return p.parseEther()
+	case "vlan":
+		if id, err := strconv.ParseUint(p.peek(), 10, 12); err == nil {
+			p.next()
+			return func(f *frameFields) bool { return len(f.vlans) > 0 && f.vlans[0] == uint16(id) }, nil
+		}
+		return func(f *frameFields) bool { return len(f.vlans) > 0 }, nil
+	case "arp":
+		return etherTypeFilter(0x0806), nil
+	case "ip":
+		return etherTypeFilter(0x0800), nil
+	case "ip6":
+		return etherTypeFilter(0x86DD), nil
+	case "tcp":
+		return protoFilter(6), nil
+	case "udp":
+		return protoFilter(17), nil
+	case "icmp":
+		return func(f *frameFields) bool { return f.etherType == 0x0800 && f.proto == 1 }, nil
+	case "icmp6":
+		return func(f *frameFields) bool { return f.etherType == 0x86DD && f.proto == 58 }, nil
+	case "proto":
+		n, err := strconv.ParseUint(p.next(), 0, 8)
+		if err != nil {
+			return nil, fmt.Errorf("proto: invalid protocol number")
+		}
+		return protoFilter(byte(n)), nil
+	}
+
+	src, dst := true, true
+	switch tok {
+	case "src":
+		dst = false
+		tok = p.next()
+	case "dst":
+		src = false
+		tok = p.next()
+	}
+	match := func(f *frameFields, fn func(a netip.Addr, port uint16) bool) bool {
+		return (src && fn(f.srcIP, f.srcPort)) || (dst && fn(f.dstIP, f.dstPort))
+	}
+	switch tok {
+	case "host":
+		addr, err := netip.ParseAddr(p.next())
+		if err != nil {
+			return nil, fmt.Errorf("host: %w", err)
+		}
+		return func(f *frameFields) bool {
+			return match(f, func(a netip.Addr, _ uint16) bool { return a == addr })
+		}, nil
+	case "net":
+		prefix, err := netip.ParsePrefix(p.next())
+		if err != nil {
+			return nil, fmt.Errorf("net: %w", err)
+		}
+		return func(f *frameFields) bool {
+			return match(f, func(a netip.Addr, _ uint16) bool { return a.IsValid() && prefix.Contains(a) })
+		}, nil
+	case "port":
+		port, err := strconv.ParseUint(p.next(), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("port: invalid port number")
+		}
+		return func(f *frameFields) bool {
+			return f.hasPorts && match(f, func(_ netip.Addr, pt uint16) bool { return pt == uint16(port) })
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown primitive %q", tok)
+}
+
+// parseEther は ether で始まる条件を読む関数
+func (p *filterParser) parseEther() (captureFilter, error) {
+	switch kind := p.next(); kind {
+	case "proto":
+		n, err := strconv.ParseUint(p.next(), 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("ether proto: invalid EtherType")
+		}
+		return etherTypeFilter(uint16(n)), nil
+	case "host", "src", "dst":
+		mac, err := net.ParseMAC(p.next())
+		if err != nil {
+			return nil, fmt.Errorf("ether %s: %w", kind, err)
+		}
+		return func(f *frameFields) bool {
+			return (kind != "dst" && bytes.Equal(f.src, mac)) || (kind != "src" && bytes.Equal(f.dst, mac))
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown ether primitive %q", kind)
+	}
+}
+
+// etherTypeFilter はEtherTypeが一致するフレームを選ぶ判定関数を返す
+func etherTypeFilter(et uint16) captureFilter {
+	return func(f *frameFields) bool { return f.etherType == et }
+}
+
+// protoFilter はIPプロトコル番号が一致するパケットを選ぶ判定関数を返す
+func protoFilter(proto byte) captureFilter {
+	return func(f *frameFields) bool { return f.srcIP.IsValid() && f.proto == proto }
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// 言語の設定値
+const (
+	languageEnglish  = "en" // 既定（ソースのメッセージをそのまま出力）
+	languageJapanese = "ja"
+)
+
+// messages はログ・検証結果の書式文字列（英語）を置き換えるカタログ（nilで英語のまま、起動時に1度だけ設定）
+var messages map[string]string
+
+// bundledCatalogs は同梱のカタログ（英語は空）
+var bundledCatalogs = map[string]map[string]string{
+	languageEnglish:  nil,
+	languageJapanese: catalogJA,
+}
+
+// msg はカタログに訳があれば書式文字列を置き換える関数
+func msg(format string) string {
+	if m, ok := messages[format]; ok {
+		return m
+	}
+	return format
+}
+
+// formatVerbs は書式文字列の変換指定（%%を除く）の数を返す関数
+func formatVerbs(format string) int {
+	n := 0
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		if i+1 < len(format) && format[i+1] == '%' {
+			i++
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+// loadCatalog は言語の同梱カタログにcatalogファイル（英語の書式 → 訳）を重ねたカタログを返す関数
+//
+// 訳の変換指定の数が元と異なるものは引数がずれるためエラーにする（順序を変えるには %[2]s のように番号を付ける）。
+func loadCatalog(cfg LogConfig) (map[string]string, error) {
+	lang := cfg.Language
+	if lang == "" {
+		lang = languageEnglish
+	}
+	bundled, ok := bundledCatalogs[lang]
+	if !ok {
+		return nil, fmt.Errorf("unknown language %q (en, ja)", cfg.Language)
+	}
+	if cfg.Catalog == "" {
+		return bundled, nil
+	}
+	data, err := os.ReadFile(cfg.Catalog)
+	if err != nil {
+		return nil, err
+	}
+	var custom map[string]string
+	if err := yaml.Unmarshal(data, &custom); err != nil {
+		return nil, fmt.Errorf("%s: %v", cfg.Catalog, err)
+	}
+	catalog := make(map[string]string, len(bundled)+len(custom))
+	for k, v := range bundled {
+		catalog[k] = v
+	}
+	for k, v := range custom {
+		if formatVerbs(k) != formatVerbs(v) {
+			return nil, fmt.Errorf("%s: %q has %d arguments but the translation has %d", cfg.Catalog, k, formatVerbs(k), formatVerbs(v))
+		}
+		catalog[k] = v
+	}
+	return catalog, nil
+}
+
+// applyCatalog はログ・検証結果に使うカタログを設定する関数（ログ出力が始まる起動時に1度だけ呼ぶ）
+func applyCatalog(cfg LogConfig) error {
+	catalog, err := loadCatalog(cfg)
+	if err != nil {
+		return err
+	}
+	messages = catalog
+	return nil
+}
+
+// catalogJA は同梱の日本語カタログ（起動・終了、インターフェース操作、ピアの状態変化など運用で目にする主なメッセージ）
+var catalogJA = map[string]string{
+	// 起動・終了
+	"EtherIP Tunnel started":                                              "EtherIPトンネルを開始しました",
+	"Received %v, shutting down":                                          "%v を受信したため終了します",
+	"Restarting %s (%s)":                                                  "%s を再起動します（%s）",
+	"Handed over to pid %d; exiting":                                      "pid %d へ引き継いだため終了します",
+	"Handover to %s failed; keeping the running process: %v":              "%s への引き継ぎに失敗したため動作を続けます: %v",
+	"Handover complete; the previous process has exited":                  "引き継ぎが完了しました（引き継ぎ元は終了しました）",
+	"Failed to load config: %v":                                           "設定の読み込みに失敗しました: %v",
+	"Failed to read config file: %v":                                      "設定ファイルを読めません: %v",
+	"Failed to parse config file: %v":                                     "設定ファイルの解析に失敗しました: %v",
+	"Another instance is running: %v":                                     "別のインスタンスが動作中です: %v",
+	"Failed to drop privileges: %v":                                       "権限の切り替えに失敗しました: %v",
+	"Invalid log setting: %v":                                             "logの設定が不正です: %v",
+	"Invalid labels: %v":                                                  "labelsの設定が不正です: %v",
+	"Tunnel %s: %v":                                                       "トンネル %s: %v",
+	"dst_host is not specified":                                           "dst_hostが指定されていません",
+	"TapName not specified, defaulting to tap0":                           "tap_nameが未指定のため tap0 を使用します",
+	"BrName not specified, defaulting to off":                             "br_nameが未指定のため off（ブリッジなし）とします",
+	"MTU not specified, defaulting to 1500":                               "mtuが未指定のため 1500 を使用します",
+	"ResolveInterval not specified, defaulting to 10s":                    "resolve_intervalが未指定のため 10s を使用します",
+	"KeepaliveInterval not specified, defaulting to %s":                   "keepalive_intervalが未指定のため %s を使用します",
+	"Config file %s not found; using environment and flag overrides only": "設定ファイル %s がないため、環境変数とフラグの指定のみを使用します",
+
+	// インターフェース
+	"TAP create: %v": "TAPの作成に失敗しました: %v",
+	"TAP read: %v":   "TAPの読み取りに失敗しました: %v",
+	"TAP interface name '%s' already exists. Choose a different name or remove the existing interface.": "TAPインターフェース名 '%s' は既に存在します。別の名前にするか既存のインターフェースを削除してください。",
+	"Interface %s not found: %v":                  "インターフェース %s が見つかりません: %v",
+	"Interface %s set UP":                         "インターフェース %s をUPにしました",
+	"Interface renamed from %s to %s":             "インターフェース名を %s から %s に変更しました",
+	"Failed to rename interface: %v":              "インターフェース名の変更に失敗しました: %v",
+	"MTU of interface %s set to %d":               "インターフェース %s のMTUを %d に設定しました",
+	"Failed to set MTU on interface %s: %v":       "インターフェース %s のMTUを設定できません: %v",
+	"Failed to set interface %s UP: %v":           "インターフェース %s をUPにできません: %v",
+	"Interface %s added to bridge %s":             "インターフェース %s をブリッジ %s に追加しました",
+	"Failed to add interface %s to bridge %s: %v": "インターフェース %s をブリッジ %s に追加できません: %v",
+	"TAP interface %s joined bridge %s":           "TAPインターフェース %s がブリッジ %s に参加しました",
+	"Interface setup: %v":                         "インターフェースの設定に失敗しました: %v",
+	"No usable address family on %s":              "%s に使用できるアドレスファミリがありません",
+	"IPv%d address found on %s: %s":               "%[2]s のIPv%[1]dアドレス: %[3]s",
+	"IPv%d unavailable on %s, skipping: %v":       "%[2]s でIPv%[1]dを使用できないためスキップします: %[3]v",
+
+	// ソケット・名前解決
+	"IPv%d socket: %v":                           "IPv%dソケット: %v",
+	"IPv%d socket bound to %s":                   "IPv%dソケットを %s にバインドしました",
+	"Failed to bind IPv%d socket to %s: %v":      "IPv%dソケットを %s にバインドできません: %v",
+	"RAW socket (IPv%d): %v":                     "RAWソケット（IPv%d）: %v",
+	"SRC: %s (%s) → DST: %s (%s)":                "送信元: %s (%s) → 宛先: %s (%s)",
+	"Resolved IPv4 %s → %s":                      "IPv4 %s を %s に解決しました",
+	"Resolved IPv6 %s → %s":                      "IPv6 %s を %s に解決しました",
+	"DNS updated: %s → %s":                       "名前解決の結果が変わりました: %s → %s",
+	"DNS lookup failed for host %s: %v":          "ホスト %s の名前解決に失敗しました: %v",
+	"DNS lookup failed for host %s (IPv%d): %v":  "ホスト %s の名前解決（IPv%d）に失敗しました: %v",
+	"DNS resolve failed for %s: %v, retry in %v": "%s の名前解決に失敗しました: %v（%v 後に再試行）",
+
+	// ピア・経路
+	"Multipoint mode with %d peers":                                             "マルチポイント構成（ピア %d）",
+	"Keepalive enabled (interval %v, timeout %v)":                               "キープアライブ有効（間隔 %v、タイムアウト %v）",
+	"Keepalive enabled (interval %v, up to %v while traffic flows, timeout %v)": "キープアライブ有効（間隔 %v、通信中は最大 %v、タイムアウト %v）",
+	"IPv%d path to %s (%s) lost (no keepalive reply for %v)":                    "IPv%d経路 %s (%s) が断になりました（%v の間キープアライブの応答なし）",
+	"IPv%d path to %s (%s) recovered":                                           "IPv%d経路 %s (%s) が復旧しました",
+	"IPv%d path to %s unavailable, skipping: %v":                                "IPv%d経路 %s を使用できないためスキップします: %v",
+	"Failover %s: %s":                      "フェイルオーバー %s: %s",
+	"Peer %s roamed: %s → %s":              "ピア %s の移動: %s → %s",
+	"Capability mismatch with peer %s: %s": "ピア %s と能力が一致しません: %s",
+	"Capability mismatch with peer %s: %s; forwarding to and from the peer stopped": "ピア %s と能力が一致しません: %s（このピアとの転送を停止しました）",
+	"Capabilities of peer %s now match":                                             "ピア %s と能力が一致しました",
+	"standby requires keepalive_interval":                                           "standbyにはkeepalive_intervalが必要です",
+	"dual_stack is enabled but keepalive is off; failover is disabled":              "dual_stackが有効ですがキープアライブが無効のため、フェイルオーバーしません",
+
+	// 自己更新
+	"Checking for updates every %v (%s)": "%v ごとに更新を確認します（%s）",
+	"Update check failed: %v":            "更新の確認に失敗しました: %v",
+	"Update install failed: %v":          "更新の適用に失敗しました: %v",
+	"Installed %s (was %s)":              "%s を適用しました（以前は %s）",
+
+	// 設定の検証（check）
+	"version must be 4 or 6 (got %d)":                      "versionは4または6です（%d が指定されています）",
+	"pid_file: directory %s does not exist":                "pid_file: ディレクトリ %s がありません",
+	"%s is already managed by a running instance (pid %s)": "%s は動作中のインスタンス（pid %s）が管理しています",
+}
@@ -0,0 +1,736 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// checkResultは設定検証の結果を保持する
+type checkResult struct {
+	errors   []string
+	warnings []string
+}
+
+// fail はエラーを記録する
+func (r *checkResult) fail(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(msg(format), args...))
+}
+
+// warn は警告を記録する
+func (r *checkResult) warn(format string, args ...interface{}) {
+	r.warnings = append(r.warnings, fmt.Sprintf(msg(format), args...))
+}
+
+// print は検証結果を標準出力へ書き出し、エラーがなければtrueを返す
+func (r *checkResult) print() bool {
+	for _, w := range r.warnings {
+		fmt.Printf("WARN:  %s\n", w)
+	}
+	for _, e := range r.errors {
+		fmt.Printf("ERROR: %s\n", e)
+	}
+	if len(r.errors) > 0 {
+		fmt.Printf("%d error(s), %d warning(s)\n", len(r.errors), len(r.warnings))
+		return false
+	}
+	fmt.Printf("Configuration OK (%d warning(s))\n", len(r.warnings))
+	return true
+}
+
+// runCheck は"check"サブコマンドを実行し、終了コードを返す関数
+func runCheck(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	path := fs.String("c", "config.yaml", "設定ファイルのパス")
+	asJSON := fs.Bool("json", false, "JSONで出力する")
+	fs.Parse(args)
+	if *asJSON {
+		logOutput = os.Stderr
+	}
+
+	cfgs, err := loadConfigs(*path)
+	if err == nil && !*asJSON {
+		// JSONは機械可読のため英語のまま、不正なら言語は英語のまま、checkConfigがエラーとして報告する
+		applyCatalog(cfgs[0].Log)
+	}
+	if *asJSON {
+		return printCheckJSON(cfgs, err)
+	}
+	if err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+		return 1
+	}
+	code := 0
+	for _, cfg := range cfgs {
+		if len(cfgs) > 1 {
+			fmt.Printf("== %s ==\n", cfg.TapName)
+		}
+		if !checkConfig(cfg).print() {
+			code = 1
+		}
+	}
+	return code
+}
+
+// printCheckJSON は全トンネルの検証結果をJSONで出力し、終了コードを返す関数
+func printCheckJSON(cfgs []*Config, loadErr error) int {
+	out := CheckOutput{Schema: cliSchemaVersion, OK: loadErr == nil, Tunnels: []CheckTunnel{}}
+	if loadErr != nil {
+		out.Error = loadErr.Error()
+	}
+	for _, cfg := range cfgs {
+		r := checkConfig(cfg)
+		out.Tunnels = append(out.Tunnels, CheckTunnel{
+			Tap:      cfg.TapName,
+			Errors:   append([]string{}, r.errors...),
+			Warnings: append([]string{}, r.warnings...),
+		})
+		if len(r.errors) > 0 {
+			out.OK = false
+		}
+	}
+	printJSON(out)
+	if !out.OK {
+		return 1
+	}
+	return 0
+}
+
+// checkConfig は設定値とホスト環境（インターフェース、ブリッジ、名前解決）を検証する関数
+func checkConfig(cfg *Config) *checkResult {
+	r := &checkResult{}
+	if cfg.legacy {
+		r.warn("%s", legacyConfigMessage)
+	}
+
+	if cfg.Version != 4 && cfg.Version != 6 {
+		r.fail("version must be 4 or 6 (got %d)", cfg.Version)
+	}
+	if cfg.MTU < 68 || cfg.MTU > 65535 {
+		r.fail("mtu %d out of range (68-65535)", cfg.MTU)
+	} else if cfg.Version == 6 && cfg.MTU < 1280 {
+		r.warn("mtu %d is below the IPv6 minimum of 1280", cfg.MTU)
+	}
+
+	// 期間指定の書式
+	durations := []struct{ key, value string }{
+		{"resolve_interval", cfg.ResolveInterval},
+		{"sla.interval", cfg.SLA.Interval},
+		{"fdb.aging", cfg.FDB.Aging},
+		{"pmtud.interval", cfg.PMTUD.Interval},
+		{"stp_cost.interval", cfg.STPCost.Interval},
+		{"alerts.interval", cfg.Alerts.Interval},
+		{"mqtt.interval", cfg.MQTT.Interval},
+		{"tee.timeout", cfg.Tee.Timeout},
+		{"rate_limit.max_delay", cfg.RateLimit.MaxDelay},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(d.value); err != nil {
+			r.fail("%s: %v", d.key, err)
+		} else if v <= 0 {
+			r.fail("%s must be positive", d.key)
+		}
+	}
+	if err := initDNS(cfg.DNS); err != nil {
+		r.fail("dns: %v", err)
+	}
+	if err := initDiscovery(cfg.Discovery); err != nil {
+		r.fail("discovery: %v", err)
+	}
+	if interval, _, err := parseKeepalive(cfg); err != nil {
+		r.fail("keepalive: %v", err)
+	} else if _, err := parseKeepaliveAdaptive(cfg, interval); err != nil {
+		r.fail("keepalive: %v", err)
+	}
+
+	// 機能ごとの設定
+	if _, err := newRateLimiter(cfg.RateLimit, cfg.MTU); err != nil {
+		r.fail("rate_limit: %v", err)
+	}
+	if err := cfg.OuterHopLimit.validate(); err != nil {
+		r.fail("outer_hop_limit: %v", err)
+	}
+	if _, err := parseLinkSpeed(cfg); err != nil {
+		r.fail("link_speed: %v", err)
+	}
+	if cfg.Roaming {
+		if !cfg.Auth.Enabled {
+			r.fail("roaming requires auth (an unauthenticated packet could redirect the tunnel)")
+		}
+		if len(cfg.peerHosts()) > 1 || len(cfg.Standby.Hosts) > 0 {
+			r.fail("roaming supports a single peer without standby (the shared auth key cannot tell peers apart)")
+		}
+	}
+	if mode, err := parseNegotiate(cfg.Negotiate); err != nil {
+		r.fail("negotiate: %v", err)
+	} else if mode != negotiateOff && (cfg.Encap == encapGRETap || cfg.Encap == encapL2TPv3) {
+		r.warn("negotiate %s: capabilities are exchanged only with an etherip-go peer", mode)
+	}
+	if cfg.Migration.enabled() {
+		if err := checkMigration(cfg); err != nil {
+			r.fail("migration: %v", err)
+		}
+		if cfg.KeepaliveInterval == "off" {
+			r.warn("migration is set but keepalive is off; the secondary family is never used")
+		}
+	}
+	if _, err := newEncapsulation(cfg); err != nil {
+		r.fail("encap: %v", err)
+	} else if err := checkEncap(cfg); err != nil {
+		r.fail("encap: %v", err)
+	} else if cfg.Encap == encapGRETap || cfg.Encap == encapL2TPv3 {
+		r.warn("encap %s: keepalive, canary, pmtud and hello work only with an etherip-go peer", cfg.Encap)
+	}
+	if kind, err := parseUnderlay(cfg); err != nil {
+		r.fail("underlay: %v", err)
+	} else if kind != underlayPlain {
+		if ifi, err := net.InterfaceByName(cfg.SrcIface); err == nil && cfg.MTU > underlayMTU(cfg, kind, ifi.MTU) {
+			r.warn("mtu %d does not fit the %s underlay on %s and will be lowered to %d", cfg.MTU, kind, cfg.SrcIface, underlayMTU(cfg, kind, ifi.MTU))
+		}
+	}
+	if err := checkIfMode(cfg); err != nil {
+		r.fail("ifmode: %v", err)
+	}
+	if err := checkLocalDelivery(cfg); err != nil {
+		r.fail("local_delivery: %v", err)
+	} else if cfg.LocalDelivery.Iface != "" && ifaceExists(cfg.LocalDelivery.Iface) {
+		r.fail("local_delivery: interface %s already exists", cfg.LocalDelivery.Iface)
+	}
+	if _, err := newMACLimiter(cfg.MACLimit); err != nil {
+		r.fail("mac_limit: %v", err)
+	}
+	if _, err := newStormControl(cfg.StormControl); err != nil {
+		r.fail("storm_control: %v", err)
+	}
+	if _, err := newFDBSyncer(nil, cfg); err != nil {
+		r.fail("fdb_sync: %v", err)
+	}
+	if _, err := newLoopDetector(nil, cfg.LoopDetect); err != nil {
+		r.fail("loop_detect: %v", err)
+	}
+	if _, err := newNDProxy(cfg.NDProxy, nil); err != nil {
+		r.fail("nd_proxy: %v", err)
+	}
+	if _, err := newMirror(cfg, nil); err != nil {
+		r.fail("mirror: %v", err)
+	}
+	if _, err := newSilenceWatcher(nil, cfg.Silence); err != nil {
+		r.fail("silence: %v", err)
+	}
+	if _, err := newVLANFilter(cfg.VLANFilter); err != nil {
+		r.fail("vlan_filter: %v", err)
+	}
+	if _, err := newMartianFilter(cfg.MartianFilter); err != nil {
+		r.fail("martian_filter: %v", err)
+	}
+	if _, err := newACLFilter(cfg.ACL); err != nil {
+		r.fail("acl: %v", err)
+	}
+	if _, err := newCompressor(cfg.Compression); err != nil {
+		r.fail("compression: %v", err)
+	}
+	if _, err := newQoSMarker(cfg.QoS); err != nil {
+		r.fail("qos: %v", err)
+	} else if cfg.QoS.FlowLabel != "" && cfg.Version == 4 && !cfg.DualStack {
+		r.warn("qos.flow_label has no effect on IPv4 tunnels")
+	}
+	if _, err := parseBridgeConfig(cfg.Bridge); err != nil {
+		r.fail("bridge: %v", err)
+	}
+	if _, err := parseSetup(cfg); err != nil {
+		r.fail("setup: %v", err)
+	}
+	if _, err := parseFailbackDelay(cfg.Standby); err != nil {
+		r.fail("standby: %v", err)
+	} else if len(cfg.Standby.Hosts) > 0 && cfg.KeepaliveInterval == "off" {
+		r.fail("standby requires keepalive_interval")
+	}
+	if cfg.Canary.Enabled {
+		if _, _, err := parseCanaryConfig(cfg.Canary, cfg.MTU); err != nil {
+			r.fail("canary: %v", err)
+		}
+	}
+	if _, _, err := parseStatsConfig(cfg.Stats); err != nil {
+		r.fail("stats: %v", err)
+	}
+	if cfg.Capture.Dir != "" {
+		if fi, err := os.Stat(cfg.Capture.Dir); err != nil || !fi.IsDir() {
+			r.warn("capture.dir %s is not an existing directory", cfg.Capture.Dir)
+		}
+	}
+	if cfg.Iperf.Address != "" {
+		if _, _, _, _, err := parseIperfConfig(cfg.Iperf); err != nil {
+			r.fail("iperf: %v", err)
+		}
+	}
+	if cfg.RecursionCheck != "off" {
+		if _, err := parseRecursionInterval(cfg.RecursionCheck); err != nil {
+			r.fail("recursion_check: %v", err)
+		}
+	}
+	if cfg.HostRoute.Enabled {
+		if _, err := parseHostRouteGateways(cfg.HostRoute); err != nil {
+			r.fail("host_route: %v", err)
+		}
+		if cfg.HostRoute.Metric < 0 {
+			r.fail("host_route.metric must not be negative")
+		}
+	}
+	if _, err := newAuthenticator(cfg.Auth); err != nil {
+		r.fail("auth: %v", err)
+	} else if cfg.Auth.Enabled && cfg.Auth.KeyEnv == "" {
+		r.warn("auth.key is stored in the config file; consider auth.key_env")
+	}
+	known := make(map[string]bool)
+	for _, host := range append(cfg.peerHosts(), cfg.Standby.Hosts...) {
+		known[host] = true
+	}
+	for host := range cfg.Auth.Peers {
+		if !known[host] {
+			r.warn("auth.peers[%s] matches no dst_host, peers or standby host; it is never used", host)
+		}
+	}
+	if _, err := newPeerAllowlist(cfg.Allowlist); err != nil {
+		r.fail("allowlist: %v", err)
+	}
+	for host := range cfg.Allowlist.Peers {
+		if !known[host] {
+			r.warn("allowlist.peers[%s] matches no dst_host, peers or standby host; it is never used", host)
+		}
+	}
+	if _, err := newHeaderChecker(cfg.HeaderMode, false, false, false); err != nil {
+		r.fail("%v", err)
+	}
+	if _, err := newRxValidator(cfg.RxValidation); err != nil {
+		r.fail("rx_validation: %v", err)
+	}
+	if workers, err := resolveWorkers(cfg.Workers); err != nil {
+		r.fail("workers: %v", err)
+	} else if _, err := newECNMarker(cfg.ECN, nil, workers.sendQueue); err != nil {
+		r.fail("ecn: %v", err)
+	}
+	if _, err := resolveBuffers(cfg.Buffers, cfg.MTU); err != nil {
+		r.fail("buffers: %v", err)
+	}
+	if _, err := parseDatapath(cfg.Datapath); err != nil {
+		r.fail("%v", err)
+	} else if cfg.Datapath == datapathAFXDP {
+		r.warn("datapath af_xdp is not implemented and falls back to af_packet (TPACKET_V3)")
+	}
+	if isAFPacket(cfg.Datapath) && !cfg.PMTUD.Enabled {
+		r.warn("datapath af_packet drops fragmented outer packets; enable pmtud, lower mtu or set oversize.action: split on the peer so they fit the path")
+	}
+	if rawSocketMissesEtherIP && (cfg.Encap == "" || cfg.Encap == encapEtherIP) {
+		// カーネルの etherip(4) がRAWソケットより先に受け取るため、src_ifaceのbpf(4)で受信する
+		if cfg.SrcIface == "" {
+			r.fail("src_iface is required on %s to receive EtherIP through bpf(4)", runtime.GOOS)
+		} else if !cfg.PMTUD.Enabled {
+			r.warn("EtherIP is received through bpf(4) on %s, which drops fragmented outer packets; enable pmtud, lower mtu or set oversize.action: split on the peer so they fit the path", runtime.GOOS)
+		}
+	}
+	if action, err := parseOversize(cfg.Oversize.Action); err != nil {
+		r.fail("%v", err)
+	} else {
+		switch {
+		case action == oversizeFragment && cfg.PMTUD.Enabled:
+			r.fail("oversize.action fragment clears DF, which pmtud needs; disable one of them")
+		case action == oversizeDF && cfg.PMTUD.Enabled:
+			r.warn("oversize.action df is redundant with pmtud, which already sets DF")
+		case cfg.Oversize.PathMTU != 0 && action != oversizeDrop && action != oversizeSplit:
+			r.warn("oversize.path_mtu is used only with action drop or split")
+		}
+		if action == oversizeFragment && cfg.Version == 6 {
+			r.warn("oversize.action fragment on IPv6 fragments at this host only; routers on the path still drop packets over their MTU")
+		}
+	}
+	switch mtu := cfg.Oversize.PathMTU; {
+	case mtu < 0:
+		r.fail("oversize.path_mtu must not be negative")
+	case mtu > 0 && mtu < 576:
+		r.warn("oversize.path_mtu %d is below the IPv4 minimum of 576", mtu)
+	case mtu > 0 && mtu < 1280 && cfg.Version == 6:
+		r.warn("oversize.path_mtu %d is below the IPv6 minimum of 1280", mtu)
+	}
+	if enabled, err := parseOffload(cfg); err != nil {
+		r.fail("offload: %v", err)
+	} else if enabled {
+		for _, tool := range []string{"tc", "bpftool"} {
+			if _, err := exec.LookPath(tool); err != nil {
+				r.fail("offload: %s not found", tool)
+			}
+		}
+		if len(cfg.ACL.Rules) > 0 || cfg.RateLimit.TX.Rate != "" || cfg.RateLimit.RX.Rate != "" || len(cfg.WasmPlugins) > 0 {
+			r.warn("offload: frames forwarded in the kernel bypass acl, rate_limit and wasm_plugins")
+		}
+	}
+	if cfg.ManageFirewall {
+		if _, err := exec.LookPath("nft"); err != nil {
+			r.fail("manage_firewall: nft not found")
+		} else if err := exec.Command("nft", "list", "chain", firewallHostFamily, firewallHostTable, firewallHostChain).Run(); err != nil {
+			r.warn("manage_firewall: no %s %s %s chain; only ICMP errors to the peers are suppressed (allow the protocol in your firewall)", firewallHostFamily, firewallHostTable, firewallHostChain)
+		}
+	}
+	if _, err := newLoopGuard(cfg.LoopGuard); err != nil {
+		r.fail("loop_guard: %v", err)
+	}
+	for i, pc := range cfg.WasmPlugins {
+		plugin, err := loadWasmPlugin(pc, 1)
+		if err != nil {
+			r.fail("wasm_plugins[%d]: %v", i, err)
+			continue
+		}
+		plugin.Close()
+	}
+	if cfg.Tee.Socket != "" {
+		if _, _, ok := parseDirections(cfg.Tee.Direction); !ok {
+			r.fail("tee.direction: invalid %q", cfg.Tee.Direction)
+		}
+	}
+	if cfg.NFQueue.Num > 0 {
+		if _, _, ok := parseDirections(cfg.NFQueue.Direction); !ok {
+			r.fail("nfqueue.direction: invalid %q", cfg.NFQueue.Direction)
+		}
+		if cfg.BrName == "off" {
+			r.fail("nfqueue requires br_name to be set")
+		}
+	}
+	if cfg.STPCost.Enabled {
+		if cfg.BrName == "off" {
+			r.fail("stp_cost requires br_name to be set")
+		}
+		if cfg.KeepaliveInterval == "off" {
+			r.fail("stp_cost requires keepalive_interval")
+		}
+	}
+	if cfg.RouteHealth.Neighbor != "" && cfg.RouteHealth.LocalAS == 0 {
+		r.fail("route_health.local_as is required")
+	}
+	if cfg.EVPN.Neighbor != "" {
+		if len(cfg.Peers) == 0 {
+			r.fail("evpn requires multiple peers (peers)")
+		}
+		if cfg.EVPN.LocalAS == 0 {
+			r.fail("evpn.local_as is required")
+		}
+		if cfg.EVPN.VNI > 0xFFFFFF {
+			r.fail("evpn.vni %d out of range (0-16777215)", cfg.EVPN.VNI)
+		}
+		if cfg.EVPN.RD != "" {
+			if _, err := parseRD(cfg.EVPN.RD); err != nil {
+				r.fail("evpn.rd: %v", err)
+			}
+		}
+		if cfg.EVPN.RouteTarget != "" {
+			if _, err := parseRouteTarget(cfg.EVPN.RouteTarget); err != nil {
+				r.fail("evpn.route_target: %v", err)
+			}
+		}
+	}
+	for i, rule := range cfg.Alerts.Rules {
+		if rule.Metric == "" || (rule.Hook == "" && rule.Webhook == "") {
+			r.fail("alerts.rules[%d]: metric and hook or webhook are required", i)
+		}
+	}
+	if err := validateLabels(cfg.Labels); err != nil {
+		r.fail("labels: %v", err)
+	}
+	for i, tok := range cfg.APITokens {
+		if len(tok.Token) < 16 {
+			r.fail("api_tokens[%d]: token must be at least 16 characters", i)
+		}
+	}
+	if len(cfg.APITokens) > 0 && cfg.APIListen == "" {
+		r.warn("api_tokens is set but api_listen is empty")
+	}
+	if _, _, err := parseHealthConfig(cfg.Health); err != nil {
+		r.fail("health: %v", err)
+	} else if cfg.Health.Peers != "" && cfg.Health.Peers != healthPeersNone && cfg.KeepaliveInterval == "off" {
+		r.warn("health.peers is %s but keepalive is off; peers are always reported up", cfg.Health.Peers)
+	}
+	if cfg.PIDFile != "" {
+		if _, err := os.Stat(filepath.Dir(cfg.PIDFile)); err != nil {
+			r.fail("pid_file: directory %s does not exist", filepath.Dir(cfg.PIDFile))
+		} else if pid, held := lockHolder(tapLockPath(cfg.PIDFile, cfg.TapName)); held {
+			r.warn("%s is already managed by a running instance (pid %s)", cfg.TapName, pid)
+		}
+	}
+	if _, err := parseHistoryConfig(cfg.History); err != nil {
+		r.fail("history: %v", err)
+	} else if cfg.History.File != "" {
+		if _, err := os.Stat(filepath.Dir(cfg.History.File)); err != nil {
+			r.fail("history.file: directory %s does not exist", filepath.Dir(cfg.History.File))
+		}
+	}
+	if cfg.ControlTrace.MaxSizeMB < 0 {
+		r.fail("control_trace.max_size_mb must not be negative")
+	} else if cfg.ControlTrace.File != "" {
+		if _, err := os.Stat(filepath.Dir(cfg.ControlTrace.File)); err != nil {
+			r.fail("control_trace.file: directory %s does not exist", filepath.Dir(cfg.ControlTrace.File))
+		} else if cfg.KeepaliveInterval == "off" {
+			r.warn("control_trace is set but keepalive is off; only route and DNS changes are recorded")
+		}
+	}
+	if _, err := parseOTLPEnv(os.Getenv); err != nil {
+		r.fail("OpenTelemetry: %v", err)
+	}
+	if key, _, err := parseUpdateConfig(cfg.Update); err != nil {
+		r.fail("update: %v", err)
+	} else if err := checkUnattendedUpdate(cfg); err != nil {
+		r.fail("update: %v", err)
+	} else if key != nil && cfg.RunAsUser != "" {
+		r.warn("update: the daemon cannot recreate interfaces when restarting as %s after an update; restart it from the service manager instead", cfg.RunAsUser)
+	}
+	if _, err := parseLogLevel(cfg.Log.Level); err != nil {
+		r.fail("log.level: %v", err)
+	}
+	if _, err := parseDebugSubsystems(cfg.Log.Debug); err != nil {
+		r.fail("log.debug: %v", err)
+	}
+	if _, err := loadCatalog(cfg.Log); err != nil {
+		r.fail("log: %v", err)
+	}
+	if settings, err := parseSysctl(cfg.Sysctl); err != nil {
+		r.fail("sysctl: %v", err)
+	} else {
+		for _, s := range settings {
+			if _, err := readSysctl(s.key); err != nil {
+				r.fail("sysctl: %s: %v", s.key, err)
+			}
+		}
+		if len(settings) > 0 && cfg.RunAsUser != "" && (cfg.Sysctl.Restore == nil || *cfg.Sysctl.Restore) {
+			r.warn("sysctl settings cannot be restored on exit after dropping privileges to %s", cfg.RunAsUser)
+		}
+	}
+	if cfg.RunAsUser != "" {
+		if _, _, err := lookupIDs(cfg.RunAsUser, cfg.RunAsGroup); err != nil {
+			r.fail("%v", err)
+		}
+	} else if cfg.RunAsGroup != "" {
+		r.fail("run_as_group requires run_as_user")
+	}
+	if cfg.MQTT.Broker != "" {
+		if u, err := url.Parse(cfg.MQTT.Broker); err != nil || u.Host == "" {
+			r.fail("mqtt.broker: invalid URL %q", cfg.MQTT.Broker)
+		}
+		if cfg.MQTT.Password != "" && cfg.MQTT.Username == "" {
+			r.fail("mqtt.password requires mqtt.username")
+		}
+	}
+	if cfg.Cluster.enabled() {
+		checkCluster(cfg, r)
+	}
+
+	// インターフェースとブリッジ
+	if ifaceExists(cfg.TapName) {
+		r.fail("tap_name %s already exists", cfg.TapName)
+	}
+	if cfg.BrName != "off" {
+		switch {
+		case isBridge(cfg.BrName):
+		case ifaceExists(cfg.BrName):
+			r.fail("%s exists but is not a bridge", cfg.BrName)
+		case cfg.Bridge.Create:
+			r.warn("bridge %s does not exist and will be created", cfg.BrName)
+		case cfg.WaitForBridge:
+			r.warn("bridge %s does not exist; startup will wait for it", cfg.BrName)
+		default:
+			r.fail("bridge %s does not exist (set bridge.create to create it)", cfg.BrName)
+		}
+	}
+	versions := []int{cfg.Version}
+	if cfg.DualStack {
+		versions = append(versions, otherVersion(cfg.Version))
+	}
+	if cfg.SrcAuto {
+		if err := checkSrcAuto(cfg); err != nil {
+			r.fail("src_auto: %v", err)
+		}
+		if cfg.SrcIface != "" && !ifaceExists(cfg.SrcIface) {
+			r.fail("src_iface %s does not exist", cfg.SrcIface)
+		}
+	} else if !ifaceExists(cfg.SrcIface) {
+		r.fail("src_iface %s does not exist", cfg.SrcIface)
+	} else {
+		usable := 0
+		for _, v := range versions {
+			ip, err := sourceIP(cfg, v)
+			if err != nil {
+				if len(cfg.SrcIP) > 0 {
+					r.warn("%v", err)
+				} else {
+					r.warn("src_iface %s has no IPv%d address", cfg.SrcIface, v)
+				}
+				continue
+			}
+			if len(cfg.SrcIP) > 0 && !interfaceHasIP(cfg.SrcIface, ip) {
+				r.warn("src_ip %s is not assigned to src_iface %s", ip, cfg.SrcIface)
+			}
+			usable++
+		}
+		if usable == 0 || (!cfg.DualStack && usable < len(versions)) {
+			r.fail("src_iface %s has no usable address", cfg.SrcIface)
+		}
+	}
+	families := map[int]bool{}
+	for _, s := range cfg.SrcIP {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			r.fail("src_ip %q is not an IP address", s)
+			continue
+		}
+		v := 6
+		if ip.To4() != nil {
+			v = 4
+		}
+		if families[v] {
+			r.fail("src_ip has more than one IPv%d address", v)
+		}
+		families[v] = true
+	}
+	if cfg.BindDevice && runtime.GOOS != "linux" {
+		r.fail("bind_device is supported only on Linux")
+	}
+	checkPlatformIface(cfg, r)
+
+	// 宛先の名前解決
+	hosts := cfg.peerHosts()
+	if len(hosts) == 0 {
+		r.fail("dst_host is not specified")
+	}
+	for _, host := range hosts {
+		resolved := 0
+		for _, v := range versions {
+			if ip, err := resolveDst(cfg.familyHost(host, v), v); err == nil {
+				resolved++
+				if cfg.SrcAuto {
+					if _, err := routeSource(ip); err != nil {
+						r.warn("src_auto: %v", err)
+					}
+				}
+			} else if cfg.DualStack {
+				r.warn("%s does not resolve for IPv%d", cfg.familyHost(host, v), v)
+			}
+		}
+		if resolved == 0 || (!cfg.DualStack && resolved < len(versions)) {
+			r.fail("%s does not resolve for IPv%d", host, cfg.Version)
+		}
+	}
+	return r
+}
+
+// printDryRun は全トンネルの検証結果と起動時に行う操作を表示する関数（何も作成しない）
+func printDryRun(cfgs []*Config) int {
+	code := 0
+	for _, cfg := range cfgs {
+		if len(cfgs) > 1 {
+			fmt.Printf("== %s ==\n", cfg.TapName)
+		}
+		if !dryRunTunnel(cfg) {
+			code = 1
+		}
+	}
+	if cfgs[0].APIListen != "" {
+		fmt.Printf("listen control API on %s\n", cfgs[0].APIListen)
+	}
+	if cfgs[0].Health.Listen != "" {
+		fmt.Printf("listen health endpoints on %s\n", cfgs[0].Health.Listen)
+	}
+	if s, err := parseOTLPEnv(os.Getenv); err == nil {
+		for _, e := range []*otlpEndpoint{s.metrics, s.traces} {
+			if e != nil {
+				fmt.Printf("export OpenTelemetry %s to %s (%s)\n", e.signal, e.url, e.protocol)
+			}
+		}
+	}
+	return code
+}
+
+// dryRunTunnel はトンネル1本分の検証結果と実行予定の操作を表示する関数
+func dryRunTunnel(cfg *Config) bool {
+	ok := checkConfig(cfg).print()
+
+	fmt.Println("\nPlanned operations:")
+	for _, op := range plannedIfaceOps(cfg) {
+		fmt.Printf("  %s\n", op)
+	}
+	if cfg.NFQueue.Num > 0 {
+		fmt.Printf("  nft: create table bridge etherip_%s (queue %d, %s)\n", cfg.TapName, cfg.NFQueue.Num, cfg.NFQueue.Direction)
+	}
+
+	versions := []int{cfg.Version}
+	if cfg.DualStack {
+		versions = append(versions, otherVersion(cfg.Version))
+	}
+	for _, v := range versions {
+		src := "?"
+		if cfg.SrcAuto {
+			src = "source per destination"
+		} else if ip, err := sourceIP(cfg, v); err == nil {
+			src = ip.String()
+		}
+		on := ""
+		if cfg.SrcIface != "" {
+			on = " on " + cfg.SrcIface
+		}
+		proto := etherIPProto
+		if e, err := newEncapsulation(cfg); err == nil {
+			proto = e.protocol()
+		}
+		fmt.Printf("  open raw IPv%d socket (protocol %d)%s (%s)\n", v, proto, on, src)
+		if cfg.BindDevice {
+			fmt.Printf("  bind IPv%d socket to %s (SO_BINDTODEVICE)\n", v, cfg.SrcIface)
+		}
+		// WireGuard・IPsecの中では外側パケットが暗号化されて運ばれるため、経路上のファイアウォールの許可は不要
+		if kind, _ := parseUnderlay(cfg); cfg.ManageFirewall {
+			fmt.Printf("  nft: allow IPv%d protocol %d from the peers and drop ICMP errors to them (table inet %s)\n", v, proto, firewallTable(cfg.TapName))
+		} else if kind == underlayPlain {
+			fmt.Printf("  firewall: allow IPv%d protocol %d from the peers\n", v, proto)
+		} else {
+			fmt.Printf("  firewall: no raw protocol rule needed (carried inside %s on %s)\n", kind, cfg.SrcIface)
+		}
+	}
+	hosts := cfg.peerHosts()
+	if cfg.DstHost != "" {
+		hosts = append(hosts, cfg.Standby.Hosts...)
+	}
+	for _, host := range hosts {
+		for _, v := range versions {
+			dst := "unresolved"
+			from := ""
+			if ip, err := resolveDst(cfg.familyHost(host, v), v); err == nil {
+				dst = ip.String()
+				if src, err := routeSource(ip); err == nil && cfg.SrcAuto {
+					from = " from " + src.String()
+				}
+			}
+			fmt.Printf("  tunnel IPv%d to %s (%s)%s\n", v, cfg.familyHost(host, v), dst, from)
+			if cfg.HostRoute.Enabled {
+				fmt.Printf("  ip route replace host route to %s dev %s\n", dst, cfg.SrcIface)
+			}
+		}
+	}
+	return ok
+}
+
+// init はサブコマンドの使い方を flag.Usage に設定する
+func init() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n  %[1]s [--config config.yaml] [--dry-run] [--<key> value ...]\n  %[1]s check [-c config.yaml] [-json]\n  %[1]s init [-o config.yaml] [-dst host] [-force]\n  %[1]s migrate [-c config.yaml] [-o new.yaml]\n  %[1]s status [-c config.yaml] [-tap tap0] [-json]\n  %[1]s trace [-c config.yaml] [-tap tap0] [-count 10] [-filter expr] [-show] [-cancel]\n  %[1]s version [-json]\n\nOptions:\n", os.Args[0])
+		flag.VisitAll(func(f *flag.Flag) {
+			if f.Usage != overrideUsage {
+				fmt.Fprintf(flag.CommandLine.Output(), "  -%s\n    \t%s\n", f.Name, f.Usage)
+			}
+		})
+		fmt.Fprintf(flag.CommandLine.Output(), "\nEvery config key can be overridden with --<key> (e.g. --dst-host, --pmtud.enabled)\n"+
+			"or ETHERIP_<KEY> (e.g. ETHERIP_DST_HOST, ETHERIP_PMTUD_ENABLED); flags > environment > config file.\n")
+	}
+}
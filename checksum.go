@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// 内側チェックサムの検証結果
+const (
+	csumIP = iota // IPv4ヘッダ
+	csumL4        // TCP・UDP・ICMP・ICMPv6
+	csumLayers
+)
+
+// csumLayerNames はカウンタ名に使う検証対象
+var csumLayerNames = [csumLayers]string{"ip", "l4"}
+
+// checksumCounterはピアごとの内側チェックサムの検証数と誤り数を保持する
+type checksumCounter struct {
+	checked atomic.Uint64             // 検証したパケット数
+	bad     [csumLayers]atomic.Uint64 // 対象ごとのチェックサムの誤り数
+}
+
+// checksumVerifierは受信した内側IPパケットのL3/L4チェックサムをサンプリングして検証する
+//
+// 破棄はせず数えるだけ（破棄はrx_validation.ip_checksum）。EtherIPはアンダーレイでのビット化けを検出しないため、
+// 壊れた経路を通ったパケットがアプリケーションで問題になる前にピアごとの誤り数で気づけるようにする。
+// 対向のTAPはチェックサムを計算済みのフレームを読むため、オフロードによる誤検出は起きない。
+type checksumVerifier struct {
+	t      *Tunnel
+	sample *sampler
+
+	skipped atomic.Uint64 // フラグメント・途中で切れたパケット等で検証しなかった数
+}
+
+// newChecksumVerifier はサンプリング設定から検証器を生成する関数（無効ならnilを返す）
+func newChecksumVerifier(t *Tunnel, cfg SamplingConfig) *checksumVerifier {
+	s := newSampler(cfg, false)
+	if s == nil {
+		return nil
+	}
+	logf("[INFO]", "Inner checksum verification enabled (1 in %d packets)", s.every)
+	return &checksumVerifier{t: t, sample: s}
+}
+
+// check はサンプリングで選ばれた受信フレームの内側チェックサムを検証し、ピアごとに数える関数
+func (v *checksumVerifier) check(peer *Peer, frame []byte) {
+	if v == nil || len(frame) < 14 {
+		return
+	}
+
+	// ホップ数タグ（transit時）とVLANタグ（QinQを含む）を読み飛ばす
+	off := 12
+	et := binary.BigEndian.Uint16(frame[off:])
+	if et == hopTagEtherType && len(frame) >= off+hopTagLen+2 {
+		off += hopTagLen
+		et = binary.BigEndian.Uint16(frame[off:])
+	}
+	for (et == tpid8021Q || et == tpid8021AD) && len(frame) >= off+vlanTagLen+2 {
+		off += vlanTagLen
+		et = binary.BigEndian.Uint16(frame[off:])
+	}
+	if et != 0x0800 && et != 0x86DD {
+		return
+	}
+	if !v.sample.hit() {
+		return
+	}
+
+	var bad [csumLayers]bool
+	var ok bool
+	if et == 0x0800 {
+		ok = verifyIPv4(frame[off+2:], &bad)
+	} else {
+		ok = verifyIPv6(frame[off+2:], &bad)
+	}
+	if !ok {
+		v.skipped.Add(1)
+		return
+	}
+	peer.csum.checked.Add(1)
+	for layer, b := range bad {
+		if b {
+			peer.csum.bad[layer].Add(1)
+		}
+	}
+}
+
+// verifyIPv4 はIPv4ヘッダと、フラグメントでなければL4のチェックサムを検証する関数（検証できなければfalse）
+func verifyIPv4(ip []byte, bad *[csumLayers]bool) bool {
+	if len(ip) < 20 {
+		return false
+	}
+	ihl := int(ip[0]&0x0F) * 4
+	total := int(binary.BigEndian.Uint16(ip[2:4]))
+	if ip[0]>>4 != 4 || ihl < 20 || total < ihl || total > len(ip) {
+		return false
+	}
+	bad[csumIP] = ipv4Checksum(ip[:ihl]) != 0
+
+	// MF・フラグメントオフセットのあるパケットはL4のチェックサムを単独で検証できない
+	if binary.BigEndian.Uint16(ip[6:8])&0x3FFF != 0 {
+		return true
+	}
+	l4 := ip[ihl:total]
+	proto := ip[9]
+	var sum uint32
+	switch proto {
+	case 6, 17:
+		if proto == 17 && len(l4) >= 8 && binary.BigEndian.Uint16(l4[6:8]) == 0 {
+			return true // UDPのチェックサムなし
+		}
+		sum = inetSum(sum, ip[12:20])
+		sum += uint32(proto) + uint32(len(l4))
+	case 1:
+	default:
+		return true
+	}
+	if !l4Complete(proto, l4) {
+		return true
+	}
+	bad[csumL4] = inetFold(inetSum(sum, l4)) != 0xFFFF
+	return true
+}
+
+// verifyIPv6 は拡張ヘッダのないIPv6パケットのL4のチェックサムを検証する関数（検証できなければfalse）
+func verifyIPv6(ip []byte, bad *[csumLayers]bool) bool {
+	if len(ip) < 40 || ip[0]>>4 != 6 {
+		return false
+	}
+	plen := int(binary.BigEndian.Uint16(ip[4:6]))
+	if plen == 0 || 40+plen > len(ip) {
+		return false // ジャンボグラム・途中で切れたパケット
+	}
+	l4 := ip[40 : 40+plen]
+	proto := ip[6]
+	if proto != 6 && proto != 17 && proto != 58 {
+		return true
+	}
+	if !l4Complete(proto, l4) {
+		return true
+	}
+	sum := inetSum(0, ip[8:40])
+	sum += uint32(proto) + uint32(len(l4))
+	bad[csumL4] = inetFold(inetSum(sum, l4)) != 0xFFFF
+	return true
+}
+
+// l4Complete はL4ヘッダがチェックサムの位置まで含まれているかを返す関数
+func l4Complete(proto byte, l4 []byte) bool {
+	switch proto {
+	case 6:
+		return len(l4) >= 20
+	case 17:
+		return len(l4) >= 8
+	}
+	return len(l4) >= 4
+}
+
+// inetSum はインターネットチェックサムの16ビット単位の和にbを加える関数（奇数長は末尾を0で埋める）
+func inetSum(sum uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+// inetFold は和を16ビットに畳み込む関数（チェックサム込みで正しければ0xFFFF）
+func inetFold(sum uint32) uint16 {
+	for sum > 0xFFFF {
+		sum = sum&0xFFFF + sum>>16
+	}
+	return uint16(sum)
+}
+
+// Counters は全ピア合計の検証数・誤り数を返す（ピアごとの値はGET /stats、GET /metrics）
+func (v *checksumVerifier) Counters() map[string]uint64 {
+	counters := map[string]uint64{"rx_csum_checked": 0, "rx_csum_skipped": v.skipped.Load()}
+	for _, name := range csumLayerNames {
+		counters["rx_csum_bad_"+name] = 0
+	}
+	for _, peer := range v.t.peers {
+		counters["rx_csum_checked"] += peer.csum.checked.Load()
+		for layer, name := range csumLayerNames {
+			counters["rx_csum_bad_"+name] += peer.csum.bad[layer].Load()
+		}
+	}
+	return counters
+}
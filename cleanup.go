@@ -0,0 +1,58 @@
+package main
+
+import "sync"
+
+// 終了時に実行する後片付け処理の一覧
+var (
+	cleanupMu  sync.Mutex
+	cleanupFns []cleanupFn
+)
+
+// cleanupFnは後片付け処理と、停止する時だけ実行するか（無停止の再起動では新しいプロセスへ残す）
+type cleanupFn struct {
+	fn       func()
+	shutdown bool
+}
+
+// registerCleanup は終了時に実行する後片付け処理を登録する関数
+func registerCleanup(fn func()) {
+	cleanupMu.Lock()
+	defer cleanupMu.Unlock()
+	cleanupFns = append(cleanupFns, cleanupFn{fn: fn})
+}
+
+// registerShutdown は停止する時だけ実行する後片付け処理を登録する関数
+//
+// インターフェース・ブリッジのメンバー・ルール・経路等、無停止の再起動で新しいプロセスがそのまま使うものの削除に使う。
+func registerShutdown(fn func()) {
+	cleanupMu.Lock()
+	defer cleanupMu.Unlock()
+	cleanupFns = append(cleanupFns, cleanupFn{fn: fn, shutdown: true})
+}
+
+// runCleanups は登録された後片付け処理を登録と逆順に実行する関数
+//
+// 引き継ぎの途中で起動に失敗した時は引き継ぎ元がまだ使っているため、停止する時だけの処理は実行しない。
+func runCleanups() {
+	runCleanupsFor(!handoverPending())
+}
+
+// runHandoverCleanups は新しいプロセスへ引き継いだ後に、停止する時だけの処理を除いて実行する関数
+func runHandoverCleanups() {
+	runCleanupsFor(false)
+}
+
+// runCleanupsFor は後片付け処理を登録と逆順に実行する関数（shutdownが偽なら停止する時だけの処理を除く）
+func runCleanupsFor(shutdown bool) {
+	cleanupMu.Lock()
+	fns := cleanupFns
+	cleanupFns = nil
+	cleanupMu.Unlock()
+
+	for i := len(fns) - 1; i >= 0; i-- {
+		if fns[i].shutdown && !shutdown {
+			continue
+		}
+		fns[i].fn()
+	}
+}
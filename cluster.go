@@ -0,0 +1,681 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// クラスタ（アクティブ・スタンバイの2台構成）関連の定数定義
+const (
+	clusterDefaultPriority = 100
+	clusterDefaultInterval = 200 * time.Millisecond
+	clusterDefaultSync     = time.Second
+	clusterDeadFactor      = 5       // 既定のdead_afterはintervalの5倍
+	clusterFDBChunk        = 64      // 1データグラムで送るFDBのエントリ数
+	clusterSeqMargin       = 1 << 16 // 引き継ぎ時にsequenceの番号を進める余裕（最後のハートビート以降に相方が送った分）
+	clusterAuthMargin      = 1 << 24 // 引き継ぎ時にauthの番号を進める余裕
+	clusterGARPCount       = 3       // アクティブになった時のGARP・非要請NAの送信回数
+	clusterGARPInterval    = 100 * time.Millisecond
+	clusterMaxMessage      = 65507
+)
+
+// errClusterStandby はスタンバイ側で外側パケットを送らなかったことを表す
+var errClusterStandby = errors.New("cluster standby")
+
+// ClusterConfigは2台のデーモンでアクティブ・スタンバイを組む設定を保持する（トップレベルのみ、Linuxのみ）
+//
+// アクティブ側だけがvipをvip_ifaceに付けて外側パケットを送受信し、スタンバイ側はTAPから読んだフレームを送らない。
+type ClusterConfig struct {
+	Listen       string   `yaml:"listen"`        // ハートビート・状態同期を受信するUDPアドレス（例: 0.0.0.0:4790、空で無効）
+	Peer         string   `yaml:"peer"`          // 相方のデーモンのアドレス（host:port）
+	Key          string   `yaml:"key"`           // ハートビートのHMAC鍵（16文字以上、両方で同じ値）
+	KeyEnv       string   `yaml:"key_env"`       // 鍵を読む環境変数（keyより優先）
+	Priority     int      `yaml:"priority"`      // 高い方がアクティブ（1-255、既定100、同じならホスト名の大きい方）
+	Preempt      bool     `yaml:"preempt"`       // 優先度の高い方が復帰したらアクティブを取り戻す
+	Interval     string   `yaml:"interval"`      // ハートビートの間隔（既定200ms）
+	DeadAfter    string   `yaml:"dead_after"`    // 相方を停止とみなす無応答時間（既定intervalの5倍）
+	SyncInterval string   `yaml:"sync_interval"` // アクティブ側がFDBを送る間隔（既定1s）
+	VIP          []string `yaml:"vip"`           // アクティブ側に付けるトンネル端点のアドレス（CIDR、アドレスファミリごとに1つ、送信元に使う）
+	VIPIface     string   `yaml:"vip_iface"`     // vipを付けるインターフェース（既定src_iface）
+}
+
+// enabled はクラスタが設定されているかを返す関数
+func (c ClusterConfig) enabled() bool {
+	return c.Listen != ""
+}
+
+// clusterTapStateはトンネルごとに引き継ぐ送信番号
+type clusterTapState struct {
+	Seq  uint32 `json:"seq,omitempty"`  // sequenceの次の番号
+	Auth uint64 `json:"auth,omitempty"` // authの次の番号
+}
+
+// clusterFDBEntryは同期するFDBのエントリ1件（ピアは宛先ホストで表す）
+type clusterFDBEntry struct {
+	MAC  string `json:"mac"`
+	Peer string `json:"peer"`
+}
+
+// clusterMessageはハートビートとFDBの同期に使うデータグラム（JSONの後ろにHMAC-SHA256を付ける）
+type clusterMessage struct {
+	Node     string                     `json:"node"`
+	Priority int                        `json:"priority"`
+	Active   bool                       `json:"active"`
+	Claim    bool                       `json:"claim,omitempty"`  // 優先度が高いためアクティブを求めている（preempt）
+	Resign   bool                       `json:"resign,omitempty"` // 終了するため直ちに引き継いでほしい
+	Boot     uint64                     `json:"boot"`             // 送信側の起動ごとの乱数
+	Seq      uint64                     `json:"seq"`              // 起動ごとに1から増える送信番号
+	Echo     uint64                     `json:"echo"`             // 送信側が最後に受け入れた受信側の起動ごとの乱数（受信側の今回の起動に応答したことを示す）
+	Taps     map[string]clusterTapState `json:"taps,omitempty"`
+	Tap      string                     `json:"tap,omitempty"` // FDBの同期の対象トンネル
+	FDB      []clusterFDBEntry          `json:"fdb,omitempty"`
+}
+
+// clusterSettingは検証済みのクラスタ設定
+type clusterSetting struct {
+	listen   string
+	peer     string
+	priority int
+	preempt  bool
+	interval time.Duration
+	dead     time.Duration
+	sync     time.Duration
+	vips     []*net.IPNet
+	iface    string
+}
+
+// parseCluster はクラスタ設定を検証する関数
+func parseCluster(cfg *Config) (clusterSetting, error) {
+	c := cfg.Cluster
+	s := clusterSetting{listen: c.Listen, peer: c.Peer, priority: c.Priority, preempt: c.Preempt,
+		interval: clusterDefaultInterval, sync: clusterDefaultSync, iface: c.VIPIface}
+	if s.peer == "" {
+		return s, errors.New("peer is not specified")
+	}
+	if _, _, err := net.SplitHostPort(s.peer); err != nil {
+		return s, fmt.Errorf("peer: %w", err)
+	}
+	if s.priority == 0 {
+		s.priority = clusterDefaultPriority
+	}
+	if s.priority < 1 || s.priority > 255 {
+		return s, fmt.Errorf("priority %d out of range (1-255)", c.Priority)
+	}
+	durations := []struct {
+		key   string
+		value string
+		dst   *time.Duration
+	}{
+		{"interval", c.Interval, &s.interval},
+		{"dead_after", c.DeadAfter, &s.dead},
+		{"sync_interval", c.SyncInterval, &s.sync},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return s, fmt.Errorf("%s: %w", d.key, err)
+		}
+		if v <= 0 {
+			return s, fmt.Errorf("%s must be positive", d.key)
+		}
+		*d.dst = v
+	}
+	if s.dead == 0 {
+		s.dead = s.interval * clusterDeadFactor
+	}
+	if s.dead <= s.interval {
+		return s, fmt.Errorf("dead_after %v must be longer than interval %v", s.dead, s.interval)
+	}
+	if len(c.VIP) == 0 {
+		return s, errors.New("vip is not specified")
+	}
+	families := map[bool]bool{}
+	for _, v := range c.VIP {
+		ip, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return s, fmt.Errorf("vip: %w", err)
+		}
+		if families[ip.To4() != nil] {
+			return s, errors.New("vip has more than one address of the same family")
+		}
+		families[ip.To4() != nil] = true
+		n.IP = ip
+		s.vips = append(s.vips, n)
+	}
+	if s.iface == "" {
+		s.iface = cfg.SrcIface
+	}
+	if s.iface == "" {
+		return s, errors.New("vip_iface is not specified (and src_iface is empty)")
+	}
+	return s, nil
+}
+
+// clusterKey はクラスタの鍵（key_envが優先）を返す関数
+func clusterKey(c ClusterConfig) (string, error) {
+	key := c.Key
+	if c.KeyEnv != "" {
+		if key = os.Getenv(c.KeyEnv); key == "" {
+			return "", fmt.Errorf("environment variable %s is empty", c.KeyEnv)
+		}
+	}
+	if len(key) < authMinKeyLen {
+		return "", fmt.Errorf("key must be at least %d characters", authMinKeyLen)
+	}
+	return key, nil
+}
+
+// clusterNodeはハートビートで相方と優先度・状態を交換してアクティブを1台に決め、
+// アクティブ側からスタンバイ側へ送信番号とFDBを同期する
+type clusterNode struct {
+	set     clusterSetting
+	name    string
+	key     *secret
+	conn    *net.UDPConn
+	tunnels []*Tunnel
+
+	active   atomic.Bool
+	stopped  atomic.Bool // 終了処理でアクティブを降りた（以後は選出しない）
+	role     sync.Mutex  // アクティブ・スタンバイの切り替えを直列化する
+	mu       sync.Mutex
+	peer     *clusterMessage                       // 最後に受け取った相方のハートビート
+	seen     time.Time                             // 最後に相方から受け取った時刻
+	boot     uint64                                // 自ノードの起動ごとの乱数
+	next     atomic.Uint64                         // 自ノードの最後の送信番号
+	peerBoot uint64                                // 受け入れた相方の起動ごとの乱数
+	last     uint64                                // 受け入れた相方の送信番号（これ以前は破棄）
+	retired  map[uint64]bool                       // 相方の以前の起動の乱数（自ノードの今回の起動の間の再送を破棄）
+	taps     map[string]clusterTapState            // 相方から受け取った送信番号
+	fdb      map[string]map[string]clusterFDBEntry // トンネル → MAC → 相方のFDBのエントリ
+
+	transitions atomic.Uint64 // アクティブ・スタンバイの切り替え回数
+	sent        atomic.Uint64 // 送信したメッセージ数
+	received    atomic.Uint64 // 受け入れたメッセージ数
+	rejected    atomic.Uint64 // 相方以外・HMAC不一致・古い送信番号のため破棄したメッセージ数
+	unbound     atomic.Uint64 // 自ノードの今回の起動の乱数を返していないため、相方の起動の確認だけに使ったメッセージ数
+	dropped     atomic.Uint64 // スタンバイのため送らなかった外側パケット数
+	restored    atomic.Uint64 // 引き継ぎ時にFDBへ登録したエントリ数
+}
+
+// cluster はクラスタ構成時の自ノード（未設定ならnil）
+var cluster *clusterNode
+
+// newClusterNode はクラスタのUDPソケットを開く関数（RAWソケットの作成前に呼び、起動直後はスタンバイとする）
+//
+// vipが自ホストに付いていない間もRAWソケットをvipで開けるよう、ip_nonlocal_bindを有効にする。
+func newClusterNode(cfg *Config) (*clusterNode, error) {
+	set, err := parseCluster(cfg)
+	if err != nil {
+		return nil, err
+	}
+	key, err := clusterKey(cfg.Cluster)
+	if err != nil {
+		return nil, err
+	}
+	if err := enableNonlocalBind(set.vips); err != nil {
+		return nil, err
+	}
+	laddr, err := net.ResolveUDPAddr("udp", set.listen)
+	if err != nil {
+		return nil, fmt.Errorf("listen: %w", err)
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	registerCleanup(func() { conn.Close() })
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		name = set.listen
+	}
+	var boot [8]byte
+	if _, err := rand.Read(boot[:]); err != nil {
+		return nil, err
+	}
+	c := &clusterNode{set: set, name: name, key: newSecret(keyBytes(key)), conn: conn, boot: binary.BigEndian.Uint64(boot[:]),
+		taps: make(map[string]clusterTapState), fdb: make(map[string]map[string]clusterFDBEntry), retired: make(map[uint64]bool)}
+	logf("[INFO]", "Cluster node %s (priority %d) listening on %s, peer %s, vip %v on %s", name, set.priority, set.listen, set.peer, cfg.Cluster.VIP, set.iface)
+	return c, nil
+}
+
+// standby はスタンバイ中（外側パケットを送らない）かを返す関数（クラスタ未設定ならfalse）
+func (c *clusterNode) standby() bool {
+	return c != nil && !c.active.Load()
+}
+
+// source はアドレスファミリのvip（RAWソケットの送信元）を返す関数（クラスタ未設定・該当なしならnil）
+func (c *clusterNode) source(version int) net.IP {
+	if c == nil {
+		return nil
+	}
+	for _, v := range c.set.vips {
+		if (v.IP.To4() != nil) == (version == 4) {
+			return v.IP
+		}
+	}
+	return nil
+}
+
+// run はトンネルの起動後にハートビートの送受信と選出を始める関数
+//
+// 起動直後はdead_afterの間相方の応答を待ってから選出し、相方が動いていれば引き継がない。
+func (c *clusterNode) run(tunnels []*Tunnel) {
+	if c == nil {
+		return
+	}
+	c.tunnels = tunnels
+	registerCleanup(c.resign)
+	go c.receive()
+	go func() {
+		start := time.Now()
+		heartbeat := time.NewTicker(c.set.interval)
+		defer heartbeat.Stop()
+		lastSync := time.Now()
+		for range heartbeat.C {
+			if c.stopped.Load() {
+				return
+			}
+			if time.Since(start) >= c.set.dead {
+				c.elect()
+			}
+			c.send(c.heartbeat())
+			if c.active.Load() && time.Since(lastSync) >= c.set.sync {
+				c.syncFDB()
+				lastSync = time.Now()
+			}
+		}
+	}()
+}
+
+// outranks は優先度とノード名で比べ、自ノードが相方より上位かを返す関数
+func (c *clusterNode) outranks(peer *clusterMessage) bool {
+	if c.set.priority != peer.Priority {
+		return c.set.priority > peer.Priority
+	}
+	return c.name > peer.Node
+}
+
+// elect は相方の生存・状態・優先度からアクティブになるか・降りるかを決める関数
+//
+// 両方が同時にアクティブにならないよう、preemptでは上位のノードが要求（claim）を出し、
+// 下位のアクティブが降りたのを確かめてからアクティブになる。
+func (c *clusterNode) elect() {
+	c.mu.Lock()
+	peer, alive := c.peer, c.peer != nil && time.Since(c.seen) < c.set.dead && !c.peer.Resign
+	c.mu.Unlock()
+
+	active := c.active.Load()
+	want := active
+	switch {
+	case !alive:
+		want = true
+	case peer.Active && active:
+		want = c.outranks(peer) // 分断からの復旧時は上位を残す
+	case peer.Active:
+		want = false
+	case active:
+		want = !(peer.Claim && !c.outranks(peer))
+	default:
+		want = c.outranks(peer)
+	}
+	switch {
+	case want && !active:
+		reason := "peer is down"
+		if alive {
+			reason = "higher priority"
+		}
+		c.becomeActive(reason)
+	case !want && active:
+		c.becomeStandby("peer claimed active")
+	}
+}
+
+// wantsClaim は自ノードが上位でpreemptが有効なため、相方にアクティブを譲るよう求めるかを返す関数
+func (c *clusterNode) wantsClaim() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.set.preempt && !c.active.Load() && c.peer != nil && c.peer.Active && c.outranks(c.peer)
+}
+
+// becomeActive は相方から受け取った送信番号・FDBを引き継いでからvipを付け、GARP・非要請NAで知らせる関数
+func (c *clusterNode) becomeActive(reason string) {
+	c.role.Lock()
+	defer c.role.Unlock()
+	if c.stopped.Load() || c.active.Load() {
+		return
+	}
+	c.restore()
+	for _, v := range c.set.vips {
+		if err := addVIP(c.set.iface, v); err != nil {
+			logf("[ERROR]", "Cluster: failed to add vip %s to %s: %v", v, c.set.iface, err)
+		}
+	}
+	c.active.Store(true)
+	c.transitions.Add(1)
+	logf("[UPDATE]", "Cluster: %s is now ACTIVE (%s)", c.name, reason)
+	c.emit("cluster_active", reason)
+	go func() {
+		for i := 0; i < clusterGARPCount; i++ {
+			for _, v := range c.set.vips {
+				if err := announceVIP(c.set.iface, v.IP); err != nil {
+					logf("[WARN]", "Cluster: failed to announce vip %s: %v", v.IP, err)
+				}
+			}
+			time.Sleep(clusterGARPInterval)
+		}
+	}()
+}
+
+// becomeStandby は外側パケットの送信を止めてからvipを外す関数
+func (c *clusterNode) becomeStandby(reason string) {
+	c.role.Lock()
+	defer c.role.Unlock()
+	if !c.active.Load() {
+		return
+	}
+	c.active.Store(false)
+	for _, v := range c.set.vips {
+		if err := delVIP(c.set.iface, v); err != nil {
+			logf("[WARN]", "Cluster: failed to remove vip %s from %s: %v", v, c.set.iface, err)
+		}
+	}
+	c.transitions.Add(1)
+	logf("[UPDATE]", "Cluster: %s is now STANDBY (%s)", c.name, reason)
+	c.emit("cluster_standby", reason)
+}
+
+// resign は終了時にアクティブならvipを外し、相方へ直ちに引き継ぐよう知らせる関数
+func (c *clusterNode) resign() {
+	c.role.Lock()
+	defer c.role.Unlock()
+	c.stopped.Store(true)
+	if !c.active.Load() {
+		return
+	}
+	c.active.Store(false)
+	msg := c.heartbeat()
+	msg.Resign = true
+	c.send(msg)
+	for _, v := range c.set.vips {
+		delVIP(c.set.iface, v)
+	}
+	logf("[INFO]", "Cluster: resigned active role")
+}
+
+// emit は全トンネルのイベントとしてクラスタの状態変化を送る関数
+func (c *clusterNode) emit(name, detail string) {
+	for _, t := range c.tunnels {
+		t.events.emit(name, "", detail)
+	}
+}
+
+// heartbeat は自ノードの状態とトンネルごとの送信番号を載せたハートビートを作る関数
+func (c *clusterNode) heartbeat() *clusterMessage {
+	c.mu.Lock()
+	echo := c.peerBoot
+	c.mu.Unlock()
+	msg := &clusterMessage{Node: c.name, Priority: c.set.priority, Active: c.active.Load(), Claim: c.wantsClaim(), Boot: c.boot, Seq: c.next.Add(1), Echo: echo}
+	if msg.Active {
+		msg.Taps = make(map[string]clusterTapState, len(c.tunnels))
+		for _, t := range c.tunnels {
+			var st clusterTapState
+			if t.seq != nil {
+				st.Seq = t.seq.highest()
+			}
+			if t.auth != nil {
+				st.Auth = t.auth.seq.Load()
+			}
+			msg.Taps[t.cfg.TapName] = st
+		}
+	}
+	return msg
+}
+
+// syncFDB はアクティブ側の学習済みMACをトンネルごとに分けて相方へ送る関数
+func (c *clusterNode) syncFDB() {
+	for _, t := range c.tunnels {
+		if t.fdb == nil {
+			continue
+		}
+		var chunk []clusterFDBEntry
+		for _, e := range t.fdb.Entries() {
+			if e.Static {
+				continue // EVPNで登録したエントリは相方も自身で受け取る
+			}
+			chunk = append(chunk, clusterFDBEntry{MAC: e.MAC, Peer: e.Peer})
+			if len(chunk) == clusterFDBChunk {
+				c.sendFDB(t.cfg.TapName, chunk)
+				chunk = nil
+			}
+		}
+		if len(chunk) > 0 {
+			c.sendFDB(t.cfg.TapName, chunk)
+		}
+	}
+}
+
+// sendFDB はFDBのエントリの一部を送る関数
+func (c *clusterNode) sendFDB(tap string, entries []clusterFDBEntry) {
+	msg := c.heartbeat()
+	msg.Tap, msg.FDB, msg.Taps = tap, entries, nil
+	c.send(msg)
+}
+
+// send はメッセージにHMACを付けて相方へ送る関数
+func (c *clusterNode) send(msg *clusterMessage) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	b = c.key.sum(b, b)
+	addr, err := net.ResolveUDPAddr("udp", c.set.peer)
+	if err != nil {
+		return
+	}
+	if _, err := c.conn.WriteToUDP(b, addr); err == nil {
+		c.sent.Add(1)
+	}
+}
+
+// receive は相方のメッセージを検証して状態を更新する関数
+func (c *clusterNode) receive() {
+	buf := make([]byte, clusterMaxMessage)
+	for {
+		n, from, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		msg, ok := c.open(buf[:n], from)
+		if !ok {
+			continue
+		}
+		c.received.Add(1)
+		c.accept(msg)
+	}
+}
+
+// open はHMACと送信元を確かめてメッセージを取り出す関数
+//
+// 相方の時計には頼らず、起動ごとの乱数と送信番号で再送・順序の入れ替わりを破棄する。
+// 以前の起動の乱数の記録は自ノードの再起動で失われるため、自ノードの今回の起動の乱数（echo）を返した
+// メッセージだけを受け入れ、再起動前に記録されたハートビート・Resignの再送でアクティブが2台にならないようにする。
+// 乱数を返していないメッセージ（相方が自ノードの起動をまだ受け取っていない）は、返す乱数を覚えるだけに使う。
+func (c *clusterNode) open(b []byte, from *net.UDPAddr) (*clusterMessage, bool) {
+	if len(b) <= sha256.Size {
+		c.rejected.Add(1)
+		return nil, false
+	}
+	if host, _, err := net.SplitHostPort(c.set.peer); err == nil {
+		if ip := net.ParseIP(host); ip != nil && !ip.Equal(from.IP) {
+			c.rejected.Add(1)
+			return nil, false
+		}
+	}
+	body := b[:len(b)-sha256.Size]
+	if !hmac.Equal(c.key.sum(nil, body), b[len(body):]) {
+		c.rejected.Add(1)
+		return nil, false
+	}
+	var msg clusterMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		c.rejected.Add(1)
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if msg.Boot != c.peerBoot {
+		// 相方が再起動した（送信番号は1からやり直す）。以前の起動のメッセージは再送とみなす
+		if c.retired[msg.Boot] {
+			c.rejected.Add(1)
+			return nil, false
+		}
+		if c.peerBoot != 0 {
+			c.retired[c.peerBoot] = true
+		}
+		c.peerBoot, c.last = msg.Boot, 0
+	}
+	if msg.Seq <= c.last {
+		c.rejected.Add(1)
+		return nil, false // リプレイ・順序の入れ替わり
+	}
+	c.last = msg.Seq
+	if msg.Echo != c.boot {
+		c.unbound.Add(1)
+		return nil, false
+	}
+	return &msg, true
+}
+
+// accept は受け取ったハートビート・FDBを記録する関数（引き継ぎ時にrestoreで反映）
+func (c *clusterNode) accept(msg *clusterMessage) {
+	c.mu.Lock()
+	c.seen = time.Now()
+	if msg.Tap != "" {
+		entries := c.fdb[msg.Tap]
+		if entries == nil {
+			entries = make(map[string]clusterFDBEntry)
+			c.fdb[msg.Tap] = entries
+		}
+		for _, e := range msg.FDB {
+			entries[e.MAC] = e
+		}
+	} else {
+		c.peer = msg
+		for tap, st := range msg.Taps {
+			c.taps[tap] = st
+		}
+	}
+	resign := msg.Resign
+	c.mu.Unlock()
+	if resign && !c.active.Load() {
+		c.becomeActive("peer resigned")
+	}
+}
+
+// restore は相方の送信番号より先へ自ノードの番号を進め、相方のFDBを登録する関数
+//
+// 対向のリプレイ検出で引き継ぎ後のパケットが古いとみなされないよう、最後のハートビート以降に
+// 相方が送った分の余裕を足す（sequenceのgapはその分増える）。
+func (c *clusterNode) restore() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, t := range c.tunnels {
+		st, ok := c.taps[t.cfg.TapName]
+		if ok && t.seq != nil {
+			for _, peer := range t.peers {
+				t.seq.advance(peer.paths, st.Seq+clusterSeqMargin)
+			}
+		}
+		if ok && t.auth != nil {
+			if next := st.Auth + clusterAuthMargin; next > t.auth.seq.Load() {
+				t.auth.seq.Store(next)
+			}
+		}
+		if t.fdb == nil {
+			continue
+		}
+		for _, e := range c.fdb[t.cfg.TapName] {
+			mac, err := net.ParseMAC(e.MAC)
+			if err != nil || len(mac) != 6 {
+				continue
+			}
+			for _, peer := range t.peers {
+				if peer.Host == e.Peer {
+					if t.fdb.restore([6]byte(mac), peer) {
+						c.restored.Add(1)
+					}
+					break
+				}
+			}
+		}
+	}
+	clear(c.fdb)
+}
+
+// Counters はクラスタの状態と同期の数を返す
+func (c *clusterNode) Counters() map[string]uint64 {
+	active := uint64(0)
+	if c.active.Load() {
+		active = 1
+	}
+	return map[string]uint64{
+		"cluster_active":           active,
+		"cluster_transitions":      c.transitions.Load(),
+		"cluster_messages_sent":    c.sent.Load(),
+		"cluster_messages_rx":      c.received.Load(),
+		"cluster_messages_invalid": c.rejected.Load(),
+		"cluster_messages_unbound": c.unbound.Load(),
+		"cluster_standby_dropped":  c.dropped.Load(),
+		"cluster_fdb_restored":     c.restored.Load(),
+	}
+}
+
+// checkCluster はクラスタ設定を検証する関数
+func checkCluster(cfg *Config, r *checkResult) {
+	if runtime.GOOS != "linux" {
+		r.fail("cluster is supported only on Linux")
+	}
+	set, err := parseCluster(cfg)
+	if err != nil {
+		r.fail("cluster: %v", err)
+		return
+	}
+	if _, err := clusterKey(cfg.Cluster); err != nil {
+		r.fail("cluster: %v", err)
+	}
+	if _, err := net.ResolveUDPAddr("udp", set.listen); err != nil {
+		r.fail("cluster.listen: %v", err)
+	}
+	if !ifaceExists(set.iface) {
+		r.fail("cluster.vip_iface %s does not exist", set.iface)
+	}
+	versions := []int{cfg.Version}
+	if cfg.DualStack {
+		versions = append(versions, otherVersion(cfg.Version))
+	}
+	for _, v := range versions {
+		if (&clusterNode{set: set}).source(v) == nil {
+			r.warn("cluster.vip has no IPv%d address; the IPv%d path will not follow failover", v, v)
+		}
+	}
+	if set.dead < 3*set.interval {
+		r.warn("cluster.dead_after %v is less than three heartbeats (interval %v); a single lost heartbeat may cause a failover", set.dead, set.interval)
+	}
+}
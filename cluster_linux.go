@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// enableNonlocalBind はvipのアドレスファミリのip_nonlocal_bindを1にする関数（終了時に元の値へ戻す）
+func enableNonlocalBind(vips []*net.IPNet) error {
+	for _, v := range vips {
+		path := "/proc/sys/net/ipv4/ip_nonlocal_bind"
+		if v.IP.To4() == nil {
+			path = "/proc/sys/net/ipv6/ip_nonlocal_bind"
+		}
+		old, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(string(old)) == "1" {
+			continue
+		}
+		if err := os.WriteFile(path, []byte("1"), 0644); err != nil {
+			return err
+		}
+		registerCleanup(func() { os.WriteFile(path, old, 0644) })
+	}
+	return nil
+}
+
+// addVIP はクラスタのvipをインターフェースに付ける関数（IPv6はDADを待たずに使えるようにする）
+func addVIP(ifname string, vip *net.IPNet) error {
+	args := []string{"addr", "replace", vip.String(), "dev", ifname}
+	if vip.IP.To4() == nil {
+		args = append(args, "nodad")
+	}
+	if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// delVIP はクラスタのvipをインターフェースから外す関数（付いていなければ何もしない）
+func delVIP(ifname string, vip *net.IPNet) error {
+	out, err := exec.Command("ip", "addr", "del", vip.String(), "dev", ifname).CombinedOutput()
+	if err != nil && !strings.Contains(string(out), "Cannot assign requested address") {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// announceVIP はvipの移動を同じセグメントへ知らせる関数（IPv4はGARP、IPv6は非要請NA）
+func announceVIP(ifname string, ip net.IP) error {
+	ifi, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return err
+	}
+	if len(ifi.HardwareAddr) != 6 {
+		return nil // Ethernet以外（トンネル・ループバック）では不要
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return sendGARP(ifi, ip4)
+	}
+	return sendUnsolicitedNA(ifi, ip.To16())
+}
+
+// htons はホストバイトオーダーの16bit値をネットワークバイトオーダーへ変換する関数
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return binary.NativeEndian.Uint16(b[:])
+}
+
+// sendGARP は送信元・宛先をvipとしたARP要求（Gratuitous ARP）をブロードキャストする関数
+func sendGARP(ifi *net.Interface, ip net.IP) error {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, int(htons(syscall.ETH_P_ARP)))
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	b := make([]byte, 0, 28)
+	b = binary.BigEndian.AppendUint16(b, 1) // Ethernet
+	b = binary.BigEndian.AppendUint16(b, syscall.ETH_P_IP)
+	b = append(b, 6, 4)
+	b = binary.BigEndian.AppendUint16(b, 1) // request
+	b = append(b, ifi.HardwareAddr...)
+	b = append(b, ip...)
+	b = append(b, 0, 0, 0, 0, 0, 0)
+	b = append(b, ip...)
+
+	sa := &syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_ARP), Ifindex: ifi.Index, Halen: 6}
+	copy(sa.Addr[:], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	return syscall.Sendto(fd, b, 0, sa)
+}
+
+// sendUnsolicitedNA は全ノード宛て（ff02::1）に上書きフラグ付きの近隣広告を送る関数（チェックサムはカーネルが計算）
+func sendUnsolicitedNA(ifi *net.Interface, ip net.IP) error {
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW, syscall.IPPROTO_ICMPV6)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, 255); err != nil {
+		return err
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, ifi.Index); err != nil {
+		return err
+	}
+	src := &syscall.SockaddrInet6{}
+	copy(src.Addr[:], ip)
+	if err := syscall.Bind(fd, src); err != nil {
+		return err
+	}
+
+	msg := []byte{136, 0, 0, 0, 0x20, 0, 0, 0} // Neighbor Advertisement, Override
+	msg = append(msg, ip...)
+	msg = append(msg, 2, 1) // Target Link-Layer Address
+	msg = append(msg, ifi.HardwareAddr...)
+
+	dst := &syscall.SockaddrInet6{ZoneId: uint32(ifi.Index)}
+	copy(dst.Addr[:], net.ParseIP("ff02::1"))
+	return syscall.Sendto(fd, msg, 0, dst)
+}
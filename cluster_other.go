@@ -0,0 +1,28 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// enableNonlocalBind はLinux以外では未対応
+func enableNonlocalBind(vips []*net.IPNet) error {
+	return fmt.Errorf("cluster is not supported on this platform")
+}
+
+// addVIP はLinux以外では未対応
+func addVIP(ifname string, vip *net.IPNet) error {
+	return fmt.Errorf("cluster is not supported on this platform")
+}
+
+// delVIP はLinux以外では未対応
+func delVIP(ifname string, vip *net.IPNet) error {
+	return nil
+}
+
+// announceVIP はLinux以外では未対応
+func announceVIP(ifname string, ip net.IP) error {
+	return nil
+}
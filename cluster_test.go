@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCluster(t *testing.T) {
+	base := func() *Config {
+		return &Config{SrcIface: "eth0", Cluster: ClusterConfig{Listen: "0.0.0.0:4790", Peer: "192.0.2.2:4790", VIP: []string{"192.0.2.10/24"}}}
+	}
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+		err    string // 空で成功
+		check  func(t *testing.T, s clusterSetting)
+	}{
+		{"defaults", func(cfg *Config) {}, "", func(t *testing.T, s clusterSetting) {
+			if s.priority != clusterDefaultPriority || s.interval != clusterDefaultInterval || s.dead != clusterDefaultInterval*clusterDeadFactor ||
+				s.sync != clusterDefaultSync || s.iface != "eth0" {
+				t.Errorf("setting = %+v", s)
+			}
+		}},
+		{"explicit", func(cfg *Config) {
+			cfg.Cluster.Priority, cfg.Cluster.Interval, cfg.Cluster.DeadAfter, cfg.Cluster.SyncInterval = 200, "100ms", "1s", "5s"
+			cfg.Cluster.VIP = append(cfg.Cluster.VIP, "2001:db8::10/64")
+			cfg.Cluster.VIPIface = "bond0"
+		}, "", func(t *testing.T, s clusterSetting) {
+			if s.priority != 200 || s.interval != 100*time.Millisecond || s.dead != time.Second || s.sync != 5*time.Second || s.iface != "bond0" {
+				t.Errorf("setting = %+v", s)
+			}
+			if len(s.vips) != 2 || !s.vips[0].IP.Equal(net.ParseIP("192.0.2.10")) || !s.vips[1].IP.Equal(net.ParseIP("2001:db8::10")) {
+				t.Errorf("vips = %v", s.vips)
+			}
+		}},
+		{"no peer", func(cfg *Config) { cfg.Cluster.Peer = "" }, "peer is not specified", nil},
+		{"peer without port", func(cfg *Config) { cfg.Cluster.Peer = "192.0.2.2" }, "peer:", nil},
+		{"priority out of range", func(cfg *Config) { cfg.Cluster.Priority = 256 }, "out of range", nil},
+		{"negative interval", func(cfg *Config) { cfg.Cluster.Interval = "-1s" }, "interval must be positive", nil},
+		{"bad sync_interval", func(cfg *Config) { cfg.Cluster.SyncInterval = "soon" }, "sync_interval:", nil},
+		{"dead_after not longer than interval", func(cfg *Config) { cfg.Cluster.Interval, cfg.Cluster.DeadAfter = "1s", "1s" }, "must be longer than interval", nil},
+		{"no vip", func(cfg *Config) { cfg.Cluster.VIP = nil }, "vip is not specified", nil},
+		{"vip without prefix", func(cfg *Config) { cfg.Cluster.VIP = []string{"192.0.2.10"} }, "vip:", nil},
+		{"two vips of one family", func(cfg *Config) { cfg.Cluster.VIP = append(cfg.Cluster.VIP, "192.0.2.11/24") }, "more than one address", nil},
+		{"no iface", func(cfg *Config) { cfg.SrcIface = "" }, "vip_iface is not specified", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := base()
+			tt.modify(cfg)
+			s, err := parseCluster(cfg)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				tt.check(t, s)
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestClusterElect(t *testing.T) {
+	tests := []struct {
+		name     string
+		priority int
+		active   bool
+		peer     *clusterMessage // nilは相方からの受信なし
+		stale    bool            // 相方の最後の受信がdead_afterより前
+		want     bool
+	}{
+		{"no peer", 100, false, nil, false, true},
+		{"peer dead", 100, false, &clusterMessage{Node: "b", Priority: 200, Active: true}, true, true},
+		{"peer resigned", 100, false, &clusterMessage{Node: "b", Priority: 200, Active: false, Resign: true}, false, true},
+		{"peer active", 200, false, &clusterMessage{Node: "b", Priority: 100, Active: true}, false, false},
+		{"both standby, higher", 200, false, &clusterMessage{Node: "b", Priority: 100}, false, true},
+		{"both standby, lower", 100, false, &clusterMessage{Node: "b", Priority: 200}, false, false},
+		{"both standby, tie broken by name", 100, false, &clusterMessage{Node: "b", Priority: 100}, false, false},
+		{"split brain, higher stays", 200, true, &clusterMessage{Node: "b", Priority: 100, Active: true}, false, true},
+		{"split brain, lower steps down", 100, true, &clusterMessage{Node: "b", Priority: 200, Active: true}, false, false},
+		{"active, higher peer claims", 100, true, &clusterMessage{Node: "b", Priority: 200, Claim: true}, false, false},
+		{"active, lower peer claims", 200, true, &clusterMessage{Node: "b", Priority: 100, Claim: true}, false, true},
+		{"active, peer standby", 100, true, &clusterMessage{Node: "b", Priority: 200}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &clusterNode{set: clusterSetting{priority: tt.priority, interval: time.Second, dead: 5 * time.Second},
+				name: "a", taps: make(map[string]clusterTapState)}
+			c.active.Store(tt.active)
+			c.peer, c.seen = tt.peer, time.Now()
+			if tt.stale {
+				c.seen = time.Now().Add(-time.Minute)
+			}
+			c.elect()
+			if got := c.active.Load(); got != tt.want {
+				t.Errorf("active = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClusterOpen(t *testing.T) {
+	key := []byte("0123456789abcdef0123")
+	c := &clusterNode{set: clusterSetting{peer: "192.0.2.2:4790"}, key: newSecret(key), boot: 7, retired: make(map[uint64]bool)}
+	other := newSecret([]byte("fedcba9876543210fedc"))
+	peer := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 4790}
+	seal := func(s *secret, msg clusterMessage) []byte {
+		b, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.sum(b, b)
+	}
+
+	tests := []struct {
+		name string
+		b    []byte
+		from *net.UDPAddr
+		want bool
+	}{
+		{"before our boot was seen", seal(c.key, clusterMessage{Node: "b", Boot: 1, Seq: 1}), peer, false},
+		{"first", seal(c.key, clusterMessage{Node: "b", Boot: 1, Seq: 2, Echo: 7}), peer, true},
+		{"next", seal(c.key, clusterMessage{Node: "b", Boot: 1, Seq: 3, Echo: 7}), peer, true},
+		{"replayed", seal(c.key, clusterMessage{Node: "b", Boot: 1, Seq: 3, Echo: 7}), peer, false},
+		{"older", seal(c.key, clusterMessage{Node: "b", Boot: 1, Seq: 2, Echo: 7}), peer, false},
+		{"skipped ahead", seal(c.key, clusterMessage{Node: "b", Boot: 1, Seq: 10, Echo: 7}), peer, true},
+		{"echoes our previous boot", seal(c.key, clusterMessage{Node: "b", Boot: 1, Seq: 11, Echo: 6, Resign: true}), peer, false},
+		{"wrong key", seal(other, clusterMessage{Node: "b", Boot: 1, Seq: 12, Echo: 7}), peer, false},
+		{"wrong source", seal(c.key, clusterMessage{Node: "b", Boot: 1, Seq: 13, Echo: 7}), &net.UDPAddr{IP: net.ParseIP("192.0.2.3"), Port: 4790}, false},
+		{"too short", make([]byte, sha256.Size), peer, false},
+		{"peer restarted", seal(c.key, clusterMessage{Node: "b", Boot: 2, Seq: 1, Echo: 7}), peer, true},
+		{"previous boot replayed", seal(c.key, clusterMessage{Node: "b", Boot: 1, Seq: 20, Echo: 7}), peer, false},
+		{"after restart", seal(c.key, clusterMessage{Node: "b", Boot: 2, Seq: 2, Echo: 7}), peer, true},
+	}
+	for _, tt := range tests {
+		msg, ok := c.open(tt.b, tt.from)
+		if ok != tt.want {
+			t.Errorf("%s: open() = %v, want %v", tt.name, ok, tt.want)
+		}
+		if ok && msg.Node != "b" {
+			t.Errorf("%s: node = %q", tt.name, msg.Node)
+		}
+	}
+	if got := c.unbound.Load(); got != 2 {
+		t.Errorf("unbound = %d, want 2", got)
+	}
+	if got := c.heartbeat().Echo; got != 2 {
+		t.Errorf("heartbeat echo = %d, want the peer's boot 2", got)
+	}
+}
+
+func TestClusterOpenAfterRestart(t *testing.T) {
+	key := newSecret([]byte("0123456789abcdef0123"))
+	peer := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 4790}
+	seal := func(msg clusterMessage) []byte {
+		b, _ := json.Marshal(msg)
+		return key.sum(b, b)
+	}
+	// 再起動前（boot 7）の自ノードへ相方が送ったハートビート・終了通知と、相方の以前の起動のもの
+	recorded := [][]byte{
+		seal(clusterMessage{Node: "b", Boot: 1, Seq: 5, Echo: 7, Active: true}),
+		seal(clusterMessage{Node: "b", Boot: 1, Seq: 6, Echo: 7, Resign: true}),
+		seal(clusterMessage{Node: "b", Boot: 2, Seq: 3, Echo: 7, Resign: true}),
+	}
+
+	c := &clusterNode{set: clusterSetting{peer: "192.0.2.2:4790"}, key: key, boot: 8, retired: make(map[uint64]bool)}
+	for i, b := range recorded {
+		if _, ok := c.open(b, peer); ok {
+			t.Errorf("recorded message %d accepted after restart", i)
+		}
+	}
+	// 相方が今回の起動の乱数を返せば受け入れる
+	if _, ok := c.open(seal(clusterMessage{Node: "b", Boot: 3, Seq: 1, Echo: 8}), peer); !ok {
+		t.Error("current message rejected")
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"etherip/header"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// 圧縮関連の定数定義
+//
+// 圧縮したフレームはEtherIPヘッダの予約バイトに方式を入れ、続けて元のフレーム長(u16)を置く。
+const (
+	compNone = 0               // 非圧縮（通常のEtherIP）
+	compLZ4  = header.CompLZ4  // LZ4ブロック
+	compZstd = header.CompZstd // zstdフレーム
+
+	compHeaderLen      = 2 + 2 // EtherIPヘッダ + 元のフレーム長
+	compDefaultMinSize = 128   // 圧縮を試みる最小フレーム長の既定値
+	compMaxFrame       = 0xFFFF
+)
+
+// CompressionConfigはペイロード圧縮の設定を保持する（両端で同じ設定が必要）
+type CompressionConfig struct {
+	Algorithm string `yaml:"algorithm"` // off, lz4, zstd
+	MinSize   int    `yaml:"min_size"`  // これより短いフレームは圧縮しない
+}
+
+// compressorはEthernetフレームを圧縮してEtherIPパケットにする
+type compressor struct {
+	alg     byte
+	minSize int
+	lz4     sync.Pool // *lz4.Compressor
+	zenc    *zstd.Encoder
+	zdec    *zstd.Decoder
+
+	compressed   atomic.Uint64 // 圧縮して送信したフレーム数
+	incompress   atomic.Uint64 // 小さくならず非圧縮で送信したフレーム数
+	bytesIn      atomic.Uint64 // 圧縮前の合計バイト数（圧縮を試みたフレーム）
+	bytesOut     atomic.Uint64 // 送信した合計バイト数（圧縮を試みたフレーム）
+	decompressed atomic.Uint64 // 展開した受信フレーム数
+	decodeErrors atomic.Uint64 // 展開に失敗した受信フレーム数
+}
+
+// newCompressor は圧縮設定から圧縮器を生成する関数（無効ならnilを返す）
+func newCompressor(cfg CompressionConfig) (*compressor, error) {
+	c := &compressor{minSize: cfg.MinSize}
+	if c.minSize == 0 {
+		c.minSize = compDefaultMinSize
+	}
+
+	switch cfg.Algorithm {
+	case "", "off":
+		return nil, nil
+	case "lz4":
+		c.alg = compLZ4
+	case "zstd":
+		c.alg = compZstd
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm %q (off, lz4, zstd)", cfg.Algorithm)
+	}
+
+	c.lz4.New = func() interface{} { return &lz4.Compressor{} }
+	var err error
+	if c.zenc, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1)); err != nil {
+		return nil, err
+	}
+	if c.zdec, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(1<<20)); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// encode はフレームを圧縮したEtherIPパケットを返す関数（小さくならなければ通常のパケット）
+func (c *compressor) encode(frame []byte) []byte {
+	if len(frame) < c.minSize || len(frame) > compMaxFrame {
+		return buildEtherIPPacket(frame)
+	}
+
+	var packet []byte
+	switch c.alg {
+	case compLZ4:
+		packet = make([]byte, compHeaderLen+lz4.CompressBlockBound(len(frame)))
+		lc := c.lz4.Get().(*lz4.Compressor)
+		n, err := lc.CompressBlock(frame, packet[compHeaderLen:])
+		c.lz4.Put(lc)
+		if err != nil || n == 0 {
+			packet = nil
+		} else {
+			packet = packet[:compHeaderLen+n]
+		}
+	case compZstd:
+		packet = c.zenc.EncodeAll(frame, make([]byte, compHeaderLen, compHeaderLen+len(frame)))
+	}
+
+	c.bytesIn.Add(uint64(len(frame)))
+	if packet == nil || len(packet) >= len(frame)+2 {
+		c.incompress.Add(1)
+		c.bytesOut.Add(uint64(len(frame)))
+		return buildEtherIPPacket(frame)
+	}
+	h := header.New(uint16(c.alg))
+	copy(packet, h[:])
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(frame)))
+	c.compressed.Add(1)
+	c.bytesOut.Add(uint64(len(packet) - compHeaderLen))
+	return packet
+}
+
+// decode は圧縮されたペイロード（元のフレーム長を含む）をdstへ展開する関数
+func (c *compressor) decode(alg byte, payload, dst []byte) ([]byte, error) {
+	if len(payload) < 2 {
+		c.decodeErrors.Add(1)
+		return nil, errors.New("short compressed payload")
+	}
+	size := int(binary.BigEndian.Uint16(payload[0:2]))
+	if size > len(dst) {
+		c.decodeErrors.Add(1)
+		return nil, errors.New("frame too large")
+	}
+
+	var frame []byte
+	var err error
+	switch alg {
+	case compLZ4:
+		var n int
+		n, err = lz4.UncompressBlock(payload[2:], dst[:size])
+		frame = dst[:n]
+	case compZstd:
+		frame, err = c.zdec.DecodeAll(payload[2:], dst[:0])
+	default:
+		err = fmt.Errorf("unknown compression algorithm %d", alg)
+	}
+	if err == nil && len(frame) != size {
+		err = fmt.Errorf("length mismatch (%d != %d)", len(frame), size)
+	}
+	if err != nil {
+		c.decodeErrors.Add(1)
+		return nil, err
+	}
+	c.decompressed.Add(1)
+	return frame, nil
+}
+
+// Counters は圧縮のカウンタを返す（圧縮率は元サイズに対する百分率）
+func (c *compressor) Counters() map[string]uint64 {
+	var ratio uint64
+	if in := c.bytesIn.Load(); in > 0 {
+		ratio = c.bytesOut.Load() * 100 / in
+	}
+	return map[string]uint64{
+		"compress_frames":         c.compressed.Load(),
+		"compress_incompressible": c.incompress.Load(),
+		"compress_bytes_in":       c.bytesIn.Load(),
+		"compress_bytes_out":      c.bytesOut.Load(),
+		"compress_ratio_percent":  ratio,
+		"decompress_frames":       c.decompressed.Load(),
+		"decompress_errors":       c.decodeErrors.Load(),
+	}
+}
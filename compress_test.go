@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestCompressorRoundTrip(t *testing.T) {
+	random := make([]byte, 1400)
+	rand.New(rand.NewSource(1)).Read(random)
+	repetitive := bytes.Repeat([]byte("etherip-frame "), 100)
+
+	tests := []struct {
+		name       string
+		algorithm  string
+		frame      []byte
+		compressed bool
+	}{
+		{"lz4 repetitive", "lz4", repetitive, true},
+		{"zstd repetitive", "zstd", repetitive, true},
+		{"lz4 random", "lz4", random, false},
+		{"zstd random", "zstd", random, false},
+		{"lz4 below min_size", "lz4", repetitive[:64], false},
+		{"zstd below min_size", "zstd", repetitive[:64], false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newCompressor(CompressionConfig{Algorithm: tt.algorithm})
+			if err != nil {
+				t.Fatal(err)
+			}
+			packet := c.encode(tt.frame)
+			hc, _ := newHeaderChecker("strict", true, false, false)
+			alg, ok := hc.Check(packet)
+			if !ok {
+				t.Fatalf("header % x rejected", packet[:etherIPHeaderLen])
+			}
+			if (alg != compNone) != tt.compressed {
+				t.Fatalf("algorithm = %d, compressed = %v", alg, tt.compressed)
+			}
+			if alg == compNone {
+				if !bytes.Equal(packet[etherIPHeaderLen:], tt.frame) {
+					t.Fatal("uncompressed payload differs from the frame")
+				}
+				return
+			}
+			if len(packet) >= len(tt.frame) {
+				t.Errorf("compressed packet %d bytes, frame %d bytes", len(packet), len(tt.frame))
+			}
+			frame, err := c.decode(alg, packet[etherIPHeaderLen:], make([]byte, 2048))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(frame, tt.frame) {
+				t.Errorf("decoded frame differs (%d bytes, want %d)", len(frame), len(tt.frame))
+			}
+		})
+	}
+}
+
+func TestCompressorDecodeErrors(t *testing.T) {
+	c, err := newCompressor(CompressionConfig{Algorithm: "zstd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := c.encode(bytes.Repeat([]byte{0x5a}, 1000))
+	payload := packet[etherIPHeaderLen:]
+
+	tests := []struct {
+		name    string
+		alg     byte
+		payload []byte
+		dst     int
+	}{
+		{"short", compZstd, payload[:1], 2048},
+		{"frame larger than buffer", compZstd, payload, 999},
+		{"corrupt", compZstd, append([]byte{payload[0], payload[1]}, bytes.Repeat([]byte{0xff}, 16)...), 2048},
+		{"wrong algorithm", compLZ4, payload, 2048},
+		{"unknown algorithm", 9, payload, 2048},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := c.decode(tt.alg, tt.payload, make([]byte, tt.dst)); err == nil {
+				t.Error("decode succeeded")
+			}
+			if got := c.decodeErrors.Load(); got != uint64(i+1) {
+				t.Errorf("decodeErrors = %d, want %d", got, i+1)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// redactKeys は値を伏せる設定キー（パスの末尾要素で判定）
+var redactKeys = map[string]bool{"password": true, "secret": true, "token": true, "key": true}
+
+// ConfigChangeは設定差分の1項目
+type ConfigChange struct {
+	Path string      `json:"path"` // "tap0.keepalive_interval" のようなドット区切りのキー
+	Op   string      `json:"op"`   // added, removed, changed
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// ConfigDiffは再読み込み1回分の差分
+type ConfigDiff struct {
+	Time    int64          `json:"time"`
+	File    string         `json:"file"`
+	Changes []ConfigChange `json:"changes"`
+}
+
+// 実行中の設定と直近の差分
+var (
+	configMu       sync.Mutex
+	runningConfigs []*Config
+	lastDiff       *ConfigDiff
+)
+
+// flattenConfig はトンネルごとの設定をドット区切りのキーと値の組にする関数（秘密情報は伏せる）
+func flattenConfig(cfgs []*Config) map[string]interface{} {
+	flat := make(map[string]interface{})
+	for _, cfg := range cfgs {
+		data, err := yaml.Marshal(cfg)
+		if err != nil {
+			continue
+		}
+		var tree map[string]interface{}
+		yaml.Unmarshal(data, &tree)
+		delete(tree, "tunnels")
+		flattenValue(flat, cfg.TapName, tree)
+	}
+	return flat
+}
+
+// flattenValue はマップ・配列を再帰的に展開する関数
+func flattenValue(flat map[string]interface{}, path string, v interface{}) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, child := range val {
+			flattenValue(flat, path+"."+k, child)
+		}
+	case map[interface{}]interface{}:
+		for k, child := range val {
+			flattenValue(flat, fmt.Sprintf("%s.%v", path, k), child)
+		}
+	case []interface{}:
+		for i, child := range val {
+			flattenValue(flat, fmt.Sprintf("%s[%d]", path, i), child)
+		}
+	default:
+		if isZeroValue(v) {
+			return // 未指定と既定値を区別しない
+		}
+		if redactKeys[path[strings.LastIndexAny(path, ".")+1:]] {
+			v = "<redacted>"
+		}
+		flat[path] = v
+	}
+}
+
+// isZeroValue は値がゼロ値かどうかを判定する関数
+func isZeroValue(v interface{}) bool {
+	return v == nil || reflect.ValueOf(v).IsZero()
+}
+
+// diffConfigs は新旧の設定を比較して差分をキー順に返す関数
+//
+// 秘密情報は伏せた値同士で比較するため、変更された場合も値は表示しない。
+func diffConfigs(oldCfgs, newCfgs []*Config) []ConfigChange {
+	oldFlat, newFlat := flattenConfig(oldCfgs), flattenConfig(newCfgs)
+
+	var changes []ConfigChange
+	for k, ov := range oldFlat {
+		nv, ok := newFlat[k]
+		switch {
+		case !ok:
+			changes = append(changes, ConfigChange{Path: k, Op: "removed", Old: ov})
+		case !reflect.DeepEqual(ov, nv):
+			changes = append(changes, ConfigChange{Path: k, Op: "changed", Old: ov, New: nv})
+		}
+	}
+	for k, nv := range newFlat {
+		if _, ok := oldFlat[k]; !ok {
+			changes = append(changes, ConfigChange{Path: k, Op: "added", New: nv})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+// reloadConfig は設定ファイルを読み直して実行中の設定との差分を記録・ログ出力する関数
+//
+// 差分の適用にはプロセスの再起動が必要。
+func reloadConfig(path string) {
+	cfgs, err := loadConfigs(path)
+	if err != nil {
+		logf("[ERROR]", "Reload: %v", err)
+		return
+	}
+	wipeConfigKeys(cfgs) // 実行中の設定と同じく鍵を持たない状態で比べる
+
+	configMu.Lock()
+	defer configMu.Unlock()
+	diff := &ConfigDiff{Time: time.Now().Unix(), File: path, Changes: diffConfigs(runningConfigs, cfgs)}
+	lastDiff = diff
+
+	if len(diff.Changes) == 0 {
+		logf("[INFO]", "Reload: no configuration changes in %s", path)
+		return
+	}
+	logf("[UPDATE]", "Reload: %d configuration change(s) in %s", len(diff.Changes), path)
+	for _, c := range diff.Changes {
+		switch c.Op {
+		case "added":
+			logf("[UPDATE]", "  + %s: %v", c.Path, c.New)
+		case "removed":
+			logf("[UPDATE]", "  - %s: %v", c.Path, c.Old)
+		default:
+			logf("[UPDATE]", "  ~ %s: %v → %v", c.Path, c.Old, c.New)
+		}
+	}
+	logf("[WARN]", "Reload: restart the daemon to apply the changes above")
+}
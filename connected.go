@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// 接続済みRAWソケット関連の定数定義
+const (
+	connectedRetry = 10 * time.Second // 接続に失敗した宛先へ再び接続を試みるまでの間隔（その間は共有ソケットで送る）
+)
+
+// sockOptionはRAWソケットに設定するソケットオプション（接続済みソケットにも同じものを設定する）
+type sockOption func(*net.IPConn) error
+
+// dialedConnは経路の宛先へ接続済みのRAWソケット
+//
+// 宛先・送信元・ソケットオプションが変わったら作り直す。connがnilなら接続に失敗している。
+type dialedConn struct {
+	conn     *net.IPConn
+	dst      net.IP
+	src      net.IP
+	gen      uint32    // 接続時のソケットオプションの世代
+	failedAt time.Time // 接続に失敗した時刻
+}
+
+// sendCounterは送信のシステムコールの回数と所要時間の累計を保持する
+//
+// 接続済み（connected_socket）と未接続（WriteTo）の1パケットあたりの時間を比べ、改善を確認する。
+type sendCounter struct {
+	calls atomic.Uint64
+	nanos atomic.Uint64
+}
+
+// observe は送信1回の所要時間を記録する関数
+func (c *sendCounter) observe(start time.Time) {
+	c.calls.Add(1)
+	c.nanos.Add(uint64(time.Since(start)))
+}
+
+// setOption はソケットオプションを共有ソケットに設定し、以後の接続済みソケットにも設定されるよう記録する関数
+//
+// --simulate時のメモリ上のソケットには設定するものがないため何もしない。
+func (s *Socket) setOption(opt sockOption) error {
+	if s.sim != nil {
+		return nil
+	}
+	if err := opt(s.Conn); err != nil {
+		return err
+	}
+	s.optMu.Lock()
+	s.opts = append(s.opts, opt)
+	s.optMu.Unlock()
+	s.optGen.Add(1) // 既存の接続済みソケットは次の送信で作り直す
+	return nil
+}
+
+// dial は宛先へ接続済みのRAWソケットを作る関数
+//
+// 送信専用のため受信は捨てる（受信は共有ソケットで行う）。src_auto時は送信元を指定せずカーネルに選ばせる。
+func (s *Socket) dial(src, dst net.IP) (*net.IPConn, error) {
+	var laddr *net.IPAddr
+	if !src.IsUnspecified() {
+		laddr = &net.IPAddr{IP: src, Zone: s.laddr.Zone}
+	}
+	raddr := &net.IPAddr{IP: dst}
+	if dst.IsLinkLocalUnicast() {
+		raddr.Zone = s.laddr.Zone
+	}
+	conn, err := net.DialIP(s.proto, laddr, raddr)
+	if err != nil {
+		return nil, err
+	}
+	if err := discardReceive(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.optMu.Lock()
+	opts := s.opts
+	s.optMu.Unlock()
+	for _, opt := range opts {
+		if err := opt(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// connection は経路の現在の宛先へ接続済みのソケットを返す関数（接続できなければnil）
+//
+// DNSの再解決・ローミング・src_autoで宛先や送信元が変わっていれば接続し直す。
+func (p *Path) connection() *net.IPConn {
+	dst := p.Dst.Load().(net.IP)
+	src := p.SrcIP.Load().(net.IP)
+	gen := p.sock.optGen.Load()
+	if d := p.dialed.Load(); d != nil && d.dst.Equal(dst) && d.src.Equal(src) && d.gen == gen {
+		if d.conn != nil || time.Since(d.failedAt) < connectedRetry {
+			return d.conn
+		}
+	}
+	return p.redial(src, dst, gen)
+}
+
+// redial は宛先へ接続し直し、古い接続を閉じる関数
+func (p *Path) redial(src, dst net.IP, gen uint32) *net.IPConn {
+	p.dialMu.Lock()
+	defer p.dialMu.Unlock()
+	if d := p.dialed.Load(); d != nil && d.dst.Equal(dst) && d.src.Equal(src) && d.gen == gen && d.conn != nil {
+		return d.conn // 他の送信goroutineが接続し直した
+	}
+
+	next := &dialedConn{dst: dst, src: src, gen: gen}
+	conn, err := p.sock.dial(src, dst)
+	if err != nil {
+		next.failedAt = time.Now()
+		logf("[WARN]", "Connected IPv%d socket to %s (%s): %v; falling back to the shared socket", p.Version, p.Host, dst, err)
+	} else {
+		next.conn = conn
+	}
+	if prev := p.dialed.Swap(next); prev != nil && prev.conn != nil {
+		prev.conn.Close()
+		p.sock.redials.Add(1)
+	}
+	return next.conn
+}
+
+// Counters は送信のシステムコールの回数・所要時間と接続し直した回数を返す
+//
+// tx_send_ns_connected / tx_send_connected と tx_send_ns_unconnected / tx_send_unconnected が1パケットあたりの送信時間（ns）。
+func (s *Socket) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"tx_send_connected":      s.sendConnected.calls.Load(),
+		"tx_send_ns_connected":   s.sendConnected.nanos.Load(),
+		"tx_send_unconnected":    s.sendUnconnected.calls.Load(),
+		"tx_send_ns_unconnected": s.sendUnconnected.nanos.Load(),
+		"tx_connected_redials":   s.redials.Load(),
+		"rx_truncated":           s.truncated.Load(),
+	}
+}
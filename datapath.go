@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// 外側パケットの受信方式
+const (
+	datapathStandard = "standard"  // RAWソケット（net.ListenIP）から1パケットずつ読む
+	datapathAFPacket = "af_packet" // AF_PACKETのTPACKET_V3受信リングからまとめて読む
+	datapathAFXDP    = "af_xdp"    // af_packetの別名（XDPプログラムのローダーを持たないため、TPACKET_V3の受信リングを使う）
+)
+
+// parseDatapath はdatapathの設定値を検証する関数（空なら標準）
+func parseDatapath(mode string) (string, error) {
+	switch mode {
+	case "", datapathStandard:
+		return datapathStandard, nil
+	case datapathAFPacket, datapathAFXDP:
+		return datapathAFPacket, nil
+	}
+	return "", fmt.Errorf("unknown datapath %q (standard, af_packet, af_xdp)", mode)
+}
+
+// isAFPacket はdatapathがaf_packet（別名のaf_xdpを含む）かを返す関数
+func isAFPacket(mode string) bool {
+	return mode == datapathAFPacket || mode == datapathAFXDP
+}
+
+// ipv4Checksum はIPv4ヘッダのチェックサムを計算する関数（正しいヘッダ全体を渡すと0を返す）
+func ipv4Checksum(hdr []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(hdr); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(hdr[i:]))
+	}
+	for sum > 0xFFFF {
+		sum = sum&0xFFFF + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// parseOuterPacket の判定結果
+const (
+	outerOK        = iota
+	outerBadHeader // IPヘッダが不正
+	outerFragment  // 断片化されている（カーネルより前で読むため再構築しない）
+	outerOther     // 上位プロトコルが別（自分宛てではない）
+)
+
+// parseOuterPacket はカーネルより前で読んだ外側のIPパケット（af_packetの受信リング・bpf(4)）を検証し、
+// 宛先・送信元・protoのペイロード・TTL（ホップリミット）を返す関数
+func parseOuterPacket(pkt []byte, proto byte) (dst, src net.IP, payload []byte, hops, result int) {
+	if len(pkt) == 0 {
+		return nil, nil, nil, 0, outerBadHeader
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 {
+			return nil, nil, nil, 0, outerBadHeader
+		}
+		ihl, total := int(pkt[0]&0x0F)*4, int(binary.BigEndian.Uint16(pkt[2:4]))
+		if ihl < 20 || total < ihl || total > len(pkt) || ipv4Checksum(pkt[:ihl]) != 0 {
+			return nil, nil, nil, 0, outerBadHeader
+		}
+		if pkt[9] != proto {
+			return nil, nil, nil, 0, outerOther
+		}
+		if binary.BigEndian.Uint16(pkt[6:8])&0x3FFF != 0 {
+			return nil, nil, nil, 0, outerFragment
+		}
+		return pkt[16:20], pkt[12:16], pkt[ihl:total], int(pkt[8]), outerOK
+	case 6:
+		payload, fragment, ok := ipv6Payload(pkt, proto)
+		switch {
+		case !ok:
+			return nil, nil, nil, 0, outerBadHeader
+		case fragment:
+			return nil, nil, nil, 0, outerFragment
+		case payload == nil:
+			return nil, nil, nil, 0, outerOther
+		}
+		return pkt[24:40], pkt[8:24], payload, int(pkt[7]), outerOK
+	}
+	return nil, nil, nil, 0, outerBadHeader
+}
+
+// outerReceiver はカーネルより前で外側パケットを読む受信方式（af_packetの受信リング・bpf(4)）に共通の受け渡しと計数
+type outerReceiver struct {
+	t     *Tunnel
+	socks map[int]*Socket // IPバージョン → ソケット
+
+	packets   atomic.Uint64 // 読んだパケット数
+	fragments atomic.Uint64 // 断片化されていたため破棄した数（再構築しない）
+	badHeader atomic.Uint64 // IPヘッダが不正で破棄した数
+	oversize  atomic.Uint64 // 受信バッファ（buffers.size）に収まらず破棄した数
+}
+
+// handle は読んだIPパケットを検証し、自分宛のEtherIPパケットを受信バッファへ複写して処理する関数
+func (r *outerReceiver) handle(pkt []byte) {
+	r.packets.Add(1)
+	dst, src, payload, hops, result := parseOuterPacket(pkt, etherIPProto)
+	switch result {
+	case outerBadHeader:
+		r.badHeader.Add(1)
+		return
+	case outerFragment:
+		r.fragments.Add(1)
+		return
+	case outerOther:
+		return
+	}
+	s := r.socks[int(pkt[0]>>4)]
+	if s == nil || !dst.Equal(s.SrcIP) {
+		return
+	}
+
+	if len(payload) > r.t.rxBufs.size {
+		r.oversize.Add(1)
+		return
+	}
+	buf := r.t.rxBufs.get()
+	n := copy(buf, payload)
+	r.t.receive(s, buf, n, &net.IPAddr{IP: append(net.IP(nil), src...)}, hops)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// TPACKET_V3受信リング関連の定数定義
+const (
+	packetVersion        = 10 // PACKET_VERSION
+	packetIgnoreOutgoing = 23 // PACKET_IGNORE_OUTGOING（Linux 4.20以降）
+	tpacketV3            = 2
+	tpStatusUser         = 1 // ブロックがユーザー空間に渡されている
+
+	ringBlockSize     = 1 << 20 // ブロック長（バイト）
+	ringBlockCount    = 32      // ブロック数（リング全体で32MiB）
+	ringFrameSize     = 2048    // V3では使われないが設定の検証に必要
+	ringRetireTimeout = 2       // パケットのあるブロックをユーザー空間へ渡すまでの待ち時間（ms）
+)
+
+// rawSocketMissesEtherIP はRAWソケットにEtherIPが届かないか（Linuxにはカーネルの実装がないため届く）
+const rawSocketMissesEtherIP = false
+
+// ringFilter は外側パケット（IPv4・IPv6のプロトコル番号97）だけをリングへ入れるBPFプログラム
+//
+// SOCK_DGRAMのためオフセットはIPヘッダ先頭から、EtherTypeは補助データ（SKF_AD_PROTOCOL）から読む。
+// IPv6は拡張ヘッダ（Hop-by-Hop・Routing・Fragment・AH・Destination Options）が続くパケットも入れ、ipv6Payloadで辿る。
+var ringFilter = []syscall.SockFilter{
+	{Code: syscall.BPF_LD | syscall.BPF_H | syscall.BPF_ABS, K: 0xFFFFF000},
+	{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jt: 0, Jf: 2, K: 0x0800},
+	{Code: syscall.BPF_LD | syscall.BPF_B | syscall.BPF_ABS, K: 9},
+	{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jt: 8, Jf: 9, K: etherIPProto},
+	{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jt: 0, Jf: 8, K: 0x86DD},
+	{Code: syscall.BPF_LD | syscall.BPF_B | syscall.BPF_ABS, K: 6},
+	{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jt: 5, Jf: 0, K: etherIPProto},
+	{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jt: 4, Jf: 0, K: ipv6HopByHop},
+	{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jt: 3, Jf: 0, K: ipv6Routing},
+	{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jt: 2, Jf: 0, K: ipv6Fragment},
+	{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jt: 1, Jf: 0, K: ipv6AH},
+	{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jt: 0, Jf: 1, K: ipv6DestOpts},
+	{Code: syscall.BPF_RET | syscall.BPF_K, K: 0x40000},
+	{Code: syscall.BPF_RET | syscall.BPF_K, K: 0},
+}
+
+// dropAllFilter はRAWソケットの受信を止めるBPFプログラム（送信には影響しない）
+var dropAllFilter = []syscall.SockFilter{
+	{Code: syscall.BPF_RET | syscall.BPF_K, K: 0},
+}
+
+// packetRingはsrc_ifaceのAF_PACKET受信リングから外側パケットを読み、受信処理へ渡す
+//
+// カーネルがブロック単位でまとめて渡すため、パケットごとのシステムコールが不要になる。
+// RAWソケットは送信専用とし、受信はBPFで止める。
+type packetRing struct {
+	outerReceiver
+	fd   int
+	ring []byte
+
+	kernelDrops atomic.Uint64 // リングが一杯でカーネルが破棄した数
+}
+
+// openPacketRing はsrc_ifaceにTPACKET_V3受信リングを作り、RAWソケットの受信を止める関数
+func openPacketRing(t *Tunnel, ifname string) (*packetRing, error) {
+	ifi, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return nil, err
+	}
+	proto := htons(syscall.ETH_P_ALL)
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, int(proto))
+	if err != nil {
+		return nil, err
+	}
+	r := &packetRing{outerReceiver: outerReceiver{t: t, socks: make(map[int]*Socket)}, fd: fd}
+	fail := func(err error) (*packetRing, error) {
+		if r.ring != nil {
+			syscall.Munmap(r.ring)
+		}
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	// バインド前にフィルタを付け、無関係なパケットがリングに入らないようにする
+	if err := syscall.AttachLsf(fd, ringFilter); err != nil {
+		return fail(err)
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_PACKET, packetVersion, tpacketV3); err != nil {
+		return fail(err)
+	}
+	syscall.SetsockoptInt(fd, syscall.SOL_PACKET, packetIgnoreOutgoing, 1)
+
+	// 386などsocketcall経由の環境もあるためx/sys/unixのラッパーで設定する
+	req := unix.TpacketReq3{
+		Block_size:     ringBlockSize,
+		Block_nr:       ringBlockCount,
+		Frame_size:     ringFrameSize,
+		Frame_nr:       ringBlockSize / ringFrameSize * ringBlockCount,
+		Retire_blk_tov: ringRetireTimeout,
+	}
+	if err := unix.SetsockoptTpacketReq3(fd, syscall.SOL_PACKET, syscall.PACKET_RX_RING, &req); err != nil {
+		return fail(err)
+	}
+	if r.ring, err = syscall.Mmap(fd, 0, ringBlockSize*ringBlockCount, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED); err != nil {
+		return fail(err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: proto, Ifindex: ifi.Index}); err != nil {
+		return fail(err)
+	}
+
+	for _, s := range t.socks {
+		raw, err := s.Conn.SyscallConn()
+		if err != nil {
+			return fail(err)
+		}
+		var serr error
+		if err := raw.Control(func(sfd uintptr) { serr = syscall.AttachLsf(int(sfd), dropAllFilter) }); err != nil {
+			return fail(err)
+		}
+		if serr != nil {
+			return fail(serr)
+		}
+		r.socks[s.Version] = s
+	}
+	return r, nil
+}
+
+// wait はリングにブロックが渡されるまで待つ関数
+func (r *packetRing) wait() {
+	fds := [1]struct {
+		fd             int32
+		events, revent int16
+	}{{fd: int32(r.fd), events: 0x1 | 0x8}} // POLLIN | POLLERR
+	syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&fds[0])), 1, 0, 0, 0, 0)
+}
+
+// run はリングのブロックを順に読み、各パケットを受信処理へ渡す関数
+func (r *packetRing) run() {
+	logf("[INFO]", "af_packet datapath: %d x %d KiB receive ring on %s", ringBlockCount, ringBlockSize>>10, r.t.cfg.SrcIface)
+	ne := binary.NativeEndian
+	for blk := 0; ; blk = (blk + 1) % ringBlockCount {
+		b := r.ring[blk*ringBlockSize : (blk+1)*ringBlockSize]
+		status := (*uint32)(unsafe.Pointer(&b[8]))
+		for atomic.LoadUint32(status)&tpStatusUser == 0 {
+			r.wait()
+		}
+
+		// struct tpacket_block_desc: num_pkts(+12), offset_to_first_pkt(+16)
+		// struct tpacket3_hdr: tp_next_offset(+0), tp_snaplen(+12), tp_net(+26)
+		num, off := ne.Uint32(b[12:]), ne.Uint32(b[16:])
+		for i := uint32(0); i < num; i++ {
+			h := b[off:]
+			snap, data := ne.Uint32(h[12:]), uint32(ne.Uint16(h[26:]))
+			r.handle(h[data : data+snap])
+			off += ne.Uint32(h[0:])
+		}
+		atomic.StoreUint32(status, 0)
+	}
+}
+
+// Counters はリングの受信数・破棄数を返す（カーネルの破棄数は読み出すたびに累計へ加える）
+func (r *packetRing) Counters() map[string]uint64 {
+	if st, err := unix.GetsockoptTpacketStatsV3(r.fd, syscall.SOL_PACKET, syscall.PACKET_STATISTICS); err == nil {
+		r.kernelDrops.Add(uint64(st.Drops))
+	}
+	return map[string]uint64{
+		"rx_ring_packets":      r.packets.Load(),
+		"rx_ring_fragments":    r.fragments.Load(),
+		"rx_ring_bad_header":   r.badHeader.Load(),
+		"rx_ring_oversize":     r.oversize.Load(),
+		"rx_ring_kernel_drops": r.kernelDrops.Load(),
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// rawSocketMissesEtherIP はRAWソケットにEtherIPが届かないか（OpenBSDはカーネルの etherip(4) が全て受け取り、
+// 一致するインターフェースがなければ破棄するため、bpf(4)で受信する）
+const rawSocketMissesEtherIP = true
+
+const (
+	bpfBufferSize = 1 << 20 // bpf(4)の受信バッファ長（net.bpf.bufsize・maxbufsizeで制限される）
+	etherHdrLen   = 14
+)
+
+// bpfFilter はsrc_iface（DLT_EN10MB）で受信した外側パケット（IPv4・IPv6のプロトコル番号97）だけを通すBPFプログラム
+//
+// af_packetの受信リングと同じく、IPv6は拡張ヘッダが続くパケットも通してipv6Payloadで辿る。
+var bpfFilter = []unix.BpfInsn{
+	{Code: unix.BPF_LD | unix.BPF_H | unix.BPF_ABS, K: 12},
+	{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 0, Jf: 2, K: 0x0800},
+	{Code: unix.BPF_LD | unix.BPF_B | unix.BPF_ABS, K: etherHdrLen + 9},
+	{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 8, Jf: 9, K: etherIPProto},
+	{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 0, Jf: 8, K: 0x86DD},
+	{Code: unix.BPF_LD | unix.BPF_B | unix.BPF_ABS, K: etherHdrLen + 6},
+	{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 5, Jf: 0, K: etherIPProto},
+	{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 4, Jf: 0, K: ipv6HopByHop},
+	{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 3, Jf: 0, K: ipv6Routing},
+	{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 2, Jf: 0, K: ipv6Fragment},
+	{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, Jf: 0, K: ipv6AH},
+	{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 0, Jf: 1, K: ipv6DestOpts},
+	{Code: unix.BPF_RET | unix.BPF_K, K: 0x40000},
+	{Code: unix.BPF_RET | unix.BPF_K, K: 0},
+}
+
+// packetRingはOpenBSDではsrc_ifaceのbpf(4)から外側パケットを読み、受信処理へ渡す
+//
+// カーネルの etherip(4) がプロトコル番号97を全て受け取るため、IP層より前でEtherIPを複写して受け取る。
+// RAWソケットは送信専用になる。
+type packetRing struct {
+	outerReceiver
+	fd  int
+	buf []byte
+
+	kernelDrops atomic.Uint64 // bpfのバッファが一杯でカーネルが破棄した数
+}
+
+// openPacketRing はsrc_ifaceのbpf(4)を開き、受信したEtherIPパケットだけを読めるようにする関数
+func openPacketRing(t *Tunnel, ifname string) (*packetRing, error) {
+	if ifname == "" {
+		return nil, errors.New("src_iface is required to receive EtherIP through bpf(4)")
+	}
+	ifr, err := newIfreq(ifname)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.Open("/dev/bpf", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	r := &packetRing{outerReceiver: outerReceiver{t: t, socks: make(map[int]*Socket)}, fd: fd}
+	fail := func(op string, err error) (*packetRing, error) {
+		unix.Close(fd)
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	// バッファ長はインターフェースを割り当てる前に決める
+	if err := unix.IoctlSetPointerInt(fd, unix.BIOCSBLEN, bpfBufferSize); err != nil {
+		return fail("BIOCSBLEN", err)
+	}
+	if err := bpfIoctl(fd, unix.BIOCSETIF, unsafe.Pointer(&ifr.buf[0])); err != nil {
+		return fail("BIOCSETIF", err)
+	}
+	if dlt, err := unix.IoctlGetInt(fd, unix.BIOCGDLT); err != nil {
+		return fail("BIOCGDLT", err)
+	} else if dlt != unix.DLT_EN10MB {
+		return fail("BIOCGDLT", fmt.Errorf("%s is not an Ethernet interface (DLT %d)", ifname, dlt))
+	}
+	prog := unix.BpfProgram{Len: uint32(len(bpfFilter)), Insns: &bpfFilter[0]}
+	if err := bpfIoctl(fd, unix.BIOCSETF, unsafe.Pointer(&prog)); err != nil {
+		return fail("BIOCSETF", err)
+	}
+	if err := unix.IoctlSetPointerInt(fd, unix.BIOCIMMEDIATE, 1); err != nil {
+		return fail("BIOCIMMEDIATE", err)
+	}
+	// 自分が送った外側パケットは読まない
+	if err := unix.IoctlSetPointerInt(fd, unix.BIOCSDIRFILT, unix.BPF_DIRECTION_OUT); err != nil {
+		return fail("BIOCSDIRFILT", err)
+	}
+	n, err := unix.IoctlGetInt(fd, unix.BIOCGBLEN)
+	if err != nil {
+		return fail("BIOCGBLEN", err)
+	}
+	r.buf = make([]byte, n)
+	for _, s := range t.socks {
+		r.socks[s.Version] = s
+	}
+	return r, nil
+}
+
+// bpfIoctl は構造体を引数にbpf(4)のioctlを発行する関数
+func bpfIoctl(fd int, req uint, arg unsafe.Pointer) error {
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(req), uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// run はbpf(4)から読んだバッファ内の各パケットを受信処理へ渡す関数
+func (r *packetRing) run() {
+	logf("[INFO]", "bpf datapath: receiving EtherIP on %s through bpf(4) (%d KiB buffer)", r.t.cfg.SrcIface, len(r.buf)>>10)
+	for {
+		n, err := unix.Read(r.fd, r.buf)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			logf("[ERROR]", "bpf read on %s: %v", r.t.cfg.SrcIface, err)
+			return
+		}
+		// struct bpf_hdr: bh_caplen(+8), bh_hdrlen(+16)、次のパケットはBPF_WORDALIGNした位置から
+		for off := 0; off+int(unsafe.Sizeof(unix.BpfHdr{})) <= n; {
+			h := (*unix.BpfHdr)(unsafe.Pointer(&r.buf[off]))
+			start, end := off+int(h.Hdrlen), off+int(h.Hdrlen)+int(h.Caplen)
+			if end > n {
+				break
+			}
+			if end-start > etherHdrLen {
+				r.handle(r.buf[start+etherHdrLen : end])
+			}
+			off = (end + unix.BPF_ALIGNMENT - 1) &^ (unix.BPF_ALIGNMENT - 1)
+		}
+	}
+}
+
+// Counters はbpfの受信数・破棄数を返す
+func (r *packetRing) Counters() map[string]uint64 {
+	var st unix.BpfStat
+	if bpfIoctl(r.fd, unix.BIOCGSTATS, unsafe.Pointer(&st)) == nil {
+		r.kernelDrops.Store(uint64(st.Drop))
+	}
+	return map[string]uint64{
+		"rx_bpf_packets":      r.packets.Load(),
+		"rx_bpf_fragments":    r.fragments.Load(),
+		"rx_bpf_bad_header":   r.badHeader.Load(),
+		"rx_bpf_oversize":     r.oversize.Load(),
+		"rx_bpf_kernel_drops": r.kernelDrops.Load(),
+	}
+}
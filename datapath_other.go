@@ -0,0 +1,24 @@
+//go:build !linux && !openbsd
+
+package main
+
+import "fmt"
+
+// rawSocketMissesEtherIP はRAWソケットにEtherIPが届かないか
+const rawSocketMissesEtherIP = false
+
+// packetRingはLinux・OpenBSD以外では未対応
+type packetRing struct{}
+
+// openPacketRing はLinux・OpenBSD以外では未対応
+func openPacketRing(t *Tunnel, ifname string) (*packetRing, error) {
+	return nil, fmt.Errorf("af_packet datapath is not supported on this platform")
+}
+
+// run はLinux・OpenBSD以外では何もしない
+func (r *packetRing) run() {}
+
+// Counters はLinux・OpenBSD以外では空
+func (r *packetRing) Counters() map[string]uint64 {
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+)
+
+// QueueInfoは/debug/etherip/queuesで返すトンネル1本分のキュー状態
+type QueueInfo struct {
+	Tap        string `json:"tap"`
+	TxQueue    int    `json:"tx_queue"`
+	TxQueueCap int    `json:"tx_queue_cap"`
+	RxQueue    int    `json:"rx_queue"`
+	RxQueueCap int    `json:"rx_queue_cap"`
+	TxDropped  uint64 `json:"tx_dropped"`
+	RxDropped  uint64 `json:"rx_dropped"`
+}
+
+// RuntimeInfoは/debug/etherip/queuesで返すランタイム全体の状態
+type RuntimeInfo struct {
+	Goroutines int         `json:"goroutines"`
+	GOMAXPROCS int         `json:"gomaxprocs"`
+	HeapAlloc  uint64      `json:"heap_alloc"`
+	NumGC      uint32      `json:"num_gc"`
+	Tunnels    []QueueInfo `json:"tunnels"`
+}
+
+// startDebug はpprof・expvar・キュー状態を返す診断用HTTPサーバを起動する関数
+//
+// 認証はないため、ループバックかUnixソケットで待ち受けること。
+func startDebug(addr string, tunnels []*Tunnel) error {
+	ln, err := listenAPI(addr)
+	if err != nil {
+		logf("[ERROR]", "Failed to listen debug on %s: %v", addr, err)
+		return err
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil && !strings.HasPrefix(addr, "unix:") {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			logf("[WARN]", "debug_listen %s is not a loopback address; profiles are served without authentication", addr)
+		}
+	}
+
+	// 各トンネルのカウンタを expvar の "etherip" として公開する
+	expvar.Publish("etherip", expvar.Func(func() interface{} {
+		all := make(map[string]map[string]uint64)
+		for _, t := range tunnels {
+			all[t.cfg.TapName] = t.counters()
+		}
+		return all
+	}))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/etherip/queues", func(w http.ResponseWriter, r *http.Request) {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		info := RuntimeInfo{
+			Goroutines: runtime.NumGoroutine(),
+			GOMAXPROCS: runtime.GOMAXPROCS(0),
+			HeapAlloc:  ms.HeapAlloc,
+			NumGC:      ms.NumGC,
+			Tunnels:    []QueueInfo{},
+		}
+		for _, t := range tunnels {
+			rxQueue, rxCap := t.recvQueueLen()
+			info.Tunnels = append(info.Tunnels, QueueInfo{
+				Tap:        t.cfg.TapName,
+				TxQueue:    len(t.sendChan),
+				TxQueueCap: cap(t.sendChan),
+				RxQueue:    rxQueue,
+				RxQueueCap: rxCap,
+				TxDropped:  t.dropped[DirTX].Load(),
+				RxDropped:  t.dropped[DirRX].Load(),
+			})
+		}
+		writeJSON(w, info)
+	})
+
+	logf("[INFO]", "Debug endpoints listening on %s", addr)
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			logf("[ERROR]", "Debug server: %v", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// サービスディスカバリ関連の定数定義
+const (
+	discoveryTimeout = 5 * time.Second
+
+	schemeConsul = "consul" // consul://サービス名?tag=タグ&dc=データセンタ
+	schemeEtcd   = "etcd"   // etcd:///キー（値はIPアドレスまたはホスト名、空白・カンマ区切りで複数可）
+	schemeDNSSD  = "dnssd"  // dnssd://_etherip._udp.example.com（SRVレコードのターゲットを解決）
+)
+
+// DiscoveryConfigは宛先をDNSの代わりにサービスディスカバリから引く設定を保持する
+//
+// dst_host・peersに "consul://", "etcd://", "dnssd://" で始まる名前を書くと、対応するバックエンドで解決する。
+type DiscoveryConfig struct {
+	Consul ConsulConfig `yaml:"consul"`
+	Etcd   EtcdConfig   `yaml:"etcd"`
+}
+
+// ConsulConfigはConsulのHTTP APIの接続先を保持する
+type ConsulConfig struct {
+	Address string `yaml:"address"` // 例: http://127.0.0.1:8500
+	Token   string `yaml:"token"`   // ACLトークン（X-Consul-Token）
+}
+
+// EtcdConfigはetcd v3のgRPCゲートウェイ（JSON API）の接続先を保持する
+type EtcdConfig struct {
+	Endpoints []string `yaml:"endpoints"` // 例: http://127.0.0.1:2379（記載順に試行）
+	Username  string   `yaml:"username"`
+	Password  string   `yaml:"password"`
+}
+
+// nameResolverは宛先の名前からアドレスファミリに合うIPアドレスとTTL（不明なら0）を引くバックエンド
+type nameResolver interface {
+	lookup(name string, version int) (net.IP, time.Duration, error)
+}
+
+// discoveryResolvers はスキームごとの名前解決バックエンド（dnssdは常に有効）
+var discoveryResolvers = map[string]nameResolver{schemeDNSSD: dnssdResolver{}}
+
+// initDiscovery はサービスディスカバリの設定からバックエンドを登録する関数
+func initDiscovery(cfg DiscoveryConfig) error {
+	client := &http.Client{Timeout: discoveryTimeout}
+	if cfg.Consul.Address != "" {
+		u, err := url.Parse(cfg.Consul.Address)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("consul.address %q must be an http(s) URL", cfg.Consul.Address)
+		}
+		discoveryResolvers[schemeConsul] = &consulResolver{address: strings.TrimSuffix(cfg.Consul.Address, "/"), token: cfg.Consul.Token, client: client}
+		logf("[INFO]", "Service discovery: consul at %s", cfg.Consul.Address)
+	}
+	if len(cfg.Etcd.Endpoints) > 0 {
+		for _, ep := range cfg.Etcd.Endpoints {
+			u, err := url.Parse(ep)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("etcd.endpoints: %q must be an http(s) URL", ep)
+			}
+		}
+		if (cfg.Etcd.Username == "") != (cfg.Etcd.Password == "") {
+			return errors.New("etcd.username and etcd.password must be set together")
+		}
+		discoveryResolvers[schemeEtcd] = &etcdResolver{cfg: cfg.Etcd, client: client}
+		logf("[INFO]", "Service discovery: etcd at %v", cfg.Etcd.Endpoints)
+	}
+	return nil
+}
+
+// discoveryScheme は宛先の名前がサービスディスカバリのスキームで始まればそのスキームを返す関数
+func discoveryScheme(host string) string {
+	scheme, _, ok := strings.Cut(host, "://")
+	if !ok {
+		return ""
+	}
+	return scheme
+}
+
+// lookupDiscovery はスキームに対応するバックエンドで宛先を解決する関数
+func lookupDiscovery(host string, version int) (net.IP, time.Duration, error) {
+	scheme := discoveryScheme(host)
+	r, ok := discoveryResolvers[scheme]
+	if !ok {
+		switch scheme {
+		case schemeConsul, schemeEtcd:
+			return nil, 0, fmt.Errorf("%s is not configured (discovery.%s)", scheme, scheme)
+		}
+		return nil, 0, fmt.Errorf("unknown discovery scheme %q (consul, etcd, dnssd)", scheme)
+	}
+	return r.lookup(host, version)
+}
+
+// pickAddress は候補（IPアドレスまたはホスト名）から指定ファミリの最初のアドレスを返す関数
+//
+// ホスト名はDNS（dns設定のリゾルバ）で解決し、そのTTLを返す。
+func pickAddress(candidates []string, version int) (net.IP, time.Duration, error) {
+	var lastErr error
+	for _, c := range candidates {
+		if c == "" {
+			continue
+		}
+		if ip := net.ParseIP(c); ip != nil {
+			if (version == 4) == (ip.To4() != nil) {
+				return ip, 0, nil
+			}
+			continue
+		}
+		ip, ttl, err := resolveDstTTL(c, version)
+		if err == nil {
+			return ip, ttl, nil
+		}
+		lastErr = err
+	}
+	if lastErr != nil {
+		return nil, 0, lastErr
+	}
+	return nil, 0, fmt.Errorf("no IPv%d address registered", version)
+}
+
+// consulResolverはConsulのヘルスチェックを通過しているサービスインスタンスのアドレスを返す
+type consulResolver struct {
+	address string
+	token   string
+	client  *http.Client
+}
+
+// consulServiceEntryは/v1/health/serviceの応答のうち使用する項目
+type consulServiceEntry struct {
+	Node struct {
+		Node    string
+		Address string
+	}
+	Service struct {
+		ID              string
+		Address         string
+		TaggedAddresses map[string]struct{ Address string }
+	}
+}
+
+// lookup はconsul://サービス名 の健全なインスタンスのうちノード名・サービスID順で最初のアドレスを返す
+func (r *consulResolver) lookup(name string, version int) (net.IP, time.Duration, error) {
+	u, err := url.Parse(name)
+	if err != nil || u.Host == "" {
+		return nil, 0, fmt.Errorf("invalid consul name %q (consul://service?tag=&dc=)", name)
+	}
+	q := url.Values{"passing": {"true"}}
+	if tag := u.Query().Get("tag"); tag != "" {
+		q.Set("tag", tag)
+	}
+	if dc := u.Query().Get("dc"); dc != "" {
+		q.Set("dc", dc)
+	}
+	req, err := http.NewRequest(http.MethodGet, r.address+"/v1/health/service/"+url.PathEscape(u.Host)+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if r.token != "" {
+		req.Header.Set("X-Consul-Token", r.token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul: %s", resp.Status)
+	}
+	var entries []consulServiceEntry
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&entries); err != nil {
+		return nil, 0, fmt.Errorf("consul: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil, 0, fmt.Errorf("consul: no passing instance of %s", u.Host)
+	}
+
+	// 再解決のたびに宛先が入れ替わらないよう順序を固定する
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Node.Node != entries[j].Node.Node {
+			return entries[i].Node.Node < entries[j].Node.Node
+		}
+		return entries[i].Service.ID < entries[j].Service.ID
+	})
+	var candidates []string
+	for _, e := range entries {
+		tagged := []string{"wan_ipv4", "lan_ipv4"}
+		if version == 6 {
+			tagged = []string{"wan_ipv6", "lan_ipv6"}
+		}
+		for _, key := range tagged {
+			candidates = append(candidates, e.Service.TaggedAddresses[key].Address)
+		}
+		candidates = append(candidates, e.Service.Address, e.Node.Address)
+	}
+	return pickAddress(candidates, version)
+}
+
+// etcdResolverはetcdのキーに登録された宛先のアドレスを返す
+type etcdResolver struct {
+	cfg    EtcdConfig
+	client *http.Client
+
+	mu    sync.Mutex
+	token string // 認証トークン（username設定時）
+}
+
+// lookup はetcd:///キー の値（IPアドレスまたはホスト名）から指定ファミリのアドレスを返す
+func (r *etcdResolver) lookup(name string, version int) (net.IP, time.Duration, error) {
+	u, err := url.Parse(name)
+	if err != nil || u.Host+u.Path == "" {
+		return nil, 0, fmt.Errorf("invalid etcd name %q (etcd:///key)", name)
+	}
+	key := u.Host + u.Path
+
+	var lastErr error
+	for _, ep := range r.cfg.Endpoints {
+		value, err := r.get(strings.TrimSuffix(ep, "/"), key)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return pickAddress(strings.FieldsFunc(value, func(c rune) bool { return c == ',' || c == ' ' || c == '\n' || c == '\t' }), version)
+	}
+	return nil, 0, lastErr
+}
+
+// get は1エンドポイントからキーの値を取得する関数（トークンの期限切れ時は認証し直して再試行する）
+func (r *etcdResolver) get(endpoint, key string) (string, error) {
+	for attempt := 0; ; attempt++ {
+		token, err := r.authenticate(endpoint, attempt > 0)
+		if err != nil {
+			return "", err
+		}
+		var res struct {
+			Kvs []struct {
+				Value string `json:"value"`
+			} `json:"kvs"`
+		}
+		status, err := r.post(endpoint+"/v3/kv/range", token, map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(key))}, &res)
+		if status == http.StatusUnauthorized && token != "" && attempt == 0 {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if len(res.Kvs) == 0 {
+			return "", fmt.Errorf("etcd: key %s not found", key)
+		}
+		value, err := base64.StdEncoding.DecodeString(res.Kvs[0].Value)
+		if err != nil {
+			return "", fmt.Errorf("etcd: %w", err)
+		}
+		return string(value), nil
+	}
+}
+
+// authenticate はusername設定時に認証トークンを返す関数（renewで取得し直す）
+func (r *etcdResolver) authenticate(endpoint string, renew bool) (string, error) {
+	if r.cfg.Username == "" {
+		return "", nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.token != "" && !renew {
+		return r.token, nil
+	}
+	var res struct {
+		Token string `json:"token"`
+	}
+	if _, err := r.post(endpoint+"/v3/auth/authenticate", "", map[string]string{"name": r.cfg.Username, "password": r.cfg.Password}, &res); err != nil {
+		return "", err
+	}
+	r.token = res.Token
+	return r.token, nil
+}
+
+// post はJSONをPOSTし、応答をvへ読み込む関数
+func (r *etcdResolver) post(url, token string, body, v any) (int, error) {
+	data, _ := json.Marshal(body)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, fmt.Errorf("etcd: %s", resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v); err != nil {
+		return resp.StatusCode, fmt.Errorf("etcd: %w", err)
+	}
+	return resp.StatusCode, nil
+}
+
+// dnssdResolverはDNS-SDのSRVレコードのターゲットのアドレスを返す
+type dnssdResolver struct{}
+
+// lookup はdnssd://名前 のSRVレコードを優先度・重み順に並べ、指定ファミリのアドレスを持つ最初のターゲットを返す
+//
+// dns.serversまたはfollow_ttl設定時はそのサーバへ問い合わせ、SRVとターゲットのTTLの小さい方を返す。
+func (dnssdResolver) lookup(name string, version int) (net.IP, time.Duration, error) {
+	u, err := url.Parse(name)
+	if err != nil || u.Host == "" {
+		return nil, 0, fmt.Errorf("invalid dnssd name %q (dnssd://_service._udp.domain)", name)
+	}
+	var srvs []*net.SRV
+	var ttl time.Duration
+	if resolver != nil {
+		srvs, ttl, err = resolver.lookupSRV(u.Host)
+	} else {
+		_, srvs, err = net.LookupSRV("", "", u.Host)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("dnssd: %w", err)
+	}
+
+	// 重みによる負荷分散は行わず、再解決のたびに宛先が入れ替わらないよう順序を固定する
+	sort.Slice(srvs, func(i, j int) bool {
+		if srvs[i].Priority != srvs[j].Priority {
+			return srvs[i].Priority < srvs[j].Priority
+		}
+		if srvs[i].Weight != srvs[j].Weight {
+			return srvs[i].Weight > srvs[j].Weight
+		}
+		return srvs[i].Target < srvs[j].Target
+	})
+	var candidates []string
+	for _, srv := range srvs {
+		if target := strings.TrimSuffix(srv.Target, "."); target != "" {
+			candidates = append(candidates, target)
+		}
+	}
+	ip, targetTTL, err := pickAddress(candidates, version)
+	if err != nil {
+		return nil, 0, err
+	}
+	if targetTTL > 0 && (ttl == 0 || targetTTL < ttl) {
+		ttl = targetTTL
+	}
+	return ip, ttl, nil
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// DNS関連の定数定義
+const (
+	dnsTimeout       = 5 * time.Second // 1サーバあたりの問い合わせタイムアウト
+	dnsDefaultMinTTL = 5 * time.Second // TTL追従時の再解決間隔の下限の既定値
+	dnsDefaultMaxTTL = time.Hour       // TTL追従時の再解決間隔の上限の既定値
+	dnsTypeA         = 1
+	dnsTypeAAAA      = 28
+	dnsTypeSRV       = 33
+)
+
+// DNSConfigは宛先の名前解決方法を保持する
+type DNSConfig struct {
+	// 問い合わせ先（記載順に試行、空でシステムのリゾルバ）
+	//   "192.0.2.53" / "192.0.2.53:53"     UDP（応答が切り詰められた場合はTCP）
+	//   "tls://192.0.2.53:853"              DNS over TLS
+	//   "https://dns.example/dns-query"     DNS over HTTPS
+	Servers   []string `yaml:"servers"`
+	FollowTTL bool     `yaml:"follow_ttl"` // resolve_intervalの代わりにレコードのTTLで再解決する
+	MinTTL    string   `yaml:"min_ttl"`    // TTL追従時の再解決間隔の下限
+	MaxTTL    string   `yaml:"max_ttl"`    // TTL追従時の再解決間隔の上限
+}
+
+// dnsResolverは指定サーバへ直接問い合わせ、TTLを取得できるリゾルバ
+type dnsResolver struct {
+	servers   []string
+	followTTL bool
+	minTTL    time.Duration
+	maxTTL    time.Duration
+	client    *http.Client
+}
+
+// resolver は宛先解決に使用するリゾルバ（nilならシステムのリゾルバ）
+var resolver *dnsResolver
+
+// initDNS はDNS設定からリゾルバを設定する関数
+//
+// follow_ttlのみ指定された場合は/etc/resolv.confのサーバへ直接問い合わせる。
+func initDNS(cfg DNSConfig) error {
+	if len(cfg.Servers) == 0 && !cfg.FollowTTL {
+		return nil
+	}
+
+	r := &dnsResolver{
+		servers:   cfg.Servers,
+		followTTL: cfg.FollowTTL,
+		minTTL:    dnsDefaultMinTTL,
+		maxTTL:    dnsDefaultMaxTTL,
+		client:    &http.Client{Timeout: dnsTimeout},
+	}
+	var err error
+	if cfg.MinTTL != "" {
+		if r.minTTL, err = time.ParseDuration(cfg.MinTTL); err != nil {
+			return fmt.Errorf("min_ttl: %w", err)
+		}
+	}
+	if cfg.MaxTTL != "" {
+		if r.maxTTL, err = time.ParseDuration(cfg.MaxTTL); err != nil {
+			return fmt.Errorf("max_ttl: %w", err)
+		}
+	}
+	if r.minTTL > r.maxTTL {
+		return fmt.Errorf("min_ttl (%v) must not exceed max_ttl (%v)", r.minTTL, r.maxTTL)
+	}
+
+	if len(r.servers) == 0 {
+		r.servers = systemNameservers()
+		if len(r.servers) == 0 {
+			return errors.New("follow_ttl requires dns.servers (no nameserver in /etc/resolv.conf)")
+		}
+	}
+	for _, s := range r.servers {
+		if !strings.HasPrefix(s, "https://") && !strings.HasPrefix(s, "tls://") {
+			if _, _, err := net.SplitHostPort(withDefaultPort(s, "53")); err != nil {
+				return fmt.Errorf("invalid DNS server %q: %w", s, err)
+			}
+		}
+	}
+
+	resolver = r
+	logf("[INFO]", "DNS servers: %v (follow_ttl=%v)", r.servers, r.followTTL)
+	return nil
+}
+
+// systemNameservers は/etc/resolv.confのnameserverを返す関数
+func systemNameservers() []string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var servers []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
+
+// withDefaultPort はポート指定がなければ既定のポートを付ける関数
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+// lookup は各サーバへ順に問い合わせ、指定ファミリの全てのアドレスとTTLを返す関数
+func (r *dnsResolver) lookup(host string, version int) ([]net.IP, time.Duration, error) {
+	qtype := uint16(dnsTypeA)
+	if version == 6 {
+		qtype = dnsTypeAAAA
+	}
+
+	var err error
+	for _, server := range r.servers {
+		var ips []net.IP
+		var ttl time.Duration
+		if ips, ttl, err = r.query(server, host, qtype); err == nil {
+			debugf(debugDNS, "%s IPv%d via %s: %v (ttl %v)", host, version, server, ips, ttl)
+			return ips, ttl, nil
+		}
+		debugf(debugDNS, "%s IPv%d via %s: %v", host, version, server, err)
+	}
+	return nil, 0, err
+}
+
+// queryID は問い合わせIDを返す関数（DoHはキャッシュ効率のためID=0とする、RFC 8484）
+func queryID(server string) uint16 {
+	if strings.HasPrefix(server, "https://") {
+		return 0
+	}
+	var b [2]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// query は1サーバへ問い合わせる関数
+func (r *dnsResolver) query(server, host string, qtype uint16) ([]net.IP, time.Duration, error) {
+	id := queryID(server)
+	msg, err := buildDNSQuery(id, host, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := r.exchange(server, msg)
+	if err != nil {
+		return nil, 0, err
+	}
+	return parseDNSResponse(resp, id, qtype)
+}
+
+// exchange は1サーバへDNSメッセージを送り、応答を返す関数
+func (r *dnsResolver) exchange(server string, msg []byte) (resp []byte, err error) {
+	switch {
+	case strings.HasPrefix(server, "https://"):
+		resp, err = r.exchangeHTTPS(server, msg)
+	case strings.HasPrefix(server, "tls://"):
+		addr := withDefaultPort(strings.TrimPrefix(server, "tls://"), "853")
+		resp, err = exchangeStream(addr, msg, true)
+	default:
+		addr := withDefaultPort(server, "53")
+		resp, err = exchangeUDP(addr, msg)
+		if err == nil && len(resp) > 2 && resp[2]&0x02 != 0 {
+			resp, err = exchangeStream(addr, msg, false) // TCビット: TCPで再問い合わせ
+		}
+	}
+	return resp, err
+}
+
+// exchangeUDP はUDPでDNSメッセージを送受信する関数
+func exchangeUDP(addr string, msg []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", addr, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// exchangeStream はTCPまたはTLS上で長さ付きDNSメッセージを送受信する関数
+func exchangeStream(addr string, msg []byte, useTLS bool) ([]byte, error) {
+	dialer := &net.Dialer{Timeout: dnsTimeout}
+	var conn net.Conn
+	var err error
+	if useTLS {
+		host, _, _ := net.SplitHostPort(addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(msg)))
+	if _, err := conn.Write(append(framed, msg...)); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	_, err = io.ReadFull(conn, resp)
+	return resp, err
+}
+
+// exchangeHTTPS はDNS over HTTPS（RFC 8484、POST）で問い合わせる関数
+func (r *dnsResolver) exchangeHTTPS(url string, msg []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+// buildDNSQuery は再帰要求付きの問い合わせメッセージを組み立てる関数
+func buildDNSQuery(id uint16, host string, qtype uint16) ([]byte, error) {
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = append(msg, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0) // RD, QDCOUNT=1
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid hostname %q", host)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	return binary.BigEndian.AppendUint16(msg, 1), nil // CLASS IN
+}
+
+// skipDNSName は圧縮を考慮してドメイン名を読み飛ばし、次のオフセットを返す関数
+func skipDNSName(msg []byte, off int) (int, error) {
+	for off < len(msg) {
+		b := int(msg[off])
+		switch {
+		case b == 0:
+			return off + 1, nil
+		case b&0xC0 == 0xC0:
+			return off + 2, nil
+		default:
+			off += 1 + b
+		}
+	}
+	return 0, errors.New("truncated DNS name")
+}
+
+// readDNSName は圧縮を展開してドメイン名を読み、次のオフセットとともに返す関数
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; off < len(msg); {
+		b := int(msg[off])
+		switch {
+		case b == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case b&0xC0 == 0xC0:
+			if off+1 >= len(msg) || jumps > 16 {
+				return "", 0, errors.New("malformed DNS name")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:off+2]) & 0x3FFF)
+			jumps++
+		default:
+			if off+1+b > len(msg) {
+				return "", 0, errors.New("truncated DNS name")
+			}
+			labels = append(labels, string(msg[off+1:off+1+b]))
+			off += 1 + b
+		}
+	}
+	return "", 0, errors.New("truncated DNS name")
+}
+
+// lookupSRV は各サーバへ順にSRVレコードを問い合わせ、レコードと最小TTLを返す関数
+func (r *dnsResolver) lookupSRV(name string) ([]*net.SRV, time.Duration, error) {
+	var err error
+	for _, server := range r.servers {
+		id := queryID(server)
+		var msg, resp []byte
+		if msg, err = buildDNSQuery(id, name, dnsTypeSRV); err != nil {
+			return nil, 0, err
+		}
+		if resp, err = r.exchange(server, msg); err != nil {
+			continue
+		}
+		var srvs []*net.SRV
+		var ttl time.Duration
+		if srvs, ttl, err = parseSRVResponse(resp, id); err == nil {
+			return srvs, ttl, nil
+		}
+	}
+	return nil, 0, err
+}
+
+// parseSRVResponse は応答からSRVレコードと最小TTLを取り出す関数
+func parseSRVResponse(msg []byte, id uint16) ([]*net.SRV, time.Duration, error) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[0:2]) != id || msg[2]&0x80 == 0 {
+		return nil, 0, errors.New("malformed DNS response")
+	}
+	if rcode := msg[3] & 0x0F; rcode != 0 {
+		return nil, 0, fmt.Errorf("DNS rcode %d", rcode)
+	}
+	qd := int(binary.BigEndian.Uint16(msg[4:6]))
+	an := int(binary.BigEndian.Uint16(msg[6:8]))
+
+	off := 12
+	var err error
+	for i := 0; i < qd; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, 0, err
+		}
+		off += 4
+	}
+
+	var srvs []*net.SRV
+	minTTL := uint32(0xFFFFFFFF)
+	for i := 0; i < an; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, 0, err
+		}
+		if off+10 > len(msg) {
+			return nil, 0, errors.New("truncated DNS answer")
+		}
+		rtype := binary.BigEndian.Uint16(msg[off : off+2])
+		ttl := binary.BigEndian.Uint32(msg[off+4 : off+8])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8 : off+10]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, 0, errors.New("truncated DNS answer")
+		}
+		minTTL = min(minTTL, ttl)
+		if rtype == dnsTypeSRV && rdlen > 6 {
+			target, _, err := readDNSName(msg, off+6)
+			if err != nil {
+				return nil, 0, err
+			}
+			srvs = append(srvs, &net.SRV{
+				Priority: binary.BigEndian.Uint16(msg[off : off+2]),
+				Weight:   binary.BigEndian.Uint16(msg[off+2 : off+4]),
+				Port:     binary.BigEndian.Uint16(msg[off+4 : off+6]),
+				Target:   target,
+			})
+		}
+		off += rdlen
+	}
+	if len(srvs) == 0 {
+		return nil, 0, errors.New("no SRV record in DNS response")
+	}
+	return srvs, time.Duration(minTTL) * time.Second, nil
+}
+
+// parseDNSResponse は応答から指定タイプの全てのアドレス（応答の順）と、それらまでの最小TTLを取り出す関数
+func parseDNSResponse(msg []byte, id uint16, qtype uint16) ([]net.IP, time.Duration, error) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[0:2]) != id || msg[2]&0x80 == 0 {
+		return nil, 0, errors.New("malformed DNS response")
+	}
+	if rcode := msg[3] & 0x0F; rcode != 0 {
+		return nil, 0, fmt.Errorf("DNS rcode %d", rcode)
+	}
+	qd := int(binary.BigEndian.Uint16(msg[4:6]))
+	an := int(binary.BigEndian.Uint16(msg[6:8]))
+
+	off := 12
+	var err error
+	for i := 0; i < qd; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, 0, err
+		}
+		off += 4
+	}
+
+	// CNAMEを辿る場合もTTLは経路上の最小値とする
+	minTTL := uint32(0xFFFFFFFF)
+	var ips []net.IP
+	for i := 0; i < an; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, 0, err
+		}
+		if off+10 > len(msg) {
+			return nil, 0, errors.New("truncated DNS answer")
+		}
+		rtype := binary.BigEndian.Uint16(msg[off : off+2])
+		ttl := binary.BigEndian.Uint32(msg[off+4 : off+8])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8 : off+10]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, 0, errors.New("truncated DNS answer")
+		}
+		minTTL = min(minTTL, ttl)
+		if rtype == qtype && (rdlen == 4 || rdlen == 16) {
+			ips = append(ips, net.IP(append([]byte(nil), msg[off:off+rdlen]...)))
+		}
+		off += rdlen
+	}
+	if len(ips) == 0 {
+		return nil, 0, errors.New("no address record in DNS response")
+	}
+	return ips, time.Duration(minTTL) * time.Second, nil
+}
+
+// resolveInterval はTTL追従時に次の再解決までの間隔を返す関数
+func (r *dnsResolver) resolveInterval(ttl time.Duration) time.Duration {
+	return max(r.minTTL, min(ttl, r.maxTTL))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+// domainName はトンネルが属するブロードキャストドメインの名前を返す関数
+//
+// domain未指定ならbr_name（off時はtap_name）とし、同じブリッジに参加するトンネルは同じドメインになる。
+func (c *Config) domainName() string {
+	switch {
+	case c.Domain != "":
+		return c.Domain
+	case c.BrName != "off":
+		return c.BrName
+	}
+	return c.TapName
+}
+
+// checkDomains はドメイン間でブリッジ・管理用TAPを共有していないことを確かめる関数
+//
+// 同じドメインの複数のトンネルは同じブリッジで1つのブロードキャストドメインとなるため、
+// ブリッジを使わないトンネル・別のブリッジに参加するトンネルを同じドメインにはできない。
+func checkDomains(cfgs []*Config) error {
+	bridges := make(map[string]string)  // br_name → ドメイン
+	members := make(map[string]*Config) // ドメイン → 最初のトンネル
+	locals := make(map[string]string)   // local_delivery.iface → tap_name
+	for _, cfg := range cfgs {
+		d := cfg.domainName()
+		if cfg.BrName != "off" {
+			if other, ok := bridges[cfg.BrName]; ok && other != d {
+				return fmt.Errorf("%s: br_name %s is already used by domain %s (domain %s must not share it)", cfg.TapName, cfg.BrName, other, d)
+			}
+			bridges[cfg.BrName] = d
+		}
+		if first, ok := members[d]; ok {
+			if cfg.BrName == "off" || first.BrName != cfg.BrName {
+				return fmt.Errorf("%s: domain %s spans several tunnels and needs the same br_name as %s (%s)", cfg.TapName, d, first.TapName, first.BrName)
+			}
+		} else {
+			members[d] = cfg
+		}
+		if ld := cfg.LocalDelivery.Iface; ld != "" {
+			if other, ok := locals[ld]; ok {
+				return fmt.Errorf("%s: local_delivery.iface %s is also used by %s", cfg.TapName, ld, other)
+			}
+			locals[ld] = cfg.TapName
+		}
+	}
+	return nil
+}
+
+// domainIsolationは同一プロセスの他のトンネルのピアから届いた外側パケットを、
+// roaming・許可リストの判定より前に破棄してドメイン間の混入を防ぐ
+type domainIsolation struct {
+	others  atomic.Pointer[[]*Tunnel] // 同一プロセスの他のトンネル（全トンネルの起動後に設定）
+	foreign atomic.Uint64             // 他のトンネルのピアが送信元のため破棄した数
+}
+
+// isolateTunnels は全トンネルの起動後に、各トンネルへ他のトンネルの一覧を設定する関数
+func isolateTunnels(tunnels []*Tunnel) {
+	for _, t := range tunnels {
+		if t.isolation == nil {
+			continue
+		}
+		var others []*Tunnel
+		for _, o := range tunnels {
+			if o != t {
+				others = append(others, o)
+			}
+		}
+		t.isolation.others.Store(&others)
+	}
+}
+
+// owned は送信元が他のトンネルのピアの宛先と一致するかを返す関数（一致すれば破棄数を数える）
+func (d *domainIsolation) owned(src net.IP, version int) bool {
+	others := d.others.Load()
+	if others == nil {
+		return false
+	}
+	for _, o := range *others {
+		for _, peer := range o.peers {
+			for _, p := range peer.paths {
+				if p.Version == version && p.Dst.Load().(net.IP).Equal(src) {
+					d.foreign.Add(1)
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Counters はドメイン間の混入を防いだ数を返す
+func (d *domainIsolation) Counters() map[string]uint64 {
+	return map[string]uint64{"rx_foreign_domain": d.foreign.Load()}
+}
+
+// DomainInfoは/domainsで返すブロードキャストドメインごとの集計
+type DomainInfo struct {
+	Name     string            `json:"name"`
+	Bridge   string            `json:"bridge,omitempty"` // br_name（off時は省略）
+	Taps     []string          `json:"taps"`
+	Peers    int               `json:"peers"`
+	PeersUp  int               `json:"peers_up"`
+	Counters map[string]uint64 `json:"counters"` // 所属するトンネルのカウンタの合計
+}
+
+// domainInfos はトンネルをドメインごとにまとめ、ピアの生存数とカウンタを合計する関数（名前順）
+func domainInfos(tunnels []*Tunnel) []DomainInfo {
+	byName := make(map[string]*DomainInfo)
+	var names []string
+	for _, t := range tunnels {
+		name := t.cfg.domainName()
+		d, ok := byName[name]
+		if !ok {
+			d = &DomainInfo{Name: name, Counters: make(map[string]uint64)}
+			if t.cfg.BrName != "off" {
+				d.Bridge = t.cfg.BrName
+			}
+			byName[name] = d
+			names = append(names, name)
+		}
+		d.Taps = append(d.Taps, t.cfg.TapName)
+		for _, ps := range t.peerStatus() {
+			d.Peers++
+			if ps.Up {
+				d.PeersUp++
+			}
+		}
+		for k, v := range t.counters() {
+			d.Counters[k] += v
+		}
+	}
+	sort.Strings(names)
+	infos := []DomainInfo{}
+	for _, name := range names {
+		infos = append(infos, *byName[name])
+	}
+	return infos
+}
+
+// handleDomains はGET /domains でトークンのテナントで参照できるトンネルのドメインごとの集計を返す関数
+func (s *apiServer) handleDomains(w http.ResponseWriter, r *http.Request) {
+	if list, ok := s.visible(w, r); ok {
+		writeJSON(w, domainInfos(list))
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+)
+
+// ECN関連の定数定義（IPv4のToS・IPv6のTraffic Classの下位2bit）
+const (
+	ecnNotECT = 0x0
+	ecnECT1   = 0x1 // L4S（RFC 9331）
+	ecnECT0   = 0x2
+	ecnCE     = 0x3
+)
+
+// ECNConfigは送信キューが溜まったときに内側IPパケットへECNのCEマークを付ける設定を保持する
+type ECNConfig struct {
+	Enabled      bool `yaml:"enabled"`
+	Threshold    int  `yaml:"threshold"`     // CEマークを付け始める送信キュー長（フレーム数、既定は送信キュー長の半分）
+	L4SThreshold int  `yaml:"l4s_threshold"` // ECT(1)のパケットにCEマークを付け始める送信キュー長（既定はthresholdと同じ、浅くするとL4Sのフローの遅延が減る）
+}
+
+// ecnMarkerは送信キュー長がしきい値を超えている間、ECN対応の内側IPv4/IPv6パケットにCEマークを付けるフィルタ
+//
+// 破棄ではなくマークで混雑を通知するため、内側のTCP・L4Sのフローがキューの溢れる前に送信を絞り、トンネル内の遅延が減る。
+// ECN非対応（Not-ECT）のパケットは変更しない。
+type ecnMarker struct {
+	queue     func() int // 現在の送信キュー長
+	threshold int
+	l4s       int
+
+	marked    atomic.Uint64 // ECT(0)にCEマークを付けた数
+	markedL4S atomic.Uint64 // ECT(1)にCEマークを付けた数
+	notECT    atomic.Uint64 // キューが溜まっていたがECN非対応でマークしなかった数
+}
+
+// newECNMarker はECNマークの設定から生成する関数（無効ならnilを返す）
+func newECNMarker(cfg ECNConfig, queue func() int, capacity int) (*ecnMarker, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if cfg.Threshold < 0 || cfg.L4SThreshold < 0 {
+		return nil, fmt.Errorf("threshold and l4s_threshold must not be negative")
+	}
+	m := &ecnMarker{queue: queue, threshold: max(1, capacity/2)}
+	if cfg.Threshold > 0 {
+		m.threshold = cfg.Threshold
+	}
+	m.l4s = m.threshold
+	if cfg.L4SThreshold > 0 {
+		m.l4s = cfg.L4SThreshold
+	}
+	if capacity > 0 && (m.threshold >= capacity || m.l4s >= capacity) {
+		return nil, fmt.Errorf("threshold %d and l4s_threshold %d must be below the send queue length %d", m.threshold, m.l4s, capacity)
+	}
+	logf("[INFO]", "ECN marking enabled (CE at send queue %d, ECT(1) at %d of %d)", m.threshold, m.l4s, capacity)
+	return m, nil
+}
+
+// Filter は送信キューが溜まっている間、ECN対応の内側IPパケットのECNフィールドをCEにする
+func (m *ecnMarker) Filter(dir Direction, frame []byte) ([]byte, Verdict) {
+	if dir != DirTX || len(frame) < 14 {
+		return frame, VerdictPass
+	}
+	queued := m.queue()
+	if queued < min(m.threshold, m.l4s) {
+		return frame, VerdictPass
+	}
+
+	off := 12
+	et := binary.BigEndian.Uint16(frame[off:])
+	for (et == tpid8021Q || et == tpid8021AD) && len(frame) >= off+vlanTagLen+2 {
+		off += vlanTagLen
+		et = binary.BigEndian.Uint16(frame[off:])
+	}
+	ip := frame[off+2:]
+
+	var ecn byte
+	switch {
+	case et == 0x0800 && len(ip) >= 20:
+		ecn = ip[1] & 0x03
+	case et == 0x86DD && len(ip) >= 40:
+		ecn = ip[1] >> 4 & 0x03
+	default:
+		return frame, VerdictPass
+	}
+	switch {
+	case ecn == ecnNotECT:
+		m.notECT.Add(1)
+		return frame, VerdictPass
+	case ecn == ecnCE:
+		return frame, VerdictPass
+	case ecn == ecnECT1 && queued >= m.l4s:
+		m.markedL4S.Add(1)
+	case ecn == ecnECT0 && queued >= m.threshold:
+		m.marked.Add(1)
+	default:
+		return frame, VerdictPass
+	}
+
+	if et == 0x0800 {
+		ihl := int(ip[0]&0x0F) * 4
+		ip[1] |= ecnCE
+		if ihl >= 20 && ihl <= len(ip) {
+			binary.BigEndian.PutUint16(ip[10:12], 0)
+			binary.BigEndian.PutUint16(ip[10:12], ipv4Checksum(ip[:ihl]))
+		}
+	} else {
+		ip[1] |= ecnCE << 4
+	}
+	return frame, VerdictPass
+}
+
+// Counters はCEマークを付けた数とマークできなかった数を返す
+func (m *ecnMarker) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"ecn_marked":     m.marked.Load(),
+		"ecn_marked_l4s": m.markedL4S.Load(),
+		"ecn_not_ect":    m.notECT.Load(),
+	}
+}
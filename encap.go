@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+
+	"etherip/header"
+)
+
+// カプセル化関連の定数定義
+const (
+	encapEtherIP = "etherip" // EtherIP（IPプロトコル97、RFC 3378）
+	encapGRETap  = "gretap"  // GRE（IPプロトコル47、RFC 2784/2890）でEthernetフレームを運ぶ
+	encapL2TPv3  = "l2tpv3"  // L2TPv3 over IP（IPプロトコル115、RFC 3931）の静的セッション
+
+	greTypeTEB     = 0x6558 // Transparent Ethernet Bridging
+	greFlagCsum    = 0x8000
+	greFlagKey     = 0x2000
+	greVersionMask = 0x0007
+	l2tpv3Proto    = 115
+	l2tpv3L2Spec   = 4 // 既定のL2固有サブレイヤ（Sビット・シーケンス番号、送信時は常に0）
+)
+
+// GREConfigはencap: gretap時のGREヘッダの設定を保持する
+type GREConfig struct {
+	Key *uint32 `yaml:"key"` // GREキー（省略でキーなし、対向と同じ値）
+}
+
+// L2TPv3Configはencap: l2tpv3時の静的セッションの設定を保持する（対向の設定と左右を入れ替えて一致させる）
+type L2TPv3Config struct {
+	SessionID     uint32 `yaml:"session_id"`      // 受信するセッションID（自身側、0以外）
+	PeerSessionID uint32 `yaml:"peer_session_id"` // 送信するセッションID（対向側、0以外）
+	Cookie        string `yaml:"cookie"`          // 受信時に照合するクッキー（16進数で4または8バイト、空でなし）
+	PeerCookie    string `yaml:"peer_cookie"`     // 送信時に付けるクッキー（16進数で4または8バイト、空でなし）
+	L2Spec        string `yaml:"l2spec"`          // L2固有サブレイヤ（none, default）
+}
+
+// encapsulationはEtherIP以外のカプセル化で、送受信時にEtherIPヘッダと相互に付け替える
+//
+// データパス内部（圧縮・認証・OAM・キャプチャ）は常にEtherIPの形式で扱い、ソケットとの境界でのみ変換する。
+// EtherIP時はnilとし、各メソッドは何もしない。
+type encapsulation struct {
+	kind   string
+	proto  int
+	header []byte // 送信時にEtherIPヘッダの代わりに付けるヘッダ
+
+	// 受信時の照合
+	greKey  *uint32
+	session uint32
+	cookie  []byte
+	l2spec  bool
+
+	invalid atomic.Uint64 // ヘッダが不正・セッションやキーが一致せず破棄した数
+}
+
+// newEncapsulation はカプセル化の設定を検証して生成する関数（EtherIPならnilを返す）
+func newEncapsulation(cfg *Config) (*encapsulation, error) {
+	switch cfg.Encap {
+	case "", encapEtherIP:
+		return nil, nil
+	case encapGRETap:
+		e := &encapsulation{kind: encapGRETap, proto: greProto, greKey: cfg.GRE.Key}
+		flags := uint16(0)
+		if e.greKey != nil {
+			flags |= greFlagKey
+		}
+		e.header = binary.BigEndian.AppendUint16(nil, flags)
+		e.header = binary.BigEndian.AppendUint16(e.header, greTypeTEB)
+		if e.greKey != nil {
+			e.header = binary.BigEndian.AppendUint32(e.header, *e.greKey)
+		}
+		return e, nil
+	case encapL2TPv3:
+		lc := cfg.L2TPv3
+		if lc.SessionID == 0 || lc.PeerSessionID == 0 {
+			return nil, fmt.Errorf("l2tpv3: session_id and peer_session_id must be non-zero")
+		}
+		e := &encapsulation{kind: encapL2TPv3, proto: l2tpv3Proto, session: lc.SessionID}
+		var err error
+		if e.cookie, err = parseL2TPCookie(lc.Cookie); err != nil {
+			return nil, fmt.Errorf("l2tpv3: cookie: %w", err)
+		}
+		peerCookie, err := parseL2TPCookie(lc.PeerCookie)
+		if err != nil {
+			return nil, fmt.Errorf("l2tpv3: peer_cookie: %w", err)
+		}
+		switch lc.L2Spec {
+		case "", "none":
+		case "default":
+			e.l2spec = true
+		default:
+			return nil, fmt.Errorf("l2tpv3: unknown l2spec %q (none, default)", lc.L2Spec)
+		}
+		e.header = binary.BigEndian.AppendUint32(nil, lc.PeerSessionID)
+		e.header = append(e.header, peerCookie...)
+		if e.l2spec {
+			e.header = append(e.header, make([]byte, l2tpv3L2Spec)...)
+		}
+		return e, nil
+	}
+	return nil, fmt.Errorf("unknown encap %q (etherip, gretap, l2tpv3)", cfg.Encap)
+}
+
+// checkEncap はEtherIP以外のカプセル化と併用できない設定がないか確認する関数
+//
+// 圧縮・認証・シーケンス番号はEtherIPヘッダのReservedや末尾の付加情報を使うため、GRE・L2TPv3の対向では解釈できない。
+func checkEncap(cfg *Config) error {
+	if cfg.Encap == "" || cfg.Encap == encapEtherIP {
+		return nil
+	}
+	switch {
+	case cfg.Compression.Algorithm != "" && cfg.Compression.Algorithm != "off":
+		return fmt.Errorf("compression requires encap etherip")
+	case cfg.Auth.Enabled:
+		return fmt.Errorf("auth requires encap etherip")
+	case cfg.Sequence.Enabled:
+		return fmt.Errorf("sequence requires encap etherip")
+	case cfg.Oversize.Action == oversizeSplit:
+		return fmt.Errorf("oversize.action split requires encap etherip")
+	case isAFPacket(cfg.Datapath):
+		return fmt.Errorf("datapath af_packet supports only encap etherip")
+	case cfg.Mirror.Collector != "" && cfg.Mirror.Encap == mirrorEncapEtherIP:
+		return fmt.Errorf("mirror encap etherip requires encap etherip")
+	}
+	return nil
+}
+
+// parseL2TPCookie は16進数のクッキーを解析する関数（空ならnil）
+func parseL2TPCookie(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 4 && len(b) != 8 {
+		return nil, fmt.Errorf("must be 4 or 8 bytes, got %d", len(b))
+	}
+	return b, nil
+}
+
+// protocol は外側IPヘッダのプロトコル番号を返す
+func (e *encapsulation) protocol() int {
+	if e == nil {
+		return etherIPProto
+	}
+	return e.proto
+}
+
+// String はカプセル化の表示名を返す
+func (e *encapsulation) String() string {
+	if e == nil {
+		return encapEtherIP
+	}
+	return e.kind
+}
+
+// overhead はEtherIPヘッダと比べて増える外側パケットのバイト数を返す（EtherIP時は0）
+func (e *encapsulation) overhead() int {
+	if e == nil {
+		return 0
+	}
+	return len(e.header) - etherIPHeaderLen
+}
+
+// wrap はEtherIPパケットのヘッダを送信用のヘッダに付け替える関数
+func (e *encapsulation) wrap(packet []byte) []byte {
+	if e == nil || len(packet) < etherIPHeaderLen {
+		return packet
+	}
+	out := make([]byte, len(e.header)+len(packet)-etherIPHeaderLen)
+	copy(out, e.header)
+	copy(out[len(e.header):], packet[etherIPHeaderLen:])
+	return out
+}
+
+// unwrap は受信したパケットのヘッダを検証し、EtherIPヘッダに付け替えた長さを返す関数（bufをその場で書き換える）
+func (e *encapsulation) unwrap(buf []byte, n int) (int, bool) {
+	if e == nil {
+		return n, true
+	}
+	hdr, ok := e.headerLen(buf[:n])
+	if !ok {
+		e.invalid.Add(1)
+		return 0, false
+	}
+	h := header.New(0)
+	copy(buf[etherIPHeaderLen:], buf[hdr:n])
+	copy(buf, h[:])
+	return n - hdr + etherIPHeaderLen, true
+}
+
+// headerLen は受信したヘッダを検証し、その長さを返す関数
+func (e *encapsulation) headerLen(packet []byte) (int, bool) {
+	switch e.kind {
+	case encapGRETap:
+		if len(packet) < 4 {
+			return 0, false
+		}
+		flags := binary.BigEndian.Uint16(packet[0:2])
+		if flags&greVersionMask != 0 || binary.BigEndian.Uint16(packet[2:4]) != greTypeTEB {
+			return 0, false
+		}
+		n := 4
+		if flags&greFlagCsum != 0 {
+			n += 4
+		}
+		hasKey := flags&greFlagKey != 0
+		if hasKey {
+			if len(packet) < n+4 {
+				return 0, false
+			}
+			if e.greKey == nil || binary.BigEndian.Uint32(packet[n:]) != *e.greKey {
+				return 0, false
+			}
+			n += 4
+		} else if e.greKey != nil {
+			return 0, false
+		}
+		if flags&greFlagSeq != 0 {
+			n += 4
+		}
+		return n, len(packet) >= n
+	case encapL2TPv3:
+		n := 4 + len(e.cookie)
+		if e.l2spec {
+			n += l2tpv3L2Spec
+		}
+		// セッションID 0は制御メッセージ（静的セッションでは使わない）
+		if len(packet) < n || binary.BigEndian.Uint32(packet[0:4]) != e.session {
+			return 0, false
+		}
+		if !bytes.Equal(packet[4:4+len(e.cookie)], e.cookie) {
+			return 0, false
+		}
+		return n, true
+	}
+	return 0, false
+}
+
+// Counters は受信時に破棄したパケット数を返す
+func (e *encapsulation) Counters() map[string]uint64 {
+	return map[string]uint64{"rx_encap_invalid": e.invalid.Load()}
+}
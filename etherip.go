@@ -0,0 +1,34 @@
+package main
+
+import "etherip/header"
+
+// EtherIPヘッダ関連の定数定義（ヘッダの組み立て・解析・検証はheaderパッケージ）
+const (
+	etherIPHeaderLen = header.Len
+	etherIPVersion   = header.Version
+)
+
+// headerCheckerは受信したEtherIPヘッダの検証器をカウンタの出力元にしたもの
+type headerChecker struct {
+	*header.Checker
+}
+
+// newHeaderChecker はheader_modeと有効な拡張（圧縮・シーケンス番号・分割）からヘッダ検証器を生成する関数
+func newHeaderChecker(mode string, comp, seq, frag bool) (*headerChecker, error) {
+	c, err := header.NewChecker(mode, header.Features{Comp: comp, Seq: seq, Frag: frag})
+	if err != nil {
+		return nil, err
+	}
+	return &headerChecker{c}, nil
+}
+
+// Counters は不正なヘッダのカウンタを返す
+func (hc *headerChecker) Counters() map[string]uint64 {
+	c := hc.Checker.Counters()
+	return map[string]uint64{
+		"rx_header_short":            c.Short,
+		"rx_header_bad_version":      c.BadVersion,
+		"rx_header_bad_reserved":     c.BadReserved,
+		"rx_header_reserved_ignored": c.ReservedIgnored,
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Webhook関連の定数定義
+const (
+	webhookDefaultRetries = 3                // 再送回数の既定値
+	webhookRetryBase      = time.Second      // 再送間隔（以降2倍ずつ）
+	webhookTimeout        = 10 * time.Second // 1回の送信のタイムアウト
+	eventDrainTimeout     = 5 * time.Second  // 終了時に送信完了を待つ時間
+)
+
+// WebhookConfigはライフサイクルイベントの送信先を保持する
+type WebhookConfig struct {
+	URL     string   `yaml:"url"`     // POST先URL
+	Secret  string   `yaml:"secret"`  // HMAC-SHA256署名鍵（空で署名しない）
+	Events  []string `yaml:"events"`  // 送信するイベント（空で全イベント）
+	Retries int      `yaml:"retries"` // 失敗時の再送回数
+}
+
+// Eventはトンネルのライフサイクルイベント
+type Event struct {
+	Event  string            `json:"event"` // up, down, peer_change, failover, recursion, corruption, silence, silence_end, src_change, loop, loop_end
+	Tap    string            `json:"tap"`
+	Tenant string            `json:"tenant,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Peer   string            `json:"peer,omitempty"`
+	Detail string            `json:"detail,omitempty"`
+	Time   int64             `json:"time"`
+}
+
+// 送信中のイベントと共有のHTTPクライアント
+var (
+	eventWG       sync.WaitGroup
+	webhookClient = &http.Client{Timeout: webhookTimeout}
+)
+
+// eventSinkはトンネル1本分のイベント送信先を保持する
+type eventSink struct {
+	tap      string
+	tenant   string
+	labels   map[string]string
+	webhooks []WebhookConfig
+}
+
+// newEventSink はトンネル設定からイベント送信先を生成する関数
+func newEventSink(cfg *Config) *eventSink {
+	e := &eventSink{tap: cfg.TapName, tenant: cfg.Tenant, labels: cfg.Labels}
+	for _, wh := range cfg.Webhooks {
+		if wh.Retries == 0 {
+			wh.Retries = webhookDefaultRetries
+		}
+		e.webhooks = append(e.webhooks, wh)
+	}
+	if len(e.webhooks) > 0 {
+		logf("[INFO]", "Event webhooks enabled for %s (%d endpoints)", e.tap, len(e.webhooks))
+	}
+	return e
+}
+
+// emit はイベントを購読しているWebhookへ非同期に送る関数（OpenTelemetryのスパンとしても記録する）
+func (e *eventSink) emit(name, peer, detail string) {
+	if e == nil {
+		return
+	}
+	now := time.Now()
+	otlp.span(name, otlpSpanInternal, now, now, nil, "etherip.tap", e.tap, "etherip.tenant", e.tenant, "etherip.peer", peer, "etherip.detail", detail)
+	if len(e.webhooks) == 0 {
+		return
+	}
+	payload, err := json.Marshal(Event{Event: name, Tap: e.tap, Tenant: e.tenant, Labels: e.labels, Peer: peer, Detail: detail, Time: time.Now().Unix()})
+	if err != nil {
+		return
+	}
+	for _, wh := range e.webhooks {
+		if len(wh.Events) > 0 && !slices.Contains(wh.Events, name) {
+			continue
+		}
+		eventWG.Add(1)
+		go func(wh WebhookConfig) {
+			defer eventWG.Done()
+			if err := postWebhook(wh, name, payload); err != nil {
+				logf("[WARN]", "Webhook %s (%s) failed: %v", wh.URL, name, err)
+			}
+		}(wh)
+	}
+}
+
+// waitEvents は送信中のイベントの完了を一定時間待つ関数
+func waitEvents(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		eventWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+// postWebhook はペイロードをPOSTし、失敗時は指数バックオフで再送する関数
+//
+// Secretが設定されていればX-EtherIP-Signatureヘッダに"sha256=<hex>"形式の署名を付ける。
+func postWebhook(wh WebhookConfig, name string, payload []byte) error {
+	var sig string
+	if wh.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(wh.Secret))
+		mac.Write(payload)
+		sig = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	var err error
+	delay := webhookRetryBase
+	for attempt := 0; attempt <= wh.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+
+		var req *http.Request
+		req, err = http.NewRequest(http.MethodPost, wh.URL, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-EtherIP-Event", name)
+		if sig != "" {
+			req.Header.Set("X-EtherIP-Signature", sig)
+		}
+
+		var resp *http.Response
+		resp, err = webhookClient.Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			return nil
+		}
+		err = fmt.Errorf("status %s", resp.Status)
+		// 429と5xx以外のエラー応答は再送しても結果が変わらない
+		if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+			return err
+		}
+	}
+	return err
+}
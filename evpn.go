@@ -0,0 +1,479 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BGP EVPN関連の定数定義
+const (
+	evpnAFI          = 25          // L2VPN
+	evpnSAFI         = 70          // EVPN
+	evpnRouteMACIP   = 2           // Route Type 2: MAC/IP Advertisement
+	evpnMACIPLen     = 33          // RD(8) + ESI(10) + Ethernet Tag(4) + MAC長(1) + MAC(6) + IP長(1) + ラベル(3)
+	evpnFlushEvery   = time.Second // 新しいローカルMACをまとめて広告する間隔
+	evpnRoutesPerMsg = 100
+)
+
+// EVPNConfigはBGP EVPNによるMACアドレスの広告・学習の設定を保持する
+//
+// FRRやGoBGPのルートリフレクタとセッションを張り、TAP側で学習したMACを
+// Route Type 2で広告し、他拠点のMACを受け取ってFDBへ固定登録する。
+type EVPNConfig struct {
+	Neighbor    string `yaml:"neighbor"`     // BGPネイバー（"192.0.2.1" または "192.0.2.1:179"、空で無効）
+	LocalAS     uint32 `yaml:"local_as"`     // 自AS番号
+	PeerAS      uint32 `yaml:"peer_as"`      // ネイバーのAS番号（省略時はlocal_asでiBGP）
+	RouterID    string `yaml:"router_id"`    // BGP識別子（省略時はsrc_ifaceのIPv4アドレス）
+	VNI         uint32 `yaml:"vni"`          // Ethernet Tagとラベルに使う識別子
+	RD          string `yaml:"rd"`           // Route Distinguisher（省略時は router_id:vni）
+	RouteTarget string `yaml:"route_target"` // Route Target "AS:番号"（省略時は local_as:vni）
+}
+
+// evpnRouteはRoute Type 2の1経路
+type evpnRoute struct {
+	mac     [6]byte
+	nextHop net.IP
+}
+
+// evpnSpeakerはBGPセッションを保持し、ローカルMACの広告とリモートMACの登録を行う
+type evpnSpeaker struct {
+	bgpNeighbor
+	t       *Tunnel
+	nextHop net.IP
+	vni     uint32
+	rd      [8]byte
+	rt      [8]byte
+
+	mu      sync.Mutex
+	conn    net.Conn
+	local   map[[6]byte]*atomic.Int64 // TAP側で観測したMACと最終観測時刻
+	pending map[[6]byte]bool          // 未広告のローカルMAC
+	remote  map[[6]byte]*Peer         // FDBへ登録したリモートMAC
+
+	established atomic.Bool
+	sent        atomic.Uint64
+	received    atomic.Uint64
+}
+
+// newEVPNSpeaker はEVPN設定を検証してスピーカーを生成する関数
+func newEVPNSpeaker(t *Tunnel, cfg EVPNConfig) (*evpnSpeaker, error) {
+	if t.fdb == nil {
+		return nil, errors.New("evpn requires multiple peers (peers)")
+	}
+	if cfg.VNI > 0xFFFFFF {
+		return nil, fmt.Errorf("vni %d out of range (0-16777215)", cfg.VNI)
+	}
+
+	e := &evpnSpeaker{
+		t:       t,
+		vni:     cfg.VNI,
+		local:   make(map[[6]byte]*atomic.Int64),
+		pending: make(map[[6]byte]bool),
+		remote:  make(map[[6]byte]*Peer),
+	}
+
+	// ネクストホップはトンネルの送信元アドレス
+	e.nextHop = t.peers[0].paths[0].SrcIP.Load().(net.IP)
+	if ip4 := e.nextHop.To4(); ip4 != nil {
+		e.nextHop = ip4
+	}
+	var err error
+	e.bgpNeighbor, err = newBGPNeighbor(cfg.Neighbor, cfg.LocalAS, cfg.PeerAS, cfg.RouterID, e.nextHop, bgpFamily{evpnAFI, evpnSAFI})
+	if err != nil {
+		return nil, err
+	}
+
+	rd := cfg.RD
+	if rd == "" {
+		rd = fmt.Sprintf("%s:%d", e.routerID, e.vni&0xFFFF)
+	}
+	if e.rd, err = parseRD(rd); err != nil {
+		return nil, fmt.Errorf("rd: %w", err)
+	}
+	rt := cfg.RouteTarget
+	if rt == "" {
+		rt = fmt.Sprintf("%d:%d", e.localAS, e.vni)
+	}
+	if e.rt, err = parseRouteTarget(rt); err != nil {
+		return nil, fmt.Errorf("route_target: %w", err)
+	}
+	return e, nil
+}
+
+// parseRD は "IPv4:番号" または "AS:番号" 形式のRoute Distinguisherを変換する関数
+func parseRD(s string) ([8]byte, error) {
+	var rd [8]byte
+	admin, num, ok := strings.Cut(s, ":")
+	if !ok {
+		return rd, fmt.Errorf("invalid %q", s)
+	}
+	if ip := net.ParseIP(admin).To4(); ip != nil {
+		n, err := strconv.ParseUint(num, 10, 16)
+		if err != nil {
+			return rd, err
+		}
+		binary.BigEndian.PutUint16(rd[0:2], 1)
+		copy(rd[2:6], ip)
+		binary.BigEndian.PutUint16(rd[6:8], uint16(n))
+		return rd, nil
+	}
+	as, err := strconv.ParseUint(admin, 10, 16)
+	if err != nil {
+		return rd, fmt.Errorf("invalid %q", s)
+	}
+	n, err := strconv.ParseUint(num, 10, 32)
+	if err != nil {
+		return rd, err
+	}
+	binary.BigEndian.PutUint16(rd[2:4], uint16(as))
+	binary.BigEndian.PutUint32(rd[4:8], uint32(n))
+	return rd, nil
+}
+
+// parseRouteTarget は "AS:番号" 形式のRoute Targetを拡張コミュニティへ変換する関数
+func parseRouteTarget(s string) ([8]byte, error) {
+	var rt [8]byte
+	admin, num, ok := strings.Cut(s, ":")
+	if !ok {
+		return rt, fmt.Errorf("invalid %q", s)
+	}
+	as, err := strconv.ParseUint(admin, 10, 32)
+	if err != nil {
+		return rt, err
+	}
+	if as <= 0xFFFF {
+		n, err := strconv.ParseUint(num, 10, 32)
+		if err != nil {
+			return rt, err
+		}
+		rt[0], rt[1] = 0x00, 0x02
+		binary.BigEndian.PutUint16(rt[2:4], uint16(as))
+		binary.BigEndian.PutUint32(rt[4:8], uint32(n))
+		return rt, nil
+	}
+	n, err := strconv.ParseUint(num, 10, 16)
+	if err != nil {
+		return rt, err
+	}
+	rt[0], rt[1] = 0x02, 0x02
+	binary.BigEndian.PutUint32(rt[2:6], uint32(as))
+	binary.BigEndian.PutUint16(rt[6:8], uint16(n))
+	return rt, nil
+}
+
+// appendMACIPRoute はRoute Type 2のNLRIを追加する関数
+func (e *evpnSpeaker) appendMACIPRoute(b []byte, mac [6]byte) []byte {
+	b = append(b, evpnRouteMACIP, evpnMACIPLen)
+	b = append(b, e.rd[:]...)
+	b = append(b, make([]byte, 10)...) // ESI（シングルホーム）
+	b = binary.BigEndian.AppendUint32(b, e.vni)
+	b = append(b, 48)
+	b = append(b, mac[:]...)
+	b = append(b, 0) // IPアドレスなし
+	return append(b, byte(e.vni>>16), byte(e.vni>>8), byte(e.vni))
+}
+
+// updateMessage はローカルMACの広告（withdraw=trueなら取り消し）のUPDATEを組み立てる関数
+func (e *evpnSpeaker) updateMessage(macs [][6]byte, withdraw bool) []byte {
+	var nlri []byte
+	for _, mac := range macs {
+		nlri = e.appendMACIPRoute(nlri, mac)
+	}
+	mp := binary.BigEndian.AppendUint16(nil, evpnAFI)
+	mp = append(mp, evpnSAFI)
+
+	var attrs []byte
+	if withdraw {
+		attrs = appendAttr(attrs, 0x80, bgpAttrMPUnreach, append(mp, nlri...))
+	} else {
+		mp = append(mp, byte(len(e.nextHop)))
+		mp = append(mp, e.nextHop...)
+		mp = append(mp, 0)
+		attrs = appendAttr(attrs, 0x40, bgpAttrOrigin, []byte{0})
+		if e.peerAS == e.localAS {
+			attrs = appendAttr(attrs, 0x40, bgpAttrASPath, nil)
+			attrs = appendAttr(attrs, 0x40, bgpAttrLocalPref, []byte{0, 0, 0, 100})
+		} else {
+			seg := []byte{2, 1}
+			attrs = appendAttr(attrs, 0x40, bgpAttrASPath, binary.BigEndian.AppendUint32(seg, e.localAS))
+		}
+		attrs = appendAttr(attrs, 0xC0, bgpAttrExtCommunty, e.rt[:])
+		attrs = appendAttr(attrs, 0x80, bgpAttrMPReach, append(mp, nlri...))
+	}
+
+	body := []byte{0, 0} // 取り消し経路（IPv4ユニキャスト）なし
+	body = binary.BigEndian.AppendUint16(body, uint16(len(attrs)))
+	return bgpMessage(bgpMsgUpdate, append(body, attrs...))
+}
+
+// parseMACIPRoutes はEVPN NLRIからRoute Type 2のMACアドレスを取り出す関数
+func parseMACIPRoutes(nlri []byte) [][6]byte {
+	var macs [][6]byte
+	for len(nlri) >= 2 {
+		rtype, rlen := nlri[0], int(nlri[1])
+		if len(nlri) < 2+rlen {
+			break
+		}
+		r := nlri[2 : 2+rlen]
+		if rtype == evpnRouteMACIP && len(r) >= 30 && r[22] == 48 {
+			var mac [6]byte
+			copy(mac[:], r[23:29])
+			macs = append(macs, mac)
+		}
+		nlri = nlri[2+rlen:]
+	}
+	return macs
+}
+
+// parseUpdate はUPDATEから広告・取り消されたEVPN経路を取り出す関数（Route Targetが一致しない広告は無視する）
+func (e *evpnSpeaker) parseUpdate(body []byte) (reach []evpnRoute, unreach [][6]byte, err error) {
+	_, attrs, _, err := splitUpdate(body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rtMatch, hasRT := false, false
+	var nh net.IP
+	var reachMACs [][6]byte
+	err = walkAttrs(attrs, func(code byte, v []byte) {
+		switch code {
+		case bgpAttrExtCommunty:
+			hasRT = true
+			for i := 0; i+8 <= len(v); i += 8 {
+				if [8]byte(v[i:i+8]) == e.rt {
+					rtMatch = true
+				}
+			}
+		case bgpAttrMPReach:
+			if len(v) < 5 || binary.BigEndian.Uint16(v[0:2]) != evpnAFI || v[2] != evpnSAFI {
+				return
+			}
+			nhLen := int(v[3])
+			if len(v) < 5+nhLen || (nhLen != 4 && nhLen != 16) {
+				return
+			}
+			nh = net.IP(append([]byte(nil), v[4:4+nhLen]...))
+			reachMACs = parseMACIPRoutes(v[5+nhLen:])
+		case bgpAttrMPUnreach:
+			if len(v) < 3 || binary.BigEndian.Uint16(v[0:2]) != evpnAFI || v[2] != evpnSAFI {
+				return
+			}
+			unreach = append(unreach, parseMACIPRoutes(v[3:])...)
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if !hasRT || rtMatch {
+		for _, mac := range reachMACs {
+			reach = append(reach, evpnRoute{mac: mac, nextHop: nh})
+		}
+	}
+	return reach, unreach, nil
+}
+
+// noteLocal はTAPから送信するフレームの送信元MACを記録する（未知のMACは広告待ちにする）
+func (e *evpnSpeaker) noteLocal(frame []byte) {
+	if len(frame) < 14 || frame[6]&0x01 != 0 {
+		return
+	}
+	var mac [6]byte
+	copy(mac[:], frame[6:12])
+	now := time.Now().UnixNano()
+
+	e.mu.Lock()
+	seen, ok := e.local[mac]
+	if !ok {
+		seen = &atomic.Int64{}
+		e.local[mac] = seen
+		e.pending[mac] = true
+	}
+	e.mu.Unlock()
+	seen.Store(now)
+}
+
+// peerByNextHop はネクストホップのアドレスを宛先とするピアを返す関数
+func (e *evpnSpeaker) peerByNextHop(nh net.IP) *Peer {
+	for _, peer := range e.t.peers {
+		for _, p := range peer.paths {
+			if dst, ok := p.Dst.Load().(net.IP); ok && dst.Equal(nh) {
+				return peer
+			}
+		}
+	}
+	return nil
+}
+
+// send はセッションへメッセージを書き込む関数（ロック取得済みで呼ぶ）
+func (e *evpnSpeaker) send(msg []byte) error {
+	if e.conn == nil {
+		return errors.New("not connected")
+	}
+	e.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := e.conn.Write(msg)
+	return err
+}
+
+// advertise はMACアドレスを最大evpnRoutesPerMsg件ずつUPDATEで送る関数（ロック取得済みで呼ぶ）
+func (e *evpnSpeaker) advertise(macs [][6]byte, withdraw bool) error {
+	for len(macs) > 0 {
+		n := min(len(macs), evpnRoutesPerMsg)
+		if err := e.send(e.updateMessage(macs[:n], withdraw)); err != nil {
+			return err
+		}
+		e.sent.Add(uint64(n))
+		macs = macs[n:]
+	}
+	return nil
+}
+
+// session はネイバーへ接続してセッションを確立し、切断まで処理する関数
+func (e *evpnSpeaker) session() error {
+	conn, r, hold, err := e.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// 確立したら全ローカルMACを広告する
+	e.mu.Lock()
+	e.conn = conn
+	all := make([][6]byte, 0, len(e.local))
+	for mac := range e.local {
+		all = append(all, mac)
+	}
+	clear(e.pending)
+	err = e.advertise(all, false)
+	e.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	e.established.Store(true)
+	logf("[INFO]", "EVPN session with %s established (hold %v, %d local MACs)", e.addr, hold, len(all))
+	defer e.teardown()
+
+	done := make(chan struct{})
+	defer close(done)
+	go bgpKeepalive(hold, done, func(msg []byte) error {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		return e.send(msg)
+	})
+
+	return bgpReadLoop(conn, r, hold, func(body []byte) error {
+		reach, unreach, err := e.parseUpdate(body)
+		if err != nil {
+			return err
+		}
+		e.applyRemote(reach, unreach)
+		return nil
+	})
+}
+
+// applyRemote はリモートMACの広告・取り消しをFDBへ反映する関数
+func (e *evpnSpeaker) applyRemote(reach []evpnRoute, unreach [][6]byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, r := range reach {
+		e.received.Add(1)
+		if r.nextHop.Equal(e.nextHop) {
+			continue // 自分が広告した経路
+		}
+		peer := e.peerByNextHop(r.nextHop)
+		if peer == nil {
+			logf("[WARN]", "EVPN: next hop %s of %s is not a configured peer", r.nextHop, net.HardwareAddr(r.mac[:]))
+			continue
+		}
+		e.t.fdb.install(r.mac, peer)
+		e.remote[r.mac] = peer
+	}
+	for _, mac := range unreach {
+		e.received.Add(1)
+		if _, ok := e.remote[mac]; ok {
+			e.t.fdb.uninstall(mac)
+			delete(e.remote, mac)
+		}
+	}
+}
+
+// teardown はセッション切断時にリモートMACをFDBから外し、フラッディングと学習に戻す関数
+func (e *evpnSpeaker) teardown() {
+	e.established.Store(false)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.conn = nil
+	for mac := range e.remote {
+		e.t.fdb.uninstall(mac)
+	}
+	clear(e.remote)
+}
+
+// flush は新しいローカルMACの広告と、エージングしたローカルMACの取り消しを行う関数
+func (e *evpnSpeaker) flush(now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var withdraw [][6]byte
+	deadline := now.Add(-e.t.fdb.aging).UnixNano()
+	for mac, seen := range e.local {
+		if seen.Load() < deadline {
+			delete(e.local, mac)
+			if !e.pending[mac] {
+				withdraw = append(withdraw, mac)
+			}
+			delete(e.pending, mac)
+		}
+	}
+	if e.conn == nil {
+		return
+	}
+
+	adds := make([][6]byte, 0, len(e.pending))
+	for mac := range e.pending {
+		adds = append(adds, mac)
+	}
+	if err := e.advertise(adds, false); err == nil {
+		clear(e.pending)
+	}
+	e.advertise(withdraw, true)
+}
+
+// run はネイバーとのセッションを維持し、ローカルMACの変化を広告する関数
+func (e *evpnSpeaker) run() {
+	logf("[INFO]", "EVPN: neighbor %s (AS %d → %d, VNI %d)", e.addr, e.localAS, e.peerAS, e.vni)
+
+	go func() {
+		ticker := time.NewTicker(evpnFlushEvery)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			e.flush(now)
+		}
+	}()
+
+	e.bgpNeighbor.run("EVPN", e.session)
+}
+
+// Counters はEVPNのカウンタを返す
+func (e *evpnSpeaker) Counters() map[string]uint64 {
+	e.mu.Lock()
+	local, remote := len(e.local), len(e.remote)
+	e.mu.Unlock()
+	var up uint64
+	if e.established.Load() {
+		up = 1
+	}
+	return map[string]uint64{
+		"evpn_established":     up,
+		"evpn_local_macs":      uint64(local),
+		"evpn_remote_macs":     uint64(remote),
+		"evpn_routes_sent":     e.sent.Load(),
+		"evpn_routes_received": e.received.Load(),
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FDB関連の定数定義
+const (
+	fdbDefaultAging = 5 * time.Minute // エントリの既定エージング時間
+	fdbDefaultMax   = 4096            // 既定の最大エントリ数
+)
+
+// FDBConfigはマルチポイント時のMAC学習テーブルの設定を保持する
+type FDBConfig struct {
+	Aging      string `yaml:"aging"`       // エントリのエージング時間
+	MaxEntries int    `yaml:"max_entries"` // 最大エントリ数（超過時は学習せずフラッディング）
+}
+
+// fdbEntryは学習済みMACアドレス1件分の情報
+type fdbEntry struct {
+	peer   *Peer
+	seen   atomic.Int64 // 最終学習時刻(UnixNano)
+	static bool         // 制御プレーン（EVPN）で登録したエントリ（エージング・上書きしない）
+}
+
+// fdbは送信元MACアドレスとピアの対応を学習する転送テーブル
+type fdb struct {
+	mu      sync.RWMutex
+	entries map[[6]byte]*fdbEntry
+	aging   time.Duration
+	max     int
+
+	flooded   atomic.Uint64 // 宛先不明・ブロードキャスト等で全ピアへ送った数
+	unicast   atomic.Uint64 // 学習済みピアへ単独送信した数
+	learnFull atomic.Uint64 // テーブル溢れで学習できなかった数
+}
+
+// FDBEntryはAPI出力用の学習済みエントリ
+type FDBEntry struct {
+	MAC    string  `json:"mac"`
+	Peer   string  `json:"peer"`
+	AgeSec float64 `json:"age_seconds"`
+	Static bool    `json:"static,omitempty"`
+}
+
+// newFDB はFDB設定からテーブルを生成する関数
+func newFDB(cfg FDBConfig) (*fdb, error) {
+	f := &fdb{entries: make(map[[6]byte]*fdbEntry), aging: fdbDefaultAging, max: fdbDefaultMax}
+	if cfg.Aging != "" {
+		d, err := time.ParseDuration(cfg.Aging)
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, errors.New("aging must be positive")
+		}
+		f.aging = d
+	}
+	if cfg.MaxEntries > 0 {
+		f.max = cfg.MaxEntries
+	}
+	go f.ageLoop()
+	return f, nil
+}
+
+// learn は受信フレームの送信元MACを学習する
+func (f *fdb) learn(frame []byte, peer *Peer) {
+	if len(frame) < 14 || frame[6]&0x01 != 0 {
+		return // マルチキャスト送信元は学習しない
+	}
+	var mac [6]byte
+	copy(mac[:], frame[6:12])
+	now := time.Now().UnixNano()
+
+	f.mu.RLock()
+	e, ok := f.entries[mac]
+	f.mu.RUnlock()
+	if ok && (e.peer == peer || e.static) {
+		e.seen.Store(now)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, exists := f.entries[mac]; !exists && len(f.entries) >= f.max {
+		f.learnFull.Add(1)
+		return
+	}
+	e = &fdbEntry{peer: peer}
+	e.seen.Store(now)
+	f.entries[mac] = e
+}
+
+// lookup は宛先MACに対応するピアを返す（不明・マルチキャストはnil）
+func (f *fdb) lookup(frame []byte) *Peer {
+	if len(frame) < 14 || frame[0]&0x01 != 0 {
+		f.flooded.Add(1)
+		return nil
+	}
+	var mac [6]byte
+	copy(mac[:], frame[0:6])
+
+	f.mu.RLock()
+	e, ok := f.entries[mac]
+	f.mu.RUnlock()
+	if !ok || (!e.static && time.Since(time.Unix(0, e.seen.Load())) > f.aging) {
+		f.flooded.Add(1)
+		return nil
+	}
+	f.unicast.Add(1)
+	return e.peer
+}
+
+// install は制御プレーンで通知されたMACアドレスを固定エントリとして登録する
+func (f *fdb) install(mac [6]byte, peer *Peer) {
+	e := &fdbEntry{peer: peer, static: true}
+	e.seen.Store(time.Now().UnixNano())
+	f.mu.Lock()
+	f.entries[mac] = e
+	f.mu.Unlock()
+}
+
+// uninstall は固定エントリを削除する
+func (f *fdb) uninstall(mac [6]byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if e, ok := f.entries[mac]; ok && e.static {
+		delete(f.entries, mac)
+	}
+}
+
+// restore はクラスタの相方が学習していたMACアドレスを学習済みとして登録する（既存のエントリは残す）
+func (f *fdb) restore(mac [6]byte, peer *Peer) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, exists := f.entries[mac]; exists || len(f.entries) >= f.max {
+		return false
+	}
+	e := &fdbEntry{peer: peer}
+	e.seen.Store(time.Now().UnixNano())
+	f.entries[mac] = e
+	return true
+}
+
+// forgetPeer は指定ピアに紐づくエントリを削除する
+func (f *fdb) forgetPeer(peer *Peer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for mac, e := range f.entries {
+		if e.peer == peer {
+			delete(f.entries, mac)
+		}
+	}
+}
+
+// ageLoop はエージング時間を過ぎたエントリを定期的に削除する関数
+func (f *fdb) ageLoop() {
+	ticker := time.NewTicker(f.aging / 2)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		f.mu.Lock()
+		for mac, e := range f.entries {
+			if !e.static && now.Sub(time.Unix(0, e.seen.Load())) > f.aging {
+				delete(f.entries, mac)
+			}
+		}
+		f.mu.Unlock()
+	}
+}
+
+// Entries は学習済みエントリをMACアドレス順に返す
+func (f *fdb) Entries() []FDBEntry {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	list := make([]FDBEntry, 0, len(f.entries))
+	for mac, e := range f.entries {
+		list = append(list, FDBEntry{
+			MAC:    net.HardwareAddr(mac[:]).String(),
+			Peer:   e.peer.Host,
+			AgeSec: time.Since(time.Unix(0, e.seen.Load())).Seconds(),
+			Static: e.static,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].MAC < list[j].MAC })
+	return list
+}
+
+// Counters はFDBのカウンタを返す
+func (f *fdb) Counters() map[string]uint64 {
+	f.mu.RLock()
+	n := len(f.entries)
+	f.mu.RUnlock()
+	return map[string]uint64{
+		"fdb_entries":    uint64(n),
+		"fdb_flooded":    f.flooded.Load(),
+		"fdb_unicast":    f.unicast.Load(),
+		"fdb_learn_full": f.learnFull.Load(),
+	}
+}
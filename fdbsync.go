@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ブリッジFDB同期関連の定数定義
+const (
+	fdbSyncDefaultInterval = 30 * time.Second
+	fdbSyncDefaultMax      = 4096
+	fdbSyncEntryLen        = 6 + 2 // MAC + VLAN ID（0でタグなし）
+)
+
+// FDBSyncConfigはブリッジで学習したMACアドレスを対向と交換し、対向のブリッジFDBへ事前に登録する設定を保持する
+type FDBSyncConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	Interval   string `yaml:"interval"`    // 送信間隔（既定30s、ブリッジのエージング時間より短くする）
+	MaxEntries int    `yaml:"max_entries"` // 送信・登録するエントリの上限（既定4096）
+}
+
+// fdbSyncKeyはブリッジFDBのエントリのキー（VLANごとに別のエントリ）
+type fdbSyncKey struct {
+	mac [6]byte
+	vid uint16
+}
+
+// bridgeFDBEntryは bridge -j fdb show の1エントリのうち使用する項目
+type bridgeFDBEntry struct {
+	MAC    string `json:"mac"`
+	Ifname string `json:"ifname"`
+	VLAN   uint16 `json:"vlan"`
+	Master string `json:"master"`
+	State  string `json:"state"`
+}
+
+// fdbSyncerはbr_nameのブリッジがLAN側のポートで学習したMACをOAMで対向へ送り、
+// 対向から受け取ったMACを自身のブリッジFDBへTAPのポート宛てとして登録する
+//
+// 再起動・フェイルオーバーの直後に対向のブリッジがMACを学習し直すまでの未知ユニキャストのフラッディングを減らす。
+// 登録はdynamicのため通常どおりエージングされ、LAN側で同じMACを学習すればブリッジが付け替える。
+type fdbSyncer struct {
+	t        *Tunnel
+	interval time.Duration
+	max      int
+	kick     chan struct{}
+	inbox    chan []byte // 対向から受け取った一覧（登録は受信ワーカーの外で行う）
+
+	mu        sync.Mutex
+	installed map[fdbSyncKey]int64 // 対向から受け取って登録したエントリ → 最終登録時刻(UnixNano)
+
+	sent      atomic.Uint64 // 送信したエントリ数
+	received  atomic.Uint64 // 受信したエントリ数
+	added     atomic.Uint64 // ブリッジFDBへ登録したエントリ数
+	conflicts atomic.Uint64 // LAN側で学習済みのため登録しなかったエントリ数
+	errors    atomic.Uint64 // ブリッジFDBの読み出し・登録の失敗数
+}
+
+// newFDBSyncer はFDB同期の設定から生成する関数（無効ならnilを返す）
+func newFDBSyncer(t *Tunnel, c *Config) (*fdbSyncer, error) {
+	cfg := c.FDBSync
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if c.BrName == "off" {
+		return nil, fmt.Errorf("fdb_sync requires br_name")
+	}
+	s := &fdbSyncer{
+		t:         t,
+		interval:  fdbSyncDefaultInterval,
+		max:       fdbSyncDefaultMax,
+		kick:      make(chan struct{}, 1),
+		inbox:     make(chan []byte, 16),
+		installed: make(map[fdbSyncKey]int64),
+	}
+	if cfg.Interval != "" {
+		d, err := time.ParseDuration(cfg.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("interval: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("interval must be positive")
+		}
+		s.interval = d
+	}
+	if cfg.MaxEntries < 0 {
+		return nil, fmt.Errorf("max_entries must not be negative")
+	}
+	if cfg.MaxEntries > 0 {
+		s.max = cfg.MaxEntries
+	}
+	return s, nil
+}
+
+// run は起動直後・送信間隔ごと・ピアの復旧時にローカルのエントリを全ピアへ送る関数
+func (s *fdbSyncer) run() {
+	logf("[INFO]", "Bridge FDB sync enabled (interval %v, max %d entries)", s.interval, s.max)
+	go func() {
+		for body := range s.inbox {
+			s.install(body)
+		}
+	}()
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		s.send()
+		s.prune()
+		select {
+		case <-ticker.C:
+		case <-s.kick:
+		}
+	}
+}
+
+// trigger は次の送信間隔を待たずに送る関数（ピアの復旧時）
+func (s *fdbSyncer) trigger() {
+	if s == nil {
+		return
+	}
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+// localEntries はブリッジがTAP以外のポートで学習したエントリを返す関数
+func (s *fdbSyncer) localEntries() (map[fdbSyncKey]bool, error) {
+	out, err := exec.Command("bridge", "-j", "fdb", "show", "br", s.t.cfg.BrName).Output()
+	if err != nil {
+		return nil, fmt.Errorf("bridge fdb show: %w", err)
+	}
+	var entries []bridgeFDBEntry
+	if err := json.Unmarshal(out, &entries); err != nil {
+		return nil, fmt.Errorf("bridge fdb show: %w", err)
+	}
+	local := make(map[fdbSyncKey]bool)
+	for _, e := range entries {
+		// ポート自身のアドレス（permanent）・手動登録（static）・ブリッジ自身・TAP側は送らない
+		if e.Master != s.t.cfg.BrName || e.Ifname == s.t.cfg.TapName || e.State == "permanent" || e.State == "static" {
+			continue
+		}
+		mac, err := net.ParseMAC(e.MAC)
+		if err != nil || len(mac) != 6 || mac[0]&0x01 != 0 {
+			continue
+		}
+		var k fdbSyncKey
+		copy(k.mac[:], mac)
+		k.vid = e.VLAN
+		local[k] = true
+	}
+	return local, nil
+}
+
+// send はローカルのエントリをMTUに収まる大きさのOAMフレームに分けて全ピアの送信経路へ送る関数
+func (s *fdbSyncer) send() {
+	local, err := s.localEntries()
+	if err != nil {
+		s.errors.Add(1)
+		logf("[WARN]", "FDB sync: %v", err)
+		return
+	}
+	perFrame := (s.t.cfg.MTU - 8 - 2) / fdbSyncEntryLen
+	var frames [][]byte
+	var body []byte
+	count := 0
+	flush := func() {
+		if count > 0 {
+			binary.BigEndian.PutUint16(body[0:2], uint16(count))
+			frames = append(frames, buildEtherIPPacket(buildOAMFrame(s.t.mac, oamFDBSync, body)))
+		}
+		body, count = nil, 0
+	}
+	n := 0
+	for k := range local {
+		if n >= s.max {
+			break
+		}
+		if count == 0 {
+			body = make([]byte, 2, 2+perFrame*fdbSyncEntryLen)
+		}
+		body = append(body, k.mac[:]...)
+		body = binary.BigEndian.AppendUint16(body, k.vid)
+		count++
+		n++
+		if count == perFrame {
+			flush()
+		}
+	}
+	flush()
+
+	for _, peer := range s.t.peers {
+		p := peer.active.Load()
+		if !p.up.Load() {
+			continue
+		}
+		for _, f := range frames {
+			p.write(s.t.seal(p, f), s.t.qos.oob(p.Version, -1))
+		}
+	}
+	s.sent.Add(uint64(n))
+}
+
+// receive は対向から受け取った一覧を登録待ちに入れる関数（受信ワーカーで外部コマンドを待たない）
+func (s *fdbSyncer) receive(body []byte) {
+	if len(body) < 2 {
+		return
+	}
+	count := int(binary.BigEndian.Uint16(body[0:2]))
+	if len(body) < 2+count*fdbSyncEntryLen {
+		return
+	}
+	s.received.Add(uint64(count))
+	select {
+	case s.inbox <- append([]byte(nil), body[:2+count*fdbSyncEntryLen]...):
+	default:
+		s.errors.Add(1) // 登録が追いつかない
+	}
+}
+
+// install は対向から受け取ったエントリをTAPのポート宛てとしてブリッジFDBへ登録する関数
+//
+// LAN側のポートで学習済みのMACは登録しない（ループ・誤った付け替えを防ぐ）。
+func (s *fdbSyncer) install(body []byte) {
+	count := int(binary.BigEndian.Uint16(body[0:2]))
+
+	local, err := s.localEntries()
+	if err != nil {
+		s.errors.Add(1)
+		logf("[WARN]", "FDB sync: %v", err)
+		return
+	}
+
+	var batch strings.Builder
+	var keys []fdbSyncKey
+	s.mu.Lock()
+	for i := 0; i < count; i++ {
+		e := body[2+i*fdbSyncEntryLen:]
+		var k fdbSyncKey
+		copy(k.mac[:], e[0:6])
+		k.vid = binary.BigEndian.Uint16(e[6:8])
+		if k.mac[0]&0x01 != 0 || k.vid > 4094 {
+			continue
+		}
+		if local[k] {
+			s.conflicts.Add(1)
+			continue
+		}
+		if _, ok := s.installed[k]; !ok && len(s.installed) >= s.max {
+			continue
+		}
+		fmt.Fprintf(&batch, "fdb replace %s dev %s master", net.HardwareAddr(k.mac[:]), s.t.cfg.TapName)
+		if k.vid != 0 {
+			fmt.Fprintf(&batch, " vlan %d", k.vid)
+		}
+		batch.WriteString(" dynamic\n")
+		keys = append(keys, k)
+	}
+	s.mu.Unlock()
+	if len(keys) == 0 {
+		return
+	}
+
+	// 1件ずつコマンドを起動せず、まとめて登録する（失敗した行があっても続ける）
+	cmd := exec.Command("bridge", "-force", "-batch", "-")
+	cmd.Stdin = strings.NewReader(batch.String())
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		s.errors.Add(1)
+		logf("[WARN]", "FDB sync: bridge fdb replace: %v: %s", err, strings.TrimSpace(stderr.String()))
+		return
+	}
+
+	now := time.Now().UnixNano()
+	s.mu.Lock()
+	for _, k := range keys {
+		s.installed[k] = now
+	}
+	s.mu.Unlock()
+	s.added.Add(uint64(len(keys)))
+}
+
+// prune は対向から送られなくなったエントリの記録を消す関数（ブリッジ側はエージングで消える）
+func (s *fdbSyncer) prune() {
+	cutoff := time.Now().Add(-3 * s.interval).UnixNano()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, seen := range s.installed {
+		if seen < cutoff {
+			delete(s.installed, k)
+		}
+	}
+}
+
+// Counters はFDB同期のカウンタを返す
+func (s *fdbSyncer) Counters() map[string]uint64 {
+	s.mu.Lock()
+	installed := len(s.installed)
+	s.mu.Unlock()
+	return map[string]uint64{
+		"fdb_sync_sent":      s.sent.Load(),
+		"fdb_sync_received":  s.received.Load(),
+		"fdb_sync_added":     s.added.Load(),
+		"fdb_sync_conflicts": s.conflicts.Load(),
+		"fdb_sync_errors":    s.errors.Load(),
+		"fdb_sync_entries":   uint64(installed),
+	}
+}
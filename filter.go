@@ -0,0 +1,235 @@
+package main
+
+import "sort"
+
+// Directionはフレームの転送方向を表す
+type Direction int
+
+const (
+	DirTX Direction = iota // TAP → トンネル
+	DirRX                  // トンネル → TAP
+)
+
+// String は方向を表す文字列を返す
+func (d Direction) String() string {
+	if d == DirTX {
+		return "tx"
+	}
+	return "rx"
+}
+
+// Verdictはフィルタによるフレームの判定結果を表す
+type Verdict int
+
+const (
+	VerdictPass Verdict = iota // 転送を継続
+	VerdictDrop                // 破棄
+)
+
+// FrameFilterはデータパス上でEthernetフレームを検査・加工するフィルタ
+//
+// Filterは加工後のフレームを返す。戻り値のスライスは入力と同じバッファを
+// 指してもよいが、入力バッファの容量を超えてはならない。
+type FrameFilter interface {
+	Filter(dir Direction, frame []byte) ([]byte, Verdict)
+}
+
+// CounterSourceは統計カウンタを公開するコンポーネントが実装するインターフェース
+type CounterSource interface {
+	Counters() map[string]uint64
+}
+
+// parseDirections は"tx"/"rx"/"both"の設定値を方向ごとの有効フラグに変換する関数
+func parseDirections(s string) (tx, rx bool, ok bool) {
+	switch s {
+	case "", "both":
+		return true, true, true
+	case "tx":
+		return true, false, true
+	case "rx":
+		return false, true, true
+	}
+	return false, false, false
+}
+
+// applyFilters はフィルタチェーンを順に適用し、破棄された場合はfalseを返す関数
+func (t *Tunnel) applyFilters(dir Direction, frame []byte) ([]byte, bool) {
+	for _, f := range t.filters {
+		var v Verdict
+		frame, v = f.Filter(dir, frame)
+		if v == VerdictDrop {
+			t.dropped[dir].Add(1)
+			return nil, false
+		}
+	}
+	return frame, true
+}
+
+// process はループガードのタグ処理とフィルタチェーンを適用し、破棄された場合はfalseを返す関数
+//
+// フィルタにはホップ数タグを除いたフレームを渡す。
+func (t *Tunnel) process(dir Direction, frame []byte) ([]byte, bool) {
+	if t.loopGuard == nil {
+		return t.applyFilters(dir, frame)
+	}
+
+	var hops int
+	var ok bool
+	if dir == DirTX {
+		frame, hops, ok = t.loopGuard.egress(frame)
+	} else {
+		frame, hops, ok = t.loopGuard.ingress(frame)
+	}
+	if !ok {
+		return nil, false
+	}
+	if frame, ok = t.applyFilters(dir, frame); !ok {
+		return nil, false
+	}
+	return t.loopGuard.tag(dir, frame, hops)
+}
+
+// counterSources はカウンタを公開しているコンポーネントの一覧を返す関数
+func (t *Tunnel) counterSources() []CounterSource {
+	list := []CounterSource{t.header, t.rxCheck, t.trace, t.txBufs, t.rxBufs}
+	for _, f := range t.filters {
+		if cs, ok := f.(CounterSource); ok {
+			list = append(list, cs)
+		}
+	}
+	for _, s := range t.socks {
+		list = append(list, s)
+	}
+	if e := t.socks[0].Encap; e != nil {
+		list = append(list, e)
+	}
+	if t.fdb != nil {
+		list = append(list, t.fdb)
+	}
+	if t.hostRoute != nil {
+		list = append(list, t.hostRoute)
+	}
+	if t.pmtud != nil {
+		list = append(list, t.pmtud)
+	}
+	if t.oversize != nil {
+		list = append(list, t.oversize)
+	}
+	if t.reasm != nil {
+		list = append(list, t.reasm)
+	}
+	if t.pacer != nil {
+		list = append(list, t.pacer)
+	}
+	if t.allow != nil {
+		list = append(list, t.allow)
+	}
+	if t.isolation != nil {
+		list = append(list, t.isolation)
+	}
+	if t.ring != nil {
+		list = append(list, t.ring)
+	}
+	if t.seq != nil {
+		list = append(list, t.seq)
+	}
+	if t.canary != nil {
+		list = append(list, t.canary)
+	}
+	if t.silence != nil {
+		list = append(list, t.silence)
+	}
+	if t.srcSelect != nil {
+		list = append(list, t.srcSelect)
+	}
+	if t.local != nil {
+		list = append(list, t.local)
+	}
+	if t.stpCost != nil {
+		list = append(list, t.stpCost)
+	}
+	if t.evpn != nil {
+		list = append(list, t.evpn)
+	}
+	if t.fdbSync != nil {
+		list = append(list, t.fdbSync)
+	}
+	if t.routes != nil {
+		list = append(list, t.routes)
+	}
+	if t.iperf != nil {
+		list = append(list, t.iperf)
+	}
+	if t.recursion != nil {
+		list = append(list, t.recursion)
+	}
+	if t.auth != nil {
+		list = append(list, t.auth)
+	}
+	if t.qos != nil && t.qos.copyInner {
+		list = append(list, t.qos)
+	}
+	if t.comp != nil {
+		list = append(list, t.comp)
+	}
+	if cluster != nil {
+		list = append(list, cluster)
+	}
+	if t.loopGuard != nil {
+		list = append(list, t.loopGuard)
+	}
+	if t.csum != nil {
+		list = append(list, t.csum)
+	}
+	if t.offload != nil {
+		list = append(list, t.offload)
+	}
+	if t.firewall != nil {
+		list = append(list, t.firewall)
+	}
+	if t.negotiate != nil {
+		list = append(list, t.negotiate)
+	}
+	return list
+}
+
+// counters は各コンポーネントが公開するカウンタをまとめて返す関数
+func (t *Tunnel) counters() map[string]uint64 {
+	rxQueue, _ := t.recvQueueLen()
+	all := map[string]uint64{
+		"tx_dropped": t.dropped[DirTX].Load(),
+		"rx_dropped": t.dropped[DirRX].Load(),
+		"tx_queue":   uint64(len(t.sendChan)),
+		"rx_queue":   uint64(rxQueue),
+		"tx_frames":  t.traffic[DirTX].frames.Load(),
+		"tx_bytes":   t.traffic[DirTX].bytes.Load(),
+		"tx_errors":  t.traffic[DirTX].errors.Load(),
+		"rx_frames":  t.traffic[DirRX].frames.Load(),
+		"rx_bytes":   t.traffic[DirRX].bytes.Load(),
+		"rx_errors":  t.traffic[DirRX].errors.Load(),
+
+		"keepalive_suppressed": t.kaSuppressed.Load(),
+		"peer_roamed":          t.roamed.Load(),
+		"rx_hop_limit_dropped": t.hopDropped.Load(),
+	}
+	for _, cs := range t.counterSources() {
+		for k, v := range cs.Counters() {
+			all[k] += v
+		}
+	}
+	return all
+}
+
+// logCounters はカウンタを名前順にログ出力する関数
+func (t *Tunnel) logCounters() {
+	all := t.counters()
+	names := make([]string, 0, len(all))
+	for k := range all {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	logf("[INFO]", "Counters for %s", t.cfg.TapName)
+	for _, k := range names {
+		logf("[INFO]", "%s: %d", k, all[k])
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	firewallInterval = 10 * time.Second // ピアのアドレスの変化をルールへ反映する間隔
+
+	// 既存のホストファイアウォールの入力チェイン（nftables.confの既定の構成）
+	firewallHostFamily = "inet"
+	firewallHostTable  = "filter"
+	firewallHostChain  = "input"
+)
+
+// firewallHandleRe は"nft -a list chain"の出力からルールのハンドルを取り出す
+var firewallHandleRe = regexp.MustCompile(`# handle (\d+)$`)
+
+// firewallManagerはトンネルのプロトコルをピアから受け入れ、ピア宛てのICMPエラーを抑止するnftablesルールを管理する
+//
+// ICMPの抑止は専用のテーブル（etherip_fw_<TAP>）のセットで宛先を絞る。既存の inet filter input チェインが
+// あれば、そのポリシー（drop）で外側パケットが捨てられないよう、ピアを送信元とする許可ルールを先頭に挿入する
+// （別テーブルのacceptでは他テーブルのdropを覆せないため）。
+type firewallManager struct {
+	t       *Tunnel
+	tapName string
+	table   string
+	proto   int
+	anySrc  bool // roaming時は送信元を絞らない（移動先のアドレスを学習できるように、allowlist設定時を除く）
+
+	mu         sync.Mutex
+	peers      string // 反映済みのピアのアドレス（比較用）
+	hostChain  bool   // 既存の入力チェインへ許可ルールを挿入している
+	syncErrors atomic.Uint64
+	lastErr    atomic.Value // 最後の反映エラー（string、ログの重複抑制用）
+}
+
+// firewallTable はTAPごとにデーモンが管理するnftablesテーブル名を返す関数
+func firewallTable(tapName string) string {
+	return "etherip_fw_" + strings.ReplaceAll(tapName, "-", "_")
+}
+
+// newFirewall は専用テーブルを作り、ピアのアドレスを反映する関数（manage_firewall無効ならnil）
+func newFirewall(t *Tunnel, cfg *Config) (*firewallManager, error) {
+	if !cfg.ManageFirewall {
+		return nil, nil
+	}
+	f := &firewallManager{
+		t:       t,
+		tapName: cfg.TapName,
+		table:   firewallTable(cfg.TapName),
+		proto:   t.socks[0].Encap.protocol(),
+		anySrc:  cfg.Roaming && !cfg.Allowlist.enabled(),
+	}
+
+	var b strings.Builder
+	// 既存テーブルを作り直して冪等にする
+	fmt.Fprintf(&b, "table inet %s {}\ndelete table inet %s\n", f.table, f.table)
+	fmt.Fprintf(&b, "table inet %s {\n", f.table)
+	b.WriteString("  set peers4 { type ipv4_addr; flags interval; }\n")
+	b.WriteString("  set peers6 { type ipv6_addr; flags interval; }\n")
+	// ソケットを開く前・再起動中に届いた外側パケットへカーネルが返すプロトコル到達不能（IPv4）・
+	// 未知の次ヘッダ（IPv6）を、ピア宛てに限って捨てる
+	b.WriteString("  chain output {\n    type filter hook output priority -150; policy accept;\n")
+	b.WriteString("    ip daddr @peers4 icmp type destination-unreachable icmp code 2 counter drop\n")
+	b.WriteString("    ip6 daddr @peers6 icmpv6 type parameter-problem icmpv6 code 1 counter drop\n  }\n")
+	b.WriteString("}\n")
+	if err := nftApply(b.String()); err != nil {
+		return nil, fmt.Errorf("create table inet %s: %w", f.table, err)
+	}
+	registerShutdown(f.remove)
+
+	if err := exec.Command("nft", "list", "chain", firewallHostFamily, firewallHostTable, firewallHostChain).Run(); err == nil {
+		f.hostChain = true
+	} else {
+		logf("[INFO]", "No %s %s %s chain; protocol %d is not filtered by nftables, so only ICMP errors are managed", firewallHostFamily, firewallHostTable, firewallHostChain, f.proto)
+	}
+	f.sync()
+	logf("[INFO]", "Firewall rules for %s installed (table inet %s, protocol %d)", f.tapName, f.table, f.proto)
+	return f, nil
+}
+
+// run はピアのアドレスの変化（名前解決・フェイルオーバー）をルールへ反映し続ける関数
+func (f *firewallManager) run() {
+	ticker := time.NewTicker(firewallInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		f.sync()
+	}
+}
+
+// peerAddrs は全ピアの全経路（予備の宛先・別ファミリを含む）の宛先と許可リストの送信元をファミリごとに返す関数
+//
+// 範囲に含まれるアドレス・範囲は省く（intervalのセットでは重なる要素を追加できないため）。
+func (f *firewallManager) peerAddrs() (v4, v6 []string) {
+	var nets4, nets6 []*net.IPNet
+	if f.t.allow != nil {
+		nets4, nets6 = f.t.allow.sources(f.t.peers)
+	}
+	for _, peer := range f.t.peers {
+		for _, p := range peer.paths {
+			dst, _ := p.Dst.Load().(net.IP)
+			if dst == nil || dst.IsUnspecified() {
+				continue
+			}
+			n, _ := parseAllowSource(dst.String())
+			if dst.To4() != nil {
+				nets4 = append(nets4, n)
+			} else {
+				nets6 = append(nets6, n)
+			}
+		}
+	}
+	return firewallElements(nets4), firewallElements(nets6)
+}
+
+// firewallElements は範囲を他の範囲に含まれるものを除いてnftablesの要素（単一アドレスはCIDRなし）にする関数
+func firewallElements(nets []*net.IPNet) []string {
+	var out []string
+	for i, n := range nets {
+		ones, _ := n.Mask.Size()
+		covered := slices.ContainsFunc(nets[:i], func(m *net.IPNet) bool {
+			mo, _ := m.Mask.Size()
+			return mo <= ones && m.Contains(n.IP)
+		}) || slices.ContainsFunc(nets[i+1:], func(m *net.IPNet) bool {
+			mo, _ := m.Mask.Size()
+			return mo < ones && m.Contains(n.IP)
+		})
+		if covered {
+			continue
+		}
+		if ones == len(n.IP)*8 {
+			out = append(out, n.IP.String())
+		} else {
+			out = append(out, n.String())
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+// sync はピアのアドレスが変わっていればセットと既存チェインの許可ルールを置き換える関数
+func (f *firewallManager) sync() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v4, v6 := f.peerAddrs()
+	key := strings.Join(v4, ",") + "|" + strings.Join(v6, ",")
+	if key == f.peers {
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "flush set inet %s peers4\nflush set inet %s peers6\n", f.table, f.table)
+	if len(v4) > 0 {
+		fmt.Fprintf(&b, "add element inet %s peers4 { %s }\n", f.table, strings.Join(v4, ", "))
+	}
+	if len(v6) > 0 {
+		fmt.Fprintf(&b, "add element inet %s peers6 { %s }\n", f.table, strings.Join(v6, ", "))
+	}
+	if f.hostChain {
+		handles, err := f.hostRules()
+		if f.check(err) != nil {
+			return
+		}
+		for _, h := range handles {
+			fmt.Fprintf(&b, "delete rule %s %s %s handle %s\n", firewallHostFamily, firewallHostTable, firewallHostChain, h)
+		}
+		insert := func(match string) {
+			fmt.Fprintf(&b, "insert rule %s %s %s %smeta l4proto %d accept comment %q\n", firewallHostFamily, firewallHostTable, firewallHostChain, match, f.proto, f.table)
+		}
+		if f.anySrc {
+			insert("")
+		} else {
+			if len(v4) > 0 {
+				insert(fmt.Sprintf("ip saddr { %s } ", strings.Join(v4, ", ")))
+			}
+			if len(v6) > 0 {
+				insert(fmt.Sprintf("ip6 saddr { %s } ", strings.Join(v6, ", ")))
+			}
+		}
+	}
+	if f.check(nftApply(b.String())) != nil {
+		return
+	}
+	if f.peers != "" {
+		logf("[UPDATE]", "Firewall rules for %s updated: peers %v %v", f.tapName, v4, v6)
+	}
+	f.peers = key
+}
+
+// hostRules は既存の入力チェインへ挿入したこのトンネルの許可ルールのハンドルを返す関数（前回の異常終了の残りを含む）
+func (f *firewallManager) hostRules() ([]string, error) {
+	out, err := exec.Command("nft", "-a", "list", "chain", firewallHostFamily, firewallHostTable, firewallHostChain).Output()
+	if err != nil {
+		return nil, err
+	}
+	var handles []string
+	comment := fmt.Sprintf("comment %q", f.table)
+	for _, line := range strings.Split(string(out), "\n") {
+		if !strings.Contains(line, comment) {
+			continue
+		}
+		if m := firewallHandleRe.FindStringSubmatch(strings.TrimSpace(line)); m != nil {
+			handles = append(handles, m[1])
+		}
+	}
+	return handles, nil
+}
+
+// check はルールの反映の失敗を数え、同じエラーの連続はログを1度だけ出す関数（errをそのまま返す）
+func (f *firewallManager) check(err error) error {
+	if err == nil {
+		f.lastErr.Store("")
+		return nil
+	}
+	f.syncErrors.Add(1)
+	if prev, _ := f.lastErr.Swap(err.Error()).(string); prev != err.Error() {
+		logf("[WARN]", "Failed to update firewall rules for %s: %v", f.tapName, err)
+	}
+	return err
+}
+
+// remove は専用テーブルと既存チェインへ挿入した許可ルールを削除する関数
+func (f *firewallManager) remove() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.hostChain {
+		if handles, err := f.hostRules(); err == nil {
+			for _, h := range handles {
+				if err := exec.Command("nft", "delete", "rule", firewallHostFamily, firewallHostTable, firewallHostChain, "handle", h).Run(); err != nil {
+					logf("[WARN]", "Failed to remove firewall rule %s from %s %s %s: %v", h, firewallHostFamily, firewallHostTable, firewallHostChain, err)
+				}
+			}
+		}
+	}
+	if err := exec.Command("nft", "delete", "table", "inet", f.table).Run(); err != nil {
+		logf("[WARN]", "Failed to remove nftables table %s: %v", f.table, err)
+		return
+	}
+	logf("[INFO]", "Firewall rules for %s removed", f.tapName)
+}
+
+// Counters はルールの反映の失敗数を返す関数
+func (f *firewallManager) Counters() map[string]uint64 {
+	return map[string]uint64{"firewall_sync_errors": f.syncErrors.Load()}
+}
+
+// nftApply はnftのスクリプトを1つのトランザクションとして適用する関数
+func nftApply(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -5,7 +5,11 @@ go 1.23.0
 toolchain go1.24.1
 
 require (
-	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8 // indirect
-	golang.org/x/sys v0.31.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	github.com/klauspost/compress v1.17.11
+	github.com/pierrec/lz4/v4 v4.1.21
+	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8
+	github.com/tetratelabs/wazero v1.8.2
+	go.etcd.io/bbolt v1.3.11
+	golang.org/x/sys v0.31.0
+	gopkg.in/yaml.v3 v3.0.1
 )
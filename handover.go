@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/songgao/water"
+)
+
+// 無停止の再起動（新しいプロセスへのTAP・ソケットの引き継ぎ）関連の定数定義
+const (
+	handoverEnv       = "ETHERIP_HANDOVER"
+	handoverTimeout   = 30 * time.Second // 新しいプロセスが転送を始めるまで待つ時間（過ぎたら止めて動作を続ける）
+	handoverSeqMargin = 1 << 20          // 引き継ぎ時にsequenceの番号を進める余裕（新しいプロセスの準備中に引き継ぎ元が送る分）
+)
+
+// errHandoverUnsupported は引き継ぎができず、後片付けをしてからの再起動になることを表すエラー
+var errHandoverUnsupported = errors.New("handover is not supported")
+
+// handoverStateは引き継ぎ元から新しいプロセスへ環境変数で渡す状態
+type handoverState struct {
+	Files   map[string]int    `json:"files"`             // 名前 → ExtraFilesの位置（fdは3+位置）
+	Ready   int               `json:"ready"`             // 転送を始めたら"ready"を書き込むパイプの位置
+	Done    int               `json:"done"`              // 引き継ぎ元の終了（EOF）を待つパイプの位置
+	Created []string          `json:"created,omitempty"` // 停止時に削除するインターフェース（引き継ぎ元が作成したもの）
+	Sysctl  map[string]string `json:"sysctl,omitempty"`  // 停止時に戻すカーネルパラメータの元の値
+	Seq     map[string]uint32 `json:"seq,omitempty"`     // トンネル/宛先/ファミリ → 送信シーケンス番号
+}
+
+// 引き継ぎ元として渡すもの
+var (
+	offeredMu      sync.Mutex
+	offeredFiles   = make(map[string]syscall.Conn) // 名前 → 新しいプロセスへ渡すファイル・ソケット
+	offeredCreated = make(map[string]bool)         // 停止時に削除するインターフェース
+	offeredSysctl  = make(map[string]string)       // 停止時に戻すカーネルパラメータの元の値
+)
+
+// 引き継ぎで起動した場合に受け取ったもの
+var (
+	inherited      *handoverState
+	inheritedMu    sync.Mutex
+	inheritedFiles map[string]int // 名前 → 受け取ったファイルのうち未使用のもののfd
+	handoverAfter  []func()       // 引き継ぎ元の終了後に実行する処理
+	handoverWait   atomic.Bool    // 引き継ぎ元がまだ動いている
+)
+
+// offerHandover は無停止の再起動で新しいプロセスへ渡すファイル・ソケットを登録する関数
+func offerHandover(name string, c syscall.Conn) {
+	offeredMu.Lock()
+	defer offeredMu.Unlock()
+	offeredFiles[name] = c
+}
+
+// markCreated は停止時に削除するインターフェースを記録する関数（無停止の再起動では削除を新しいプロセスへ任せる）
+func markCreated(name string) {
+	offeredMu.Lock()
+	defer offeredMu.Unlock()
+	offeredCreated[name] = true
+}
+
+// offerSysctl は停止時に戻すカーネルパラメータの元の値を記録する関数（最初に記録した値を残す）
+func offerSysctl(key, value string) {
+	offeredMu.Lock()
+	defer offeredMu.Unlock()
+	if _, ok := offeredSysctl[key]; !ok {
+		offeredSysctl[key] = value
+	}
+}
+
+// inheritHandover は環境変数から引き継ぎの状態を読む関数（引き継ぎで起動したのでなければ何もしない）
+//
+// 環境変数は読んだら消し、アラートのフック等の子プロセスへ渡さない。
+func inheritHandover() error {
+	v, ok := os.LookupEnv(handoverEnv)
+	if !ok {
+		return nil
+	}
+	os.Unsetenv(handoverEnv)
+	var st handoverState
+	if err := json.Unmarshal([]byte(v), &st); err != nil {
+		return fmt.Errorf("%s: %w", handoverEnv, err)
+	}
+	inheritedFiles = make(map[string]int, len(st.Files))
+	for name, i := range st.Files {
+		inheritedFiles[name] = 3 + i
+	}
+	inherited = &st
+	handoverWait.Store(true)
+	logf("[INFO]", "Taking over %d files from the previous process", len(st.Files))
+	return nil
+}
+
+// inheritedFD は引き継ぎ元から受け取ったファイルのfdを返す関数（なければfalse、同じ名前は1度だけ返す）
+func inheritedFD(name string) (int, bool) {
+	inheritedMu.Lock()
+	defer inheritedMu.Unlock()
+	fd, ok := inheritedFiles[name]
+	delete(inheritedFiles, name)
+	return fd, ok
+}
+
+// inheritedFile は引き継ぎ元から受け取ったファイルを返す関数（なければnil）
+func inheritedFile(name string) *os.File {
+	fd, ok := inheritedFD(name)
+	if !ok {
+		return nil
+	}
+	return os.NewFile(uintptr(fd), name)
+}
+
+// inheritedTAP は引き継ぎ元から受け取ったTAPを返す関数（なければnil）
+func inheritedTAP(name string) (*water.Interface, error) {
+	fd, ok := inheritedFD("tap:" + name)
+	if !ok {
+		return nil, nil
+	}
+	// ExtraFilesで渡す時に非ブロッキングが外れるため、ポーラーで読めるよう戻してから開く
+	if err := setNonblock(fd); err != nil {
+		os.NewFile(uintptr(fd), name).Close()
+		return nil, fmt.Errorf("inherited %s: %w", name, err)
+	}
+	f := os.NewFile(uintptr(fd), name)
+	registerCleanup(func() { f.Close() })
+	logf("[INFO]", "Took over TAP %s", name)
+	return &water.Interface{ReadWriteCloser: f}, nil
+}
+
+// inheritedConn は引き継ぎ元から受け取ったソケットを返す関数（なければnil）
+func inheritedConn(name string) (*net.IPConn, error) {
+	f := inheritedFile(name)
+	if f == nil {
+		return nil, nil
+	}
+	defer f.Close()
+	c, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherited %s: %w", name, err)
+	}
+	conn, ok := c.(*net.IPConn)
+	if !ok {
+		c.Close()
+		return nil, fmt.Errorf("inherited %s is not a raw IP socket", name)
+	}
+	return conn, nil
+}
+
+// inheritedListener は引き継ぎ元から受け取った待ち受けソケットを返す関数（なければnil）
+func inheritedListener(name string) (net.Listener, error) {
+	f := inheritedFile(name)
+	if f == nil {
+		return nil, nil
+	}
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherited %s: %w", name, err)
+	}
+	return ln, nil
+}
+
+// inheritedCreated は引き継ぎ元が作成したインターフェースかを返す関数（真なら停止時の削除を引き継ぐ）
+func inheritedCreated(name string) bool {
+	if inherited == nil {
+		return false
+	}
+	for _, n := range inherited.Created {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// inheritedSysctl は引き継ぎ元が変える前のカーネルパラメータの値を返す関数
+func inheritedSysctl(key string) (string, bool) {
+	if inherited == nil {
+		return "", false
+	}
+	v, ok := inherited.Sysctl[key]
+	return v, ok
+}
+
+// handoverPending は引き継ぎで起動し、引き継ぎ元がまだ動いているかを返す関数
+func handoverPending() bool {
+	return handoverWait.Load()
+}
+
+// afterHandover は引き継ぎ元の終了後に実行する処理を登録する関数（引き継ぎでなければすぐ実行する）
+//
+// 統計履歴のDB等、引き継ぎ元が閉じるまで開けないものに使う。
+func afterHandover(fn func()) {
+	inheritedMu.Lock()
+	if handoverPending() {
+		handoverAfter = append(handoverAfter, fn)
+		inheritedMu.Unlock()
+		return
+	}
+	inheritedMu.Unlock()
+	fn()
+}
+
+// seqKey は引き継ぐ送信シーケンス番号のキー（トンネル/宛先/ファミリ）を返す関数
+func seqKey(t *Tunnel, p *Path) string {
+	return fmt.Sprintf("%s/%s/v%d", t.cfg.TapName, p.Host, p.Version)
+}
+
+// restoreHandoverSeq は引き継ぎ元の送信シーケンス番号より先から送るよう各経路の番号を進める関数
+func restoreHandoverSeq(tunnels []*Tunnel) {
+	if inherited == nil {
+		return
+	}
+	for _, t := range tunnels {
+		if t.seq == nil {
+			continue
+		}
+		for _, peer := range t.peers {
+			for _, p := range peer.paths {
+				if n, ok := inherited.Seq[seqKey(t, p)]; ok {
+					t.seq.advance([]*Path{p}, n+handoverSeqMargin)
+				}
+			}
+		}
+	}
+}
+
+// completeHandover は転送を始めたことを引き継ぎ元へ知らせ、引き継ぎ元が終了したら登録された処理を実行する関数
+//
+// 設定の変更で使わなくなったTAP・ソケットは閉じる（引き継ぎ元の終了とともに消える）。
+func completeHandover() {
+	if inherited == nil {
+		return
+	}
+	ready := os.NewFile(uintptr(3+inherited.Ready), "handover-ready")
+	done := os.NewFile(uintptr(3+inherited.Done), "handover-done")
+	inheritedMu.Lock()
+	for name, fd := range inheritedFiles {
+		logf("[INFO]", "Closing %s, which is no longer configured", name)
+		os.NewFile(uintptr(fd), name).Close()
+	}
+	inheritedFiles = nil
+	inheritedMu.Unlock()
+
+	if _, err := io.WriteString(ready, "ready\n"); err != nil {
+		logf("[WARN]", "Handover: cannot notify the previous process: %v", err)
+	}
+	ready.Close()
+	go func() {
+		io.Copy(io.Discard, done)
+		done.Close()
+		inheritedMu.Lock()
+		handoverWait.Store(false)
+		fns := handoverAfter
+		handoverAfter = nil
+		inheritedMu.Unlock()
+		logf("[INFO]", "Handover complete; the previous process has exited")
+		for _, fn := range fns {
+			fn()
+		}
+	}()
+}
+
+// handOver は新しいバイナリを同じ引数で起動してTAP・ソケット等を渡し、転送を始めるまで待つ関数（新しいプロセスのPIDを返す）
+//
+// 新しいプロセスが時間内に転送を始めなければ止めてエラーを返す（呼び出し側はそのまま動作を続ける）。
+// クラスタでは相方へ引き継ぐため、シミュレーションではTAP・ソケットがないため対応しない。
+func handOver(exe string, tunnels []*Tunnel) (int, error) {
+	switch {
+	case !handoverSupported:
+		return 0, errHandoverUnsupported
+	case cluster != nil:
+		return 0, fmt.Errorf("%w with cluster (the peer takes over instead)", errHandoverUnsupported)
+	case simulation != nil:
+		return 0, fmt.Errorf("%w in simulation", errHandoverUnsupported)
+	}
+
+	st := handoverState{Files: make(map[string]int), Sysctl: make(map[string]string), Seq: make(map[string]uint32)}
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	offeredMu.Lock()
+	for name, c := range offeredFiles {
+		f, err := dupFile(c, name)
+		if err != nil {
+			offeredMu.Unlock()
+			return 0, fmt.Errorf("%s: %w", name, err)
+		}
+		st.Files[name] = len(files)
+		files = append(files, f)
+	}
+	for name := range offeredCreated {
+		st.Created = append(st.Created, name)
+	}
+	for k, v := range offeredSysctl {
+		st.Sysctl[k] = v
+	}
+	offeredMu.Unlock()
+	for _, t := range tunnels {
+		if t.seq == nil {
+			continue
+		}
+		for _, peer := range t.peers {
+			for _, p := range peer.paths {
+				st.Seq[seqKey(t, p)] = t.seq.counter(p).Load()
+			}
+		}
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer readyR.Close()
+	doneR, doneW, err := os.Pipe()
+	if err != nil {
+		readyW.Close()
+		return 0, err
+	}
+	st.Ready, st.Done = len(files), len(files)+1
+	files = append(files, readyW, doneR)
+	env, err := json.Marshal(st)
+	if err != nil {
+		doneW.Close()
+		return 0, err
+	}
+
+	// ExtraFilesで渡すとブロッキングになるため、起動後に元の状態へ戻す（ファイルの状態は新しいプロセスと共有）
+	restore := saveBlocking(files)
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(withoutEnv(os.Environ(), handoverEnv), handoverEnv+"="+string(env))
+	err = cmd.Start()
+	restore()
+	if err != nil {
+		doneW.Close()
+		return 0, err
+	}
+	for _, f := range files {
+		f.Close()
+	}
+	files = nil
+
+	// 新しいプロセスが転送を始めるか、終了する（パイプのEOF）まで待つ
+	readyR.SetReadDeadline(time.Now().Add(handoverTimeout))
+	line, err := bufio.NewReader(readyR).ReadString('\n')
+	if err == nil && line == "ready\n" {
+		// doneWは終了時に閉じられ、新しいプロセスへ引き継ぎ元の終了を知らせる
+		return cmd.Process.Pid, nil
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+	doneW.Close()
+	if err == nil || errors.Is(err, io.EOF) {
+		err = fmt.Errorf("new process exited before it started forwarding")
+	}
+	return 0, err
+}
+
+// withoutEnv は環境変数の一覧からkeyを除いたものを返す関数
+func withoutEnv(env []string, key string) []string {
+	out := env[:0:0]
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, key+"=") {
+			out = append(out, kv)
+		}
+	}
+	return out
+}
+
+// sdNotify はサービスマネージャ（systemdのType=notify）へ状態を知らせる関数（NOTIFY_SOCKETがなければ何もしない）
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+	if strings.HasPrefix(addr, "@") {
+		addr = "\x00" + addr[1:] // 抽象名前空間
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		logf("[WARN]", "sd_notify %q: %v", state, err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		logf("[WARN]", "sd_notify %q: %v", state, err)
+	}
+}
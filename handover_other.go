@@ -0,0 +1,26 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// handoverSupported はfdを渡せないプラットフォームでは偽（後片付けをしてから再起動する）
+const handoverSupported = false
+
+// dupFile はfdを渡せないプラットフォームでは未対応（後片付けをしてから再起動する）
+func dupFile(c syscall.Conn, name string) (*os.File, error) {
+	return nil, errHandoverUnsupported
+}
+
+// setNonblock はfdを渡せないプラットフォームでは未対応
+func setNonblock(fd int) error {
+	return errHandoverUnsupported
+}
+
+// saveBlocking はfdを渡せないプラットフォームでは何もしない
+func saveBlocking(files []*os.File) func() {
+	return func() {}
+}
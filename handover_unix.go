@@ -0,0 +1,60 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// handoverSupported はfdを新しいプロセスへ渡して無停止で再起動できるか
+const handoverSupported = true
+
+// dupFile はファイル・ソケットのfdを複製して新しいプロセスへ渡せるようにする関数（複製はclose-on-exec）
+func dupFile(c syscall.Conn, name string) (*os.File, error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var fd int
+	var dupErr error
+	if err := rc.Control(func(s uintptr) { fd, dupErr = unix.FcntlInt(s, unix.F_DUPFD_CLOEXEC, 0) }); err != nil {
+		return nil, err
+	}
+	if dupErr != nil {
+		return nil, dupErr
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// setNonblock はfdを非ブロッキングにする関数
+func setNonblock(fd int) error {
+	return unix.SetNonblock(fd, true)
+}
+
+// saveBlocking はファイルの非ブロッキングの状態を記録し、元へ戻す関数を返す関数
+//
+// os/execはExtraFilesをブロッキングにして渡すが、状態はファイルを共有する引き継ぎ元のソケット等にも及ぶ。
+func saveBlocking(files []*os.File) func() {
+	nonblock := make([]bool, len(files))
+	for i, f := range files {
+		if rc, err := f.SyscallConn(); err == nil {
+			rc.Control(func(fd uintptr) {
+				flags, err := unix.FcntlInt(fd, unix.F_GETFL, 0)
+				nonblock[i] = err == nil && flags&unix.O_NONBLOCK != 0
+			})
+		}
+	}
+	return func() {
+		for i, f := range files {
+			if !nonblock[i] {
+				continue
+			}
+			if rc, err := f.SyscallConn(); err == nil {
+				rc.Control(func(fd uintptr) { unix.SetNonblock(int(fd), true) })
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+//go:build unix
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// handoverTestFail を設定すると、新しいプロセス側は転送を始めずに終了する
+const handoverTestFail = "ETHERIP_TEST_HANDOVER_FAIL"
+
+func TestHandOver(t *testing.T) {
+	if _, ok := os.LookupEnv(handoverEnv); ok {
+		// 新しいプロセス側: 受け取ったパイプへPIDを書いてから転送の開始を知らせる
+		if os.Getenv(handoverTestFail) != "" {
+			os.Exit(1)
+		}
+		if err := inheritHandover(); err != nil {
+			os.Exit(2)
+		}
+		f := inheritedFile("test:pipe")
+		if f == nil || !inheritedCreated("br0") {
+			os.Exit(3)
+		}
+		fmt.Fprintf(f, "%d\n", os.Getpid())
+		f.Close()
+		completeHandover()
+		os.Exit(0)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := os.Args
+	os.Args = []string{args[0], "-test.run=^TestHandOver$"}
+	defer func() { os.Args = args }()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	offerHandover("test:pipe", w)
+	markCreated("br0")
+	defer func() {
+		delete(offeredFiles, "test:pipe")
+		delete(offeredCreated, "br0")
+		w.Close()
+	}()
+
+	t.Run("rollback", func(t *testing.T) {
+		t.Setenv(handoverTestFail, "1")
+		if _, err := handOver(exe, nil); err == nil || !strings.Contains(err.Error(), "exited before") {
+			t.Errorf("handOver() error = %v, want exited before forwarding", err)
+		}
+	})
+
+	pid, err := handOver(exe, nil)
+	if err != nil {
+		t.Fatalf("handOver() error = %v", err)
+	}
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := strconv.Atoi(strings.TrimSpace(line)); got != pid {
+		t.Errorf("new process wrote pid %d to the inherited pipe, handOver() returned %d", got, pid)
+	}
+}
+
+func TestRestoreHandoverSeq(t *testing.T) {
+	p4, p6 := &Path{Host: "a", Version: 4}, &Path{Host: "a", Version: 6}
+	tun := &Tunnel{cfg: &Config{TapName: "tap0"}, seq: newSequencer(SequenceConfig{Enabled: true}), peers: []*Peer{{paths: []*Path{p4, p6}}}}
+	inherited = &handoverState{Seq: map[string]uint32{"tap0/a/v4": 100}}
+	defer func() { inherited = nil }()
+
+	restoreHandoverSeq([]*Tunnel{tun})
+	if got := tun.seq.counter(p4).Load(); got != 100+handoverSeqMargin {
+		t.Errorf("v4 counter = %d, want %d", got, 100+handoverSeqMargin)
+	}
+	if got := tun.seq.counter(p6).Load(); got != 0 {
+		t.Errorf("v6 counter = %d, want 0 (not handed over)", got)
+	}
+}
+
+func TestRunCleanupsFor(t *testing.T) {
+	var ran []string
+	registerCleanup(func() { ran = append(ran, "close") })
+	registerShutdown(func() { ran = append(ran, "delete") })
+	runHandoverCleanups()
+	if strings.Join(ran, ",") != "close" {
+		t.Errorf("after handover ran %v, want only close", ran)
+	}
+
+	ran = nil
+	registerCleanup(func() { ran = append(ran, "close") })
+	registerShutdown(func() { ran = append(ran, "delete") })
+	runCleanups()
+	if strings.Join(ran, ",") != "delete,close" {
+		t.Errorf("on shutdown ran %v, want delete,close", ran)
+	}
+}
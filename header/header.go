@@ -0,0 +1,139 @@
+// Package header はEtherIPヘッダ（RFC 3378）の組み立て・解析と受信ヘッダの検証を行うパッケージ
+//
+// このデーモンではReservedを次のように拡張して使う（いずれも設定で有効にした場合のみ）。
+//
+//	0x800 シーケンス番号サブヘッダ有無ビット
+//	0x400 分割サブヘッダ有無ビット
+//	下位8bit ペイロードの圧縮方式
+package header
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// EtherIPヘッダ関連の定数定義
+const (
+	Len     = 2 // Version(4bit) + Reserved(12bit)
+	Version = 3 // RFC 3378で規定されたバージョン
+
+	FlagSeq  = 0x800 // Reservedのシーケンス番号サブヘッダ有無ビット
+	FlagFrag = 0x400 // Reservedの分割サブヘッダ有無ビット
+
+	CompLZ4  = 1 // Reservedの圧縮方式: LZ4ブロック
+	CompZstd = 2 // Reservedの圧縮方式: zstdフレーム
+)
+
+// HeaderはEtherIPヘッダ
+type Header [Len]byte
+
+// New はReservedを指定してVersion=3のヘッダを生成する関数
+func New(reserved uint16) Header {
+	return Header{Version<<4 | byte(reserved>>8)&0x0F, byte(reserved)}
+}
+
+// Parse はパケット先頭のヘッダを読み取る関数（長さのみ検証する）
+func Parse(packet []byte) (Header, error) {
+	if len(packet) < Len {
+		return Header{}, errors.New("short EtherIP header")
+	}
+	return Header{packet[0], packet[1]}, nil
+}
+
+// Version はVersionフィールドを返す
+func (h Header) Version() uint8 {
+	return h[0] >> 4
+}
+
+// Reserved はReservedフィールドを返す
+func (h Header) Reserved() uint16 {
+	return uint16(h[0]&0x0F)<<8 | uint16(h[1])
+}
+
+// String はヘッダを表示用の文字列にする
+func (h Header) String() string {
+	return fmt.Sprintf("version=%d reserved=0x%03x", h.Version(), h.Reserved())
+}
+
+// Features は受信側で有効な拡張（有効なものだけReservedのビットを解釈する）
+type Features struct {
+	Comp bool // 圧縮（Reservedの圧縮方式）
+	Seq  bool // シーケンス番号（FlagSeq）
+	Frag bool // 分割（FlagFrag）
+}
+
+// Checkerは受信したEtherIPヘッダを検証し、不正なヘッダを数える
+//
+//	strict  Version=3かつReserved=0のみ受け入れる（Featuresで有効にした拡張のビットのみ可）
+//	lenient Version=3であればReservedは無視する
+type Checker struct {
+	strict   bool
+	features Features
+
+	short       atomic.Uint64
+	badVersion  atomic.Uint64
+	badReserved atomic.Uint64 // strictで破棄した数
+	ignored     atomic.Uint64 // lenientでReservedを無視した数
+}
+
+// Counters は不正なヘッダのカウンタ
+type Counters struct {
+	Short           uint64 // ヘッダ長に満たないパケット
+	BadVersion      uint64 // Versionが3以外
+	BadReserved     uint64 // strictで破棄したReserved
+	ReservedIgnored uint64 // lenientで無視したReserved
+}
+
+// NewChecker はheader_mode（空・strict・lenient）からヘッダ検証器を生成する関数
+func NewChecker(mode string, f Features) (*Checker, error) {
+	switch mode {
+	case "", "strict":
+		return &Checker{strict: true, features: f}, nil
+	case "lenient":
+		return &Checker{features: f}, nil
+	}
+	return nil, fmt.Errorf("unknown header_mode %q (strict or lenient)", mode)
+}
+
+// Check はヘッダを検証し、圧縮方式（非圧縮は0）と受け入れ可否を返す
+func (c *Checker) Check(packet []byte) (byte, bool) {
+	h, err := Parse(packet)
+	if err != nil {
+		c.short.Add(1)
+		return 0, false
+	}
+	if h.Version() != Version {
+		c.badVersion.Add(1)
+		return 0, false
+	}
+
+	reserved := h.Reserved()
+	if c.features.Frag {
+		reserved &^= FlagFrag
+	}
+	if c.features.Seq {
+		reserved &^= FlagSeq
+	}
+	switch {
+	case reserved == 0:
+		return 0, true
+	case c.features.Comp && (reserved == CompLZ4 || reserved == CompZstd):
+		return byte(reserved), true
+	case c.strict:
+		c.badReserved.Add(1)
+		return 0, false
+	}
+	c.ignored.Add(1)
+	return 0, true
+}
+
+// Counters は不正なヘッダのカウンタを返す
+func (c *Checker) Counters() Counters {
+	return Counters{
+		Short:           c.short.Load(),
+		BadVersion:      c.badVersion.Load(),
+		BadReserved:     c.badReserved.Load(),
+		ReservedIgnored: c.ignored.Load(),
+	}
+}
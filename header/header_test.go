@@ -0,0 +1,72 @@
+package header
+
+import "testing"
+
+func TestHeader(t *testing.T) {
+	tests := []struct {
+		reserved uint16
+		bytes    Header
+	}{
+		{0, Header{0x30, 0x00}},
+		{CompZstd, Header{0x30, 0x02}},
+		{FlagSeq | CompLZ4, Header{0x38, 0x01}},
+		{FlagFrag, Header{0x34, 0x00}},
+		{0xFFFF, Header{0x3F, 0xFF}}, // Reservedは12bitに切り詰める
+	}
+	for _, tt := range tests {
+		h := New(tt.reserved)
+		if h != tt.bytes {
+			t.Errorf("New(0x%x) = % x, want % x", tt.reserved, h[:], tt.bytes[:])
+		}
+		p, err := Parse(h[:])
+		if err != nil || p.Version() != Version || p.Reserved() != tt.reserved&0xFFF {
+			t.Errorf("Parse(% x) = %v, %v", h[:], p, err)
+		}
+	}
+	if _, err := Parse([]byte{0x30}); err == nil {
+		t.Error("Parse of a 1-byte packet succeeded")
+	}
+}
+
+func TestChecker(t *testing.T) {
+	all := Features{Comp: true, Seq: true, Frag: true}
+	tests := []struct {
+		name     string
+		mode     string
+		features Features
+		packet   []byte
+		alg      byte
+		ok       bool
+		counters Counters
+	}{
+		{"plain", "strict", Features{}, []byte{0x30, 0x00}, 0, true, Counters{}},
+		{"short", "strict", all, []byte{0x30}, 0, false, Counters{Short: 1}},
+		{"bad version", "lenient", all, []byte{0x40, 0x00}, 0, false, Counters{BadVersion: 1}},
+		{"lz4", "strict", Features{Comp: true}, []byte{0x30, 0x01}, CompLZ4, true, Counters{}},
+		{"zstd with seq", "strict", all, []byte{0x38, 0x02}, CompZstd, true, Counters{}},
+		{"frag", "strict", Features{Frag: true}, []byte{0x34, 0x00}, 0, true, Counters{}},
+		{"comp disabled", "strict", Features{Seq: true, Frag: true}, []byte{0x30, 0x01}, 0, false, Counters{BadReserved: 1}},
+		{"seq disabled", "strict", Features{Comp: true, Frag: true}, []byte{0x38, 0x00}, 0, false, Counters{BadReserved: 1}},
+		{"frag disabled", "", Features{Comp: true, Seq: true}, []byte{0x34, 0x00}, 0, false, Counters{BadReserved: 1}},
+		{"unknown algorithm", "strict", all, []byte{0x30, 0x03}, 0, false, Counters{BadReserved: 1}},
+		{"unknown bits lenient", "lenient", Features{}, []byte{0x31, 0x23}, 0, true, Counters{ReservedIgnored: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewChecker(tt.mode, tt.features)
+			if err != nil {
+				t.Fatal(err)
+			}
+			alg, ok := c.Check(tt.packet)
+			if alg != tt.alg || ok != tt.ok {
+				t.Errorf("Check(% x) = %d, %v, want %d, %v", tt.packet, alg, ok, tt.alg, tt.ok)
+			}
+			if got := c.Counters(); got != tt.counters {
+				t.Errorf("Counters() = %+v, want %+v", got, tt.counters)
+			}
+		})
+	}
+	if _, err := NewChecker("loose", Features{}); err == nil {
+		t.Error("NewChecker accepted an unknown mode")
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// HealthConfigはオーケストレータ向けのヘルスチェックエンドポイントの設定を保持する
+type HealthConfig struct {
+	Listen   string `yaml:"listen"`    // /healthz・/readyzの待ち受けアドレス（空で無効）
+	Peers    string `yaml:"peers"`     // /readyzで要求するピアの状態（any: 1台以上が生存, all: 全台が生存, none: 見ない）
+	DNSGrace string `yaml:"dns_grace"` // 宛先の再解決に失敗し続けても準備完了とみなす時間
+}
+
+// ヘルスチェック関連の定数定義
+const (
+	healthPeersAny  = "any"
+	healthPeersAll  = "all"
+	healthPeersNone = "none"
+
+	defaultDNSGrace = time.Minute
+)
+
+// parseHealthConfig はヘルスチェックの設定値を検証する関数（ピア条件と再解決の猶予を返す）
+func parseHealthConfig(cfg HealthConfig) (string, time.Duration, error) {
+	peers := cfg.Peers
+	switch peers {
+	case "":
+		peers = healthPeersAny
+	case healthPeersAny, healthPeersAll, healthPeersNone:
+	default:
+		return "", 0, fmt.Errorf("unknown peers %q (any, all, none)", cfg.Peers)
+	}
+	grace := defaultDNSGrace
+	if cfg.DNSGrace != "" {
+		d, err := time.ParseDuration(cfg.DNSGrace)
+		if err != nil {
+			return "", 0, fmt.Errorf("dns_grace: %w", err)
+		}
+		if d < 0 {
+			return "", 0, fmt.Errorf("dns_grace %v must not be negative", d)
+		}
+		grace = d
+	}
+	return peers, grace, nil
+}
+
+// HealthCheckはヘルスチェック1項目分の結果
+type HealthCheck struct {
+	Tunnel string `json:"tunnel"`
+	Check  string `json:"check"` // tap, socket, peers, dns
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// HealthReportは/healthz・/readyzで返す結果
+type HealthReport struct {
+	Status string        `json:"status"` // ok, fail
+	Checks []HealthCheck `json:"checks"`
+}
+
+// healthCheckerは全トンネルのヘルスチェックを行う
+type healthChecker struct {
+	tunnels []*Tunnel
+	peers   string
+	grace   time.Duration
+}
+
+// checkTAP はTAPが存在し、UPになっているか確認する関数
+func checkTAP(t *Tunnel) HealthCheck {
+	c := HealthCheck{Tunnel: t.cfg.TapName, Check: "tap"}
+	if simulation != nil {
+		c.OK, c.Detail = true, "simulated"
+		return c
+	}
+	ifi, err := net.InterfaceByName(t.cfg.TapName)
+	switch {
+	case err != nil:
+		c.Detail = err.Error()
+	case ifi.Flags&net.FlagUp == 0:
+		c.Detail = "interface is down"
+	default:
+		c.OK = true
+	}
+	return c
+}
+
+// checkSockets はRAWソケットが閉じられていないか確認する関数
+func checkSockets(t *Tunnel) HealthCheck {
+	c := HealthCheck{Tunnel: t.cfg.TapName, Check: "socket", OK: true}
+	for _, s := range t.socks {
+		if s.sim != nil {
+			continue
+		}
+		raw, err := s.Conn.SyscallConn()
+		if err == nil {
+			err = raw.Control(func(uintptr) {})
+		}
+		if err != nil {
+			c.OK, c.Detail = false, fmt.Sprintf("IPv%d: %v", s.Version, err)
+			break
+		}
+	}
+	return c
+}
+
+// checkPeers はキープアライブで生存と判定されているピアの数を条件と照らし合わせる関数
+func (h *healthChecker) checkPeers(t *Tunnel) HealthCheck {
+	c := HealthCheck{Tunnel: t.cfg.TapName, Check: "peers"}
+	up := 0
+	for _, peer := range t.peers {
+		if peer.up.Load() {
+			up++
+		}
+	}
+	c.Detail = fmt.Sprintf("%d/%d up", up, len(t.peers))
+	switch h.peers {
+	case healthPeersAll:
+		c.OK = up == len(t.peers)
+	case healthPeersAny:
+		c.OK = up > 0
+	}
+	if t.keepaliveInterval == 0 {
+		c.Detail += " (keepalive off)"
+	}
+	return c
+}
+
+// checkDNS は宛先の再解決が猶予を超えて失敗し続けていないか確認する関数
+func (h *healthChecker) checkDNS(t *Tunnel, now time.Time) HealthCheck {
+	c := HealthCheck{Tunnel: t.cfg.TapName, Check: "dns", OK: true}
+	for _, peer := range t.peers {
+		for _, p := range peer.paths {
+			since := p.dnsFailed.Load()
+			if since == 0 {
+				continue
+			}
+			failing := now.Sub(time.Unix(0, since)).Truncate(time.Second)
+			if failing > h.grace {
+				c.OK = false
+			}
+			c.Detail = fmt.Sprintf("%s (IPv%d) failing for %v", p.Host, p.Version, failing)
+			if !c.OK {
+				return c
+			}
+		}
+	}
+	return c
+}
+
+// report は全トンネルのチェック結果をまとめる関数（readyがfalseならTAP・ソケットのみ）
+func (h *healthChecker) report(ready bool) HealthReport {
+	rep := HealthReport{Status: "ok", Checks: []HealthCheck{}}
+	now := time.Now()
+	for _, t := range h.tunnels {
+		rep.Checks = append(rep.Checks, checkTAP(t), checkSockets(t))
+		if ready {
+			if h.peers != healthPeersNone {
+				rep.Checks = append(rep.Checks, h.checkPeers(t))
+			}
+			rep.Checks = append(rep.Checks, h.checkDNS(t, now))
+		}
+	}
+	for _, c := range rep.Checks {
+		if !c.OK {
+			rep.Status = "fail"
+		}
+	}
+	return rep
+}
+
+// handler は結果をJSONで返し、失敗があれば503とするハンドラを返す関数
+func (h *healthChecker) handler(ready bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rep := h.report(ready)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if rep.Status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if r.Method == http.MethodHead {
+			return
+		}
+		json.NewEncoder(w).Encode(rep)
+	}
+}
+
+// startHealth はKubernetes・Nomadなどのプローブ向けに/healthz・/readyzを起動する関数
+//
+// /healthzはTAPとRAWソケット、/readyzはそれに加えてピアの生存と宛先の名前解決を確認する。
+// 認証はなく、カウンタや設定は返さない。
+func startHealth(cfg HealthConfig, tunnels []*Tunnel) error {
+	peers, grace, err := parseHealthConfig(cfg)
+	if err != nil {
+		logf("[ERROR]", "health: %v", err)
+		return err
+	}
+	ln, err := listenAPI(cfg.Listen)
+	if err != nil {
+		logf("[ERROR]", "Failed to listen health on %s: %v", cfg.Listen, err)
+		return err
+	}
+	h := &healthChecker{tunnels: tunnels, peers: peers, grace: grace}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.handler(false))
+	mux.HandleFunc("/readyz", h.handler(true))
+
+	logf("[INFO]", "Health endpoints listening on %s", cfg.Listen)
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			logf("[ERROR]", "Health server: %v", err)
+		}
+	}()
+	return nil
+}
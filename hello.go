@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// ハンドシェイク関連の定数定義
+const (
+	helloInterval = 10 * time.Minute // 対向の情報を取得済みの場合の再送間隔（再起動・更新の検出用）
+	helloRetry    = 10 * time.Second // 対向の情報が未取得の場合の再送間隔
+)
+
+// buildVersion はビルド時に -ldflags "-X main.buildVersion=v1.2.3" で埋め込むバージョン
+var buildVersion = ""
+
+// daemonVersion は自身のバージョンを返す関数（未指定ならモジュール情報・VCSリビジョンから）
+func daemonVersion() string {
+	if buildVersion != "" {
+		return buildVersion
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "devel"
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	var rev, dirty string
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			rev = s.Value[:min(12, len(s.Value))]
+		case "vcs.modified":
+			if s.Value == "true" {
+				dirty = "-dirty"
+			}
+		}
+	}
+	if rev == "" {
+		return "devel"
+	}
+	return "devel-" + rev + dirty
+}
+
+// PeerSoftwareは対向デーモンからハンドシェイクで受け取ったソフトウェア情報
+type PeerSoftware struct {
+	Version   string `json:"version"`
+	Platform  string `json:"platform"` // GOOS/GOARCH
+	GoVersion string `json:"go"`
+	Seen      int64  `json:"seen,omitempty"`     // 最後に受け取った時刻（Unix秒、受信側で設定）
+	Observed  string `json:"observed,omitempty"` // 応答のみ: 要求の送信元として見えたアドレス
+
+	Capabilities *Capabilities `json:"capabilities,omitempty"` // データパスの設定（能力の交換に対応していない旧版では省略）
+}
+
+// localSoftware は自身のソフトウェア情報と能力をハンドシェイクの本文にする関数（observedは応答時のみ）
+func (t *Tunnel) localSoftware(observed string) []byte {
+	body, _ := json.Marshal(PeerSoftware{
+		Version:      daemonVersion(),
+		Platform:     runtime.GOOS + "/" + runtime.GOARCH,
+		GoVersion:    runtime.Version(),
+		Observed:     observed,
+		Capabilities: t.localCapabilities(),
+	})
+	return body
+}
+
+// noteSoftware はハンドシェイクで受け取った対向の情報を記録し、初回・変更時にログ出力する関数（不正な本文ならnilを返す）
+func (t *Tunnel) noteSoftware(peer *Peer, body []byte) *PeerSoftware {
+	var sw PeerSoftware
+	if err := json.Unmarshal(body, &sw); err != nil || sw.Version == "" {
+		return nil
+	}
+	sw.Seen = time.Now().Unix()
+	prev := peer.software.Swap(&sw)
+	if prev == nil || prev.Version != sw.Version || prev.Platform != sw.Platform {
+		logf("[INFO]", "Peer %s runs etherip %s (%s, %s)", peer.Host, sw.Version, sw.Platform, sw.GoVersion)
+	}
+	if t.negotiate != nil {
+		t.negotiate.check(t, peer, sw.Capabilities)
+	}
+	return &sw
+}
+
+// runHello は全ピアへ定期的にハンドシェイクを送り、対向のソフトウェア情報を取得する関数
+//
+// 要求にも自身の情報を載せるため、どちらか一方が送れば両端が互いの情報を得る。
+// 対応していない古いデーモンは要求を無視するため、情報は未取得のままとなる。
+// 能力が一致しないピアには、設定の修正・再起動を早く検出できるよう未取得時と同じ間隔で送り続ける。
+func (t *Tunnel) runHello() {
+	body := t.localSoftware("")
+	packet := buildOAMFrame(t.mac, oamHelloRequest, body)
+	last := make(map[*Peer]time.Time)
+	ticker := time.NewTicker(helloRetry)
+	defer ticker.Stop()
+	for now := time.Now(); ; now = <-ticker.C {
+		for _, peer := range t.peers {
+			if peer.software.Load() != nil && peer.mismatch.Load() == nil && now.Sub(last[peer]) < helloInterval && !peer.rehello.Swap(false) {
+				continue
+			}
+			p := peer.active.Load()
+			p.write(t.seal(p, buildEtherIPPacket(packet)), t.qos.oob(p.Version, -1))
+			last[peer] = now
+		}
+	}
+}
+
+// replyHello はハンドシェイク要求へ自身の情報を返す関数
+func (t *Tunnel) replyHello(p *Path, from net.Addr) {
+	observed := ""
+	if addr, ok := from.(*net.IPAddr); ok {
+		observed = addr.IP.String()
+	}
+	reply := buildOAMFrame(t.mac, oamHelloReply, t.localSoftware(observed))
+	p.writeTo(t.seal(p, buildEtherIPPacket(reply)), from)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// frameSizeBounds はフレーム長ヒストグラムのバケットの上限（バイト、Ethernetヘッダを含む内側フレーム長）
+//
+// 1280（IPv6最小MTU）・1514/1518（標準MTUのフレーム、タグ付き）・9018（ジャンボ）の前後を分け、MTU調整の判断に使う。
+var frameSizeBounds = []uint64{64, 128, 256, 512, 1024, 1280, 1400, 1514, 1518, 1522, 2048, 4096, 9018}
+
+// rttBounds はRTTヒストグラムのバケットの上限
+var rttBounds = []uint64{
+	uint64(500 * time.Microsecond), uint64(time.Millisecond), uint64(2500 * time.Microsecond),
+	uint64(5 * time.Millisecond), uint64(10 * time.Millisecond), uint64(25 * time.Millisecond),
+	uint64(50 * time.Millisecond), uint64(100 * time.Millisecond), uint64(250 * time.Millisecond),
+	uint64(500 * time.Millisecond), uint64(time.Second), uint64(2500 * time.Millisecond),
+}
+
+// histogramは昇順の上限を持つバケットへ値を数える（起動時からの累計）
+type histogram struct {
+	bounds []uint64
+	counts []atomic.Uint64 // バケットごと（最後は上限超え）
+	sum    atomic.Uint64
+}
+
+// HistogramSnapshotはAPI・メトリクス出力用のヒストグラムの値
+type HistogramSnapshot struct {
+	Bounds []uint64 `json:"bounds"` // バケットの上限
+	Counts []uint64 `json:"counts"` // バケットごとの数（累積ではない、最後は上限超え）
+	Sum    uint64   `json:"sum"`
+	Count  uint64   `json:"count"`
+}
+
+// newHistogram はヒストグラムを生成する関数
+func newHistogram(bounds []uint64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds)+1)}
+}
+
+// observe は値を1つ記録する関数
+func (h *histogram) observe(v uint64) {
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(v)
+}
+
+// snapshot は現在の値を返す関数
+func (h *histogram) snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{Bounds: h.bounds, Counts: make([]uint64, len(h.counts)), Sum: h.sum.Load()}
+	for i := range h.counts {
+		s.Counts[i] = h.counts[i].Load()
+		s.Count += s.Counts[i]
+	}
+	return s
+}
+
+// quantile は値のq分位（0-1）が入るバケットの上限を返す関数（上限超えのバケットならok=false）
+func (s HistogramSnapshot) quantile(q float64) (bound uint64, ok bool) {
+	if s.Count == 0 {
+		return 0, false
+	}
+	rank := uint64(q*float64(s.Count) + 0.5)
+	var seen uint64
+	for i, c := range s.Counts {
+		seen += c
+		if seen >= max(rank, 1) {
+			if i == len(s.Bounds) {
+				return 0, false
+			}
+			return s.Bounds[i], true
+		}
+	}
+	return 0, false
+}
+
+// mean は平均値を返す関数
+func (s HistogramSnapshot) mean() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return float64(s.Sum) / float64(s.Count)
+}
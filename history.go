@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// 統計履歴関連の定数定義
+const (
+	historyDefaultRetention = 30 * 24 * time.Hour // 既定の保存期間
+	historyDefaultRange     = 24 * time.Hour      // /historyでfromを省略したときの範囲
+	historyMaxPoints        = 10000               // /historyで返す点数の上限（超える場合はstepを大きくする）
+)
+
+// HistoryConfigは分単位の転送統計を保存する組み込みDBの設定を保持する（トップレベルのみ）
+type HistoryConfig struct {
+	File      string `yaml:"file"`      // DBファイル（空で無効）
+	Retention string `yaml:"retention"` // 保存期間（空で720h）
+}
+
+// HistoryPointは履歴の1点（1分、またはstepでまとめた区間の差分）
+type HistoryPoint struct {
+	Time      int64   `json:"time"`    // 区間の開始時刻（Unix秒）
+	Seconds   float64 `json:"seconds"` // 実際に集計した秒数（起動直後・停止中の区間は短い）
+	TxFrames  uint64  `json:"tx_frames"`
+	TxBytes   uint64  `json:"tx_bytes"`
+	RxFrames  uint64  `json:"rx_frames"`
+	RxBytes   uint64  `json:"rx_bytes"`
+	TxDropped uint64  `json:"tx_dropped"`
+	RxDropped uint64  `json:"rx_dropped"`
+	TxErrors  uint64  `json:"tx_errors"`
+	RxErrors  uint64  `json:"rx_errors"`
+}
+
+// HistoryReportは/historyで返す履歴
+type HistoryReport struct {
+	Tap    string         `json:"tap"`
+	From   int64          `json:"from"`
+	To     int64          `json:"to"`
+	Step   int64          `json:"step"` // 1点の区間（秒）
+	Points []HistoryPoint `json:"points"`
+}
+
+// historyRecorderはトンネルごとの転送統計を1分ごとにDBへ書き込む
+type historyRecorder struct {
+	db        *bolt.DB
+	retention time.Duration
+	tunnels   []*Tunnel
+
+	mu   sync.Mutex
+	prev map[*Tunnel]statsTotals // 前回書き込み時の累計
+	last time.Time
+}
+
+// history は統計履歴の記録先（nilなら無効）
+var history *historyRecorder
+
+// parseHistoryConfig は統計履歴の設定を検証する関数
+func parseHistoryConfig(cfg HistoryConfig) (time.Duration, error) {
+	if cfg.Retention == "" {
+		return historyDefaultRetention, nil
+	}
+	if cfg.File == "" {
+		return 0, fmt.Errorf("retention requires file")
+	}
+	retention, err := time.ParseDuration(cfg.Retention)
+	if err != nil {
+		return 0, fmt.Errorf("retention: %w", err)
+	}
+	if retention < time.Hour {
+		return 0, fmt.Errorf("retention %v must be at least 1h", retention)
+	}
+	return retention, nil
+}
+
+// startHistory は統計履歴のDBを開いて記録を開始する関数（fileが空なら何もしない）
+func startHistory(cfg HistoryConfig, tunnels []*Tunnel) error {
+	retention, err := parseHistoryConfig(cfg)
+	if err != nil || cfg.File == "" {
+		return err
+	}
+	db, err := bolt.Open(cfg.File, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("open %s: %w", cfg.File, err)
+	}
+	h := &historyRecorder{db: db, retention: retention, tunnels: tunnels, prev: make(map[*Tunnel]statsTotals), last: time.Now()}
+	for _, t := range tunnels {
+		h.prev[t] = trafficTotals(t)
+	}
+	history = h
+	registerCleanup(func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.record(time.Now())
+		if err := h.db.Close(); err != nil {
+			logf("[WARN]", "Failed to close stats history %s: %v", cfg.File, err)
+		}
+		h.db = nil
+	})
+	go h.run()
+	logf("[INFO]", "Stats history: %s (retention %v)", cfg.File, retention)
+	return nil
+}
+
+// run は分の境目ごとに履歴を書き込み、保存期間を過ぎた点を削除する関数
+func (h *historyRecorder) run() {
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		now = time.Now()
+		h.mu.Lock()
+		h.record(now)
+		h.prune(now)
+		h.mu.Unlock()
+	}
+}
+
+// historyKey は区間の開始時刻をDBのキー（ビッグエンディアン、時刻順に並ぶ）にする関数
+func historyKey(t int64) []byte {
+	var k [8]byte
+	binary.BigEndian.PutUint64(k[:], uint64(t))
+	return k[:]
+}
+
+// record は前回からの差分を直前の分の点として書き込む関数（h.muを保持して呼ぶ）
+//
+// 同じ分の点が既にあれば（再起動・終了時の書き込み）足し合わせる。
+func (h *historyRecorder) record(now time.Time) {
+	if h.db == nil {
+		return
+	}
+	elapsed := now.Sub(h.last).Seconds()
+	// 分の境目の直後に起きた場合は終わった分へ記録する
+	minute := now.Add(-time.Second).Truncate(time.Minute).Unix()
+	h.last = now
+
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		for _, t := range h.tunnels {
+			cur := trafficTotals(t)
+			prev := h.prev[t]
+			h.prev[t] = cur
+			p := HistoryPoint{
+				Time:      minute,
+				Seconds:   elapsed,
+				TxFrames:  cur.TxFrames - prev.TxFrames,
+				TxBytes:   cur.TxBytes - prev.TxBytes,
+				RxFrames:  cur.RxFrames - prev.RxFrames,
+				RxBytes:   cur.RxBytes - prev.RxBytes,
+				TxDropped: cur.TxDropped - prev.TxDropped,
+				RxDropped: cur.RxDropped - prev.RxDropped,
+				TxErrors:  cur.TxErrors - prev.TxErrors,
+				RxErrors:  cur.RxErrors - prev.RxErrors,
+			}
+			b, err := tx.CreateBucketIfNotExists([]byte(t.cfg.TapName))
+			if err != nil {
+				return err
+			}
+			key := historyKey(minute)
+			if v := b.Get(key); v != nil {
+				var old HistoryPoint
+				if json.Unmarshal(v, &old) == nil {
+					p.add(old)
+				}
+			}
+			data, err := json.Marshal(p)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(key, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logf("[WARN]", "Failed to write stats history: %v", err)
+	}
+}
+
+// prune は保存期間を過ぎた点を削除する関数（h.muを保持して呼ぶ）
+func (h *historyRecorder) prune(now time.Time) {
+	if h.db == nil {
+		return
+	}
+	limit := historyKey(now.Add(-h.retention).Unix())
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(_ []byte, b *bolt.Bucket) error {
+			c := b.Cursor()
+			for k, _ := c.First(); k != nil && string(k) < string(limit); k, _ = c.First() {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		logf("[WARN]", "Failed to prune stats history: %v", err)
+	}
+}
+
+// add は別の区間の値を足し合わせる関数（時刻は変えない）
+func (p *HistoryPoint) add(o HistoryPoint) {
+	p.Seconds += o.Seconds
+	p.TxFrames += o.TxFrames
+	p.TxBytes += o.TxBytes
+	p.RxFrames += o.RxFrames
+	p.RxBytes += o.RxBytes
+	p.TxDropped += o.TxDropped
+	p.RxDropped += o.RxDropped
+	p.TxErrors += o.TxErrors
+	p.RxErrors += o.RxErrors
+}
+
+// query はトンネルの[from, to)の点をstepの区間ごとにまとめて返す関数（h.muを保持して呼ぶ）
+func (h *historyRecorder) query(tap string, from, to time.Time, step time.Duration) ([]HistoryPoint, error) {
+	points := []HistoryPoint{}
+	stepSec := int64(step / time.Second)
+	err := h.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(tap))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		end := string(historyKey(to.Unix()))
+		for k, v := c.Seek(historyKey(from.Unix())); k != nil && string(k) < end; k, v = c.Next() {
+			var p HistoryPoint
+			if err := json.Unmarshal(v, &p); err != nil {
+				continue
+			}
+			p.Time -= (p.Time - from.Unix()) % stepSec
+			if n := len(points); n > 0 && points[n-1].Time == p.Time {
+				points[n-1].add(p)
+				continue
+			}
+			points = append(points, p)
+		}
+		return nil
+	})
+	return points, err
+}
+
+// parseHistoryTime は/historyの時刻（Unix秒、RFC3339、"-24h"のような現在からの相対時間）を解釈する関数
+func parseHistoryTime(s string, now time.Time) (time.Time, error) {
+	if strings.HasPrefix(s, "-") {
+		d, err := time.ParseDuration(s[1:])
+		if err != nil {
+			return time.Time{}, err
+		}
+		return now.Add(-d), nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// historyReport は制御APIのクエリ（from, to, step）から履歴を作る関数
+func (h *historyRecorder) historyReport(tap string, q url.Values) (HistoryReport, error) {
+	now := time.Now()
+	from, to := now.Add(-historyDefaultRange), now
+	step := time.Minute
+	var err error
+	if s := q.Get("from"); s != "" {
+		if from, err = parseHistoryTime(s, now); err != nil {
+			return HistoryReport{}, fmt.Errorf("from: %w", err)
+		}
+	}
+	if s := q.Get("to"); s != "" {
+		if to, err = parseHistoryTime(s, now); err != nil {
+			return HistoryReport{}, fmt.Errorf("to: %w", err)
+		}
+	}
+	if s := q.Get("step"); s != "" {
+		if step, err = time.ParseDuration(s); err != nil {
+			return HistoryReport{}, fmt.Errorf("step: %w", err)
+		}
+		if step < time.Minute || step%time.Minute != 0 {
+			return HistoryReport{}, fmt.Errorf("step %v must be a multiple of 1m", step)
+		}
+	}
+	from = from.Truncate(time.Minute)
+	if !to.After(from) {
+		return HistoryReport{}, fmt.Errorf("to must be after from")
+	}
+	if to.Sub(from)/step > historyMaxPoints {
+		return HistoryReport{}, fmt.Errorf("too many points (at most %d); use a larger step", historyMaxPoints)
+	}
+
+	// 書き込み前の今の分も返せるよう、記録中の値を先に書き込む
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.db == nil {
+		return HistoryReport{}, fmt.Errorf("stats history is closed")
+	}
+	if to.After(h.last) {
+		h.record(now)
+	}
+
+	points, err := h.query(tap, from, to, step)
+	if err != nil {
+		return HistoryReport{}, err
+	}
+	return HistoryReport{Tap: tap, From: from.Unix(), To: to.Unix(), Step: int64(step / time.Second), Points: points}, nil
+}
+
+// handleHistory は/historyの要求を処理する関数
+func handleHistory(w http.ResponseWriter, r *http.Request, t *Tunnel) {
+	if history == nil {
+		http.Error(w, "stats history is disabled (history.file)", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rep, err := history.historyReport(t.cfg.TapName, r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, rep)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ホスト経路関連の定数定義
+const hostRouteCheckInterval = time.Second // 宛先の変更（DNS再解決）を確認する間隔
+
+// HostRouteConfigはピアの宛先へのホスト経路（/32, /128）を固定する設定を保持する
+//
+// トンネル越しのネットワークにピアのアドレスが含まれると、外側パケットがトンネル自身へ
+// 経路選択されて再帰する。src_ifaceとアンダーレイのネクストホップを指定した経路を入れて防ぐ。
+type HostRouteConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Gateway  string `yaml:"gateway"`  // IPv4のネクストホップ（省略時はsrc_ifaceの経路から自動検出）
+	Gateway6 string `yaml:"gateway6"` // IPv6のネクストホップ（省略時はsrc_ifaceの経路から自動検出）
+	Metric   int    `yaml:"metric"`   // 経路のメトリック（0で指定しない）
+}
+
+// hostRouteは設置済みのホスト経路
+type hostRoute struct {
+	dst net.IP
+	via net.IP // nilならオンリンク
+}
+
+// hostRouterはピアの各経路の宛先へのホスト経路を設置し、宛先の変更に追従する
+type hostRouter struct {
+	t        *Tunnel
+	iface    string
+	gateways map[int]net.IP // 設定されたネクストホップ（アドレスファミリ別）
+	metric   int
+
+	mu        sync.Mutex
+	installed map[*Path]hostRoute
+
+	updates atomic.Uint64 // 宛先の変更で経路を入れ替えた回数
+}
+
+// parseHostRouteGateways はネクストホップの設定を検証する関数
+func parseHostRouteGateways(cfg HostRouteConfig) (map[int]net.IP, error) {
+	gateways := make(map[int]net.IP)
+	for _, g := range []struct {
+		key, value string
+		version    int
+	}{{"gateway", cfg.Gateway, 4}, {"gateway6", cfg.Gateway6, 6}} {
+		if g.value == "" {
+			continue
+		}
+		ip := net.ParseIP(g.value)
+		if ip == nil || (ip.To4() != nil) != (g.version == 4) {
+			return nil, fmt.Errorf("%s: invalid IPv%d address %q", g.key, g.version, g.value)
+		}
+		gateways[g.version] = ip
+	}
+	return gateways, nil
+}
+
+// newHostRouter はホスト経路の設定を検証し、全経路の宛先へ経路を設置する関数
+func newHostRouter(t *Tunnel, cfg HostRouteConfig) (*hostRouter, error) {
+	gateways, err := parseHostRouteGateways(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Metric < 0 {
+		return nil, fmt.Errorf("metric %d must not be negative", cfg.Metric)
+	}
+	h := &hostRouter{
+		t:         t,
+		iface:     t.cfg.SrcIface,
+		gateways:  gateways,
+		metric:    cfg.Metric,
+		installed: make(map[*Path]hostRoute),
+	}
+	for _, peer := range t.peers {
+		for _, p := range peer.paths {
+			if err := h.install(p); err != nil {
+				h.removeAll()
+				return nil, fmt.Errorf("%s: %w", peer.Host, err)
+			}
+		}
+	}
+	return h, nil
+}
+
+// hostPrefix は宛先のホスト経路のプレフィックス表記を返す関数
+func hostPrefix(dst net.IP) string {
+	if dst.To4() != nil {
+		return dst.String() + "/32"
+	}
+	return dst.String() + "/128"
+}
+
+// detectGateway はsrc_ifaceから宛先へ出る経路のネクストホップを調べる関数（オンリンクならnil）
+func detectGateway(dst net.IP, iface string) (net.IP, error) {
+	out, err := exec.Command("ip", "-o", "route", "get", dst.String(), "oif", iface).Output()
+	if err != nil {
+		return nil, fmt.Errorf("no route to %s via %s", dst, iface)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) > 0 && fields[0] == "local" {
+		return nil, fmt.Errorf("%s is a local address", dst)
+	}
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "via" {
+			return net.ParseIP(fields[i+1]), nil
+		}
+	}
+	return nil, nil
+}
+
+// routeArgs はホスト経路を設置・削除するipコマンドの引数を返す関数
+func (h *hostRouter) routeArgs(op string, p *Path, r hostRoute) []string {
+	args := []string{"route", op, hostPrefix(r.dst)}
+	if r.via != nil {
+		args = append(args, "via", r.via.String())
+	}
+	args = append(args, "dev", h.iface)
+	if op == "replace" {
+		args = append(args, "src", p.SrcIP.Load().(net.IP).String())
+	}
+	if h.metric > 0 {
+		args = append(args, "metric", strconv.Itoa(h.metric))
+	}
+	if p.Version == 6 {
+		args = append([]string{"-6"}, args...)
+	}
+	return args
+}
+
+// install は経路の現在の宛先へホスト経路を設置し、以前の宛先の経路を削除する関数
+func (h *hostRouter) install(p *Path) error {
+	dst := p.Dst.Load().(net.IP)
+	prev, ok := h.installed[p]
+	if ok && prev.dst.Equal(dst) {
+		return nil
+	}
+
+	r := hostRoute{dst: dst, via: h.gateways[p.Version]}
+	if r.via == nil {
+		via, err := detectGateway(dst, h.iface)
+		if err != nil {
+			return err
+		}
+		r.via = via
+	}
+	if out, err := exec.Command("ip", h.routeArgs("replace", p, r)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("ip route replace %s: %v: %s", hostPrefix(dst), err, strings.TrimSpace(string(out)))
+	}
+	if r.via != nil {
+		logf("[INFO]", "Host route %s via %s dev %s installed", hostPrefix(dst), r.via, h.iface)
+	} else {
+		logf("[INFO]", "Host route %s dev %s installed", hostPrefix(dst), h.iface)
+	}
+
+	if ok {
+		h.remove(p, prev)
+	}
+	h.installed[p] = r
+	return nil
+}
+
+// remove はホスト経路を削除する関数
+func (h *hostRouter) remove(p *Path, r hostRoute) {
+	if err := exec.Command("ip", h.routeArgs("del", p, r)...).Run(); err != nil {
+		logf("[WARN]", "Failed to delete host route %s: %v", hostPrefix(r.dst), err)
+		return
+	}
+	logf("[INFO]", "Host route %s removed", hostPrefix(r.dst))
+}
+
+// removeAll は設置した全ホスト経路を削除する関数
+func (h *hostRouter) removeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for p, r := range h.installed {
+		h.remove(p, r)
+	}
+	clear(h.installed)
+}
+
+// run は宛先の変更を監視し、ホスト経路を付け替える関数
+func (h *hostRouter) run() {
+	ticker := time.NewTicker(hostRouteCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.mu.Lock()
+		for _, peer := range h.t.peers {
+			for _, p := range peer.paths {
+				if r, ok := h.installed[p]; ok && r.dst.Equal(p.Dst.Load().(net.IP)) {
+					continue
+				}
+				if err := h.install(p); err != nil {
+					logf("[WARN]", "Host route to %s: %v", peer.Host, err)
+					continue
+				}
+				h.updates.Add(1)
+			}
+		}
+		h.mu.Unlock()
+	}
+}
+
+// Counters はホスト経路の数と付け替え回数を返す
+func (h *hostRouter) Counters() map[string]uint64 {
+	h.mu.Lock()
+	n := len(h.installed)
+	h.mu.Unlock()
+	return map[string]uint64{
+		"host_routes":        uint64(n),
+		"host_route_updates": h.updates.Load(),
+	}
+}
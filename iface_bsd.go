@@ -0,0 +1,364 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/songgao/water"
+	"golang.org/x/sys/unix"
+)
+
+// BSDのtap(4)は名前を変更できない（OpenBSD）か、変更するとデバイスノードと対応しなくなるため、
+// tap_nameにはクローンするインターフェース名（tap0等）をそのまま指定させる
+// （macOSはtapカーネル拡張の/dev/tapNを開くとインターフェースが現れ、閉じると消える）
+var bsdTAPName = regexp.MustCompile(`^tap[0-9]+$`)
+
+// bsdBridgeName はブリッジとして扱うインターフェース名（bridge(4)・OpenBSDのveb(4)）
+var bsdBridgeName = regexp.MustCompile(`^(bridge|veb)[0-9]+$`)
+
+// ifreqLen はstruct ifreqの大きさ（ioctlの要求番号に埋め込まれた引数長から求める、NetBSDは他より大きい）
+const ifreqLen = unix.SIOCSIFFLAGS >> 16 & 0x1fff
+
+// timeTSize はtime_tの大きさ（FreeBSDの386のみ4バイト）
+const timeTSize = unsafe.Sizeof(unix.Timespec{}.Sec)
+
+// in6AliasReqLen はstruct in6_aliasreqの大きさ（名前・sockaddr_in6×3・ifra_flagsの後にin6_addrlifetimeとOS固有の末尾が続く）
+const in6AliasReqLen = (unix.IFNAMSIZ + 3*unix.SizeofSockaddrInet6 + 4 + 2*timeTSize + 8 + in6AliasReqExtra + timeTSize - 1) &^ (timeTSize - 1)
+
+// siocAIFADDRIN6 はIPv6アドレスを追加するSIOCAIFADDR_IN6（_IOW('i', n, struct in6_aliasreq)、x/sysに定義がない）
+const siocAIFADDRIN6 = uint(0x80000000 | in6AliasReqLen<<16 | 'i'<<8 | siocAIFADDRIN6Num)
+
+// nd6InfiniteLifetime はIPv6アドレスの有効期限を無期限にするND6_INFINITE_LIFETIME
+const nd6InfiniteLifetime = 0xffffffff
+
+// ifreqはインターフェースのioctlに渡すstruct ifreq（名前の後ろにフラグ・MTU等の共用体が続く）
+type ifreq struct {
+	name string
+	buf  []byte
+}
+
+// newIfreq はnameのstruct ifreqを作る関数
+func newIfreq(name string) (*ifreq, error) {
+	return newIfreqFor(name, unix.SIOCSIFFLAGS)
+}
+
+// newIfreqFor はreqの引数長に合わせ、先頭にnameを置いた構造体（ifaliasreq・in6_aliasreq等）を作る関数
+func newIfreqFor(name string, req uint) (*ifreq, error) {
+	if len(name) >= unix.IFNAMSIZ {
+		return nil, fmt.Errorf("interface name %s is too long", name)
+	}
+	ifr := &ifreq{name: name, buf: make([]byte, req>>16&0x1fff)}
+	copy(ifr.buf, name)
+	return ifr, nil
+}
+
+// data は共用体（ifr_flags・ifr_mtu等）の位置を返す関数
+func (ifr *ifreq) data() []byte {
+	return ifr.buf[unix.IFNAMSIZ:]
+}
+
+// ioctl はstruct ifreqを引数にioctlを発行する関数（opはエラーに含める要求名）
+func (ifr *ifreq) ioctl(req uint, op string) error {
+	return ifioctl(unix.AF_INET, ifr.name, req, unsafe.Pointer(&ifr.buf[0]), op)
+}
+
+// ifioctl はfamilyのソケットでインターフェースnameのioctlを発行する関数
+//
+// アドレスの操作はそのアドレスファミリのソケットで行う必要がある（IPv6はAF_INET6、NetBSDのリンク層アドレスはAF_LINK）。
+func ifioctl(family int, name string, req uint, arg unsafe.Pointer, op string) error {
+	fd, err := bsdSocket(family, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", op, name, err)
+	}
+	defer unix.Close(fd)
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(req), uintptr(arg)); errno != 0 {
+		return fmt.Errorf("%s %s: %w", op, name, errno)
+	}
+	return nil
+}
+
+// bsdSocket はclose-on-execかつノンブロッキングのソケットを開く関数
+//
+// macOSにはSOCK_CLOEXEC・SOCK_NONBLOCKがないため、開いた後にForkLockの下で設定する。
+func bsdSocket(family, typ, proto int) (int, error) {
+	syscall.ForkLock.RLock()
+	defer syscall.ForkLock.RUnlock()
+	fd, err := unix.Socket(family, typ, proto)
+	if err != nil {
+		return -1, err
+	}
+	unix.CloseOnExec(fd)
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// cloneIface はインターフェース（tap(4)・bridge(4)・veb(4)）をSIOCIFCREATEでクローンする関数
+func cloneIface(name string) error {
+	ifr, err := newIfreq(name)
+	if err != nil {
+		return err
+	}
+	return ifr.ioctl(unix.SIOCIFCREATE, "SIOCIFCREATE")
+}
+
+// destroyIface はクローンしたインターフェースをSIOCIFDESTROYで削除する関数
+func destroyIface(name string) error {
+	ifr, err := newIfreq(name)
+	if err != nil {
+		return err
+	}
+	return ifr.ioctl(unix.SIOCIFDESTROY, "SIOCIFDESTROY")
+}
+
+// createTAP はtap(4)をクローンして/dev/<name>を開く関数
+//
+// 名前の変更は行わないため、返す名前は常にnameとなる。起動時に作成した場合は終了時に削除する。
+// 無停止の再起動では引き継ぎ元が開いたTAPをそのまま使う。
+func createTAP(name string, devType water.DeviceType) (*water.Interface, string, error) {
+	if devType != water.TAP {
+		return nil, "", fmt.Errorf("ifmode tun is not supported on %s", runtime.GOOS)
+	}
+	if !bsdTAPName.MatchString(name) {
+		return nil, "", fmt.Errorf("%s is not a tap(4) interface name (tap0, tap1, ...)", name)
+	}
+	if ifce, err := inheritedTAP(name); ifce != nil || err != nil {
+		if ifce != nil && inheritedCreated(name) {
+			destroyOnShutdown(name)
+		}
+		return ifce, name, err
+	}
+	if !ifaceExists(name) {
+		if err := cloneIface(name); err == nil {
+			destroyOnShutdown(name)
+		} else if _, statErr := os.Stat("/dev/" + name); statErr != nil {
+			if runtime.GOOS == "darwin" {
+				return nil, "", fmt.Errorf("/dev/%s not found: a tap kernel extension is required on macOS", name)
+			}
+			return nil, "", err
+		}
+	}
+	f, err := os.OpenFile("/dev/"+name, os.O_RDWR, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	registerCleanup(func() { f.Close() })
+	return &water.Interface{ReadWriteCloser: f}, name, nil
+}
+
+// destroyOnShutdown は起動時にクローンしたTAPを停止時に削除するよう登録する関数（無停止の再起動では新しいプロセスへ任せる）
+func destroyOnShutdown(name string) {
+	markCreated(name)
+	registerShutdown(func() {
+		if err := destroyIface(name); err != nil {
+			logf("[WARN]", "Failed to destroy %s: %v", name, err)
+		}
+	})
+}
+
+// renameInterface はBSDでは対応しない（tap_nameにクローンする名前を指定する）
+func renameInterface(oldName, newName string) error {
+	return fmt.Errorf("renaming %s to %s is not supported on %s", oldName, newName, runtime.GOOS)
+}
+
+// linkUp はインターフェースを有効(UP)にする関数（SIOCGIFFLAGSで読んだフラグにIFF_UPを足して書き戻す）
+func linkUp(ifname string) error {
+	ifr, err := newIfreq(ifname)
+	if err == nil {
+		err = ifr.ioctl(unix.SIOCGIFFLAGS, "SIOCGIFFLAGS")
+	}
+	if err == nil {
+		flags := binary.NativeEndian.Uint16(ifr.data())
+		binary.NativeEndian.PutUint16(ifr.data(), flags|unix.IFF_UP)
+		err = ifr.ioctl(unix.SIOCSIFFLAGS, "SIOCSIFFLAGS")
+	}
+	if err != nil {
+		logf("[ERROR]", "Failed to set interface %s UP: %v", ifname, err)
+		return err
+	}
+	logf("[INFO]", "Interface %s set UP", ifname)
+	return nil
+}
+
+// setTAPMTU はインターフェースのMTUを設定する関数
+func setTAPMTU(name string, mtu int) error {
+	ifr, err := newIfreq(name)
+	if err == nil {
+		binary.NativeEndian.PutUint32(ifr.data(), uint32(mtu))
+		err = ifr.ioctl(unix.SIOCSIFMTU, "SIOCSIFMTU")
+	}
+	if err != nil {
+		logf("[ERROR]", "Failed to set MTU on interface %s: %v", name, err)
+		return err
+	}
+	logf("[INFO]", "MTU of interface %s set to %d", name, mtu)
+	return nil
+}
+
+// replaceAddress はインターフェースにアドレス（CIDR）を追加する関数（SIOCAIFADDR・SIOCAIFADDR_IN6、既にあれば更新される）
+func replaceAddress(ifname, cidr string) error {
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		// struct ifaliasreq: ifra_addr・ifra_broadaddr（空ならカーネルが求める）・ifra_mask
+		ifr, err := newIfreqFor(ifname, siocAIFADDR)
+		if err != nil {
+			return err
+		}
+		copy(ifr.data(), sockaddrInet4(ip4))
+		copy(ifr.data()[2*unix.SizeofSockaddrInet4:], sockaddrInet4(net.IP(ipnet.Mask)))
+		return ifr.ioctl(siocAIFADDR, "SIOCAIFADDR")
+	}
+	// struct in6_aliasreq: ifra_addr・ifra_dstaddr・ifra_prefixmask・ifra_flagsの後のifra_lifetimeを無期限にする
+	ifr, err := newIfreqFor(ifname, siocAIFADDRIN6)
+	if err != nil {
+		return err
+	}
+	copy(ifr.data(), sockaddrInet6(ip))
+	copy(ifr.data()[2*unix.SizeofSockaddrInet6:], sockaddrInet6(net.IP(ipnet.Mask)))
+	lifetime := ifr.data()[3*unix.SizeofSockaddrInet6+4+2*timeTSize:]
+	binary.NativeEndian.PutUint32(lifetime, nd6InfiniteLifetime)     // ia6t_vltime
+	binary.NativeEndian.PutUint32(lifetime[4:], nd6InfiniteLifetime) // ia6t_pltime
+	return ifioctl(unix.AF_INET6, ifname, siocAIFADDRIN6, unsafe.Pointer(&ifr.buf[0]), "SIOCAIFADDR_IN6")
+}
+
+// sockaddrInet4 はIPv4アドレス（またはマスク）のstruct sockaddr_inを返す関数
+func sockaddrInet4(ip net.IP) []byte {
+	sa := &unix.RawSockaddrInet4{Len: unix.SizeofSockaddrInet4, Family: unix.AF_INET}
+	copy(sa.Addr[:], ip.To4())
+	return unsafe.Slice((*byte)(unsafe.Pointer(sa)), unix.SizeofSockaddrInet4)
+}
+
+// sockaddrInet6 はIPv6アドレス（またはマスク）のstruct sockaddr_in6を返す関数
+func sockaddrInet6(ip net.IP) []byte {
+	sa := &unix.RawSockaddrInet6{Len: unix.SizeofSockaddrInet6, Family: unix.AF_INET6}
+	copy(sa.Addr[:], ip.To16())
+	return unsafe.Slice((*byte)(unsafe.Pointer(sa)), unix.SizeofSockaddrInet6)
+}
+
+// addToBridge はTAPインターフェースを指定したブリッジに追加する関数（既にメンバーなら何もしない）
+func addToBridge(ifname, brname string) error {
+	if err := bridgeMember(brname, ifname, true); err != nil && !errors.Is(err, unix.EEXIST) {
+		logf("[ERROR]", "Failed to add interface %s to bridge %s: %v", ifname, brname, err)
+		return err
+	}
+	logf("[INFO]", "Interface %s added to bridge %s", ifname, brname)
+	return nil
+}
+
+// isBridge はインターフェースが存在するブリッジかどうかを判定する関数
+func isBridge(name string) bool {
+	return bsdBridgeName.MatchString(name) && ifaceExists(name)
+}
+
+// createBridge はブリッジをクローンしてUPにする関数（STPはメンバーごとの設定のため対象外）
+func createBridge(name string, b bridgeSetup) error {
+	if !bsdBridgeName.MatchString(name) {
+		return fmt.Errorf("%s is not a bridge(4) interface name (bridge0, bridge1, ...)", name)
+	}
+	if err := cloneIface(name); err != nil {
+		return err
+	}
+	if b.forwardDelay > 0 {
+		if err := bridgeForwardDelay(name, uint8(min(b.forwardDelay/time.Second, 255))); err != nil {
+			return err
+		}
+	}
+	return linkUp(name)
+}
+
+// deleteBridge はブリッジを削除する関数
+func deleteBridge(name string) error {
+	return destroyIface(name)
+}
+
+// detachFromBridge はTAPインターフェースをブリッジから外す関数
+func detachFromBridge(ifname, brname string) {
+	if err := bridgeMember(brname, ifname, false); err != nil {
+		logf("[WARN]", "Failed to detach %s from bridge %s: %v", ifname, brname, err)
+		return
+	}
+	logf("[INFO]", "Interface %s detached from bridge %s", ifname, brname)
+}
+
+// waitIfaceChange は経路制御ソケットでインターフェースの変化（作成・削除・状態変更・アドレスの追加）を最大dの間待つ関数
+//
+// 呼び出し側が状態を確かめ直す。ソケットを開けなければdだけ待つ。
+func waitIfaceChange(d time.Duration) {
+	deadline := time.Now().Add(d)
+	fd, err := bsdSocket(unix.AF_ROUTE, unix.SOCK_RAW, unix.AF_UNSPEC)
+	if err != nil {
+		time.Sleep(d)
+		return
+	}
+	f := os.NewFile(uintptr(fd), "route")
+	defer f.Close()
+	f.SetReadDeadline(deadline)
+	buf := make([]byte, 2048)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			if !os.IsTimeout(err) {
+				time.Sleep(time.Until(deadline))
+			}
+			return
+		}
+		// rt_msghdr・if_msghdr等は共通して長さ(u16)・版数(u8)・種類(u8)で始まる
+		if n < 4 {
+			continue
+		}
+		switch buf[3] {
+		case unix.RTM_IFINFO, rtmIfAnnounce, unix.RTM_NEWADDR:
+			return
+		}
+	}
+}
+
+// plannedIfaceOps はdry-runで表示する、起動時のTAP・ブリッジの操作を返す関数
+func plannedIfaceOps(cfg *Config) []string {
+	ops := []string{
+		fmt.Sprintf("ifconfig %s create (unless it exists) and open /dev/%s", cfg.TapName, cfg.TapName),
+		fmt.Sprintf("ifconfig %s up", cfg.TapName),
+		fmt.Sprintf("ifconfig %s mtu %d", cfg.TapName, cfg.MTU),
+	}
+	if cfg.BrName != "off" {
+		if b, err := parseBridgeConfig(cfg.Bridge); err == nil && b.create && !ifaceExists(cfg.BrName) {
+			ops = append(ops, fmt.Sprintf("ifconfig %s create", cfg.BrName), fmt.Sprintf("ifconfig %s up", cfg.BrName))
+		}
+		ops = append(ops, fmt.Sprintf("ifconfig %s addm %s", cfg.BrName, cfg.TapName))
+	}
+	return ops
+}
+
+// checkPlatformIface はBSDのインターフェース設定の制約を確認する関数
+func checkPlatformIface(cfg *Config, r *checkResult) {
+	if cfg.IfMode == ifModeTUN {
+		r.fail("ifmode tun is not supported on %s", runtime.GOOS)
+	}
+	if !bsdTAPName.MatchString(cfg.TapName) {
+		r.fail("tap_name %s must be a tap(4) interface name (tap0, tap1, ...) on %s", cfg.TapName, runtime.GOOS)
+	}
+	if name := cfg.LocalDelivery.Iface; name != "" && !bsdTAPName.MatchString(name) {
+		r.fail("local_delivery.iface %s must be a tap(4) interface name on %s", name, runtime.GOOS)
+	}
+	if cfg.BrName != "off" && !bsdBridgeName.MatchString(cfg.BrName) {
+		r.fail("br_name %s must be a bridge(4) or veb(4) interface name on %s", cfg.BrName, runtime.GOOS)
+	}
+	if cfg.Bridge.Create && cfg.Bridge.STP {
+		r.warn("bridge.stp is not applied on %s; enable it per member with ifconfig %s stp %s", runtime.GOOS, cfg.BrName, cfg.TapName)
+	}
+}
@@ -0,0 +1,11 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+const (
+	siocAIFADDR       = unix.SIOCAIFADDR
+	siocAIFADDRIN6Num = 26 // SIOCAIFADDR_IN6
+	in6AliasReqExtra  = 0
+	ifbreqLen         = 80               // struct ifbreq（#pragma pack(4)）
+	rtmIfAnnounce     = unix.RTM_IFINFO2 // RTM_IFANNOUNCEがないため、インターフェースの追加時に届く拡張版のRTM_IFINFOを待つ
+)
@@ -0,0 +1,11 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+const (
+	siocAIFADDR       = unix.SIOCAIFADDR
+	siocAIFADDRIN6Num = 26 // SIOCAIFADDR_IN6
+	in6AliasReqExtra  = 0
+	ifbreqLen         = 72 // struct ifbreq（STPの指定ルート・対向の情報を含む）
+	rtmIfAnnounce     = unix.RTM_IFANNOUNCE
+)
@@ -0,0 +1,58 @@
+//go:build darwin || dragonfly || freebsd || netbsd
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// bridge(4)のSIOCSDRVSPECで渡す要求（if_bridgevar.hのBRDG*）
+const (
+	brdgAdd = 0  // BRDGADD: メンバーの追加（struct ifbreq）
+	brdgDel = 1  // BRDGDEL: メンバーの削除（struct ifbreq）
+	brdgSFD = 18 // BRDGSFD: フォワーディング遅延の設定（struct ifbrparam）
+)
+
+// ifdrv はドライバ固有の要求をSIOCSDRVSPECで渡すstruct ifdrv
+type ifdrv struct {
+	name [unix.IFNAMSIZ]byte
+	cmd  uintptr
+	len  uintptr
+	data unsafe.Pointer
+}
+
+// bridgeDrvSpec はブリッジbrnameへSIOCSDRVSPECでcmdを発行する関数（argはcmdごとの構造体）
+func bridgeDrvSpec(brname string, cmd uintptr, arg []byte, op string) error {
+	if len(brname) >= unix.IFNAMSIZ {
+		return fmt.Errorf("interface name %s is too long", brname)
+	}
+	d := &ifdrv{cmd: cmd, len: uintptr(len(arg)), data: unsafe.Pointer(&arg[0])}
+	copy(d.name[:], brname)
+	err := ifioctl(unix.AF_INET, brname, unix.SIOCSDRVSPEC, unsafe.Pointer(d), op)
+	runtime.KeepAlive(arg)
+	return err
+}
+
+// bridgeMember はifnameをブリッジbrnameのメンバーに追加・削除する関数（BRDGADD・BRDGDEL）
+func bridgeMember(brname, ifname string, add bool) error {
+	if len(ifname) >= unix.IFNAMSIZ {
+		return fmt.Errorf("interface name %s is too long", ifname)
+	}
+	req := make([]byte, ifbreqLen)
+	copy(req, ifname) // ifbr_ifsname
+	if add {
+		return bridgeDrvSpec(brname, brdgAdd, req, "BRDGADD")
+	}
+	return bridgeDrvSpec(brname, brdgDel, req, "BRDGDEL")
+}
+
+// bridgeForwardDelay はブリッジのフォワーディング遅延を秒で設定する関数（BRDGSFD）
+func bridgeForwardDelay(brname string, sec uint8) error {
+	param := make([]byte, 4) // struct ifbrparamは32ビットの共用体、ifbrp_fwddelayは先頭の8ビット
+	param[0] = sec
+	return bridgeDrvSpec(brname, brdgSFD, param, "BRDGSFD")
+}
@@ -0,0 +1,12 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+const (
+	// SIOCAIFADDR（_IOW('i', 43, struct in_aliasreq)、x/sysの値は末尾にifra_vhidがない旧版のOSIOCAIFADDR）
+	siocAIFADDR       = 0x80000000 | (unix.IFNAMSIZ+3*unix.SizeofSockaddrInet4+4)<<16 | 'i'<<8 | 43
+	siocAIFADDRIN6Num = 27 // SIOCAIFADDR_IN6（26は旧版のOSIOCAIFADDR_IN6）
+	in6AliasReqExtra  = 4  // ifra_vhid
+	ifbreqLen         = 80 // struct ifbreq
+	rtmIfAnnounce     = unix.RTM_IFANNOUNCE
+)
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/songgao/water"
+)
+
+// createTAP はTAP（TUN）を作成し、カーネルが割り当てた名前とともに返す関数
+//
+// Linuxでは任意の名前へ変更できるため、nameへの変更は呼び出し側（renameInterface）で行う。
+// 無停止の再起動では引き継ぎ元のTAP（名前は変更済み）をそのまま使う。
+func createTAP(name string, devType water.DeviceType) (*water.Interface, string, error) {
+	if ifce, err := inheritedTAP(name); ifce != nil || err != nil {
+		return ifce, name, err
+	}
+	ifce, err := water.New(water.Config{DeviceType: devType})
+	if err != nil {
+		return nil, "", err
+	}
+	registerCleanup(func() { ifce.Close() })
+	return ifce, ifce.Name(), nil
+}
+
+// renameInterface はインターフェースの名前を変更する関数
+func renameInterface(oldName, newName string) error {
+	if err := exec.Command("ip", "link", "set", oldName, "name", newName).Run(); err != nil {
+		logf("[ERROR]", "Failed to rename interface: %v", err)
+		return err
+	}
+	logf("[INFO]", "Interface renamed from %s to %s", oldName, newName)
+	return nil
+}
+
+// linkUp はインターフェースを有効(UP)にする関数
+func linkUp(ifname string) error {
+	if err := exec.Command("ip", "link", "set", "dev", ifname, "up").Run(); err != nil {
+		logf("[ERROR]", "Failed to set interface %s UP: %v", ifname, err)
+		return err
+	}
+	logf("[INFO]", "Interface %s set UP", ifname)
+	return nil
+}
+
+// setTAPMTU はインターフェースのMTUを設定する関数
+func setTAPMTU(name string, mtu int) error {
+	if err := exec.Command("ip", "link", "set", "dev", name, "mtu", fmt.Sprintf("%d", mtu)).Run(); err != nil {
+		logf("[ERROR]", "Failed to set MTU on interface %s: %v", name, err)
+		return err
+	}
+	logf("[INFO]", "MTU of interface %s set to %d", name, mtu)
+	return nil
+}
+
+// setLinkAddress はインターフェースのMACアドレスを設定する関数
+func setLinkAddress(ifname string, mac net.HardwareAddr) error {
+	if out, err := exec.Command("ip", "link", "set", "dev", ifname, "address", mac.String()).CombinedOutput(); err != nil {
+		return fmt.Errorf("set MAC of %s: %v: %s", ifname, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// replaceAddress はインターフェースにアドレス（CIDR）を付ける関数（付いていれば何もしない）
+func replaceAddress(ifname, cidr string) error {
+	if out, err := exec.Command("ip", "addr", "replace", cidr, "dev", ifname).CombinedOutput(); err != nil {
+		return fmt.Errorf("add address %s to %s: %v: %s", cidr, ifname, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// addToBridge はTAPインターフェースを指定したブリッジに追加する関数
+func addToBridge(ifname, brname string) error {
+	if err := exec.Command("ip", "link", "set", "dev", ifname, "master", brname).Run(); err != nil {
+		logf("[ERROR]", "Failed to add interface %s to bridge %s: %v", ifname, brname, err)
+		return err
+	}
+	logf("[INFO]", "Interface %s added to bridge %s", ifname, brname)
+	return nil
+}
+
+// isBridge はインターフェースがLinuxブリッジかどうかを判定する関数
+func isBridge(name string) bool {
+	_, err := os.Stat("/sys/class/net/" + name + "/bridge")
+	return err == nil
+}
+
+// bridgeCreateArgs はブリッジを作成するipコマンドの引数を返す関数
+func bridgeCreateArgs(name string, b bridgeSetup) []string {
+	args := []string{"link", "add", "name", name, "type", "bridge"}
+	if b.stp {
+		args = append(args, "stp_state", "1")
+	}
+	if b.forwardDelay > 0 {
+		// forward_delayの単位は1/100秒
+		args = append(args, "forward_delay", strconv.FormatInt(b.forwardDelay.Milliseconds()/10, 10))
+	}
+	return args
+}
+
+// createBridge はブリッジを作成してUPにする関数
+func createBridge(name string, b bridgeSetup) error {
+	if out, err := exec.Command("ip", bridgeCreateArgs(name, b)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("ip link add %s: %v: %s", name, err, out)
+	}
+	return linkUp(name)
+}
+
+// deleteBridge はブリッジを削除する関数
+func deleteBridge(name string) error {
+	return exec.Command("ip", "link", "del", "dev", name).Run()
+}
+
+// detachFromBridge はTAPインターフェースをブリッジから外す関数
+func detachFromBridge(ifname, brname string) {
+	if err := exec.Command("ip", "link", "set", "dev", ifname, "nomaster").Run(); err != nil {
+		logf("[WARN]", "Failed to detach %s from its bridge: %v", ifname, err)
+		return
+	}
+	logf("[INFO]", "Interface %s detached from bridge", ifname)
+}
+
+// waitIfaceChange はインターフェースの変化を待つ関数（Linuxでは一定時間待つだけ）
+func waitIfaceChange(d time.Duration) {
+	time.Sleep(d)
+}
+
+// plannedIfaceOps はdry-runで表示する、起動時のTAP・ブリッジの操作を返す関数
+func plannedIfaceOps(cfg *Config) []string {
+	kind := "TAP"
+	if cfg.IfMode == ifModeTUN {
+		kind = "TUN"
+	}
+	ops := []string{
+		fmt.Sprintf("create %s device and rename it to %s", kind, cfg.TapName),
+		fmt.Sprintf("ip link set dev %s up", cfg.TapName),
+		fmt.Sprintf("ip link set dev %s mtu %d", cfg.TapName, cfg.MTU),
+	}
+	if cfg.BrName != "off" {
+		if b, err := parseBridgeConfig(cfg.Bridge); err == nil && b.create && !ifaceExists(cfg.BrName) {
+			ops = append(ops, "ip "+strings.Join(bridgeCreateArgs(cfg.BrName, b), " "), fmt.Sprintf("ip link set dev %s up", cfg.BrName))
+		}
+		ops = append(ops, fmt.Sprintf("ip link set dev %s master %s", cfg.TapName, cfg.BrName))
+	}
+	return ops
+}
+
+// checkPlatformIface はプラットフォーム固有のインターフェース設定の制約を確認する関数
+func checkPlatformIface(cfg *Config, r *checkResult) {}
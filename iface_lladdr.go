@@ -0,0 +1,21 @@
+//go:build darwin || dragonfly || freebsd || openbsd
+
+package main
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// setLinkAddress はインターフェースのMACアドレスをSIOCSIFLLADDRで設定する関数
+func setLinkAddress(ifname string, mac net.HardwareAddr) error {
+	ifr, err := newIfreq(ifname)
+	if err != nil {
+		return err
+	}
+	// ifr_addr: sa_lenにアドレス長、sa_familyにAF_LINKを入れ、sa_dataにMACアドレスを置く
+	ifr.data()[0], ifr.data()[1] = byte(len(mac)), unix.AF_LINK
+	copy(ifr.data()[2:], mac)
+	return ifr.ioctl(unix.SIOCSIFLLADDR, "SIOCSIFLLADDR")
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	siocAIFADDR       = unix.SIOCAIFADDR
+	siocAIFADDRIN6Num = 107 // SIOCAIFADDR_IN6（26はSIOCAIFADDR）
+	in6AliasReqExtra  = 0
+	ifbreqLen         = 24 // struct ifbreq
+	rtmIfAnnounce     = unix.RTM_IFANNOUNCE
+
+	iflrActive    = 0x8000 // IFLR_ACTIVE: 追加したリンク層アドレスを使用中にする
+	sockaddrDlLen = 32     // struct sockaddr_dl
+)
+
+// setLinkAddress はインターフェースのMACアドレスを設定する関数
+//
+// NetBSDにはSIOCSIFLLADDRがないため、SIOCALIFADDRでリンク層アドレスを追加して有効にする（ifconfig link ... activeと同じ）。
+func setLinkAddress(ifname string, mac net.HardwareAddr) error {
+	ifr, err := newIfreqFor(ifname, unix.SIOCALIFADDR)
+	if err != nil {
+		return err
+	}
+	// struct if_laddrreq: flags・prefixlenの後のaddrにstruct sockaddr_dlを置く
+	binary.NativeEndian.PutUint32(ifr.data(), iflrActive)
+	binary.NativeEndian.PutUint32(ifr.data()[4:], uint32(8*len(mac)))
+	sdl := ifr.data()[8:]
+	sdl[0], sdl[1] = sockaddrDlLen, unix.AF_LINK
+	sdl[4], sdl[6] = unix.IFT_ETHER, byte(len(mac)) // dl_type, dl_alen
+	copy(sdl[8:], mac)
+	return ifioctl(unix.AF_LINK, ifname, unix.SIOCALIFADDR, unsafe.Pointer(&ifr.buf[0]), "SIOCALIFADDR")
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const (
+	siocAIFADDR       = unix.SIOCAIFADDR
+	siocAIFADDRIN6Num = 26 // SIOCAIFADDR_IN6
+	in6AliasReqExtra  = 0
+	rtmIfAnnounce     = unix.RTM_IFANNOUNCE
+)
+
+// bridgeMember はifnameをブリッジbrname（bridge(4)・veb(4)）のメンバーに追加・削除する関数（SIOCBRDGADD・SIOCBRDGDEL）
+func bridgeMember(brname, ifname string, add bool) error {
+	req, op := uint(unix.SIOCBRDGADD), "SIOCBRDGADD"
+	if !add {
+		req, op = unix.SIOCBRDGDEL, "SIOCBRDGDEL"
+	}
+	// struct ifbreq: ifbr_name（ブリッジ）の後にifbr_ifsname（メンバー）が続く
+	ifr, err := newIfreqFor(brname, req)
+	if err != nil {
+		return err
+	}
+	if _, err := newIfreq(ifname); err != nil {
+		return err
+	}
+	copy(ifr.data(), ifname)
+	return ifr.ioctl(req, op)
+}
+
+// bridgeForwardDelay はブリッジのフォワーディング遅延を秒で設定する関数（SIOCBRDGSFD）
+func bridgeForwardDelay(brname string, sec uint8) error {
+	ifr, err := newIfreqFor(brname, unix.SIOCBRDGSFD)
+	if err != nil {
+		return err
+	}
+	ifr.data()[0] = sec // struct ifbrparam: ifbrp_name の後の ifbrp_fwddelay
+	return ifr.ioctl(unix.SIOCBRDGSFD, "SIOCBRDGSFD")
+}
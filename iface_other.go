@@ -0,0 +1,83 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"time"
+
+	"github.com/songgao/water"
+)
+
+// errIfaceUnsupported はTAP・ブリッジの操作に対応していないプラットフォームで返すエラー
+var errIfaceUnsupported = fmt.Errorf("TAP and bridge setup is not supported on %s", runtime.GOOS)
+
+// createTAP はLinux・BSD以外では未対応
+func createTAP(name string, devType water.DeviceType) (*water.Interface, string, error) {
+	return nil, "", errIfaceUnsupported
+}
+
+// renameInterface はLinux・BSD以外では未対応
+func renameInterface(oldName, newName string) error {
+	return errIfaceUnsupported
+}
+
+// linkUp はLinux・BSD以外では未対応
+func linkUp(ifname string) error {
+	return errIfaceUnsupported
+}
+
+// setTAPMTU はLinux・BSD以外では未対応
+func setTAPMTU(name string, mtu int) error {
+	return errIfaceUnsupported
+}
+
+// setLinkAddress はLinux・BSD以外では未対応
+func setLinkAddress(ifname string, mac net.HardwareAddr) error {
+	return errIfaceUnsupported
+}
+
+// replaceAddress はLinux・BSD以外では未対応
+func replaceAddress(ifname, cidr string) error {
+	return errIfaceUnsupported
+}
+
+// addToBridge はLinux・BSD以外では未対応
+func addToBridge(ifname, brname string) error {
+	return errIfaceUnsupported
+}
+
+// isBridge はLinux・BSD以外では未対応（常にfalse）
+func isBridge(name string) bool {
+	return false
+}
+
+// createBridge はLinux・BSD以外では未対応
+func createBridge(name string, b bridgeSetup) error {
+	return errIfaceUnsupported
+}
+
+// deleteBridge はLinux・BSD以外では未対応
+func deleteBridge(name string) error {
+	return errIfaceUnsupported
+}
+
+// detachFromBridge はLinux・BSD以外では未対応（何もしない）
+func detachFromBridge(ifname, brname string) {}
+
+// waitIfaceChange はインターフェースの変化を待つ関数（一定時間待つだけ）
+func waitIfaceChange(d time.Duration) {
+	time.Sleep(d)
+}
+
+// plannedIfaceOps はLinux・BSD以外では未対応（操作なし）
+func plannedIfaceOps(cfg *Config) []string {
+	return nil
+}
+
+// checkPlatformIface はTAP・ブリッジを扱えないプラットフォームであることを報告する関数
+func checkPlatformIface(cfg *Config, r *checkResult) {
+	r.fail("TAP and bridge setup is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/songgao/water"
+)
+
+// インターフェースモード関連の定数定義
+const (
+	ifModeTAP = "tap" // Ethernetフレームを転送（ブリッジ可能）
+	ifModeTUN = "tun" // IPパケットを転送（ルーティングのみ、Ethernetヘッダは送信時に合成）
+
+	ethHeaderLen = 14
+)
+
+// tunMAC はTUNモードで合成するEthernetヘッダの送信元・宛先MAC（ローカル管理アドレス、両端で共通）
+var tunMAC = net.HardwareAddr{0x02, 0x45, 0x49, 0x50, 0x00, 0x01}
+
+// parseIfMode はifmodeの設定値からTAP/TUNの種別を返す関数
+func parseIfMode(mode string) (water.DeviceType, error) {
+	switch mode {
+	case "", ifModeTAP:
+		return water.TAP, nil
+	case ifModeTUN:
+		return water.TUN, nil
+	}
+	return water.TAP, fmt.Errorf("unknown ifmode %q (tap, tun)", mode)
+}
+
+// checkIfMode はTUNモードと併用できないL2前提の設定がないか確認する関数
+func checkIfMode(cfg *Config) error {
+	if _, err := parseIfMode(cfg.IfMode); err != nil {
+		return err
+	}
+	if cfg.IfMode != ifModeTUN {
+		return nil
+	}
+	switch {
+	case cfg.BrName != "off":
+		return fmt.Errorf("ifmode tun cannot join a bridge; set br_name: \"off\"")
+	case len(cfg.peerHosts()) > 1:
+		return fmt.Errorf("ifmode tun supports a single peer")
+	case cfg.NFQueue.Num > 0:
+		return fmt.Errorf("nfqueue requires ifmode tap")
+	case cfg.STPCost.Enabled:
+		return fmt.Errorf("stp_cost requires ifmode tap")
+	case cfg.EVPN.Neighbor != "":
+		return fmt.Errorf("evpn requires ifmode tap")
+	case cfg.Iperf.Address != "":
+		return fmt.Errorf("iperf requires ifmode tap")
+	case cfg.LocalDelivery.Iface != "":
+		return fmt.Errorf("local_delivery requires ifmode tap")
+	case cfg.NDProxy.Enabled:
+		return fmt.Errorf("nd_proxy requires ifmode tap")
+	case cfg.LoopDetect.Enabled:
+		return fmt.Errorf("loop_detect requires ifmode tap")
+	case cfg.FDBSync.Enabled:
+		return fmt.Errorf("fdb_sync requires ifmode tap")
+	}
+	return nil
+}
+
+// readFrame はTAPからフレームを、TUNからはIPパケットを読んでEthernetヘッダを合成したフレームをbufへ読み込む関数
+//
+// TUNでIPv4/IPv6以外を読んだ場合は長さ0を返す。
+func (t *Tunnel) readFrame(buf []byte) (int, error) {
+	if t.tunMode == nil {
+		return t.ifce.Read(buf)
+	}
+	n, err := t.ifce.Read(buf[ethHeaderLen:])
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	var etherType uint16
+	switch buf[ethHeaderLen] >> 4 {
+	case 4:
+		etherType = 0x0800
+	case 6:
+		etherType = 0x86DD
+	default:
+		t.tunMode.nonIP[DirTX].Add(1)
+		return 0, nil
+	}
+	copy(buf[0:6], tunMAC)
+	copy(buf[6:12], tunMAC)
+	binary.BigEndian.PutUint16(buf[12:14], etherType)
+	return ethHeaderLen + n, nil
+}
+
+// writeFrame はフレームをTAPへ、TUNにはEthernetヘッダを除いたIPパケットを書き込む関数
+//
+// TUNモードでIP以外のフレームはtunFilterが破棄するため、ここには来ない。
+func (t *Tunnel) writeFrame(frame []byte) (int, error) {
+	if t.tunMode == nil {
+		return t.ifce.Write(frame)
+	}
+	return t.ifce.Write(frame[ethHeaderLen:])
+}
+
+// tunFilterはTUNモードで、TUNへ書き込めないIPv4/IPv6以外のフレーム（VLANタグ付きを含む）を受信時に破棄するフィルタ
+type tunFilter struct {
+	nonIP [2]atomic.Uint64 // 方向別のIP以外で破棄したフレーム数
+}
+
+// Filter は受信したフレームがIPv4/IPv6でなければ破棄する
+func (f *tunFilter) Filter(dir Direction, frame []byte) ([]byte, Verdict) {
+	if dir != DirRX {
+		return frame, VerdictPass
+	}
+	if len(frame) > ethHeaderLen {
+		if et := binary.BigEndian.Uint16(frame[12:14]); et == 0x0800 || et == 0x86DD {
+			return frame, VerdictPass
+		}
+	}
+	f.nonIP[DirRX].Add(1)
+	return nil, VerdictDrop
+}
+
+// Counters は方向別のIP以外で破棄したフレーム数を返す
+func (f *tunFilter) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"tun_tx_non_ip": f.nonIP[DirTX].Load(),
+		"tun_rx_non_ip": f.nonIP[DirRX].Load(),
+	}
+}
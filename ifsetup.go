@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// インターフェース設定の再試行関連の定数定義
+const (
+	setupDefaultAttempts   = 5
+	setupDefaultBackoff    = time.Second
+	setupDefaultMaxBackoff = 30 * time.Second
+	bridgeWaitPoll         = time.Second // wait_for_bridge時のブリッジ出現の確認間隔
+)
+
+// SetupConfigは起動時のTAP・ブリッジの設定に失敗した時の再試行を保持する
+type SetupConfig struct {
+	Attempts      int    `yaml:"attempts"`       // 各手順の試行回数（既定5、1で再試行しない）
+	Backoff       string `yaml:"backoff"`        // 最初の再試行までの待ち時間（失敗のたびに倍、既定1s）
+	MaxBackoff    string `yaml:"max_backoff"`    // 再試行の待ち時間の上限（既定30s）
+	BridgeTimeout string `yaml:"bridge_timeout"` // wait_for_bridge時にブリッジの作成を待つ時間（空で無期限）
+}
+
+// ifSetupは検証済みのインターフェース設定の再試行方法
+type ifSetup struct {
+	attempts      int
+	backoff       time.Duration
+	maxBackoff    time.Duration
+	waitBridge    bool
+	bridgeTimeout time.Duration // 0なら無期限
+}
+
+// setupStepは起動時のインターフェース設定の1手順
+type setupStep struct {
+	name string
+	run  func() error
+}
+
+// parseSetup は再試行とwait_for_bridgeの設定を検証する関数
+func parseSetup(cfg *Config) (ifSetup, error) {
+	s := ifSetup{
+		attempts:   setupDefaultAttempts,
+		backoff:    setupDefaultBackoff,
+		maxBackoff: setupDefaultMaxBackoff,
+		waitBridge: cfg.WaitForBridge,
+	}
+	if cfg.Setup.Attempts < 0 {
+		return s, fmt.Errorf("attempts must not be negative")
+	}
+	if cfg.Setup.Attempts > 0 {
+		s.attempts = cfg.Setup.Attempts
+	}
+	durations := []struct {
+		key   string
+		value string
+		dst   *time.Duration
+	}{
+		{"backoff", cfg.Setup.Backoff, &s.backoff},
+		{"max_backoff", cfg.Setup.MaxBackoff, &s.maxBackoff},
+		{"bridge_timeout", cfg.Setup.BridgeTimeout, &s.bridgeTimeout},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return s, fmt.Errorf("%s: %w", d.key, err)
+		}
+		if v <= 0 {
+			return s, fmt.Errorf("%s must be positive", d.key)
+		}
+		*d.dst = v
+	}
+	if s.maxBackoff < s.backoff {
+		return s, fmt.Errorf("max_backoff %v is shorter than backoff %v", s.maxBackoff, s.backoff)
+	}
+	if s.waitBridge && cfg.BrName == "off" {
+		return s, fmt.Errorf("wait_for_bridge requires br_name")
+	}
+	if s.waitBridge && cfg.Bridge.Create {
+		return s, fmt.Errorf("wait_for_bridge and bridge.create are mutually exclusive")
+	}
+	return s, nil
+}
+
+// run は手順を順に実行し、失敗した手順は指数バックオフで再試行する関数
+//
+// 起動直後はブリッジ・udevの処理が終わっておらず ip link set が一時的に失敗することがあるため、
+// 試行回数を使い切った手順があった時だけ起動失敗とする。
+func (s ifSetup) run(steps []setupStep) error {
+	for _, step := range steps {
+		if err := s.retry(step); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retry は1手順を成功するか試行回数を使い切るまで実行する関数
+func (s ifSetup) retry(step setupStep) error {
+	delay := s.backoff
+	for attempt := 1; ; attempt++ {
+		err := step.run()
+		if err == nil {
+			if attempt > 1 {
+				logf("[INFO]", "Setup step %q succeeded on attempt %d", step.name, attempt)
+			}
+			return nil
+		}
+		if attempt >= s.attempts {
+			return fmt.Errorf("%s: %w (gave up after %d attempts)", step.name, err, attempt)
+		}
+		logf("[WARN]", "Setup step %q failed (attempt %d/%d), retrying in %v: %v", step.name, attempt, s.attempts, delay, err)
+		time.Sleep(delay)
+		delay = min(delay*2, s.maxBackoff)
+	}
+}
+
+// waitForBridge はbr_nameのブリッジが作成されるまで待つ関数（bridge_timeoutを過ぎたらエラー）
+//
+// ブリッジを別のサービス（systemd-networkd等）が作る構成で、起動順に依存しないようにする。
+func (s ifSetup) waitForBridge(name string) error {
+	if isBridge(name) {
+		return nil
+	}
+	logf("[INFO]", "Waiting for bridge %s to appear", name)
+	start := time.Now()
+	for !isBridge(name) {
+		if ifaceExists(name) {
+			return fmt.Errorf("%s exists but is not a bridge", name)
+		}
+		if s.bridgeTimeout > 0 && time.Since(start) >= s.bridgeTimeout {
+			return fmt.Errorf("bridge %s did not appear within %v", name, s.bridgeTimeout)
+		}
+		waitIfaceChange(bridgeWaitPoll)
+	}
+	logf("[INFO]", "Bridge %s appeared after %v", name, time.Since(start).Round(time.Second))
+	return nil
+}
+
+// setupInterface はTAPの名前変更・UP・MTU設定・ブリッジ参加を再試行付きで順に行う関数
+//
+// 既存のブリッジへ参加する構成でwait_for_bridgeが有効なら、ブリッジの作成を待ってから参加する。
+func setupInterface(cfg *Config, s ifSetup, actualName string) error {
+	var steps []setupStep
+	if actualName != cfg.TapName {
+		steps = append(steps, setupStep{"rename", func() error {
+			if !ifaceExists(actualName) && ifaceExists(cfg.TapName) {
+				return nil // 前回の試行で変更済み
+			}
+			return renameInterface(actualName, cfg.TapName)
+		}})
+	}
+	steps = append(steps,
+		setupStep{"link up", func() error { return linkUp(cfg.TapName) }},
+		setupStep{"mtu", func() error { return setTAPMTU(cfg.TapName, cfg.MTU) }},
+	)
+	if err := s.run(steps); err != nil || cfg.BrName == "off" {
+		return err
+	}
+
+	// ブリッジの出現待ちは自前でタイムアウトするため再試行しない
+	if s.waitBridge {
+		if err := s.waitForBridge(cfg.BrName); err != nil {
+			return err
+		}
+	}
+	return s.run([]setupStep{
+		{"bridge", func() error { return ensureBridge(cfg) }},
+		{"bridge join", func() error { return addToBridge(cfg.TapName, cfg.BrName) }},
+	})
+}
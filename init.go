@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// initTemplate は"init"サブコマンドで書き出す設定ファイルの雛形
+//
+// 主要なキーのみを載せ、その他のキーはREADMEの例を参照する。
+const initTemplate = `# etherip-go config.yaml（etherip init で生成）
+# 全キーの説明はREADMEの Example config.yaml を参照
+# 記載のないキーは既定値のまま、フラグ（--dst-host）・環境変数（ETHERIP_DST_HOST）で上書き可能
+
+# IP version (4 or 6)
+## 既定経路のあるアドレスファミリ: %[1]s
+version: %[2]d
+
+# Outer Interface
+## 既定経路のインターフェース（送信元: %[6]s）
+src_iface: %[3]s
+
+# Dual Stack (true or false)
+## versionを優先ファミリとしてA/AAAA両方を使い、キープアライブ断でもう一方へフェイルオーバー
+dual_stack: %[8]t
+
+# Keepalive (off, 5s)
+## ピアの生存監視、statusコマンド・/readyzでの表示に使用
+keepalive_interval: 5s
+
+# Authentication (HMAC)
+## 有効にする場合は対向と同じ鍵を設定（以下は生成した乱数の鍵）
+auth:
+  enabled: false
+  key: "%[9]s"
+
+# Bridge Creation and Cleanup
+## br_nameのブリッジがない場合、create: true なら作成
+bridge:
+  create: false
+
+# Control API (statusコマンドで使用、空で無効)
+api_listen: 127.0.0.1:9097
+
+# Tunnels
+## 対向でも同じ設定を作り、dst_hostに互いのアドレスを書く
+## mtuは%[3]sのMTU %[4]d から外側IPv%[2]dヘッダ・EtherIPヘッダ・内側Ethernetヘッダ（xfrm・vti上ではESPも）を引いた値（断片化しない上限）
+tunnels:
+  - tap_name: tap0
+    br_name: "off" # 例: br0
+    mtu: %[5]d
+    dst_host: %[7]s
+`
+
+// defaultRoute は既定経路に使われるインターフェースと送信元アドレスを返す関数
+//
+// 文書用アドレスへの経路でカーネルが選ぶ送信元アドレスを調べ、それを持つインターフェースを探す。
+func defaultRoute(version int) (*net.Interface, net.IP, error) {
+	target := net.ParseIP("192.0.2.1")
+	if version == 6 {
+		target = net.ParseIP("2001:db8::1")
+	}
+	src, err := routeSource(target)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range ifaces {
+		if interfaceHasIP(ifaces[i].Name, src) {
+			return &ifaces[i], src, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("no interface has %s", src)
+}
+
+// renderInitConfig は検出した既定経路から設定ファイルの雛形を生成する関数
+func renderInitConfig(dst string) (string, error) {
+	var families []string
+	var ifi *net.Interface
+	var src net.IP
+	version := 0
+	for _, v := range []int{4, 6} {
+		i, ip, err := defaultRoute(v)
+		if err != nil {
+			continue
+		}
+		families = append(families, fmt.Sprintf("IPv%d (%s)", v, i.Name))
+		if version == 0 {
+			version, ifi, src = v, i, ip
+		}
+	}
+	if version == 0 {
+		return "", fmt.Errorf("no default route found; write src_iface and version by hand")
+	}
+	// 対向をIPで指定した場合はそのファミリに合わせる
+	if ip := net.ParseIP(dst); ip != nil {
+		v := 6
+		if ip.To4() != nil {
+			v = 4
+		}
+		i, ip, err := defaultRoute(v)
+		if err != nil {
+			return "", fmt.Errorf("no IPv%d default route for %s", v, dst)
+		}
+		version, ifi, src, families = v, i, ip, []string{fmt.Sprintf("IPv%d (%s)", v, i.Name)}
+	}
+	dualStack := false
+	if len(families) == 2 {
+		// 両ファミリの既定経路が同じインターフェースなら両方使う
+		_, ip6, _ := defaultRoute(6)
+		dualStack = interfaceHasIP(ifi.Name, ip6)
+	}
+
+	mtu := ifi.MTU - underlayOverhead(detectUnderlay(ifi.Name)) - ipHeaderLen(version) - etherIPOverhead
+	if dst == "" {
+		dst = "peer.example.com # 対向のホスト名またはIP"
+	}
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(initTemplate, strings.Join(families, ", "), version, ifi.Name, ifi.MTU, mtu, src, dst, dualStack, hex.EncodeToString(key)), nil
+}
+
+// runInit は"init"サブコマンドを実行し、コメント付きの設定ファイルの雛形を書き出す関数
+func runInit(args []string) int {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	out := fs.String("o", "config.yaml", "書き出し先（\"-\"で標準出力）")
+	dst := fs.String("dst", "", "対向のホスト名またはIP（空で仮の値）")
+	force := fs.Bool("force", false, "既存のファイルを上書きする")
+	fs.Parse(args)
+
+	conf, err := renderInitConfig(*dst)
+	if err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+		return 1
+	}
+	if *out == "-" {
+		fmt.Print(conf)
+		return 0
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if *force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(*out, flags, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			fmt.Printf("ERROR: %s already exists (use -force to overwrite)\n", *out)
+		} else {
+			fmt.Printf("ERROR: %v\n", err)
+		}
+		return 1
+	}
+	if _, err := f.WriteString(conf); err != nil {
+		f.Close()
+		fmt.Printf("ERROR: %v\n", err)
+		return 1
+	}
+	if err := f.Close(); err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+		return 1
+	}
+	if *dst == "" {
+		fmt.Printf("Wrote %s; set dst_host, then run \"%s check -c %s\"\n", *out, os.Args[0], *out)
+	} else {
+		fmt.Printf("Wrote %s; run \"%s check -c %s\"\n", *out, os.Args[0], *out)
+	}
+	return 0
+}
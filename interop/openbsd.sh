@@ -0,0 +1,112 @@
+#!/bin/sh
+# OpenBSDのカーネルの etherip(4) とetherip-goの相互接続試験
+#
+# 1台のOpenBSD上で経路制御ドメイン（rdomain）を2つに分け、pair(4)で下位ネットワークをつなぐ。
+# rdomain 0 でetherip-go（tap0）を、rdomain 1 でカーネルの etherip(4) を動かし、
+# オーバーレイ越しのping（両方向・TAPのMTUちょうどのフレーム）が通ることを確かめる。
+# OpenBSDではカーネルの etherip(4) がRAWソケットより先にEtherIPを受け取るため、etherip-goはbpf(4)で受信する
+# （IP層より前のため断片化された外側パケットは再構築しない。下位ネットワークのMTUは最大長のフレームが収まる1600にする）。
+#
+# 使い方: doas sh interop/openbsd.sh（CIでは vmactions/openbsd-vm の中で実行）
+#   ETHERIP_BIN でビルド済みのバイナリを指定（省略時はリポジトリをビルド）、KEEP=1 で失敗時に後片付けしない
+#
+# 下位ネットワーク: pair0（rdomain 0）10.98.0.1 と pair1（rdomain 1）10.98.0.2、MTU 1600
+# オーバーレイ: 172.31.0.1（etherip-goのtap0）と 172.31.0.2（etherip0）
+set -eu
+
+ROOT=$(cd "$(dirname "$0")/.." && pwd)
+WORK=$(mktemp -d /tmp/etherip-interop.XXXXXX)
+LOCAL=10.98.0.1
+REMOTE=10.98.0.2
+OVERLAY_LOCAL=172.31.0.1
+OVERLAY_REMOTE=172.31.0.2
+ALLOW=$(sysctl -n net.inet.etherip.allow)
+PID=
+OK=0
+
+log() { printf '[interop] %s\n' "$*"; }
+
+# cleanup はデーモンを止め、インターフェースとsysctlを元に戻す
+cleanup() {
+	if [ -n "$PID" ]; then
+		kill "$PID" 2>/dev/null || true
+		wait "$PID" 2>/dev/null || true
+	fi
+	for ifname in etherip0 pair1 pair0 tap0; do
+		ifconfig "$ifname" destroy 2>/dev/null || true
+	done
+	sysctl -q net.inet.etherip.allow="$ALLOW"
+	if [ "${KEEP:-0}" = 1 ] && [ "$OK" = 0 ]; then
+		log "logs kept in $WORK"
+	else
+		rm -rf "$WORK"
+	fi
+}
+
+# fail はデーモンのログを表示して失敗で終わる
+fail() {
+	log "FAIL $*"
+	tail -n 40 "$WORK/etherip.log" || true
+	netstat -s -p etherip || true
+	exit 1
+}
+
+# wait_ping <rdomain> <宛先> <秒> はrdomainから応答があるまでpingを繰り返す
+wait_ping() {
+	i=0
+	while [ "$i" -lt "$3" ]; do
+		if route -T "$1" exec ping -c 1 -w 1 "$2" >/dev/null 2>&1; then
+			return 0
+		fi
+		i=$((i + 1))
+	done
+	return 1
+}
+
+if [ "$(id -u)" != 0 ]; then
+	echo "run as root (rdomains and tap(4) are required)" >&2
+	exit 2
+fi
+trap cleanup EXIT
+BIN=${ETHERIP_BIN:-$WORK/etherip}
+if [ -z "${ETHERIP_BIN:-}" ]; then
+	(cd "$ROOT" && go build -o "$BIN" .)
+fi
+
+# 下位ネットワーク（rdomainを先に決めてからアドレスを付ける）
+ifconfig pair1 create rdomain 1 mtu 1600 "$REMOTE/24" up
+ifconfig pair0 create mtu 1600 "$LOCAL/24" patch pair1 up
+
+# rdomain 1: カーネルの etherip(4)（外側のパケットもrdomain 1で送受信する）
+sysctl -q net.inet.etherip.allow=1
+ifconfig etherip0 create rdomain 1 tunneldomain 1 tunnel "$REMOTE" "$LOCAL" "$OVERLAY_REMOTE/24" up
+
+# rdomain 0: etherip-go（tap0を作ってオーバーレイのアドレスを付ける）
+cat >"$WORK/config.yaml" <<CONFIG
+version: 4
+tap_name: tap0
+br_name: "off"
+mtu: 1500
+src_iface: pair0
+dst_host: $REMOTE
+CONFIG
+"$BIN" -config "$WORK/config.yaml" >"$WORK/etherip.log" 2>&1 &
+PID=$!
+i=0
+until ifconfig tap0 >/dev/null 2>&1 && grep -q "set UP" "$WORK/etherip.log"; do
+	i=$((i + 1))
+	[ "$i" -lt 50 ] || fail "tap0 did not appear"
+	sleep 0.2
+done
+ifconfig tap0 "$OVERLAY_LOCAL/24"
+
+wait_ping 0 "$OVERLAY_REMOTE" 10 || fail "ping from etherip-go to etherip(4)"
+log "PASS ping etherip-go -> etherip(4)"
+route -T 1 exec ping -c 20 -i 0.1 -w 1 "$OVERLAY_LOCAL" >/dev/null || fail "ping from etherip(4) to etherip-go"
+log "PASS ping etherip(4) -> etherip-go"
+# TAPのMTUちょうどの内側パケット（DF付き）
+ping -c 5 -w 2 -D -s 1472 "$OVERLAY_REMOTE" >/dev/null || fail "large frames to etherip(4)"
+route -T 1 exec ping -c 5 -w 2 -D -s 1472 "$OVERLAY_LOCAL" >/dev/null || fail "large frames to etherip-go"
+log "PASS large"
+OK=1
+log "all cases passed"
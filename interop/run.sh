@@ -0,0 +1,279 @@
+#!/usr/bin/env bash
+# etherip-goの相互接続試験
+#
+# network namespaceとvethで作った下位ネットワーク上で2台（DNSフェイルオーバーでは3台）のデーモンを動かし、
+# オーバーレイ越しのping・最大長のフレーム・VLANタグ付きフレーム・宛先の名前解決の切り替え・クラスタのフェイルオーバーを確かめる。
+# Linuxカーネルの gretap・L2TPv3（l2tp_eth）を対向にした、encap: gretap・l2tpv3の相互接続も確かめる
+# （LinuxにはEtherIPの実装がないため、EtherIPの対向はetherip-go同士のみ）。
+#
+# 使い方: sudo interop/run.sh [ケース...]（省略時は全ケース）
+#   ケース: ping large vlan dns gretap l2tpv3 cluster
+#   ETHERIP_BIN でビルド済みのバイナリを指定（省略時はリポジトリをビルド）、KEEP=1 で失敗時に後片付けしない
+#
+# 下位ネットワーク: eipWのbr0に eipA 10.99.0.1, eipB 10.99.0.2, eipC 10.99.0.3 をvethで接続
+# オーバーレイ: 172.31.0.0/24（VLAN 100は172.31.100.0/24）、TAPは各namespaceの eip0
+set -euo pipefail
+
+ROOT=$(cd "$(dirname "$0")/.." && pwd)
+WORK=$(mktemp -d /tmp/etherip-interop.XXXXXX)
+NAMESPACES=(eipW eipA eipB eipC)
+declare -A UNDERLAY=([eipA]=10.99.0.1 [eipB]=10.99.0.2 [eipC]=10.99.0.3)
+declare -A OVERLAY=([eipA]=172.31.0.1 [eipB]=172.31.0.2 [eipC]=172.31.0.2)
+FAILED=()
+
+log() { printf '[interop] %s\n' "$*"; }
+
+# skip <理由> は実行環境のカーネルが対応していないケースを飛ばす（サブシェルで実行中のケースを終了コード77で抜ける）
+skip() {
+	log "$*, skipped"
+	exit 77
+}
+
+# cleanup はデーモンを止め、namespaceと一時ファイルを削除する
+cleanup() {
+	stop_daemons
+	for ns in "${NAMESPACES[@]}"; do
+		ip netns del "$ns" 2>/dev/null || true
+		rm -rf "/etc/netns/$ns"
+	done
+	if [[ ${KEEP:-0} == 1 && ${#FAILED[@]} -gt 0 ]]; then
+		log "logs kept in $WORK"
+	else
+		rm -rf "$WORK"
+	fi
+}
+
+# stop_daemons [ns...] はnamespace内のプロセス（デーモン）を止めて終了を待つ（省略時は全namespace）
+stop_daemons() {
+	local targets=("$@") pids=()
+	if [[ ${#targets[@]} -eq 0 ]]; then
+		targets=("${NAMESPACES[@]}")
+	fi
+	for ns in "${targets[@]}"; do
+		pids+=($(ip netns pids "$ns" 2>/dev/null || true))
+	done
+	if [[ ${#pids[@]} -eq 0 ]]; then
+		return 0
+	fi
+	kill "${pids[@]}" 2>/dev/null || true
+	for _ in $(seq 50); do
+		kill -0 "${pids[@]}" 2>/dev/null || return 0
+		sleep 0.1
+	done
+	kill -9 "${pids[@]}" 2>/dev/null || true
+}
+
+# setup_underlay は下位ネットワークを作り直す（各ケースの前に呼ぶ）
+setup_underlay() {
+	stop_daemons
+	for ns in "${NAMESPACES[@]}"; do
+		ip netns del "$ns" 2>/dev/null || true
+		ip netns add "$ns"
+		ip -n "$ns" link set lo up
+	done
+	ip -n eipW link add name br0 type bridge
+	ip -n eipW link set br0 up
+	for ns in eipA eipB eipC; do
+		ip link add "w-$ns" type veth peer name "v-$ns"
+		ip link set "w-$ns" netns eipW
+		ip link set "v-$ns" netns "$ns"
+		ip -n "$ns" link set "v-$ns" name v0
+		ip -n eipW link set "w-$ns" master br0 up
+		ip -n "$ns" addr add "${UNDERLAY[$ns]}/24" dev v0
+		ip -n "$ns" link set v0 up
+		mkdir -p "/etc/netns/$ns"
+		: >"/etc/netns/$ns/hosts"
+	done
+}
+
+# kernel_supports <ip link addの引数...> はカーネルがリンクの種類に対応しているかを、eipWに作って消すことで確かめる
+kernel_supports() {
+	ip -n eipW link add name probe0 "$@" >/dev/null 2>&1 || return 1
+	ip -n eipW link del probe0
+}
+
+# start_daemon <ns> <dst_host> [追加の設定行...] はnamespace内でデーモンを起動し、TAPにオーバーレイのアドレスを付ける
+start_daemon() {
+	local ns=$1 dst=$2
+	shift 2
+	local cfg="$WORK/$ns.yaml"
+	{
+		printf 'version: 4\ntap_name: eip0\nbr_name: "off"\nmtu: 1500\nsrc_iface: v0\n'
+		printf 'dst_host: %s\nresolve_interval: 1s\n' "$dst"
+		printf '%s\n' "$@"
+	} >"$cfg"
+	ip netns exec "$ns" "$BIN" -config "$cfg" >>"$WORK/$ns.log" 2>&1 &
+	for _ in $(seq 50); do
+		if ip -n "$ns" link show eip0 >/dev/null 2>&1; then
+			ip -n "$ns" addr add "${OVERLAY[$ns]}/24" dev eip0
+			return 0
+		fi
+		sleep 0.2
+	done
+	log "$ns: eip0 did not appear"
+	cat "$WORK/$ns.log"
+	return 1
+}
+
+# wait_ping <ns> <宛先> <秒> [pingの引数...] は応答があるまでpingを繰り返す
+wait_ping() {
+	local ns=$1 dst=$2 timeout=$3
+	shift 3
+	local deadline=$((SECONDS + timeout))
+	while ((SECONDS < deadline)); do
+		if ip netns exec "$ns" ping -c 1 -W 1 "$@" "$dst" >/dev/null 2>&1; then
+			return 0
+		fi
+	done
+	return 1
+}
+
+# case_ping はetherip-go同士でオーバーレイ越しにpingが通ることを確かめる
+case_ping() {
+	start_daemon eipA "${UNDERLAY[eipB]}"
+	start_daemon eipB "${UNDERLAY[eipA]}"
+	wait_ping eipA "${OVERLAY[eipB]}" 10
+	ip netns exec eipA ping -c 20 -i 0.05 -W 1 "${OVERLAY[eipB]}" >/dev/null
+}
+
+# case_large はTAPのMTUちょうどの内側パケット（DF付き）が、外側の断片化を経て届くことを確かめる
+case_large() {
+	start_daemon eipA "${UNDERLAY[eipB]}"
+	start_daemon eipB "${UNDERLAY[eipA]}"
+	wait_ping eipA "${OVERLAY[eipB]}" 10
+	ip netns exec eipA ping -c 5 -W 2 -M do -s 1472 "${OVERLAY[eipB]}" >/dev/null
+	ip netns exec eipB ping -c 5 -W 2 -M do -s 1472 "${OVERLAY[eipA]}" >/dev/null
+}
+
+# case_vlan はTAP上のVLANサブインターフェース同士で、最大長を含むタグ付きフレームが届くことを確かめる
+case_vlan() {
+	if ! kernel_supports link br0 type vlan id 100; then
+		skip "vlan: 8021q is not available"
+	fi
+	start_daemon eipA "${UNDERLAY[eipB]}"
+	start_daemon eipB "${UNDERLAY[eipA]}"
+	local i=1
+	for ns in eipA eipB; do
+		ip -n "$ns" link add link eip0 name eip0.100 type vlan id 100
+		ip -n "$ns" addr add "172.31.100.$i/24" dev eip0.100
+		ip -n "$ns" link set eip0.100 up
+		i=$((i + 1))
+	done
+	wait_ping eipA 172.31.100.2 10
+	ip netns exec eipA ping -c 5 -W 2 -M do -s 1472 172.31.100.2 >/dev/null
+}
+
+# case_dns は宛先の名前解決の結果が変わると、再起動せずに新しい宛先へ切り替わることを確かめる
+#
+# eipAは peer.test（最初はeipB）へ接続し、eipBのデーモンを止めてからhostsをeipCへ書き換える。
+# Goのリゾルバは/etc/hostsを5秒ごとに読み直すため、resolve_interval 1sと合わせて20秒以内の復旧を期待する。
+case_dns() {
+	printf '%s peer.test\n' "${UNDERLAY[eipB]}" >"/etc/netns/eipA/hosts"
+	start_daemon eipA peer.test
+	start_daemon eipB "${UNDERLAY[eipA]}"
+	wait_ping eipA "${OVERLAY[eipB]}" 10
+	stop_daemons eipB
+	# 同じinodeのまま書き換える（ip netns execはファイル単位でbind mountするため）
+	printf '%s peer.test\n' "${UNDERLAY[eipC]}" >"/etc/netns/eipA/hosts"
+	start_daemon eipC "${UNDERLAY[eipA]}"
+	wait_ping eipA "${OVERLAY[eipC]}" 20
+	grep -q "DNS updated: ${UNDERLAY[eipB]} → ${UNDERLAY[eipC]}" "$WORK/eipA.log"
+}
+
+# case_gretap はLinuxカーネルのgretapを対向にencap: gretapで接続できることを確かめる
+case_gretap() {
+	if ! kernel_supports type gretap local "${UNDERLAY[eipB]}" remote "${UNDERLAY[eipA]}"; then
+		skip "gretap: ip_gre is not available"
+	fi
+	start_daemon eipA "${UNDERLAY[eipB]}" "encap: gretap" "gre:" "  key: 100"
+	ip -n eipB link add eip0 type gretap local "${UNDERLAY[eipB]}" remote "${UNDERLAY[eipA]}" key 100
+	ip -n eipB addr add "${OVERLAY[eipB]}/24" dev eip0
+	ip -n eipB link set eip0 up
+	wait_ping eipA "${OVERLAY[eipB]}" 10
+	ip netns exec eipA ping -c 5 -W 2 -M do -s 1400 "${OVERLAY[eipB]}" >/dev/null
+}
+
+# case_l2tpv3 はLinuxカーネルのL2TPv3（IP直収容の静的セッション）を対向にencap: l2tpv3で接続できることを確かめる
+case_l2tpv3() {
+	if ! modprobe -q l2tp_eth 2>/dev/null || ! modprobe -q l2tp_ip 2>/dev/null; then
+		skip "l2tpv3: l2tp_eth/l2tp_ip are not available"
+	fi
+	start_daemon eipA "${UNDERLAY[eipB]}" "encap: l2tpv3" "l2tpv3:" "  session_id: 10" "  peer_session_id: 20"
+	ip -n eipB l2tp add tunnel tunnel_id 1 peer_tunnel_id 1 encap ip local "${UNDERLAY[eipB]}" remote "${UNDERLAY[eipA]}"
+	ip -n eipB l2tp add session name eip0 tunnel_id 1 session_id 20 peer_session_id 10
+	ip -n eipB addr add "${OVERLAY[eipB]}/24" dev eip0
+	ip -n eipB link set eip0 up
+	wait_ping eipA "${OVERLAY[eipB]}" 10
+}
+
+# case_cluster はクラスタ（eipAがアクティブ、eipBがスタンバイ）のvipへ接続したeipCが、
+# eipAのデーモンを止めた後もeipBを経由してオーバーレイの同じアドレスへ届くことを確かめる
+#
+# 2台のTAPは同じブリッジの先にある想定のため、eipBのeip0にeipAと同じMACアドレス・オーバーレイのアドレスを付ける。
+case_cluster() {
+	local vip=10.99.0.100 mac
+	cluster_conf() {
+		printf 'cluster:\n  listen: %s:4790\n  peer: %s:4790\n  key: interop-cluster-key\n' "$1" "$2"
+		printf '  priority: %s\n  interval: 100ms\n  vip: ["%s/24"]\n' "$3" "$vip"
+	}
+	start_daemon eipA "${UNDERLAY[eipC]}" "$(cluster_conf "${UNDERLAY[eipA]}" "${UNDERLAY[eipB]}" 200)"
+	sleep 1
+	start_daemon eipB "${UNDERLAY[eipC]}" "$(cluster_conf "${UNDERLAY[eipB]}" "${UNDERLAY[eipA]}" 100)"
+	mac=$(ip -n eipA -br link show eip0 | awk '{print $3}')
+	ip -n eipB addr flush dev eip0
+	ip -n eipB link set eip0 address "$mac"
+	ip -n eipB addr add "${OVERLAY[eipA]}/24" dev eip0
+	start_daemon eipC "$vip"
+	wait_ping eipC "${OVERLAY[eipA]}" 10
+	grep -q "is now ACTIVE" "$WORK/eipA.log"
+	! grep -q "is now ACTIVE" "$WORK/eipB.log"
+	stop_daemons eipA
+	wait_ping eipC "${OVERLAY[eipA]}" 5
+	grep -q "is now ACTIVE (peer resigned)" "$WORK/eipB.log"
+	ip -n eipB -br addr show v0 | grep -q "$vip/"
+}
+
+main() {
+	if [[ $(id -u) != 0 ]]; then
+		echo "run as root (network namespaces and TAP devices are required)" >&2
+		exit 2
+	fi
+	trap cleanup EXIT
+	BIN=${ETHERIP_BIN:-$WORK/etherip}
+	if [[ -z ${ETHERIP_BIN:-} ]]; then
+		(cd "$ROOT" && go build -o "$BIN" .)
+	fi
+
+	local cases=("$@")
+	if [[ ${#cases[@]} -eq 0 ]]; then
+		cases=(ping large vlan dns gretap l2tpv3 cluster)
+	fi
+	for c in "${cases[@]}"; do
+		if ! declare -F "case_$c" >/dev/null; then
+			echo "unknown case: $c" >&2
+			exit 2
+		fi
+		setup_underlay
+		: >"$WORK/eipA.log" >"$WORK/eipB.log" >"$WORK/eipC.log"
+		# ifの条件の中ではerrexitが効かないため、サブシェルの終了コードで判定する
+		local rc=0
+		(set -e && "case_$c") || rc=$?
+		if [[ $rc -eq 0 ]]; then
+			log "PASS $c"
+		elif [[ $rc -eq 77 ]]; then
+			log "SKIP $c"
+		else
+			log "FAIL $c"
+			FAILED+=("$c")
+			tail -n 20 "$WORK"/eip?.log
+		fi
+		stop_daemons
+	done
+	if [[ ${#FAILED[@]} -gt 0 ]]; then
+		log "failed: ${FAILED[*]}"
+		exit 1
+	fi
+	log "all cases passed"
+}
+
+main "$@"
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// iperf3応答機能関連の定数定義
+const (
+	iperfDefaultPort  = 5201
+	iperfDefaultTime  = 10               // 試験時間の既定値（秒）
+	iperfCookieLen    = 37               // セッション識別用クッキー（36文字 + NUL）
+	iperfDefaultBlock = 128 * 1024       // 1回の送信サイズの既定値（TCP）
+	iperfMaxBlock     = 1024 * 1024      // 1回の送信サイズの上限
+	iperfMaxStreams   = 128              // 並列ストリーム数の上限
+	iperfMaxJSON      = 64 * 1024        // パラメータ・結果JSONの上限
+	iperfSetupTimeout = 10 * time.Second // パラメータ交換・ストリーム接続・結果交換の待ち時間
+	iperfEndGrace     = 30 * time.Second // 試験時間を過ぎてからTEST_ENDを待つ時間
+	iperfIfPrefix     = "eipf-"          // 応答用インターフェース名の接頭辞
+	iperfAccessDenied = 0xFF             // ACCESS_DENIED (-1)
+)
+
+// iperf3の制御チャネルの状態
+const (
+	iperfTestStart       = 1
+	iperfTestRunning     = 2
+	iperfTestEnd         = 4
+	iperfParamExchange   = 9
+	iperfCreateStreams   = 10
+	iperfClientTerminate = 12
+	iperfExchangeResults = 13
+	iperfDisplayResults  = 14
+)
+
+// IperfConfigはオーバーレイ上のiperf3応答機能の設定を保持する
+//
+// TAP（br_name指定時はブリッジ）上に専用MACのmacvlanを作り、そのアドレスでiperf3サーバとして応答する。
+// 対向拠点から `iperf3 -c <address>` で、別ホストを用意せずにトンネル自体の性能を確認できる。
+type IperfConfig struct {
+	Address string `yaml:"address"` // 応答用のアドレスとプレフィックス長（例: 10.0.0.250/24、空で無効）
+	MAC     string `yaml:"mac"`     // 応答用インターフェースのMAC（省略時はカーネルが生成）
+	Port    int    `yaml:"port"`    // 待ち受けポート（既定5201）
+}
+
+// iperfParamsはクライアントから受け取る試験パラメータ（使用する項目のみ）
+type iperfParams struct {
+	TCP           bool `json:"tcp"`
+	UDP           bool `json:"udp"`
+	Time          int  `json:"time"` // 試験時間（秒）
+	Bytes         int  `json:"num"`  // 転送量で終了する場合のバイト数
+	BlockCount    int  `json:"blockcount"`
+	Omit          int  `json:"omit"` // 集計から除く開始直後の時間（秒）
+	Parallel      int  `json:"parallel"`
+	Reverse       bool `json:"reverse"`
+	Bidirectional bool `json:"bidirectional"`
+	Len           int  `json:"len"`
+}
+
+// iperfStreamResultはクライアントへ返すストリームごとの結果
+type iperfStreamResult struct {
+	ID          int     `json:"id"`
+	Bytes       uint64  `json:"bytes"`
+	Retransmits int     `json:"retransmits"`
+	Jitter      float64 `json:"jitter"`
+	Errors      int     `json:"errors"`
+	Packets     int     `json:"packets"`
+	StartTime   float64 `json:"start_time"`
+	EndTime     float64 `json:"end_time"`
+}
+
+// iperfResultsはクライアントへ返す試験結果
+type iperfResults struct {
+	CPUUtilTotal         float64             `json:"cpu_util_total"`
+	CPUUtilUser          float64             `json:"cpu_util_user"`
+	CPUUtilSystem        float64             `json:"cpu_util_system"`
+	SenderHasRetransmits int                 `json:"sender_has_retransmits"`
+	Streams              []iperfStreamResult `json:"streams"`
+}
+
+// iperfTestは実行中の試験1件分の状態
+type iperfTest struct {
+	cookie  string
+	streams chan net.Conn // 同じクッキーで接続してきたデータストリーム
+}
+
+// iperfResponderはオーバーレイ上でiperf3クライアントの試験に応答する
+type iperfResponder struct {
+	ifname string
+	ln     net.Listener
+
+	mu   sync.Mutex
+	test *iperfTest // 実行中の試験（同時に1件のみ、なければnil）
+
+	tests   atomic.Uint64 // 完了した試験数
+	rxBytes atomic.Uint64 // 試験で受信したバイト数
+	txBytes atomic.Uint64 // 試験で送信したバイト数
+}
+
+// parseIperfConfig はiperf3応答機能の設定を検証する関数
+func parseIperfConfig(cfg IperfConfig) (net.IP, *net.IPNet, net.HardwareAddr, int, error) {
+	ip, ipnet, err := net.ParseCIDR(cfg.Address)
+	if err != nil {
+		return nil, nil, nil, 0, fmt.Errorf("address: %w", err)
+	}
+	var mac net.HardwareAddr
+	if cfg.MAC != "" {
+		if mac, err = net.ParseMAC(cfg.MAC); err != nil || len(mac) != 6 || mac[0]&1 != 0 {
+			return nil, nil, nil, 0, fmt.Errorf("mac: invalid unicast MAC %q", cfg.MAC)
+		}
+	}
+	port := cfg.Port
+	if port == 0 {
+		port = iperfDefaultPort
+	}
+	if port < 1 || port > 65535 {
+		return nil, nil, nil, 0, fmt.Errorf("port %d out of range", cfg.Port)
+	}
+	return ip, ipnet, mac, port, nil
+}
+
+// iperfIfname はTAP名から応答用インターフェース名を返す関数（IFNAMSIZに収まるよう切り詰める）
+func iperfIfname(tapName string) string {
+	name := iperfIfPrefix + tapName
+	if len(name) > 15 {
+		name = name[:15]
+	}
+	return name
+}
+
+// newIperfResponder は応答用インターフェースを作成して待ち受けを開始する関数
+//
+// lowerはmacvlanの親インターフェース（ブリッジ参加時はブリッジ、そうでなければTAP）。
+func newIperfResponder(cfg IperfConfig, tapName, lower string) (*iperfResponder, error) {
+	ip, ipnet, mac, port, err := parseIperfConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &iperfResponder{ifname: iperfIfname(tapName)}
+	args := []string{"link", "add", "link", lower, "name", r.ifname}
+	if mac != nil {
+		args = append(args, "address", mac.String())
+	}
+	args = append(args, "type", "macvlan", "mode", "bridge")
+	if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("ip link add %s: %v: %s", r.ifname, err, out)
+	}
+	registerCleanup(r.close)
+
+	ones, _ := ipnet.Mask.Size()
+	cidr := ip.String() + "/" + strconv.Itoa(ones)
+	if out, err := exec.Command("ip", "addr", "add", cidr, "dev", r.ifname).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("ip addr add %s: %v: %s", cidr, err, out)
+	}
+	if err := linkUp(r.ifname); err != nil {
+		return nil, err
+	}
+
+	// アドレスが使用可能になるまで（IPv6のDAD等）少し待つ
+	for i := 0; ; i++ {
+		r.ln, err = net.Listen("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		if err == nil || i == 30 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		return nil, err
+	}
+	logf("[INFO]", "iperf3 responder listening on %s (%s via %s)", r.ln.Addr(), r.ifname, lower)
+	return r, nil
+}
+
+// close は待ち受けを止めて応答用インターフェースを削除する関数
+func (r *iperfResponder) close() {
+	if r.ln != nil {
+		r.ln.Close()
+	}
+	if err := exec.Command("ip", "link", "del", "dev", r.ifname).Run(); err != nil {
+		logf("[WARN]", "Failed to delete %s: %v", r.ifname, err)
+	}
+}
+
+// run は接続を受け付け、制御接続かデータストリームかを振り分ける関数
+func (r *iperfResponder) run() {
+	for {
+		conn, err := r.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logf("[WARN]", "iperf3 accept: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go r.accept(conn)
+	}
+}
+
+// accept は接続のクッキーを読み、実行中の試験のストリームか新しい試験として処理する関数
+func (r *iperfResponder) accept(conn net.Conn) {
+	cookie := make([]byte, iperfCookieLen)
+	conn.SetReadDeadline(time.Now().Add(iperfSetupTimeout))
+	if _, err := io.ReadFull(conn, cookie); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	r.mu.Lock()
+	test := r.test
+	switch {
+	case test != nil && test.cookie == string(cookie):
+		r.mu.Unlock()
+		select {
+		case test.streams <- conn:
+		default:
+			conn.Close()
+		}
+		return
+	case test != nil:
+		r.mu.Unlock()
+		conn.Write([]byte{iperfAccessDenied})
+		conn.Close()
+		return
+	}
+	test = &iperfTest{cookie: string(cookie), streams: make(chan net.Conn, iperfMaxStreams)}
+	r.test = test
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		r.test = nil
+		r.mu.Unlock()
+	}()
+	defer conn.Close()
+	if err := r.serve(conn, test); err != nil {
+		logf("[WARN]", "iperf3 test from %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// readIperfJSON は長さ（4バイト）付きのJSONを読み取る関数
+func readIperfJSON(conn net.Conn, v any) error {
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n > iperfMaxJSON {
+		return fmt.Errorf("JSON too large (%d bytes)", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(buf, v)
+}
+
+// writeIperfJSON は長さ（4バイト）付きのJSONを書き込む関数
+func writeIperfJSON(conn net.Conn, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(b))), b...))
+	return err
+}
+
+// readIperfState は制御チャネルの状態を1つ読み取る関数
+func readIperfState(conn net.Conn) (int8, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return 0, err
+	}
+	return int8(b[0]), nil
+}
+
+// serve は制御接続で1件の試験を進める関数（TCPの送信・受信に対応）
+func (r *iperfResponder) serve(ctrl net.Conn, test *iperfTest) error {
+	ctrl.SetDeadline(time.Now().Add(iperfSetupTimeout))
+	if _, err := ctrl.Write([]byte{iperfParamExchange}); err != nil {
+		return err
+	}
+	var params iperfParams
+	if err := readIperfJSON(ctrl, &params); err != nil {
+		return fmt.Errorf("parameters: %w", err)
+	}
+	if params.UDP || params.Bidirectional {
+		ctrl.Write([]byte{iperfAccessDenied})
+		return errors.New("only TCP tests in one direction are supported")
+	}
+	streams := max(params.Parallel, 1)
+	if streams > iperfMaxStreams {
+		ctrl.Write([]byte{iperfAccessDenied})
+		return fmt.Errorf("too many parallel streams (%d)", streams)
+	}
+	block := params.Len
+	if block <= 0 {
+		block = iperfDefaultBlock
+	}
+	block = min(block, iperfMaxBlock)
+
+	// データストリームの接続を待つ
+	if _, err := ctrl.Write([]byte{iperfCreateStreams}); err != nil {
+		return err
+	}
+	conns := make([]net.Conn, 0, streams)
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	timeout := time.After(iperfSetupTimeout)
+	for len(conns) < streams {
+		select {
+		case c := <-test.streams:
+			conns = append(conns, c)
+		case <-timeout:
+			return fmt.Errorf("only %d of %d streams connected", len(conns), streams)
+		}
+	}
+
+	if _, err := ctrl.Write([]byte{iperfTestStart, iperfTestRunning}); err != nil {
+		return err
+	}
+	start := time.Now()
+	counts := make([]atomic.Uint64, streams)
+	var wg sync.WaitGroup
+	for i, c := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if params.Reverse {
+				buf := make([]byte, block)
+				for {
+					n, err := c.Write(buf)
+					counts[i].Add(uint64(n))
+					if err != nil {
+						return
+					}
+				}
+			}
+			buf := make([]byte, max(block, iperfDefaultBlock))
+			for {
+				n, err := c.Read(buf)
+				counts[i].Add(uint64(n))
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	// クライアントの試験終了（TEST_END）を待つ
+	ctrl.SetDeadline(time.Time{})
+	if params.Bytes == 0 && params.BlockCount == 0 {
+		ctrl.SetDeadline(time.Now().Add(params.duration() + iperfEndGrace))
+	}
+	state, err := readIperfState(ctrl)
+	elapsed := time.Since(start)
+	for _, c := range conns {
+		c.SetDeadline(time.Now())
+	}
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	if state == iperfClientTerminate {
+		return errors.New("terminated by client")
+	}
+	if state != iperfTestEnd {
+		return fmt.Errorf("unexpected state %d", state)
+	}
+
+	// 結果の交換
+	ctrl.SetDeadline(time.Now().Add(iperfSetupTimeout))
+	if _, err := ctrl.Write([]byte{iperfExchangeResults}); err != nil {
+		return err
+	}
+	if err := readIperfJSON(ctrl, nil); err != nil {
+		return fmt.Errorf("client results: %w", err)
+	}
+	results := iperfResults{Streams: make([]iperfStreamResult, streams)}
+	var total uint64
+	for i := range results.Streams {
+		// iperf3のストリームIDは1, 3, 4, ...の順に振られる
+		id := 1
+		if i > 0 {
+			id = i + 2
+		}
+		n := counts[i].Load()
+		total += n
+		results.Streams[i] = iperfStreamResult{ID: id, Bytes: n, Retransmits: -1, EndTime: elapsed.Seconds()}
+	}
+	if err := writeIperfJSON(ctrl, results); err != nil {
+		return err
+	}
+	if _, err := ctrl.Write([]byte{iperfDisplayResults}); err != nil {
+		return err
+	}
+	readIperfState(ctrl) // IPERF_DONE（届かなくても結果は確定済み）
+
+	direction := "receive"
+	if params.Reverse {
+		direction = "send"
+		r.txBytes.Add(total)
+	} else {
+		r.rxBytes.Add(total)
+	}
+	r.tests.Add(1)
+	logf("[INFO]", "iperf3 test from %s: %s %d bytes in %.1fs (%.2f Mbit/s, %d streams)",
+		ctrl.RemoteAddr(), direction, total, elapsed.Seconds(), float64(total)*8/elapsed.Seconds()/1e6, streams)
+	return nil
+}
+
+// duration は試験時間（omitを含む）を返す関数
+func (p iperfParams) duration() time.Duration {
+	sec := p.Time
+	if sec <= 0 {
+		sec = iperfDefaultTime
+	}
+	return time.Duration(sec+p.Omit) * time.Second
+}
+
+// Counters はiperf3応答機能の試験数と転送量を返す
+func (r *iperfResponder) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"iperf_tests":    r.tests.Load(),
+		"iperf_rx_bytes": r.rxBytes.Load(),
+		"iperf_tx_bytes": r.txBytes.Load(),
+	}
+}
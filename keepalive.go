@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// OAM（デーモン間制御）フレーム関連の定数定義
+const (
+	oamEtherType = 0x88B5 // IEEE 802 Local Experimental EtherType
+	oamMagic     = "EIPO" // OAMフレーム識別用マジック
+	oamVersion   = 1      // OAMプロトコルバージョン
+	oamHeaderLen = 14 + 8 // Ethernetヘッダ + OAMヘッダ(magic/version/type/length)
+
+	oamKeepaliveRequest = 1  // キープアライブ要求
+	oamKeepaliveReply   = 2  // キープアライブ応答
+	oamProbeRequest     = 3  // PMTUDプローブ要求（パディングで任意サイズ）
+	oamProbeReply       = 4  // PMTUDプローブ応答
+	oamCanaryRequest    = 5  // カナリア要求（本文をそのまま折り返す）
+	oamCanaryReply      = 6  // カナリア応答
+	oamHelloRequest     = 7  // ハンドシェイク要求（自身のバージョン・プラットフォームを載せる）
+	oamHelloReply       = 8  // ハンドシェイク応答
+	oamTrace            = 9  // トレースの印の予告（直後に送るフレームの指紋を載せる）
+	oamFDBSync          = 10 // ブリッジで学習したMACアドレスの一覧
+)
+
+// oamDstMAC はOAMフレームの宛先MAC（ブリッジが転送しない予約アドレス）
+var oamDstMAC = net.HardwareAddr{0x01, 0x80, 0xC2, 0x00, 0x00, 0x0F}
+
+// parseKeepalive はキープアライブ設定を解析する関数（"off"の場合は0を返す）
+func parseKeepalive(cfg *Config) (time.Duration, time.Duration, error) {
+	if cfg.KeepaliveInterval == "off" {
+		if cfg.DualStack {
+			logf("[WARN]", "dual_stack is enabled but keepalive is off; failover is disabled")
+		}
+		return 0, 0, nil
+	}
+
+	interval, err := time.ParseDuration(cfg.KeepaliveInterval)
+	if err != nil {
+		return 0, 0, err
+	}
+	if interval <= 0 {
+		return 0, 0, fmt.Errorf("keepalive_interval must be positive")
+	}
+
+	// タイムアウト未指定時は送信間隔の3倍とする
+	timeout := 3 * interval
+	if cfg.KeepaliveTimeout != "" {
+		timeout, err = time.ParseDuration(cfg.KeepaliveTimeout)
+		if err != nil {
+			return 0, 0, err
+		}
+		if timeout <= interval {
+			return 0, 0, fmt.Errorf("keepalive_timeout (%v) must be longer than keepalive_interval (%v)", timeout, interval)
+		}
+	}
+	return interval, timeout, nil
+}
+
+// parseKeepaliveAdaptive はkeepalive_adaptiveを解析する関数（空・"off"の場合は0を返す）
+func parseKeepaliveAdaptive(cfg *Config, interval time.Duration) (time.Duration, error) {
+	if cfg.KeepaliveAdaptive == "" || cfg.KeepaliveAdaptive == "off" {
+		return 0, nil
+	}
+	limit, err := time.ParseDuration(cfg.KeepaliveAdaptive)
+	if err != nil {
+		return 0, err
+	}
+	if interval == 0 {
+		return 0, fmt.Errorf("keepalive_adaptive requires keepalive_interval")
+	}
+	if limit <= interval {
+		return 0, fmt.Errorf("keepalive_adaptive (%v) must be longer than keepalive_interval (%v)", limit, interval)
+	}
+	return limit, nil
+}
+
+// buildOAMFrame はOAMフレーム（Ethernetフレーム）を生成する関数
+func buildOAMFrame(src net.HardwareAddr, msgType byte, body []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(oamDstMAC)
+	if len(src) == 6 {
+		buf.Write(src)
+	} else {
+		buf.Write(make([]byte, 6))
+	}
+	binary.Write(&buf, binary.BigEndian, uint16(oamEtherType))
+	buf.WriteString(oamMagic)
+	buf.WriteByte(oamVersion)
+	buf.WriteByte(msgType)
+	binary.Write(&buf, binary.BigEndian, uint16(len(body)))
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// isOAMFrame はフレームがOAMフレームかどうかを判定する関数
+func isOAMFrame(frame []byte) bool {
+	return len(frame) >= oamHeaderLen &&
+		binary.BigEndian.Uint16(frame[12:14]) == oamEtherType &&
+		string(frame[14:18]) == oamMagic
+}
+
+// handleOAM は受信したOAMフレームを種別ごとに処理する関数
+func (t *Tunnel) handleOAM(peer *Peer, p *Path, from net.Addr, frame []byte) {
+	msgType := frame[19]
+	length := int(binary.BigEndian.Uint16(frame[20:22]))
+	if frame[18] != oamVersion || len(frame) < oamHeaderLen+length {
+		return
+	}
+	body := frame[oamHeaderLen : oamHeaderLen+length]
+
+	switch msgType {
+	case oamKeepaliveRequest:
+		// 要求を受信した経路・送信元へそのまま応答を返す
+		reply := buildOAMFrame(t.mac, oamKeepaliveReply, body)
+		p.writeTo(t.seal(p, buildEtherIPPacket(reply)), from)
+		debugf(debugKeepalive, "request from %s (%s) on IPv%d, replied", peer.Host, from, p.Version)
+	case oamKeepaliveReply:
+		if len(body) < 12 {
+			return
+		}
+		now := time.Now()
+		p.lastRecv.Store(now.UnixNano())
+		// 要求に載せた送信時刻との差をRTTとする（応答側は本文をそのまま返す）
+		rtt := now.Sub(time.Unix(0, int64(binary.BigEndian.Uint64(body[4:12]))))
+		p.rtt.Store(int64(max(rtt, 1)))
+		debugf(debugKeepalive, "reply #%d from %s (%s) on IPv%d, rtt %v", binary.BigEndian.Uint32(body[0:4]), peer.Host, from, p.Version, rtt)
+
+		// SLAの損失率・遅延は送信に使用中の経路で計測する
+		if peer.sla != nil && p == peer.active.Load() {
+			peer.sla.recordReply(now, rtt)
+		}
+	case oamProbeRequest:
+		// 応答はパディングを除いた小さなフレームで返す
+		if len(body) >= 6 {
+			reply := buildOAMFrame(t.mac, oamProbeReply, body[:6])
+			p.writeTo(t.seal(p, buildEtherIPPacket(reply)), from)
+		}
+	case oamProbeReply:
+		if t.pmtud != nil {
+			t.pmtud.ack(body)
+		}
+	case oamCanaryRequest:
+		// 受信した本文を1ビットも変えずに返す（送信側で照合する）
+		reply := buildOAMFrame(t.mac, oamCanaryReply, body)
+		p.writeTo(t.seal(p, buildEtherIPPacket(reply)), from)
+	case oamCanaryReply:
+		if t.canary != nil {
+			t.canary.verify(peer, p, body)
+		}
+	case oamTrace:
+		t.trace.expect(peer, body)
+	case oamFDBSync:
+		if t.fdbSync != nil {
+			t.fdbSync.receive(body)
+		}
+	case oamHelloRequest:
+		t.noteSoftware(peer, body)
+		t.replyHello(p, from)
+	case oamHelloReply:
+		if sw := t.noteSoftware(peer, body); sw != nil && t.srcSelect != nil {
+			t.srcSelect.verify(peer, p, sw.Observed)
+		}
+	}
+}
+
+// startKeepalive は全ピアの全経路へ定期的にキープアライブを送信し、経路の生死判定と切り替えを行う関数
+//
+// keepalive_adaptive有効時は、直近の送信間隔内に経路からデータを受信していればキープアライブを省略し、
+// 送信間隔をkeepaliveMaxまで緩める。受信が途絶えると次の送信から元の間隔に戻る。
+func (t *Tunnel) startKeepalive(interval, timeout time.Duration) {
+	if t.keepaliveMax > 0 {
+		logf("[INFO]", "Keepalive enabled (interval %v, up to %v while traffic flows, timeout %v)", interval, t.keepaliveMax, timeout)
+	} else {
+		logf("[INFO]", "Keepalive enabled (interval %v, timeout %v)", interval, timeout)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var seq uint32
+	last := time.Now()
+	for now := range ticker.C {
+		seq++
+		body := make([]byte, 12)
+		binary.BigEndian.PutUint32(body[0:4], seq)
+		binary.BigEndian.PutUint64(body[4:12], uint64(now.UnixNano()))
+		packet := buildEtherIPPacket(buildOAMFrame(t.mac, oamKeepaliveRequest, body))
+
+		for _, peer := range t.peers {
+			t.keepalivePeer(peer, packet, now, now.Sub(last), timeout)
+		}
+		last = now
+	}
+}
+
+// keepalivePeer は1ピア分のキープアライブ送信と経路判定を行う関数
+func (t *Tunnel) keepalivePeer(peer *Peer, packet []byte, now time.Time, elapsed, timeout time.Duration) {
+	anyUp := false
+	inputs := make([]ControlPath, len(peer.paths))
+	for i, p := range peer.paths {
+		dst := p.Dst.Load().(net.IP)
+		if t.keepaliveQuiet(p, now) {
+			t.kaSuppressed.Add(1)
+			debugf(debugKeepalive, "request to %s (%s) on IPv%d suppressed (data received)", p.Host, dst, p.Version)
+		} else {
+			err := p.write(t.seal(p, packet), t.qos.oob(p.Version, -1))
+			debugf(debugKeepalive, "request to %s (%s) on IPv%d sent (err %v)", p.Host, dst, p.Version, err)
+			p.lastSent.Store(now.UnixNano())
+			if peer.sla != nil && p == peer.active.Load() {
+				peer.sla.recordSent(now)
+			}
+		}
+
+		inputs[i] = controlPathState(t, p) // 判定と記録で同じ入力を使う
+		anyUp = t.judgePath(p, inputs[i], now, timeout) || anyUp
+	}
+
+	peer.selectActivePath(now)
+	if anyUp != peer.up.Swap(anyUp) {
+		if anyUp {
+			t.events.emit("up", peer.Host, "keepalive recovered")
+			t.fdbSync.trigger() // 再起動・経路断の間に対向のブリッジが忘れたMACを送り直す
+		} else {
+			t.events.emit("down", peer.Host, fmt.Sprintf("no keepalive reply for %v", timeout))
+		}
+	}
+	controlTrace.tick(peer, now, inputs)
+	if peer.sla != nil {
+		peer.sla.recordTick(now, elapsed, anyUp)
+	}
+
+	// 到達不能になったピアの学習済みMACは破棄してフラッディングに戻す
+	if !anyUp && t.fdb != nil {
+		t.fdb.forgetPeer(peer)
+	}
+}
+
+// judgePath は経路の判定への入力（キープアライブの応答・経路の状態）から経路の生死を判定し、変化をログ出力する関数
+func (t *Tunnel) judgePath(p *Path, in ControlPath, now time.Time, timeout time.Duration) bool {
+	alive := t.keepaliveAlive(in.Recv, in.Data, now, timeout) && !in.RouteDown && !in.Recursing
+	if alive != p.up.Swap(alive) {
+		dst := p.Dst.Load().(net.IP)
+		if alive {
+			p.upSince.Store(now.UnixNano())
+			logf("[RESET]", "IPv%d path to %s (%s) recovered", p.Version, p.Host, dst)
+		} else {
+			logf("[WARN]", "IPv%d path to %s (%s) lost (no keepalive reply for %v)", p.Version, p.Host, dst, timeout)
+		}
+	}
+	return alive
+}
+
+// keepaliveQuiet は経路がデータを受信中で、今回のキープアライブを省略できるか判定する関数
+func (t *Tunnel) keepaliveQuiet(p *Path, now time.Time) bool {
+	if t.keepaliveMax == 0 {
+		return false
+	}
+	return now.Sub(time.Unix(0, p.lastData.Load())) < t.keepaliveInterval &&
+		now.Sub(time.Unix(0, p.lastSent.Load())) < t.keepaliveMax
+}
+
+// keepaliveAlive は経路が生きているか判定する関数
+//
+// 適応制御時はデータの受信もキープアライブ応答と同様に扱う。ただし片方向の障害を見逃さないよう、
+// 応答そのものもkeepaliveMax+timeout以内に受信していることを条件とする。
+func (t *Tunnel) keepaliveAlive(lastRecv, lastData int64, now time.Time, timeout time.Duration) bool {
+	if t.keepaliveMax == 0 {
+		return now.Sub(time.Unix(0, lastRecv)) < timeout
+	}
+	last := max(lastRecv, lastData)
+	return now.Sub(time.Unix(0, last)) < timeout && now.Sub(time.Unix(0, lastRecv)) < t.keepaliveMax+timeout
+}
+
+// refreshPeer はキープアライブ以外で経路の状態が変わった際に送信経路とピアの状態を更新する関数
+func (t *Tunnel) refreshPeer(peer *Peer, reason string) {
+	anyUp := false
+	inputs := make([]ControlPath, len(peer.paths))
+	for i, p := range peer.paths {
+		inputs[i] = controlPathState(t, p)
+		anyUp = anyUp || inputs[i].Up
+	}
+
+	now := time.Now()
+	peer.selectActivePath(now)
+	if anyUp != peer.up.Swap(anyUp) {
+		if anyUp {
+			t.events.emit("up", peer.Host, reason)
+		} else {
+			t.events.emit("down", peer.Host, reason)
+		}
+	}
+	controlTrace.refresh(peer, now, reason, inputs)
+	if !anyUp && t.fdb != nil {
+		t.fdb.forgetPeer(peer)
+	}
+}
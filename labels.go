@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// labelNameRe はラベル名（Prometheusのラベル名として使える形式）
+var labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// reservedLabels はメトリクス・イベントで既に使っているためlabelsに書けない名前
+var reservedLabels = map[string]bool{
+	"tap": true, "tenant": true, "peer": true, "direction": true,
+	"vlan": true, "layer": true, "name": true, "le": true, "domain": true,
+}
+
+// logLabels はログの各行の先頭に付けるトップレベルのラベル（"site=tokyo region=ap"、空で付けない）
+var logLabels string
+
+// validateLabels はラベル名を検証する関数
+func validateLabels(labels map[string]string) error {
+	for k := range labels {
+		switch {
+		case !labelNameRe.MatchString(k) || strings.HasPrefix(k, "__"):
+			return fmt.Errorf("invalid label name %q (letters, digits and underscores, not starting with a digit or __)", k)
+		case reservedLabels[k]:
+			return fmt.Errorf("label name %q is reserved", k)
+		}
+	}
+	return nil
+}
+
+// labelPairs はラベルを名前順の名前と値の組の並びにする関数（メトリクスのラベル用）
+func labelPairs(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys)*2)
+	for _, k := range keys {
+		pairs = append(pairs, k, labels[k])
+	}
+	return pairs
+}
+
+// labelEnv はフックコマンドへ渡すラベルの環境変数（ETHERIP_LABEL_<名前>）を返す関数
+func labelEnv(labels map[string]string) []string {
+	pairs := labelPairs(labels)
+	env := make([]string, 0, len(labels))
+	for i := 0; i < len(pairs); i += 2 {
+		env = append(env, "ETHERIP_LABEL_"+strings.ToUpper(pairs[i])+"="+pairs[i+1])
+	}
+	return env
+}
+
+// applyLogLabels はログに付けるラベルを設定する関数（ログ出力が始まる起動時に1度だけ呼ぶ）
+func applyLogLabels(labels map[string]string) error {
+	if err := validateLabels(labels); err != nil {
+		return err
+	}
+	pairs := labelPairs(labels)
+	fields := make([]string, 0, len(labels))
+	for i := 0; i < len(pairs); i += 2 {
+		fields = append(fields, pairs[i]+"="+pairs[i+1])
+	}
+	logLabels = strings.Join(fields, " ")
+	return nil
+}
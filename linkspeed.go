@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// link_speedの設定値
+const (
+	linkSpeedAuto = "auto" // rate_limitの帯域（tx・rxの大きい方）に合わせる
+)
+
+// parseLinkSpeed はlink_speedの設定値をMb/s単位の速度に変換する関数（空なら0）
+func parseLinkSpeed(cfg *Config) (int, error) {
+	var bps float64
+	switch cfg.LinkSpeed {
+	case "":
+		return 0, nil
+	case linkSpeedAuto:
+		for _, rc := range []RateConfig{cfg.RateLimit.TX, cfg.RateLimit.RX} {
+			if rc.Rate == "" {
+				continue
+			}
+			rate, err := parseBitrate(rc.Rate)
+			if err != nil {
+				return 0, fmt.Errorf("rate_limit: %w", err)
+			}
+			bps = max(bps, rate)
+		}
+		if bps == 0 {
+			return 0, fmt.Errorf("auto requires rate_limit.tx.rate or rate_limit.rx.rate")
+		}
+	default:
+		var err error
+		if bps, err = parseBitrate(cfg.LinkSpeed); err != nil {
+			return 0, fmt.Errorf("%q: %w", cfg.LinkSpeed, err)
+		}
+	}
+	// ethtoolの速度はMb/s単位の32ビット値（0xFFFFFFFFは不明を表す）
+	mbps := math.Ceil(bps / 1e6)
+	if mbps >= math.MaxUint32 {
+		return 0, fmt.Errorf("%s is too fast", cfg.LinkSpeed)
+	}
+	return int(mbps), nil
+}
+
+// applyLinkSpeed はTAPの速度（ethtool・/sys/class/net/<tap>/speed）を設定値に合わせる関数
+//
+// TAPの速度は既定で10Mb/sのため、ifSpeedから使用率を計算する監視（SNMP等）が意味のない値を出す。
+// 帯域制限を設定していれば、その帯域を回線速度として見せる。
+func applyLinkSpeed(cfg *Config) (int, error) {
+	mbps, err := parseLinkSpeed(cfg)
+	if err != nil || mbps == 0 {
+		return 0, err
+	}
+	if err := setLinkSpeed(cfg.TapName, mbps); err != nil {
+		return mbps, err
+	}
+	logf("[INFO]", "Link speed of %s set to %d Mb/s full duplex", cfg.TapName, mbps)
+	return mbps, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// ethtool関連の定数定義（linux/ethtool.h, linux/sockios.h）
+const (
+	siocEthtool    = 0x8946
+	ethtoolGSet    = 0x00000001
+	ethtoolSSet    = 0x00000002
+	duplexFull     = 0x01
+	autonegDisable = 0x00
+)
+
+// ethtoolCmdはETHTOOL_GSET・ETHTOOL_SSETで受け渡すstruct ethtool_cmd
+type ethtoolCmd struct {
+	cmd           uint32
+	supported     uint32
+	advertising   uint32
+	speed         uint16
+	duplex        uint8
+	port          uint8
+	phyAddress    uint8
+	transceiver   uint8
+	autoneg       uint8
+	mdioSupport   uint8
+	maxTxPkt      uint32
+	maxRxPkt      uint32
+	speedHi       uint16
+	ethTpMdix     uint8
+	ethTpMdixCtrl uint8
+	lpAdvertising uint32
+	reserved      [2]uint32
+}
+
+// ifreqDataはifr_dataにポインタを渡すstruct ifreq
+type ifreqData struct {
+	name [syscall.IFNAMSIZ]byte
+	data unsafe.Pointer
+	_    [24 - unsafe.Sizeof(uintptr(0))]byte
+}
+
+// ethtool はインターフェースにethtoolのコマンドを発行する関数
+func ethtool(fd int, ifname string, cmd *ethtoolCmd) error {
+	var ifr ifreqData
+	copy(ifr.name[:syscall.IFNAMSIZ-1], ifname)
+	ifr.data = unsafe.Pointer(cmd)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), siocEthtool, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setLinkSpeed はTAP/TUNのethtoolの速度を設定し、全二重・自動ネゴシエーションなしとする関数
+//
+// tunドライバは設定値を保持して返すだけのため、転送には影響しない。
+func setLinkSpeed(ifname string, mbps int) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	cmd := ethtoolCmd{cmd: ethtoolGSet}
+	if err := ethtool(fd, ifname, &cmd); err != nil {
+		return err
+	}
+	cmd.cmd = ethtoolSSet
+	cmd.speed = uint16(mbps)
+	cmd.speedHi = uint16(mbps >> 16)
+	cmd.duplex = duplexFull
+	cmd.autoneg = autonegDisable
+	return ethtool(fd, ifname, &cmd)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+// setLinkSpeed はLinux以外では未対応
+func setLinkSpeed(ifname string, mbps int) error {
+	return fmt.Errorf("not supported on this platform")
+}
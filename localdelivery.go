@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/songgao/water"
+)
+
+// LocalDeliveryConfigはTAP自身のMAC宛てのフレームをブリッジではなく管理用のTAPへ渡す設定を保持する
+type LocalDeliveryConfig struct {
+	Iface   string   `yaml:"iface"`   // 自ホスト宛てのフレームを渡す管理用TAPの名前（空で無効）
+	Address []string `yaml:"address"` // 管理用TAPに付けるアドレス（CIDR、空で付けない）
+}
+
+// localDeliveryはオーバーレイからデーモンのホストへの管理用アクセスを、ブリッジを経由せずに折り返す
+//
+// 管理用TAPにはトンネルのTAPと同じMACを付け、そのMAC宛てのユニキャストは管理用TAPのみへ、
+// ブロードキャスト・マルチキャストは両方へ渡す（ARP・NDの解決用）。管理用TAPから読んだフレームはトンネルへ送る。
+type localDelivery struct {
+	ifce *water.Interface
+	name string
+	mac  net.HardwareAddr
+
+	delivered atomic.Uint64 // 管理用TAPへ渡したユニキャスト数
+	flooded   atomic.Uint64 // 管理用TAPへ複製したブロードキャスト・マルチキャスト数
+	sent      atomic.Uint64 // 管理用TAPからトンネルへ送ったフレーム数
+	errors    atomic.Uint64 // 管理用TAPへの書き込みエラー数
+}
+
+// checkLocalDelivery は管理用TAPの設定を検証する関数
+func checkLocalDelivery(cfg *Config) error {
+	ld := cfg.LocalDelivery
+	if ld.Iface == "" {
+		if len(ld.Address) > 0 {
+			return fmt.Errorf("address requires iface")
+		}
+		return nil
+	}
+	if ld.Iface == cfg.TapName || ld.Iface == cfg.BrName {
+		return fmt.Errorf("iface %s must differ from tap_name and br_name", ld.Iface)
+	}
+	for _, a := range ld.Address {
+		if _, _, err := net.ParseCIDR(a); err != nil {
+			return fmt.Errorf("address %q is not a CIDR", a)
+		}
+	}
+	return nil
+}
+
+// newLocalDelivery は管理用TAPを作成し、トンネルのTAPと同じMAC・MTU・指定のアドレスを設定する関数（無効ならnilを返す）
+func newLocalDelivery(cfg *Config, mac net.HardwareAddr) (*localDelivery, error) {
+	ld := cfg.LocalDelivery
+	if ld.Iface == "" {
+		return nil, nil
+	}
+	if len(mac) != 6 {
+		return nil, fmt.Errorf("MAC address of %s is unknown", cfg.TapName)
+	}
+	if ifaceExists(ld.Iface) {
+		return nil, fmt.Errorf("interface %s already exists", ld.Iface)
+	}
+	ifce, actualName, err := createTAP(ld.Iface, water.TAP)
+	if err != nil {
+		return nil, fmt.Errorf("TAP create: %w", err)
+	}
+	if actualName != ld.Iface {
+		if err := renameInterface(actualName, ld.Iface); err != nil {
+			return nil, err
+		}
+	}
+	if err := setLinkAddress(ld.Iface, mac); err != nil {
+		return nil, err
+	}
+	if err := setTAPMTU(ld.Iface, cfg.MTU); err != nil {
+		return nil, err
+	}
+	for _, a := range ld.Address {
+		if err := replaceAddress(ld.Iface, a); err != nil {
+			return nil, err
+		}
+	}
+	if err := linkUp(ld.Iface); err != nil {
+		return nil, err
+	}
+	logf("[INFO]", "Frames to %s (%s) are delivered to %s instead of the bridge", mac, cfg.TapName, ld.Iface)
+	return &localDelivery{ifce: ifce, name: ld.Iface, mac: mac}, nil
+}
+
+// run は管理用TAPから読んだフレームをトンネルの送信キューへ渡す関数
+func (l *localDelivery) run(t *Tunnel) {
+	for {
+		t.pacer.wait()
+		buf := t.txBufs.get()
+		n, err := l.ifce.Read(buf)
+		if err != nil {
+			logf("[ERROR]", "%s read: %v", l.name, err)
+			t.txBufs.put(buf)
+			continue
+		}
+		l.sent.Add(1)
+		t.enqueue(t.sendChan, Packet{Data: buf, Offset: 0, Length: n, Pool: t.txBufs})
+	}
+}
+
+// deliver はトンネルから受信したフレームを宛先MACに応じて管理用TAPへ渡す関数
+//
+// 自身のMAC宛てで管理用TAPだけに渡した場合はtrueを返す（トンネルのTAPへは書き込まない）。
+func (l *localDelivery) deliver(frame []byte) bool {
+	if len(frame) < 14 {
+		return false
+	}
+	dst := net.HardwareAddr(frame[0:6])
+	multi := dst[0]&0x01 != 0
+	if !multi && !bytes.Equal(dst, l.mac) {
+		return false
+	}
+	if _, err := l.ifce.Write(frame); err != nil {
+		l.errors.Add(1)
+	} else if multi {
+		l.flooded.Add(1)
+	} else {
+		l.delivered.Add(1)
+	}
+	return !multi
+}
+
+// Counters は管理用TAPとの間で受け渡したフレーム数を返す
+func (l *localDelivery) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"local_delivered": l.delivered.Load(),
+		"local_flooded":   l.flooded.Load(),
+		"local_sent":      l.sent.Load(),
+		"local_errors":    l.errors.Load(),
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ログレベル（小さいほど詳細）
+const (
+	levelDebug int32 = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+// debugSubsystemは個別にDEBUGログを有効にできるサブシステム
+type debugSubsystem int
+
+const (
+	debugDNS       debugSubsystem = iota // 宛先の名前解決
+	debugDatapath                        // 受信パケットの破棄理由
+	debugKeepalive                       // キープアライブの送受信
+	debugSubsystemCount
+)
+
+var debugSubsystemNames = [debugSubsystemCount]string{"dns", "datapath", "keepalive"}
+
+// デバッグ出力関連の定数定義
+const (
+	debugLinesPerSecond = 200   // DEBUGログの1秒あたりの上限（超過分は数えるだけ）
+	hexdumpMaxBytes     = 256   // 16進ダンプするフレームの先頭バイト数
+	hexdumpMaxFrames    = 10000 // 1回の指定でダンプするフレーム数の上限
+)
+
+// LogConfigはログの詳細度を保持する（トップレベルのみ、実行中は制御APIで変更可能）
+type LogConfig struct {
+	Level string   `yaml:"level"` // debug, info, warn, error（空でinfo）
+	Debug []string `yaml:"debug"` // 個別にDEBUGログを出すサブシステム（dns, datapath, keepalive, all）
+
+	Language string `yaml:"language"` // ログ・checkの出力の言語（en, ja、空でen）
+	Catalog  string `yaml:"catalog"`  // 同梱の訳を上書き・追加するカタログ（英語の書式 → 訳のYAML）
+}
+
+// LogStatusは/logで返すログの詳細度
+type LogStatus struct {
+	Level      string   `json:"level"`
+	Debug      []string `json:"debug"`             // DEBUGログを出しているサブシステム（level: debug時は全て）
+	HexDump    int64    `json:"hexdump_remaining"` // 16進ダンプする残りのフレーム数
+	Suppressed uint64   `json:"debug_suppressed"`  // 上限を超えて出力しなかったDEBUGログの数
+}
+
+// logStateは実行中に変更できるログの詳細度
+var logState struct {
+	level      atomic.Int32
+	debug      atomic.Uint32 // サブシステムのビットマスク
+	hexdump    atomic.Int64  // 16進ダンプする残りのフレーム数
+	window     atomic.Int64  // DEBUGログを数えている秒（Unix時刻）
+	lines      atomic.Int64  // window内に出力したDEBUGログの数
+	suppressed atomic.Uint64
+}
+
+func init() {
+	logState.level.Store(levelInfo)
+}
+
+// tagLevel はログのタグに対応するレベルを返す関数
+func tagLevel(tag string) int32 {
+	switch tag {
+	case "[DEBUG]":
+		return levelDebug
+	case "[WARN]":
+		return levelWarn
+	case "[ERROR]":
+		return levelError
+	}
+	return levelInfo
+}
+
+// parseLogLevel はレベル名を検証する関数
+func parseLogLevel(name string) (int32, error) {
+	if name == "" {
+		return levelInfo, nil
+	}
+	for i, n := range logLevelNames {
+		if n == name {
+			return int32(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q (debug, info, warn, error)", name)
+}
+
+// parseDebugSubsystems はサブシステム名の一覧をビットマスクにする関数（allで全て）
+func parseDebugSubsystems(names []string) (uint32, error) {
+	var mask uint32
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" || name == "none" {
+			continue
+		}
+		if name == "all" {
+			mask = 1<<debugSubsystemCount - 1
+			continue
+		}
+		found := false
+		for i, n := range debugSubsystemNames {
+			if n == name {
+				mask |= 1 << i
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown debug subsystem %q (dns, datapath, keepalive, all)", name)
+		}
+	}
+	return mask, nil
+}
+
+// applyLogConfig は起動時のログの詳細度を設定する関数
+func applyLogConfig(cfg LogConfig) error {
+	level, err := parseLogLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	mask, err := parseDebugSubsystems(cfg.Debug)
+	if err != nil {
+		return err
+	}
+	logState.level.Store(level)
+	logState.debug.Store(mask)
+	return nil
+}
+
+// debugEnabled はサブシステムのDEBUGログを出力するか判定する関数
+func debugEnabled(sub debugSubsystem) bool {
+	return logState.level.Load() == levelDebug || logState.debug.Load()&(1<<sub) != 0
+}
+
+// debugAllow はDEBUGログの1秒あたりの上限を超えていないか判定する関数（超えていれば数える）
+func debugAllow() bool {
+	now := time.Now().Unix()
+	if w := logState.window.Load(); w != now && logState.window.CompareAndSwap(w, now) {
+		logState.lines.Store(0)
+	}
+	if logState.lines.Add(1) > debugLinesPerSecond {
+		logState.suppressed.Add(1)
+		return false
+	}
+	return true
+}
+
+// debugf はサブシステムのDEBUGログを出力する関数（levelによらずサブシステム単位で有効にできる）
+func debugf(sub debugSubsystem, format string, a ...interface{}) {
+	if !debugEnabled(sub) || !debugAllow() {
+		return
+	}
+	writeLog("[DEBUG]", debugSubsystemNames[sub]+": "+fmt.Sprintf(format, a...))
+}
+
+// hexdumpFrame は16進ダンプが有効な間、転送するフレームの概要と先頭を出力する関数
+//
+// 指定したフレーム数を出力すると自動的に止まる（転送中のデーモンでの出しっぱなしを防ぐ）。
+func hexdumpFrame(tap string, dir Direction, frame []byte) {
+	if logState.hexdump.Load() <= 0 || logState.hexdump.Add(-1) < 0 {
+		return
+	}
+	n := min(len(frame), hexdumpMaxBytes)
+	writeLog("[DEBUG]", fmt.Sprintf("hexdump %s %s %s (%d bytes)\n%s", tap, dir, describeFrame(frame), len(frame), strings.TrimRight(hex.Dump(frame[:n]), "\n")))
+}
+
+// currentLogStatus は現在のログの詳細度を返す関数
+func currentLogStatus() LogStatus {
+	st := LogStatus{
+		Level:      logLevelNames[logState.level.Load()],
+		Debug:      []string{},
+		HexDump:    max(logState.hexdump.Load(), 0),
+		Suppressed: logState.suppressed.Load(),
+	}
+	for i, name := range debugSubsystemNames {
+		if debugEnabled(debugSubsystem(i)) {
+			st.Debug = append(st.Debug, name)
+		}
+	}
+	return st
+}
+
+// updateLogStatus は制御APIのクエリ（level, debug, hexdump）でログの詳細度を変更する関数
+//
+// 指定しなかった項目は変えない。debugは指定した一覧で置き換える（空・noneで全て無効）。
+func updateLogStatus(q url.Values) (LogStatus, error) {
+	level := logState.level.Load()
+	mask := logState.debug.Load()
+	hexdump := int64(-1)
+	var err error
+	if q.Has("level") {
+		if level, err = parseLogLevel(q.Get("level")); err != nil {
+			return LogStatus{}, err
+		}
+	}
+	if q.Has("debug") {
+		if mask, err = parseDebugSubsystems(strings.Split(q.Get("debug"), ",")); err != nil {
+			return LogStatus{}, err
+		}
+	}
+	if q.Has("hexdump") {
+		if hexdump, err = strconv.ParseInt(q.Get("hexdump"), 10, 64); err != nil || hexdump < 0 || hexdump > hexdumpMaxFrames {
+			return LogStatus{}, fmt.Errorf("hexdump must be between 0 and %d", hexdumpMaxFrames)
+		}
+	}
+
+	logState.level.Store(level)
+	logState.debug.Store(mask)
+	if hexdump >= 0 {
+		logState.hexdump.Store(hexdump)
+	}
+	st := currentLogStatus()
+	logf("[UPDATE]", "Log settings changed: level %s, debug %v, hexdump %d frames", st.Level, st.Debug, st.HexDump)
+	return st, nil
+}
+
+// handleLog は/logの要求を処理する関数（ログの設定はプロセス全体のため全テナントのトークンが必要）
+func (s *apiServer) handleLog(w http.ResponseWriter, r *http.Request) {
+	if len(s.tokens) > 0 {
+		tenant, ok := tokenTenant(s.tokens, r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if tenant != "*" {
+			http.Error(w, "log settings require a token for all tenants", http.StatusForbidden)
+			return
+		}
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, currentLogStatus())
+	case http.MethodPost:
+		st, err := updateLogStatus(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, st)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// runLog は"log"サブコマンドを実行し、動作中のデーモンのログの詳細度を表示・変更する関数
+func runLog(args []string) int {
+	fs := flag.NewFlagSet("log", flag.ExitOnError)
+	path := fs.String("c", "config.yaml", "設定ファイルのパス（api_listen・api_tokensを読む）")
+	addr := fs.String("api", "", "制御APIのアドレス（空で設定ファイルのapi_listen）")
+	token := fs.String("token", os.Getenv("ETHERIP_API_TOKEN"), "制御APIのトークン（空で設定ファイルのapi_tokens）")
+	level := fs.String("level", "", "ログレベル（debug, info, warn, error）")
+	debug := fs.String("debug", "", "DEBUGログを出すサブシステム（dns,datapath,keepalive,all、noneで無効）")
+	hexdump := fs.Int("hexdump", 0, "転送する次のN個のフレームを16進ダンプする（0で中止）")
+	fs.Parse(args)
+
+	fail := func(format string, a ...interface{}) int {
+		fmt.Fprintf(os.Stderr, "ERROR: "+format+"\n", a...)
+		return 1
+	}
+	if err := resolveAPI(*path, addr, token); err != nil {
+		return fail("%v", err)
+	}
+	client, base := apiClient(*addr)
+
+	// 指定されたフラグだけを変更する
+	q := url.Values{}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "level":
+			q.Set("level", *level)
+		case "debug":
+			q.Set("debug", *debug)
+		case "hexdump":
+			q.Set("hexdump", strconv.Itoa(*hexdump))
+		}
+	})
+
+	var st LogStatus
+	var err error
+	if len(q) == 0 {
+		err = apiGet(client, base, *token, "/log", &st)
+	} else {
+		err = apiDo(client, http.MethodPost, base, *token, "/log?"+q.Encode(), &st)
+	}
+	if err != nil {
+		return fail("%v", err)
+	}
+	debugList := "none"
+	if len(st.Debug) > 0 {
+		debugList = strings.Join(st.Debug, ",")
+	}
+	fmt.Printf("level %s, debug %s, hexdump %d frames remaining (%d debug lines suppressed)\n", st.Level, debugList, st.HexDump, st.Suppressed)
+	return 0
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ループ検出関連の定数定義
+const (
+	loopProbeEtherType = 0x88B5 // IEEE 802 Local Experimental EtherType 1
+	loopProbeMagic     = "EIPLOOP\x00"
+
+	loopDetectDefaultInterval = 2 * time.Second
+	loopDetectDefaultHold     = 60 * time.Second
+	loopDetectLogInterval     = 10 * time.Second // 検出を繰り返す間の警告ログの最短間隔
+
+	loopActionLog      = "log"
+	loopActionBlock    = "block"
+	loopActionShutdown = "shutdown"
+)
+
+// LoopDetectConfigはTAPとブリッジ先のLANを通るループの検出と、検出時の動作の設定を保持する
+type LoopDetectConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Interval string `yaml:"interval"` // プローブをTAPへ送る間隔（既定2s）
+	Action   string `yaml:"action"`   // 検出時の動作（log, block, shutdown、既定block）
+	Hold     string `yaml:"hold"`     // blockでトンネルを止める時間（既定60s、解除後にループが残っていれば再び止める）
+}
+
+// loopDetectorは自身が送ったプローブフレームが戻ってくることで、トンネルとブリッジ先のLANのループを検出するフィルタ
+//
+// プローブはデーモンごとの乱数のIDを載せたブロードキャストとしてTAPへ書き込む。
+// トンネルから受信する（LAN → 別経路 → 対向 → トンネル）か、TAPから再び読める（LAN → ブリッジの別ポート）場合はループとみなす。
+// 他のデーモンのプローブは通常のフレームとして転送する。
+type loopDetector struct {
+	t        *Tunnel
+	interval time.Duration
+	action   string
+	hold     time.Duration
+	probe    []byte
+	id       []byte
+
+	blockedUntil atomic.Int64 // トンネルを止めている期限(UnixNano、0で通常)
+	logged       atomic.Int64 // 最後に警告した時刻(UnixNano)
+	shutdown     sync.Once
+
+	sent     atomic.Uint64    // 送ったプローブの数
+	detected [2]atomic.Uint64 // 方向別の戻ってきたプローブの数
+	blocked  atomic.Uint64    // ループ検出中に破棄したフレーム数
+}
+
+// newLoopDetector はループ検出の設定から生成する関数（無効ならnilを返す）
+func newLoopDetector(t *Tunnel, cfg LoopDetectConfig) (*loopDetector, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	d := &loopDetector{t: t, interval: loopDetectDefaultInterval, action: loopActionBlock, hold: loopDetectDefaultHold}
+	var err error
+	if cfg.Interval != "" {
+		if d.interval, err = time.ParseDuration(cfg.Interval); err != nil || d.interval <= 0 {
+			return nil, fmt.Errorf("invalid interval %q", cfg.Interval)
+		}
+	}
+	if cfg.Hold != "" {
+		if d.hold, err = time.ParseDuration(cfg.Hold); err != nil || d.hold <= 0 {
+			return nil, fmt.Errorf("invalid hold %q", cfg.Hold)
+		}
+	}
+	switch cfg.Action {
+	case "":
+	case loopActionLog, loopActionBlock, loopActionShutdown:
+		d.action = cfg.Action
+	default:
+		return nil, fmt.Errorf("unknown action %q (log, block, shutdown)", cfg.Action)
+	}
+
+	// 送信元はローカル管理のユニキャストMAC、IDは8バイトの乱数
+	d.probe = make([]byte, 60)
+	d.id = d.probe[22:30]
+	if _, err := rand.Read(d.probe[6:12]); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(d.id); err != nil {
+		return nil, err
+	}
+	copy(d.probe[0:6], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	d.probe[6] = d.probe[6]&0xfc | 0x02
+	binary.BigEndian.PutUint16(d.probe[12:14], loopProbeEtherType)
+	copy(d.probe[14:22], loopProbeMagic)
+	return d, nil
+}
+
+// run は一定間隔でプローブをTAPへ書き込み、blockの期限が過ぎたらトンネルを再開する関数
+func (d *loopDetector) run() {
+	logf("[INFO]", "Loop detection enabled on %s (probe every %v, action %s)", d.t.cfg.TapName, d.interval, d.action)
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if until := d.blockedUntil.Load(); until != 0 && time.Now().UnixNano() >= until && d.blockedUntil.CompareAndSwap(until, 0) {
+			logf("[INFO]", "Loop on %s no longer seen for %v, tunnel resumed", d.t.cfg.TapName, d.hold)
+			d.t.events.emit("loop_end", "", fmt.Sprintf("tunnel resumed after %v", d.hold))
+		}
+		if _, err := d.t.ifce.Write(d.probe); err == nil {
+			d.sent.Add(1)
+		}
+	}
+}
+
+// isOwnProbe はフレームが自身の送ったプローブか判定する関数
+func (d *loopDetector) isOwnProbe(frame []byte) bool {
+	return len(frame) >= 30 && binary.BigEndian.Uint16(frame[12:14]) == loopProbeEtherType &&
+		string(frame[14:22]) == loopProbeMagic && bytes.Equal(frame[22:30], d.id)
+}
+
+// detect はプローブが戻ってきたときに設定された動作を行う関数
+func (d *loopDetector) detect(dir Direction) {
+	d.detected[dir].Add(1)
+	via := "the tunnel"
+	if dir == DirTX {
+		via = "another bridge port"
+	}
+	now := time.Now().UnixNano()
+
+	switch d.action {
+	case loopActionBlock:
+		// 止めている間にプローブが戻れば期限を延ばす
+		if d.blockedUntil.Swap(now+int64(d.hold)) != 0 {
+			return
+		}
+		detail := fmt.Sprintf("probe returned via %s, tunnel blocked for %v", via, d.hold)
+		logf("[ERROR]", "Loop detected on %s: %s", d.t.cfg.TapName, detail)
+		d.t.events.emit("loop", "", detail)
+	case loopActionShutdown:
+		d.shutdown.Do(func() {
+			detail := fmt.Sprintf("probe returned via %s, shutting down", via)
+			logf("[ERROR]", "Loop detected on %s: %s", d.t.cfg.TapName, detail)
+			d.t.events.emit("loop", "", detail)
+			go func() {
+				runCleanups()
+				os.Exit(1)
+			}()
+		})
+	default:
+		if last := d.logged.Load(); time.Duration(now-last) >= loopDetectLogInterval && d.logged.CompareAndSwap(last, now) {
+			detail := fmt.Sprintf("probe returned via %s", via)
+			logf("[WARN]", "Loop detected on %s: %s", d.t.cfg.TapName, detail)
+			d.t.events.emit("loop", "", detail)
+		}
+	}
+}
+
+// Filter は戻ってきた自身のプローブを破棄してループを検出し、blockの間はすべてのフレームを破棄する
+func (d *loopDetector) Filter(dir Direction, frame []byte) ([]byte, Verdict) {
+	if d.isOwnProbe(frame) {
+		d.detect(dir)
+		return nil, VerdictDrop
+	}
+	if d.blockedUntil.Load() != 0 {
+		d.blocked.Add(1)
+		return nil, VerdictDrop
+	}
+	return frame, VerdictPass
+}
+
+// Counters はプローブの送信数・検出数とループ検出中の破棄数を返す
+func (d *loopDetector) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"loop_probes":      d.sent.Load(),
+		"loop_detected_rx": d.detected[DirRX].Load(),
+		"loop_detected_tx": d.detected[DirTX].Load(),
+		"loop_blocked":     d.blocked.Load(),
+	}
+}
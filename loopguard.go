@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+)
+
+// ループガード関連の定数定義
+const (
+	hopTagEtherType       = 0x88B6 // IEEE 802 Local Experimental EtherType 2
+	hopTagLen             = 4      // EtherType(2) + ホップ数(1) + 予約(1)
+	loopGuardDefaultLimit = 8      // ホップ数上限の既定値
+)
+
+// LoopGuardConfigはデーモン間を中継するフレームのホップ数制限の設定を保持する
+//
+// 送信元MACの直後にホップ数タグを挿入して送る。対向もloop_guardを有効にすること。
+type LoopGuardConfig struct {
+	Enabled  bool `yaml:"enabled"`
+	HopLimit int  `yaml:"hop_limit"` // これを超えるホップ数のフレームを破棄する
+	Transit  bool `yaml:"transit"`   // TAPへ書き込むフレームにタグを残す（ブリッジ先が他のデーモンのTAPのみの中継点）
+}
+
+// loopGuardはホップ数タグの付与・除去と上限超過フレームの破棄を行う
+type loopGuard struct {
+	limit   int
+	transit bool
+
+	exceeded [2]atomic.Uint64 // 方向別の上限超過で破棄した数
+	untagged atomic.Uint64    // タグなしで受信した数（対向がloop_guard無効）
+	noRoom   atomic.Uint64    // タグを挿入する余地がなく破棄した数
+}
+
+// newLoopGuard はループガード設定から生成する関数（無効ならnilを返す）
+func newLoopGuard(cfg LoopGuardConfig) (*loopGuard, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if cfg.HopLimit < 0 || cfg.HopLimit > 255 {
+		return nil, fmt.Errorf("hop_limit %d out of range (1-255)", cfg.HopLimit)
+	}
+	lg := &loopGuard{limit: loopGuardDefaultLimit, transit: cfg.Transit}
+	if cfg.HopLimit > 0 {
+		lg.limit = cfg.HopLimit
+	}
+	return lg, nil
+}
+
+// stripHopTag はフレームにホップ数タグがあれば取り除き、ホップ数（なければ0）を返す関数
+func stripHopTag(frame []byte) ([]byte, int, bool) {
+	if len(frame) < 12+hopTagLen+2 || binary.BigEndian.Uint16(frame[12:14]) != hopTagEtherType {
+		return frame, 0, false
+	}
+	hops := int(frame[14])
+	copy(frame[12:], frame[12+hopTagLen:])
+	return frame[:len(frame)-hopTagLen], hops, true
+}
+
+// insertHopTag はフレームの送信元MACの直後にホップ数タグを挿入する関数（容量不足ならfalse）
+func insertHopTag(frame []byte, hops int) ([]byte, bool) {
+	n := len(frame)
+	if n < 14 || n+hopTagLen > cap(frame) {
+		return frame, false
+	}
+	frame = frame[:n+hopTagLen]
+	copy(frame[12+hopTagLen:], frame[12:n])
+	binary.BigEndian.PutUint16(frame[12:14], hopTagEtherType)
+	frame[14], frame[15] = byte(hops), 0
+	return frame, true
+}
+
+// egress はTAPから読んだフレームのタグを取り除き、送信時のホップ数を返す（上限超過ならfalse）
+func (lg *loopGuard) egress(frame []byte) ([]byte, int, bool) {
+	frame, hops, _ := stripHopTag(frame)
+	hops++
+	if hops > lg.limit {
+		lg.exceeded[DirTX].Add(1)
+		return nil, 0, false
+	}
+	return frame, hops, true
+}
+
+// ingress はトンネルから受信したフレームのタグを取り除き、ホップ数を返す（上限超過ならfalse）
+func (lg *loopGuard) ingress(frame []byte) ([]byte, int, bool) {
+	frame, hops, tagged := stripHopTag(frame)
+	if !tagged {
+		lg.untagged.Add(1)
+		hops = 1
+	}
+	if hops > lg.limit {
+		lg.exceeded[DirRX].Add(1)
+		return nil, 0, false
+	}
+	return frame, hops, true
+}
+
+// tag はフィルタ適用後のフレームにタグを付け直す（受信時は中継点の場合のみ）
+func (lg *loopGuard) tag(dir Direction, frame []byte, hops int) ([]byte, bool) {
+	if dir == DirRX && !lg.transit {
+		return frame, true
+	}
+	frame, ok := insertHopTag(frame, hops)
+	if !ok {
+		lg.noRoom.Add(1)
+	}
+	return frame, ok
+}
+
+// Counters はループガードのカウンタを返す
+func (lg *loopGuard) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"loop_guard_tx_exceeded": lg.exceeded[DirTX].Load(),
+		"loop_guard_rx_exceeded": lg.exceeded[DirRX].Load(),
+		"loop_guard_rx_untagged": lg.untagged.Load(),
+		"loop_guard_no_room":     lg.noRoom.Load(),
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 送信元MACごとのフレームレート制限関連の定数定義
+const (
+	macLimitDefaultPenalty = 30 * time.Second
+	macLimitDefaultMax     = 65536
+	macLimitIdle           = time.Minute // この間フレームのなかった送信元MACは満杯時に削除する
+)
+
+// MACLimitConfigは送信元MACごとの毎秒フレーム数の上限と、超過したMACを一時的に遮断する設定を保持する
+type MACLimitConfig struct {
+	PPS        int    `yaml:"pps"`         // 送信元MACごとの毎秒フレーム数の上限（0で無効）
+	Burst      int    `yaml:"burst"`       // 許容するバーストのフレーム数（既定はppsと同じ）
+	Direction  string `yaml:"direction"`   // 制限する方向（tx, rx, both）
+	Penalty    string `yaml:"penalty"`     // 超過した送信元MACのフレームをすべて破棄する時間（既定30s）
+	MaxEntries int    `yaml:"max_entries"` // 追跡する送信元MACの最大数（既定65536）
+}
+
+// macLimitKeyは方向と送信元MACの組
+type macLimitKey struct {
+	dir Direction
+	mac [6]byte
+}
+
+// macLimitEntryは送信元MAC1つ分のトークンバケットと遮断状態
+type macLimitEntry struct {
+	tokens  float64
+	last    int64 // UnixNano
+	boxed   int64 // 遮断の期限(UnixNano、0で通常)
+	dropped uint64
+}
+
+// MACPenaltyは遮断中の送信元MAC（制御APIで表示する）
+type MACPenalty struct {
+	MAC          string  `json:"mac"`
+	Direction    string  `json:"direction"`
+	RemainingSec float64 `json:"remaining_seconds"`
+	Dropped      uint64  `json:"dropped"` // 今回の遮断中に破棄したフレーム数
+}
+
+// macLimiterは送信元MACごとの毎秒フレーム数を制限し、超過したMACをpenaltyの間遮断するフィルタ
+//
+// 片側の拠点の異常なホスト1台がトンネルの帯域を占有しないようにする。
+type macLimiter struct {
+	dirs    [2]bool
+	pps     float64
+	burst   float64
+	penalty time.Duration
+	max     int
+
+	mu      sync.Mutex
+	entries map[macLimitKey]*macLimitEntry
+
+	dropped atomic.Uint64 // 超過・遮断中で破棄したフレーム数
+	boxed   atomic.Uint64 // 遮断した回数
+}
+
+// newMACLimiter は設定から送信元MACごとの制限を生成する関数（無効ならnilを返す）
+func newMACLimiter(cfg MACLimitConfig) (*macLimiter, error) {
+	if cfg.PPS == 0 {
+		return nil, nil
+	}
+	if cfg.PPS < 0 || cfg.Burst < 0 || cfg.MaxEntries < 0 {
+		return nil, fmt.Errorf("pps, burst and max_entries must not be negative")
+	}
+	tx, rx, ok := parseDirections(cfg.Direction)
+	if !ok {
+		return nil, fmt.Errorf("invalid direction %q", cfg.Direction)
+	}
+	l := &macLimiter{
+		dirs:    [2]bool{DirTX: tx, DirRX: rx},
+		pps:     float64(cfg.PPS),
+		burst:   float64(cfg.PPS),
+		penalty: macLimitDefaultPenalty,
+		max:     macLimitDefaultMax,
+		entries: make(map[macLimitKey]*macLimitEntry),
+	}
+	if cfg.Burst > 0 {
+		l.burst = float64(cfg.Burst)
+	}
+	if cfg.Penalty != "" {
+		d, err := time.ParseDuration(cfg.Penalty)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid penalty %q", cfg.Penalty)
+		}
+		l.penalty = d
+	}
+	if cfg.MaxEntries > 0 {
+		l.max = cfg.MaxEntries
+	}
+	logf("[INFO]", "Per-MAC limit: %d frames/s (burst %.0f, penalty %v)", cfg.PPS, l.burst, l.penalty)
+	return l, nil
+}
+
+// entry は送信元MACの状態を返す関数（l.muを保持して呼ぶ、満杯で追跡できなければnil）
+func (l *macLimiter) entry(key macLimitKey, now int64) *macLimitEntry {
+	if e, ok := l.entries[key]; ok {
+		return e
+	}
+	if len(l.entries) >= l.max {
+		for k, e := range l.entries {
+			if e.boxed == 0 && time.Duration(now-e.last) >= macLimitIdle {
+				delete(l.entries, k)
+			}
+		}
+		if len(l.entries) >= l.max {
+			return nil
+		}
+	}
+	e := &macLimitEntry{tokens: l.burst, last: now}
+	l.entries[key] = e
+	return e
+}
+
+// Filter は送信元MACごとのトークンバケットを消費し、超過したMACを遮断する
+func (l *macLimiter) Filter(dir Direction, frame []byte) ([]byte, Verdict) {
+	if !l.dirs[dir] || len(frame) < 14 || frame[6]&0x01 != 0 {
+		return frame, VerdictPass
+	}
+	key := macLimitKey{dir: dir}
+	copy(key.mac[:], frame[6:12])
+	now := time.Now().UnixNano()
+
+	l.mu.Lock()
+	e := l.entry(key, now)
+	if e == nil {
+		l.mu.Unlock()
+		return frame, VerdictPass
+	}
+	if e.boxed != 0 {
+		if now < e.boxed {
+			e.dropped++
+			l.mu.Unlock()
+			l.dropped.Add(1)
+			return nil, VerdictDrop
+		}
+		// 遮断の期限が過ぎたらバケットを満たして再開する
+		e.boxed, e.dropped, e.tokens = 0, 0, l.burst
+		logf("[INFO]", "Per-MAC limit: %s (%s) released", net.HardwareAddr(key.mac[:]), dir)
+	}
+	e.tokens = min(l.burst, e.tokens+float64(now-e.last)/float64(time.Second)*l.pps)
+	e.last = now
+	if e.tokens >= 1 {
+		e.tokens--
+		l.mu.Unlock()
+		return frame, VerdictPass
+	}
+	if l.penalty > 0 {
+		e.boxed = now + int64(l.penalty)
+		e.dropped = 1
+	}
+	l.mu.Unlock()
+
+	l.dropped.Add(1)
+	if l.penalty > 0 {
+		l.boxed.Add(1)
+		logf("[WARN]", "Per-MAC limit: %s (%s) exceeded %.0f frames/s, blocked for %v", net.HardwareAddr(key.mac[:]), dir, l.pps, l.penalty)
+	}
+	return nil, VerdictDrop
+}
+
+// Penalties は遮断中の送信元MACの一覧を返す
+func (l *macLimiter) Penalties() []MACPenalty {
+	now := time.Now().UnixNano()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := []MACPenalty{}
+	for key, e := range l.entries {
+		if e.boxed == 0 || now >= e.boxed {
+			continue
+		}
+		list = append(list, MACPenalty{
+			MAC:          net.HardwareAddr(key.mac[:]).String(),
+			Direction:    key.dir.String(),
+			RemainingSec: time.Duration(e.boxed - now).Seconds(),
+			Dropped:      e.dropped,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].MAC < list[j].MAC })
+	return list
+}
+
+// release は送信元MACの遮断を解除する関数（遮断中でなければfalse）
+func (l *macLimiter) release(mac net.HardwareAddr) bool {
+	if len(mac) != 6 {
+		return false
+	}
+	released := false
+	l.mu.Lock()
+	for _, dir := range []Direction{DirTX, DirRX} {
+		key := macLimitKey{dir: dir}
+		copy(key.mac[:], mac)
+		if e, ok := l.entries[key]; ok && e.boxed != 0 {
+			e.boxed, e.dropped, e.tokens = 0, 0, l.burst
+			released = true
+		}
+	}
+	l.mu.Unlock()
+	if released {
+		logf("[INFO]", "Per-MAC limit: %s released via API", mac)
+	}
+	return released
+}
+
+// Counters は破棄数・遮断回数・遮断中の送信元MACの数を返す
+func (l *macLimiter) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"mac_limit_dropped": l.dropped.Load(),
+		"mac_limit_boxed":   l.boxed.Load(),
+		"mac_limit_active":  uint64(len(l.Penalties())),
+	}
+}
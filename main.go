@@ -2,28 +2,27 @@ package main
 
 import (
 	"bytes"
+	"etherip/header"
 	"flag"
 	"fmt"
 	"github.com/songgao/water"
 	"gopkg.in/yaml.v3"
+	"io"
 	"net"
 	"os"
-	"os/exec"
+	"os/signal"
 	"runtime"
+	"slices"
 	"sync"
-	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 // 定数定義
 const (
 	etherIPProto     = 97               // EtherIPのプロトコル番号（RFC3378準拠）
-	bufferSize       = 131070           // バッファサイズ
+	bufferSize       = 131070           // バッファサイズの上限（buffers.size）
 	retryOnFailDelay = 30 * time.Second // DNS解決失敗時の再試行間隔
-	sendWorkerCount  = 4                // 送信goroutine数
-	recvWorkerCount  = 4                // 受信goroutine数
-	sendChanSize     = 100              // 送信チャネルバッファサイズ
-	recvChanSize     = 100              // 受信チャネルバッファサイズ
 )
 
 // ログ出力用のカラーコード定義
@@ -33,15 +32,31 @@ var colors = map[string]string{
 	"[ERROR]":  "\033[31m", // 赤
 	"[UPDATE]": "\033[32m", // 緑
 	"[RESET]":  "\033[35m", // 紫
+	"[TRACE]":  "\033[36m", // 水色
+	"[DEBUG]":  "\033[90m", // 灰色
 }
 
-// logf はカラー付きのログ出力を行う
+// logOutput はログの出力先（JSONを標準出力へ書くサブコマンドでは標準エラー出力に切り替える）
+var logOutput io.Writer = os.Stdout
+
+// logf はカラー付きのログ出力を行う（log.levelより詳細なタグは出力しない）
 func logf(tag, format string, a ...interface{}) {
+	if tagLevel(tag) < logState.level.Load() {
+		return
+	}
+	writeLog(tag, fmt.Sprintf(msg(format), a...))
+}
+
+// writeLog はレベルによらず1行（または複数行）のログを出力する関数
+func writeLog(tag, msg string) {
 	color, ok := colors[tag]
 	if !ok {
 		color = "\033[0m"
 	}
-	fmt.Printf("%s%s %s\033[0m\n", color, tag, fmt.Sprintf(format, a...))
+	if logLabels != "" {
+		msg = logLabels + " " + msg
+	}
+	fmt.Fprintf(logOutput, "%s%s %s\033[0m\n", color, tag, msg)
 }
 
 // Configは設定ファイルから読み取る情報を保持する
@@ -49,10 +64,145 @@ type Config struct {
 	Version         int    `yaml:"version"`          // IPv4 or IPv6 (4 or 6)
 	TapName         string `yaml:"tap_name"`         // TAPインターフェース名
 	BrName          string `yaml:"br_name"`          // ブリッジ名（"off"で無効）
+	IfMode          string `yaml:"ifmode"`           // インターフェースモード（tap: Ethernetフレーム, tun: IPパケット）
 	MTU             int    `yaml:"mtu"`              // MTUサイズ
 	SrcIface        string `yaml:"src_iface"`        // 送信元インターフェース名
 	DstHost         string `yaml:"dst_host"`         // 送信先ホスト名またはIP
 	ResolveInterval string `yaml:"resolve_interval"` // DNS再解決間隔
+
+	SrcIP        []string `yaml:"src_ip"`         // 送信元IPアドレス（アドレスファミリごとに1つ、省略時はsrc_ifaceから自動選択）
+	SrcLinkLocal bool     `yaml:"src_link_local"` // 自動選択でIPv6リンクローカルアドレスも候補にする
+	BindDevice   bool     `yaml:"bind_device"`    // RAWソケットをsrc_ifaceにバインドする（SO_BINDTODEVICE）
+	SrcAuto      bool     `yaml:"src_auto"`       // 送信元を宛先ごとにカーネルの経路選択に任せる（src_iface不要）
+
+	Underlay string `yaml:"underlay"` // src_ifaceの種類（auto, plain, wireguard, ipsec）、WireGuard・IPsec上ではTAPのMTUを自動で下げる
+
+	Peers []string `yaml:"peers"` // マルチポイント時の追加ピア（ホスト名またはIP）
+
+	Standby StandbyConfig `yaml:"standby"` // dst_hostの予備の宛先（アクティブ・スタンバイ）
+
+	HostRoute HostRouteConfig `yaml:"host_route"` // ピアの宛先へのホスト経路の固定
+
+	Iperf IperfConfig `yaml:"iperf"` // オーバーレイ上のiperf3応答機能
+
+	RecursionCheck string `yaml:"recursion_check"` // 宛先への経路がTAP・ブリッジを向いていないかの確認間隔（"off"で無効）
+
+	Tunnels []yaml.Node `yaml:"tunnels"` // 複数トンネル（各要素はトップレベルの設定を上書き）
+
+	Bridge BridgeConfig `yaml:"bridge"` // br_nameのブリッジの自動作成と終了時の後片付け
+
+	WaitForBridge bool        `yaml:"wait_for_bridge"` // br_nameのブリッジが他のサービスに作成されるまで待ってから参加する
+	Setup         SetupConfig `yaml:"setup"`           // TAP・ブリッジの設定に失敗した時の再試行
+
+	DualStack         bool   `yaml:"dual_stack"`         // デュアルスタック（versionを優先ファミリとして両方使用）
+	KeepaliveInterval string `yaml:"keepalive_interval"` // キープアライブ送信間隔（"off"で無効）
+	KeepaliveTimeout  string `yaml:"keepalive_timeout"`  // 応答がない場合に経路断と判定するまでの時間
+
+	KeepaliveAdaptive string `yaml:"keepalive_adaptive"` // 通信中に緩めるキープアライブ送信間隔の上限（空で無効）
+
+	Migration MigrationConfig `yaml:"migration"` // dst_hostへのファミリごとの宛先（IPv4・IPv6間の移行用、dual_stackを有効にする）
+
+	WasmPlugins []WasmPluginConfig `yaml:"wasm_plugins"` // WASMポリシープラグイン（記載順に適用）
+	Tee         TeeConfig          `yaml:"tee"`          // 外部プロセスへのフレーム複製
+	Mirror      MirrorConfig       `yaml:"mirror"`       // 遠隔のコレクタへのフレーム複製（ERSPAN・EtherIP）
+	RateLimit   RateLimitConfig    `yaml:"rate_limit"`   // 帯域制限
+	NFQueue     NFQueueConfig      `yaml:"nfqueue"`      // NFQUEUEによる検査フック
+	VLANFilter  VLANFilterConfig   `yaml:"vlan_filter"`  // VLANによるフレーム選別
+
+	MartianFilter MartianFilterConfig `yaml:"martian_filter"` // 不正な送信元アドレスの内側IPパケットの破棄
+
+	LinkSpeed string `yaml:"link_speed"` // TAPのethtoolの速度（auto: rate_limitの帯域、k/M/G接尾辞可、空で変更しない）
+
+	ACL ACLConfig `yaml:"acl"` // MAC・EtherType・VLAN・内側IPのアドレス範囲による内側フレームの許可・破棄
+
+	StormControl StormControlConfig `yaml:"storm_control"` // ブロードキャスト・マルチキャスト・未知ユニキャストの毎秒フレーム数の上限
+
+	MACLimit MACLimitConfig `yaml:"mac_limit"` // 送信元MACごとの毎秒フレーム数の上限と超過したMACの一時遮断
+
+	LoopDetect LoopDetectConfig `yaml:"loop_detect"` // TAPとブリッジ先のLANを通るループの検出と遮断
+
+	NDProxy NDProxyConfig `yaml:"nd_proxy"` // トンネル越しの近隣広告のキャッシュとローカルの近隣要請への代理応答
+
+	LocalDelivery LocalDeliveryConfig `yaml:"local_delivery"` // TAP自身のMAC宛てフレームを管理用TAPへ渡す（ブリッジ停止中の管理アクセス用）
+
+	APIListen   string    `yaml:"api_listen"`   // 制御APIの待ち受けアドレス（"unix:/path"可、空で無効）
+	DebugListen string    `yaml:"debug_listen"` // pprof・expvar・キュー状態の待ち受けアドレス（空で無効）
+	SLA         SLAConfig `yaml:"sla"`          // SLAレポート
+	FDB         FDBConfig `yaml:"fdb"`          // マルチポイント時のMAC学習テーブル
+
+	Stats StatsConfig `yaml:"stats"` // 転送統計の定期集計・ログ・ファイル出力
+
+	History HistoryConfig `yaml:"history"` // 分単位の転送統計を組み込みDBへ保存（トップレベルのみ、制御APIの/historyで参照）
+
+	Update UpdateConfig `yaml:"update"` // 署名付きリリースによる自己更新（トップレベルのみ）
+
+	ControlTrace ControlTraceConfig `yaml:"control_trace"` // 経路の判定への入力と結果の記録（トップレベルのみ、replay -controlで再生）
+
+	Health HealthConfig `yaml:"health"` // オーケストレータ向けの/healthz・/readyz
+
+	RunAsUser  string `yaml:"run_as_user"`  // 起動処理の完了後に切り替える実行ユーザー（空でrootのまま）
+	RunAsGroup string `yaml:"run_as_group"` // 実行グループ（省略時はユーザーのプライマリグループ）
+
+	PIDFile string `yaml:"pid_file"` // PIDファイル（flockで排他、同じディレクトリにTAP名ごとのロックも置く、空で無効）
+
+	Sysctl SysctlConfig `yaml:"sysctl"` // 起動時に設定し終了時に戻すカーネルパラメータ（バッファ・バックログ）
+
+	Log LogConfig `yaml:"log"` // ログレベルとサブシステムごとのDEBUGログ（実行中は制御APIで変更可能）
+
+	Tenant    string            `yaml:"tenant"`     // トンネルの所有者ラベル（API・イベント・メトリクスに付与）
+	Labels    map[string]string `yaml:"labels"`     // 運用者が定義する固定ラベル（site, region等、ログ・メトリクス・イベント・フローに付与）
+	Domain    string            `yaml:"domain"`     // 所属するブロードキャストドメイン（空ならbr_name、off時はtap_name。API・メトリクスで集計）
+	APITokens []APIToken        `yaml:"api_tokens"` // 制御APIのトークン（空で認証なし）
+
+	Cluster ClusterConfig `yaml:"cluster"` // 別ホストのデーモンとのアクティブ・スタンバイ構成
+
+	DNS      DNSConfig       `yaml:"dns"`      // 宛先の名前解決
+	PMTUD    PMTUDConfig     `yaml:"pmtud"`    // Path MTU探索
+	Oversize OversizeConfig  `yaml:"oversize"` // TAPのフレームが外側の経路MTUを超える場合の扱い（DF・IPフラグメント・破棄・分割）
+	Canary   CanaryConfig    `yaml:"canary"`   // カナリアフレームによる転送経路の完全性検査
+	Silence  SilenceConfig   `yaml:"silence"`  // ピアから何も受信しない状態が続いた場合の対処
+	STPCost  STPCostConfig   `yaml:"stp_cost"` // 遅延・損失に応じたブリッジポートのコスト調整
+	EVPN     EVPNConfig      `yaml:"evpn"`     // BGP EVPNによるMACアドレスの広告・学習
+	FDBSync  FDBSyncConfig   `yaml:"fdb_sync"` // ブリッジで学習したMACアドレスの対向との交換
+	Alerts   AlertConfig     `yaml:"alerts"`   // しきい値アラート
+	Webhooks []WebhookConfig `yaml:"webhooks"` // ライフサイクルイベントの送信先
+	MQTT     MQTTConfig      `yaml:"mqtt"`     // MQTTブローカーへのステータス発行
+
+	Discovery DiscoveryConfig `yaml:"discovery"` // 宛先をConsul・etcd・DNS-SDから引く（dst_host: consul://サービス名 等）
+
+	RouteHealth RouteHealthConfig `yaml:"route_health"` // ルーティングデーモンの経路取り消しによるフェイルオーバー
+
+	RxValidation RxValidationConfig `yaml:"rx_validation"` // TAPへ書き込む前の内側フレームの長さ・EtherType・チェックサムの検証
+
+	OuterHopLimit OuterHopLimitConfig `yaml:"outer_hop_limit"` // 外側パケットの送信時のTTL・ホップリミットと受信時の下限
+
+	ConnectedSocket bool `yaml:"connected_socket"` // 経路ごとに宛先へ接続したRAWソケットで送信する（パケットごとの経路検索を省く）
+
+	HeaderMode  string            `yaml:"header_mode"` // 受信ヘッダの検証（strict: RFC 3378準拠, lenient: Reservedを無視）
+	Workers     WorkerConfig      `yaml:"workers"`     // 転送ワーカー数・キュー長・CPU固定
+	Buffers     BufferConfig      `yaml:"buffers"`     // 送受信バッファの大きさ・確保数とキューが満杯のときの動作
+	Datapath    string            `yaml:"datapath"`    // 外側パケットの受信方式（standard, af_packet）
+	Encap       string            `yaml:"encap"`       // カプセル化（etherip, gretap, l2tpv3）
+	GRE         GREConfig         `yaml:"gre"`         // encap: gretap時のGREキー
+	L2TPv3      L2TPv3Config      `yaml:"l2tpv3"`      // encap: l2tpv3時の静的セッション
+	Compression CompressionConfig `yaml:"compression"` // ペイロード圧縮
+	Auth        AuthConfig        `yaml:"auth"`        // 事前共有鍵によるペイロード認証
+	Sequence    SequenceConfig    `yaml:"sequence"`    // シーケンス番号による重複・順序入れ替わり・リプレイの検出
+	Roaming     bool              `yaml:"roaming"`     // 認証済みパケットの送信元アドレスへ宛先を追従させる（単一ピア・auth必須）
+	Allowlist   AllowlistConfig   `yaml:"allowlist"`   // 宛先のアドレス以外に受け入れる外側パケットの送信元（CIDR・DNSラウンドロビンの全レコード）
+	Negotiate   string            `yaml:"negotiate"`   // ハンドシェイクで交換した能力の照合（off, warn, strict、空でoff）
+	QoS         QoSConfig         `yaml:"qos"`         // 外側ヘッダのDSCP・IPv6フローラベル
+	LoopGuard   LoopGuardConfig   `yaml:"loop_guard"`  // デーモン間中継のホップ数制限
+	Telemetry   TelemetryConfig   `yaml:"telemetry"`   // 観測機能の有効化・サンプリング
+	Capture     CaptureConfig     `yaml:"capture"`     // 制御APIから開始するパケットキャプチャ
+
+	ECN ECNConfig `yaml:"ecn"` // 送信キューが溜まったときの内側IPパケットへのECN CEマーク
+
+	Offload OffloadConfig `yaml:"offload"` // eBPF（tc）によるカーネル内でのカプセル化・カプセル化解除
+
+	ManageFirewall bool `yaml:"manage_firewall"` // ピアからの外側パケットの許可とICMPエラー抑止のnftablesルールを設定・終了時に削除
+
+	legacy bool // tunnelsを使わない旧形式の設定から読み込んだ
 }
 
 // Packetはパケットデータを格納するための構造体
@@ -60,178 +210,1009 @@ type Packet struct {
 	Data   []byte
 	Offset int
 	Length int
-	Pool   *sync.Pool
+	Pool   *bufferPool
+	Peer   *Peer // 受信元ピア（受信時のみ）
+	Comp   byte  // 圧縮方式（受信時のみ、0は非圧縮）
 }
 
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	configPath := "config.yaml"
+	// 環境変数による設定の上書きはサブコマンドにも適用する
+	loadEnvOverrides()
+
+	// サブコマンド
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check":
+			os.Exit(runCheck(os.Args[2:]))
+		case "init":
+			os.Exit(runInit(os.Args[2:]))
+		case "migrate":
+			os.Exit(runMigrate(os.Args[2:]))
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		case "status":
+			os.Exit(runStatus(os.Args[2:]))
+		case "trace":
+			os.Exit(runTrace(os.Args[2:]))
+		case "log":
+			os.Exit(runLog(os.Args[2:]))
+		case "version":
+			os.Exit(runVersion(os.Args[2:]))
+		case "update":
+			os.Exit(runUpdate(os.Args[2:]))
+		case "bench":
+			os.Exit(runBench(os.Args[2:]))
+		}
+	}
+
+	defaultPath := "config.yaml"
+	if v := os.Getenv("ETHERIP_CONFIG"); v != "" {
+		defaultPath = v
+	}
+	configPath := flag.String("config", defaultPath, "設定ファイルのパス（環境変数 ETHERIP_CONFIG でも指定可）")
+	dryRun := flag.Bool("dry-run", false, "設定を検証し、実行予定のインターフェース操作を表示して終了する")
+	simulate := flag.String("simulate", "", "root権限なしで各トンネルと対向をメモリ上で接続して動かし、TAPの入出力をこのディレクトリのpcap・Unixソケットで行う")
+	registerOverrideFlags(flag.CommandLine)
 	flag.Parse()
 
-	cfg, err := loadConfig(configPath)
+	cfgs, err := loadConfigs(*configPath)
 	if err != nil {
 		logf("[ERROR]", "Failed to load config: %v", err)
 		os.Exit(1)
 	}
+	if *dryRun {
+		os.Exit(printDryRun(cfgs))
+	}
 
-	interval, err := time.ParseDuration(cfg.ResolveInterval)
-	if err != nil {
-		logf("[ERROR]", "Invalid resolve_interval: %v", err)
+	// DNS・制御APIはトップレベルの設定を全トンネルで共有する
+	global := cfgs[0]
+	if err := applyLogConfig(global.Log); err != nil {
+		logf("[ERROR]", "Invalid log setting: %v", err)
 		os.Exit(1)
 	}
-
-	// TAPインターフェース作成
-	ifce, err := water.New(water.Config{DeviceType: water.TAP})
-	if err != nil {
-		logf("[ERROR]", "TAP create: %v", err)
+	if err := applyCatalog(global.Log); err != nil {
+		logf("[ERROR]", "Invalid log setting: %v", err)
+		os.Exit(1)
+	}
+	if err := applyLogLabels(global.Labels); err != nil {
+		logf("[ERROR]", "Invalid labels: %v", err)
+		os.Exit(1)
+	}
+	// 無停止の再起動で起動した場合は、引き継ぎ元からTAP・ソケット等を受け取る
+	if err := inheritHandover(); err != nil {
+		logf("[ERROR]", "Handover: %v", err)
+		os.Exit(1)
+	}
+	if *simulate != "" {
+		if cfgs, err = startSimulation(*simulate, cfgs); err != nil {
+			logf("[ERROR]", "Simulation: %v", err)
+			os.Exit(1)
+		}
+	}
+	if global.PIDFile != "" {
+		if err := lockInstance(global.PIDFile, cfgs); err != nil {
+			logf("[ERROR]", "Another instance is running: %v", err)
+			runCleanups()
+			os.Exit(1)
+		}
+	}
+	// ソケットを作る前にバッファの既定値等を設定する
+	if err := applySysctl(global.Sysctl); err != nil {
+		logf("[ERROR]", "sysctl: %v", err)
+		runCleanups()
+		os.Exit(1)
+	}
+	if err := initDNS(global.DNS); err != nil {
+		logf("[ERROR]", "Invalid dns setting: %v", err)
 		os.Exit(1)
 	}
-	defer ifce.Close()
+	if err := initDiscovery(global.Discovery); err != nil {
+		logf("[ERROR]", "Invalid discovery setting: %v", err)
+		os.Exit(1)
+	}
+	if global.Cluster.enabled() {
+		// RAWソケットをvipで開き、パケットを送る前にスタンバイとして起動する
+		if cluster, err = newClusterNode(global); err != nil {
+			logf("[ERROR]", "Cluster: %v", err)
+			runCleanups()
+			os.Exit(1)
+		}
+	}
 
-	actualName := ifce.Name()
+	if err := startControlTrace(global.ControlTrace); err != nil {
+		logf("[ERROR]", "Control trace: %v", err)
+		runCleanups()
+		os.Exit(1)
+	}
+	if err := startOTLP(); err != nil {
+		logf("[ERROR]", "OpenTelemetry: %v", err)
+		runCleanups()
+		os.Exit(1)
+	}
 
-	// 目的のTAPインターフェース名が既に存在している場合の対処
-	if actualName != cfg.TapName {
-		if ifaceExists(cfg.TapName) {
-			logf("[ERROR]", "TAP interface name '%s' already exists. Choose a different name or remove the existing interface.", cfg.TapName)
+	var tunnels []*Tunnel
+	for _, cfg := range cfgs {
+		tun, err := startTunnel(cfg, len(cfgs) > 1)
+		if err != nil {
+			logf("[ERROR]", "Tunnel %s: %v", cfg.TapName, err)
+			runCleanups()
 			os.Exit(1)
 		}
-
-		// インターフェースの名前変更を実行
-		if err := renameInterface(actualName, cfg.TapName); err != nil {
-			logf("[ERROR]", "Rename TAP: %v", err)
+		tunnels = append(tunnels, tun)
+	}
+	restoreHandoverSeq(tunnels)
+	isolateTunnels(tunnels)
+	cluster.run(tunnels)
+	// 鍵はロック済みのメモリへ移したため、設定に残る文字列を消す
+	wipeConfigKeys(cfgs)
+	runningConfigs = cfgs
+	// 統計履歴のDBは引き継ぎ元が閉じるまで開けないため、無停止の再起動では引き継ぎ元の終了後に開く
+	afterHandover(func() {
+		if err := startHistory(global.History, tunnels); err != nil {
+			logf("[ERROR]", "Stats history: %v", err)
+			runCleanups()
 			os.Exit(1)
 		}
+	})
+	otlp.watch(tunnels)
+
+	// SIGHUP受信時に設定ファイルを読み直して差分をログ出力
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGHUP)
+		for range sig {
+			reloadConfig(*configPath)
+		}
+	}()
+
+	// SIGUSR1受信時にカウンタをログ出力
+	if countersSignal != nil {
+		go func() {
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, countersSignal)
+			for range sig {
+				for _, tun := range tunnels {
+					tun.logCounters()
+				}
+			}
+		}()
 	}
 
-	if err := linkUp(cfg.TapName); err != nil {
-		logf("[ERROR]", "TAP UP: %v", err)
-		os.Exit(1)
+	// SIGUSR2受信時に置き換えられたバイナリへTAP・ソケットを引き継いで再起動（権限を落とした後は新しいプロセスがインターフェースを設定できないため無視）
+	if restartSignal != nil {
+		go func() {
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, restartSignal)
+			for range sig {
+				if global.RunAsUser != "" {
+					logf("[WARN]", "Ignoring SIGUSR2: cannot restart after dropping privileges to %s; restart from the service manager", global.RunAsUser)
+					continue
+				}
+				restartSelf("SIGUSR2", tunnels)
+			}
+		}()
 	}
 
-	if err := setTAPMTU(cfg.TapName, cfg.MTU); err != nil {
-		logf("[ERROR]", "MTU: %v", err)
+	// 定期的な更新の確認
+	if key, interval, err := parseUpdateConfig(global.Update); err != nil {
+		logf("[ERROR]", "update: %v", err)
+		runCleanups()
 		os.Exit(1)
+	} else if err := checkUnattendedUpdate(global); err != nil {
+		logf("[ERROR]", "update: %v", err)
+		runCleanups()
+		os.Exit(1)
+	} else if interval > 0 {
+		go runUpdateChecks(global.Update, key, interval, tunnels)
 	}
 
-	// ブリッジへの自動参加処理
-	if cfg.BrName != "off" {
-		if err := addToBridge(cfg.TapName, cfg.BrName); err != nil {
-			logf("[ERROR]", "Failed to add %s to bridge %s: %v", cfg.TapName, cfg.BrName, err)
+	// 終了シグナル受信時に後片付けを行って終了
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		s := <-sig
+		logf("[INFO]", "Received %v, shutting down", s)
+		runCleanups()
+		os.Exit(0)
+	}()
+
+	// 制御API
+	if global.APIListen != "" {
+		if err := startAPI(global.APIListen, global.APITokens, tunnels); err != nil {
+			runCleanups()
 			os.Exit(1)
 		}
-		logf("[INFO]", "TAP interface %s joined bridge %s", cfg.TapName, cfg.BrName)
 	}
+	if global.DebugListen != "" {
+		if err := startDebug(global.DebugListen, tunnels); err != nil {
+			runCleanups()
+			os.Exit(1)
+		}
+	}
+	if global.Health.Listen != "" {
+		if err := startHealth(global.Health, tunnels); err != nil {
+			runCleanups()
+			os.Exit(1)
+		}
+	}
+
+	// TAP・ソケット・インターフェース設定が済んだら権限を落とす
+	if global.RunAsUser != "" {
+		if err := dropPrivileges(global.RunAsUser, global.RunAsGroup); err != nil {
+			logf("[ERROR]", "Failed to drop privileges: %v", err)
+			runCleanups()
+			os.Exit(1)
+		}
+	}
+
+	for _, tun := range tunnels {
+		tun.events.emit("up", "", "tunnel started")
+		if tun.cfg.legacy {
+			logf("[WARN]", "%s", legacyConfigMessage)
+			tun.events.emit("deprecated", "", legacyConfigMessage)
+		}
+	}
+	registerShutdown(func() {
+		for _, tun := range tunnels {
+			tun.events.emit("down", "", "tunnel stopped")
+		}
+		waitEvents(eventDrainTimeout)
+	})
+
+	// メインスレッドは終了せず、全トンネルのワーカー終了待ち（永続）
+	var wg sync.WaitGroup
+	for _, tun := range tunnels {
+		wg.Add(1)
+		go func(tun *Tunnel) {
+			defer wg.Done()
+			tun.Run()
+		}(tun)
+	}
+	// 無停止の再起動では転送を始めたことを引き継ぎ元へ知らせ（引き継ぎ元はこれを受けて終了する）、
+	// それ以外はサービスマネージャ（systemdのType=notify）へ起動の完了を知らせる
+	if inherited != nil {
+		completeHandover()
+	} else {
+		sdNotify("READY=1")
+	}
+	wg.Wait()
+}
 
-	srcIP, err := getInterfaceIP(cfg.SrcIface, cfg.Version)
+// startTunnel はトンネル1本分のTAP・ソケット・ピアを準備し、監視系goroutineを起動する関数
+//
+// sharedは同一プロセスで複数のトンネルを動かす場合にtrueとする。
+func startTunnel(cfg *Config, shared bool) (*Tunnel, error) {
+	interval, err := time.ParseDuration(cfg.ResolveInterval)
 	if err != nil {
-		logf("[ERROR]", "Source IP: %v", err)
-		os.Exit(1)
+		logf("[ERROR]", "Invalid resolve_interval: %v", err)
+		return nil, err
 	}
 
-	dstIPVal := atomic.Value{}
-	firstDst, err := resolveDst(cfg.DstHost, cfg.Version)
+	keepaliveInterval, keepaliveTimeout, err := parseKeepalive(cfg)
 	if err != nil {
-		logf("[ERROR]", "Resolve %s: %v", cfg.DstHost, err)
-		os.Exit(1)
+		logf("[ERROR]", "Invalid keepalive setting: %v", err)
+		return nil, err
+	}
+	keepaliveMax, err := parseKeepaliveAdaptive(cfg, keepaliveInterval)
+	if err != nil {
+		logf("[ERROR]", "Invalid keepalive setting: %v", err)
+		return nil, err
+	}
+	failback, err := parseFailbackDelay(cfg.Standby)
+	if err != nil {
+		logf("[ERROR]", "Invalid standby setting: %v", err)
+		return nil, err
+	}
+	if len(cfg.Standby.Hosts) > 0 && keepaliveInterval == 0 {
+		logf("[ERROR]", "standby requires keepalive_interval")
+		return nil, fmt.Errorf("standby requires keepalive_interval")
+	}
+	if err := checkLocalDelivery(cfg); err != nil {
+		logf("[ERROR]", "local_delivery: %v", err)
+		return nil, err
+	}
+	if err := checkEncap(cfg); err != nil {
+		logf("[ERROR]", "encap: %v", err)
+		return nil, err
+	}
+	if cfg.SrcAuto {
+		if err := checkSrcAuto(cfg); err != nil {
+			logf("[ERROR]", "src_auto: %v", err)
+			return nil, err
+		}
+	}
+	if cfg.Migration.enabled() {
+		if err := checkMigration(cfg); err != nil {
+			logf("[ERROR]", "migration: %v", err)
+			return nil, err
+		}
+	}
+	if err := checkIfMode(cfg); err != nil {
+		logf("[ERROR]", "ifmode: %v", err)
+		return nil, err
+	}
+	if err := validateLabels(cfg.Labels); err != nil {
+		logf("[ERROR]", "labels: %v", err)
+		return nil, err
+	}
+	if cfg.Roaming && (!cfg.Auth.Enabled || len(cfg.peerHosts()) > 1 || len(cfg.Standby.Hosts) > 0) {
+		logf("[ERROR]", "roaming requires auth and a single peer without standby")
+		return nil, fmt.Errorf("roaming requires auth and a single peer without standby")
 	}
-	dstIPVal.Store(firstDst)
 
-	// 宛先の定期的なDNS再解決処理開始goroutine
-	go startDynamicResolver(cfg.DstHost, cfg.Version, interval, &dstIPVal)
+	workers, err := resolveWorkers(cfg.Workers)
+	if err != nil {
+		logf("[ERROR]", "Invalid workers setting: %v", err)
+		return nil, err
+	}
+	buffers, err := resolveBuffers(cfg.Buffers, cfg.MTU)
+	if err != nil {
+		logf("[ERROR]", "Invalid buffers setting: %v", err)
+		return nil, err
+	}
 
-	proto := fmt.Sprintf("ip%d:%d", cfg.Version, etherIPProto)
-	rawConn, err := net.ListenIP(proto, &net.IPAddr{IP: srcIP})
+	if _, err := applyUnderlay(cfg); err != nil {
+		logf("[ERROR]", "Invalid underlay: %v", err)
+		return nil, err
+	}
+
+	setup, err := parseSetup(cfg)
 	if err != nil {
-		logf("[ERROR]", "RAW socket: %v", err)
-		os.Exit(1)
+		logf("[ERROR]", "Invalid setup setting: %v", err)
+		return nil, err
 	}
-	defer rawConn.Close()
 
-	logf("[INFO]", "EtherIP Tunnel started")
-	logf("[INFO]", "TAP: %s | MTU: %d", cfg.TapName, cfg.MTU)
-	logf("[INFO]", "SRC: %s (%s) → DST: %s (%s)", srcIP, cfg.SrcIface, firstDst, cfg.DstHost)
+	events := newEventSink(cfg)
 
-	sendPool := &sync.Pool{New: func() interface{} { return make([]byte, bufferSize) }}
-	recvPool := &sync.Pool{New: func() interface{} { return make([]byte, bufferSize) }}
+	// TAPインターフェース作成（ifmode: tunならTUN）
+	devType, err := parseIfMode(cfg.IfMode)
+	if err != nil {
+		logf("[ERROR]", "Invalid ifmode: %v", err)
+		return nil, err
+	}
+	var ifce *water.Interface
+	if simulation != nil {
+		ifce, err = simulation.tap(cfg)
+	} else {
+		ifce, err = openTAP(cfg, setup, devType)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	// 送信/受信用チャネル
-	sendChan := make(chan Packet, sendChanSize)
-	recvChan := make(chan Packet, recvChanSize)
+	// 監視がifSpeedから使用率を計算できるよう、TAPの速度を帯域制限に合わせる（未対応のカーネルでは警告のみ）
+	linkSpeed, err := applyLinkSpeed(cfg)
+	if err != nil {
+		if linkSpeed == 0 {
+			logf("[ERROR]", "Invalid link_speed: %v", err)
+			return nil, err
+		}
+		logf("[WARN]", "Could not set the link speed of %s (reported via the API only): %v", cfg.TapName, err)
+	}
 
-	// TAPから読み取り、送信チャネルへ送る
-	go func() {
-		for {
-			buf := sendPool.Get().([]byte)
-			n, err := ifce.Read(buf)
-			if err != nil {
-				logf("[ERROR]", "TAP read: %v", err)
-				sendPool.Put(buf)
-				continue
-			}
-			sendChan <- Packet{buf, 0, n, sendPool}
+	// NFQUEUEによる検査フック（bridgeファミリのため自動ブリッジ参加が前提）
+	if cfg.NFQueue.Num > 0 {
+		if cfg.BrName == "off" {
+			logf("[ERROR]", "nfqueue requires br_name to be set")
+			return nil, fmt.Errorf("nfqueue requires br_name")
 		}
-	}()
+		if err := installNFQueue(cfg.TapName, cfg.NFQueue); err != nil {
+			logf("[ERROR]", "NFQUEUE: %v", err)
+			return nil, err
+		}
+		registerShutdown(func() { removeNFQueue(cfg.TapName) })
+	}
 
-	// RAWソケットから受信チャネルへ送る
-	go func() {
-		for {
-			buf := recvPool.Get().([]byte)
-			n, _, err := rawConn.ReadFrom(buf)
-			if err != nil || n < 2 || buf[0]>>4 != 3 || buf[0]&0x0F != 0 || buf[1] != 0 {
-				recvPool.Put(buf)
-				continue
+	if len(cfg.peerHosts()) == 0 {
+		logf("[ERROR]", "dst_host is not specified")
+		return nil, fmt.Errorf("dst_host is not specified")
+	}
+
+	// 使用するアドレスファミリごとにRAWソケットを準備（先頭が優先ファミリ）
+	versions := []int{cfg.Version}
+	if cfg.DualStack {
+		versions = append(versions, otherVersion(cfg.Version))
+	}
+
+	var socks []*Socket
+	for _, v := range versions {
+		var sock *Socket
+		if simulation != nil {
+			sock, err = simulation.socket(cfg, v)
+		} else {
+			sock, err = openSocket(cfg, v)
+		}
+		if err != nil {
+			if !cfg.DualStack {
+				logf("[ERROR]", "IPv%d socket: %v", v, err)
+				return nil, err
 			}
-			recvChan <- Packet{buf, 2, n - 2, recvPool}
+			logf("[WARN]", "IPv%d unavailable on %s, skipping: %v", v, cfg.SrcIface, err)
+			continue
 		}
-	}()
+		if sock.Conn != nil {
+			registerCleanup(func() { sock.Conn.Close() })
+		}
+		socks = append(socks, sock)
+	}
+	if len(socks) == 0 {
+		logf("[ERROR]", "No usable address family on %s", cfg.SrcIface)
+		return nil, fmt.Errorf("no usable address family on %s", cfg.SrcIface)
+	}
 
-	// 送信処理ワーカーgoroutine
-	var wg sync.WaitGroup
-	for i := 0; i < sendWorkerCount; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for pkt := range sendChan {
-				packet := buildEtherIPPacket(pkt.Data[:pkt.Length])
-				currentDst := dstIPVal.Load().(net.IP)
-				rawConn.WriteTo(packet, &net.IPAddr{IP: currentDst})
-				pkt.Pool.Put(pkt.Data)
+	// ピアごとに経路を準備
+	var peers []*Peer
+	for _, host := range cfg.peerHosts() {
+		var peer *Peer
+		if host == cfg.DstHost && cfg.Migration.enabled() {
+			peer, err = newMigrationPeer(cfg, socks)
+		} else {
+			peer, err = newPeer(host, socks, cfg.DualStack)
+		}
+		if err != nil {
+			logf("[ERROR]", "Resolve %s: %v", host, err)
+			return nil, err
+		}
+		peer.events = events
+		if host == cfg.DstHost && len(cfg.Standby.Hosts) > 0 {
+			peer.addStandby(cfg.Standby.Hosts, socks, cfg.DualStack, failback)
+		}
+		peers = append(peers, peer)
+
+		// 宛先の定期的なDNS再解決処理開始goroutine
+		for _, p := range peer.paths {
+			go startDynamicResolver(p, interval, events, cfg.Allowlist.DNSRecords)
+		}
+	}
+
+	tun := newTunnel(cfg, ifce, socks, peers, workers, buffers)
+	if simulation != nil {
+		tun.mac = simulation.mac(cfg)
+	}
+	tun.events = events
+	tun.strictPeers = shared
+	// 経路監視・STPコスト・アラート等のゴルーチンが読むため、起動前に設定する
+	tun.keepaliveInterval = keepaliveInterval
+	if shared {
+		tun.isolation = &domainIsolation{}
+	}
+	if tun.allow, err = newPeerAllowlist(cfg.Allowlist); err != nil {
+		logf("[ERROR]", "Invalid allowlist: %v", err)
+		return nil, err
+	}
+	tun.roaming = cfg.Roaming
+	tun.linkSpeed = linkSpeed
+	datapath, err := parseDatapath(cfg.Datapath)
+	if err != nil {
+		logf("[ERROR]", "Invalid datapath: %v", err)
+		return nil, err
+	}
+	if cfg.Datapath == datapathAFXDP {
+		logf("[WARN]", "datapath af_xdp is not implemented; receiving through the af_packet (TPACKET_V3) ring instead")
+	}
+	if cfg.ConnectedSocket {
+		logf("[INFO]", "Sending through connected raw sockets (one per path, re-dialed when the destination changes)")
+	}
+	if tun.local, err = newLocalDelivery(cfg, tun.mac); err != nil {
+		logf("[ERROR]", "local_delivery: %v", err)
+		return nil, err
+	}
+	if datapath == datapathAFPacket {
+		if tun.ring, err = openPacketRing(tun, cfg.SrcIface); err != nil {
+			logf("[ERROR]", "af_packet datapath on %s: %v", cfg.SrcIface, err)
+			return nil, err
+		}
+	} else if rawSocketMissesEtherIP && simulation == nil && (cfg.Encap == "" || cfg.Encap == encapEtherIP) {
+		if tun.ring, err = openPacketRing(tun, cfg.SrcIface); err != nil {
+			logf("[ERROR]", "bpf datapath on %s: %v", cfg.SrcIface, err)
+			return nil, err
+		}
+	}
+	if tun.comp, err = newCompressor(cfg.Compression); err != nil {
+		logf("[ERROR]", "Invalid compression setting: %v", err)
+		return nil, err
+	}
+	if tun.comp != nil {
+		logf("[INFO]", "Payload compression: %s (min_size %d)", cfg.Compression.Algorithm, tun.comp.minSize)
+	}
+	if tun.qos, err = newQoSMarker(cfg.QoS); err != nil {
+		logf("[ERROR]", "Invalid qos setting: %v", err)
+		return nil, err
+	}
+	if tun.qos != nil {
+		for _, s := range socks {
+			if err := tun.qos.apply(s); err != nil {
+				logf("[ERROR]", "QoS: %v", err)
+				return nil, err
 			}
-		}()
+		}
+		logf("[INFO]", "QoS marking: dscp %d (copy_inner_dscp=%v), flow_label %q", cfg.QoS.DSCP, cfg.QoS.CopyInnerDSCP, cfg.QoS.FlowLabel)
+	}
+	if tun.auth, err = newAuthenticator(cfg.Auth); err != nil {
+		logf("[ERROR]", "Invalid auth setting: %v", err)
+		return nil, err
+	}
+	if tun.auth != nil {
+		logf("[INFO]", "Payload authentication: HMAC-SHA256 (max_skew %v, replay_window %d)", tun.auth.policy.maxSkew, tun.auth.policy.window)
+		for host, policy := range tun.auth.peers {
+			logf("[INFO]", "Payload authentication for %s: max_skew %v, replay_window %d", host, policy.maxSkew, policy.window)
+		}
+	}
+	if tun.seq = newSequencer(cfg.Sequence); tun.seq != nil {
+		logf("[INFO]", "Sequence numbering enabled (count_only=%v)", cfg.Sequence.CountOnly)
+	}
+	if tun.header, err = newHeaderChecker(cfg.HeaderMode, tun.comp != nil, tun.seq != nil, cfg.Oversize.Action == oversizeSplit); err != nil {
+		logf("[ERROR]", "Invalid header_mode: %v", err)
+		return nil, err
+	}
+	if tun.negotiate, err = newNegotiator(cfg.Negotiate); err != nil {
+		logf("[ERROR]", "Invalid negotiate setting: %v", err)
+		return nil, err
+	}
+	if tun.rxCheck, err = newRxValidator(cfg.RxValidation); err != nil {
+		logf("[ERROR]", "Invalid rx_validation: %v", err)
+		return nil, err
+	}
+	if tun.loopGuard, err = newLoopGuard(cfg.LoopGuard); err != nil {
+		logf("[ERROR]", "Invalid loop_guard setting: %v", err)
+		return nil, err
+	}
+	if tun.loopGuard != nil {
+		logf("[INFO]", "Loop guard: hop_limit %d (transit=%v)", tun.loopGuard.limit, tun.loopGuard.transit)
 	}
 
-	// 受信処理ワーカーgoroutine
-	for i := 0; i < recvWorkerCount; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for pkt := range recvChan {
-				ifce.Write(pkt.Data[pkt.Offset : pkt.Offset+pkt.Length])
-				pkt.Pool.Put(pkt.Data)
+	// 複数ピア時はMAC学習による転送先の選択を行う
+	if len(peers) > 1 {
+		if tun.fdb, err = newFDB(cfg.FDB); err != nil {
+			logf("[ERROR]", "Invalid fdb setting: %v", err)
+			return nil, err
+		}
+		logf("[INFO]", "Multipoint mode with %d peers", len(peers))
+	}
+
+	// ピアの宛先へのホスト経路の固定（トンネル経由への再帰を防ぐ）
+	if cfg.HostRoute.Enabled {
+		if tun.hostRoute, err = newHostRouter(tun, cfg.HostRoute); err != nil {
+			logf("[ERROR]", "Host route: %v", err)
+			return nil, err
+		}
+		registerShutdown(tun.hostRoute.removeAll)
+		go tun.hostRoute.run()
+	}
+
+	// オーバーレイ上のiperf3応答機能
+	if cfg.Iperf.Address != "" {
+		lower := cfg.TapName
+		if cfg.BrName != "off" {
+			lower = cfg.BrName
+		}
+		if tun.iperf, err = newIperfResponder(cfg.Iperf, cfg.TapName, lower); err != nil {
+			logf("[ERROR]", "iperf3 responder: %v", err)
+			return nil, err
+		}
+		go tun.iperf.run()
+	}
+
+	// 宛先への経路がトンネル自身を向いていないかの監視
+	if tun.recursion, err = newRecursionGuard(tun, cfg.RecursionCheck); err != nil {
+		logf("[ERROR]", "Invalid recursion_check: %v", err)
+		return nil, err
+	}
+	if tun.recursion != nil {
+		go tun.recursion.run()
+	}
+
+	// WASMポリシープラグインの読み込み
+	for _, pc := range cfg.WasmPlugins {
+		plugin, err := loadWasmPlugin(pc, workers.total())
+		if err != nil {
+			logf("[ERROR]", "WASM plugin %s: %v", pc.Path, err)
+			return nil, err
+		}
+		registerCleanup(func() { plugin.Close() })
+		tun.filters = append(tun.filters, plugin)
+	}
+
+	// 帯域制限（外部プロセスやプラグインより先に適用）
+	limiter, err := newRateLimiter(cfg.RateLimit, cfg.MTU)
+	if err != nil {
+		logf("[ERROR]", "Rate limit: %v", err)
+		return nil, err
+	}
+	if limiter != nil {
+		tun.filters = append([]FrameFilter{limiter}, tun.filters...)
+	}
+
+	// ループ・異常なホストによるフラッディングの抑制（帯域制限より先に適用）
+	storm, err := newStormControl(cfg.StormControl)
+	if err != nil {
+		logf("[ERROR]", "Storm control: %v", err)
+		return nil, err
+	}
+	if storm != nil {
+		tun.filters = append([]FrameFilter{storm}, tun.filters...)
+	}
+
+	// 近隣要請への代理応答（応答できた要請がストーム抑制・帯域制限を消費しないよう先に適用）
+	nd, err := newNDProxy(cfg.NDProxy, tun.ifce.Write)
+	if err != nil {
+		logf("[ERROR]", "ND proxy: %v", err)
+		return nil, err
+	}
+	if nd != nil {
+		tun.filters = append([]FrameFilter{nd}, tun.filters...)
+	}
+
+	// 送信元MACごとの制限（異常なホストをストーム抑制・帯域制限より先に遮断）
+	if tun.macLimit, err = newMACLimiter(cfg.MACLimit); err != nil {
+		logf("[ERROR]", "Per-MAC limit: %v", err)
+		return nil, err
+	}
+	if tun.macLimit != nil {
+		tun.filters = append([]FrameFilter{tun.macLimit}, tun.filters...)
+	}
+
+	// VLANによる選別（対象外VLANが帯域を消費しないよう先頭に配置）
+	vlan, err := newVLANFilter(cfg.VLANFilter)
+	if err != nil {
+		logf("[ERROR]", "VLAN filter: %v", err)
+		return nil, err
+	}
+	if vlan != nil {
+		tun.filters = append([]FrameFilter{vlan}, tun.filters...)
+	}
+
+	// トンネルとブリッジ先のLANを通るループの検出（遮断中は他のフィルタより先に破棄）
+	loop, err := newLoopDetector(tun, cfg.LoopDetect)
+	if err != nil {
+		logf("[ERROR]", "Loop detection: %v", err)
+		return nil, err
+	}
+	if loop != nil {
+		tun.filters = append([]FrameFilter{loop}, tun.filters...)
+		go loop.run()
+	}
+
+	// 不正な送信元アドレスを持つ内側IPパケットの破棄
+	martian, err := newMartianFilter(cfg.MartianFilter)
+	if err != nil {
+		logf("[ERROR]", "Martian filter: %v", err)
+		return nil, err
+	}
+	if martian != nil {
+		tun.filters = append(tun.filters, martian)
+	}
+
+	// 内側フレームのアクセス制御
+	acl, err := newACLFilter(cfg.ACL)
+	if err != nil {
+		logf("[ERROR]", "ACL: %v", err)
+		return nil, err
+	}
+	if acl != nil {
+		tun.filters = append(tun.filters, acl)
+	}
+
+	// 外部プロセス（DPI/IDS等）へのフレーム複製
+	if cfg.Tee.Socket != "" {
+		tee, err := newTeeClient(cfg.Tee, cfg.TapName)
+		if err != nil {
+			logf("[ERROR]", "Tee: %v", err)
+			return nil, err
+		}
+		tun.filters = append(tun.filters, tee)
+	}
+
+	// 遠隔のコレクタへのフレーム複製
+	mirror, err := newMirror(cfg, socks)
+	if err != nil {
+		logf("[ERROR]", "Mirror: %v", err)
+		return nil, err
+	}
+	if mirror != nil {
+		tun.filters = append(tun.filters, mirror)
+		go mirror.run()
+	}
+
+	// 送信キューの混雑を内側のフローへECNで通知（観測より先に適用し、マーク後のフレームを記録）
+	ecn, err := newECNMarker(cfg.ECN, func() int { return len(tun.sendChan) }, workers.sendQueue)
+	if err != nil {
+		logf("[ERROR]", "ECN: %v", err)
+		return nil, err
+	}
+	if ecn != nil {
+		tun.filters = append(tun.filters, ecn)
+	}
+
+	// 転送されるフレームの観測（フィルタチェーンの末尾）
+	if tun.telemetry = newTelemetry(cfg.Telemetry); tun.telemetry != nil {
+		tun.filters = append(tun.filters, tun.telemetry)
+	}
+	if tun.capture = newCapturer(cfg.Capture); tun.capture != nil {
+		tun.filters = append(tun.filters, tun.capture)
+	}
+	tun.csum = newChecksumVerifier(tun, cfg.Telemetry.Checksums)
+
+	// eBPFによるカーネル内転送（デーモンは宛先・送信元の同期と、処理できないフレームの転送を行う）
+	if tun.offload, err = newOffloader(tun, cfg); err != nil {
+		logf("[ERROR]", "Offload: %v", err)
+		return nil, err
+	}
+	if tun.offload != nil {
+		go tun.offload.run()
+	}
+
+	// ピアからの外側パケットの許可とピア宛てのICMPエラーの抑止
+	if tun.firewall, err = newFirewall(tun, cfg); err != nil {
+		logf("[ERROR]", "Firewall: %v", err)
+		return nil, err
+	}
+	if tun.firewall != nil {
+		go tun.firewall.run()
+	}
+
+	logf("[INFO]", "EtherIP Tunnel started")
+	logf("[INFO]", "TAP: %s | MTU: %d", cfg.TapName, cfg.MTU)
+	logf("[INFO]", "Workers: send %d (queue %d), recv %d (queue %d, flow order %v), cpus %v", workers.sendWorkers, workers.sendQueue, workers.recvWorkers, workers.recvQueue, workers.flowOrder, workers.cpus)
+	logf("[INFO]", "Buffers: %d bytes, prealloc %d, max outstanding %d, queue full %s", buffers.size, buffers.prealloc, buffers.maxOutstanding, buffers.queueFull())
+	for _, peer := range peers {
+		for _, p := range peer.paths {
+			logf("[INFO]", "SRC: %s (%s) → DST: %s (%s)", p.SrcIP.Load(), cfg.SrcIface, p.Dst.Load(), p.Host)
+		}
+	}
+
+	// 経路の判定への入力の記録（キープアライブの開始前に状態を書く）
+	tun.keepaliveMax = keepaliveMax
+	controlTrace.start(tun, keepaliveInterval, keepaliveTimeout)
+
+	// キープアライブによる経路監視とSLA集計
+	if keepaliveInterval > 0 {
+		saved := make(map[string]*slaState)
+		if cfg.SLA.File != "" {
+			saved = loadSLAFile(cfg.SLA.File)
+		}
+		rttSampler := newSampler(cfg.Telemetry.RTTHistogram, true)
+		for _, peer := range peers {
+			peer.sla = newSLATracker(peer.Host, saved[peer.Host], rttSampler)
+		}
+		if cfg.SLA.File != "" {
+			slaInterval := slaDefaultInterval
+			if cfg.SLA.Interval != "" {
+				if slaInterval, err = time.ParseDuration(cfg.SLA.Interval); err != nil {
+					logf("[ERROR]", "Invalid sla.interval: %v", err)
+					return nil, err
+				}
+				if slaInterval <= 0 {
+					logf("[ERROR]", "Invalid sla.interval: must be positive")
+					return nil, fmt.Errorf("sla.interval must be positive")
+				}
 			}
-		}()
+			go tun.startSLAWriter(cfg.SLA.File, slaInterval)
+			registerCleanup(func() { tun.writeSLAFile(cfg.SLA.File) })
+		}
+		go tun.startKeepalive(keepaliveInterval, keepaliveTimeout)
+	} else if cfg.SLA.File != "" {
+		logf("[WARN]", "sla.file is set but keepalive is off; SLA tracking disabled")
 	}
 
-	// メインスレッドは終了せず、ワーカー終了待ち（永続）
-	wg.Wait()
+	// 対向デーモンのバージョン取得
+	go tun.runHello()
+
+	// 転送統計の定期集計
+	if tun.stats, err = newStatsCollector(tun, cfg.Stats); err != nil {
+		logf("[ERROR]", "Invalid stats setting: %v", err)
+		return nil, err
+	}
+	if tun.stats != nil {
+		go tun.stats.run()
+		registerCleanup(func() { tun.stats.saveLifetime() })
+	}
+	if cfg.Stats.PerVLAN {
+		tun.vlanStats = &vlanStats{}
+	}
+
+	// Path MTU探索
+	if cfg.PMTUD.Enabled {
+		if tun.pmtud, err = newPMTUD(tun, cfg.PMTUD); err != nil {
+			logf("[ERROR]", "PMTUD: %v", err)
+			return nil, err
+		}
+		go tun.pmtud.run()
+	}
+	if tun.oversize, err = newOversize(tun, cfg.Oversize); err != nil {
+		logf("[ERROR]", "Oversize handling: %v", err)
+		return nil, err
+	}
+	if cfg.Oversize.Action == oversizeSplit {
+		tun.reasm = newReassembler(buffers.size)
+	}
+
+	// カナリアフレームによる転送経路の完全性検査
+	if cfg.Canary.Enabled {
+		if tun.canary, err = newCanaryChecker(tun, cfg.Canary); err != nil {
+			logf("[ERROR]", "Invalid canary setting: %v", err)
+			return nil, err
+		}
+		go tun.canary.run()
+	}
+
+	// ピアの無受信時の対処
+	if tun.silence, err = newSilenceWatcher(tun, cfg.Silence); err != nil {
+		logf("[ERROR]", "Invalid silence setting: %v", err)
+		return nil, err
+	}
+	if cfg.SrcAuto {
+		tun.srcSelect = &srcSelector{t: tun}
+		go tun.srcSelect.run()
+	}
+	if tun.silence != nil {
+		go tun.silence.run()
+	}
+
+	// 遅延・損失に応じたブリッジポートのコスト調整
+	if cfg.STPCost.Enabled {
+		if tun.stpCost, err = newSTPCoster(tun, cfg.STPCost); err != nil {
+			logf("[ERROR]", "STP cost: %v", err)
+			return nil, err
+		}
+		go tun.stpCost.run()
+	}
+
+	// ルーティングデーモンの経路取り消しによるフェイルオーバー
+	if cfg.RouteHealth.Neighbor != "" {
+		if tun.routes, err = newRouteWatcher(tun, cfg.RouteHealth); err != nil {
+			logf("[ERROR]", "Route health: %v", err)
+			return nil, err
+		}
+		go tun.routes.run()
+	}
+
+	// BGP EVPNによるMACアドレスの広告・学習
+	if cfg.EVPN.Neighbor != "" {
+		if tun.evpn, err = newEVPNSpeaker(tun, cfg.EVPN); err != nil {
+			logf("[ERROR]", "EVPN: %v", err)
+			return nil, err
+		}
+		go tun.evpn.run()
+	}
+
+	// ブリッジで学習したMACアドレスの対向との交換
+	if tun.fdbSync, err = newFDBSyncer(tun, cfg); err != nil {
+		logf("[ERROR]", "FDB sync: %v", err)
+		return nil, err
+	}
+	if tun.fdbSync != nil {
+		go tun.fdbSync.run()
+	}
+
+	// しきい値アラート
+	if len(cfg.Alerts.Rules) > 0 {
+		alerts, err := newAlerter(tun, cfg.Alerts)
+		if err != nil {
+			logf("[ERROR]", "Alerts: %v", err)
+			return nil, err
+		}
+		go alerts.run()
+	}
+
+	// MQTTへのステータス発行
+	if cfg.MQTT.Broker != "" {
+		mqtt, err := newMQTTPublisher(tun, cfg.MQTT)
+		if err != nil {
+			logf("[ERROR]", "MQTT: %v", err)
+			return nil, err
+		}
+		go mqtt.run()
+		registerCleanup(mqtt.close)
+	}
+
+	return tun, nil
 }
 
-// loadConfig は YAML設定ファイルを読み込み、Config構造体に格納する
-func loadConfig(path string) (*Config, error) {
+// loadConfigs は YAML設定ファイルを読み込み、トンネルごとのConfigを返す
+//
+// tunnelsが指定されている場合、各要素に書かれたキーはトップレベルの同じキーを丸ごと置き換える。
+func loadConfigs(path string) ([]*Config, error) {
 	data, err := os.ReadFile(path)
+	defer clear(data) // 鍵を含むファイルの内容をヒープに残さない（設定値はコピー済み）
 	if err != nil {
-		logf("[ERROR]", "Failed to read config file: %v", err)
+		if !os.IsNotExist(err) || len(configOverrides) == 0 {
+			logf("[ERROR]", "Failed to read config file: %v", err)
+			return nil, err
+		}
+		logf("[INFO]", "Config file %s not found; using environment and flag overrides only", path)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		logf("[ERROR]", "Failed to parse config file: %v", err)
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		doc.Content = []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}
+	}
+	top := doc.Content[0]
+	if top.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("config must be a mapping")
+	}
+	if err := applyOverrides(top); err != nil {
+		logf("[ERROR]", "%v", err)
 		return nil, err
 	}
 
-	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
+	var base Config
+	if err := top.Decode(&base); err != nil {
 		logf("[ERROR]", "Failed to parse config file: %v", err)
 		return nil, err
 	}
+	if len(base.Tunnels) == 0 {
+		base.legacy = true
+		applyDefaults(&base)
+		return []*Config{&base}, nil
+	}
+
+	var cfgs []*Config
+	taps := make(map[string]bool)
+	slaFiles := make(map[string]string)
+	endpoints := make(map[string]string)
+	for i := range base.Tunnels {
+		var cfg Config
+		if err := mergeTunnelNode(top, &base.Tunnels[i]).Decode(&cfg); err != nil {
+			return nil, fmt.Errorf("tunnels[%d]: %w", i, err)
+		}
+		applyDefaults(&cfg)
+
+		if taps[cfg.TapName] {
+			return nil, fmt.Errorf("tunnels[%d]: duplicate tap_name %s", i, cfg.TapName)
+		}
+		taps[cfg.TapName] = true
+		if cfg.SLA.File != "" {
+			if other, dup := slaFiles[cfg.SLA.File]; dup {
+				return nil, fmt.Errorf("tunnels[%d]: sla.file %s is also used by %s", i, cfg.SLA.File, other)
+			}
+			slaFiles[cfg.SLA.File] = cfg.TapName
+		}
+		// EtherIPにはトンネル識別子がないため、送信元と宛先の組はトンネル間で重複できない
+		for _, host := range cfg.peerHosts() {
+			key := cfg.SrcIface + "|" + host
+			if other, dup := endpoints[key]; dup {
+				return nil, fmt.Errorf("tunnels[%d]: %s via %s is also used by %s", i, host, cfg.SrcIface, other)
+			}
+			endpoints[key] = cfg.TapName
+		}
+		cfgs = append(cfgs, &cfg)
+	}
+	if err := checkDomains(cfgs); err != nil {
+		return nil, err
+	}
+	return cfgs, nil
+}
 
+// mergeTunnelNode はトップレベルのマッピングにトンネル要素のキーを上書きしたノードを返す関数
+func mergeTunnelNode(top, tunnel *yaml.Node) *yaml.Node {
+	merged := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	overridden := make(map[string]bool)
+	if tunnel.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(tunnel.Content); i += 2 {
+			overridden[tunnel.Content[i].Value] = true
+		}
+	}
+	for i := 0; i+1 < len(top.Content); i += 2 {
+		key := top.Content[i].Value
+		if key != "tunnels" && !overridden[key] {
+			merged.Content = append(merged.Content, top.Content[i], top.Content[i+1])
+		}
+	}
+	if tunnel.Kind == yaml.MappingNode {
+		merged.Content = append(merged.Content, tunnel.Content...)
+	}
+	return merged
+}
+
+// applyDefaults は未指定の設定項目に既定値を設定する関数
+func applyDefaults(cfg *Config) {
 	// デフォルト値を設定（設定漏れ防止）
 	if cfg.MTU == 0 {
 		cfg.MTU = 1500
@@ -249,130 +1230,286 @@ func loadConfig(path string) (*Config, error) {
 		cfg.BrName = "off"
 		logf("[INFO]", "BrName not specified, defaulting to off")
 	}
+	if cfg.Migration.enabled() && !cfg.DualStack {
+		cfg.DualStack = true
+		logf("[INFO]", "DualStack enabled for migration")
+	}
+	if cfg.KeepaliveInterval == "" {
+		cfg.KeepaliveInterval = "off"
+		if cfg.DualStack || len(cfg.Standby.Hosts) > 0 {
+			// デュアルスタック・予備の宛先へのフェイルオーバー判定にはキープアライブが必須
+			cfg.KeepaliveInterval = "5s"
+		}
+		logf("[INFO]", "KeepaliveInterval not specified, defaulting to %s", cfg.KeepaliveInterval)
+	}
+}
 
-	return &cfg, nil
+// peerHosts は dst_host と peers を合わせた重複のないピア一覧を返す
+func (cfg *Config) peerHosts() []string {
+	var hosts []string
+	seen := make(map[string]bool)
+	for _, h := range append([]string{cfg.DstHost}, cfg.Peers...) {
+		if h != "" && !seen[h] {
+			seen[h] = true
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
 }
 
 // buildEtherIPPacket は EtherIPヘッダを付与したパケットを生成する関数
 func buildEtherIPPacket(frame []byte) []byte {
+	h := header.New(0)
 	var buf bytes.Buffer
-	buf.Write([]byte{0x30, 0x00}) // EtherIP ヘッダ (Version=3, Reserved=0)
+	buf.Write(h[:]) // EtherIP ヘッダ (Version=3, Reserved=0)
 	buf.Write(frame)
 	return buf.Bytes()
 }
 
-// renameInterface はインターフェースの名前を変更する関数
-func renameInterface(oldName, newName string) error {
-	if err := exec.Command("ip", "link", "set", oldName, "name", newName).Run(); err != nil {
-		logf("[ERROR]", "Failed to rename interface: %v", err)
-		return err
-	}
-	logf("[INFO]", "Interface renamed from %s to %s", oldName, newName)
-	return nil
-}
-
 // ifaceExists は指定された名前のインターフェースが存在するか確認する関数
 func ifaceExists(name string) bool {
 	_, err := net.InterfaceByName(name)
 	return err == nil
 }
 
-// linkUp はインターフェースを有効(UP)にする関数
-func linkUp(ifname string) error {
-	if err := exec.Command("ip", "link", "set", "dev", ifname, "up").Run(); err != nil {
-		logf("[ERROR]", "Failed to set interface %s UP: %v", ifname, err)
-		return err
-	}
-	logf("[INFO]", "Interface %s set UP", ifname)
-	return nil
-}
-
-// setTAPMTU はインターフェースのMTUを設定する関数
-func setTAPMTU(name string, mtu int) error {
-	if err := exec.Command("ip", "link", "set", "dev", name, "mtu", fmt.Sprintf("%d", mtu)).Run(); err != nil {
-		logf("[ERROR]", "Failed to set MTU on interface %s: %v", name, err)
-		return err
-	}
-	logf("[INFO]", "MTU of interface %s set to %d", name, mtu)
-	return nil
-}
-
-// addToBridge はTAPインターフェースを指定したブリッジに追加する関数
-func addToBridge(ifname, brname string) error {
-	if err := exec.Command("ip", "link", "set", "dev", ifname, "master", brname).Run(); err != nil {
-		logf("[ERROR]", "Failed to add interface %s to bridge %s: %v", ifname, brname, err)
-		return err
-	}
-	logf("[INFO]", "Interface %s added to bridge %s", ifname, brname)
-	return nil
-}
-
-// getInterfaceIP は指定されたインターフェースからIPv4またはIPv6のIPアドレスを取得する関数
-func getInterfaceIP(ifname string, version int) (net.IP, error) {
+// getInterfaceIP は指定されたインターフェースからIPv4またはIPv6のIPアドレスを選ぶ関数
+//
+// 複数ある場合はグローバル、プライベート（RFC 1918・ULA）、リンクローカル（linkLocal指定時のみ）の順に優先する。
+func getInterfaceIP(ifname string, version int, linkLocal bool) (net.IP, error) {
 	iface, err := net.InterfaceByName(ifname)
 	if err != nil {
 		logf("[ERROR]", "Interface %s not found: %v", ifname, err)
 		return nil, err
 	}
 
+	var best net.IP
+	bestRank := 3
 	addrs, _ := iface.Addrs()
 	for _, addr := range addrs {
 		ip, _, _ := net.ParseCIDR(addr.String())
-		if version == 4 && ip.To4() != nil {
-			logf("[INFO]", "IPv4 address found on %s: %s", ifname, ip)
-			return ip, nil
+		if ip == nil || (version == 4) != (ip.To4() != nil) {
+			continue
 		}
-		if version == 6 && ip.To16() != nil && ip.To4() == nil {
-			logf("[INFO]", "IPv6 address found on %s: %s", ifname, ip)
-			return ip, nil
+		rank := 0
+		switch {
+		case ip.IsLoopback() || ip.IsMulticast() || ip.IsUnspecified():
+			continue
+		case ip.IsLinkLocalUnicast():
+			if version == 4 || !linkLocal {
+				continue
+			}
+			rank = 2
+		case ip.IsPrivate():
+			rank = 1
+		}
+		if rank < bestRank {
+			best, bestRank = ip, rank
 		}
 	}
+	if best != nil {
+		logf("[INFO]", "IPv%d address found on %s: %s", version, ifname, best)
+		return best, nil
+	}
 
 	err = fmt.Errorf("no suitable IP found for IPv%d on %s", version, ifname)
 	logf("[ERROR]", "%v", err)
 	return nil, err
 }
 
+// sourceIP はsrc_ipの指定（なければsrc_ifaceからの自動選択）から送信元アドレスを返す関数
+func sourceIP(cfg *Config, version int) (net.IP, error) {
+	if ip := cluster.source(version); ip != nil {
+		return ip, nil // クラスタではvipを送信元にする
+	}
+	if len(cfg.SrcIP) == 0 {
+		return getInterfaceIP(cfg.SrcIface, version, cfg.SrcLinkLocal)
+	}
+	for _, s := range cfg.SrcIP {
+		ip := net.ParseIP(s)
+		if ip != nil && (version == 4) == (ip.To4() != nil) {
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("src_ip has no IPv%d address", version)
+}
+
+// interfaceHasIP は指定されたインターフェースにアドレスが付いているか確認する関数
+func interfaceHasIP(ifname string, ip net.IP) bool {
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return false
+	}
+	addrs, _ := iface.Addrs()
+	for _, addr := range addrs {
+		if a, _, _ := net.ParseCIDR(addr.String()); a.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // resolveDst は宛先のFQDNをIPアドレスにDNS解決する関数
 func resolveDst(host string, version int) (net.IP, error) {
+	ip, _, err := resolveDstTTL(host, version)
+	return ip, err
+}
+
+// resolveDstTTL は宛先を解決し、レコードのTTLも返す関数（システムのリゾルバ使用時のTTLは0）
+func resolveDstTTL(host string, version int) (net.IP, time.Duration, error) {
+	ips, ttl, err := resolveDstAll(host, version)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ips[0], ttl, nil
+}
+
+// resolveDstAll は宛先を解決し、指定ファミリの全てのアドレス（先頭を宛先に使う）とTTLを返す関数
+//
+// 名前の解決はOpenTelemetryのスパン（dns.resolve）として記録する。
+func resolveDstAll(host string, version int) ([]net.IP, time.Duration, error) {
+	if net.ParseIP(host) != nil {
+		return lookupDst(host, version)
+	}
+	start := time.Now()
+	ips, ttl, err := lookupDst(host, version)
+	var addr string
+	if len(ips) > 0 {
+		addr = ips[0].String()
+	}
+	otlp.span("dns.resolve", otlpSpanClient, start, time.Now(), err,
+		"dns.question.name", host, "network.type", fmt.Sprintf("ipv%d", version), "etherip.address", addr)
+	return ips, ttl, err
+}
+
+// lookupDst は宛先をDNS（リゾルバ未設定ならシステムのリゾルバ）で解決する関数
+//
+// consul:// 等で始まる宛先はサービスディスカバリのバックエンドで解決する（アドレスは1つ）。
+func lookupDst(host string, version int) ([]net.IP, time.Duration, error) {
+	if discoveryScheme(host) != "" {
+		ip, ttl, err := lookupDiscovery(host, version)
+		if err != nil {
+			logf("[ERROR]", "Discovery lookup failed for %s (IPv%d): %v", host, version, err)
+			return nil, 0, err
+		}
+		return []net.IP{ip}, ttl, nil
+	}
+	if resolver != nil && net.ParseIP(host) == nil {
+		ips, ttl, err := resolver.lookup(host, version)
+		if err != nil {
+			logf("[ERROR]", "DNS lookup failed for host %s (IPv%d): %v", host, version, err)
+			return nil, 0, err
+		}
+		return ips, ttl, nil
+	}
+
 	ips, err := net.LookupIP(host)
 	if err != nil {
 		logf("[ERROR]", "DNS lookup failed for host %s: %v", host, err)
-		return nil, err
+		return nil, 0, err
 	}
 
+	var found []net.IP
 	for _, ip := range ips {
 		if version == 4 && ip.To4() != nil {
-			// logf("[INFO]", "Resolved IPv4 %s → %s", host, ip)
-			return ip, nil
+			found = append(found, ip)
 		}
 		if version == 6 && ip.To16() != nil && ip.To4() == nil {
-			// logf("[INFO]", "Resolved IPv6 %s → %s", host, ip)
-			return ip, nil
+			found = append(found, ip)
 		}
 	}
+	if len(found) > 0 {
+		return found, 0, nil
+	}
 
 	err = fmt.Errorf("no suitable IP found for host %s (IPv%d)", host, version)
 	logf("[ERROR]", "%v", err)
-	return nil, err
+	return nil, 0, err
+}
+
+// openTAP はTAP（ifmode: tunならTUN）を作成し、名前変更・UP・MTU・ブリッジへの参加を行う関数
+func openTAP(cfg *Config, setup ifSetup, devType water.DeviceType) (*water.Interface, error) {
+	ifce, actualName, err := createTAP(cfg.TapName, devType)
+	if err != nil {
+		logf("[ERROR]", "TAP create: %v", err)
+		return nil, err
+	}
+	if c, ok := ifce.ReadWriteCloser.(syscall.Conn); ok {
+		offerHandover("tap:"+cfg.TapName, c)
+	}
+
+	// 目的のTAPインターフェース名が既に存在している場合の対処
+	if actualName != cfg.TapName && ifaceExists(cfg.TapName) {
+		logf("[ERROR]", "TAP interface name '%s' already exists. Choose a different name or remove the existing interface.", cfg.TapName)
+		return nil, fmt.Errorf("interface %s already exists", cfg.TapName)
+	}
+
+	// 名前変更・UP・MTU・ブリッジへの自動参加（一時的な失敗は再試行）
+	if err := setupInterface(cfg, setup, actualName); err != nil {
+		logf("[ERROR]", "Interface setup: %v", err)
+		return nil, err
+	}
+	if cfg.BrName != "off" {
+		logf("[INFO]", "TAP interface %s joined bridge %s", cfg.TapName, cfg.BrName)
+	}
+	return ifce, nil
 }
 
 // startDynamicResolver は宛先IPを定期的にDNS再解決する関数
-func startDynamicResolver(host string, version int, interval time.Duration, dstVal *atomic.Value) {
+//
+// dns.follow_ttl有効時は2回目以降の間隔をレコードのTTLに合わせる。
+//
+// 失敗し続けている間は経路のdnsFailedに開始時刻を記録する（/readyzの判定に使用）。
+//
+// recordsが真（allowlist.dns_records）なら起動直後にも解決して全てのアドレスを経路に記録し、
+// ラウンドロビンで順序が変わっただけなら宛先を切り替えない。
+func startDynamicResolver(p *Path, interval time.Duration, events *eventSink, records bool) {
+	host, dstVal := p.Host, &p.Dst
+	if net.ParseIP(host) != nil {
+		return // IPアドレス指定は再解決不要
+	}
+	// 比較は前回の解決結果と行い、roamingで追従した宛先をDNSが変わらない限り上書きしない
+	resolved := dstVal.Load().(net.IP)
+	wait := interval
+	if records {
+		wait = 0
+	}
 	for {
-		time.Sleep(interval)
+		time.Sleep(wait)
+		wait = interval
 		for {
-			newIP, err := resolveDst(host, version)
+			ips, ttl, err := resolveDstAll(host, p.Version)
 			if err != nil {
+				p.dnsFailed.CompareAndSwap(0, time.Now().UnixNano())
 				logf("[WARN]", "DNS resolve failed for %s: %v, retry in %v", host, err, retryOnFailDelay)
 				time.Sleep(retryOnFailDelay)
 				continue
 			}
+			p.dnsFailed.Store(0)
 
-			old := dstVal.Load().(net.IP)
-			if !old.Equal(newIP) {
+			newIP := ips[0]
+			if records {
+				switch prev := p.records.Swap(&ips); {
+				case prev == nil:
+					logf("[INFO]", "DNS records for %s (IPv%d): %v", host, p.Version, ips)
+				case !slices.EqualFunc(*prev, ips, net.IP.Equal):
+					logf("[UPDATE]", "DNS records for %s (IPv%d): %v → %v", host, p.Version, *prev, ips)
+				}
+				if slices.ContainsFunc(ips, resolved.Equal) {
+					newIP = resolved
+				}
+			}
+
+			if !resolved.Equal(newIP) {
+				old := dstVal.Load().(net.IP)
 				logf("[UPDATE]", "DNS updated: %s → %s", old, newIP)
 				dstVal.Store(newIP)
+				controlTrace.dst(p, newIP, "dns")
+				resolved = newIP
+				events.emit("peer_change", host, fmt.Sprintf("%s → %s", old, newIP))
+			}
+			// TTLのないバックエンド（consul, etcd）はresolve_intervalで再解決する
+			if resolver != nil && resolver.followTTL && (ttl > 0 || discoveryScheme(host) == "") {
+				wait = resolver.resolveInterval(ttl)
 			}
 			break
 		}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// 送信元アドレスの破棄理由
+const (
+	martianMulticast = iota
+	martianLoopback
+	martianUnspecified
+	martianBroadcast
+	martianBogon
+	martianReasons
+)
+
+// martianReasonNames はカウンタ名に使う破棄理由
+var martianReasonNames = [martianReasons]string{"multicast", "loopback", "unspecified", "broadcast", "bogon"}
+
+// MartianFilterConfigは内側IPパケットの送信元アドレス検査の設定を保持する
+type MartianFilterConfig struct {
+	Enabled   bool     `yaml:"enabled"`
+	Direction string   `yaml:"direction"` // 検査する方向（tx, rx, both）
+	Bogons    []string `yaml:"bogons"`    // 追加で破棄する送信元アドレス範囲（CIDR）
+}
+
+// martianFilterはマルチキャスト・ループバック・未指定アドレス等を送信元とする内側IPパケットを破棄するフィルタ
+//
+// DHCPの要求（0.0.0.0からUDP 67番宛）とIPv6の重複アドレス検出・MLD（::からICMPv6/Hop-by-Hop）は通す。
+type martianFilter struct {
+	dirs   [2]bool
+	bogons []*net.IPNet
+
+	dropped [2][martianReasons]atomic.Uint64 // 方向・理由ごとの破棄数
+}
+
+// newMartianFilter は設定からフィルタを生成する関数（無効ならnilを返す）
+func newMartianFilter(cfg MartianFilterConfig) (*martianFilter, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	tx, rx, ok := parseDirections(cfg.Direction)
+	if !ok {
+		return nil, fmt.Errorf("invalid direction %q", cfg.Direction)
+	}
+
+	f := &martianFilter{dirs: [2]bool{DirTX: tx, DirRX: rx}}
+	for _, s := range cfg.Bogons {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("bogons: %w", err)
+		}
+		f.bogons = append(f.bogons, n)
+	}
+	return f, nil
+}
+
+// classify は送信元アドレスを検査し、破棄理由（問題なければ-1）を返す
+func (f *martianFilter) classify(src net.IP, exempt bool) int {
+	switch {
+	case src.IsUnspecified() || (len(src) == net.IPv4len && src[0] == 0):
+		if exempt {
+			return -1
+		}
+		return martianUnspecified
+	case src.IsMulticast():
+		return martianMulticast
+	case src.IsLoopback():
+		return martianLoopback
+	case src.Equal(net.IPv4bcast):
+		return martianBroadcast
+	}
+	for _, n := range f.bogons {
+		if n.Contains(src) {
+			return martianBogon
+		}
+	}
+	return -1
+}
+
+// Filter は内側IPv4/IPv6パケットの送信元アドレスを検査する
+func (f *martianFilter) Filter(dir Direction, frame []byte) ([]byte, Verdict) {
+	if !f.dirs[dir] || len(frame) < 14 {
+		return frame, VerdictPass
+	}
+
+	// VLANタグ（QinQを含む）を読み飛ばす
+	off := 12
+	et := binary.BigEndian.Uint16(frame[off:])
+	for (et == tpid8021Q || et == tpid8021AD) && len(frame) >= off+vlanTagLen+2 {
+		off += vlanTagLen
+		et = binary.BigEndian.Uint16(frame[off:])
+	}
+	off += 2
+
+	reason := -1
+	switch {
+	case et == 0x0800 && len(frame) >= off+20:
+		ip := frame[off:]
+		ihl := int(ip[0]&0x0F) * 4
+		exempt := ip[9] == 17 && len(ip) >= ihl+4 && binary.BigEndian.Uint16(ip[ihl+2:]) == 67
+		reason = f.classify(net.IP(ip[12:16]), exempt)
+	case et == 0x86DD && len(frame) >= off+40:
+		ip := frame[off:]
+		exempt := ip[6] == 58 || ip[6] == 0
+		reason = f.classify(net.IP(ip[8:24]), exempt)
+	}
+	if reason < 0 {
+		return frame, VerdictPass
+	}
+	f.dropped[dir][reason].Add(1)
+	return nil, VerdictDrop
+}
+
+// Counters は方向・理由ごとの破棄数を返す
+func (f *martianFilter) Counters() map[string]uint64 {
+	counters := make(map[string]uint64)
+	for dir := range f.dropped {
+		for reason, name := range martianReasonNames {
+			counters[fmt.Sprintf("martian_%s_%s", Direction(dir), name)] = f.dropped[dir][reason].Load()
+		}
+	}
+	return counters
+}
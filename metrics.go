@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// metricFamilyは1つのメトリクスとそのサンプル（Prometheusのテキスト形式・OTLPで出力）
+type metricFamily struct {
+	name    string
+	kind    string // counter, gauge, histogram, untyped
+	help    string
+	samples []metricSample
+}
+
+// metricSampleはラベル（名前と値の組）付きのサンプル1つ
+type metricSample struct {
+	labels  []string
+	value   uint64
+	float   float64            // isFloatの時の値
+	isFloat bool               // 整数でない値（gaugeのみ）
+	hist    *HistogramSnapshot // histogramの時の値
+	scale   float64            // histogramの上限・合計の単位の換算
+}
+
+// add はラベル（名前と値の組）付きのサンプルを追加する関数
+func (m *metricFamily) add(value uint64, labels ...string) {
+	m.samples = append(m.samples, metricSample{labels: labels, value: value})
+}
+
+// addFloat は整数でない値のサンプルを追加する関数
+func (m *metricFamily) addFloat(value float64, labels ...string) {
+	m.samples = append(m.samples, metricSample{labels: labels, float: value, isFloat: true})
+}
+
+// addHistogram はヒストグラムのサンプルを追加する関数（scaleで上限・合計の単位を換算）
+func (m *metricFamily) addHistogram(s HistogramSnapshot, scale float64, labels ...string) {
+	m.samples = append(m.samples, metricSample{labels: labels, hist: &s, scale: scale})
+}
+
+// writeText はPrometheusのテキスト形式で出力する関数（ヒストグラムは_bucket・_sum・_countに展開）
+func (m *metricFamily) writeText(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	for _, s := range m.samples {
+		switch {
+		case s.hist != nil:
+			var cum uint64
+			for i, c := range s.hist.Counts {
+				cum += c
+				le := "+Inf"
+				if i < len(s.hist.Bounds) {
+					le = strconv.FormatFloat(float64(s.hist.Bounds[i])*s.scale, 'f', -1, 64)
+				}
+				m.writeLine(w, "_bucket", strconv.FormatUint(cum, 10), append(s.labels[:len(s.labels):len(s.labels)], "le", le))
+			}
+			m.writeLine(w, "_sum", strconv.FormatFloat(float64(s.hist.Sum)*s.scale, 'g', -1, 64), s.labels)
+			m.writeLine(w, "_count", strconv.FormatUint(s.hist.Count, 10), s.labels)
+		case s.isFloat:
+			m.writeLine(w, "", strconv.FormatFloat(s.float, 'g', -1, 64), s.labels)
+		default:
+			m.writeLine(w, "", strconv.FormatUint(s.value, 10), s.labels)
+		}
+	}
+}
+
+// writeLine は名前に接尾辞を付けたサンプルを1行出力する関数
+func (m *metricFamily) writeLine(w io.Writer, suffix, value string, labels []string) {
+	var b strings.Builder
+	b.WriteString(m.name)
+	b.WriteString(suffix)
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(labels[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteString("} ")
+	b.WriteString(value)
+	b.WriteByte('\n')
+	io.WriteString(w, b.String())
+}
+
+// escapeLabel はラベル値のバックスラッシュ・引用符・改行をエスケープする関数
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// trafficCounterNames は方向別の転送統計として出力するため、etherip_counterに含めないカウンタ
+var trafficCounterNames = map[string]bool{
+	"tx_frames": true, "tx_bytes": true, "tx_errors": true, "tx_dropped": true,
+	"rx_frames": true, "rx_bytes": true, "rx_errors": true, "rx_dropped": true,
+}
+
+// writeMetrics はトンネルの転送統計とカウンタをPrometheusのテキスト形式で出力する関数
+func writeMetrics(w http.ResponseWriter, tunnels []*Tunnel) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range collectMetrics(tunnels) {
+		m.writeText(w)
+	}
+}
+
+// collectMetrics はトンネルの転送統計（ピア・VLAN IDごとを含む）とカウンタを集め、サンプルのあるメトリクスを返す関数
+func collectMetrics(tunnels []*Tunnel) []*metricFamily {
+	frames := &metricFamily{name: "etherip_frames_total", kind: "counter", help: "Frames forwarded through the tunnel."}
+	bytes := &metricFamily{name: "etherip_bytes_total", kind: "counter", help: "Bytes of inner frames forwarded through the tunnel."}
+	errors := &metricFamily{name: "etherip_errors_total", kind: "counter", help: "Raw socket send errors (tx) and TAP write errors (rx)."}
+	dropped := &metricFamily{name: "etherip_dropped_total", kind: "counter", help: "Frames dropped by filters or validation."}
+	linkSpeed := &metricFamily{name: "etherip_link_speed_bits", kind: "gauge", help: "Link speed set on the TAP by link_speed (bits/sec)."}
+	peerUp := &metricFamily{name: "etherip_peer_up", kind: "gauge", help: "Whether the peer is alive according to keepalive."}
+	peerFrames := &metricFamily{name: "etherip_peer_frames_total", kind: "counter", help: "Frames forwarded per peer."}
+	peerBytes := &metricFamily{name: "etherip_peer_bytes_total", kind: "counter", help: "Bytes of inner frames forwarded per peer."}
+	peerErrors := &metricFamily{name: "etherip_peer_errors_total", kind: "counter", help: "Send and TAP write errors per peer."}
+	peerDropped := &metricFamily{name: "etherip_peer_dropped_total", kind: "counter", help: "Frames received from the peer and dropped by filters or validation."}
+	peerChecksumChecked := &metricFamily{name: "etherip_peer_checksum_checked_total", kind: "counter", help: "Sampled inner IP packets from the peer whose checksums were verified."}
+	peerChecksumErrors := &metricFamily{name: "etherip_peer_checksum_errors_total", kind: "counter", help: "Sampled inner IP packets from the peer with a bad IPv4 header (ip) or TCP/UDP/ICMP (l4) checksum."}
+	frameSize := &metricFamily{name: "etherip_frame_size_bytes", kind: "histogram", help: "Sizes of forwarded inner frames including the Ethernet header (sampled, telemetry.frame_sizes)."}
+	peerRTT := &metricFamily{name: "etherip_peer_rtt_seconds", kind: "histogram", help: "Keepalive round-trip time on the active path (sampled, telemetry.rtt_histogram)."}
+	peerRTTLast := &metricFamily{name: "etherip_peer_rtt_last_seconds", kind: "gauge", help: "Round-trip time of the latest keepalive reply on the active path."}
+	vlanFrames := &metricFamily{name: "etherip_vlan_frames_total", kind: "counter", help: "Frames forwarded per local VLAN ID (0 is untagged)."}
+	vlanBytes := &metricFamily{name: "etherip_vlan_bytes_total", kind: "counter", help: "Bytes of inner frames forwarded per local VLAN ID."}
+	vlanDropped := &metricFamily{name: "etherip_vlan_dropped_total", kind: "counter", help: "Frames dropped by filters or validation per local VLAN ID."}
+	other := &metricFamily{name: "etherip_counter", kind: "untyped", help: "Other counters as shown by /counters."}
+
+	for _, t := range tunnels {
+		// トンネルのラベル（tap・domain指定時はdomain・運用者定義のlabels）に個別のラベルを続ける
+		base := []string{"tap", t.cfg.TapName}
+		if t.cfg.Domain != "" {
+			base = append(base, "domain", t.cfg.Domain)
+		}
+		base = append(base, labelPairs(t.cfg.Labels)...)
+		tl := func(extra ...string) []string { return append(base[:len(base):len(base)], extra...) }
+		for _, dir := range []Direction{DirTX, DirRX} {
+			d := dir.String()
+			frames.add(t.traffic[dir].frames.Load(), tl("direction", d)...)
+			bytes.add(t.traffic[dir].bytes.Load(), tl("direction", d)...)
+			errors.add(t.traffic[dir].errors.Load(), tl("direction", d)...)
+			dropped.add(t.dropped[dir].Load(), tl("direction", d)...)
+		}
+		if t.linkSpeed > 0 {
+			linkSpeed.add(uint64(t.linkSpeed)*1e6, tl()...)
+		}
+		for d, s := range t.telemetry.FrameSizes() {
+			frameSize.addHistogram(s, 1, tl("direction", d)...)
+		}
+
+		for _, peer := range t.peers {
+			up := uint64(0)
+			if peer.up.Load() {
+				up = 1
+			}
+			peerUp.add(up, tl("peer", peer.Host)...)
+			for _, dir := range []Direction{DirTX, DirRX} {
+				d := dir.String()
+				peerFrames.add(peer.traffic[dir].frames.Load(), tl("peer", peer.Host, "direction", d)...)
+				peerBytes.add(peer.traffic[dir].bytes.Load(), tl("peer", peer.Host, "direction", d)...)
+				peerErrors.add(peer.traffic[dir].errors.Load(), tl("peer", peer.Host, "direction", d)...)
+			}
+			peerDropped.add(peer.dropped.Load(), tl("peer", peer.Host, "direction", DirRX.String())...)
+			if peer.sla != nil {
+				peerRTT.addHistogram(peer.sla.rttHist.snapshot(), 1e-9, tl("peer", peer.Host)...)
+			}
+			if rtt := peer.active.Load().rtt.Load(); rtt > 0 {
+				peerRTTLast.addFloat(float64(rtt)/1e9, tl("peer", peer.Host)...)
+			}
+			if t.csum != nil {
+				peerChecksumChecked.add(peer.csum.checked.Load(), tl("peer", peer.Host)...)
+				for layer, name := range csumLayerNames {
+					peerChecksumErrors.add(peer.csum.bad[layer].Load(), tl("peer", peer.Host, "layer", name)...)
+				}
+			}
+		}
+
+		for _, v := range t.trafficBreakdown().VLANs {
+			vid := strconv.Itoa(int(v.VLAN))
+			vlanFrames.add(v.TxFrames, tl("vlan", vid, "direction", "tx")...)
+			vlanFrames.add(v.RxFrames, tl("vlan", vid, "direction", "rx")...)
+			vlanBytes.add(v.TxBytes, tl("vlan", vid, "direction", "tx")...)
+			vlanBytes.add(v.RxBytes, tl("vlan", vid, "direction", "rx")...)
+			vlanDropped.add(v.TxDropped, tl("vlan", vid, "direction", "tx")...)
+			vlanDropped.add(v.RxDropped, tl("vlan", vid, "direction", "rx")...)
+		}
+
+		counters := t.counters()
+		names := make([]string, 0, len(counters))
+		for k := range counters {
+			if !trafficCounterNames[k] {
+				names = append(names, k)
+			}
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			other.add(counters[k], tl("name", k)...)
+		}
+	}
+
+	var list []*metricFamily
+	for _, m := range []*metricFamily{frames, bytes, errors, dropped, linkSpeed, peerUp, peerFrames, peerBytes, peerErrors, peerDropped, peerChecksumChecked, peerChecksumErrors, frameSize, peerRTT, peerRTTLast, vlanFrames, vlanBytes, vlanDropped, other} {
+		if len(m.samples) > 0 {
+			list = append(list, m)
+		}
+	}
+	return list
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// legacyTunnelKeys は旧形式から移行する際にtunnelsの要素へ移すトンネル固有のキー
+var legacyTunnelKeys = []string{"tap_name", "br_name", "mtu", "dst_host", "peers"}
+
+// legacyConfigMessage は旧形式（tunnelsなし）の設定に対する非推奨メッセージ
+const legacyConfigMessage = "config without tunnels is deprecated; run 'etherip migrate' to convert it"
+
+// migrateConfig は旧形式の設定をtunnels形式へ変換したYAMLを返す関数（コメントは保持する）
+func migrateConfig(data []byte) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("config is not a YAML mapping")
+	}
+	top := doc.Content[0]
+
+	tunnel := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	var rest []*yaml.Node
+	for i := 0; i+1 < len(top.Content); i += 2 {
+		key, value := top.Content[i], top.Content[i+1]
+		switch {
+		case key.Value == "tunnels":
+			if len(value.Content) > 0 {
+				return nil, fmt.Errorf("config already uses tunnels")
+			}
+		case containsString(legacyTunnelKeys, key.Value):
+			tunnel.Content = append(tunnel.Content, key, value)
+		default:
+			rest = append(rest, key, value)
+		}
+	}
+
+	// 移したキーのコメントはtunnelsの見出しとしては残さない
+	for i := 0; i < len(tunnel.Content); i += 2 {
+		tunnel.Content[i].HeadComment = ""
+	}
+	tunnelsKey := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "tunnels", HeadComment: "# Tunnels (migrated from the flat config)"}
+	tunnels := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Content: []*yaml.Node{tunnel}}
+	top.Content = append(rest, tunnelsKey, tunnels)
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// containsString はスライスに文字列が含まれるかを返す関数
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// runMigrate は"migrate"サブコマンドを実行し、終了コードを返す関数
+func runMigrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	path := fs.String("c", "config.yaml", "変換する設定ファイルのパス")
+	out := fs.String("o", "", "書き出し先（空で標準出力）")
+	fs.Parse(args)
+
+	data, err := os.ReadFile(*path)
+	if err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+		return 1
+	}
+	converted, err := migrateConfig(data)
+	if err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+		return 1
+	}
+	if *out == "" {
+		os.Stdout.Write(converted)
+		return 0
+	}
+	if err := os.WriteFile(*out, converted, 0600); err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Converted %s to %s\n", *path, *out)
+	return 0
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// MigrationConfigはアンダーレイをIPv4からIPv6へ（またはその逆へ）移行する間、同じピアへ両ファミリで張る設定を保持する
+type MigrationConfig struct {
+	IPv4 string `yaml:"ipv4"` // IPv4経路の宛先（ホスト名またはIP、空でdst_hostを解決）
+	IPv6 string `yaml:"ipv6"` // IPv6経路の宛先（ホスト名またはIP、空でdst_hostを解決）
+}
+
+// enabled は移行用の宛先が設定されているか返す関数
+func (mc MigrationConfig) enabled() bool {
+	return mc.IPv4 != "" || mc.IPv6 != ""
+}
+
+// familyHost はピアの指定アドレスファミリの経路で解決する宛先を返す関数
+//
+// migrationでそのファミリの宛先が指定されていればdst_hostの代わりにそれを使う。
+func (cfg *Config) familyHost(host string, version int) string {
+	if host != cfg.DstHost {
+		return host
+	}
+	if version == 4 && cfg.Migration.IPv4 != "" {
+		return cfg.Migration.IPv4
+	}
+	if version == 6 && cfg.Migration.IPv6 != "" {
+		return cfg.Migration.IPv6
+	}
+	return host
+}
+
+// checkMigration はmigrationの宛先がdst_host・アドレスファミリと矛盾しないか確認する関数
+func checkMigration(cfg *Config) error {
+	if cfg.DstHost == "" {
+		return fmt.Errorf("dst_host is required (names the peer being migrated)")
+	}
+	for _, f := range []struct {
+		version int
+		host    string
+	}{{4, cfg.Migration.IPv4}, {6, cfg.Migration.IPv6}} {
+		ip := net.ParseIP(f.host)
+		if ip != nil && (ip.To4() != nil) != (f.version == 4) {
+			return fmt.Errorf("ipv%d %s is not an IPv%d address", f.version, f.host, f.version)
+		}
+	}
+	return nil
+}
+
+// newMigrationPeer はdst_hostのピアをファミリごとの宛先で生成する関数
+//
+// 経路の並びはソケットと同じく version のファミリが先頭（主系）、もう一方が副系となる。
+func newMigrationPeer(cfg *Config, socks []*Socket) (*Peer, error) {
+	var paths []*Path
+	for _, s := range socks {
+		host := cfg.familyHost(cfg.DstHost, s.Version)
+		p, err := newPaths(host, []*Socket{s}, true)
+		if err != nil {
+			logf("[WARN]", "Migration: IPv%d path to %s unavailable, skipping: %v", s.Version, host, err)
+			continue
+		}
+		paths = append(paths, p...)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no usable path to %s", cfg.DstHost)
+	}
+	peer := &Peer{Host: cfg.DstHost, paths: paths}
+	peer.active.Store(peer.paths[0])
+	peer.up.Store(true)
+	for _, p := range paths {
+		logf("[INFO]", "Migration: IPv%d path to %s via %s", p.Version, cfg.DstHost, p.Host)
+	}
+	return peer, nil
+}
+
+// MigrationStatusは移行中のピア1台分の主系ファミリと経路の状態
+type MigrationStatus struct {
+	Host    string       `json:"host"`
+	Primary int          `json:"primary"` // 送信に優先するアドレスファミリ
+	Active  int          `json:"active"`  // 送信に使用中の経路のアドレスファミリ
+	Paths   []PathStatus `json:"paths"`
+}
+
+// PathStatusは経路1本分の状態
+type PathStatus struct {
+	Version int    `json:"version"`
+	Host    string `json:"host"`
+	Dst     string `json:"dst"`
+	Up      bool   `json:"up"`
+}
+
+// primaryVersion はピアが送信に優先するアドレスファミリを返す関数
+func (peer *Peer) primaryVersion() int {
+	if v := int(peer.primary.Load()); v != 0 {
+		return v
+	}
+	return peer.paths[0].Version
+}
+
+// orderedPaths は主系ファミリの経路を先頭に並べ替えた経路一覧を返す関数（ファミリ内の順序は保つ）
+func (peer *Peer) orderedPaths() []*Path {
+	v := int(peer.primary.Load())
+	if v == 0 || peer.paths[0].Version == v {
+		return peer.paths
+	}
+	paths := make([]*Path, 0, len(peer.paths))
+	for _, p := range peer.paths {
+		if p.Version == v {
+			paths = append(paths, p)
+		}
+	}
+	for _, p := range peer.paths {
+		if p.Version != v {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// setPrimary は送信に優先するアドレスファミリを切り替え、直ちに送信経路を選び直す関数
+//
+// 切り替え先の経路が生きていれば failback を待たずに移る（再起動までの一時的な変更）。
+func (peer *Peer) setPrimary(version int) error {
+	target := peer.pathFor(version)
+	if target == nil {
+		return fmt.Errorf("peer %s has no IPv%d path", peer.Host, version)
+	}
+	peer.primary.Store(int32(version))
+	logf("[UPDATE]", "Migration: %s primary family set to IPv%d", peer.Host, version)
+	if target.up.Load() {
+		target.upSince.Store(0)
+	}
+	now := time.Now()
+	peer.selectActivePath(now)
+	controlTrace.primary(peer, version, now)
+	return nil
+}
+
+// migrationStatus は両ファミリの経路を持つピアの移行状態を返す関数
+func (t *Tunnel) migrationStatus() []MigrationStatus {
+	list := []MigrationStatus{}
+	for _, peer := range t.peers {
+		if peer.pathFor(4) == nil || peer.pathFor(6) == nil {
+			continue
+		}
+		st := MigrationStatus{Host: peer.Host, Primary: peer.primaryVersion(), Active: peer.active.Load().Version}
+		for _, p := range peer.orderedPaths() {
+			st.Paths = append(st.Paths, PathStatus{
+				Version: p.Version,
+				Host:    p.Host,
+				Dst:     p.Dst.Load().(net.IP).String(),
+				Up:      p.up.Load(),
+			})
+		}
+		list = append(list, st)
+	}
+	return list
+}
+
+// handleMigration は移行状態の参照（GET）と主系ファミリの切り替え（POST ?primary=4|6[&peer=host]）を行うハンドラ
+func (t *Tunnel) handleMigration(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, t.migrationStatus())
+	case http.MethodPost:
+		q := r.URL.Query()
+		version, err := strconv.Atoi(q.Get("primary"))
+		if err != nil || (version != 4 && version != 6) {
+			http.Error(w, "primary must be 4 or 6", http.StatusBadRequest)
+			return
+		}
+		host, matched := q.Get("peer"), false
+		for _, peer := range t.peers {
+			// ピア未指定時は切り替え先のファミリの経路を持つピアのみ対象とする
+			if (host != "" && host != peer.Host) || (host == "" && peer.pathFor(version) == nil) {
+				continue
+			}
+			matched = true
+			if err := peer.setPrimary(version); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+		}
+		if !matched {
+			http.Error(w, fmt.Sprintf("no peer with an IPv%d path", version), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, t.migrationStatus())
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// リモートミラー関連の定数定義
+const (
+	mirrorEncapERSPAN  = "erspan"  // GRE + ERSPAN Type II（IPプロトコル47）
+	mirrorEncapEtherIP = "etherip" // EtherIP（IPプロトコル97、トンネルのRAWソケットを共用）
+
+	greProto          = 47
+	greFlagSeq        = 0x1000 // GREヘッダのSビット（シーケンス番号あり）
+	greTypeERSPAN     = 0x88BE // ERSPAN Type II
+	erspanHeaderLen   = 8 + 8  // GRE(シーケンス番号付き) + ERSPAN Type II
+	erspanVersion     = 1      // Type II
+	erspanEnPreserved = 3      // 元のVLANタグをフレーム内にそのまま残す
+	mirrorQueueSize   = 1024   // 送信キューの長さ
+)
+
+// MirrorConfigは選別・サンプリングしたフレームを遠隔のコレクタへ送るリモートミラーの設定を保持する
+type MirrorConfig struct {
+	Collector string `yaml:"collector"`  // 送信先のホスト名またはIP（空で無効）
+	Encap     string `yaml:"encap"`      // カプセル化（erspan, etherip）
+	SessionID int    `yaml:"session_id"` // ERSPANのセッションID（0〜1023）
+	Direction string `yaml:"direction"`  // 対象方向（tx, rx, both）
+	Filter    string `yaml:"filter"`     // 対象フレームを選ぶフィルタ式（captureと同じ書式）
+	Sample    int    `yaml:"sample"`     // N件に1件だけ送る（0と1は全件）
+	Snaplen   int    `yaml:"snaplen"`    // フレームの切り詰め長（0で切り詰めない）
+}
+
+// mirrorはフィルタチェーンで観測したフレームの複製をカプセル化してコレクタへ送る
+type mirror struct {
+	encap   string
+	session uint32
+	tx, rx  bool
+	match   captureFilter
+	sample  *sampler
+	snaplen int
+	conn    *net.IPConn
+	dst     *net.IPAddr
+	queue   chan []byte
+	seq     atomic.Uint32 // GREのシーケンス番号
+
+	mirrored atomic.Uint64 // 送信したフレーム数
+	dropped  atomic.Uint64 // 送信キューが一杯で送れなかった数
+	errors   atomic.Uint64 // 送信エラー数
+}
+
+// newMirror はリモートミラーの設定から生成する関数（collectorが空ならnilを返す）
+//
+// etherip時はトンネルの同じアドレスファミリのRAWソケットで送り、erspan時はGRE用のRAWソケットを開く。
+func newMirror(cfg *Config, socks []*Socket) (*mirror, error) {
+	mc := cfg.Mirror
+	if mc.Collector == "" {
+		return nil, nil
+	}
+	m := &mirror{encap: mc.Encap, session: uint32(mc.SessionID), snaplen: mc.Snaplen}
+	if m.encap == "" {
+		m.encap = mirrorEncapERSPAN
+	}
+	if m.encap != mirrorEncapERSPAN && m.encap != mirrorEncapEtherIP {
+		return nil, fmt.Errorf("unknown encap %q (erspan, etherip)", mc.Encap)
+	}
+	if mc.SessionID < 0 || mc.SessionID > 1023 {
+		return nil, fmt.Errorf("session_id %d out of range (0-1023)", mc.SessionID)
+	}
+	if mc.Snaplen < 0 || (mc.Snaplen > 0 && mc.Snaplen < 14) {
+		return nil, fmt.Errorf("snaplen %d must be 0 or at least 14", mc.Snaplen)
+	}
+	var ok bool
+	if m.tx, m.rx, ok = parseDirections(mc.Direction); !ok {
+		return nil, fmt.Errorf("invalid direction %q (tx, rx or both)", mc.Direction)
+	}
+	var err error
+	if m.match, err = compileCaptureFilter(mc.Filter); err != nil {
+		return nil, fmt.Errorf("filter: %w", err)
+	}
+	enabled := true
+	m.sample = newSampler(SamplingConfig{Enabled: &enabled, Sample: mc.Sample}, true)
+	if socks == nil {
+		return m, nil // 設定の検証のみ
+	}
+
+	// 宛先のアドレスファミリはIP指定ならそのまま、名前なら優先ファミリで解決する
+	version := cfg.Version
+	if ip := net.ParseIP(mc.Collector); ip != nil {
+		version = 6
+		if ip.To4() != nil {
+			version = 4
+		}
+	}
+	ip, err := resolveDst(mc.Collector, version)
+	if err != nil {
+		return nil, err
+	}
+	m.dst = &net.IPAddr{IP: ip}
+
+	var sock *Socket
+	for _, s := range socks {
+		if s.Version == version {
+			sock = s
+		}
+	}
+	if sock == nil {
+		return nil, fmt.Errorf("no IPv%d socket on %s for collector %s", version, cfg.SrcIface, mc.Collector)
+	}
+	if m.encap == mirrorEncapEtherIP {
+		m.conn = sock.Conn
+	} else {
+		if m.conn, err = net.ListenIP(fmt.Sprintf("ip%d:%d", version, greProto), &net.IPAddr{IP: sock.SrcIP}); err != nil {
+			return nil, fmt.Errorf("GRE socket: %w", err)
+		}
+		discardReceive(m.conn)
+		registerCleanup(func() { m.conn.Close() })
+	}
+	m.queue = make(chan []byte, mirrorQueueSize)
+	return m, nil
+}
+
+// Filter は対象のフレームを複製して送信キューへ積む（フレームは常に通過させる）
+func (m *mirror) Filter(dir Direction, frame []byte) ([]byte, Verdict) {
+	if (dir == DirTX && !m.tx) || (dir == DirRX && !m.rx) {
+		return frame, VerdictPass
+	}
+	if m.match != nil {
+		if f, ok := parseFrameFields(frame); !ok || !m.match(f) {
+			return frame, VerdictPass
+		}
+	}
+	if !m.sample.hit() {
+		return frame, VerdictPass
+	}
+
+	select {
+	case m.queue <- m.encapsulate(dir, frame):
+	default:
+		m.dropped.Add(1)
+	}
+	return frame, VerdictPass
+}
+
+// encapsulate はフレームを切り詰めてERSPANまたはEtherIPでカプセル化する関数
+//
+// ERSPAN Type IIには方向の欄がないため、Indexに1（TAP → ピア）か2（ピア → TAP）を入れる。
+func (m *mirror) encapsulate(dir Direction, frame []byte) []byte {
+	truncated := m.snaplen > 0 && len(frame) > m.snaplen
+	if truncated {
+		frame = frame[:m.snaplen]
+	}
+	if m.encap == mirrorEncapEtherIP {
+		return buildEtherIPPacket(frame)
+	}
+
+	pkt := make([]byte, erspanHeaderLen+len(frame))
+	binary.BigEndian.PutUint16(pkt[0:], greFlagSeq)
+	binary.BigEndian.PutUint16(pkt[2:], greTypeERSPAN)
+	binary.BigEndian.PutUint32(pkt[4:], m.seq.Add(1)-1)
+	word := uint32(erspanVersion)<<28 | uint32(erspanEnPreserved)<<11 | m.session
+	if truncated {
+		word |= 1 << 10
+	}
+	binary.BigEndian.PutUint32(pkt[8:], word)
+	index := uint32(1)
+	if dir == DirRX {
+		index = 2
+	}
+	binary.BigEndian.PutUint32(pkt[12:], index)
+	copy(pkt[erspanHeaderLen:], frame)
+	return pkt
+}
+
+// run は送信キューのパケットをコレクタへ送る関数
+func (m *mirror) run() {
+	logf("[INFO]", "Mirroring frames to %s (%s) via %s", m.dst, m.encap, m.conn.LocalAddr())
+	for pkt := range m.queue {
+		if _, err := m.conn.WriteTo(pkt, m.dst); err != nil {
+			m.errors.Add(1)
+			continue
+		}
+		m.mirrored.Add(1)
+	}
+}
+
+// Counters はミラーの送信数・破棄数を返す
+func (m *mirror) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"mirror_frames":  m.mirrored.Load(),
+		"mirror_dropped": m.dropped.Load(),
+		"mirror_errors":  m.errors.Load(),
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// MQTT関連の定数定義
+const (
+	mqttDefaultInterval = 30 * time.Second // 発行間隔の既定値
+	mqttDialTimeout     = 10 * time.Second // ブローカー接続のタイムアウト
+)
+
+// MQTTConfigはMQTTブローカーへのステータス発行の設定を保持する
+type MQTTConfig struct {
+	Broker   string `yaml:"broker"`    // "tcp://host:1883" または "tls://host:8883"（空で無効）
+	ClientID string `yaml:"client_id"` // クライアントID
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Topic    string `yaml:"topic"`    // トピックの接頭辞（/status, /countersを付けて発行）
+	Interval string `yaml:"interval"` // 発行間隔
+}
+
+// MQTTStatusは<topic>/statusへ発行するトンネル状態
+type MQTTStatus struct {
+	Tap    string            `json:"tap"`
+	Tenant string            `json:"tenant,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Up     bool              `json:"up"`
+	Peers  []PeerStatus      `json:"peers,omitempty"`
+	Time   int64             `json:"time"`
+}
+
+// mqttPublisherはMQTT 3.1.1でステータスとカウンタを発行する（QoS 0のみ）
+type mqttPublisher struct {
+	t        *Tunnel
+	cfg      MQTTConfig
+	addr     string
+	useTLS   bool
+	host     string
+	interval time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// newMQTTPublisher はMQTT設定を検証して発行器を生成する関数
+func newMQTTPublisher(t *Tunnel, cfg MQTTConfig) (*mqttPublisher, error) {
+	u, err := url.Parse(cfg.Broker)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &mqttPublisher{t: t, cfg: cfg, addr: u.Host, host: u.Hostname(), interval: mqttDefaultInterval}
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		if u.Port() == "" {
+			m.addr = net.JoinHostPort(u.Hostname(), "1883")
+		}
+	case "tls", "ssl", "mqtts":
+		m.useTLS = true
+		if u.Port() == "" {
+			m.addr = net.JoinHostPort(u.Hostname(), "8883")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported broker scheme %q (tcp or tls)", u.Scheme)
+	}
+
+	if cfg.Interval != "" {
+		if m.interval, err = time.ParseDuration(cfg.Interval); err != nil {
+			return nil, err
+		}
+		if m.interval <= 0 {
+			return nil, fmt.Errorf("interval must be positive")
+		}
+	}
+	if cfg.Password != "" && cfg.Username == "" {
+		// MQTT 3.1.1ではユーザー名なしのパスワードはプロトコル違反
+		return nil, fmt.Errorf("password requires username")
+	}
+	if m.cfg.Topic == "" {
+		m.cfg.Topic = "etherip/" + t.cfg.TapName
+		if t.cfg.Tenant != "" {
+			m.cfg.Topic = "etherip/" + t.cfg.Tenant + "/" + t.cfg.TapName
+		}
+	}
+	if m.cfg.ClientID == "" {
+		hostname, _ := os.Hostname()
+		m.cfg.ClientID = "etherip-" + hostname + "-" + t.cfg.TapName
+	}
+	return m, nil
+}
+
+// mqttString はMQTTの長さ付き文字列を追加する関数
+func mqttString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// mqttPacket は固定ヘッダ（種別と残り長）を付けてパケットを組み立てる関数
+func mqttPacket(header byte, body []byte) []byte {
+	pkt := []byte{header}
+	n := len(body)
+	for {
+		d := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			d |= 0x80
+		}
+		pkt = append(pkt, d)
+		if n == 0 {
+			break
+		}
+	}
+	return append(pkt, body...)
+}
+
+// statusPayload は現在のトンネル状態をJSONにする関数
+func (m *mqttPublisher) statusPayload(up bool) []byte {
+	st := MQTTStatus{Tap: m.t.cfg.TapName, Tenant: m.t.cfg.Tenant, Labels: m.t.cfg.Labels, Up: up, Time: time.Now().Unix()}
+	if up {
+		st.Peers = m.t.peerStatus()
+	}
+	data, _ := json.Marshal(st)
+	return data
+}
+
+// connect はブローカーへ接続する関数（切断時の状態をLast Willとして登録する）
+func (m *mqttPublisher) connect() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: mqttDialTimeout}
+	var conn net.Conn
+	var err error
+	if m.useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", m.addr, &tls.Config{ServerName: m.host})
+	} else {
+		conn, err = dialer.Dial("tcp", m.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// clean session + will(retain, QoS 0)
+	flags := byte(0x02 | 0x04 | 0x20)
+	if m.cfg.Username != "" {
+		flags |= 0x80
+	}
+	if m.cfg.Password != "" {
+		flags |= 0x40
+	}
+	keepalive := min(2*m.interval/time.Second, 0xFFFF)
+
+	body := mqttString(nil, "MQTT")
+	body = append(body, 4, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(keepalive))
+	body = mqttString(body, m.cfg.ClientID)
+	body = mqttString(body, m.cfg.Topic+"/status")
+	body = mqttString(body, string(m.statusPayload(false)))
+	if m.cfg.Username != "" {
+		body = mqttString(body, m.cfg.Username)
+	}
+	if m.cfg.Password != "" {
+		body = mqttString(body, m.cfg.Password)
+	}
+
+	conn.SetDeadline(time.Now().Add(mqttDialTimeout))
+	if _, err := conn.Write(mqttPacket(0x10, body)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ack := make([]byte, 4)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if ack[0] != 0x20 || ack[3] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("connection refused (code %d)", ack[3])
+	}
+	conn.SetDeadline(time.Time{})
+
+	// PINGRESP等の受信を読み捨て、切断を検知する
+	go func() {
+		io.Copy(io.Discard, bufio.NewReader(conn))
+		m.mu.Lock()
+		if m.conn == conn {
+			m.conn = nil
+		}
+		m.mu.Unlock()
+		conn.Close()
+	}()
+	return conn, nil
+}
+
+// publish はQoS 0でメッセージを発行する関数（未接続なら接続する）
+func (m *mqttPublisher) publish(topic string, payload []byte, retain bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn == nil {
+		conn, err := m.connect()
+		if err != nil {
+			return err
+		}
+		logf("[INFO]", "MQTT connected to %s", m.addr)
+		m.conn = conn
+	}
+
+	header := byte(0x30)
+	if retain {
+		header |= 0x01
+	}
+	body := append(mqttString(nil, topic), payload...)
+	m.conn.SetWriteDeadline(time.Now().Add(mqttDialTimeout))
+	if _, err := m.conn.Write(mqttPacket(header, body)); err != nil {
+		m.conn.Close()
+		m.conn = nil
+		return err
+	}
+	return nil
+}
+
+// publishAll はステータス（retain）とカウンタを発行する関数
+func (m *mqttPublisher) publishAll() error {
+	if err := m.publish(m.cfg.Topic+"/status", m.statusPayload(true), true); err != nil {
+		return err
+	}
+	counters, _ := json.Marshal(m.t.counters())
+	return m.publish(m.cfg.Topic+"/counters", counters, false)
+}
+
+// run は発行間隔ごとにステータスとカウンタを発行する関数
+func (m *mqttPublisher) run() {
+	logf("[INFO]", "MQTT publishing to %s (topic %s, interval %v)", m.addr, m.cfg.Topic, m.interval)
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		if err := m.publishAll(); err != nil {
+			logf("[WARN]", "MQTT publish to %s failed: %v", m.addr, err)
+		}
+		<-ticker.C
+	}
+}
+
+// close は停止状態を発行してブローカーから切断する関数
+func (m *mqttPublisher) close() {
+	m.mu.Lock()
+	connected := m.conn != nil
+	m.mu.Unlock()
+	if !connected {
+		return
+	}
+
+	m.publish(m.cfg.Topic+"/status", m.statusPayload(false), true)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn != nil {
+		m.conn.Write([]byte{0xE0, 0x00})
+		m.conn.Close()
+		m.conn = nil
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NDプロキシ関連の定数定義
+const (
+	ndProxyDefaultLifetime   = 30 * time.Second
+	ndProxyDefaultMaxEntries = 4096
+
+	icmpv6NS        = 135
+	icmpv6NA        = 136
+	ndOptTargetLL   = 2
+	ndFlagRouter    = 0x80
+	ndFlagSolicited = 0x40
+	ndFlagOverride  = 0x20
+)
+
+// NDProxyConfigはトンネル越しに観測した近隣探索の結果をキャッシュし、ローカルの要請へ代理応答する設定を保持する
+type NDProxyConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	Lifetime   string `yaml:"lifetime"`    // キャッシュの有効期間（既定30s）
+	MaxEntries int    `yaml:"max_entries"` // キャッシュの最大エントリ数（既定4096）
+}
+
+// ndKeyはNDキャッシュのキー（VLANごとに別のセグメントとして扱う）
+type ndKey struct {
+	vid    uint16
+	target [16]byte
+}
+
+// ndEntryはトンネル越しに観測した近隣広告を保持する
+type ndEntry struct {
+	mac     [6]byte
+	router  bool
+	expires int64 // UnixNano
+}
+
+// ndProxyはトンネルから受信した近隣広告(NA)を記録し、TAPから来たマルチキャストの近隣要請(NS)に代理で応答するフィルタ
+//
+// 遅延の大きい回線で多数のIPv6ホストが同じアドレスを繰り返し解決する際のND往復を減らす。
+// 到達性確認（ユニキャストのNS）と重複アドレス検出（送信元::のNS）は常にトンネルへ通す。
+type ndProxy struct {
+	write    func([]byte) (int, error) // 代理応答をTAPへ書き込む
+	lifetime time.Duration
+	max      int
+
+	mu    sync.Mutex
+	cache map[ndKey]ndEntry
+
+	learned  atomic.Uint64 // キャッシュに記録した近隣広告の数
+	answered atomic.Uint64 // 代理応答した近隣要請の数
+	missed   atomic.Uint64 // キャッシュになくトンネルへ通した近隣要請の数
+	errors   atomic.Uint64 // 代理応答の書き込みエラー数
+}
+
+// newNDProxy は設定からNDプロキシを生成する関数（無効ならnilを返す）
+func newNDProxy(cfg NDProxyConfig, write func([]byte) (int, error)) (*ndProxy, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	p := &ndProxy{write: write, lifetime: ndProxyDefaultLifetime, max: ndProxyDefaultMaxEntries, cache: make(map[ndKey]ndEntry)}
+	if cfg.Lifetime != "" {
+		d, err := time.ParseDuration(cfg.Lifetime)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid lifetime %q", cfg.Lifetime)
+		}
+		p.lifetime = d
+	}
+	if cfg.MaxEntries < 0 {
+		return nil, fmt.Errorf("max_entries %d must not be negative", cfg.MaxEntries)
+	} else if cfg.MaxEntries > 0 {
+		p.max = cfg.MaxEntries
+	}
+	logf("[INFO]", "ND proxy enabled (lifetime %v, max %d entries)", p.lifetime, p.max)
+	return p, nil
+}
+
+// parseND はフレームがIPv6の近隣要請・近隣広告であれば、VLAN ID・IPv6ヘッダの位置・ICMPv6タイプを返す関数
+func parseND(frame []byte) (vid uint16, off int, typ byte, ok bool) {
+	if len(frame) < 14 {
+		return 0, 0, 0, false
+	}
+	off = 12
+	et := binary.BigEndian.Uint16(frame[off:])
+	for (et == tpid8021Q || et == tpid8021AD) && len(frame) >= off+vlanTagLen+2 {
+		vid = binary.BigEndian.Uint16(frame[off+2:]) & 0x0FFF
+		off += vlanTagLen
+		et = binary.BigEndian.Uint16(frame[off:])
+	}
+	off += 2
+	// 近隣探索はホップ限界255・拡張ヘッダなしのICMPv6のみ（RFC 4861 7.1）
+	if et != 0x86DD || len(frame) < off+40+24 {
+		return 0, 0, 0, false
+	}
+	ip := frame[off:]
+	if ip[6] != 58 || ip[7] != 255 || ip[40+1] != 0 {
+		return 0, 0, 0, false
+	}
+	typ = ip[40]
+	return vid, off, typ, typ == icmpv6NS || typ == icmpv6NA
+}
+
+// ndOption はNDメッセージのオプションから指定の種類のリンク層アドレスを探す関数
+func ndOption(opts []byte, kind byte) ([]byte, bool) {
+	for len(opts) >= 8 {
+		n := int(opts[1]) * 8
+		if n == 0 || n > len(opts) {
+			return nil, false
+		}
+		if opts[0] == kind {
+			return opts[2:8], true
+		}
+		opts = opts[n:]
+	}
+	return nil, false
+}
+
+// learn はトンネルから受信した近隣広告の対象アドレスとMACアドレスを記録する関数
+func (p *ndProxy) learn(vid uint16, frame []byte, off int, now int64) {
+	ip := frame[off:]
+	msg := ip[40:]
+	target := net.IP(msg[8:24])
+	if target.IsMulticast() || target.IsUnspecified() {
+		return
+	}
+	key := ndKey{vid: vid}
+	copy(key.target[:], target)
+	e := ndEntry{router: msg[4]&ndFlagRouter != 0, expires: now + int64(p.lifetime)}
+	if mac, ok := ndOption(msg[24:], ndOptTargetLL); ok {
+		copy(e.mac[:], mac)
+	} else {
+		copy(e.mac[:], frame[6:12])
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.cache[key]; !ok && len(p.cache) >= p.max {
+		// 満杯なら期限切れを掃除し、それでも空きがなければ記録しない
+		for k, old := range p.cache {
+			if old.expires <= now {
+				delete(p.cache, k)
+			}
+		}
+		if len(p.cache) >= p.max {
+			return
+		}
+	}
+	p.cache[key] = e
+	p.learned.Add(1)
+}
+
+// lookup は有効期間内のキャッシュを返す関数
+func (p *ndProxy) lookup(key ndKey, now int64) (ndEntry, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.cache[key]
+	if !ok {
+		return ndEntry{}, false
+	}
+	if e.expires <= now {
+		delete(p.cache, key)
+		return ndEntry{}, false
+	}
+	return e, true
+}
+
+// ndAnswer はTAPから来た近隣要請に対する近隣広告を組み立てる関数
+//
+// 要請のVLANタグを引き継ぎ、対象アドレスの所有者が応答したのと同じ形式（S・Oフラグと対象リンク層アドレス）にする。
+func ndAnswer(frame []byte, off int, e ndEntry) []byte {
+	ns := frame[off:]
+	out := make([]byte, off+40+32)
+	copy(out[0:6], frame[6:12]) // 要請の送信元へ
+	copy(out[6:12], e.mac[:])
+	copy(out[12:off], frame[12:off])
+
+	ip := out[off:]
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:6], 32)
+	ip[6] = 58
+	ip[7] = 255
+	copy(ip[8:24], ns[40+8:40+24]) // 対象アドレスから
+	copy(ip[24:40], ns[8:24])      // 要請の送信元アドレスへ
+
+	msg := ip[40:]
+	msg[0] = icmpv6NA
+	msg[4] = ndFlagSolicited | ndFlagOverride
+	if e.router {
+		msg[4] |= ndFlagRouter
+	}
+	copy(msg[8:24], ns[40+8:40+24])
+	msg[24] = ndOptTargetLL
+	msg[25] = 1
+	copy(msg[26:32], e.mac[:])
+	binary.BigEndian.PutUint16(msg[2:4], icmpv6Checksum(ip[8:24], ip[24:40], msg))
+	return out
+}
+
+// icmpv6Checksum は疑似ヘッダを含むICMPv6のチェックサムを計算する関数
+func icmpv6Checksum(src, dst net.IP, msg []byte) uint16 {
+	b := make([]byte, 0, 40+len(msg)+1)
+	b = append(b, src.To16()...)
+	b = append(b, dst.To16()...)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(msg)))
+	b = append(b, 0, 0, 0, 58)
+	b = append(b, msg...)
+	if len(msg)%2 == 1 {
+		b = append(b, 0)
+	}
+	return ipv4Checksum(b)
+}
+
+// Filter はトンネルから受信した近隣広告を記録し、キャッシュにある近隣要請へTAP側で応答する
+func (p *ndProxy) Filter(dir Direction, frame []byte) ([]byte, Verdict) {
+	vid, off, typ, ok := parseND(frame)
+	if !ok {
+		return frame, VerdictPass
+	}
+	now := time.Now().UnixNano()
+	if dir == DirRX {
+		if typ == icmpv6NA {
+			p.learn(vid, frame, off, now)
+		}
+		return frame, VerdictPass
+	}
+
+	ip := frame[off:]
+	if typ != icmpv6NS || !net.IP(ip[24:40]).IsMulticast() || net.IP(ip[8:24]).IsUnspecified() {
+		return frame, VerdictPass
+	}
+	key := ndKey{vid: vid}
+	copy(key.target[:], ip[40+8:40+24])
+	e, ok := p.lookup(key, now)
+	if !ok {
+		p.missed.Add(1)
+		return frame, VerdictPass
+	}
+	if _, err := p.write(ndAnswer(frame, off, e)); err != nil {
+		p.errors.Add(1)
+		return frame, VerdictPass
+	}
+	p.answered.Add(1)
+	return nil, VerdictDrop
+}
+
+// Counters は記録・代理応答した近隣探索の数とキャッシュのエントリ数を返す
+func (p *ndProxy) Counters() map[string]uint64 {
+	p.mu.Lock()
+	entries := len(p.cache)
+	p.mu.Unlock()
+	return map[string]uint64{
+		"nd_learned":  p.learned.Load(),
+		"nd_answered": p.answered.Load(),
+		"nd_missed":   p.missed.Load(),
+		"nd_errors":   p.errors.Load(),
+		"nd_entries":  uint64(entries),
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// negotiateの設定値
+const (
+	negotiateOff    = "off"    // 能力を交換するのみで照合しない（既定）
+	negotiateWarn   = "warn"   // 不一致をERRORログ・イベントで通知し、転送は続ける
+	negotiateStrict = "strict" // 不一致の間はそのピアとのフレームの転送を止める
+)
+
+// Capabilitiesはハンドシェイクで交換するデータパスの設定（両端で一致しないとフレームが壊れる・破棄されるもの）
+type Capabilities struct {
+	IfMode      string `json:"ifmode"`
+	MTU         int    `json:"mtu"`
+	Encap       string `json:"encap"`
+	Auth        bool   `json:"auth"`
+	Sequence    bool   `json:"sequence"`
+	Compression string `json:"compression,omitempty"` // 圧縮方式（無効なら省略）
+	LoopGuard   bool   `json:"loop_guard"`
+	Split       bool   `json:"split,omitempty"` // 経路MTUを超えるパケットを分割して送る（oversize.action: split）
+	Reassembly  bool   `json:"reassembly"`      // 分割されたパケットを再構成できる
+}
+
+// negotiatorは対向から受け取った能力を自身の設定と照合する
+type negotiator struct {
+	strict bool
+
+	mismatches atomic.Uint64    // 不一致を検出した回数
+	blocked    [2]atomic.Uint64 // strictで転送しなかったフレーム数（方向別）
+}
+
+// parseNegotiate はnegotiateの設定値を検証する関数
+func parseNegotiate(mode string) (string, error) {
+	switch mode {
+	case "", negotiateOff:
+		return negotiateOff, nil
+	case negotiateWarn, negotiateStrict:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown negotiate %q (off, warn, strict)", mode)
+}
+
+// newNegotiator は能力の照合を設定する関数（offならnilを返す）
+func newNegotiator(mode string) (*negotiator, error) {
+	mode, err := parseNegotiate(mode)
+	if err != nil || mode == negotiateOff {
+		return nil, err
+	}
+	return &negotiator{strict: mode == negotiateStrict}, nil
+}
+
+// localCapabilities は自身のデータパスの設定を能力として返す関数
+func (t *Tunnel) localCapabilities() *Capabilities {
+	c := &Capabilities{
+		IfMode:     t.cfg.IfMode,
+		MTU:        t.cfg.MTU,
+		Encap:      t.cfg.Encap,
+		Auth:       t.auth != nil,
+		Sequence:   t.seq != nil,
+		LoopGuard:  t.loopGuard != nil,
+		Split:      t.oversize != nil && t.oversize.action == oversizeSplit,
+		Reassembly: true,
+	}
+	if c.IfMode == "" {
+		c.IfMode = "tap"
+	}
+	if c.Encap == "" {
+		c.Encap = "etherip"
+	}
+	if t.comp != nil {
+		c.Compression = t.cfg.Compression.Algorithm
+	}
+	return c
+}
+
+// diffCapabilities は両端の能力の不一致を列挙する関数（一致すれば空）
+//
+// 圧縮方式は受信側がどちらも展開できるため、有効・無効のみを照合する。
+// 分割は受信側が常に再構成するため、再構成できない旧版の対向へ分割して送る場合のみ不一致とする。
+func diffCapabilities(local, remote *Capabilities) []string {
+	var diffs []string
+	if local.IfMode != remote.IfMode {
+		diffs = append(diffs, fmt.Sprintf("ifmode %s here, %s on peer", local.IfMode, remote.IfMode))
+	}
+	if local.MTU != remote.MTU {
+		diffs = append(diffs, fmt.Sprintf("mtu %d here, %d on peer", local.MTU, remote.MTU))
+	}
+	if local.Encap != remote.Encap {
+		diffs = append(diffs, fmt.Sprintf("encap %s here, %s on peer", local.Encap, remote.Encap))
+	}
+	onOff := func(name string, here, there bool) {
+		if here != there {
+			diffs = append(diffs, fmt.Sprintf("%s %s here, %s on peer", name, enabledWord(here), enabledWord(there)))
+		}
+	}
+	onOff("auth", local.Auth, remote.Auth)
+	onOff("sequence", local.Sequence, remote.Sequence)
+	onOff("compression", local.Compression != "", remote.Compression != "")
+	onOff("loop_guard", local.LoopGuard, remote.LoopGuard)
+	if local.Split && !remote.Reassembly {
+		diffs = append(diffs, "split here, peer cannot reassemble")
+	}
+	if remote.Split && !local.Reassembly {
+		diffs = append(diffs, "split on peer, cannot reassemble here")
+	}
+	return diffs
+}
+
+// enabledWord は有効・無効をログ用の語にする関数
+func enabledWord(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// check は対向の能力を照合し、不一致の発生・解消をログとイベントで通知する関数
+//
+// 能力を送ってこない旧版の対向は照合できないため、strictでも転送を止めない。
+func (n *negotiator) check(t *Tunnel, peer *Peer, remote *Capabilities) {
+	if remote == nil {
+		if peer.negotiated.CompareAndSwap(false, true) {
+			logf("[WARN]", "Peer %s does not advertise capabilities (older etherip-go); not verified", peer.Host)
+		}
+		return
+	}
+	peer.negotiated.Store(true)
+	reason := strings.Join(diffCapabilities(t.localCapabilities(), remote), ", ")
+	prev := peer.mismatch.Load()
+	switch {
+	case reason != "" && (prev == nil || *prev != reason):
+		n.mismatches.Add(1)
+		peer.mismatch.Store(&reason)
+		if n.strict {
+			logf("[ERROR]", "Capability mismatch with peer %s: %s; forwarding to and from the peer stopped", peer.Host, reason)
+		} else {
+			logf("[ERROR]", "Capability mismatch with peer %s: %s", peer.Host, reason)
+		}
+		t.events.emit("capability_mismatch", peer.Host, reason)
+	case reason == "" && prev != nil:
+		peer.mismatch.Store(nil)
+		logf("[RESET]", "Capabilities of peer %s now match", peer.Host)
+		t.events.emit("capability_match", peer.Host, "")
+	}
+}
+
+// blocks はstrictで不一致のピアとのフレームを止めるか判定する関数（止めたら数える）
+func (n *negotiator) blocks(peer *Peer, dir Direction) bool {
+	if n == nil || !n.strict || peer.mismatch.Load() == nil {
+		return false
+	}
+	n.blocked[dir].Add(1)
+	return true
+}
+
+// Counters は能力の不一致の検出回数と止めたフレーム数を返す関数
+func (n *negotiator) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"capability_mismatches": n.mismatches.Load(),
+		"tx_capability_blocked": n.blocked[DirTX].Load(),
+		"rx_capability_blocked": n.blocked[DirRX].Load(),
+	}
+}
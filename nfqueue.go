@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// NFQueueConfigはNFQUEUEによる検査フックの設定を保持する
+type NFQueueConfig struct {
+	Num       int    `yaml:"num"`       // キュー番号（0で無効）
+	Direction string `yaml:"direction"` // 対象方向（tx, rx, both）
+	Bypass    bool   `yaml:"bypass"`    // キューの消費者がいない場合に通過させるか
+}
+
+// nfqueueTable はTAPごとにデーモンが管理するnftablesテーブル名を返す関数
+func nfqueueTable(tapName string) string {
+	return "etherip_" + strings.ReplaceAll(tapName, "-", "_")
+}
+
+// installNFQueue はTAPを通過するフレームをNFQUEUEへ送るbridgeファミリのルールを設定する関数
+//
+// rx方向はトンネルから出てブリッジへ入るフレーム（iifname）、tx方向はブリッジから
+// トンネルへ入るフレーム（oifname）が対象となる。キューの消費者（Suricata等）の
+// 判定でdropされたフレームはブリッジへ届かない。
+func installNFQueue(tapName string, cfg NFQueueConfig) error {
+	tx, rx, ok := parseDirections(cfg.Direction)
+	if !ok {
+		return fmt.Errorf("invalid direction %q (tx, rx or both)", cfg.Direction)
+	}
+
+	queue := fmt.Sprintf("queue num %d", cfg.Num)
+	if cfg.Bypass {
+		queue += " bypass"
+	}
+
+	table := nfqueueTable(tapName)
+	var b strings.Builder
+	// 既存テーブルを作り直して冪等にする
+	fmt.Fprintf(&b, "table bridge %s {}\ndelete table bridge %s\n", table, table)
+	fmt.Fprintf(&b, "table bridge %s {\n", table)
+	if rx {
+		fmt.Fprintf(&b, "  chain rx { type filter hook prerouting priority -200; iifname %q %s; }\n", tapName, queue)
+	}
+	if tx {
+		fmt.Fprintf(&b, "  chain tx { type filter hook postrouting priority -200; oifname %q %s; }\n", tapName, queue)
+	}
+	b.WriteString("}\n")
+
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(b.String())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		logf("[ERROR]", "Failed to install NFQUEUE rules: %v: %s", err, strings.TrimSpace(string(out)))
+		return err
+	}
+	logf("[INFO]", "NFQUEUE %d hooked on %s (tx=%v rx=%v bypass=%v)", cfg.Num, tapName, tx, rx, cfg.Bypass)
+	return nil
+}
+
+// removeNFQueue はinstallNFQueueで設定したテーブルを削除する関数
+func removeNFQueue(tapName string) {
+	table := nfqueueTable(tapName)
+	if err := exec.Command("nft", "delete", "table", "bridge", table).Run(); err != nil {
+		logf("[WARN]", "Failed to remove nftables table %s: %v", table, err)
+		return
+	}
+	logf("[INFO]", "NFQUEUE rules for %s removed", tapName)
+}
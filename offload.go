@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// offload.modeの設定値
+const (
+	offloadOff = "off"
+	offloadTC  = "tc"  // TAPのegressとsrc_ifaceのingressにtc（clsact）のeBPFプログラムを付ける
+	offloadXDP = "xdp" // 未対応（XDPはTAP → 物理インターフェースの向きに付けられない）
+)
+
+const (
+	offloadPinDir   = "/sys/fs/bpf/tc/globals" // tcがLIBBPF_PIN_BY_NAMEのマップをピン留めするディレクトリ
+	offloadPref     = "97"                     // tcフィルタの優先度（EtherIPのプロトコル番号）
+	offloadInterval = time.Second              // マップの同期・統計の読み出し間隔
+)
+
+// OffloadConfigはeBPFによるカーネル内でのカプセル化・カプセル化解除の設定を保持する
+type OffloadConfig struct {
+	Mode   string `yaml:"mode"`   // off, tc（空でoff）
+	Object string `yaml:"object"` // bpf/etherip_tc.cをビルドしたオブジェクトファイル
+}
+
+// parseOffload はoffloadの設定値と、カーネル内で処理できない機能との組み合わせを検証する関数（有効ならtrue）
+//
+// eBPFプログラムはEtherIPヘッダだけを付け外しするため、ヘッダを加工する機能・フレームごとの状態を持つ機能とは併用できない。
+func parseOffload(cfg *Config) (bool, error) {
+	switch cfg.Offload.Mode {
+	case "", offloadOff:
+		return false, nil
+	case offloadTC:
+	case offloadXDP:
+		return false, fmt.Errorf("xdp is not supported (XDP cannot run on frames leaving the TAP); use tc")
+	default:
+		return false, fmt.Errorf("unknown mode %q (off, tc)", cfg.Offload.Mode)
+	}
+
+	switch {
+	case cfg.Offload.Object == "":
+		return false, fmt.Errorf("object is required")
+	case cfg.SrcIface == "":
+		return false, fmt.Errorf("src_iface is required (the decap program is attached to its ingress)")
+	case cfg.IfMode == ifModeTUN:
+		return false, fmt.Errorf("ifmode tun is not supported")
+	case cfg.Encap != "" && cfg.Encap != encapEtherIP:
+		return false, fmt.Errorf("encap %s is not supported", cfg.Encap)
+	case len(cfg.peerHosts()) > 1:
+		return false, fmt.Errorf("multiple peers are not supported (the kernel program has no FDB)")
+	case isAFPacket(cfg.Datapath):
+		return false, fmt.Errorf("datapath af_packet is not supported (the ring would see offloaded packets too)")
+	case cfg.Auth.Enabled, cfg.Sequence.Enabled, cfg.LoopGuard.Enabled:
+		return false, fmt.Errorf("auth, sequence and loop_guard are not supported")
+	case cfg.Compression.Algorithm != "" && cfg.Compression.Algorithm != "off":
+		return false, fmt.Errorf("compression is not supported")
+	case cfg.QoS.CopyInnerDSCP || cfg.QoS.FlowLabel != "":
+		return false, fmt.Errorf("qos.copy_inner_dscp and qos.flow_label are not supported (qos.dscp is)")
+	case cfg.OuterHopLimit.RXMin > 0:
+		return false, fmt.Errorf("outer_hop_limit.rx_min is not supported")
+	}
+	if _, err := os.Stat(cfg.Offload.Object); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// offloadIngressはdecapプログラムを付けたsrc_iface（同じインターフェースを使う複数のトンネルで共有）
+var offloadIngress struct {
+	sync.Mutex
+	ifaces map[string]bool
+}
+
+// offloaderはeBPFマップへ宛先・送信元を書き込み、カーネル内の転送統計を読み出す（制御プレーン）
+type offloader struct {
+	t       *Tunnel
+	tap     int // TAPのifindex
+	oif     int // src_ifaceのifindex
+	ttl     byte
+	tos     byte
+	tapName string
+
+	mu sync.Mutex      // 同期と終了時の削除の排他
+	tx []byte          // 書き込み済みの送信設定（未設定ならnil）
+	rx map[string]bool // 書き込み済みの受信キー（hex）
+	st [6]uint64       // 前回読み出した統計
+
+	txFrames    atomic.Uint64
+	txBytes     atomic.Uint64
+	txFallback  atomic.Uint64
+	rxFrames    atomic.Uint64
+	rxBytes     atomic.Uint64
+	rxPassed    atomic.Uint64
+	syncErrors  atomic.Uint64
+	lastSyncErr atomic.Value // 最後の同期エラー（string、ログの重複抑制用）
+}
+
+// newOffloader はtcにeBPFプログラムを付け、マップの同期を準備する関数（offload無効ならnil）
+func newOffloader(t *Tunnel, cfg *Config) (*offloader, error) {
+	enabled, err := parseOffload(cfg)
+	if err != nil || !enabled {
+		return nil, err
+	}
+	tap, err := net.InterfaceByName(cfg.TapName)
+	if err != nil {
+		return nil, err
+	}
+	phys, err := net.InterfaceByName(cfg.SrcIface)
+	if err != nil {
+		return nil, err
+	}
+	o := &offloader{
+		t:       t,
+		tap:     tap.Index,
+		oif:     phys.Index,
+		ttl:     byte(cfg.OuterHopLimit.TX),
+		tos:     byte(cfg.QoS.DSCP << 2),
+		tapName: cfg.TapName,
+		rx:      make(map[string]bool),
+	}
+
+	if err := tcAttach(cfg.TapName, "egress", cfg.Offload.Object, "tc/encap"); err != nil {
+		return nil, err
+	}
+	registerShutdown(o.remove)
+	offloadIngress.Lock()
+	defer offloadIngress.Unlock()
+	if !offloadIngress.ifaces[cfg.SrcIface] {
+		if err := tcAttach(cfg.SrcIface, "ingress", cfg.Offload.Object, "tc/decap"); err != nil {
+			return nil, err
+		}
+		if offloadIngress.ifaces == nil {
+			offloadIngress.ifaces = make(map[string]bool)
+		}
+		offloadIngress.ifaces[cfg.SrcIface] = true
+		iface := cfg.SrcIface
+		registerShutdown(func() { tcDetach(iface, "ingress") })
+	}
+	logf("[INFO]", "eBPF offload: encap on %s egress, decap on %s ingress (%s)", cfg.TapName, cfg.SrcIface, cfg.Offload.Object)
+	return o, nil
+}
+
+// run は経路の変化をマップへ反映し、統計を読み出し続ける関数
+func (o *offloader) run() {
+	ticker := time.NewTicker(offloadInterval)
+	defer ticker.Stop()
+	for {
+		o.sync()
+		<-ticker.C
+	}
+}
+
+// sync は使用中の経路の宛先・送信元をマップへ書き込み、カーネル内で転送した分を統計へ加える関数
+//
+// 送信設定は使用中の経路のみ、受信キーはピアの全経路（予備の宛先・別ファミリを含む）を書き込む。
+// 経路が落ちている・送信元が未確定の間は送信設定を消し、デーモンの送信（破棄・再送判断）に任せる。
+func (o *offloader) sync() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	peer := o.t.peers[0]
+	key := o.tapKey()
+
+	var tx []byte
+	if p := peer.active.Load(); p.up.Load() && !p.recursing.Load() {
+		src, _ := p.SrcIP.Load().(net.IP)
+		dst, _ := p.Dst.Load().(net.IP)
+		if src != nil && !src.IsUnspecified() && dst != nil {
+			tx = o.txValue(p.Version, src, dst)
+		}
+	}
+	if string(tx) != string(o.tx) {
+		var err error
+		if tx == nil {
+			err = bpfMapDelete("etherip_tx", key)
+		} else {
+			err = bpfMapUpdate("etherip_tx", key, tx)
+		}
+		if o.check("etherip_tx", err) {
+			o.tx = tx
+		}
+	}
+
+	want := make(map[string]bool)
+	for _, p := range peer.paths {
+		src, _ := p.SrcIP.Load().(net.IP)
+		dst, _ := p.Dst.Load().(net.IP)
+		if src == nil || src.IsUnspecified() || dst == nil {
+			continue
+		}
+		k := hex.EncodeToString(rxKey(p.Version, dst, src))
+		want[k] = true
+		if o.rx[k] {
+			continue
+		}
+		b, _ := hex.DecodeString(k)
+		if o.check("etherip_rx", bpfMapUpdate("etherip_rx", b, binary.NativeEndian.AppendUint32(nil, uint32(o.tap)))) {
+			o.rx[k] = true
+		}
+	}
+	for k := range o.rx {
+		if want[k] {
+			continue
+		}
+		b, _ := hex.DecodeString(k)
+		if o.check("etherip_rx", bpfMapDelete("etherip_rx", b)) {
+			delete(o.rx, k)
+		}
+	}
+
+	// 統計はeBPFプログラムが初めて処理したときに作られる
+	v, err := bpfMapLookup("etherip_stats", key)
+	if err != nil || len(v) < 48 {
+		return
+	}
+	var st [6]uint64
+	for i := range st {
+		st[i] = binary.NativeEndian.Uint64(v[i*8:])
+	}
+	d := func(i int) uint64 { return st[i] - o.st[i] }
+	o.txFrames.Add(d(0))
+	o.txBytes.Add(d(1))
+	o.txFallback.Add(d(2))
+	o.rxFrames.Add(d(3))
+	o.rxBytes.Add(d(4))
+	o.rxPassed.Add(d(5))
+	// 統計・メトリクスにカーネル内で転送した分も含めるよう、トンネルとピアの転送数にも加える
+	for _, c := range []*trafficCounter{&o.t.traffic[DirTX], &peer.traffic[DirTX]} {
+		c.frames.Add(d(0))
+		c.bytes.Add(d(1))
+	}
+	for _, c := range []*trafficCounter{&o.t.traffic[DirRX], &peer.traffic[DirRX]} {
+		c.frames.Add(d(3))
+		c.bytes.Add(d(4))
+	}
+	o.st = st
+}
+
+// check はマップ操作の失敗を数え、同じエラーの連続はログを1度だけ出す関数（成功ならtrue）
+func (o *offloader) check(name string, err error) bool {
+	if err == nil {
+		o.lastSyncErr.Store("")
+		return true
+	}
+	o.syncErrors.Add(1)
+	msg := fmt.Sprintf("%s: %v", name, err)
+	if prev, _ := o.lastSyncErr.Swap(msg).(string); prev != msg {
+		logf("[WARN]", "eBPF offload map update failed: %s", msg)
+	}
+	return false
+}
+
+// remove はTAPのeBPFプログラムとこのトンネルのマップのエントリを削除する関数
+func (o *offloader) remove() {
+	tcDetach(o.tapName, "egress")
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	key := o.tapKey()
+	if o.tx != nil {
+		bpfMapDelete("etherip_tx", key)
+	}
+	bpfMapDelete("etherip_stats", key)
+	for k := range o.rx {
+		b, _ := hex.DecodeString(k)
+		bpfMapDelete("etherip_rx", b)
+	}
+	logf("[INFO]", "eBPF offload on %s removed", o.tapName)
+}
+
+// tapKey はTAPのifindexをマップのキー（u32、ホストのバイトオーダー）にする関数
+func (o *offloader) tapKey() []byte {
+	return binary.NativeEndian.AppendUint32(nil, uint32(o.tap))
+}
+
+// txValue はstruct tx_cfgを組み立てる関数
+func (o *offloader) txValue(version int, src, dst net.IP) []byte {
+	b := binary.NativeEndian.AppendUint32(make([]byte, 0, 40), uint32(o.oif))
+	b = append(b, byte(version), o.ttl, o.tos, 0)
+	return append(append(b, offloadAddr(version, src)...), offloadAddr(version, dst)...)
+}
+
+// rxKey はstruct rx_keyを組み立てる関数（saddrはピア、daddrは自身のアドレス）
+func rxKey(version int, saddr, daddr net.IP) []byte {
+	b := []byte{byte(version), 0, 0, 0}
+	return append(append(b, offloadAddr(version, saddr)...), offloadAddr(version, daddr)...)
+}
+
+// offloadAddr はアドレスを16バイトの欄に詰める関数（IPv4は先頭4バイト）
+func offloadAddr(version int, ip net.IP) []byte {
+	b := make([]byte, 16)
+	if version == 4 {
+		copy(b, ip.To4())
+	} else {
+		copy(b, ip.To16())
+	}
+	return b
+}
+
+// Counters はカーネル内の転送数とマップの同期失敗数を返す関数
+func (o *offloader) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"offload_tx_frames":   o.txFrames.Load(),
+		"offload_tx_bytes":    o.txBytes.Load(),
+		"offload_tx_fallback": o.txFallback.Load(),
+		"offload_rx_frames":   o.rxFrames.Load(),
+		"offload_rx_bytes":    o.rxBytes.Load(),
+		"offload_rx_passed":   o.rxPassed.Load(),
+		"offload_sync_errors": o.syncErrors.Load(),
+	}
+}
+
+// tcAttach はclsact qdiscを用意し、オブジェクトファイルのセクションをdirect-actionのフィルタとして付ける関数
+func tcAttach(dev, dir, object, section string) error {
+	if out, err := exec.Command("tc", "qdisc", "replace", "dev", dev, "clsact").CombinedOutput(); err != nil {
+		return fmt.Errorf("tc qdisc clsact on %s: %v: %s", dev, err, strings.TrimSpace(string(out)))
+	}
+	args := []string{"filter", "replace", "dev", dev, dir, "pref", offloadPref, "handle", "1",
+		"bpf", "direct-action", "object-file", object, "section", section}
+	if out, err := exec.Command("tc", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("tc filter %s on %s %s: %v: %s", section, dev, dir, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// tcDetach はtcAttachで付けたフィルタを削除する関数（clsact qdiscは他の利用者のため残す）
+func tcDetach(dev, dir string) {
+	if out, err := exec.Command("tc", "filter", "del", "dev", dev, dir, "pref", offloadPref).CombinedOutput(); err != nil {
+		logf("[WARN]", "Failed to remove tc filter on %s %s: %v: %s", dev, dir, err, strings.TrimSpace(string(out)))
+	}
+}
+
+// bpftoolの引数に渡すバイト列（"hex 01 02 ..."）
+func bpftoolBytes(b []byte) []string {
+	args := []string{"hex"}
+	for _, c := range b {
+		args = append(args, fmt.Sprintf("%02x", c))
+	}
+	return args
+}
+
+// bpfMapUpdate はピン留めされたマップへエントリを書き込む関数
+func bpfMapUpdate(name string, key, value []byte) error {
+	args := append([]string{"map", "update", "pinned", filepath.Join(offloadPinDir, name), "key"}, bpftoolBytes(key)...)
+	args = append(append(args, "value"), bpftoolBytes(value)...)
+	if out, err := exec.Command("bpftool", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// bpfMapDelete はピン留めされたマップからエントリを削除する関数（存在しなくてもエラーにしない）
+func bpfMapDelete(name string, key []byte) error {
+	args := append([]string{"map", "delete", "pinned", filepath.Join(offloadPinDir, name), "key"}, bpftoolBytes(key)...)
+	out, err := exec.Command("bpftool", args...).CombinedOutput()
+	if err != nil && !strings.Contains(string(out), "No such file") {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// bpfMapLookup はピン留めされたマップのエントリの値を読む関数
+func bpfMapLookup(name string, key []byte) ([]byte, error) {
+	args := append([]string{"-j", "map", "lookup", "pinned", filepath.Join(offloadPinDir, name), "key"}, bpftoolBytes(key)...)
+	out, err := exec.Command("bpftool", args...).Output()
+	if err != nil {
+		return nil, err
+	}
+	var entry struct {
+		Value []string `json:"value"` // "0x01" 形式のバイト列
+	}
+	if err := json.Unmarshal(out, &entry); err != nil {
+		return nil, err
+	}
+	value := make([]byte, len(entry.Value))
+	for i, s := range entry.Value {
+		v, err := strconv.ParseUint(s, 0, 8)
+		if err != nil {
+			return nil, err
+		}
+		value[i] = byte(v)
+	}
+	return value, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import "encoding/binary"
+
+// FNV-1aの定数
+const (
+	fnvOffset32 = 2166136261
+	fnvPrime32  = 16777619
+)
+
+// fnvAdd はFNV-1aハッシュにバイト列を加える関数
+func fnvAdd(h uint32, b []byte) uint32 {
+	for _, c := range b {
+		h ^= uint32(c)
+		h *= fnvPrime32
+	}
+	return h
+}
+
+// flowHash はフレームのフロー（MACアドレス対、IPアドレス対、TCP/UDPポート）のハッシュ値を返す関数
+//
+// IPv4の断片はポートを含めずに計算し、同じパケットの断片を同じワーカーに揃える。
+func flowHash(frame []byte) uint32 {
+	h := uint32(fnvOffset32)
+	if len(frame) < 14 {
+		return h
+	}
+	h = fnvAdd(h, frame[0:12])
+
+	off := 12
+	et := binary.BigEndian.Uint16(frame[off:])
+	for (et == tpid8021Q || et == tpid8021AD) && len(frame) >= off+vlanTagLen+2 {
+		h = fnvAdd(h, frame[off+2:off+4])
+		off += vlanTagLen
+		et = binary.BigEndian.Uint16(frame[off:])
+	}
+	ip := frame[off+2:]
+
+	switch {
+	case et == 0x0800 && len(ip) >= 20:
+		h = fnvAdd(h, ip[12:20])
+		ihl := int(ip[0]&0x0F) * 4
+		fragmented := binary.BigEndian.Uint16(ip[6:8])&0x3FFF != 0
+		if (ip[9] == 6 || ip[9] == 17) && !fragmented && len(ip) >= ihl+4 {
+			h = fnvAdd(h, ip[ihl:ihl+4])
+		}
+	case et == 0x86DD && len(ip) >= 40:
+		h = fnvAdd(h, ip[8:40])
+		if (ip[6] == 6 || ip[6] == 17) && len(ip) >= 44 {
+			h = fnvAdd(h, ip[40:44])
+		}
+	}
+	return h
+}
+
+// recvQueue は受信パケットを渡すキューを選ぶ関数
+//
+// フロー順序保証時は同じフローを常に同じワーカーへ渡す。圧縮フレームは中身を
+// 見られないため、ピア単位で振り分ける。
+func (t *Tunnel) recvQueue(peer *Peer, payload []byte, compressed bool) chan Packet {
+	n := len(t.recvChans)
+	if n == 1 {
+		return t.recvChans[0]
+	}
+	if compressed {
+		for i, p := range t.peers {
+			if p == peer {
+				return t.recvChans[i%n]
+			}
+		}
+		return t.recvChans[0]
+	}
+	return t.recvChans[flowHash(payload)%uint32(n)]
+}
+
+// recvQueueLen は受信キュー全体の滞留数と容量を返す関数
+func (t *Tunnel) recvQueueLen() (int, int) {
+	length, capacity := 0, 0
+	for _, ch := range t.recvChans {
+		length += len(ch)
+		capacity += cap(ch)
+	}
+	return length, capacity
+}
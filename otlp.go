@@ -0,0 +1,824 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OpenTelemetry（OTLP）関連の定数定義
+const (
+	otlpDefaultInterval = time.Minute      // OTEL_METRIC_EXPORT_INTERVALの既定値
+	otlpDefaultTimeout  = 10 * time.Second // OTEL_EXPORTER_OTLP_TIMEOUTの既定値
+	otlpSpanDelay       = 5 * time.Second  // スパンをまとめて送る間隔
+	otlpMaxQueuedSpans  = 2048             // 送信待ちのスパンの上限（超えた分は捨てる）
+	otlpScopeName       = "etherip"
+
+	otlpProtocolGRPC     = "grpc"
+	otlpProtocolProtobuf = "http/protobuf" // 既定
+	otlpProtocolJSON     = "http/json"
+
+	otlpTemporalityCumulative = 2 // AggregationTemporality
+	otlpSpanInternal          = 1 // SpanKind
+	otlpSpanClient            = 3
+	otlpStatusError           = 2 // Status.code
+)
+
+// otlpSignalsはシグナルごとのHTTPのパスとgRPCのメソッド
+var otlpSignals = map[string]struct{ path, method string }{
+	"metrics": {"/v1/metrics", "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"},
+	"traces":  {"/v1/traces", "/opentelemetry.proto.collector.trace.v1.TraceService/Export"},
+}
+
+// otlpUnitsはメトリクス名の接尾辞とOTLPの単位（UCUM）
+var otlpUnits = []struct{ suffix, unit string }{
+	{"_bytes", "By"},
+	{"_seconds", "s"},
+	{"_bits", "bit/s"},
+}
+
+// otlpEndpointはシグナル1つ（metrics, traces）の送信先
+type otlpEndpoint struct {
+	signal   string
+	url      string
+	protocol string
+	headers  map[string]string
+	gzip     bool
+	client   *http.Client
+	failing  atomic.Bool // 直前の送信が失敗した（失敗と復旧だけをログ出力する）
+}
+
+// otlpSettingsはOTEL_*環境変数から読んだOTLPの送信設定
+type otlpSettings struct {
+	metrics, traces *otlpEndpoint // nilで送らない
+	interval        time.Duration
+	resource        []otlpKeyValue
+}
+
+// parseOTLPEnv はOTEL_*環境変数からOTLPの送信設定を読む関数
+//
+// シグナルごとにOTEL_{METRICS,TRACES}_EXPORTER=otlpか送信先（OTEL_EXPORTER_OTLP_ENDPOINTまたはシグナル別）の指定で有効になり、
+// noneまたはOTEL_SDK_DISABLED=trueで無効になる。送信先・プロトコル・ヘッダ等はシグナル別の値を優先する。
+func parseOTLPEnv(getenv func(string) string) (*otlpSettings, error) {
+	s := &otlpSettings{interval: otlpDefaultInterval}
+	if disabled, _ := strconv.ParseBool(getenv("OTEL_SDK_DISABLED")); disabled {
+		return s, nil
+	}
+	for _, signal := range []string{"metrics", "traces"} {
+		key := "OTEL_" + strings.ToUpper(signal) + "_EXPORTER"
+		switch exporter := getenv(key); exporter {
+		case "none":
+			continue
+		case "":
+			if getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && getenv("OTEL_EXPORTER_OTLP_"+strings.ToUpper(signal)+"_ENDPOINT") == "" {
+				continue
+			}
+		case "otlp":
+		default:
+			return nil, fmt.Errorf("%s: unsupported exporter %q (otlp, none)", key, exporter)
+		}
+		e, err := parseOTLPEndpoint(getenv, signal)
+		if err != nil {
+			return nil, err
+		}
+		if signal == "metrics" {
+			s.metrics = e
+		} else {
+			s.traces = e
+		}
+	}
+	if v := getenv("OTEL_METRIC_EXPORT_INTERVAL"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms <= 0 {
+			return nil, fmt.Errorf("OTEL_METRIC_EXPORT_INTERVAL: %q is not a positive number of milliseconds", v)
+		}
+		s.interval = time.Duration(ms) * time.Millisecond
+	}
+
+	attrs := map[string]string{"service.name": "etherip", "service.version": daemonVersion()}
+	if host, err := os.Hostname(); err == nil {
+		attrs["host.name"] = host
+	}
+	custom, err := parseOTLPPairs("OTEL_RESOURCE_ATTRIBUTES", getenv("OTEL_RESOURCE_ATTRIBUTES"))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range custom {
+		attrs[k] = v
+	}
+	if name := getenv("OTEL_SERVICE_NAME"); name != "" {
+		attrs["service.name"] = name
+	}
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s.resource = append(s.resource, otlpKeyValue{Key: k, Value: otlpValue{StringValue: attrs[k]}})
+	}
+	return s, nil
+}
+
+// parseOTLPEndpoint はシグナル1つの送信先をOTEL_EXPORTER_OTLP_*から読む関数
+func parseOTLPEndpoint(getenv func(string) string, signal string) (*otlpEndpoint, error) {
+	prefix := "OTEL_EXPORTER_OTLP_" + strings.ToUpper(signal) + "_"
+	env := func(key string) (string, string) {
+		if v := getenv(prefix + key); v != "" {
+			return prefix + key, v
+		}
+		return "OTEL_EXPORTER_OTLP_" + key, getenv("OTEL_EXPORTER_OTLP_" + key)
+	}
+
+	e := &otlpEndpoint{signal: signal, protocol: otlpProtocolProtobuf}
+	if key, v := env("PROTOCOL"); v != "" {
+		if v != otlpProtocolGRPC && v != otlpProtocolProtobuf && v != otlpProtocolJSON {
+			return nil, fmt.Errorf("%s: unsupported protocol %q (grpc, http/protobuf, http/json)", key, v)
+		}
+		e.protocol = v
+	}
+	insecure := false
+	if key, v := env("INSECURE"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %q is not a boolean", key, v)
+		}
+		insecure = b
+	}
+
+	// シグナル別の送信先はそのまま、共通の送信先にはシグナルのパスを付ける（gRPCはパスを使わない）
+	key, raw := prefix+"ENDPOINT", getenv(prefix+"ENDPOINT")
+	perSignal := raw != ""
+	if !perSignal {
+		key, raw = "OTEL_EXPORTER_OTLP_ENDPOINT", getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+	if raw == "" {
+		raw = "http://localhost:4318"
+		if e.protocol == otlpProtocolGRPC {
+			raw = "http://localhost:4317"
+		}
+	}
+	if e.protocol == otlpProtocolGRPC && !strings.Contains(raw, "://") {
+		if insecure {
+			raw = "http://" + raw
+		} else {
+			raw = "https://" + raw
+		}
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%s: %q is not an http or https URL", key, raw)
+	}
+	switch {
+	case e.protocol == otlpProtocolGRPC:
+		u.Path = otlpSignals[signal].method
+	case !perSignal:
+		u.Path = strings.TrimSuffix(u.Path, "/") + otlpSignals[signal].path
+	}
+	e.url = u.String()
+
+	headerKey, headers := env("HEADERS")
+	if e.headers, err = parseOTLPPairs(headerKey, headers); err != nil {
+		return nil, err
+	}
+	timeout := otlpDefaultTimeout
+	if key, v := env("TIMEOUT"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms <= 0 {
+			return nil, fmt.Errorf("%s: %q is not a positive number of milliseconds", key, v)
+		}
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+	switch key, v := env("COMPRESSION"); v {
+	case "", "none":
+	case "gzip":
+		e.gzip = true
+	default:
+		return nil, fmt.Errorf("%s: unsupported compression %q (gzip, none)", key, v)
+	}
+
+	// TLS（CA・クライアント証明書）
+	tlsCfg := &tls.Config{}
+	if key, v := env("CERTIFICATE"); v != "" {
+		pem, err := os.ReadFile(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		tlsCfg.RootCAs = x509.NewCertPool()
+		if !tlsCfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates in %s", key, v)
+		}
+	}
+	certKey, cert := env("CLIENT_CERTIFICATE")
+	keyKey, keyFile := env("CLIENT_KEY")
+	if (cert == "") != (keyFile == "") {
+		return nil, fmt.Errorf("%s and %s must be set together", certKey, keyKey)
+	}
+	if cert != "" {
+		pair, err := tls.LoadX509KeyPair(cert, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", certKey, err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{pair}
+	}
+
+	tr := &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsCfg, ForceAttemptHTTP2: true}
+	if e.protocol == otlpProtocolGRPC && u.Scheme == "http" {
+		// 平文のgRPCはHTTP/2を直接話す（h2c）
+		if err := enableH2C(tr); err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	e.client = &http.Client{Timeout: timeout, Transport: tr}
+	return e, nil
+}
+
+// parseOTLPPairs は "key1=value1,key2=value2" 形式（値はURLエンコード）の環境変数を読む関数
+func parseOTLPPairs(key, v string) (map[string]string, error) {
+	pairs := make(map[string]string)
+	for _, item := range strings.Split(v, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%s: %q is not key=value", key, item)
+		}
+		decoded, err := url.QueryUnescape(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", key, name, err)
+		}
+		pairs[name] = decoded
+	}
+	return pairs, nil
+}
+
+// otlpExporterはメトリクスを定期的に、制御プレーンの操作のスパンをまとめてOTLPで送る
+type otlpExporter struct {
+	*otlpSettings
+	start time.Time // 累積値の起点
+
+	mu      sync.Mutex
+	tunnels []*Tunnel
+	spans   []otlpSpan
+	dropped uint64 // 上限を超えて捨てたスパンの数
+}
+
+// otlp はOpenTelemetryの送信先（nilなら無効）
+var otlp *otlpExporter
+
+// startOTLP はOTEL_*環境変数を読み、有効ならスパンの送信を始める関数（メトリクスはwatchで始める）
+func startOTLP() error {
+	s, err := parseOTLPEnv(os.Getenv)
+	if err != nil {
+		return err
+	}
+	if s.metrics == nil && s.traces == nil {
+		return nil
+	}
+	o := &otlpExporter{otlpSettings: s, start: time.Now()}
+	otlp = o
+	if s.traces != nil {
+		logf("[INFO]", "OpenTelemetry traces to %s (%s)", s.traces.url, s.traces.protocol)
+		go func() {
+			for range time.Tick(otlpSpanDelay) {
+				o.flushSpans()
+			}
+		}()
+	}
+	return nil
+}
+
+// watch はトンネルのメトリクスの定期送信を始める関数
+//
+// 終了時はトンネルを閉じる前に残りのスパンと最後のメトリクスを送る（後から登録した後片付けが先に動く）。
+func (o *otlpExporter) watch(tunnels []*Tunnel) {
+	if o == nil {
+		return
+	}
+	registerCleanup(func() {
+		o.flushSpans()
+		o.exportMetrics()
+	})
+	if o.metrics == nil {
+		return
+	}
+	o.mu.Lock()
+	o.tunnels = tunnels
+	o.mu.Unlock()
+	logf("[INFO]", "OpenTelemetry metrics to %s every %v (%s)", o.metrics.url, o.interval, o.metrics.protocol)
+	go func() {
+		for range time.Tick(o.interval) {
+			o.exportMetrics()
+		}
+	}()
+}
+
+// exportMetrics は/metricsと同じメトリクスを累積値で送る関数
+func (o *otlpExporter) exportMetrics() {
+	if o.metrics == nil {
+		return
+	}
+	o.mu.Lock()
+	tunnels := o.tunnels
+	o.mu.Unlock()
+	if len(tunnels) == 0 {
+		return
+	}
+	metrics := otlpMetrics(collectMetrics(tunnels), o.start, time.Now())
+	o.metrics.export(&otlpRequest{ResourceMetrics: []otlpResourceData{{
+		Resource:     otlpResource{Attributes: o.resource},
+		ScopeMetrics: []otlpScopeData{{Scope: otlpScope{Name: otlpScopeName, Version: daemonVersion()}, Metrics: metrics}},
+	}}})
+}
+
+// span は制御プレーンの操作1つをスパンとして記録する関数（attrsは名前と値の組）
+func (o *otlpExporter) span(name string, kind int, start, end time.Time, err error, attrs ...string) {
+	if o == nil || o.traces == nil {
+		return
+	}
+	var id [24]byte
+	rand.Read(id[:])
+	s := otlpSpan{
+		TraceID:    hex.EncodeToString(id[:16]),
+		SpanID:     hex.EncodeToString(id[16:]),
+		Name:       name,
+		Kind:       kind,
+		StartTime:  uint64(start.UnixNano()),
+		EndTime:    uint64(end.UnixNano()),
+		Attributes: otlpAttributes(attrs),
+	}
+	if err != nil {
+		s.Status = otlpStatus{Code: otlpStatusError, Message: err.Error()}
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.spans) >= otlpMaxQueuedSpans {
+		o.dropped++
+		return
+	}
+	o.spans = append(o.spans, s)
+}
+
+// flushSpans は送信待ちのスパンを送る関数
+func (o *otlpExporter) flushSpans() {
+	if o.traces == nil {
+		return
+	}
+	o.mu.Lock()
+	spans, dropped := o.spans, o.dropped
+	o.spans, o.dropped = nil, 0
+	o.mu.Unlock()
+	if dropped > 0 {
+		logf("[WARN]", "OpenTelemetry: %d spans dropped (queue full)", dropped)
+	}
+	if len(spans) == 0 {
+		return
+	}
+	o.traces.export(&otlpRequest{ResourceSpans: []otlpResourceData{{
+		Resource:   otlpResource{Attributes: o.resource},
+		ScopeSpans: []otlpScopeData{{Scope: otlpScope{Name: otlpScopeName, Version: daemonVersion()}, Spans: spans}},
+	}}})
+}
+
+// export は送信し、失敗と復旧をログ出力する関数（送れなかった分は再送しない）
+func (e *otlpEndpoint) export(req *otlpRequest) {
+	err := e.send(req)
+	switch was := e.failing.Swap(err != nil); {
+	case err != nil && !was:
+		logf("[WARN]", "OpenTelemetry %s export to %s failed: %v", e.signal, e.url, err)
+	case err == nil && was:
+		logf("[RESET]", "OpenTelemetry %s export to %s recovered", e.signal, e.url)
+	}
+}
+
+// send はリクエストをプロトコルに合わせて符号化し、POSTする関数
+func (e *otlpEndpoint) send(req *otlpRequest) error {
+	var body []byte
+	if e.protocol == otlpProtocolJSON {
+		var err error
+		if body, err = json.Marshal(req); err != nil {
+			return err
+		}
+	} else {
+		var p protoBuf
+		req.proto(&p)
+		body = p.b
+	}
+	if e.gzip {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(body)
+		zw.Close()
+		body = buf.Bytes()
+	}
+	if e.protocol == otlpProtocolGRPC {
+		// gRPCのメッセージ枠（圧縮フラグ1バイト + 長さ4バイト）
+		frame := make([]byte, 5, 5+len(body))
+		if e.gzip {
+			frame[0] = 1
+		}
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(body)))
+		body = append(frame, body...)
+	}
+
+	hr, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	switch e.protocol {
+	case otlpProtocolGRPC:
+		hr.Header.Set("Content-Type", "application/grpc")
+		hr.Header.Set("TE", "trailers")
+		if e.gzip {
+			hr.Header.Set("Grpc-Encoding", "gzip")
+		}
+	case otlpProtocolJSON:
+		hr.Header.Set("Content-Type", "application/json")
+	default:
+		hr.Header.Set("Content-Type", "application/x-protobuf")
+	}
+	if e.gzip && e.protocol != otlpProtocolGRPC {
+		hr.Header.Set("Content-Encoding", "gzip")
+	}
+	for k, v := range e.headers {
+		hr.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(hr)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20)) // gRPCのトレーラは本文を読み切ってから届く
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	if e.protocol == otlpProtocolGRPC {
+		status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+		if status == "" {
+			status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message") // Trailers-Only
+		}
+		if status != "" && status != "0" {
+			return fmt.Errorf("grpc status %s: %s", status, message)
+		}
+	}
+	return nil
+}
+
+// otlpMetrics はメトリクスをOTLPのデータモデルに変換する関数
+//
+// counterは単調増加の累積Sum（名前の_totalを除く）、gauge・untypedはGauge、histogramは累積のHistogramにする。
+func otlpMetrics(families []*metricFamily, start, now time.Time) []otlpMetric {
+	startNs, nowNs := uint64(start.UnixNano()), uint64(now.UnixNano())
+	var list []otlpMetric
+	for _, m := range families {
+		om := otlpMetric{Name: m.name, Description: m.help}
+		if m.kind == "counter" {
+			om.Name = strings.TrimSuffix(m.name, "_total")
+		}
+		for _, u := range otlpUnits {
+			if strings.HasSuffix(om.Name, u.suffix) {
+				om.Unit = u.unit
+			}
+		}
+
+		if m.kind == "histogram" {
+			om.Histogram = &otlpHistogram{Temporality: otlpTemporalityCumulative}
+			for _, s := range m.samples {
+				dp := otlpHistogramPoint{Attributes: otlpAttributes(s.labels), StartTime: startNs, Time: nowNs,
+					Count: s.hist.Count, Sum: float64(s.hist.Sum) * s.scale, BucketCounts: s.hist.Counts}
+				for _, b := range s.hist.Bounds {
+					dp.Bounds = append(dp.Bounds, float64(b)*s.scale)
+				}
+				om.Histogram.DataPoints = append(om.Histogram.DataPoints, dp)
+			}
+			list = append(list, om)
+			continue
+		}
+
+		var points []otlpNumberPoint
+		for _, s := range m.samples {
+			dp := otlpNumberPoint{Attributes: otlpAttributes(s.labels), StartTime: startNs, Time: nowNs}
+			if s.isFloat {
+				dp.AsDouble = &s.float
+			} else {
+				v := int64(s.value)
+				dp.AsInt = &v
+			}
+			points = append(points, dp)
+		}
+		if m.kind == "counter" {
+			om.Sum = &otlpSum{DataPoints: points, Temporality: otlpTemporalityCumulative, Monotonic: true}
+		} else {
+			om.Gauge = &otlpGauge{DataPoints: points}
+		}
+		list = append(list, om)
+	}
+	return list
+}
+
+// otlpAttributes はラベル（名前と値の組）を属性にする関数（値が空の組は除く）
+func otlpAttributes(labels []string) []otlpKeyValue {
+	var attrs []otlpKeyValue
+	for i := 0; i+1 < len(labels); i += 2 {
+		if labels[i+1] == "" {
+			continue
+		}
+		attrs = append(attrs, otlpKeyValue{Key: labels[i], Value: otlpValue{StringValue: labels[i+1]}})
+	}
+	return attrs
+}
+
+// OTLPのデータモデル（JSONはOTLP/HTTPのJSON符号化、protoはProtocol Buffersの符号化）
+
+// otlpRequestはExportMetricsServiceRequest・ExportTraceServiceRequest
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceData `json:"resourceMetrics,omitempty"`
+	ResourceSpans   []otlpResourceData `json:"resourceSpans,omitempty"`
+}
+
+// otlpResourceDataはResourceMetrics・ResourceSpans
+type otlpResourceData struct {
+	Resource     otlpResource    `json:"resource"`
+	ScopeMetrics []otlpScopeData `json:"scopeMetrics,omitempty"`
+	ScopeSpans   []otlpScopeData `json:"scopeSpans,omitempty"`
+}
+
+// otlpResourceはResource
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+// otlpScopeDataはScopeMetrics・ScopeSpans
+type otlpScopeData struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics,omitempty"`
+	Spans   []otlpSpan   `json:"spans,omitempty"`
+}
+
+// otlpScopeはInstrumentationScope
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+// otlpKeyValueは属性（値は文字列のみ）
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// otlpValueはAnyValue
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// otlpMetricはMetric（Gauge・Sum・Histogramのいずれか）
+type otlpMetric struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Unit        string         `json:"unit,omitempty"`
+	Gauge       *otlpGauge     `json:"gauge,omitempty"`
+	Sum         *otlpSum       `json:"sum,omitempty"`
+	Histogram   *otlpHistogram `json:"histogram,omitempty"`
+}
+
+// otlpGaugeはGauge
+type otlpGauge struct {
+	DataPoints []otlpNumberPoint `json:"dataPoints"`
+}
+
+// otlpSumはSum
+type otlpSum struct {
+	DataPoints  []otlpNumberPoint `json:"dataPoints"`
+	Temporality int               `json:"aggregationTemporality"`
+	Monotonic   bool              `json:"isMonotonic"`
+}
+
+// otlpHistogramはHistogram
+type otlpHistogram struct {
+	DataPoints  []otlpHistogramPoint `json:"dataPoints"`
+	Temporality int                  `json:"aggregationTemporality"`
+}
+
+// otlpNumberPointはNumberDataPoint（AsInt・AsDoubleのいずれか）
+type otlpNumberPoint struct {
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+	StartTime  uint64         `json:"startTimeUnixNano"`
+	Time       uint64         `json:"timeUnixNano"`
+	AsInt      *int64         `json:"asInt,omitempty"`
+	AsDouble   *float64       `json:"asDouble,omitempty"`
+}
+
+// otlpHistogramPointはHistogramDataPoint（BucketCountsは累積ではない、最後は上限超え）
+type otlpHistogramPoint struct {
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	StartTime    uint64         `json:"startTimeUnixNano"`
+	Time         uint64         `json:"timeUnixNano"`
+	Count        uint64         `json:"count"`
+	Sum          float64        `json:"sum"`
+	BucketCounts []uint64       `json:"bucketCounts"`
+	Bounds       []float64      `json:"explicitBounds"`
+}
+
+// otlpSpanはSpan（トレースID・スパンIDは16進）
+type otlpSpan struct {
+	TraceID    string         `json:"traceId"`
+	SpanID     string         `json:"spanId"`
+	Name       string         `json:"name"`
+	Kind       int            `json:"kind"`
+	StartTime  uint64         `json:"startTimeUnixNano"`
+	EndTime    uint64         `json:"endTimeUnixNano"`
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+	Status     otlpStatus     `json:"status"`
+}
+
+// otlpStatusはStatus
+type otlpStatus struct {
+	Message string `json:"message,omitempty"`
+	Code    int    `json:"code,omitempty"`
+}
+
+// protoBufは最小限のProtocol Buffersエンコーダ（OTLPの送信に使う型のみ）
+type protoBuf struct{ b []byte }
+
+// tag はフィールド番号とワイヤ型を書く関数
+func (p *protoBuf) tag(field, wire int) { p.b = binary.AppendUvarint(p.b, uint64(field<<3|wire)) }
+
+// varint は可変長整数のフィールドを書く関数（0は省略）
+func (p *protoBuf) varint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	p.tag(field, 0)
+	p.b = binary.AppendUvarint(p.b, v)
+}
+
+// fixed64 は64ビット固定長のフィールドを書く関数
+func (p *protoBuf) fixed64(field int, v uint64) {
+	p.tag(field, 1)
+	p.b = binary.LittleEndian.AppendUint64(p.b, v)
+}
+
+// bytes は長さ付きのフィールドを書く関数
+func (p *protoBuf) bytes(field int, v []byte) {
+	p.tag(field, 2)
+	p.b = binary.AppendUvarint(p.b, uint64(len(v)))
+	p.b = append(p.b, v...)
+}
+
+// string は文字列のフィールドを書く関数（空は省略）
+func (p *protoBuf) string(field int, v string) {
+	if v != "" {
+		p.bytes(field, []byte(v))
+	}
+}
+
+// message は入れ子のメッセージを書く関数
+func (p *protoBuf) message(field int, fn func(*protoBuf)) {
+	var m protoBuf
+	fn(&m)
+	p.bytes(field, m.b)
+}
+
+// packedFixed64 は64ビット固定長の繰り返しフィールドをpackedで書く関数
+func (p *protoBuf) packedFixed64(field int, vs []uint64) {
+	if len(vs) == 0 {
+		return
+	}
+	b := make([]byte, 0, 8*len(vs))
+	for _, v := range vs {
+		b = binary.LittleEndian.AppendUint64(b, v)
+	}
+	p.bytes(field, b)
+}
+
+// proto はリクエストを符号化する関数（両シグナルともフィールド番号は同じ）
+func (r *otlpRequest) proto(p *protoBuf) {
+	for _, rd := range append(r.ResourceMetrics, r.ResourceSpans...) {
+		p.message(1, func(p *protoBuf) {
+			p.message(1, func(p *protoBuf) { protoAttributes(p, 1, rd.Resource.Attributes) })
+			for _, sd := range append(rd.ScopeMetrics, rd.ScopeSpans...) {
+				p.message(2, func(p *protoBuf) {
+					p.message(1, func(p *protoBuf) {
+						p.string(1, sd.Scope.Name)
+						p.string(2, sd.Scope.Version)
+					})
+					for _, m := range sd.Metrics {
+						p.message(2, m.proto)
+					}
+					for _, s := range sd.Spans {
+						p.message(2, s.proto)
+					}
+				})
+			}
+		})
+	}
+}
+
+// protoAttributes は属性（KeyValue）の繰り返しフィールドを書く関数
+func protoAttributes(p *protoBuf, field int, attrs []otlpKeyValue) {
+	for _, kv := range attrs {
+		p.message(field, func(p *protoBuf) {
+			p.string(1, kv.Key)
+			p.message(2, func(p *protoBuf) { p.bytes(1, []byte(kv.Value.StringValue)) })
+		})
+	}
+}
+
+// proto はMetricを符号化する関数
+func (m otlpMetric) proto(p *protoBuf) {
+	p.string(1, m.Name)
+	p.string(2, m.Description)
+	p.string(3, m.Unit)
+	switch {
+	case m.Gauge != nil:
+		p.message(5, func(p *protoBuf) {
+			for _, dp := range m.Gauge.DataPoints {
+				p.message(1, dp.proto)
+			}
+		})
+	case m.Sum != nil:
+		p.message(7, func(p *protoBuf) {
+			for _, dp := range m.Sum.DataPoints {
+				p.message(1, dp.proto)
+			}
+			p.varint(2, uint64(m.Sum.Temporality))
+			if m.Sum.Monotonic {
+				p.varint(3, 1)
+			}
+		})
+	case m.Histogram != nil:
+		p.message(9, func(p *protoBuf) {
+			for _, dp := range m.Histogram.DataPoints {
+				p.message(1, dp.proto)
+			}
+			p.varint(2, uint64(m.Histogram.Temporality))
+		})
+	}
+}
+
+// proto はNumberDataPointを符号化する関数
+func (dp otlpNumberPoint) proto(p *protoBuf) {
+	p.fixed64(2, dp.StartTime)
+	p.fixed64(3, dp.Time)
+	if dp.AsDouble != nil {
+		p.fixed64(4, math.Float64bits(*dp.AsDouble))
+	} else if dp.AsInt != nil {
+		p.fixed64(6, uint64(*dp.AsInt))
+	}
+	protoAttributes(p, 7, dp.Attributes)
+}
+
+// proto はHistogramDataPointを符号化する関数
+func (dp otlpHistogramPoint) proto(p *protoBuf) {
+	p.fixed64(2, dp.StartTime)
+	p.fixed64(3, dp.Time)
+	p.fixed64(4, dp.Count)
+	p.fixed64(5, math.Float64bits(dp.Sum))
+	p.packedFixed64(6, dp.BucketCounts)
+	bounds := make([]uint64, len(dp.Bounds))
+	for i, b := range dp.Bounds {
+		bounds[i] = math.Float64bits(b)
+	}
+	p.packedFixed64(7, bounds)
+	protoAttributes(p, 9, dp.Attributes)
+}
+
+// proto はSpanを符号化する関数
+func (s otlpSpan) proto(p *protoBuf) {
+	traceID, _ := hex.DecodeString(s.TraceID)
+	spanID, _ := hex.DecodeString(s.SpanID)
+	p.bytes(1, traceID)
+	p.bytes(2, spanID)
+	p.string(5, s.Name)
+	p.varint(6, uint64(s.Kind))
+	p.fixed64(7, s.StartTime)
+	p.fixed64(8, s.EndTime)
+	protoAttributes(p, 9, s.Attributes)
+	if s.Status.Code != 0 {
+		p.message(15, func(p *protoBuf) {
+			p.string(2, s.Status.Message)
+			p.varint(3, uint64(s.Status.Code))
+		})
+	}
+}
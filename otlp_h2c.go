@@ -0,0 +1,12 @@
+//go:build go1.24
+
+package main
+
+import "net/http"
+
+// enableH2C は平文のHTTP/2（h2c）で接続するよう設定する関数
+func enableH2C(tr *http.Transport) error {
+	tr.Protocols = new(http.Protocols)
+	tr.Protocols.SetUnencryptedHTTP2(true)
+	return nil
+}
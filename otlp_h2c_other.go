@@ -0,0 +1,13 @@
+//go:build !go1.24
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// enableH2C は平文のHTTP/2（h2c）で接続するよう設定する関数（Go 1.24未満のビルドは未対応）
+func enableH2C(tr *http.Transport) error {
+	return fmt.Errorf("grpc over plain http requires a build with Go 1.24 or later; use https or http/protobuf")
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// 設定の上書き関連の定数定義
+const (
+	overrideEnvPrefix = "ETHERIP_"
+	overrideUsage     = "設定キーの上書き" // flag.Usageで個別に表示しない目印
+)
+
+// configOverrides は環境変数・フラグで指定された設定キーの上書き（キー → YAMLの値）
+//
+// 優先順位はフラグ > 環境変数 > 設定ファイル > 既定値。
+var configOverrides = map[string]string{}
+
+// configKeys はConfigのyamlタグから上書きできる全キーを返す関数（入れ子は"pmtud.enabled"のようにドットで区切る）
+//
+// 構造体は末端のキーに展開し、リスト・マップはキー全体をYAMLで指定する。tunnelsは対象外。
+func configKeys() map[string]reflect.Type {
+	keys := make(map[string]reflect.Type)
+	var walk func(t reflect.Type, prefix string)
+	walk = func(t reflect.Type, prefix string) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, opts, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			if name == "-" || (prefix == "" && name == "tunnels") {
+				continue
+			}
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer && ft.Elem().Kind() == reflect.Struct {
+				ft = ft.Elem()
+			}
+			if opts == "inline" {
+				walk(ft, prefix)
+				continue
+			}
+			if name == "" {
+				name = strings.ToLower(f.Name)
+			}
+			if ft.Kind() == reflect.Struct && ft != reflect.TypeOf(yaml.Node{}) {
+				walk(ft, prefix+name+".")
+				continue
+			}
+			keys[prefix+name] = f.Type
+		}
+	}
+	walk(reflect.TypeOf(Config{}), "")
+	return keys
+}
+
+// overrideFlagName は設定キーに対応するフラグ名を返す関数（dst_host → dst-host）
+func overrideFlagName(key string) string {
+	return strings.ReplaceAll(key, "_", "-")
+}
+
+// overrideEnvName は設定キーに対応する環境変数名を返す関数（pmtud.enabled → ETHERIP_PMTUD_ENABLED）
+func overrideEnvName(key string) string {
+	return overrideEnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(key))
+}
+
+// loadEnvOverrides は ETHERIP_ で始まる環境変数のうち設定キーに対応するものを上書きとして読み込む関数
+//
+// 対応しない変数（ETHERIP_API_TOKENなど）は無視する。
+func loadEnvOverrides() {
+	for key := range configKeys() {
+		if v, ok := os.LookupEnv(overrideEnvName(key)); ok {
+			configOverrides[key] = v
+		}
+	}
+}
+
+// registerOverrideFlags は全設定キーを --dst-host, --pmtud.enabled のようなフラグとして登録する関数
+func registerOverrideFlags(fs *flag.FlagSet) {
+	for key, t := range configKeys() {
+		set := func(v string) error {
+			configOverrides[key] = v
+			return nil
+		}
+		// 真偽値は値を省略した --pmtud.enabled を true とみなす
+		if t.Kind() == reflect.Bool {
+			fs.BoolFunc(overrideFlagName(key), overrideUsage, set)
+		} else {
+			fs.Func(overrideFlagName(key), overrideUsage, set)
+		}
+	}
+}
+
+// overrideNode は上書きの値をキーの型に合わせたYAMLノードにする関数
+//
+// 文字列のキーは値をそのまま使い、それ以外はYAMLとして解釈する（リストは "[a, b]" のように書く）。
+func overrideNode(t reflect.Type, value string) (*yaml.Node, error) {
+	if t.Kind() == reflect.String {
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}, nil
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(value), &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: ""}, nil
+	}
+	return doc.Content[0], nil
+}
+
+// applyOverrides はトップレベルのマッピングへ上書きを反映する関数
+//
+// tunnelsの要素に同じキーを書いたトンネルでは、そちらが優先される。
+func applyOverrides(top *yaml.Node) error {
+	keys := configKeys()
+	names := make([]string, 0, len(configOverrides))
+	for key := range configOverrides {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+
+	for _, key := range names {
+		node, err := overrideNode(keys[key], configOverrides[key])
+		if err != nil {
+			return fmt.Errorf("override %s: %w", key, err)
+		}
+		m := top
+		parts := strings.Split(key, ".")
+		for _, part := range parts[:len(parts)-1] {
+			child := mappingValue(m, part)
+			if child == nil || child.Kind != yaml.MappingNode {
+				child = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+				setMappingValue(m, part, child)
+			}
+			m = child
+		}
+		setMappingValue(m, parts[len(parts)-1], node)
+		logf("[INFO]", "Config %s overridden", key)
+	}
+	return nil
+}
+
+// mappingValue はマッピングノードからキーの値を返す関数（なければnil）
+func mappingValue(m *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// setMappingValue はマッピングノードのキーの値を置き換える関数（なければ追加する）
+func setMappingValue(m *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			m.Content[i+1] = value
+			return
+		}
+	}
+	m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
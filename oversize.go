@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"etherip/header"
+)
+
+// oversize.actionの設定値
+const (
+	oversizeKernel   = "kernel"   // カーネルの既定に任せる（既定）
+	oversizeFragment = "fragment" // DFを立てず、経路MTUを超えた外側パケットはカーネルがIPフラグメント化する
+	oversizeDF       = "df"       // DFを立て、経路MTUを超えた外側パケットは送信エラーとする
+	oversizeDrop     = "drop"     // 経路MTUを超えるフレームを送信前に破棄し、ICMPで送信元へ通知する
+	oversizeSplit    = "split"    // 経路MTUに収まるようにEtherIPパケットを分割し、対向で再構成する
+)
+
+// アプリケーションレベルの分割の定数定義
+//
+// 分割したパケットはEtherIPヘッダのReservedのビットを立て、ヘッダの直後に
+// サブヘッダ（識別子u16・番号u8・分割数u8）を入れる。シーケンス番号・認証は分割後のパケットごとに付ける。
+const (
+	etherIPFragFlag     = header.FlagFrag // Reservedの分割サブヘッダ有無ビット
+	fragHeaderLen       = 4               // 分割サブヘッダ長
+	fragMaxCount        = 255             // 1つのパケットの最大分割数
+	reassemblyTimeout   = 2 * time.Second // 全ての断片が揃うまで待つ時間
+	reassemblyMaxQueued = 1024            // 再構成を待つパケット数の上限
+	oversizeLogInterval = time.Minute     // 破棄のWARNログの最短間隔
+	oversizeICMPPerSec  = 100             // 1秒あたりに返すICMPの上限
+	defaultPathMTU      = 1500            // 経路MTUが不明な場合に仮定する値
+)
+
+// errOversizeは経路MTUを超えるため送信しなかったことを示す
+var errOversize = errors.New("frame exceeds the path MTU")
+
+// OversizeConfigはTAPのフレームとEtherIPヘッダが外側の経路MTUを超える場合の扱いを保持する
+type OversizeConfig struct {
+	Action  string `yaml:"action"`   // kernel, fragment, df, drop, split（空でkernel）
+	PathMTU int    `yaml:"path_mtu"` // drop・splitで使う外側の経路MTU（0でPMTUDの結果、なければ1500）
+}
+
+// oversizeHandlerは送信方向で経路MTUを超えるパケットを扱う（kernel以外の場合）
+//
+// fragment・dfはソケットのDFの設定のみで、drop・splitは送信前にサイズを確認して破棄・分割する。
+type oversizeHandler struct {
+	t       *Tunnel
+	action  string
+	pathMTU int
+
+	nextID  atomic.Uint32 // 分割したパケットの識別子
+	logged  atomic.Int64  // 最後に破棄をログに出した時刻(UnixNano)
+	icmpSec atomic.Int64  // ICMPの上限を数えている秒(Unix)
+	icmpN   atomic.Int64  // その秒に返したICMPの数
+
+	dropped   atomic.Uint64 // 経路MTUを超えるため破棄したフレーム数
+	icmp      atomic.Uint64 // TAPへ返したICMP Frag Needed / Packet Too Big の数
+	splits    atomic.Uint64 // 分割したパケット数
+	fragments atomic.Uint64 // 分割して送った断片の数
+	emsgsize  atomic.Uint64 // 送信時にEMSGSIZEとなった数
+}
+
+// parseOversize はoversize.actionの設定値を検証する関数
+func parseOversize(action string) (string, error) {
+	switch action {
+	case "", oversizeKernel:
+		return oversizeKernel, nil
+	case oversizeFragment, oversizeDF, oversizeDrop, oversizeSplit:
+		return action, nil
+	}
+	return "", fmt.Errorf("unknown oversize.action %q (kernel, fragment, df, drop, split)", action)
+}
+
+// newOversize は設定に応じて各ソケットのDFを設定し、処理器を生成する関数（kernelならnilを返す）
+func newOversize(t *Tunnel, cfg OversizeConfig) (*oversizeHandler, error) {
+	action, err := parseOversize(cfg.Action)
+	if err != nil || action == oversizeKernel {
+		return nil, err
+	}
+	for _, s := range t.socks {
+		var opt sockOption
+		switch action {
+		case oversizeFragment:
+			opt = func(c *net.IPConn) error { return setAllowFragment(c, s.Version) }
+		case oversizeDF:
+			opt = func(c *net.IPConn) error { return setDontFragment(c, s.Version) }
+		default:
+			continue
+		}
+		if err := s.setOption(opt); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.PathMTU > 0 {
+		logf("[INFO]", "Oversize handling: %s (path MTU %d)", action, cfg.PathMTU)
+	} else {
+		logf("[INFO]", "Oversize handling: %s", action)
+	}
+	return &oversizeHandler{t: t, action: action, pathMTU: cfg.PathMTU}, nil
+}
+
+// limit は経路で送れるEtherIPパケット（sealの前）の最大長を返す関数
+//
+// 経路MTUはpath_mtu、PMTUDの結果、1500の順に使う。
+func (o *oversizeHandler) limit(p *Path) int {
+	mtu := o.pathMTU
+	if mtu <= 0 {
+		mtu = int(p.pmtu.Load())
+	}
+	if mtu <= 0 {
+		mtu = defaultPathMTU
+	}
+	return mtu - ipHeaderLen(p.Version) - o.t.sealOverhead()
+}
+
+// intercept は経路MTUを超えるパケットを破棄または分割して送り、処理した場合はtrueを返す関数
+//
+// plainはsealの前のEtherIPパケット、frameは元の内側フレーム。
+func (o *oversizeHandler) intercept(peer *Peer, frame, plain []byte, dscp int) (bool, error) {
+	if o.action != oversizeDrop && o.action != oversizeSplit {
+		return false, nil
+	}
+	limit := o.limit(peer.active.Load())
+	if len(plain) <= limit {
+		return false, nil
+	}
+	if o.action == oversizeDrop {
+		o.drop(peer, frame, limit)
+		return true, errOversize
+	}
+	return true, o.sendSplit(peer, plain, limit, dscp)
+}
+
+// drop は経路MTUを超えるフレームを数えて破棄し、送信元へICMPを返す関数
+func (o *oversizeHandler) drop(peer *Peer, frame []byte, limit int) {
+	o.dropped.Add(1)
+	now := time.Now().UnixNano()
+	if last := o.logged.Load(); now-last >= int64(oversizeLogInterval) && o.logged.CompareAndSwap(last, now) {
+		logf("[WARN]", "Frame of %d bytes to %s exceeds the path MTU (up to %d bytes of EtherIP payload); dropped (%d so far)",
+			len(frame), peer.Host, limit-etherIPHeaderLen, o.dropped.Load())
+	}
+	if !o.allowICMP(now) {
+		return
+	}
+	if reply := oversizeICMP(frame, limit-etherIPHeaderLen); reply != nil {
+		if _, err := o.t.writeFrame(reply); err == nil {
+			o.icmp.Add(1)
+		}
+	}
+}
+
+// allowICMP は1秒あたりのICMPの上限を超えていなければtrueを返す関数
+func (o *oversizeHandler) allowICMP(now int64) bool {
+	sec := now / int64(time.Second)
+	if cur := o.icmpSec.Load(); cur != sec && o.icmpSec.CompareAndSwap(cur, sec) {
+		o.icmpN.Store(0)
+	}
+	return o.icmpN.Add(1) <= oversizeICMPPerSec
+}
+
+// sendSplit はEtherIPパケットを経路MTUに収まる断片に分けてsealし、ピアへ送る関数
+func (o *oversizeHandler) sendSplit(peer *Peer, plain []byte, limit, dscp int) error {
+	chunk := limit - etherIPHeaderLen - fragHeaderLen
+	payload := plain[etherIPHeaderLen:]
+	count := (len(payload) + chunk - 1) / chunk
+	if chunk <= 0 || count > fragMaxCount {
+		o.dropped.Add(1)
+		return errOversize
+	}
+	o.splits.Add(1)
+	id := uint16(o.nextID.Add(1))
+	for i := 0; i < count; i++ {
+		part := payload[i*chunk : min(len(payload), (i+1)*chunk)]
+		frag := make([]byte, etherIPHeaderLen+fragHeaderLen+len(part))
+		copy(frag, plain[:etherIPHeaderLen])
+		frag[0] |= etherIPFragFlag >> 8
+		binary.BigEndian.PutUint16(frag[etherIPHeaderLen:], id)
+		frag[etherIPHeaderLen+2] = byte(i)
+		frag[etherIPHeaderLen+3] = byte(count)
+		copy(frag[etherIPHeaderLen+fragHeaderLen:], part)
+		if err := o.t.sendTo(peer, frag, dscp); err != nil {
+			return err
+		}
+		o.fragments.Add(1)
+	}
+	return nil
+}
+
+// noteSendError は送信エラーがEMSGSIZEであれば数える関数
+func (o *oversizeHandler) noteSendError(err error) {
+	if o != nil && errors.Is(err, syscall.EMSGSIZE) {
+		o.emsgsize.Add(1)
+	}
+}
+
+// Counters は経路MTUを超えたパケットの処理数を返す
+func (o *oversizeHandler) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"tx_oversize_dropped":   o.dropped.Load(),
+		"tx_oversize_icmp":      o.icmp.Load(),
+		"tx_oversize_split":     o.splits.Load(),
+		"tx_oversize_fragments": o.fragments.Load(),
+		"tx_oversize_emsgsize":  o.emsgsize.Load(),
+	}
+}
+
+// oversizeICMP は破棄するフレームの送信元へ返すICMP Frag Needed / ICMPv6 Packet Too Big のフレームを生成する関数
+//
+// payloadMaxは送れる内側フレームの最大長。IPv4はDFの立ったパケットにのみ返す。
+// 宛先MACと送信元MAC、IPアドレスを入れ替え、VLANタグはそのまま残す（経路上のルータとして振る舞う）。
+func oversizeICMP(frame []byte, payloadMax int) []byte {
+	if len(frame) < ethHeaderLen {
+		return nil
+	}
+	off := 12
+	et := binary.BigEndian.Uint16(frame[off:])
+	for (et == tpid8021Q || et == tpid8021AD) && len(frame) >= off+vlanTagLen+2 {
+		off += vlanTagLen
+		et = binary.BigEndian.Uint16(frame[off:])
+	}
+	l2 := off + 2
+	ip := frame[l2:]
+	mtu := payloadMax - l2
+
+	var msg []byte
+	switch et {
+	case 0x0800:
+		if len(ip) < 20 || ip[0]>>4 != 4 || binary.BigEndian.Uint16(ip[6:8])&0x4000 == 0 {
+			return nil // DFのないパケットはカーネルの既定どおり分割されるはずのもの
+		}
+		if ihl := int(ip[0]&0x0F) * 4; ip[9] == 1 && len(ip) > ihl && ip[ihl] != 0 && ip[ihl] != 8 {
+			return nil // エコー以外のICMP（エラー）には返さない
+		}
+		quote := ip[:min(len(ip), 576-20-8)]
+		msg = make([]byte, 20+8+len(quote))
+		msg[0] = 0x45
+		binary.BigEndian.PutUint16(msg[2:4], uint16(len(msg)))
+		msg[8] = 64
+		msg[9] = 1
+		copy(msg[12:16], ip[16:20])
+		copy(msg[16:20], ip[12:16])
+		binary.BigEndian.PutUint16(msg[10:12], ipv4Checksum(msg[:20]))
+		icmp := msg[20:]
+		icmp[0], icmp[1] = 3, 4 // Destination Unreachable / Fragmentation Needed
+		binary.BigEndian.PutUint16(icmp[6:8], uint16(max(mtu, 68)))
+		copy(icmp[8:], quote)
+		binary.BigEndian.PutUint16(icmp[2:4], ipv4Checksum(icmp))
+	case 0x86DD:
+		if len(ip) < 40 || ip[6] == 58 && len(ip) > 40 && ip[40] < 128 {
+			return nil // ICMPv6エラーには返さない
+		}
+		quote := ip[:min(len(ip), 1280-40-8)]
+		msg = make([]byte, 40+8+len(quote))
+		msg[0] = 0x60
+		binary.BigEndian.PutUint16(msg[4:6], uint16(8+len(quote)))
+		msg[6] = 58
+		msg[7] = 64
+		copy(msg[8:24], ip[24:40])
+		copy(msg[24:40], ip[8:24])
+		icmp := msg[40:]
+		icmp[0] = 2 // Packet Too Big
+		binary.BigEndian.PutUint32(icmp[4:8], uint32(max(mtu, 1280)))
+		copy(icmp[8:], quote)
+		binary.BigEndian.PutUint16(icmp[2:4], icmpv6Checksum(net.IP(msg[8:24]), net.IP(msg[24:40]), icmp))
+	default:
+		return nil
+	}
+
+	reply := make([]byte, l2+len(msg))
+	copy(reply[0:6], frame[6:12])
+	copy(reply[6:12], frame[0:6])
+	copy(reply[12:l2], frame[12:l2])
+	copy(reply[l2:], msg)
+	return reply
+}
+
+// reassemblyKeyは再構成中のパケットを識別する
+type reassemblyKey struct {
+	peer *Peer
+	id   uint16
+}
+
+// reassemblyEntryは再構成中のパケットの断片を保持する
+type reassemblyEntry struct {
+	header [etherIPHeaderLen]byte
+	parts  [][]byte
+	got    int
+	size   int
+	since  time.Time
+}
+
+// reassemblerは対向が分割したEtherIPパケットを再構成する（oversize.action: splitの場合のみ）
+type reassembler struct {
+	max       int // 再構成後のパケットの上限（受信バッファの大きさ）
+	mu        sync.Mutex
+	pending   map[reassemblyKey]*reassemblyEntry
+	lastSweep time.Time
+
+	fragments atomic.Uint64 // 受信した断片の数
+	completed atomic.Uint64 // 再構成したパケット数
+	expired   atomic.Uint64 // 全ての断片が揃わずに破棄したパケット数
+	invalid   atomic.Uint64 // サブヘッダが不正なため破棄した断片の数
+	overflow  atomic.Uint64 // 再構成待ちが上限に達したため破棄した断片の数
+	tooLarge  atomic.Uint64 // 再構成中に受信バッファを超えたため破棄したパケット数
+}
+
+// newReassembler は再構成後の大きさの上限（受信バッファの大きさ）を指定して再構成器を生成する関数
+func newReassembler(max int) *reassembler {
+	return &reassembler{max: max, pending: make(map[reassemblyKey]*reassemblyEntry)}
+}
+
+// isFragment はEtherIPパケットが分割サブヘッダを持つかを返す関数
+func isFragment(packet []byte) bool {
+	return len(packet) >= etherIPHeaderLen && packet[0]&(etherIPFragFlag>>8) != 0
+}
+
+// add は断片を記録し、全て揃えば分割前のEtherIPパケットを返す関数（揃うまではnil）
+//
+// 断片の内容はコピーするため、呼び出し元はバッファをすぐ再利用できる。
+func (r *reassembler) add(peer *Peer, packet []byte) []byte {
+	r.fragments.Add(1)
+	if len(packet) < etherIPHeaderLen+fragHeaderLen {
+		r.invalid.Add(1)
+		return nil
+	}
+	key := reassemblyKey{peer: peer, id: binary.BigEndian.Uint16(packet[etherIPHeaderLen:])}
+	index, count := int(packet[etherIPHeaderLen+2]), int(packet[etherIPHeaderLen+3])
+	if count == 0 || index >= count {
+		r.invalid.Add(1)
+		return nil
+	}
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now.Sub(r.lastSweep) >= reassemblyTimeout {
+		r.sweep(now)
+	}
+	e := r.pending[key]
+	if e != nil && len(e.parts) != count {
+		r.invalid.Add(1)
+		return nil
+	}
+	if e == nil {
+		if len(r.pending) >= reassemblyMaxQueued {
+			r.overflow.Add(1)
+			return nil
+		}
+		e = &reassemblyEntry{parts: make([][]byte, count), since: now}
+		r.pending[key] = e
+	}
+	if e.parts[index] != nil {
+		return nil // 重複
+	}
+	if index == 0 {
+		copy(e.header[:], packet[:etherIPHeaderLen])
+		e.header[0] &^= etherIPFragFlag >> 8
+	}
+	part := packet[etherIPHeaderLen+fragHeaderLen:]
+	if etherIPHeaderLen+e.size+len(part) > r.max {
+		// 揃う前に上限を超えた時点で破棄し、残りの断片のために保持し続けない
+		delete(r.pending, key)
+		r.tooLarge.Add(1)
+		return nil
+	}
+	e.parts[index] = append([]byte(nil), part...)
+	e.got++
+	e.size += len(part)
+	if e.got < count {
+		return nil
+	}
+
+	delete(r.pending, key)
+	r.completed.Add(1)
+	out := make([]byte, 0, etherIPHeaderLen+e.size)
+	out = append(out, e.header[:]...)
+	for _, part := range e.parts {
+		out = append(out, part...)
+	}
+	return out
+}
+
+// sweep は時間内に揃わなかった再構成待ちを破棄する関数（mu保持中に呼ぶ）
+func (r *reassembler) sweep(now time.Time) {
+	r.lastSweep = now
+	for key, e := range r.pending {
+		if now.Sub(e.since) >= reassemblyTimeout {
+			delete(r.pending, key)
+			r.expired.Add(1)
+		}
+	}
+}
+
+// Counters は断片の受信・再構成数を返す
+func (r *reassembler) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"rx_fragments":            r.fragments.Load(),
+		"rx_reassembled":          r.completed.Load(),
+		"rx_reassembly_expired":   r.expired.Load(),
+		"rx_reassembly_invalid":   r.invalid.Load(),
+		"rx_reassembly_overflow":  r.overflow.Load(),
+		"rx_reassembly_too_large": r.tooLarge.Load(),
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// fragTestPacket は分割サブヘッダ（識別子・番号・分割数）を付けた断片を組み立てる
+func fragTestPacket(id uint16, index, count byte, part []byte) []byte {
+	b := []byte{0x30 | etherIPFragFlag>>8, 0x00}
+	b = binary.BigEndian.AppendUint16(b, id)
+	b = append(b, index, count)
+	return append(b, part...)
+}
+
+func TestReassemblerAdd(t *testing.T) {
+	plain := func(payload string) []byte { return append([]byte{0x30, 0x00}, payload...) }
+	tests := []struct {
+		name      string
+		max       int
+		fragments [][]byte
+		want      []byte // 最後の断片で返るパケット（nilは揃わない・破棄）
+		counters  map[string]uint64
+	}{
+		{
+			name:      "in order",
+			max:       64,
+			fragments: [][]byte{fragTestPacket(1, 0, 3, []byte("abc")), fragTestPacket(1, 1, 3, []byte("def")), fragTestPacket(1, 2, 3, []byte("g"))},
+			want:      plain("abcdefg"),
+			counters:  map[string]uint64{"rx_fragments": 3, "rx_reassembled": 1},
+		},
+		{
+			name:      "out of order with duplicate",
+			max:       64,
+			fragments: [][]byte{fragTestPacket(7, 1, 2, []byte("def")), fragTestPacket(7, 1, 2, []byte("def")), fragTestPacket(7, 0, 2, []byte("abc"))},
+			want:      plain("abcdef"),
+			counters:  map[string]uint64{"rx_fragments": 3, "rx_reassembled": 1},
+		},
+		{
+			name:      "single fragment",
+			max:       64,
+			fragments: [][]byte{fragTestPacket(2, 0, 1, []byte("abc"))},
+			want:      plain("abc"),
+			counters:  map[string]uint64{"rx_fragments": 1, "rx_reassembled": 1},
+		},
+		{
+			name:      "interleaved ids",
+			max:       64,
+			fragments: [][]byte{fragTestPacket(1, 0, 2, []byte("ab")), fragTestPacket(2, 0, 2, []byte("xy")), fragTestPacket(1, 1, 2, []byte("cd"))},
+			want:      plain("abcd"),
+			counters:  map[string]uint64{"rx_fragments": 3, "rx_reassembled": 1},
+		},
+		{
+			name:      "missing fragment",
+			max:       64,
+			fragments: [][]byte{fragTestPacket(3, 0, 3, []byte("abc")), fragTestPacket(3, 2, 3, []byte("g"))},
+			counters:  map[string]uint64{"rx_fragments": 2},
+		},
+		{
+			name:      "short subheader",
+			max:       64,
+			fragments: [][]byte{fragTestPacket(4, 0, 2, nil)[:4]},
+			counters:  map[string]uint64{"rx_fragments": 1, "rx_reassembly_invalid": 1},
+		},
+		{
+			name:      "index beyond count",
+			max:       64,
+			fragments: [][]byte{fragTestPacket(4, 2, 2, []byte("abc"))},
+			counters:  map[string]uint64{"rx_fragments": 1, "rx_reassembly_invalid": 1},
+		},
+		{
+			name:      "zero count",
+			max:       64,
+			fragments: [][]byte{fragTestPacket(4, 0, 0, []byte("abc"))},
+			counters:  map[string]uint64{"rx_fragments": 1, "rx_reassembly_invalid": 1},
+		},
+		{
+			name:      "count mismatch",
+			max:       64,
+			fragments: [][]byte{fragTestPacket(5, 0, 2, []byte("abc")), fragTestPacket(5, 1, 3, []byte("def"))},
+			counters:  map[string]uint64{"rx_fragments": 2, "rx_reassembly_invalid": 1},
+		},
+		{
+			name: "too large before complete",
+			max:  etherIPHeaderLen + 5,
+			fragments: [][]byte{fragTestPacket(6, 0, 3, []byte("abc")), fragTestPacket(6, 1, 3, []byte("def")),
+				fragTestPacket(6, 2, 3, []byte("g"))},
+			counters: map[string]uint64{"rx_fragments": 3, "rx_reassembly_too_large": 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newReassembler(tt.max)
+			peer := &Peer{Host: "192.0.2.1"}
+			var got []byte
+			for i, frag := range tt.fragments {
+				if !isFragment(frag) {
+					t.Fatalf("fragment %d: isFragment = false", i)
+				}
+				got = r.add(peer, frag)
+				if got != nil && i != len(tt.fragments)-1 {
+					t.Fatalf("fragment %d: reassembled early: % x", i, got)
+				}
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("add() = % x, want % x", got, tt.want)
+			}
+			for name, v := range r.Counters() {
+				if v != tt.counters[name] {
+					t.Errorf("%s = %d, want %d", name, v, tt.counters[name])
+				}
+			}
+		})
+	}
+}
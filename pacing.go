@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// TAPの読み取りの調整の定数定義
+const (
+	paceDefaultHigh = 75                     // 読み取りを止める送信キューの使用率（%）の既定値
+	paceInterval    = 200 * time.Microsecond // 止めている間にキューを確かめる間隔
+	paceBusyBackoff = time.Millisecond       // アンダーレイの送信バッファが満杯のとき読み取りを止める時間
+)
+
+// readPacerは送信キューが埋まっている間TAPの読み取りを止め、溢れたフレームをカーネルにTAPで破棄させる（queue_full: pace）
+//
+// 読み取ってから内部で捨てるのではなく、TAPの送信キュー（txqueuelen）で待たせて溢れた分を
+// インターフェースのドロップ（ip -s link・ifconfigのTX dropped）として数えさせる。
+type readPacer struct {
+	depth     func() int // 送信キューの現在の長さ
+	high, low int        // 読み取りを止める長さ・再開する長さ
+	busyUntil atomic.Int64
+
+	paused     atomic.Uint64 // 読み取りを止めた回数
+	pausedNs   atomic.Uint64 // 読み取りを止めていた時間の合計(ns)
+	underlayNB atomic.Uint64 // アンダーレイへの送信がENOBUFS・EAGAINとなった数
+}
+
+// newReadPacer は送信キューの長さと容量から読み取りの調整器を生成する関数
+//
+// highPercentは止める使用率（%）。キューが半分まで空くと再開する。
+func newReadPacer(depth func() int, capacity, highPercent int) *readPacer {
+	if highPercent == 0 {
+		highPercent = paceDefaultHigh
+	}
+	high := max(1, capacity*highPercent/100)
+	return &readPacer{depth: depth, high: high, low: high / 2}
+}
+
+// wait はTAPから読み取る前に呼び、送信キューが埋まっているかアンダーレイが混雑している間は待つ関数
+func (r *readPacer) wait() {
+	if r == nil || r.depth() < r.high && time.Now().UnixNano() >= r.busyUntil.Load() {
+		return
+	}
+	r.paused.Add(1)
+	start := time.Now()
+	for r.depth() > r.low || time.Now().UnixNano() < r.busyUntil.Load() {
+		time.Sleep(paceInterval)
+	}
+	r.pausedNs.Add(uint64(time.Since(start)))
+}
+
+// noteSendError はアンダーレイの送信バッファが満杯で送れなかった場合に読み取りを少し止める関数
+func (r *readPacer) noteSendError(err error) {
+	if r == nil || !errors.Is(err, syscall.ENOBUFS) && !errors.Is(err, syscall.EAGAIN) {
+		return
+	}
+	r.underlayNB.Add(1)
+	r.busyUntil.Store(time.Now().Add(paceBusyBackoff).UnixNano())
+}
+
+// Counters は読み取りを止めた回数・時間を返す
+func (r *readPacer) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"tx_read_paused":     r.paused.Load(),
+		"tx_read_paused_us":  r.pausedNs.Load() / uint64(time.Microsecond),
+		"tx_underlay_nobufs": r.underlayNB.Load(),
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Socketはアドレスファミリごとの送信元IPとRAWソケットを保持する（全ピアで共有）
+type Socket struct {
+	Version int            // 4 or 6
+	SrcIP   net.IP         // 送信元IPアドレス（src_auto時は未指定アドレス）
+	Conn    *net.IPConn    // RAWソケット
+	Encap   *encapsulation // EtherIP以外のカプセル化（EtherIP時はnil）
+
+	connected bool        // 経路ごとに宛先へ接続したソケットで送る（connected_socket）
+	proto     string      // net.DialIPに渡すプロトコル（ip4:97 等）
+	laddr     *net.IPAddr // 共有ソケットのローカルアドレス（リンクローカル時のZoneを含む）
+
+	optMu  sync.Mutex
+	opts   []sockOption  // 接続済みソケットにも設定するソケットオプション
+	optGen atomic.Uint32 // optsを変更するたびに増やす世代
+
+	sendConnected   sendCounter
+	sendUnconnected sendCounter
+	redials         atomic.Uint64 // 宛先・送信元の変化で接続し直した回数
+	truncated       atomic.Uint64 // 受信バッファに収まらず破棄した数
+
+	sim *simPort // --simulate時のメモリ上の受信口（nilでRAWソケット）
+}
+
+// Pathはピアへのアドレスファミリごとの通信経路を保持する
+type Path struct {
+	Version   int                      // 4 or 6
+	Host      string                   // 宛先ホスト名またはIP（予備の宛先の経路ではその宛先）
+	SrcIP     atomic.Value             // 送信元IPアドレス(net.IP、src_auto時は経路表の変化に追従)
+	Conn      *net.IPConn              // RAWソケット（Socketと共有）
+	encap     *encapsulation           // EtherIP以外のカプセル化（Socketと共有）
+	sock      *Socket                  // 経路のソケット（接続済みソケットの作成用）
+	Dst       atomic.Value             // 宛先IPアドレス(net.IP)
+	lastRecv  atomic.Int64             // 最後にキープアライブ応答を受信した時刻(UnixNano)
+	lastData  atomic.Int64             // 最後にキープアライブ以外のパケットを受信した時刻(UnixNano、適応制御時のみ)
+	lastSent  atomic.Int64             // 最後にキープアライブを送信した時刻(UnixNano)
+	rtt       atomic.Int64             // 最後のキープアライブ応答のRTT(ns、未受信なら0)
+	up        atomic.Bool              // 経路が生きていると判定されているか
+	upSince   atomic.Int64             // 最後に復旧した時刻(UnixNano、起動時から生きていれば0)
+	routeDown atomic.Bool              // 経路監視で宛先への経路が取り消されている
+	recursing atomic.Bool              // 宛先への経路がトンネル自身を向いている（送信しない）
+	dnsFailed atomic.Int64             // 宛先の再解決に失敗し続けている開始時刻(UnixNano、成功中は0)
+	pmtu      atomic.Int32             // PMTUDで探索した外側の経路MTU（未探索なら0）
+	records   atomic.Pointer[[]net.IP] // 宛先の名前解決で返った全てのアドレス（allowlist.dns_records時のみ）
+
+	dialed atomic.Pointer[dialedConn] // 宛先へ接続済みのソケット（connected_socket時のみ）
+	dialMu sync.Mutex
+}
+
+// Peerは対向デーモン1台分の経路と状態を保持する
+type Peer struct {
+	Host   string               // 宛先ホスト名またはIP
+	paths  []*Path              // 経路一覧（先頭が優先ファミリ）
+	active atomic.Pointer[Path] // 現在送信に使用している経路
+	up     atomic.Bool          // いずれかの経路が生きているか
+	sla    *slaTracker          // SLA集計（キープアライブ無効時はnil）
+	events *eventSink           // イベント送信先
+
+	failback time.Duration // 優先度の高い経路が復旧してから戻すまでの安定時間（0で即時）
+	rehello  atomic.Bool   // 送信元が変わったため、次の周期でハンドシェイクを送り直す
+	primary  atomic.Int32  // 制御APIで切り替えた送信に優先するアドレスファミリ（0で経路一覧の順）
+
+	software   atomic.Pointer[PeerSoftware] // 対向デーモンのソフトウェア情報（ハンドシェイク前・非対応ならnil）
+	mismatch   atomic.Pointer[string]       // 対向と一致しない能力（negotiate有効時、一致・未照合ならnil）
+	negotiated atomic.Bool                  // 対向から能力の有無を受け取った（旧版の警告を1度だけ出す）
+
+	lastHeard atomic.Int64 // 最後に何かを受信した時刻(UnixNano、silence・keepalive_adaptive設定時のみ)
+	silent    atomic.Bool  // 無受信がsilence.afterを超えて続いている
+	degraded  atomic.Bool  // silenceのdegradedアクションで付けた状態
+
+	traffic [2]trafficCounter // ピアとの転送フレーム数・バイト数・エラー数（方向別）
+	dropped atomic.Uint64     // ピアから受信してフィルタ・検証で破棄したフレーム数
+	csum    checksumCounter   // ピアから受信した内側パケットのチェックサムの検証数・誤り数
+}
+
+// openSocket は指定アドレスファミリの送信元IP取得とRAWソケット作成を行う関数
+func openSocket(cfg *Config, version int) (*Socket, error) {
+	var srcIP net.IP
+	var err error
+	switch {
+	case cfg.SrcAuto && version == 4:
+		srcIP = net.IPv4zero
+	case cfg.SrcAuto:
+		srcIP = net.IPv6unspecified
+	default:
+		if srcIP, err = sourceIP(cfg, version); err != nil {
+			return nil, err
+		}
+	}
+
+	encap, err := newEncapsulation(cfg)
+	if err != nil {
+		return nil, err
+	}
+	proto := fmt.Sprintf("ip%d:%d", version, encap.protocol())
+	laddr := &net.IPAddr{IP: srcIP}
+	if srcIP.IsLinkLocalUnicast() {
+		laddr.Zone = cfg.SrcIface
+	}
+	// 無停止の再起動では、引き継ぎ元が同じプロトコル・アドレスで開いたソケットをそのまま使う（受信待ちのパケットも引き継ぐ）
+	key := fmt.Sprintf("socket:%s/%s/%s", cfg.TapName, proto, laddr)
+	conn, err := inheritedConn(key)
+	if conn == nil && err == nil {
+		conn, err = net.ListenIP(proto, laddr)
+	}
+	if err != nil {
+		logf("[ERROR]", "RAW socket (IPv%d): %v", version, err)
+		return nil, err
+	}
+	offerHandover(key, conn)
+	s := &Socket{Version: version, SrcIP: srcIP, Conn: conn, Encap: encap, connected: cfg.ConnectedSocket, proto: proto, laddr: laddr}
+	if cfg.BindDevice {
+		// 複数の上流を持つホストで、経路表によらずsrc_iface経由で送受信する
+		if err := s.setOption(func(c *net.IPConn) error { return bindToDevice(c, cfg.SrcIface) }); err != nil {
+			conn.Close()
+			logf("[ERROR]", "Failed to bind IPv%d socket to %s: %v", version, cfg.SrcIface, err)
+			return nil, err
+		}
+		logf("[INFO]", "IPv%d socket bound to %s", version, cfg.SrcIface)
+	}
+	if err := applyHopLimit(s, cfg.OuterHopLimit); err != nil {
+		conn.Close()
+		logf("[ERROR]", "Outer hop limit: %v", err)
+		return nil, err
+	}
+	return s, nil
+}
+
+// newPaths は宛先を各アドレスファミリで解決して経路を生成する関数
+//
+// dualStackの場合、解決できないファミリは警告のうえ経路から除外する。
+func newPaths(host string, socks []*Socket, dualStack bool) ([]*Path, error) {
+	var paths []*Path
+	now := time.Now().UnixNano()
+
+	for _, s := range socks {
+		dst, err := resolveDst(host, s.Version)
+		if err != nil {
+			if !dualStack {
+				return nil, err
+			}
+			logf("[WARN]", "IPv%d path to %s unavailable, skipping: %v", s.Version, host, err)
+			continue
+		}
+
+		// 未指定アドレスのソケット（src_auto）では宛先への経路から送信元を決める
+		src := s.SrcIP
+		if src.IsUnspecified() {
+			if src, err = routeSource(dst); err != nil {
+				if !dualStack {
+					return nil, err
+				}
+				logf("[WARN]", "IPv%d path to %s unavailable, skipping: %v", s.Version, host, err)
+				continue
+			}
+		}
+
+		// 起動直後はすべての経路を生きているものとして扱う
+		p := &Path{Version: s.Version, Host: host, Conn: s.Conn, encap: s.Encap, sock: s}
+		p.SrcIP.Store(src)
+		p.Dst.Store(dst)
+		p.lastRecv.Store(now)
+		p.up.Store(true)
+		paths = append(paths, p)
+	}
+
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no usable path to %s", host)
+	}
+	return paths, nil
+}
+
+// newPeer は宛先を各アドレスファミリで解決してピアを生成する関数
+func newPeer(host string, socks []*Socket, dualStack bool) (*Peer, error) {
+	paths, err := newPaths(host, socks, dualStack)
+	if err != nil {
+		return nil, err
+	}
+	peer := &Peer{Host: host, paths: paths}
+	peer.active.Store(peer.paths[0])
+	peer.up.Store(true)
+	return peer, nil
+}
+
+// otherVersion は4と6を入れ替えたアドレスファミリを返す関数
+func otherVersion(version int) int {
+	if version == 4 {
+		return 6
+	}
+	return 4
+}
+
+// pathFor は指定アドレスファミリの経路を返す関数（なければnil）
+func (peer *Peer) pathFor(version int) *Path {
+	for _, p := range peer.paths {
+		if p.Version == version {
+			return p
+		}
+	}
+	return nil
+}
+
+// write は経路の宛先へパケットを送る関数（oobがあれば補助データとして付ける、再帰経路・クラスタのスタンバイ中なら送らない）
+func (p *Path) write(packet, oob []byte) error {
+	if p.recursing.Load() {
+		return errRecursiveRoute
+	}
+	if cluster.standby() {
+		return errClusterStandby
+	}
+	packet = p.encap.wrap(packet)
+	if p.sock.sim != nil {
+		return simulation.send(p.sock, p.Dst.Load().(net.IP), packet)
+	}
+	start := time.Now()
+	if p.sock.connected {
+		// 接続済みソケットでは宛先を渡さず、パケットごとの経路検索を省く
+		if conn := p.connection(); conn != nil {
+			var err error
+			if oob == nil {
+				_, err = conn.Write(packet)
+			} else {
+				_, _, err = conn.WriteMsgIP(packet, oob, nil)
+			}
+			p.sock.sendConnected.observe(start)
+			return err
+		}
+	}
+	addr := &net.IPAddr{IP: p.Dst.Load().(net.IP)}
+	var err error
+	if oob == nil {
+		_, err = p.Conn.WriteTo(packet, addr)
+	} else {
+		_, _, err = p.Conn.WriteMsgIP(packet, oob, addr)
+	}
+	p.sock.sendUnconnected.observe(start)
+	return err
+}
+
+// writeTo はパケットを送信用のカプセル化にして指定の宛先へ送る関数（OAMの応答用、共有ソケットを使う）
+func (p *Path) writeTo(packet []byte, addr net.Addr) error {
+	if cluster.standby() {
+		return errClusterStandby
+	}
+	if p.sock.sim != nil {
+		return simulation.send(p.sock, addr.(*net.IPAddr).IP, p.encap.wrap(packet))
+	}
+	_, err := p.Conn.WriteTo(p.encap.wrap(packet), addr)
+	return err
+}
+
+// selectActivePath は生きている経路のうち最も優先度の高いものを送信経路として選択する関数
+//
+// 使用中の経路が生きている間は、より優先度の高い経路へは復旧からfailback経過後に戻す。
+func (peer *Peer) selectActivePath(now time.Time) {
+	cur := peer.active.Load()
+	paths := peer.orderedPaths()
+	next := paths[0]
+	for _, p := range paths {
+		if !p.up.Load() {
+			continue
+		}
+		if p != cur && cur.up.Load() && now.Sub(time.Unix(0, p.upSince.Load())) < peer.failback {
+			continue
+		}
+		next = p
+		break
+	}
+
+	prev := peer.active.Swap(next)
+	if prev == next {
+		return
+	}
+	change := fmt.Sprintf("IPv%d → IPv%d", prev.Version, next.Version)
+	if prev.Host != next.Host {
+		change = fmt.Sprintf("%s (%s) → %s (%s)", prev.Host, prev.Dst.Load(), next.Host, next.Dst.Load())
+	}
+	logf("[UPDATE]", "Failover %s: %s", peer.Host, change)
+	peer.events.emit("failover", peer.Host, change)
+}
+
+// PeerStatusはAPI・MQTTで公開するピア1台分の状態
+type PeerStatus struct {
+	Host     string        `json:"host"`
+	Up       bool          `json:"up"`
+	Version  int           `json:"version"` // 送信に使用中の経路のアドレスファミリ
+	Dst      string        `json:"dst"`
+	Software *PeerSoftware `json:"software,omitempty"`            // 対向デーモンのバージョン（ハンドシェイク非対応の旧版では省略）
+	Degraded bool          `json:"degraded,omitempty"`            // 無受信が続いている（silenceのdegradedアクション）
+	RTTMs    float64       `json:"rtt_ms,omitempty"`              // 送信に使用中の経路の最後のキープアライブのRTT（未計測なら省略）
+	Mismatch string        `json:"capability_mismatch,omitempty"` // 対向と一致しない能力（negotiate有効時）
+}
+
+// peerStatus は全ピアの現在の状態を返す関数
+func (t *Tunnel) peerStatus() []PeerStatus {
+	var list []PeerStatus
+	for _, peer := range t.peers {
+		p := peer.active.Load()
+		st := PeerStatus{
+			Host:     peer.Host,
+			Up:       peer.up.Load(),
+			Version:  p.Version,
+			Dst:      p.Dst.Load().(net.IP).String(),
+			Software: peer.software.Load(),
+			Degraded: peer.degraded.Load(),
+			RTTMs:    float64(p.rtt.Load()) / float64(time.Millisecond),
+		}
+		if m := peer.mismatch.Load(); m != nil {
+			st.Mismatch = *m
+		}
+		list = append(list, st)
+	}
+	return list
+}
+
+// lookupPeer は受信パケットの送信元アドレスからピアと経路を特定する関数
+//
+// ピアが1台のみの場合は従来どおり送信元を問わずそのピアからの受信とみなす
+// （同一プロセスで複数トンネルを動かす場合を除く）。
+func (t *Tunnel) lookupPeer(from net.Addr, version int) (*Peer, *Path) {
+	if addr, ok := from.(*net.IPAddr); ok {
+		for _, peer := range t.peers {
+			for _, p := range peer.paths {
+				if p.Version == version && p.Dst.Load().(net.IP).Equal(addr.IP) {
+					return peer, p
+				}
+			}
+		}
+	}
+
+	// 他のトンネルのピアからのパケットは、同じ認証鍵でもroaming・許可リストで受け入れない
+	if addr, ok := from.(*net.IPAddr); ok && t.isolation != nil && t.isolation.owned(addr.IP, version) {
+		return nil, nil
+	}
+
+	// 許可リストの設定時は、許可した範囲・名前解決の結果に一致する送信元のみ受け入れる（roaming時の移動先も限る）
+	if t.allow != nil {
+		if addr, ok := from.(*net.IPAddr); ok {
+			if peer, p := t.allow.lookup(t.peers, addr.IP, version); peer != nil {
+				return peer, p
+			}
+		}
+		t.allow.rejected.Add(1)
+		return nil, nil
+	}
+
+	// roaming時は認証で対向を確かめるため、未知の送信元も単一ピアの候補とする
+	if len(t.peers) == 1 && (!t.strictPeers || t.roaming) {
+		if p := t.peers[0].pathFor(version); p != nil {
+			return t.peers[0], p
+		}
+	}
+	return nil, nil
+}
+
+// roam は認証済みパケットの送信元へ経路の宛先を切り替える関数（NAT・DHCPでアドレスが変わる対向向け）
+func (t *Tunnel) roam(peer *Peer, p *Path, src net.IP) {
+	src = append(net.IP(nil), src...)
+	old := p.Dst.Swap(src).(net.IP)
+	controlTrace.dst(p, src, "roam")
+	t.roamed.Add(1)
+	logf("[UPDATE]", "Peer %s roamed: %s → %s", peer.Host, old, src)
+	t.events.emit("peer_change", peer.Host, fmt.Sprintf("roamed %s → %s", old, src))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// errLockHeld は他のプロセスがロックを保持していることを表すエラー
+var errLockHeld = errors.New("lock is held by another process")
+
+// pidLockはflockで排他ロックを保持しているPIDファイル
+//
+// ロックはプロセスの終了（異常終了を含む）でカーネルが外すため、残ったファイルが次の起動を妨げることはない。
+type pidLock struct {
+	f    *os.File
+	path string
+}
+
+// acquirePIDLock はファイルを作成して排他ロックを取り、自身のPIDを書き込む関数
+//
+// 他のプロセスがロックを保持していれば、ファイルに書かれたそのPIDを含むエラーを返す。
+func acquirePIDLock(path string) (*pidLock, error) {
+	var f *os.File
+	for {
+		var err error
+		if f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644); err != nil {
+			return nil, err
+		}
+		if err := lockFile(f); err != nil {
+			owner, _ := io.ReadAll(io.LimitReader(f, 32))
+			f.Close()
+			if errors.Is(err, errLockHeld) {
+				return nil, fmt.Errorf("%s is locked by another process (pid %s)", path, strings.TrimSpace(string(owner)))
+			}
+			return nil, fmt.Errorf("lock %s: %w", path, err)
+		}
+		// 開いてからロックを取るまでの間に前のプロセスが削除したファイルなら開き直す
+		locked, err1 := f.Stat()
+		current, err2 := os.Stat(path)
+		if err1 == nil && err2 == nil && os.SameFile(locked, current) {
+			break
+		}
+		f.Close()
+	}
+	l := &pidLock{f: f, path: path}
+	if err := l.writePID(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// writePID はファイルの内容を自身のPIDに置き換える関数
+func (l *pidLock) writePID() error {
+	err := l.f.Truncate(0)
+	if err == nil {
+		_, err = l.f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		return fmt.Errorf("write %s: %w", l.path, err)
+	}
+	return nil
+}
+
+// release はファイルを削除してからロックを外す関数（権限を落とした後は削除できずにファイルが残るが、ロックは外れる）
+func (l *pidLock) release() {
+	os.Remove(l.path)
+	l.f.Close()
+}
+
+// lockHolder はロックが他のプロセスに保持されていれば、ファイルに書かれたPIDを返す関数（check用）
+func lockHolder(path string) (string, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	if !lockHeld(f) {
+		return "", false
+	}
+	owner, _ := io.ReadAll(io.LimitReader(f, 32))
+	return strings.TrimSpace(string(owner)), true
+}
+
+// tapLockPath はTAP名ごとの排他ロックのファイル名を返す関数（pid_fileと同じディレクトリに置く）
+func tapLockPath(pidFile, tapName string) string {
+	return filepath.Join(filepath.Dir(pidFile), "etherip-"+tapName+".lock")
+}
+
+// lockInstance はpid_fileとトンネルごとのTAP名のロックを取り、終了時に外すよう登録する関数
+//
+// 同じTAPを2つのデーモンが奪い合うと、後から起動した側がインターフェースを作り直して先の側の転送が黙って止まるため、
+// インターフェースに触れる前に起動を止める。
+//
+// 無停止の再起動では引き継ぎ元のロックをそのまま受け取り、引き継ぎ元が終了してからPIDを書き換える。
+func lockInstance(pidFile string, cfgs []*Config) error {
+	paths := []string{pidFile}
+	for _, cfg := range cfgs {
+		paths = append(paths, tapLockPath(pidFile, cfg.TapName))
+	}
+	for _, path := range paths {
+		var l *pidLock
+		if f := inheritedFile("lock:" + path); f != nil {
+			l = &pidLock{f: f, path: path}
+			afterHandover(func() {
+				if err := l.writePID(); err != nil {
+					logf("[WARN]", "PID file: %v", err)
+				}
+			})
+		} else {
+			var err error
+			if l, err = acquirePIDLock(path); err != nil {
+				return err
+			}
+		}
+		offerHandover("lock:"+path, l.f)
+		registerShutdown(l.release)
+	}
+	logf("[INFO]", "PID file %s (pid %d)", pidFile, os.Getpid())
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// lockFile はflockのないプラットフォームでは未対応
+func lockFile(f *os.File) error {
+	return fmt.Errorf("pid_file is not supported on this platform")
+}
+
+// lockHeld はflockのないプラットフォームでは未対応（常にfalse）
+func lockHeld(f *os.File) bool {
+	return false
+}
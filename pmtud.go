@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// PMTUD関連の定数定義
+const (
+	pmtudDefaultInterval = 10 * time.Minute // 定期プローブ間隔の既定値
+	pmtudProbeTimeout    = time.Second      // プローブ応答待ち時間
+	pmtudProbeRetries    = 2                // 1サイズあたりの試行回数
+	pmtudPrecision       = 8                // 二分探索の終了幅（バイト）
+	etherIPOverhead      = 2 + 14           // EtherIPヘッダ + 内側Ethernetヘッダ
+)
+
+// PMTUDConfigはPath MTU探索の設定を保持する
+type PMTUDConfig struct {
+	Enabled    bool   `yaml:"enabled"`     // PMTUDを有効にする（送信パケットにDFを設定）
+	Interval   string `yaml:"interval"`    // 定期プローブ間隔
+	AutoAdjust bool   `yaml:"auto_adjust"` // 探索結果に合わせてTAPのMTUを自動調整する
+}
+
+// pmtudはOAMプローブとカーネルの経路キャッシュ（ICMP Frag Needed / Packet Too Big）からPath MTUを探索する
+type pmtud struct {
+	t          *Tunnel
+	interval   time.Duration
+	autoAdjust bool
+	tapMTU     atomic.Int64 // 現在のTAP MTU
+
+	mu      sync.Mutex
+	pending map[uint32]chan struct{} // 応答待ちのプローブ
+	nextID  atomic.Uint32
+	trigger chan struct{} // 即時再探索の要求
+
+	tooBig    atomic.Uint64 // 送信時にEMSGSIZEとなった数
+	probes    atomic.Uint64 // 送信したプローブ数
+	probeLost atomic.Uint64 // 応答のなかったプローブ数
+}
+
+// newPMTUD はPMTUD設定から探索器を生成し、各ソケットにDFを設定する関数
+func newPMTUD(t *Tunnel, cfg PMTUDConfig) (*pmtud, error) {
+	d := &pmtud{
+		t:          t,
+		interval:   pmtudDefaultInterval,
+		autoAdjust: cfg.AutoAdjust,
+		pending:    make(map[uint32]chan struct{}),
+		trigger:    make(chan struct{}, 1),
+	}
+	d.tapMTU.Store(int64(t.cfg.MTU))
+
+	if cfg.Interval != "" {
+		iv, err := time.ParseDuration(cfg.Interval)
+		if err != nil {
+			return nil, err
+		}
+		if iv <= 0 {
+			return nil, errors.New("interval must be positive")
+		}
+		d.interval = iv
+	}
+
+	for _, s := range t.socks {
+		if err := s.setOption(func(c *net.IPConn) error { return setDontFragment(c, s.Version) }); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// ipHeaderLen は外側IPヘッダ長を返す関数
+func ipHeaderLen(version int) int {
+	if version == 4 {
+		return 20
+	}
+	return 40
+}
+
+// routeCacheMTU はカーネルの経路キャッシュに記録されたPath MTUを返す関数（なければ0）
+//
+// ICMP Frag Needed / Packet Too Big を受信するとカーネルが宛先ごとのMTUを記録する。
+func routeCacheMTU(dst net.IP) int {
+	out, err := exec.Command("ip", "route", "get", dst.String()).Output()
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(out))
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "mtu" {
+			if mtu, err := strconv.Atoi(fields[i+1]); err == nil {
+				return mtu
+			}
+		}
+	}
+	return 0
+}
+
+// noteSendError は送信エラーがEMSGSIZEであれば即時再探索を要求する
+func (d *pmtud) noteSendError(err error) {
+	if !errors.Is(err, syscall.EMSGSIZE) {
+		return
+	}
+	d.tooBig.Add(1)
+	select {
+	case d.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// run は定期的およびEMSGSIZE発生時に全ピアのPath MTUを探索する関数
+func (d *pmtud) run() {
+	logf("[INFO]", "PMTUD enabled (interval %v, auto_adjust=%v)", d.interval, d.autoAdjust)
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		d.probeAll()
+		select {
+		case <-ticker.C:
+		case <-d.trigger:
+		}
+	}
+}
+
+// probeAll は全ピアの送信経路を探索し、TAP MTUとの整合を確認する関数
+//
+// 最小サイズのプローブにも応答がない経路（対向の停止・経路断）はPath MTUを不明とし、
+// 前回の結果とTAP MTUを変えない。
+func (d *pmtud) probeAll() {
+	limit := d.t.cfg.MTU
+	known := 0
+	for _, peer := range d.t.peers {
+		p := peer.active.Load()
+		pmtu, ok := d.discover(p)
+		if !ok {
+			logf("[WARN]", "Path MTU to %s (IPv%d) is unknown: no probe was answered; keeping the previous result", peer.Host, p.Version)
+			if pmtu = int(p.pmtu.Load()); pmtu <= 0 {
+				continue
+			}
+		} else {
+			p.pmtu.Store(int32(pmtu))
+		}
+		known++
+		tapMax := pmtu - ipHeaderLen(p.Version) - etherIPOverhead - d.t.sealOverhead()
+		if ok {
+			logf("[INFO]", "Path MTU to %s (IPv%d): %d (TAP MTU up to %d)", peer.Host, p.Version, pmtu, tapMax)
+		}
+		if tapMax < limit {
+			limit = tapMax
+		}
+	}
+
+	cur := int(d.tapMTU.Load())
+	if known == 0 || limit == cur {
+		return
+	}
+	if !d.autoAdjust {
+		if limit < cur {
+			logf("[WARN]", "TAP MTU %d exceeds the path MTU; frames larger than %d bytes will be dropped. Set mtu: %d", cur, limit, limit)
+		}
+		return
+	}
+
+	// 縮小は即時、拡大は設定値まで戻す
+	if err := setTAPMTU(d.t.cfg.TapName, limit); err == nil {
+		logf("[UPDATE]", "TAP MTU adjusted: %d → %d", cur, limit)
+		d.tapMTU.Store(int64(limit))
+	}
+}
+
+// discover は二分探索で外側パケットの最大サイズを求める関数（最小サイズにも応答がなければfalse）
+func (d *pmtud) discover(p *Path) (int, bool) {
+	ipHdr := ipHeaderLen(p.Version)
+	lo := 576
+	if p.Version == 6 {
+		lo = 1280
+	}
+	hi := d.t.cfg.MTU + etherIPOverhead + d.t.sealOverhead() + ipHdr
+
+	// ICMPで通知済みのMTUがあれば探索の上限とする
+	if cached := routeCacheMTU(p.Dst.Load().(net.IP)); cached > 0 && cached < hi {
+		hi = cached
+	}
+	if d.probe(p, hi) {
+		return hi, true
+	}
+
+	hi--
+	answered := false
+	for hi-lo > pmtudPrecision {
+		mid := (lo + hi) / 2
+		if d.probe(p, mid) {
+			lo, answered = mid, true
+		} else {
+			hi = mid - 1
+		}
+	}
+	if !answered && !d.probe(p, lo) {
+		return 0, false
+	}
+	return lo, true
+}
+
+// probe は指定サイズの外側パケットとなるOAMプローブを送り、応答があればtrueを返す
+func (d *pmtud) probe(p *Path, size int) bool {
+	frameLen := size - ipHeaderLen(p.Version) - 2 - d.t.sealOverhead()
+	if frameLen < oamHeaderLen+6 {
+		return true
+	}
+
+	for i := 0; i < pmtudProbeRetries; i++ {
+		id := d.nextID.Add(1)
+		body := make([]byte, frameLen-oamHeaderLen)
+		binary.BigEndian.PutUint32(body[0:4], id)
+		binary.BigEndian.PutUint16(body[4:6], uint16(size))
+
+		ch := make(chan struct{}, 1)
+		d.mu.Lock()
+		d.pending[id] = ch
+		d.mu.Unlock()
+
+		d.probes.Add(1)
+		packet := d.t.seal(p, buildEtherIPPacket(buildOAMFrame(d.t.mac, oamProbeRequest, body)))
+		err := p.write(packet, d.t.qos.oob(p.Version, -1))
+
+		ok := false
+		if err == nil {
+			select {
+			case <-ch:
+				ok = true
+			case <-time.After(pmtudProbeTimeout):
+			}
+		}
+
+		d.mu.Lock()
+		delete(d.pending, id)
+		d.mu.Unlock()
+
+		if ok {
+			return true
+		}
+		d.probeLost.Add(1)
+		if errors.Is(err, syscall.EMSGSIZE) {
+			return false // ローカルで既知のMTU超過のため再試行不要
+		}
+	}
+	return false
+}
+
+// ack はプローブ応答を受信したことを通知する
+func (d *pmtud) ack(body []byte) {
+	if len(body) < 4 {
+		return
+	}
+	id := binary.BigEndian.Uint32(body[0:4])
+	d.mu.Lock()
+	ch, ok := d.pending[id]
+	d.mu.Unlock()
+	if ok {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Counters はPMTUDのカウンタを返す
+func (d *pmtud) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"pmtud_too_big":    d.tooBig.Load(),
+		"pmtud_probes":     d.probes.Load(),
+		"pmtud_probe_lost": d.probeLost.Load(),
+		"pmtud_tap_mtu":    uint64(d.tapMTU.Load()),
+	}
+}
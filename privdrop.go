@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// lookupIDs はrun_as_user/run_as_group（名前または数値）をUID/GIDへ変換する関数
+//
+// run_as_groupを省略した場合はユーザーのプライマリグループを使用する。
+func lookupIDs(userName, groupName string) (int, int, error) {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		if u, err = user.LookupId(userName); err != nil {
+			return 0, 0, fmt.Errorf("run_as_user: unknown user %q", userName)
+		}
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return 0, 0, fmt.Errorf("run_as_group: unknown group %q", groupName)
+			}
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return uid, gid, nil
+}
+
+// dropPrivileges はTAP・ソケット・インターフェース設定の完了後に実行ユーザーを切り替える関数
+func dropPrivileges(userName, groupName string) error {
+	uid, gid, err := lookupIDs(userName, groupName)
+	if err != nil {
+		return err
+	}
+	if os.Geteuid() != 0 {
+		logf("[WARN]", "Not running as root; run_as_user %s ignored", userName)
+		return nil
+	}
+
+	kept, err := setIDs(uid, gid)
+	if err != nil {
+		return fmt.Errorf("switch to uid %d gid %d: %w", uid, gid, err)
+	}
+	if kept {
+		logf("[INFO]", "Dropped privileges to uid %d gid %d (keeping CAP_NET_ADMIN, CAP_NET_RAW)", uid, gid)
+	} else {
+		logf("[WARN]", "Dropped privileges to uid %d gid %d without capabilities (build with CGO_ENABLED=0 to keep them); PMTUD MTU updates and nftables cleanup will fail", uid, gid)
+	}
+	return nil
+}
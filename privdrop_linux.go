@@ -0,0 +1,63 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// ケーパビリティ関連の定数定義（linux/capability.h, linux/prctl.h）
+const (
+	capNetAdmin          = 12
+	capNetRaw            = 13
+	capVersion3          = 0x20080522
+	prCapAmbient         = 47
+	prCapAmbientRaise    = 2
+	keptCapabilitiesMask = 1<<capNetAdmin | 1<<capNetRaw
+)
+
+// capHeaderとcapDataはcapset(2)の引数
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+// setIDs はCAP_NET_ADMIN・CAP_NET_RAWだけを残して指定のUID/GIDへ切り替える関数
+//
+// 実行中のPMTUDによるMTU変更や終了時のnftables削除で外部コマンドを使うため、
+// 両ケーパビリティはambientにも設定して子プロセスへ引き継ぐ。
+// cgoを有効にしたビルドでは全スレッドへの設定ができないため、keptはfalseとなる。
+func setIDs(uid, gid int) (kept bool, err error) {
+	_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, syscall.PR_SET_KEEPCAPS, 1, 0)
+	keep := errno == 0
+
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return false, err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return false, err
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return false, err
+	}
+	if !keep {
+		return false, nil
+	}
+
+	hdr := capHeader{version: capVersion3}
+	data := [2]capData{{effective: keptCapabilitiesMask, permitted: keptCapabilitiesMask, inheritable: keptCapabilitiesMask}}
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return false, errno
+	}
+	for _, c := range []uintptr{capNetAdmin, capNetRaw} {
+		if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientRaise, c); errno != 0 {
+			return false, errno
+		}
+	}
+	return true, nil
+}
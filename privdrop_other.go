@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+// setIDs はLinux以外では未対応
+func setIDs(uid, gid int) (bool, error) {
+	return false, fmt.Errorf("not supported on this platform")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+)
+
+// QoS関連の定数定義
+const (
+	qosMaxDSCP      = 63
+	qosMaxFlowLabel = 0xFFFFF
+)
+
+// QoSConfigは外側ヘッダのDSCP・IPv6フローラベルの設定を保持する
+type QoSConfig struct {
+	DSCP          int    `yaml:"dscp"`            // 外側ヘッダのDSCP（0-63、IPv4はToS・IPv6はTraffic Classの上位6bit）
+	CopyInnerDSCP bool   `yaml:"copy_inner_dscp"` // 内側IPパケットのDSCPを外側へコピー（IP以外のフレームはdscpの値）
+	FlowLabel     string `yaml:"flow_label"`      // IPv6フローラベル（0x1-0xFFFFF、"auto"でカーネルが自動設定）
+}
+
+// qosMarkerは送信パケットの外側ヘッダにDSCPとフローラベルを設定する
+type qosMarker struct {
+	dscp      byte
+	copyInner bool
+	flowLabel uint32 // 0なら固定しない
+	autoLabel bool
+
+	copied atomic.Uint64 // 内側のDSCPをコピーして送信した数
+}
+
+// newQoSMarker はQoS設定を検証して生成する関数（何も設定しなければnilを返す）
+func newQoSMarker(cfg QoSConfig) (*qosMarker, error) {
+	if cfg.DSCP == 0 && !cfg.CopyInnerDSCP && cfg.FlowLabel == "" {
+		return nil, nil
+	}
+	if cfg.DSCP < 0 || cfg.DSCP > qosMaxDSCP {
+		return nil, fmt.Errorf("dscp %d out of range (0-%d)", cfg.DSCP, qosMaxDSCP)
+	}
+	q := &qosMarker{dscp: byte(cfg.DSCP), copyInner: cfg.CopyInnerDSCP}
+	switch cfg.FlowLabel {
+	case "":
+	case "auto":
+		q.autoLabel = true
+	default:
+		v, err := strconv.ParseUint(cfg.FlowLabel, 0, 32)
+		if err != nil || v == 0 || v > qosMaxFlowLabel {
+			return nil, fmt.Errorf("flow_label %q out of range (0x1-0x%X or auto)", cfg.FlowLabel, qosMaxFlowLabel)
+		}
+		q.flowLabel = uint32(v)
+	}
+	return q, nil
+}
+
+// apply はソケットに既定のDSCPとフローラベルの自動設定を行う関数
+func (q *qosMarker) apply(s *Socket) error {
+	if q.dscp != 0 {
+		if err := s.setOption(func(c *net.IPConn) error { return setTrafficClass(c, s.Version, int(q.dscp)<<2) }); err != nil {
+			return fmt.Errorf("set DSCP on IPv%d socket: %w", s.Version, err)
+		}
+	}
+	if s.Version == 6 && q.autoLabel {
+		if err := s.setOption(setAutoFlowLabel); err != nil {
+			return fmt.Errorf("enable automatic flow labels: %w", err)
+		}
+	}
+	return nil
+}
+
+// innerDSCP は内側フレームがIPv4/IPv6であればそのDSCPを返す関数（それ以外は-1）
+func innerDSCP(frame []byte) int {
+	if len(frame) < 14 {
+		return -1
+	}
+	off := 12
+	et := binary.BigEndian.Uint16(frame[off:])
+	for (et == tpid8021Q || et == tpid8021AD) && len(frame) >= off+vlanTagLen+2 {
+		off += vlanTagLen
+		et = binary.BigEndian.Uint16(frame[off:])
+	}
+	ip := frame[off+2:]
+	switch {
+	case et == 0x0800 && len(ip) >= 20:
+		return int(ip[1] >> 2)
+	case et == 0x86DD && len(ip) >= 40:
+		return int((ip[0]&0x0F)<<4|ip[1]>>4) >> 2
+	}
+	return -1
+}
+
+// classify はフレームの送信に使うDSCPを返す関数（ソケットの既定値でよければ-1）
+func (q *qosMarker) classify(frame []byte) int {
+	if q == nil || !q.copyInner {
+		return -1
+	}
+	dscp := innerDSCP(frame)
+	if dscp >= 0 {
+		q.copied.Add(1)
+	}
+	return dscp
+}
+
+// oob はパケットごとに指定する補助データ（DSCP・フローラベル）を返す関数（不要ならnil）
+func (q *qosMarker) oob(version, dscp int) []byte {
+	if q == nil || (dscp < 0 && (version == 4 || q.flowLabel == 0)) {
+		return nil
+	}
+	return qosControlMessage(version, dscp, q.flowLabel)
+}
+
+// Counters は内側のDSCPをコピーした数を返す
+func (q *qosMarker) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"qos_dscp_copied": q.copied.Load(),
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimitConfigはトンネルの帯域制限設定を保持する
+type RateLimitConfig struct {
+	TX       RateConfig `yaml:"tx"`        // 送信方向（TAP → トンネル）
+	RX       RateConfig `yaml:"rx"`        // 受信方向（トンネル → TAP）
+	Policy   string     `yaml:"policy"`    // 超過時の動作（drop or queue）
+	MaxDelay string     `yaml:"max_delay"` // queue時の最大待ち時間（超える場合は破棄）
+}
+
+// RateConfigは一方向のトークンバケット設定を保持する
+type RateConfig struct {
+	Rate  string `yaml:"rate"`  // 帯域（bits/sec、k/M/G接尾辞可、空で無制限）
+	Burst string `yaml:"burst"` // バースト許容量（bits、k/M/G接尾辞可）
+}
+
+// tokenBucketはビット単位のトークンバケット
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // bits/sec
+	burst  float64 // bits
+	tokens float64
+	last   time.Time
+}
+
+// reserve はnビット分のトークンを確保し、送出可能になるまでの待ち時間を返す
+//
+// maxDelayを超える待ちが必要な場合はトークンを消費せずokにfalseを返す。
+func (b *tokenBucket) reserve(n float64, maxDelay time.Duration) (wait time.Duration, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens >= n {
+		b.tokens -= n
+		return 0, true
+	}
+
+	wait = time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+	if wait > maxDelay {
+		return 0, false
+	}
+	b.tokens -= n
+	return wait, true
+}
+
+// rateLimiterは方向ごとのトークンバケットで帯域を制限するフィルタ
+type rateLimiter struct {
+	buckets  [2]*tokenBucket // DirTX, DirRX
+	queue    bool            // 超過時に待機させるか
+	maxDelay time.Duration
+
+	shaped  [2]atomic.Uint64 // 待機させたフレーム数
+	dropped [2]atomic.Uint64 // 破棄したフレーム数
+}
+
+// newRateLimiter は帯域制限設定からフィルタを生成する関数（無制限ならnilを返す）
+func newRateLimiter(cfg RateLimitConfig, mtu int) (*rateLimiter, error) {
+	r := &rateLimiter{maxDelay: 50 * time.Millisecond}
+
+	switch cfg.Policy {
+	case "", "drop":
+	case "queue":
+		r.queue = true
+	default:
+		return nil, fmt.Errorf("invalid policy %q (drop or queue)", cfg.Policy)
+	}
+	if cfg.MaxDelay != "" {
+		d, err := time.ParseDuration(cfg.MaxDelay)
+		if err != nil {
+			return nil, err
+		}
+		r.maxDelay = d
+	}
+
+	// 最大フレームが1つは必ず通過できるバースト量を下限とする
+	minBurst := float64((mtu + 18) * 8)
+
+	policy := "drop"
+	if r.queue {
+		policy = "queue"
+	}
+
+	enabled := false
+	for i, rc := range [2]RateConfig{cfg.TX, cfg.RX} {
+		dir := Direction(i)
+		if rc.Rate == "" {
+			continue
+		}
+		rate, err := parseBitrate(rc.Rate)
+		if err != nil {
+			return nil, fmt.Errorf("%s rate: %w", dir, err)
+		}
+
+		// バースト未指定時は100ms分とする
+		burst := rate / 10
+		if rc.Burst != "" {
+			if burst, err = parseBitrate(rc.Burst); err != nil {
+				return nil, fmt.Errorf("%s burst: %w", dir, err)
+			}
+		}
+		if burst < minBurst {
+			logf("[WARN]", "%s burst %.0f bits is smaller than one frame, raising to %.0f", dir, burst, minBurst)
+			burst = minBurst
+		}
+
+		r.buckets[dir] = &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+		logf("[INFO]", "Rate limit %s: %s (burst %.0f bits, policy %s)", dir, rc.Rate, burst, policy)
+		enabled = true
+	}
+
+	if !enabled {
+		return nil, nil
+	}
+	return r, nil
+}
+
+// parseBitrate は"10M"や"512k"などの表記をビット数に変換する関数
+func parseBitrate(s string) (float64, error) {
+	s = strings.TrimSuffix(strings.TrimSpace(s), "bps")
+	mult := 1.0
+	switch {
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "K"):
+		mult = 1e3
+	case strings.HasSuffix(s, "M"):
+		mult = 1e6
+	case strings.HasSuffix(s, "G"):
+		mult = 1e9
+	}
+	if mult != 1.0 {
+		s = s[:len(s)-1]
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if v <= 0 {
+		return 0, fmt.Errorf("must be positive")
+	}
+	return v * mult, nil
+}
+
+// Filter はトークンバケットに従ってフレームを通過・待機・破棄する
+func (r *rateLimiter) Filter(dir Direction, frame []byte) ([]byte, Verdict) {
+	b := r.buckets[dir]
+	if b == nil {
+		return frame, VerdictPass
+	}
+
+	maxDelay := time.Duration(0)
+	if r.queue {
+		maxDelay = r.maxDelay
+	}
+
+	wait, ok := b.reserve(float64(len(frame)*8), maxDelay)
+	if !ok {
+		r.dropped[dir].Add(1)
+		return nil, VerdictDrop
+	}
+	if wait > 0 {
+		r.shaped[dir].Add(1)
+		time.Sleep(wait)
+	}
+	return frame, VerdictPass
+}
+
+// Counters は帯域制限のカウンタを返す
+func (r *rateLimiter) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"ratelimit_tx_shaped":  r.shaped[DirTX].Load(),
+		"ratelimit_tx_dropped": r.dropped[DirTX].Load(),
+		"ratelimit_rx_shaped":  r.shaped[DirRX].Load(),
+		"ratelimit_rx_dropped": r.dropped[DirRX].Load(),
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 再帰経路検出関連の定数定義
+const recursionDefaultInterval = 5 * time.Second // 宛先への経路を確認する既定の間隔
+
+// errRecursiveRoute は宛先への経路がトンネル自身を向いているため送信しなかったことを示す
+var errRecursiveRoute = errors.New("route to peer points into the tunnel")
+
+// recursionGuardはピアの宛先への経路がTAP・ブリッジを向いていないか監視する
+//
+// トンネル越しのネットワークにピアのアドレスが含まれると、カプセル化したパケットが再びTAPへ
+// 経路選択されて無限に再カプセル化され、CPUとWAN回線を使い潰す。該当する経路は送信を止めて断とする。
+type recursionGuard struct {
+	t        *Tunnel
+	interval time.Duration
+	devices  map[string]bool // トンネル自身とみなす出力インターフェース（TAP・ブリッジ）
+
+	detected atomic.Uint64 // 再帰経路を検出した回数
+	dropped  atomic.Uint64 // 再帰経路のため送信しなかったパケット数
+}
+
+// newRecursionGuard は再帰経路の監視を設定し、起動時点の経路を確認する関数（"off"ならnilを返す）
+func newRecursionGuard(t *Tunnel, interval string) (*recursionGuard, error) {
+	if interval == "off" {
+		return nil, nil
+	}
+	d, err := parseRecursionInterval(interval)
+	if err != nil {
+		return nil, err
+	}
+	g := &recursionGuard{t: t, interval: d, devices: map[string]bool{t.cfg.TapName: true}}
+	if t.cfg.BrName != "off" {
+		g.devices[t.cfg.BrName] = true
+	}
+	g.check()
+	return g, nil
+}
+
+// parseRecursionInterval は確認間隔を解析する関数（空なら既定値）
+func parseRecursionInterval(interval string) (time.Duration, error) {
+	if interval == "" {
+		return recursionDefaultInterval, nil
+	}
+	d, err := time.ParseDuration(interval)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("interval must be positive")
+	}
+	return d, nil
+}
+
+// routeDevice は宛先への経路の出力インターフェースを調べる関数
+func routeDevice(dst net.IP) (string, error) {
+	out, err := exec.Command("ip", "-o", "route", "get", dst.String()).Output()
+	if err != nil {
+		return "", fmt.Errorf("no route to %s", dst)
+	}
+	fields := strings.Fields(string(out))
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "dev" {
+			return fields[i+1], nil
+		}
+	}
+	return "", fmt.Errorf("no output device for %s", dst)
+}
+
+// check は全経路の宛先への経路を確認し、再帰の検出・解消に応じて経路の状態を更新する関数
+//
+// 解消時はキープアライブ有効時は次の応答を待ち、無効時は直ちに戻す。
+func (g *recursionGuard) check() {
+	for _, peer := range g.t.peers {
+		changed, reason := false, "recursive route cleared"
+		for _, p := range peer.paths {
+			dst := p.Dst.Load().(net.IP)
+			dev, err := routeDevice(dst)
+			if err != nil {
+				continue
+			}
+			looped := g.devices[dev]
+			switch {
+			case looped && !p.recursing.Swap(true):
+				logf("[ERROR]", "Recursive routing: IPv%d packets to %s (%s) would be routed via %s; stopped sending on this path", p.Version, p.Host, dst, dev)
+				g.t.events.emit("recursion", peer.Host, fmt.Sprintf("%s routed via %s", dst, dev))
+				g.detected.Add(1)
+				p.up.Store(false)
+				changed, reason = true, "recursive route to peer"
+			case !looped && p.recursing.Swap(false):
+				logf("[RESET]", "Route to %s (%s) no longer points into the tunnel (via %s)", p.Host, dst, dev)
+				if g.t.keepaliveInterval == 0 {
+					p.up.Store(true)
+					changed = true
+				}
+			}
+		}
+		if changed {
+			g.t.refreshPeer(peer, reason)
+		}
+	}
+}
+
+// run は定期的に宛先への経路を確認する関数
+func (g *recursionGuard) run() {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		g.check()
+	}
+}
+
+// Counters は再帰経路の検出回数と送信しなかったパケット数を返す
+func (g *recursionGuard) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"recursion_detected":   g.detected.Load(),
+		"tx_recursion_dropped": g.dropped.Load(),
+	}
+}
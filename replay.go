@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// pcap読み込み関連の定数定義
+const (
+	pcapMagicMicro  = 0xA1B2C3D4 // マイクロ秒精度のpcap
+	pcapngMagic     = 0x0A0D0D0A // pcapng（未対応）
+	pcapMaxRecord   = 262144     // 1レコードの最大長（破損ファイルの検出用）
+	replayMaxSleep  = time.Second
+	replayStatsTick = 5 * time.Second
+)
+
+// pcapReaderはpcapファイルからフレームを順に読み出す
+type pcapReader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+	nano  bool   // タイムスタンプがナノ秒精度
+	link  uint32 // リンク種別（1: Ethernet, 101: IPパケット）
+}
+
+// newPCAPReader はpcapのファイルヘッダを読んで読み出し器を生成する関数
+func newPCAPReader(r io.Reader) (*pcapReader, error) {
+	p := &pcapReader{r: bufio.NewReaderSize(r, 1<<16)}
+	hdr := make([]byte, 24)
+	if _, err := io.ReadFull(p.r, hdr); err != nil {
+		return nil, fmt.Errorf("short pcap header: %w", err)
+	}
+	switch magic := binary.LittleEndian.Uint32(hdr[0:4]); {
+	case magic == pcapngMagic:
+		return nil, errors.New("pcapng is not supported; convert with 'editcap -F pcap'")
+	case magic == pcapMagicMicro || magic == pcapMagicNano:
+		p.order, p.nano = binary.LittleEndian, magic == pcapMagicNano
+	case binary.BigEndian.Uint32(hdr[0:4]) == pcapMagicMicro || binary.BigEndian.Uint32(hdr[0:4]) == pcapMagicNano:
+		p.order, p.nano = binary.BigEndian, binary.BigEndian.Uint32(hdr[0:4]) == pcapMagicNano
+	default:
+		return nil, fmt.Errorf("not a pcap file (magic %#08x)", magic)
+	}
+	p.link = p.order.Uint32(hdr[20:24]) & 0x0FFFFFFF
+	if p.link != pcapLinkEthernet && p.link != pcapLinkRaw {
+		return nil, fmt.Errorf("unsupported link type %d (Ethernet or raw IP with EtherIP only)", p.link)
+	}
+	return p, nil
+}
+
+// next は次のレコードのタイムスタンプとデータを返す関数（途中で切り詰められたレコードはtruncatedを返す）
+func (p *pcapReader) next() (ts time.Duration, data []byte, truncated bool, err error) {
+	var rec [16]byte
+	if _, err := io.ReadFull(p.r, rec[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			err = fmt.Errorf("truncated record header")
+		}
+		return 0, nil, false, err
+	}
+	sec, frac := p.order.Uint32(rec[0:4]), p.order.Uint32(rec[4:8])
+	capLen, origLen := p.order.Uint32(rec[8:12]), p.order.Uint32(rec[12:16])
+	if capLen > pcapMaxRecord {
+		return 0, nil, false, fmt.Errorf("record length %d is too large (corrupt file?)", capLen)
+	}
+	data = make([]byte, capLen)
+	if _, err := io.ReadFull(p.r, data); err != nil {
+		return 0, nil, false, fmt.Errorf("truncated record: %w", err)
+	}
+	ts = time.Duration(sec) * time.Second
+	if p.nano {
+		ts += time.Duration(frac)
+	} else {
+		ts += time.Duration(frac) * time.Microsecond
+	}
+	return ts, data, capLen < origLen, nil
+}
+
+// innerFrame はレコードから内側のEthernetフレームを取り出す関数（IPパケットはEtherIPのみ、圧縮は未対応）
+func (p *pcapReader) innerFrame(data []byte) ([]byte, bool) {
+	if p.link == pcapLinkEthernet {
+		return data, len(data) >= 14
+	}
+	if len(data) < 1 {
+		return nil, false
+	}
+	var payload []byte
+	switch data[0] >> 4 {
+	case 4:
+		ihl := int(data[0]&0x0F) * 4
+		if len(data) < 20 || ihl < 20 || len(data) < ihl || data[9] != etherIPProto ||
+			binary.BigEndian.Uint16(data[6:8])&0x3FFF != 0 {
+			return nil, false
+		}
+		payload = data[ihl:]
+	case 6:
+		if len(data) < 40 || data[6] != etherIPProto {
+			return nil, false
+		}
+		payload = data[40:]
+	default:
+		return nil, false
+	}
+	frame, ok := etherIPPayload(payload)
+	return frame, ok && len(frame) >= 14
+}
+
+// frameInjectorはTAPへフレームを送り込み、トンネルの送信経路に乗せる
+type frameInjector interface {
+	Inject(frame []byte) error
+	Close() error
+}
+
+// replayStatsは再生したフレーム数と読み飛ばした数
+type replayStats struct {
+	sent, bytes, skipped, filtered, errors uint64
+}
+
+// runReplay は"replay"サブコマンドを実行し、終了コードを返す関数
+//
+// pcapのフレームを動作中のトンネルのTAPへ注入し、送信経路（フィルタチェーン→カプセル化→ピア）を通す。
+// 元の送信間隔をspeed倍で再現し、負荷試験や報告された通信パターンの再現に使う。
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	path := fs.String("c", "config.yaml", "設定ファイルのパス（-i省略時に先頭のトンネルのtap_nameを使う）")
+	ifname := fs.String("i", "", "注入先のTAP（空で設定ファイルのtap_name）")
+	file := fs.String("r", "", "再生するpcapファイル（Ethernet、またはEtherIPの外側IPパケット）")
+	speed := fs.Float64("speed", 1, "再生速度の倍率（2で2倍速、0で間隔を空けずに送信）")
+	loop := fs.Int("loop", 1, "繰り返し回数（0で中断するまで繰り返す）")
+	filter := fs.String("filter", "", "再生するフレームを選ぶフィルタ式（captureと同じ書式）")
+	control := fs.String("control", "", "pcapの代わりに制御プレーンの記録（control_trace.file）を再生して経路の判定をやり直す（デーモン不要、-iでトンネルを絞る）")
+	fs.Parse(args)
+
+	if *control != "" {
+		return replayControl(*control, *ifname)
+	}
+
+	if *file == "" && fs.NArg() == 1 {
+		*file = fs.Arg(0)
+	}
+	if *file == "" {
+		fmt.Fprintln(os.Stderr, "usage: etherip replay [-c config.yaml] [-i tap0] [-speed 1] [-loop 1] [-filter expr] -r file.pcap")
+		fmt.Fprintln(os.Stderr, "       etherip replay [-i tap0] -control trace.jsonl")
+		return 2
+	}
+	if *speed < 0 || *loop < 0 {
+		fmt.Fprintln(os.Stderr, "ERROR: speed and loop must not be negative")
+		return 2
+	}
+	match, err := compileCaptureFilter(*filter)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: filter: %v\n", err)
+		return 2
+	}
+	if *ifname == "" {
+		cfgs, err := loadConfigs(*path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v (use -i to name the TAP)\n", err)
+			return 1
+		}
+		*ifname = cfgs[0].TapName
+	}
+	if !ifaceExists(*ifname) {
+		fmt.Fprintf(os.Stderr, "ERROR: interface %s not found (is the tunnel running?)\n", *ifname)
+		return 1
+	}
+	inj, err := openFrameInjector(*ifname)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s: %v\n", *ifname, err)
+		return 1
+	}
+	defer inj.Close()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	var st replayStats
+	started := time.Now()
+	ticker := time.NewTicker(replayStatsTick)
+	defer ticker.Stop()
+	fmt.Printf("Replaying %s into %s (speed %gx, loop %d)\n", *file, *ifname, *speed, *loop)
+
+	code := 0
+	for n := 0; *loop == 0 || n < *loop; n++ {
+		done, err := replayFile(*file, inj, *speed, match, &st, stop, ticker.C)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s: %v\n", *file, err)
+			code = 1
+			break
+		}
+		if done {
+			break
+		}
+	}
+	elapsed := time.Since(started).Seconds()
+	fmt.Printf("Sent %d frames (%s) in %.1fs, %.1f pps; skipped %d, filtered %d, errors %d\n",
+		st.sent, formatBytes(st.bytes), elapsed, float64(st.sent)/max(elapsed, 0.001), st.skipped, st.filtered, st.errors)
+	return code
+}
+
+// replayFile はpcapを1回再生する関数（中断されたらdoneを返す）
+func replayFile(path string, inj frameInjector, speed float64, match captureFilter, st *replayStats, stop <-chan os.Signal, tick <-chan time.Time) (done bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	p, err := newPCAPReader(f)
+	if err != nil {
+		return false, err
+	}
+
+	var first time.Duration
+	start := time.Now()
+	for i := 0; ; i++ {
+		ts, data, truncated, err := p.next()
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if i == 0 {
+			first = ts
+		}
+		frame, ok := p.innerFrame(data)
+		if !ok || truncated {
+			st.skipped++
+			continue
+		}
+		if match != nil {
+			if ff, ok := parseFrameFields(frame); !ok || !match(ff) {
+				st.filtered++
+				continue
+			}
+		}
+
+		// 元の送信時刻まで待つ（待ち時間が長くても中断・進捗表示に応じられるよう分割する）
+		if speed > 0 && ts > first {
+			due := start.Add(time.Duration(float64(ts-first) / speed))
+			for wait := time.Until(due); wait > 0; wait = time.Until(due) {
+				select {
+				case <-stop:
+					return true, nil
+				case <-tick:
+					fmt.Printf("  %d frames sent\n", st.sent)
+				case <-time.After(min(wait, replayMaxSleep)):
+				}
+			}
+		}
+		select {
+		case <-stop:
+			return true, nil
+		case <-tick:
+			fmt.Printf("  %d frames sent\n", st.sent)
+		default:
+		}
+
+		if err := inj.Inject(frame); err != nil {
+			if st.errors == 0 {
+				fmt.Fprintf(os.Stderr, "WARN: failed to inject frame %d: %v\n", i+1, err)
+			}
+			st.errors++
+			continue
+		}
+		st.sent++
+		st.bytes += uint64(len(frame))
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// packetInjectorはAF_PACKETソケットでTAPからフレームを送出する
+//
+// TAPから送出したフレームはデーモンがTAPから読み取るため、通常のTX経路と同じ処理を受ける。
+type packetInjector struct {
+	fd   int
+	addr *syscall.SockaddrLinklayer
+}
+
+// openFrameInjector はTAPに束縛したAF_PACKETソケットを開く関数
+func openFrameInjector(ifname string) (frameInjector, error) {
+	ifi, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+	if err != nil {
+		return nil, err
+	}
+	addr := &syscall.SockaddrLinklayer{Ifindex: ifi.Index}
+	if err := syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &packetInjector{fd: fd, addr: addr}, nil
+}
+
+// Inject はフレームを1件送出する
+func (p *packetInjector) Inject(frame []byte) error {
+	return syscall.Sendto(p.fd, frame, 0, p.addr)
+}
+
+// Close はソケットを閉じる
+func (p *packetInjector) Close() error {
+	return syscall.Close(p.fd)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+// openFrameInjector はLinux以外では未対応
+func openFrameInjector(ifname string) (frameInjector, error) {
+	return nil, fmt.Errorf("not supported on this platform")
+}
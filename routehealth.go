@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+)
+
+// RouteHealthConfigはルーティングデーモンから受け取る経路によるフェイルオーバーの設定を保持する
+//
+// FRRやGoBGPとBGPセッションを張ってIPv4/IPv6ユニキャスト経路を受け取り、ピアの宛先を含む経路が
+// 取り消された時点で、キープアライブのタイムアウトを待たずにその経路を断とみなす。
+type RouteHealthConfig struct {
+	Neighbor string `yaml:"neighbor"`  // BGPネイバー（"127.0.0.1" または "127.0.0.1:179"、空で無効）
+	LocalAS  uint32 `yaml:"local_as"`  // 自AS番号
+	PeerAS   uint32 `yaml:"peer_as"`   // ネイバーのAS番号（省略時はlocal_asでiBGP）
+	RouterID string `yaml:"router_id"` // BGP識別子（省略時はsrc_ifaceのIPv4アドレス）
+}
+
+// routeWatcherは受信した経路表を保持し、ピアの宛先への到達性を判定する
+type routeWatcher struct {
+	bgpNeighbor
+	t *Tunnel
+
+	mu      sync.Mutex
+	rib     map[netip.Prefix]bool // 受信済みのプレフィックス（デフォルト経路は判定に使わない）
+	covered map[*Path]bool        // 宛先を含む経路があったか
+
+	established atomic.Bool
+	withdrawals atomic.Uint64 // 経路の取り消しで経路断とした回数
+}
+
+// newRouteWatcher は経路監視の設定を検証して生成する関数
+func newRouteWatcher(t *Tunnel, cfg RouteHealthConfig) (*routeWatcher, error) {
+	var fallback net.IP
+	for _, s := range t.socks {
+		if s.Version == 4 && !s.SrcIP.IsUnspecified() {
+			fallback = s.SrcIP
+		}
+	}
+	n, err := newBGPNeighbor(cfg.Neighbor, cfg.LocalAS, cfg.PeerAS, cfg.RouterID, fallback,
+		bgpFamily{1, 1}, bgpFamily{2, 1})
+	if err != nil {
+		return nil, err
+	}
+	return &routeWatcher{
+		bgpNeighbor: n,
+		t:           t,
+		rib:         make(map[netip.Prefix]bool),
+		covered:     make(map[*Path]bool),
+	}, nil
+}
+
+// parsePrefixes はNLRI形式（プレフィックス長 + アドレス）の並びを読み取る関数
+func parsePrefixes(b []byte, version int) ([]netip.Prefix, error) {
+	var list []netip.Prefix
+	for len(b) > 0 {
+		bits := int(b[0])
+		n := (bits + 7) / 8
+		if bits > ipBits(version) || len(b) < 1+n {
+			return nil, fmt.Errorf("invalid IPv%d prefix", version)
+		}
+		var addr netip.Addr
+		if version == 4 {
+			var a [4]byte
+			copy(a[:], b[1:1+n])
+			addr = netip.AddrFrom4(a)
+		} else {
+			var a [16]byte
+			copy(a[:], b[1:1+n])
+			addr = netip.AddrFrom16(a)
+		}
+		list = append(list, netip.PrefixFrom(addr, bits).Masked())
+		b = b[1+n:]
+	}
+	return list, nil
+}
+
+// ipBits はアドレスファミリのアドレス長（ビット）を返す関数
+func ipBits(version int) int {
+	if version == 4 {
+		return 32
+	}
+	return 128
+}
+
+// parseRouteUpdate はUPDATEから追加・取り消されたユニキャスト経路を取り出す関数
+func parseRouteUpdate(body []byte) (reach, unreach []netip.Prefix, err error) {
+	withdrawn, attrs, nlri, err := splitUpdate(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if unreach, err = parsePrefixes(withdrawn, 4); err != nil {
+		return nil, nil, err
+	}
+	if reach, err = parsePrefixes(nlri, 4); err != nil {
+		return nil, nil, err
+	}
+
+	// MP_REACH_NLRI / MP_UNREACH_NLRI（IPv6ユニキャスト等）
+	var mpErr error
+	err = walkAttrs(attrs, func(code byte, v []byte) {
+		if (code != bgpAttrMPReach && code != bgpAttrMPUnreach) || len(v) < 3 || v[2] != 1 {
+			return
+		}
+		version := 0
+		switch binary.BigEndian.Uint16(v[0:2]) {
+		case 1:
+			version = 4
+		case 2:
+			version = 6
+		default:
+			return
+		}
+		v = v[3:]
+		if code == bgpAttrMPReach {
+			if len(v) < 1 || len(v) < 2+int(v[0]) {
+				mpErr = fmt.Errorf("truncated MP_REACH_NLRI")
+				return
+			}
+			v = v[2+int(v[0]):] // ネクストホップと予約バイトを飛ばす
+		}
+		list, err := parsePrefixes(v, version)
+		if err != nil {
+			mpErr = err
+			return
+		}
+		if code == bgpAttrMPReach {
+			reach = append(reach, list...)
+		} else {
+			unreach = append(unreach, list...)
+		}
+	})
+	if err == nil {
+		err = mpErr
+	}
+	return reach, unreach, err
+}
+
+// covers はデフォルト経路以外に宛先を含むプレフィックスがあるか判定する関数（ロック取得済みで呼ぶ）
+func (w *routeWatcher) covers(dst net.IP) bool {
+	addr, ok := netip.AddrFromSlice(dst)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	for bits := addr.BitLen(); bits > 0; bits-- {
+		if p, err := addr.Prefix(bits); err == nil && w.rib[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluate は経路表の変化に応じて各経路の断・復旧を判定する関数（ロック取得済みで呼ぶ）
+//
+// 宛先を含む経路が一度も届いていない経路は判定しない。復旧はキープアライブ有効時は
+// 次の応答を待ち、無効時は経路の再広告で直ちに戻す。
+func (w *routeWatcher) evaluate() {
+	for _, peer := range w.t.peers {
+		changed, reason := false, "route to peer restored"
+		for _, p := range peer.paths {
+			dst := p.Dst.Load().(net.IP)
+			ok := w.covers(dst)
+			prev := w.covered[p]
+			w.covered[p] = ok
+			switch {
+			case prev && !ok:
+				p.routeDown.Store(true)
+				if p.up.Swap(false) {
+					logf("[WARN]", "IPv%d path to %s (%s) lost (route withdrawn)", p.Version, peer.Host, dst)
+				}
+				w.withdrawals.Add(1)
+				changed, reason = true, "route to peer withdrawn"
+			case ok && p.routeDown.Swap(false):
+				logf("[RESET]", "Route to %s (%s) restored", peer.Host, dst)
+				if w.t.keepaliveInterval == 0 {
+					p.up.Store(true)
+					changed = true
+				}
+			}
+		}
+		if changed {
+			w.t.refreshPeer(peer, reason)
+		}
+	}
+}
+
+// session はネイバーへ接続して経路を受け取り、切断まで処理する関数
+func (w *routeWatcher) session() error {
+	conn, r, hold, err := w.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	w.established.Store(true)
+	logf("[INFO]", "Route health session with %s established (hold %v)", w.addr, hold)
+	defer w.teardown()
+
+	var wmu sync.Mutex
+	done := make(chan struct{})
+	defer close(done)
+	go bgpKeepalive(hold, done, func(msg []byte) error {
+		wmu.Lock()
+		defer wmu.Unlock()
+		_, err := conn.Write(msg)
+		return err
+	})
+
+	return bgpReadLoop(conn, r, hold, func(body []byte) error {
+		reach, unreach, err := parseRouteUpdate(body)
+		if err != nil {
+			return err
+		}
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		for _, p := range unreach {
+			delete(w.rib, p)
+		}
+		for _, p := range reach {
+			if p.Bits() > 0 {
+				w.rib[p] = true
+			}
+		}
+		w.evaluate()
+		return nil
+	})
+}
+
+// teardown はセッション切断時に経路表を破棄し、経路断の判定をキープアライブへ戻す関数
+func (w *routeWatcher) teardown() {
+	w.established.Store(false)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	clear(w.rib)
+	clear(w.covered)
+	for _, peer := range w.t.peers {
+		changed := false
+		for _, p := range peer.paths {
+			if p.routeDown.Swap(false) && w.t.keepaliveInterval == 0 {
+				p.up.Store(true)
+				changed = true
+			}
+		}
+		if changed {
+			w.t.refreshPeer(peer, "route health session down")
+		}
+	}
+}
+
+// run はネイバーとのセッションを維持する関数
+func (w *routeWatcher) run() {
+	logf("[INFO]", "Route health: neighbor %s (AS %d → %d)", w.addr, w.localAS, w.peerAS)
+	w.bgpNeighbor.run("Route health", w.session)
+}
+
+// Counters は経路監視のカウンタを返す
+func (w *routeWatcher) Counters() map[string]uint64 {
+	w.mu.Lock()
+	n := len(w.rib)
+	w.mu.Unlock()
+	var up uint64
+	if w.established.Load() {
+		up = 1
+	}
+	return map[string]uint64{
+		"route_health_established": up,
+		"route_health_prefixes":    uint64(n),
+		"route_health_withdrawals": w.withdrawals.Load(),
+	}
+}
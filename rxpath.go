@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// IPv6の拡張ヘッダ（RFC 8200）
+const (
+	ipv6HopByHop = 0
+	ipv6Routing  = 43
+	ipv6Fragment = 44
+	ipv6AH       = 51
+	ipv6DestOpts = 60
+	ipv6MaxExt   = 8 // 読み飛ばす拡張ヘッダの数の上限（連鎖を使った負荷を避ける）
+)
+
+// OuterHopLimitConfigは外側パケットのTTL（IPv4）・ホップリミット（IPv6）の設定を保持する
+type OuterHopLimitConfig struct {
+	TX    int `yaml:"tx"`     // 送信する外側パケットの値（1-255、0でカーネルの既定値）
+	RXMin int `yaml:"rx_min"` // これ未満で届いた外側パケットを破棄する（1-255、0で無効、255で直結のピアのみ、RFC 5082）
+}
+
+// validate はTTL・ホップリミットの範囲を検証する関数
+func (c OuterHopLimitConfig) validate() error {
+	if c.TX < 0 || c.TX > 255 {
+		return fmt.Errorf("tx must be between 1 and 255")
+	}
+	if c.RXMin < 0 || c.RXMin > 255 {
+		return fmt.Errorf("rx_min must be between 1 and 255")
+	}
+	return nil
+}
+
+// applyHopLimit はソケットに送信時のTTL・ホップリミットを設定し、rx_min設定時は受信時の値を得られるようにする関数
+func applyHopLimit(s *Socket, cfg OuterHopLimitConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	if cfg.TX > 0 {
+		if err := s.setOption(func(c *net.IPConn) error { return setHopLimit(c, s.Version, cfg.TX) }); err != nil {
+			return fmt.Errorf("IPv%d hop limit: %w", s.Version, err)
+		}
+	}
+	// IPv4はヘッダごと受信するため、IPv6だけ補助データで受け取る
+	if cfg.RXMin > 0 && s.Version == 6 {
+		if err := setRecvHopLimit(s.Conn); err != nil {
+			return fmt.Errorf("IPv6 receive hop limit: %w", err)
+		}
+	}
+	return nil
+}
+
+// read はRAWソケットから外側パケットを1つ読み、bufの先頭にIPヘッダより後ろ（EtherIPヘッダ以降）を置く関数
+//
+// IPv4のRAWソケットはIPヘッダごと渡すため、ヘッダを検証して取り除く。IPv6はカーネルが拡張ヘッダまで取り除いて
+// ペイロードだけを渡すため、ホップリミットは補助データから読む（受け取れなければ-1）。不正なパケットはn=0を返す。
+func (s *Socket) read(buf, oob []byte) (n int, from *net.IPAddr, hops int, err error) {
+	if s.sim != nil {
+		return s.sim.read(s, buf)
+	}
+	n, oobn, flags, from, err := s.Conn.ReadMsgIP(buf, oob)
+	if err != nil {
+		return 0, nil, -1, err
+	}
+	// 受信バッファ（buffers.size）に収まらなかったパケットは末尾が欠けているため破棄する
+	if flags&msgTrunc != 0 {
+		s.truncated.Add(1)
+		return 0, from, -1, nil
+	}
+	if s.Version == 6 {
+		return n, from, parseHopLimit(oob[:oobn]), nil
+	}
+	payload, ttl, ok := ipv4Payload(buf[:n])
+	if !ok {
+		return 0, from, -1, nil
+	}
+	return copy(buf, payload), from, ttl, nil
+}
+
+// ipv4Payload はIPv4ヘッダを検証し、ペイロードとTTLを返す関数
+func ipv4Payload(pkt []byte) (payload []byte, ttl int, ok bool) {
+	if len(pkt) < 20 || pkt[0]>>4 != 4 {
+		return nil, 0, false
+	}
+	ihl, total := int(pkt[0]&0x0F)*4, int(binary.BigEndian.Uint16(pkt[2:4]))
+	if ihl < 20 || total < ihl || total > len(pkt) {
+		return nil, 0, false
+	}
+	return pkt[ihl:total], int(pkt[8]), true
+}
+
+// ipv6Payload はIPv6ヘッダに続く拡張ヘッダを読み飛ばし、protoのペイロードを返す関数
+//
+// AF_PACKETで読むパケットはカーネルが拡張ヘッダを処理する前のものなので、固定ヘッダの次ヘッダだけで判定しない。
+// protoのフラグメントはfragment=trueを返す（af_packetでは再構築しない）。上位プロトコルが別のパケットはnilを返し、
+// ヘッダが壊れている場合だけok=falseを返す。
+func ipv6Payload(pkt []byte, proto byte) (payload []byte, fragment bool, ok bool) {
+	if len(pkt) < 40 || pkt[0]>>4 != 6 {
+		return nil, false, false
+	}
+	plen := int(binary.BigEndian.Uint16(pkt[4:6]))
+	if plen == 0 || 40+plen > len(pkt) {
+		return nil, false, false // ジャンボグラム・途中で切れたパケット
+	}
+	next, rest := pkt[6], pkt[40:40+plen]
+	for i := 0; i <= ipv6MaxExt; i++ {
+		var hlen int
+		switch next {
+		case proto:
+			return rest, false, true
+		case ipv6HopByHop, ipv6Routing, ipv6DestOpts:
+			if len(rest) < 8 {
+				return nil, false, false
+			}
+			hlen = (int(rest[1]) + 1) * 8
+		case ipv6AH:
+			if len(rest) < 8 {
+				return nil, false, false
+			}
+			hlen = (int(rest[1]) + 2) * 4
+		case ipv6Fragment:
+			if len(rest) < 8 {
+				return nil, false, false
+			}
+			return nil, rest[0] == proto, true
+		default:
+			return nil, false, true // ESP・上位プロトコルが別（自分宛てではない）
+		}
+		if hlen > len(rest) {
+			return nil, false, false
+		}
+		next, rest = rest[0], rest[hlen:]
+	}
+	return nil, false, true
+}
@@ -0,0 +1,6 @@
+//go:build !unix
+
+package main
+
+// msgTrunc はMSG_TRUNCのないプラットフォームでは0（切り詰めを検出しない）
+const msgTrunc = 0
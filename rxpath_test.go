@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// ipv6TestPacket は次ヘッダnextと拡張ヘッダ・ペイロードを続けたIPv6パケットを組み立てる
+func ipv6TestPacket(next byte, rest []byte) []byte {
+	pkt := make([]byte, 40, 40+len(rest))
+	pkt[0] = 6 << 4
+	binary.BigEndian.PutUint16(pkt[4:6], uint16(len(rest)))
+	pkt[6], pkt[7] = next, 64
+	return append(pkt, rest...)
+}
+
+// ipv6TestExt は次ヘッダnextを持つ8バイト単位の拡張ヘッダ（Hop-by-Hop・Routing・Destination Options）を作る
+func ipv6TestExt(next byte, units int) []byte {
+	ext := make([]byte, units*8)
+	ext[0], ext[1] = next, byte(units-1)
+	return ext
+}
+
+func TestIPv6Payload(t *testing.T) {
+	payload := []byte{0x30, 0x00, 0xde, 0xad, 0xbe, 0xef}
+	cat := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	fragment := func(next byte) []byte { return []byte{next, 0, 0, 1, 0, 0, 0, 42} } // オフセット0、後続あり
+
+	loop := []byte{}
+	for i := 0; i <= ipv6MaxExt; i++ {
+		loop = append(loop, ipv6TestExt(ipv6DestOpts, 1)...)
+	}
+
+	tests := []struct {
+		name     string
+		pkt      []byte
+		payload  []byte
+		fragment bool
+		ok       bool
+	}{
+		{"no extension", ipv6TestPacket(etherIPProto, payload), payload, false, true},
+		{"hop-by-hop", ipv6TestPacket(ipv6HopByHop, cat(ipv6TestExt(etherIPProto, 1), payload)), payload, false, true},
+		{"routing", ipv6TestPacket(ipv6Routing, cat(ipv6TestExt(etherIPProto, 3), payload)), payload, false, true},
+		{"hop-by-hop and destination options", ipv6TestPacket(ipv6HopByHop, cat(ipv6TestExt(ipv6DestOpts, 1), ipv6TestExt(etherIPProto, 2), payload)), payload, false, true},
+		{"fragment", ipv6TestPacket(ipv6Fragment, cat(fragment(etherIPProto), payload)), nil, true, true},
+		{"fragment of other protocol", ipv6TestPacket(ipv6Fragment, cat(fragment(17), payload)), nil, false, true},
+		{"other protocol", ipv6TestPacket(17, payload), nil, false, true},
+		{"truncated extension", ipv6TestPacket(ipv6Routing, ipv6TestExt(etherIPProto, 2)[:12]), nil, false, false},
+		{"extension shorter than 8 bytes", ipv6TestPacket(ipv6HopByHop, []byte{etherIPProto, 0, 0, 0}), nil, false, false},
+		{"truncated fragment", ipv6TestPacket(ipv6Fragment, fragment(etherIPProto)[:4]), nil, false, false},
+		{"payload length beyond packet", ipv6TestPacket(etherIPProto, payload)[:44], nil, false, false},
+		{"jumbogram", ipv6TestPacket(ipv6HopByHop, nil), nil, false, false},
+		{"not ipv6", ipv6TestPacket(etherIPProto, payload)[1:], nil, false, false},
+		{"extension loop", ipv6TestPacket(ipv6DestOpts, cat(loop, payload)), nil, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, fragment, ok := ipv6Payload(tt.pkt, etherIPProto)
+			if ok != tt.ok || fragment != tt.fragment || !bytes.Equal(got, tt.payload) {
+				t.Errorf("ipv6Payload() = % x, %v, %v, want % x, %v, %v", got, fragment, ok, tt.payload, tt.fragment, tt.ok)
+			}
+		})
+	}
+}
+
+func TestOuterHopLimitValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  OuterHopLimitConfig
+		ok   bool
+	}{
+		{"disabled", OuterHopLimitConfig{}, true},
+		{"tx and rx_min", OuterHopLimitConfig{TX: 255, RXMin: 255}, true},
+		{"tx minimum", OuterHopLimitConfig{TX: 1}, true},
+		{"negative tx", OuterHopLimitConfig{TX: -1}, false},
+		{"tx too large", OuterHopLimitConfig{TX: 256}, false},
+		{"negative rx_min", OuterHopLimitConfig{RXMin: -1}, false},
+		{"rx_min too large", OuterHopLimitConfig{RXMin: 256}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.validate(); (err == nil) != tt.ok {
+				t.Errorf("validate() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestReceiveHopLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		rxMin   int
+		hops    int
+		dropped bool
+	}{
+		{"disabled", 0, 1, false},
+		{"unknown hop limit", 255, -1, false},
+		{"directly connected", 255, 255, false},
+		{"above minimum", 64, 100, false},
+		{"at minimum", 64, 64, false},
+		{"below minimum", 64, 63, true},
+		{"one router away", 255, 254, true},
+		{"zero", 1, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hc, err := newHeaderChecker("strict", false, false, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tun := &Tunnel{
+				cfg:    &Config{OuterHopLimit: OuterHopLimitConfig{RXMin: tt.rxMin}},
+				header: hc,
+				rxBufs: newBufferPool(DirRX, bufferSizing{size: 64}),
+			}
+			// バージョン不正のヘッダにして、ホップ数の検査を通ったパケットはヘッダ検証で破棄させる
+			buf := tun.rxBufs.get()
+			buf[0], buf[1] = 0x40, 0x00
+			tun.receive(&Socket{Version: 6}, buf, etherIPHeaderLen, &net.IPAddr{IP: net.ParseIP("2001:db8::2")}, tt.hops)
+			if got := tun.hopDropped.Load(); got != map[bool]uint64{true: 1}[tt.dropped] {
+				t.Errorf("hopDropped = %d, want dropped %v", got, tt.dropped)
+			}
+			if got := hc.Counters()["rx_header_bad_version"]; (got == 1) == tt.dropped {
+				t.Errorf("rx_header_bad_version = %d, want checked %v", got, !tt.dropped)
+			}
+		})
+	}
+}
+
+// ipv4TestPacket はプロトコルprotoのペイロードを続けた、チェックサムの正しいIPv4パケットを組み立てる
+func ipv4TestPacket(proto byte, fragOff uint16, payload []byte) []byte {
+	pkt := make([]byte, 20, 20+len(payload))
+	pkt[0], pkt[8], pkt[9] = 0x45, 64, proto
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(20+len(payload)))
+	binary.BigEndian.PutUint16(pkt[6:8], fragOff)
+	copy(pkt[12:16], net.IPv4(192, 0, 2, 1).To4())
+	copy(pkt[16:20], net.IPv4(192, 0, 2, 2).To4())
+	binary.BigEndian.PutUint16(pkt[10:12], ipv4Checksum(pkt))
+	return append(pkt, payload...)
+}
+
+func TestParseOuterPacket(t *testing.T) {
+	payload := []byte{0x30, 0x00, 0xde, 0xad, 0xbe, 0xef}
+	badSum := ipv4TestPacket(etherIPProto, 0, payload)
+	badSum[10] ^= 0xff
+	tests := []struct {
+		name    string
+		pkt     []byte
+		result  int
+		payload []byte
+		hops    int
+	}{
+		{"empty", nil, outerBadHeader, nil, 0},
+		{"ipv4", ipv4TestPacket(etherIPProto, 0, payload), outerOK, payload, 64},
+		{"ipv4 bad checksum", badSum, outerBadHeader, nil, 0},
+		{"ipv4 truncated", ipv4TestPacket(etherIPProto, 0, payload)[:22], outerBadHeader, nil, 0},
+		{"ipv4 first fragment", ipv4TestPacket(etherIPProto, 0x2000, payload), outerFragment, nil, 0},
+		{"ipv4 later fragment", ipv4TestPacket(etherIPProto, 0x0010, payload), outerFragment, nil, 0},
+		{"ipv4 other protocol", ipv4TestPacket(47, 0, payload), outerOther, nil, 0},
+		{"ipv6", ipv6TestPacket(etherIPProto, payload), outerOK, payload, 64},
+		{"ipv6 after hop-by-hop", ipv6TestPacket(ipv6HopByHop, append(ipv6TestExt(etherIPProto, 1), payload...)), outerOK, payload, 64},
+		{"ipv6 fragment", ipv6TestPacket(ipv6Fragment, append([]byte{etherIPProto, 0, 0, 1, 0, 0, 0, 42}, payload...)), outerFragment, nil, 0},
+		{"ipv6 other protocol", ipv6TestPacket(47, payload), outerOther, nil, 0},
+		{"unknown version", []byte{0x50, 0, 0, 0}, outerBadHeader, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, got, hops, result := parseOuterPacket(tt.pkt, etherIPProto)
+			if result != tt.result {
+				t.Fatalf("result = %d, want %d", result, tt.result)
+			}
+			if !bytes.Equal(got, tt.payload) || hops != tt.hops {
+				t.Errorf("payload = % x, hops = %d, want % x, %d", got, hops, tt.payload, tt.hops)
+			}
+		})
+	}
+}
@@ -0,0 +1,8 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// msgTrunc は受信バッファに収まらなかったことを表すrecvmsgのフラグ
+const msgTrunc = syscall.MSG_TRUNC
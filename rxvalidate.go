@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+)
+
+// 受信フレームの破棄理由
+const (
+	rxInvalidRunt = iota
+	rxInvalidEtherType
+	rxInvalidTruncated
+	rxInvalidChecksum
+	rxInvalidReasons
+)
+
+// rxInvalidNames はカウンタ名に使う破棄理由
+var rxInvalidNames = [rxInvalidReasons]string{"runt", "ethertype", "truncated", "checksum"}
+
+// RxValidationConfigはトンネルから受信した内側フレームをTAPへ書き込む前の検証の設定を保持する
+//
+// 14バイト未満のフレームは設定によらず破棄する。
+type RxValidationConfig struct {
+	EtherTypes []int `yaml:"ether_types"` // 受け入れるEtherType（VLANタグの内側、空で制限なし）
+	Truncated  bool  `yaml:"truncated"`   // 内側IPv4/IPv6・ARPのヘッダ長・ペイロード長に満たないフレームを破棄する
+	IPChecksum bool  `yaml:"ip_checksum"` // 内側IPv4ヘッダのチェックサムが誤っているフレームを破棄する
+}
+
+// rxValidatorは受信した内側フレームを検証し、不正なフレームを理由ごとに数える
+type rxValidator struct {
+	etherTypes map[uint16]bool
+	truncated  bool
+	checksum   bool
+
+	dropped [rxInvalidReasons]atomic.Uint64
+}
+
+// newRxValidator は設定から受信フレームの検証器を生成する関数
+func newRxValidator(cfg RxValidationConfig) (*rxValidator, error) {
+	v := &rxValidator{truncated: cfg.Truncated, checksum: cfg.IPChecksum}
+	for _, et := range cfg.EtherTypes {
+		if et < 0x0600 || et > 0xFFFF {
+			return nil, fmt.Errorf("ether_types: 0x%04x is not an EtherType (0x0600-0xffff)", et)
+		}
+		if v.etherTypes == nil {
+			v.etherTypes = make(map[uint16]bool)
+		}
+		v.etherTypes[uint16(et)] = true
+	}
+	return v, nil
+}
+
+// classify はフレームの破棄理由を返す関数（正常なら-1）
+func (v *rxValidator) classify(frame []byte) int {
+	if len(frame) < 14 {
+		return rxInvalidRunt
+	}
+
+	// ホップ数タグ（transit時）とVLANタグ（QinQを含む）を読み飛ばす
+	off := 12
+	et := binary.BigEndian.Uint16(frame[off:])
+	if et == hopTagEtherType && len(frame) >= off+hopTagLen+2 {
+		off += hopTagLen
+		et = binary.BigEndian.Uint16(frame[off:])
+	}
+	for (et == tpid8021Q || et == tpid8021AD) && len(frame) >= off+vlanTagLen+2 {
+		off += vlanTagLen
+		et = binary.BigEndian.Uint16(frame[off:])
+	}
+	if v.etherTypes != nil && !v.etherTypes[et] {
+		return rxInvalidEtherType
+	}
+	if !v.truncated && !v.checksum {
+		return -1
+	}
+
+	payload := frame[off+2:]
+	switch et {
+	case 0x0800:
+		if len(payload) < 20 {
+			if v.truncated {
+				return rxInvalidTruncated
+			}
+			return -1
+		}
+		ihl := int(payload[0]&0x0F) * 4
+		total := int(binary.BigEndian.Uint16(payload[2:4]))
+		if v.truncated && (ihl < 20 || total < ihl || total > len(payload)) {
+			return rxInvalidTruncated
+		}
+		if v.checksum && ihl >= 20 && ihl <= len(payload) && ipv4Checksum(payload[:ihl]) != 0 {
+			return rxInvalidChecksum
+		}
+	case 0x86DD:
+		// ペイロード長0はジャンボグラムのため検証しない
+		if v.truncated && (len(payload) < 40 || 40+int(binary.BigEndian.Uint16(payload[4:6])) > len(payload)) {
+			return rxInvalidTruncated
+		}
+	case 0x0806:
+		if v.truncated && len(payload) < 28 {
+			return rxInvalidTruncated
+		}
+	}
+	return -1
+}
+
+// valid はフレームをTAPへ書き込んでよいか判定し、不正なら理由ごとに数える関数
+func (v *rxValidator) valid(frame []byte) bool {
+	reason := v.classify(frame)
+	if reason < 0 {
+		return true
+	}
+	v.dropped[reason].Add(1)
+	return false
+}
+
+// Counters は理由ごとの破棄数を返す
+func (v *rxValidator) Counters() map[string]uint64 {
+	counters := make(map[string]uint64, rxInvalidReasons)
+	for reason, name := range rxInvalidNames {
+		counters["rx_invalid_"+name] = v.dropped[reason].Load()
+	}
+	return counters
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/sha256"
+	"hash"
+	"sync"
+	"unsafe"
+)
+
+// secretHMACBlock はHMAC-SHA256のブロック長
+const secretHMACBlock = sha256.BlockSize
+
+// secretはHMAC-SHA256の鍵をスワップされず、コアダンプに含まれないメモリに保持する
+//
+// crypto/hmacは鍵から作ったipad・opadをGoのヒープに持ち続けるため使わず、ipad・opadを専用のメモリに置いて
+// HMACを計算する。計算に使うダイジェストは使い終わるたびにResetし、鍵に由来する状態を残さない。
+type secret struct {
+	buf     []byte    // ipad | opad（mlock・MADV_DONTDUMP済みのページ）
+	locked  bool      // mlockできた
+	digests sync.Pool // hash.Hash（Reset済み）
+}
+
+// secretsは終了時にゼロで上書きする鍵の一覧
+var secrets struct {
+	mu   sync.Mutex
+	list []*secret
+}
+
+// newSecret は鍵からipad・opadを作って専用のメモリに置く関数（keyは変更せず、呼び出し元が消去する）
+//
+// ロックできなかった場合（RLIMIT_MEMLOCK不足等）は警告して通常のメモリで続行する。
+func newSecret(key []byte) *secret {
+	buf, locked, err := allocSecret(2 * secretHMACBlock)
+	if err != nil {
+		logf("[WARN]", "Key material is not locked in memory (may be swapped or dumped): %v", err)
+	}
+	s := &secret{buf: buf, locked: locked}
+	s.digests.New = func() interface{} { return sha256.New() }
+
+	// ブロック長より長い鍵はハッシュ値を鍵とする（RFC 2104）
+	k := key
+	if len(k) > secretHMACBlock {
+		sum := sha256.Sum256(k)
+		k = sum[:]
+		defer clear(sum[:])
+	}
+	ipad, opad := s.buf[:secretHMACBlock], s.buf[secretHMACBlock:]
+	copy(ipad, k)
+	copy(opad, k)
+	for i := range ipad {
+		ipad[i] ^= 0x36
+		opad[i] ^= 0x5c
+	}
+
+	secrets.mu.Lock()
+	if len(secrets.list) == 0 {
+		registerCleanup(wipeSecrets)
+	}
+	secrets.list = append(secrets.list, s)
+	secrets.mu.Unlock()
+	return s
+}
+
+// keyBytes は文字列の鍵をコピーせずにバイト列として参照する関数（鍵の複製をヒープに作らずnewSecretへ渡す）
+func keyBytes(s string) []byte {
+	return unsafe.Slice(unsafe.StringData(s), len(s))
+}
+
+// wipeConfigKeys は設定に残るauth・clusterの鍵の文字列をゼロで上書きして空にする関数
+//
+// 鍵をnewSecretで専用のメモリへ移した後と、再読み込みで読んだ設定に使い、差分・APIに生の鍵を残さない。
+// 設定ファイル・フラグ・環境変数から読んだ文字列（書き込めるメモリ）のみを対象とすること。
+func wipeConfigKeys(cfgs []*Config) {
+	for _, cfg := range cfgs {
+		for _, key := range []*string{&cfg.Auth.Key, &cfg.Cluster.Key} {
+			clear(keyBytes(*key))
+			*key = ""
+		}
+	}
+}
+
+// sum はdataのHMAC-SHA256をdstへ追加する関数
+func (s *secret) sum(dst, data []byte) []byte {
+	h := s.digests.Get().(hash.Hash)
+	var inner [sha256.Size]byte
+	h.Write(s.buf[:secretHMACBlock])
+	h.Write(data)
+	h.Sum(inner[:0])
+	h.Reset()
+	h.Write(s.buf[secretHMACBlock:])
+	h.Write(inner[:])
+	dst = h.Sum(dst)
+	h.Reset()
+	s.digests.Put(h)
+	return dst
+}
+
+// wipeSecrets は全ての鍵をゼロで上書きし、ロックを解除する関数（終了時）
+//
+// 転送中のgoroutineが参照していても落ちないよう、メモリ自体は解放しない。
+func wipeSecrets() {
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+	for _, s := range secrets.list {
+		clear(s.buf)
+		if s.locked {
+			unlockSecret(s.buf)
+		}
+	}
+	logf("[INFO]", "Wiped %d key(s) from memory", len(secrets.list))
+	secrets.list = nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// madvDontDump はコアダンプから除外するmadvise(2)の指定（linux/mman.h）
+const madvDontDump = 16
+
+// allocSecret は鍵を置くページを確保し、コアダンプからの除外とスワップの禁止を設定する関数
+//
+// ページはGoのヒープの外に確保するため、GCによる複製・移動がない。mlockに失敗しても確保したページを返す。
+func allocSecret(n int) (buf []byte, locked bool, err error) {
+	page := os.Getpagesize()
+	size := (n + page - 1) / page * page
+	mem, err := syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS)
+	if err != nil {
+		return make([]byte, n), false, err
+	}
+	if err := syscall.Madvise(mem, madvDontDump); err != nil {
+		return mem[:n], false, err
+	}
+	if err := syscall.Mlock(mem); err != nil {
+		return mem[:n], false, err
+	}
+	return mem[:n], true, nil
+}
+
+// unlockSecret はallocSecretでロックしたページのロックを解除する関数
+func unlockSecret(buf []byte) {
+	syscall.Munlock(buf)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+// allocSecret はLinux以外ではロックできないため、通常のメモリを返す関数
+func allocSecret(n int) ([]byte, bool, error) {
+	return make([]byte, n), false, fmt.Errorf("not supported on this platform")
+}
+
+// unlockSecret はLinux以外では何もしない関数
+func unlockSecret([]byte) {}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"etherip/header"
+)
+
+// シーケンス番号サブヘッダ関連の定数定義
+//
+// 有効時はEtherIPヘッダのReservedの最上位ビットを立て、ヘッダの直後に送信シーケンス番号(u32)を入れる。
+// 圧縮方式（Reservedの下位8bit）・認証トレーラと併用できる。
+const (
+	etherIPSeqFlag = header.FlagSeq // Reservedのサブヘッダ有無ビット
+	seqHeaderLen   = 4
+	seqResyncRun   = 16 // 送信側の再起動とみなす、ウィンドウより古い番号が増えながら続いた数
+)
+
+// SequenceConfigはシーケンス番号による重複・順序入れ替わり・リプレイ検出の設定を保持する
+type SequenceConfig struct {
+	Enabled   bool `yaml:"enabled"`
+	CountOnly bool `yaml:"count_only"` // 重複・リプレイを数えるだけで破棄しない
+}
+
+// seqWindowは経路ごとの受信ウィンドウと送信側の再起動検出の状態
+type seqWindow struct {
+	replayWindow
+	started   bool   // 最初のパケットを受信済み
+	lastStale uint32 // 直前にウィンドウより古いと判定した番号
+	staleRun  int    // ウィンドウより古い番号が増えながら続いた数
+}
+
+// sequencerは送信パケットへのシーケンス番号の付与と、受信時の重複・順序入れ替わり・リプレイの検出を行う
+type sequencer struct {
+	countOnly bool
+	next      sync.Map // *Path → *atomic.Uint32（送信シーケンス番号、対向の経路ごとのウィンドウに合わせて経路ごとに持つ）
+	windows   sync.Map // *Path → *seqWindow
+
+	inOrder   atomic.Uint64 // 順序どおりに受信した数
+	gap       atomic.Uint64 // 飛んだ番号の数（後から届いた分も含む）
+	reordered atomic.Uint64 // 順序が入れ替わって届いた数
+	duplicate atomic.Uint64 // ウィンドウ内で受信済みの番号
+	replayed  atomic.Uint64 // ウィンドウより古い番号
+	missing   atomic.Uint64 // サブヘッダなしで受信した数（対向がsequence無効）
+	short     atomic.Uint64 // サブヘッダより短いパケット
+	resync    atomic.Uint64 // 送信側の再起動とみなしてウィンドウを作り直した数
+}
+
+// newSequencer はシーケンス番号の設定から生成する関数（無効ならnilを返す）
+func newSequencer(cfg SequenceConfig) *sequencer {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &sequencer{countOnly: cfg.CountOnly}
+}
+
+// overhead はサブヘッダによって増える外側パケットのバイト数を返す（無効時は0）
+func (s *sequencer) overhead() int {
+	if s == nil {
+		return 0
+	}
+	return seqHeaderLen
+}
+
+// counter は経路の送信シーケンス番号を返す関数（初回は0から始める）
+func (s *sequencer) counter(p *Path) *atomic.Uint32 {
+	if v, ok := s.next.Load(p); ok {
+		return v.(*atomic.Uint32)
+	}
+	v, _ := s.next.LoadOrStore(p, new(atomic.Uint32))
+	return v.(*atomic.Uint32)
+}
+
+// highest は全経路の送信シーケンス番号のうち最も進んだものを返す関数（一周を考慮）
+func (s *sequencer) highest() uint32 {
+	var top uint32
+	s.next.Range(func(_, v any) bool {
+		if n := v.(*atomic.Uint32).Load(); int32(n-top) > 0 {
+			top = n
+		}
+		return true
+	})
+	return top
+}
+
+// advance は経路の送信シーケンス番号をnextより前なら進める関数
+func (s *sequencer) advance(paths []*Path, next uint32) {
+	for _, p := range paths {
+		c := s.counter(p)
+		for cur := c.Load(); int32(next-cur) > 0 && !c.CompareAndSwap(cur, next); cur = c.Load() {
+		}
+	}
+}
+
+// stamp はEtherIPヘッダの直後に経路pの次のシーケンス番号を挿入し、Reservedのビットを立てる関数
+func (s *sequencer) stamp(p *Path, packet []byte) []byte {
+	out := make([]byte, len(packet)+seqHeaderLen)
+	copy(out, packet[:etherIPHeaderLen])
+	out[0] |= etherIPSeqFlag >> 8
+	binary.BigEndian.PutUint32(out[etherIPHeaderLen:], s.counter(p).Add(1))
+	copy(out[etherIPHeaderLen+seqHeaderLen:], packet[etherIPHeaderLen:])
+	return out
+}
+
+// open は受信パケットのサブヘッダを取り除いて照合し、残りの長さと受け入れ可否を返す関数
+//
+// サブヘッダのないパケットは数えるだけでそのまま受け入れる（片側ずつ有効にできるようにするため）。
+func (s *sequencer) open(p *Path, packet []byte) (int, bool) {
+	h, err := header.Parse(packet)
+	if err != nil || h.Reserved()&etherIPSeqFlag == 0 {
+		s.missing.Add(1)
+		return len(packet), true
+	}
+	if len(packet) < etherIPHeaderLen+seqHeaderLen {
+		s.short.Add(1)
+		return 0, false
+	}
+	seq := binary.BigEndian.Uint32(packet[etherIPHeaderLen:])
+	packet[0] &^= etherIPSeqFlag >> 8
+	copy(packet[etherIPHeaderLen:], packet[etherIPHeaderLen+seqHeaderLen:])
+	return len(packet) - seqHeaderLen, s.check(p, seq)
+}
+
+// expandSeq は32bitのシーケンス番号を、これまでの最大値に最も近い64bitの値へ拡張する関数（一周を考慮）
+func expandSeq(top uint64, seq uint32) uint64 {
+	v := top&^0xFFFFFFFF | uint64(seq)
+	switch {
+	case v+1<<31 < top:
+		v += 1 << 32
+	case v > top+1<<31 && v >= 1<<32:
+		v -= 1 << 32
+	}
+	return v
+}
+
+// check は経路のウィンドウでシーケンス番号を照合して数え、受け入れるかを返す関数
+func (s *sequencer) check(p *Path, seq uint32) bool {
+	v, ok := s.windows.Load(p)
+	if !ok {
+		v, _ = s.windows.LoadOrStore(p, &seqWindow{})
+	}
+	w := v.(*seqWindow)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.started {
+		w.started = true
+		w.reset(uint64(seq))
+		s.inOrder.Add(1)
+		return true
+	}
+	top := w.top
+	switch w.update(expandSeq(top, seq)) {
+	case replayInOrder:
+		s.inOrder.Add(1)
+		s.gap.Add(w.top - top - 1)
+		w.staleRun = 0
+		return true
+	case replayReordered:
+		s.reordered.Add(1)
+		return true
+	case replayDuplicate:
+		s.duplicate.Add(1)
+		return s.countOnly
+	}
+
+	// 送信側が再起動して番号が戻った場合は、古い番号が増えながら続いたらウィンドウを作り直す
+	if w.staleRun > 0 && seq > w.lastStale && seq-w.lastStale < authReplayWindow {
+		w.staleRun++
+	} else {
+		w.staleRun = 1
+	}
+	w.lastStale = seq
+	if w.staleRun >= seqResyncRun {
+		w.reset(uint64(seq))
+		w.staleRun = 0
+		s.resync.Add(1)
+		logf("[WARN]", "Sequence numbers from %s (%s) restarted; receive window reset", p.Host, p.Dst.Load().(net.IP))
+		return true
+	}
+	s.replayed.Add(1)
+	return s.countOnly
+}
+
+// etherIPPayload は非圧縮のEtherIPパケットから内側のフレームを取り出す関数（サブヘッダは読み飛ばす）
+func etherIPPayload(packet []byte) ([]byte, bool) {
+	h, err := header.Parse(packet)
+	if err != nil {
+		return nil, false
+	}
+	switch h.Reserved() {
+	case 0:
+		return packet[etherIPHeaderLen:], true
+	case etherIPSeqFlag:
+		if len(packet) >= etherIPHeaderLen+seqHeaderLen {
+			return packet[etherIPHeaderLen+seqHeaderLen:], true
+		}
+	}
+	return nil, false
+}
+
+// Counters はシーケンス番号の照合結果のカウンタを返す
+func (s *sequencer) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"rx_seq_in_order":  s.inOrder.Load(),
+		"rx_seq_gap":       s.gap.Load(),
+		"rx_seq_reordered": s.reordered.Load(),
+		"rx_seq_duplicate": s.duplicate.Load(),
+		"rx_seq_replayed":  s.replayed.Load(),
+		"rx_seq_missing":   s.missing.Load(),
+		"rx_seq_short":     s.short.Load(),
+		"rx_seq_resync":    s.resync.Load(),
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestExpandSeq(t *testing.T) {
+	tests := []struct {
+		top  uint64
+		seq  uint32
+		want uint64
+	}{
+		{0, 1, 1},
+		{100, 90, 90},
+		{0xFFFFFFF0, 0x10, 0x100000010}, // 一周した
+		{0x100000010, 0xFFFFFFF0, 0xFFFFFFF0},
+		{0x100000010, 0x20, 0x100000020},
+		{5, 0xFFFFFFF0, 0xFFFFFFF0}, // 最初の一周では戻さない
+	}
+	for _, tt := range tests {
+		if got := expandSeq(tt.top, tt.seq); got != tt.want {
+			t.Errorf("expandSeq(0x%x, 0x%x) = 0x%x, want 0x%x", tt.top, tt.seq, got, tt.want)
+		}
+	}
+}
+
+func TestSequencerPerPath(t *testing.T) {
+	s := newSequencer(SequenceConfig{Enabled: true})
+	v4, v6, other := &Path{Version: 4, Host: "a"}, &Path{Version: 6, Host: "a"}, &Path{Version: 4, Host: "b"}
+	stamped := func(p *Path) uint32 {
+		return binary.BigEndian.Uint32(s.stamp(p, buildEtherIPPacket(make([]byte, 14)))[etherIPHeaderLen:])
+	}
+
+	// 経路ごとに1から数え、他の経路へ送った分で番号が飛ばない
+	steps := []struct {
+		p    *Path
+		want uint32
+	}{{v4, 1}, {v4, 2}, {v6, 1}, {other, 1}, {v4, 3}, {v6, 2}}
+	for i, st := range steps {
+		if got := stamped(st.p); got != st.want {
+			t.Fatalf("step %d: IPv%d to %s stamped %d, want %d", i, st.p.Version, st.p.Host, got, st.want)
+		}
+	}
+	if got := s.highest(); got != 3 {
+		t.Errorf("highest() = %d, want 3", got)
+	}
+
+	// 引き継ぎでは全経路を進め、既に先へ進んだ経路は戻さない
+	s.counter(other).Store(100)
+	s.advance([]*Path{v4, v6, other}, 50)
+	for _, st := range []struct {
+		p    *Path
+		want uint32
+	}{{v4, 51}, {v6, 51}, {other, 101}} {
+		if got := stamped(st.p); got != st.want {
+			t.Errorf("after advance: IPv%d to %s stamped %d, want %d", st.p.Version, st.p.Host, got, st.want)
+		}
+	}
+
+	// 一周をまたいでも進んだ側を最大とする
+	s.counter(v6).Store(0xFFFFFFF0)
+	s.counter(v4).Store(5)
+	s.advance([]*Path{other}, 0)
+	if got := s.highest(); got != 101 {
+		t.Errorf("highest() = %d, want 101", got)
+	}
+	s.counter(other).Store(0x10)
+	if got := s.highest(); got != 0x10 {
+		t.Errorf("highest() across wrap = 0x%x, want 0x10", got)
+	}
+}
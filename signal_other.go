@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// countersSignal・restartSignal はSIGUSR1・SIGUSR2のないプラットフォームでは未対応（nil）
+var countersSignal, restartSignal os.Signal
+
+// signalRestart はSIGUSR2のないプラットフォームでは未対応
+func signalRestart(pid int) error {
+	return fmt.Errorf("not supported on this platform")
+}
@@ -0,0 +1,19 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// countersSignal・restartSignal はカウンタをログへ出力するシグナルと、置き換えたバイナリで再起動するシグナル
+var (
+	countersSignal os.Signal = syscall.SIGUSR1
+	restartSignal  os.Signal = syscall.SIGUSR2
+)
+
+// signalRestart は動作中のデーモンへ再起動のシグナルを送る関数
+func signalRestart(pid int) error {
+	return syscall.Kill(pid, syscall.SIGUSR2)
+}
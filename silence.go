@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 無受信時のアクション
+const (
+	silenceLog          = "log"           // 警告ログとsilenceイベント
+	silenceDegraded     = "degraded"      // ピアの状態にdegradedを付ける（API・status・MQTTで参照）
+	silenceFlushFDB     = "flush_fdb"     // 学習済みMACを破棄してフラッディングに戻す
+	silenceResetSession = "reset_session" // 認証・シーケンス番号の受信ウィンドウを破棄する
+	silenceHook         = "hook"          // 外部コマンドを実行する
+)
+
+// SilenceConfigはピアから何も受信しない状態が続いた場合の対処を保持する
+type SilenceConfig struct {
+	After   string   `yaml:"after"`   // 無受信がこの時間続いたら発動（空で無効）
+	Actions []string `yaml:"actions"` // log, degraded, flush_fdb, reset_session, hook（省略時はlog）
+	Hook    string   `yaml:"hook"`    // hookアクションで実行するコマンド（標準入力にイベントのJSON）
+}
+
+// silenceWatcherはピアごとの最終受信時刻を監視し、無受信が続いたピアに設定されたアクションを行う
+type silenceWatcher struct {
+	t       *Tunnel
+	after   time.Duration
+	actions []string
+	hook    string
+
+	triggered atomic.Uint64 // 発動した回数
+}
+
+// newSilenceWatcher は無受信時の対処の設定から監視を生成する関数（無効ならnilを返す）
+func newSilenceWatcher(t *Tunnel, cfg SilenceConfig) (*silenceWatcher, error) {
+	if cfg.After == "" {
+		if len(cfg.Actions) > 0 || cfg.Hook != "" {
+			return nil, fmt.Errorf("after is required with actions or hook")
+		}
+		return nil, nil
+	}
+	after, err := time.ParseDuration(cfg.After)
+	if err != nil {
+		return nil, fmt.Errorf("after: %w", err)
+	}
+	if after < time.Second {
+		return nil, fmt.Errorf("after %v must be at least 1s", after)
+	}
+	actions := cfg.Actions
+	if len(actions) == 0 {
+		actions = []string{silenceLog}
+	}
+	for _, a := range actions {
+		switch a {
+		case silenceLog, silenceDegraded, silenceFlushFDB, silenceResetSession, silenceHook:
+		default:
+			return nil, fmt.Errorf("unknown action %q (log, degraded, flush_fdb, reset_session, hook)", a)
+		}
+	}
+	if slices.Contains(actions, silenceHook) != (cfg.Hook != "") {
+		return nil, fmt.Errorf("hook action and hook command must be set together")
+	}
+	return &silenceWatcher{t: t, after: after, actions: actions, hook: cfg.Hook}, nil
+}
+
+// has は指定のアクションが設定されているか返す関数
+func (w *silenceWatcher) has(action string) bool {
+	return slices.Contains(w.actions, action)
+}
+
+// run は一定間隔で全ピアの最終受信時刻を確認する関数
+func (w *silenceWatcher) run() {
+	logf("[INFO]", "Silence policy: %s after %v without packets from a peer", strings.Join(w.actions, ", "), w.after)
+	start := time.Now().UnixNano()
+	for _, peer := range w.t.peers {
+		peer.lastHeard.CompareAndSwap(0, start)
+	}
+
+	ticker := time.NewTicker(min(max(w.after/4, time.Second), 30*time.Second))
+	defer ticker.Stop()
+	for now := range ticker.C {
+		for _, peer := range w.t.peers {
+			quiet := now.Sub(time.Unix(0, peer.lastHeard.Load())).Truncate(time.Second)
+			silent := quiet >= w.after
+			if silent == peer.silent.Load() {
+				continue
+			}
+			peer.silent.Store(silent)
+			if silent {
+				w.trigger(peer, quiet)
+			} else {
+				w.recover(peer)
+			}
+		}
+	}
+}
+
+// trigger はピアの無受信が続いた際に設定されたアクションを行う関数
+func (w *silenceWatcher) trigger(peer *Peer, quiet time.Duration) {
+	w.triggered.Add(1)
+	detail := fmt.Sprintf("nothing received for %v", quiet)
+	if w.has(silenceLog) {
+		logf("[WARN]", "Peer %s is silent: %s", peer.Host, detail)
+		w.t.events.emit("silence", peer.Host, detail)
+	}
+	if w.has(silenceDegraded) {
+		peer.degraded.Store(true)
+	}
+	if w.has(silenceFlushFDB) && w.t.fdb != nil {
+		w.t.fdb.forgetPeer(peer)
+	}
+	if w.has(silenceResetSession) {
+		// 暗号化のセッションはないため、対向の再起動後に古い番号で破棄されないよう受信ウィンドウを作り直す
+		for _, p := range peer.paths {
+			if w.t.auth != nil {
+				w.t.auth.windows.Delete(p.Host)
+			}
+			if w.t.seq != nil {
+				w.t.seq.windows.Delete(p)
+			}
+		}
+	}
+	if w.has(silenceHook) {
+		go w.runHook(peer, "silence", detail)
+	}
+}
+
+// recover はピアから再び受信した際にdegradedを外し、復旧を通知する関数
+func (w *silenceWatcher) recover(peer *Peer) {
+	peer.degraded.Store(false)
+	if w.has(silenceLog) {
+		logf("[RESET]", "Peer %s is no longer silent", peer.Host)
+		w.t.events.emit("silence_end", peer.Host, "packets received again")
+	}
+	if w.has(silenceHook) {
+		go w.runHook(peer, "silence_end", "packets received again")
+	}
+}
+
+// runHook はフックコマンドへイベントを渡して実行する関数
+func (w *silenceWatcher) runHook(peer *Peer, event, detail string) {
+	payload, _ := json.Marshal(Event{
+		Event:  event,
+		Tap:    w.t.cfg.TapName,
+		Tenant: w.t.cfg.Tenant,
+		Labels: w.t.cfg.Labels,
+		Peer:   peer.Host,
+		Detail: detail,
+		Time:   time.Now().Unix(),
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), alertHookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, w.hook)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(),
+		"ETHERIP_EVENT="+event,
+		"ETHERIP_PEER="+peer.Host,
+		"ETHERIP_TAP="+w.t.cfg.TapName,
+		"ETHERIP_TENANT="+w.t.cfg.Tenant,
+	)
+	cmd.Env = append(cmd.Env, labelEnv(w.t.cfg.Labels)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		logf("[WARN]", "Silence hook %s failed: %v %s", w.hook, err, strings.TrimSpace(string(out)))
+	}
+}
+
+// Counters は無受信時の対処が発動した回数を返す
+func (w *silenceWatcher) Counters() map[string]uint64 {
+	return map[string]uint64{"peer_silence": w.triggered.Load()}
+}
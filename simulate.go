@@ -0,0 +1,392 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/songgao/water"
+)
+
+// シミュレーション関連の定数定義
+const (
+	simulatePeerSuffix = "-peer"     // 対向側のTAP名に付ける接尾辞
+	simulateQueue      = 1024        // TAP・ソケットの受信キュー長
+	simulateMaxTunnels = 127         // 対向を含めてアドレスを割り当てられるトンネル数の上限
+	simulateHopLimit   = 64          // outer_hop_limit.tx未指定時に届ける外側パケットのTTL・ホップリミット
+	simulateWireFile   = "wire.pcap" // 全ての外側パケットの記録
+	simulateInExt      = ".in.pcap"  // TAPへ入力するフレーム（ifmode: tunではIPパケット）
+	simulateOutExt     = ".out.pcap" // TAPへ書き込まれたフレーム
+	simulateSwitchExt  = ".sock"     // フレームを送受信するUnixデータグラムソケット
+)
+
+// simulation は--simulate時のメモリ上のネットワーク（nilなら通常動作）
+var simulation *simulator
+
+// simulatorは権限なしで設定のトンネルとその対向を同じプロセス内で動かすため、メモリ上のネットワークとTAPを提供する
+//
+// 外側パケットは宛先アドレスのソケットへメモリ上で届け、TAPの入出力はディレクトリ内のpcapとUnixソケットで行う。
+// 転送・フィルタ・認証・圧縮等はそのまま動くが、外側のDSCP・フローラベル等のソケットオプションは反映しない。
+type simulator struct {
+	dir  string
+	wire *pcapFile
+
+	mu    sync.Mutex
+	ports map[string]*simPort // ソケットのアドレス → 受信口
+
+	sent     atomic.Uint64 // 送信された外側パケット数
+	unrouted atomic.Uint64 // 宛先のソケットがなく捨てた外側パケット数
+	overflow atomic.Uint64 // 受信キューが満杯で捨てた外側パケット数
+}
+
+// simPortはメモリ上のソケットの受信口
+type simPort struct {
+	addr  net.IP
+	hops  int // 送信する外側パケットのTTL・ホップリミット
+	queue chan simPacket
+}
+
+// simPacketはメモリ上のネットワークを流れる外側パケット（IPヘッダより後ろ）
+type simPacket struct {
+	data []byte
+	from net.IP
+	hops int
+}
+
+// simTAPはTAPの代わりに、pcapから読んだフレームとUnixソケットに届いたフレームを入力し、書き込まれたフレームをpcapとUnixソケットへ出力する
+type simTAP struct {
+	name string
+	in   chan []byte
+	out  *pcapFile
+	sw   *net.UnixConn
+
+	mu      sync.Mutex
+	clients map[string]*net.UnixAddr // フレームを送ってきたUnixソケット（以後は書き込まれたフレームも受け取る）
+}
+
+// pcapFileはシミュレーションのフレーム・外側パケットを記録するpcapファイル（1件ごとに書き出す）
+type pcapFile struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// createPCAPFile はpcapファイルを作成してファイルヘッダを書き込む関数
+func createPCAPFile(path string, link uint32) (*pcapFile, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(pcapFileHeader(link)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &pcapFile{f: f}, nil
+}
+
+// write はデータを1件記録する関数
+func (p *pcapFile) write(data []byte) {
+	rec := pcapRecordHeader(time.Now(), len(data))
+	b := append(rec[:], data[:min(len(data), pcapSnapLen)]...)
+	p.mu.Lock()
+	p.f.Write(b)
+	p.mu.Unlock()
+}
+
+// Close はファイルを閉じる関数
+func (p *pcapFile) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.f.Close()
+}
+
+// simulateAddr はn番目のトンネルに割り当てる外側アドレスを返す関数（文書用のアドレス範囲）
+func simulateAddr(version, n int) net.IP {
+	if version == 6 {
+		ip := net.ParseIP("2001:db8::")
+		ip[15] = byte(n)
+		return ip
+	}
+	return net.IPv4(198, 51, 100, byte(n))
+}
+
+// simulateConfig はホストのネットワークを操作する設定を無効にする関数（無効にしたものは警告する）
+func simulateConfig(cfg *Config) {
+	disable := []struct {
+		name string
+		on   bool
+		off  func()
+	}{
+		{"br_name", cfg.BrName != "off", func() { cfg.BrName, cfg.Bridge, cfg.WaitForBridge = "off", BridgeConfig{}, false }},
+		{"peers", len(cfg.Peers) > 0, func() { cfg.Peers = nil }},
+		{"standby", len(cfg.Standby.Hosts) > 0, func() { cfg.Standby = StandbyConfig{} }},
+		{"migration", cfg.Migration.enabled(), func() { cfg.Migration = MigrationConfig{} }},
+		{"dual_stack", cfg.DualStack, func() { cfg.DualStack = false }},
+		{"src_auto", cfg.SrcAuto, func() { cfg.SrcAuto = false }},
+		{"bind_device", cfg.BindDevice, func() { cfg.BindDevice = false }},
+		{"connected_socket", cfg.ConnectedSocket, func() { cfg.ConnectedSocket = false }},
+		{"datapath", isAFPacket(cfg.Datapath), func() { cfg.Datapath = datapathStandard }},
+		{"underlay", cfg.Underlay == underlayWireGuard || cfg.Underlay == underlayIPsec, func() {}},
+		{"host_route", cfg.HostRoute.Enabled, func() { cfg.HostRoute = HostRouteConfig{} }},
+		{"iperf", cfg.Iperf.Address != "", func() { cfg.Iperf = IperfConfig{} }},
+		{"nfqueue", cfg.NFQueue.Num > 0, func() { cfg.NFQueue = NFQueueConfig{} }},
+		{"link_speed", cfg.LinkSpeed != "", func() { cfg.LinkSpeed = "" }},
+		{"local_delivery", cfg.LocalDelivery.Iface != "", func() { cfg.LocalDelivery = LocalDeliveryConfig{} }},
+		{"mirror", cfg.Mirror.Collector != "", func() { cfg.Mirror = MirrorConfig{} }},
+		{"offload", cfg.Offload.Mode != "" && cfg.Offload.Mode != offloadOff, func() { cfg.Offload = OffloadConfig{} }},
+		{"manage_firewall", cfg.ManageFirewall, func() { cfg.ManageFirewall = false }},
+		{"stp_cost", cfg.STPCost.Enabled, func() { cfg.STPCost = STPCostConfig{} }},
+		{"evpn", cfg.EVPN.Neighbor != "", func() { cfg.EVPN = EVPNConfig{} }},
+		{"fdb_sync", cfg.FDBSync.Enabled, func() { cfg.FDBSync = FDBSyncConfig{} }},
+		{"route_health", cfg.RouteHealth.Neighbor != "", func() { cfg.RouteHealth = RouteHealthConfig{} }},
+	}
+	for _, d := range disable {
+		if d.on {
+			logf("[WARN]", "Simulation: %s needs the host network and is disabled on %s", d.name, cfg.TapName)
+			d.off()
+		}
+	}
+	cfg.SrcIface, cfg.Underlay, cfg.RecursionCheck = "", underlayPlain, "off"
+}
+
+// mirrorConfig は設定の対向側の設定を作る関数
+//
+// 同じファイル・外部の送信先へ両側から出力しないよう、対向側ではそれらを無効にする。
+func mirrorConfig(cfg *Config) *Config {
+	peer := *cfg
+	peer.TapName = cfg.TapName + simulatePeerSuffix
+	peer.L2TPv3.SessionID, peer.L2TPv3.PeerSessionID = cfg.L2TPv3.PeerSessionID, cfg.L2TPv3.SessionID
+	peer.L2TPv3.Cookie, peer.L2TPv3.PeerCookie = cfg.L2TPv3.PeerCookie, cfg.L2TPv3.Cookie
+	peer.SLA.File = ""
+	peer.Stats.File, peer.Stats.LifetimeFile = "", ""
+	peer.Tee = TeeConfig{}
+	peer.Webhooks = nil
+	peer.MQTT = MQTTConfig{}
+	peer.legacy = false // 移行の警告は元の設定の分だけ出す
+	return &peer
+}
+
+// startSimulation はシミュレーションを開始し、設定の各トンネルとその対向を交互に並べた設定を返す関数
+//
+// 各トンネルの宛先は対向側のアドレスに置き換える（dst_host・名前解決は使わない）。
+// PIDファイル・sysctl・run_as_userはホストに影響するため使わない。
+func startSimulation(dir string, cfgs []*Config) ([]*Config, error) {
+	if 2*len(cfgs) > simulateMaxTunnels {
+		return nil, fmt.Errorf("too many tunnels (%d) to simulate", len(cfgs))
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	wire, err := createPCAPFile(filepath.Join(dir, simulateWireFile), pcapLinkRaw)
+	if err != nil {
+		return nil, err
+	}
+	sim := &simulator{dir: dir, wire: wire, ports: make(map[string]*simPort)}
+	registerCleanup(func() {
+		logf("[INFO]", "Simulation: %d outer packets sent, %d unrouted, %d dropped on full queues", sim.sent.Load(), sim.unrouted.Load(), sim.overflow.Load())
+		wire.Close()
+	})
+
+	global := cfgs[0]
+	if global.PIDFile != "" || global.RunAsUser != "" || len(global.Sysctl.Settings) > 0 || global.Sysctl.Profile != "" || global.Cluster.enabled() {
+		logf("[WARN]", "Simulation: pid_file, sysctl, run_as_user and cluster are ignored")
+		global.PIDFile, global.RunAsUser, global.RunAsGroup, global.Sysctl, global.Cluster = "", "", "", SysctlConfig{}, ClusterConfig{}
+	}
+
+	var all []*Config
+	for i, cfg := range cfgs {
+		simulateConfig(cfg)
+		peer := mirrorConfig(cfg)
+		local, remote := simulateAddr(cfg.Version, 2*i+1), simulateAddr(cfg.Version, 2*i+2)
+		cfg.SrcIP, cfg.DstHost = []string{local.String()}, remote.String()
+		peer.SrcIP, peer.DstHost = []string{remote.String()}, local.String()
+		logf("[INFO]", "Simulation: %s (%s) ⇄ %s (%s)", cfg.TapName, local, peer.TapName, remote)
+		all = append(all, cfg, peer)
+	}
+	logf("[INFO]", "Simulation: frames in %s/<tap>%s or on %s/<tap>%s, output in <tap>%s and %s", dir, simulateInExt, dir, simulateSwitchExt, simulateOutExt, simulateWireFile)
+	simulation = sim
+	return all, nil
+}
+
+// mac はTAPのMACアドレスの代わりに、TAP名から決まるローカル管理アドレスを返す関数
+func (sim *simulator) mac(cfg *Config) net.HardwareAddr {
+	h := fnv.New32a()
+	h.Write([]byte(cfg.TapName))
+	sum := h.Sum32()
+	return net.HardwareAddr{0x02, 0x00, byte(sum >> 24), byte(sum >> 16), byte(sum >> 8), byte(sum)}
+}
+
+// socket はRAWソケットの代わりに、src_ipのアドレスで受信するメモリ上のソケットを作る関数
+func (sim *simulator) socket(cfg *Config, version int) (*Socket, error) {
+	encap, err := newEncapsulation(cfg)
+	if err != nil {
+		return nil, err
+	}
+	addr := net.ParseIP(cfg.SrcIP[0])
+	if (addr.To4() != nil) != (version == 4) {
+		return nil, fmt.Errorf("simulated address %s is not IPv%d", addr, version)
+	}
+	port := &simPort{addr: addr, hops: simulateHopLimit, queue: make(chan simPacket, simulateQueue)}
+	if cfg.OuterHopLimit.TX > 0 {
+		port.hops = cfg.OuterHopLimit.TX
+	}
+	sim.mu.Lock()
+	sim.ports[addr.String()] = port
+	sim.mu.Unlock()
+	return &Socket{Version: version, SrcIP: addr, Encap: encap, sim: port}, nil
+}
+
+// send は外側パケットを記録し、宛先アドレスのソケットへ届ける関数（宛先がない・キューが満杯なら捨てる）
+func (sim *simulator) send(s *Socket, dst net.IP, packet []byte) error {
+	sim.sent.Add(1)
+	sim.wire.write(outerIPPacket(s.sim.addr, dst, s.Encap.protocol(), packet))
+	sim.mu.Lock()
+	to := sim.ports[dst.String()]
+	sim.mu.Unlock()
+	if to == nil {
+		sim.unrouted.Add(1)
+		return nil
+	}
+	select {
+	case to.queue <- simPacket{data: append([]byte(nil), packet...), from: s.sim.addr, hops: s.sim.hops}:
+	default:
+		sim.overflow.Add(1)
+	}
+	return nil
+}
+
+// read は届いた外側パケットを1つbufへ読み出す関数（Socket.readと同じ規約）
+func (port *simPort) read(s *Socket, buf []byte) (int, *net.IPAddr, int, error) {
+	pkt := <-port.queue
+	from := &net.IPAddr{IP: pkt.from}
+	if len(pkt.data) > len(buf) {
+		s.truncated.Add(1)
+		return 0, from, -1, nil
+	}
+	return copy(buf, pkt.data), from, pkt.hops, nil
+}
+
+// tap はTAPの代わりに、ディレクトリ内のpcap・Unixソケットで入出力するインターフェースを作る関数
+func (sim *simulator) tap(cfg *Config) (*water.Interface, error) {
+	link := uint32(pcapLinkEthernet)
+	if cfg.IfMode == ifModeTUN {
+		link = pcapLinkRaw
+	}
+	out, err := createPCAPFile(filepath.Join(sim.dir, cfg.TapName+simulateOutExt), link)
+	if err != nil {
+		return nil, err
+	}
+	sockPath := filepath.Join(sim.dir, cfg.TapName+simulateSwitchExt)
+	os.Remove(sockPath)
+	sw, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sockPath, Net: "unixgram"})
+	if err != nil {
+		out.Close()
+		return nil, err
+	}
+	t := &simTAP{name: cfg.TapName, in: make(chan []byte, simulateQueue), out: out, sw: sw, clients: make(map[string]*net.UnixAddr)}
+	registerCleanup(func() {
+		t.Close()
+		os.Remove(sockPath)
+	})
+	go t.serveSwitch()
+
+	in := filepath.Join(sim.dir, cfg.TapName+simulateInExt)
+	if _, err := os.Stat(in); err == nil {
+		go t.replay(in, link)
+	}
+	return &water.Interface{ReadWriteCloser: t}, nil
+}
+
+// Read は入力されたフレームを1つ読む関数（入力があるまで待つ）
+func (t *simTAP) Read(b []byte) (int, error) {
+	return copy(b, <-t.in), nil
+}
+
+// Write はトンネルから届いたフレームをpcapへ記録し、Unixソケットの送信元へも送る関数
+func (t *simTAP) Write(b []byte) (int, error) {
+	t.out.write(b)
+	t.mu.Lock()
+	for key, addr := range t.clients {
+		if _, err := t.sw.WriteToUnix(b, addr); err != nil {
+			delete(t.clients, key) // 送信元が閉じた
+		}
+	}
+	t.mu.Unlock()
+	return len(b), nil
+}
+
+// Close はpcapとUnixソケットを閉じる関数
+func (t *simTAP) Close() error {
+	t.sw.Close()
+	return t.out.Close()
+}
+
+// serveSwitch はUnixソケットに届いたフレームをTAPへ入力する関数
+//
+// 送信元のソケットがアドレスを持っていれば（bindしていれば）、以後TAPに書き込まれたフレームを送り返す。
+func (t *simTAP) serveSwitch() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := t.sw.ReadFromUnix(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if addr != nil && addr.Name != "" {
+			t.mu.Lock()
+			t.clients[addr.Name] = addr
+			t.mu.Unlock()
+		}
+		t.in <- append([]byte(nil), buf[:n]...)
+	}
+}
+
+// replay はpcapのフレームを記録順にTAPへ入力する関数（間隔は再現せず、キューが空くのを待って入れる）
+//
+// TAPではEthernetのpcap（またはEtherIPの外側IPパケット）、ifmode: tunではIPパケットのpcapを読む。
+func (t *simTAP) replay(path string, link uint32) {
+	f, err := os.Open(path)
+	if err != nil {
+		logf("[WARN]", "Simulation: %v", err)
+		return
+	}
+	defer f.Close()
+	r, err := newPCAPReader(f)
+	if err != nil {
+		logf("[WARN]", "Simulation: %s: %v", path, err)
+		return
+	}
+	if link == pcapLinkRaw && r.link != pcapLinkRaw {
+		logf("[WARN]", "Simulation: %s must contain IP packets for ifmode tun", path)
+		return
+	}
+	var sent, skipped int
+	for {
+		_, data, _, err := r.next()
+		if err != nil {
+			if err != io.EOF {
+				logf("[WARN]", "Simulation: %s: %v", path, err)
+			}
+			break
+		}
+		frame, ok := data, len(data) > 0
+		if link != pcapLinkRaw {
+			frame, ok = r.innerFrame(data)
+		}
+		if !ok {
+			skipped++
+			continue
+		}
+		t.in <- frame
+		sent++
+	}
+	logf("[INFO]", "Simulation: %d frames from %s fed into %s (%d skipped)", sent, path, t.name, skipped)
+}
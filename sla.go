@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// SLA集計関連の定数定義
+const (
+	slaRTTBuckets      = 24                     // RTTヒストグラムのバケット数
+	slaRTTBase         = 100 * time.Microsecond // 最小バケットの上限（以降2倍ずつ）
+	slaDefaultInterval = time.Minute            // JSON出力間隔の既定値
+)
+
+// SLAConfigはSLAレポートの設定を保持する
+type SLAConfig struct {
+	File     string `yaml:"file"`     // レポートJSONの出力先（空で出力しない）
+	Interval string `yaml:"interval"` // 出力間隔
+}
+
+// slaMonthは1か月分のSLA集計値を保持する
+type slaMonth struct {
+	Month      string                `json:"month"` // "2006-01"形式（UTC）
+	UpSec      float64               `json:"up_seconds"`
+	DownSec    float64               `json:"down_seconds"`
+	Sent       uint64                `json:"keepalives_sent"`
+	Received   uint64                `json:"keepalives_received"`
+	RTTBuckets [slaRTTBuckets]uint64 `json:"rtt_buckets"`
+}
+
+// SLAReportはAPIおよびJSON出力用のSLAレポート
+type SLAReport struct {
+	Peer            string  `json:"peer"`
+	Month           string  `json:"month"`
+	Availability    float64 `json:"availability_percent"`
+	UpSeconds       float64 `json:"up_seconds"`
+	DownSeconds     float64 `json:"down_seconds"`
+	KeepalivesSent  uint64  `json:"keepalives_sent"`
+	KeepalivesRecv  uint64  `json:"keepalives_received"`
+	Loss            float64 `json:"loss_percent"`
+	LatencyP50Ms    float64 `json:"latency_p50_ms"`
+	LatencyP90Ms    float64 `json:"latency_p90_ms"`
+	LatencyP99Ms    float64 `json:"latency_p99_ms"`
+	LatencySamples  uint64  `json:"latency_samples"`
+	GeneratedAtUnix int64   `json:"generated_at"`
+}
+
+// slaStateは永続化する当月・前月の集計値
+type slaState struct {
+	Current  *slaMonth `json:"current"`
+	Previous *slaMonth `json:"previous"`
+}
+
+// slaTrackerはキープアライブ結果から月次の可用性・損失率・遅延を集計する
+type slaTracker struct {
+	mu    sync.Mutex
+	peer  string
+	state slaState
+	rtt   *sampler // RTTヒストグラムへの記録（nilで記録しない）
+
+	rttHist *histogram // 起動時からのRTTの分布（メトリクス用、月次の集計とは別）
+}
+
+// slaFilePeerはJSON出力におけるピア1台分の内容
+type slaFilePeer struct {
+	Current  *SLAReport `json:"current"`
+	Previous *SLAReport `json:"previous"`
+	State    slaState   `json:"state"`
+}
+
+// newSLATracker はピアのSLA集計を生成する関数（savedがあれば集計を継続する）
+func newSLATracker(peer string, saved *slaState, rtt *sampler) *slaTracker {
+	s := &slaTracker{peer: peer, rtt: rtt, rttHist: newHistogram(rttBounds)}
+	if saved != nil {
+		s.state = *saved
+	}
+	s.rotate(time.Now())
+	return s
+}
+
+// loadSLAFile は前回出力したJSONからピアごとの集計状態を読み込む関数
+func loadSLAFile(file string) map[string]*slaState {
+	states := make(map[string]*slaState)
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return states
+	}
+
+	var saved struct {
+		Peers map[string]slaFilePeer `json:"peers"`
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		logf("[WARN]", "Ignoring unreadable SLA file %s: %v", file, err)
+		return states
+	}
+	for host, p := range saved.Peers {
+		state := p.State
+		states[host] = &state
+	}
+	logf("[INFO]", "SLA state restored from %s", file)
+	return states
+}
+
+// rotate は月が変わっていれば当月の集計を前月へ移す（ロック取得済みで呼ぶ）
+func (s *slaTracker) rotate(now time.Time) *slaMonth {
+	month := now.UTC().Format("2006-01")
+	if s.state.Current == nil || s.state.Current.Month != month {
+		if s.state.Current != nil {
+			s.state.Previous = s.state.Current
+		}
+		s.state.Current = &slaMonth{Month: month}
+	}
+	return s.state.Current
+}
+
+// recordTick はキープアライブ周期ごとにトンネルの稼働・停止時間を加算する
+func (s *slaTracker) recordTick(now time.Time, elapsed time.Duration, up bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.rotate(now)
+	if up {
+		m.UpSec += elapsed.Seconds()
+	} else {
+		m.DownSec += elapsed.Seconds()
+	}
+}
+
+// recordSent はキープアライブ要求の送信を記録する
+func (s *slaTracker) recordSent(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rotate(now).Sent++
+}
+
+// recordReply はキープアライブ応答の受信とRTTを記録する
+func (s *slaTracker) recordReply(now time.Time, rtt time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.rotate(now)
+	m.Received++
+	if !s.rtt.hit() {
+		return
+	}
+	s.rttHist.observe(uint64(max(rtt, 0)))
+
+	i := 0
+	for bound := slaRTTBase; rtt > bound && i < slaRTTBuckets-1; bound *= 2 {
+		i++
+	}
+	m.RTTBuckets[i]++
+}
+
+// percentile はヒストグラムからパーセンタイル値（バケット上限、ミリ秒）を求める関数
+func (m *slaMonth) percentile(p float64) (float64, uint64) {
+	var total uint64
+	for _, c := range m.RTTBuckets {
+		total += c
+	}
+	if total == 0 {
+		return 0, 0
+	}
+
+	target := uint64(p * float64(total))
+	var acc uint64
+	bound := slaRTTBase
+	for _, c := range m.RTTBuckets {
+		acc += c
+		if acc > target {
+			break
+		}
+		bound *= 2
+	}
+	return float64(bound) / float64(time.Millisecond), total
+}
+
+// snapshot は当月の集計値のコピーを返す
+func (s *slaTracker) snapshot() slaMonth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *s.rotate(time.Now())
+}
+
+// since は前回のスナップショットからの増分を返す（月が変わった場合はfalse）
+func (m slaMonth) since(prev slaMonth) (slaMonth, bool) {
+	if m.Month != prev.Month || m.Sent < prev.Sent || m.Received < prev.Received {
+		return slaMonth{}, false
+	}
+	d := slaMonth{Month: m.Month, Sent: m.Sent - prev.Sent, Received: m.Received - prev.Received}
+	for i := range m.RTTBuckets {
+		d.RTTBuckets[i] = m.RTTBuckets[i] - prev.RTTBuckets[i]
+	}
+	return d, true
+}
+
+// report は1か月分の集計値をレポート形式に変換する関数
+func (s *slaTracker) report(m *slaMonth) *SLAReport {
+	if m == nil {
+		return nil
+	}
+	r := &SLAReport{
+		Peer:            s.peer,
+		Month:           m.Month,
+		UpSeconds:       m.UpSec,
+		DownSeconds:     m.DownSec,
+		KeepalivesSent:  m.Sent,
+		KeepalivesRecv:  m.Received,
+		GeneratedAtUnix: time.Now().Unix(),
+	}
+	if total := m.UpSec + m.DownSec; total > 0 {
+		r.Availability = m.UpSec / total * 100
+	}
+	if m.Sent > 0 && m.Received <= m.Sent {
+		r.Loss = float64(m.Sent-m.Received) / float64(m.Sent) * 100
+	}
+	r.LatencyP50Ms, r.LatencySamples = m.percentile(0.50)
+	r.LatencyP90Ms, _ = m.percentile(0.90)
+	r.LatencyP99Ms, _ = m.percentile(0.99)
+	return r
+}
+
+// Reports は当月と前月のSLAレポートを返す
+func (s *slaTracker) Reports() map[string]*SLAReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rotate(time.Now())
+	return map[string]*SLAReport{
+		"current":  s.report(s.state.Current),
+		"previous": s.report(s.state.Previous),
+	}
+}
+
+// filePeer はJSON出力用にレポートと集計状態をまとめる関数
+func (s *slaTracker) filePeer() slaFilePeer {
+	reports := s.Reports()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.state
+	return slaFilePeer{Current: reports["current"], Previous: reports["previous"], State: state}
+}
+
+// slaReports は全ピアのSLAレポートをピアごとに返す関数
+func (t *Tunnel) slaReports() map[string]map[string]*SLAReport {
+	reports := make(map[string]map[string]*SLAReport)
+	for _, peer := range t.peers {
+		if peer.sla != nil {
+			reports[peer.Host] = peer.sla.Reports()
+		}
+	}
+	return reports
+}
+
+// writeSLAFile は全ピアのレポートと集計状態をJSONファイルへ原子的に書き出す関数
+func (t *Tunnel) writeSLAFile(file string) error {
+	peers := make(map[string]slaFilePeer)
+	for _, peer := range t.peers {
+		if peer.sla != nil {
+			peers[peer.Host] = peer.sla.filePeer()
+		}
+	}
+
+	data, err := json.MarshalIndent(map[string]interface{}{"peers": peers}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(filepath.Dir(file), "."+filepath.Base(file)+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// startSLAWriter はSLAレポートを定期的にJSONファイルへ出力する関数
+func (t *Tunnel) startSLAWriter(file string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := t.writeSLAFile(file); err != nil {
+			logf("[WARN]", "Failed to write SLA report %s: %v", file, err)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// setDontFragment はRAWソケットの送信パケットにDFを設定し、PMTUDを有効にする関数
+func setDontFragment(conn *net.IPConn, version int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if version == 4 {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+		} else {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// setAllowFragment はRAWソケットの送信パケットにDFを設定せず、経路MTUを超えるパケットをカーネルに分割させる関数
+func setAllowFragment(conn *net.IPConn, version int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if version == 4 {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DONT)
+		} else {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DONT)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// bindToDevice はRAWソケットをインターフェースにバインドする関数（SO_BINDTODEVICE）
+func bindToDevice(conn *net.IPConn, ifname string) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = syscall.BindToDevice(int(fd), ifname)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// discardReceive は送信専用のRAWソケットの受信を止め、読まれないパケットが溜まらないようにする関数
+func discardReceive(conn *net.IPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = syscall.AttachLsf(int(fd), dropAllFilter)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// IPV6_AUTOFLOWLABEL・IPV6_FLOWINFO（syscallパッケージに定義がない）
+const (
+	ipv6AutoFlowLabel = 70
+	ipv6FlowInfo      = 11
+)
+
+// setTrafficClass はRAWソケットの送信パケットのToS（IPv4）またはTraffic Class（IPv6）を設定する関数
+func setTrafficClass(conn *net.IPConn, version, tc int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if version == 4 {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tc)
+		} else {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tc)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// setAutoFlowLabel はIPv6のRAWソケットでフローラベルの自動設定を有効にする関数
+func setAutoFlowLabel(conn *net.IPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6AutoFlowLabel, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// qosControlMessage はDSCP（負なら省略）とIPv6フローラベル（0なら省略）を指定する補助データを組み立てる関数
+func qosControlMessage(version, dscp int, label uint32) []byte {
+	var oob []byte
+	add := func(level, typ int32, data []byte) {
+		b := make([]byte, syscall.CmsgSpace(len(data)))
+		h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+		h.Level = level
+		h.Type = typ
+		h.SetLen(syscall.CmsgLen(len(data)))
+		copy(b[syscall.CmsgLen(0):], data)
+		oob = append(oob, b...)
+	}
+
+	if dscp >= 0 {
+		var tc [4]byte
+		*(*int32)(unsafe.Pointer(&tc[0])) = int32(dscp << 2)
+		if version == 4 {
+			add(syscall.IPPROTO_IP, syscall.IP_TOS, tc[:])
+		} else {
+			add(syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tc[:])
+		}
+	}
+	if version == 6 && label != 0 {
+		var fl [4]byte
+		binary.BigEndian.PutUint32(fl[:], label)
+		add(syscall.IPPROTO_IPV6, ipv6FlowInfo, fl[:])
+	}
+	return oob
+}
+
+// setHopLimit はRAWソケットの送信パケットのTTL（IPv4）またはホップリミット（IPv6）を設定する関数
+func setHopLimit(conn *net.IPConn, version, hops int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if version == 4 {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, hops)
+		} else {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, hops)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// setRecvHopLimit はIPv6のRAWソケットで受信パケットのホップリミットを補助データで受け取る関数
+func setRecvHopLimit(conn *net.IPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVHOPLIMIT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// parseHopLimit は受信時の補助データからIPv6のホップリミットを取り出す関数（なければ-1）
+func parseHopLimit(oob []byte) int {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return -1
+	}
+	for _, m := range msgs {
+		if m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_HOPLIMIT && len(m.Data) >= 4 {
+			return int(binary.NativeEndian.Uint32(m.Data))
+		}
+	}
+	return -1
+}
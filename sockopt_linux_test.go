@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// hopLimitTestCmsg はレベル・種別・値を指定した補助データを1つ作る
+func hopLimitTestCmsg(level, typ int32, v uint32) []byte {
+	b := make([]byte, syscall.CmsgSpace(4))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level, h.Type = level, typ
+	h.SetLen(syscall.CmsgLen(4))
+	binary.NativeEndian.PutUint32(b[syscall.CmsgLen(0):], v)
+	return b
+}
+
+func TestParseHopLimit(t *testing.T) {
+	hop := func(v uint32) []byte { return hopLimitTestCmsg(syscall.IPPROTO_IPV6, syscall.IPV6_HOPLIMIT, v) }
+	other := hopLimitTestCmsg(syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, 7)
+	tests := []struct {
+		name string
+		oob  []byte
+		want int
+	}{
+		{"none", nil, -1},
+		{"hop limit", hop(64), 64},
+		{"directly connected", hop(255), 255},
+		{"after other message", append(append([]byte{}, other...), hop(1)...), 1},
+		{"other message only", other, -1},
+		{"ipv4 level", hopLimitTestCmsg(syscall.IPPROTO_IP, syscall.IPV6_HOPLIMIT, 64), -1},
+		{"truncated", hop(64)[:syscall.CmsgLen(0)+2], -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseHopLimit(tt.oob); got != tt.want {
+				t.Errorf("parseHopLimit() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyHopLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		cfg     OuterHopLimitConfig
+		ttl     int  // 0は設定しない（カーネルの既定値）
+		recv    bool // IPV6_RECVHOPLIMITを有効にする
+		ok      bool
+	}{
+		{"ipv4 default", 4, OuterHopLimitConfig{}, 0, false, true},
+		{"ipv4 tx", 4, OuterHopLimitConfig{TX: 255}, 255, false, true},
+		{"ipv4 rx_min", 4, OuterHopLimitConfig{TX: 1, RXMin: 255}, 1, false, true},
+		{"ipv6 tx", 6, OuterHopLimitConfig{TX: 32}, 32, false, true},
+		{"ipv6 rx_min", 6, OuterHopLimitConfig{TX: 255, RXMin: 255}, 255, true, true},
+		{"out of range", 4, OuterHopLimitConfig{TX: 300}, 0, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			network, addr := "ip4:97", "127.0.0.1"
+			if tt.version == 6 {
+				network, addr = "ip6:97", "::1"
+			}
+			conn, err := net.ListenIP(network, &net.IPAddr{IP: net.ParseIP(addr)})
+			if err != nil {
+				t.Skipf("raw socket: %v", err)
+			}
+			defer conn.Close()
+			s := &Socket{Version: tt.version, Conn: conn}
+			if err := applyHopLimit(s, tt.cfg); (err == nil) != tt.ok {
+				t.Fatalf("applyHopLimit() = %v, want ok %v", err, tt.ok)
+			}
+			if !tt.ok {
+				return
+			}
+			if tt.ttl > 0 && len(s.opts) != 1 {
+				t.Errorf("%d socket options recorded for connected sockets, want 1", len(s.opts))
+			}
+
+			raw, err := conn.SyscallConn()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ttl, recv int
+			raw.Control(func(fd uintptr) {
+				if tt.version == 4 {
+					ttl, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL)
+				} else {
+					ttl, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS)
+					recv, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVHOPLIMIT)
+				}
+			})
+			if tt.ttl > 0 && ttl != tt.ttl {
+				t.Errorf("hop limit = %d, want %d", ttl, tt.ttl)
+			}
+			if (recv != 0) != tt.recv {
+				t.Errorf("IPV6_RECVHOPLIMIT = %d, want %v", recv, tt.recv)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// setDontFragment はLinux以外では未対応
+func setDontFragment(conn *net.IPConn, version int) error {
+	return fmt.Errorf("not supported on this platform")
+}
+
+// setAllowFragment はLinux以外では未対応
+func setAllowFragment(conn *net.IPConn, version int) error {
+	return fmt.Errorf("not supported on this platform")
+}
+
+// bindToDevice はLinux以外では未対応
+func bindToDevice(conn *net.IPConn, ifname string) error {
+	return fmt.Errorf("not supported on this platform")
+}
+
+// discardReceive はLinux以外では何もしない（受信は読まれずに溜まる）
+func discardReceive(conn *net.IPConn) error {
+	return nil
+}
+
+// setTrafficClass はLinux以外では未対応
+func setTrafficClass(conn *net.IPConn, version, tc int) error {
+	return fmt.Errorf("not supported on this platform")
+}
+
+// setAutoFlowLabel はLinux以外では未対応
+func setAutoFlowLabel(conn *net.IPConn) error {
+	return fmt.Errorf("not supported on this platform")
+}
+
+// qosControlMessage はLinux以外では未対応（補助データを付けない）
+func qosControlMessage(version, dscp int, label uint32) []byte {
+	return nil
+}
+
+// setHopLimit はLinux以外では未対応
+func setHopLimit(conn *net.IPConn, version, hops int) error {
+	return fmt.Errorf("not supported on this platform")
+}
+
+// setRecvHopLimit はLinux以外では未対応
+func setRecvHopLimit(conn *net.IPConn) error {
+	return fmt.Errorf("not supported on this platform")
+}
+
+// parseHopLimit はLinux以外では未対応（常に-1）
+func parseHopLimit(oob []byte) int {
+	return -1
+}
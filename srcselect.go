@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// srcCheckInterval は src_auto 時に宛先ごとの送信元を経路表と照合する間隔
+const srcCheckInterval = 10 * time.Second
+
+// routeSource はカーネルが宛先への経路で選ぶ送信元アドレスを返す関数
+//
+// UDPソケットを接続するだけで、パケットは送らない（ポリシールーティングも反映される）。
+func routeSource(dst net.IP) (net.IP, error) {
+	network := "udp6"
+	if dst.To4() != nil {
+		network = "udp4"
+	}
+	conn, err := net.DialUDP(network, nil, &net.UDPAddr{IP: dst, Port: 9})
+	if err != nil {
+		return nil, fmt.Errorf("no route to %s: %w", dst, err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// checkSrcAuto はsrc_autoと併用できない設定がないか確認する関数
+func checkSrcAuto(cfg *Config) error {
+	switch {
+	case len(cfg.SrcIP) > 0:
+		return fmt.Errorf("src_auto and src_ip are exclusive")
+	case isAFPacket(cfg.Datapath):
+		return fmt.Errorf("datapath af_packet needs a fixed source address")
+	case cfg.Cluster.enabled():
+		return fmt.Errorf("cluster sends from the vip and needs a fixed source address")
+	case cfg.SrcIface == "" && cfg.BindDevice:
+		return fmt.Errorf("bind_device requires src_iface")
+	case cfg.SrcIface == "" && cfg.HostRoute.Enabled:
+		return fmt.Errorf("host_route requires src_iface")
+	}
+	return nil
+}
+
+// srcSelectorは src_auto 時に経路ごとの送信元を経路表の変化へ追従させ、対向から見えるアドレスと照合する
+type srcSelector struct {
+	t *Tunnel
+
+	changes    atomic.Uint64 // 経路表の変化で送信元を切り替えた回数
+	mismatches atomic.Uint64 // 対向から見えた送信元が選んだ送信元と異なった回数
+}
+
+// run は一定間隔で全経路の送信元を経路表と照合する関数
+func (s *srcSelector) run() {
+	logf("[INFO]", "Source address chosen per destination by the kernel (checked every %v)", srcCheckInterval)
+	ticker := time.NewTicker(srcCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, peer := range s.t.peers {
+			for _, p := range peer.paths {
+				s.refresh(peer, p)
+			}
+		}
+	}
+}
+
+// refresh は経路の宛先に対してカーネルが選ぶ送信元が変わっていれば切り替える関数
+//
+// 切り替え後はハンドシェイクを送り直し、対向から見えるアドレスを確かめる。
+func (s *srcSelector) refresh(peer *Peer, p *Path) {
+	dst := p.Dst.Load().(net.IP)
+	src, err := routeSource(dst)
+	if err != nil {
+		logf("[WARN]", "Source for %s (IPv%d): %v", peer.Host, p.Version, err)
+		return
+	}
+	old := p.SrcIP.Load().(net.IP)
+	if src.Equal(old) {
+		return
+	}
+	p.SrcIP.Store(src)
+	s.changes.Add(1)
+	change := fmt.Sprintf("IPv%d %s → %s (to %s)", p.Version, old, src, dst)
+	logf("[UPDATE]", "Source for %s changed: %s", peer.Host, change)
+	s.t.events.emit("src_change", peer.Host, change)
+	peer.rehello.Store(true)
+}
+
+// verify はハンドシェイク応答で対向から見えた送信元が、経路の送信元と一致するか確認する関数
+//
+// NAT・ポリシールーティングの設定誤りで対向が想定と異なるアドレスから受信している場合に警告する。
+func (s *srcSelector) verify(peer *Peer, p *Path, observed string) {
+	ip := net.ParseIP(observed)
+	if ip == nil {
+		return // 応答に送信元を載せない旧版
+	}
+	if src := p.SrcIP.Load().(net.IP); !ip.Equal(src) {
+		s.mismatches.Add(1)
+		logf("[WARN]", "Peer %s sees our IPv%d source as %s, but %s was selected (NAT or policy routing?)", peer.Host, p.Version, ip, src)
+	}
+}
+
+// Counters は送信元の切り替え回数と不一致の回数を返す
+func (s *srcSelector) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"src_changes":    s.changes.Load(),
+		"src_mismatches": s.mismatches.Load(),
+	}
+}
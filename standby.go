@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// アクティブ・スタンバイ関連の定数定義
+const standbyDefaultFailback = 30 * time.Second // 優先度の高い宛先へ戻すまでの既定の安定時間
+
+// StandbyConfigはdst_hostが死んだ時に切り替える予備の宛先の設定を保持する
+type StandbyConfig struct {
+	Hosts         []string `yaml:"hosts"`          // 予備の宛先（記載順に優先、ホスト名またはIP）
+	FailbackDelay string   `yaml:"failback_delay"` // 優先度の高い宛先が復旧してから戻すまでの安定時間（"0s"で即時）
+}
+
+// parseFailbackDelay はフェイルバックの安定時間を解析する関数（予備の宛先がなければ0）
+func parseFailbackDelay(cfg StandbyConfig) (time.Duration, error) {
+	if len(cfg.Hosts) == 0 {
+		return 0, nil
+	}
+	if cfg.FailbackDelay == "" {
+		return standbyDefaultFailback, nil
+	}
+	d, err := time.ParseDuration(cfg.FailbackDelay)
+	if err != nil {
+		return 0, fmt.Errorf("failback_delay: %w", err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("failback_delay %v must not be negative", d)
+	}
+	return d, nil
+}
+
+// addStandby は予備の宛先の経路を、既存の経路より優先度の低い経路として追加する関数
+//
+// 解決できない宛先は警告のうえ除外する（起動後の再解決では追加しない）。
+func (peer *Peer) addStandby(hosts []string, socks []*Socket, dualStack bool, failback time.Duration) {
+	peer.failback = failback
+	for _, host := range hosts {
+		paths, err := newPaths(host, socks, dualStack)
+		if err != nil {
+			logf("[WARN]", "Standby destination %s unavailable, skipping: %v", host, err)
+			continue
+		}
+		peer.paths = append(peer.paths, paths...)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StatsConfigは転送統計の定期集計・出力の設定を保持する
+type StatsConfig struct {
+	Interval     string `yaml:"interval"`      // 集計間隔（空で無効）
+	File         string `yaml:"file"`          // 集計ごとに1行追記するファイル（空で出力しない）
+	Format       string `yaml:"format"`        // fileの形式（csv, json）
+	LifetimeFile string `yaml:"lifetime_file"` // 累計値の保存先（再起動後も累計を引き継ぐ、空で保存しない）
+	PerVLAN      bool   `yaml:"per_vlan"`      // VLAN IDごとの転送統計を集計する（制御APIの/stats・/metricsで参照）
+}
+
+// trafficCounterは方向ごとの転送フレーム数・バイト数・エラー数を保持する
+type trafficCounter struct {
+	frames atomic.Uint64
+	bytes  atomic.Uint64
+	errors atomic.Uint64 // 送信時はRAWソケット、受信時はTAPへの書き込み失敗
+}
+
+// add は転送した1フレームを数える関数
+func (c *trafficCounter) add(n int) {
+	c.frames.Add(1)
+	c.bytes.Add(uint64(n))
+}
+
+// statsTotalsは転送統計の累計値
+type statsTotals struct {
+	Since     int64  `json:"since"` // 累計の開始時刻（Unix秒）
+	TxFrames  uint64 `json:"tx_frames"`
+	TxBytes   uint64 `json:"tx_bytes"`
+	RxFrames  uint64 `json:"rx_frames"`
+	RxBytes   uint64 `json:"rx_bytes"`
+	TxDropped uint64 `json:"tx_dropped"`
+	RxDropped uint64 `json:"rx_dropped"`
+	TxErrors  uint64 `json:"tx_errors"`
+	RxErrors  uint64 `json:"rx_errors"`
+}
+
+// StatsRecordは集計間隔1回分の統計（ファイル出力の1行）
+type StatsRecord struct {
+	Time      int64       `json:"time"`
+	Tap       string      `json:"tap"`
+	Interval  float64     `json:"interval"` // 実際の集計間隔（秒）
+	TxPPS     float64     `json:"tx_pps"`
+	TxBPS     float64     `json:"tx_bps"`
+	RxPPS     float64     `json:"rx_pps"`
+	RxBPS     float64     `json:"rx_bps"`
+	TxDropped uint64      `json:"tx_dropped"` // 間隔内の破棄数
+	RxDropped uint64      `json:"rx_dropped"`
+	TxErrors  uint64      `json:"tx_errors"` // 間隔内のエラー数
+	RxErrors  uint64      `json:"rx_errors"`
+	Buffers   uint64      `json:"buffer_bytes"` // 集計時点の使用中・保持中の送受信バッファのバイト数
+	Lifetime  statsTotals `json:"lifetime"`
+}
+
+// statsCSVHeader はCSV出力の列名
+var statsCSVHeader = []string{
+	"time", "tap", "interval", "tx_pps", "tx_bps", "rx_pps", "rx_bps",
+	"tx_dropped", "rx_dropped", "tx_errors", "rx_errors",
+	"lifetime_tx_frames", "lifetime_tx_bytes", "lifetime_rx_frames", "lifetime_rx_bytes",
+	"buffer_bytes",
+}
+
+// statsCollectorは転送統計を定期的に集計してログ・ファイルへ出力する
+type statsCollector struct {
+	t            *Tunnel
+	interval     time.Duration
+	file         string
+	format       string
+	lifetimeFile string
+
+	mu   sync.Mutex
+	base statsTotals // 前回までの起動の累計（lifetime_fileから読み込み）
+	prev statsTotals // 前回集計時の今回の起動分
+	last time.Time
+}
+
+// parseStatsConfig は統計出力の設定を検証する関数（無効ならintervalは0）
+func parseStatsConfig(cfg StatsConfig) (time.Duration, string, error) {
+	if cfg.Interval == "" {
+		if cfg.File != "" || cfg.LifetimeFile != "" {
+			return 0, "", fmt.Errorf("interval is required with file or lifetime_file")
+		}
+		return 0, "", nil
+	}
+	interval, err := time.ParseDuration(cfg.Interval)
+	if err != nil {
+		return 0, "", fmt.Errorf("interval: %w", err)
+	}
+	if interval < time.Second {
+		return 0, "", fmt.Errorf("interval %v must be at least 1s", interval)
+	}
+	format := cfg.Format
+	switch format {
+	case "":
+		format = "csv"
+	case "csv", "json":
+	default:
+		return 0, "", fmt.Errorf("unknown format %q (csv, json)", cfg.Format)
+	}
+	return interval, format, nil
+}
+
+// newStatsCollector は統計出力を生成する関数（intervalが空ならnilを返す）
+func newStatsCollector(t *Tunnel, cfg StatsConfig) (*statsCollector, error) {
+	interval, format, err := parseStatsConfig(cfg)
+	if err != nil || interval == 0 {
+		return nil, err
+	}
+	s := &statsCollector{
+		t:            t,
+		interval:     interval,
+		file:         cfg.File,
+		format:       format,
+		lifetimeFile: cfg.LifetimeFile,
+		last:         time.Now(),
+	}
+	s.base.Since = s.last.Unix()
+	if s.lifetimeFile != "" {
+		if data, err := os.ReadFile(s.lifetimeFile); err == nil {
+			if err := json.Unmarshal(data, &s.base); err != nil {
+				logf("[WARN]", "Ignoring unreadable stats lifetime file %s: %v", s.lifetimeFile, err)
+				s.base = statsTotals{Since: s.last.Unix()}
+			} else {
+				logf("[INFO]", "Stats lifetime totals restored from %s (since %s)", s.lifetimeFile, time.Unix(s.base.Since, 0).Format(time.RFC3339))
+			}
+		}
+	}
+	return s, nil
+}
+
+// current は今回の起動分の累計を返す関数
+func (s *statsCollector) current() statsTotals {
+	return trafficTotals(s.t)
+}
+
+// trafficTotals はトンネルの起動時からの転送統計の累計を返す関数（Sinceは設定しない）
+func trafficTotals(t *Tunnel) statsTotals {
+	return statsTotals{
+		TxFrames:  t.traffic[DirTX].frames.Load(),
+		TxBytes:   t.traffic[DirTX].bytes.Load(),
+		RxFrames:  t.traffic[DirRX].frames.Load(),
+		RxBytes:   t.traffic[DirRX].bytes.Load(),
+		TxDropped: t.dropped[DirTX].Load(),
+		RxDropped: t.dropped[DirRX].Load(),
+		TxErrors:  t.traffic[DirTX].errors.Load(),
+		RxErrors:  t.traffic[DirRX].errors.Load(),
+	}
+}
+
+// lifetime は前回までの起動の累計に今回の起動分を足した値を返す関数
+func (s *statsCollector) lifetime(cur statsTotals) statsTotals {
+	b := s.base
+	return statsTotals{
+		Since:     b.Since,
+		TxFrames:  b.TxFrames + cur.TxFrames,
+		TxBytes:   b.TxBytes + cur.TxBytes,
+		RxFrames:  b.RxFrames + cur.RxFrames,
+		RxBytes:   b.RxBytes + cur.RxBytes,
+		TxDropped: b.TxDropped + cur.TxDropped,
+		RxDropped: b.RxDropped + cur.RxDropped,
+		TxErrors:  b.TxErrors + cur.TxErrors,
+		RxErrors:  b.RxErrors + cur.RxErrors,
+	}
+}
+
+// collect は前回集計時からの差分で1間隔分の統計を作る関数
+func (s *statsCollector) collect(now time.Time) StatsRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur := s.current()
+	prev := s.prev
+	elapsed := now.Sub(s.last).Seconds()
+	s.prev, s.last = cur, now
+
+	rate := func(c, p uint64) float64 {
+		if elapsed <= 0 {
+			return 0
+		}
+		return float64(c-p) / elapsed
+	}
+	return StatsRecord{
+		Time:      now.Unix(),
+		Tap:       s.t.cfg.TapName,
+		Interval:  elapsed,
+		TxPPS:     rate(cur.TxFrames, prev.TxFrames),
+		TxBPS:     rate(cur.TxBytes, prev.TxBytes) * 8,
+		RxPPS:     rate(cur.RxFrames, prev.RxFrames),
+		RxBPS:     rate(cur.RxBytes, prev.RxBytes) * 8,
+		TxDropped: cur.TxDropped - prev.TxDropped,
+		RxDropped: cur.RxDropped - prev.RxDropped,
+		TxErrors:  cur.TxErrors - prev.TxErrors,
+		RxErrors:  cur.RxErrors - prev.RxErrors,
+		Buffers:   s.t.txBufs.bytes() + s.t.rxBufs.bytes(),
+		Lifetime:  s.lifetime(cur),
+	}
+}
+
+// formatBytes はバイト数を単位付きの表示用文字列にする関数
+func formatBytes(n uint64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	v, exp := float64(n), 0
+	for v >= unit && exp < 5 {
+		v /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", v, "kMGTP"[exp-1])
+}
+
+// logSummary は集計結果を1行でログ出力する関数
+func logSummary(r StatsRecord) {
+	logf("[INFO]", "Stats %s: TX %.1f pps %.2f Mbit/s, RX %.1f pps %.2f Mbit/s, dropped %d/%d, errors %d/%d, buffers %s (lifetime TX %s, RX %s)",
+		r.Tap, r.TxPPS, r.TxBPS/1e6, r.RxPPS, r.RxBPS/1e6, r.TxDropped, r.RxDropped, r.TxErrors, r.RxErrors,
+		formatBytes(r.Buffers), formatBytes(r.Lifetime.TxBytes), formatBytes(r.Lifetime.RxBytes))
+}
+
+// appendRecord は集計結果をファイルへ1行追記する関数（CSVは空のファイルにヘッダを書く）
+func (s *statsCollector) appendRecord(r StatsRecord) error {
+	f, err := os.OpenFile(s.file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if s.format == "json" {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(append(b, '\n'))
+		return err
+	}
+
+	w := csv.NewWriter(f)
+	if fi, err := f.Stat(); err == nil && fi.Size() == 0 {
+		w.Write(statsCSVHeader)
+	}
+	ff := func(v float64) string { return strconv.FormatFloat(v, 'f', 2, 64) }
+	u := func(v uint64) string { return strconv.FormatUint(v, 10) }
+	w.Write([]string{
+		time.Unix(r.Time, 0).UTC().Format(time.RFC3339), r.Tap, ff(r.Interval),
+		ff(r.TxPPS), ff(r.TxBPS), ff(r.RxPPS), ff(r.RxBPS),
+		u(r.TxDropped), u(r.RxDropped), u(r.TxErrors), u(r.RxErrors),
+		u(r.Lifetime.TxFrames), u(r.Lifetime.TxBytes), u(r.Lifetime.RxFrames), u(r.Lifetime.RxBytes),
+		u(r.Buffers),
+	})
+	w.Flush()
+	return w.Error()
+}
+
+// saveLifetime は累計値をファイルへ保存する関数
+func (s *statsCollector) saveLifetime() error {
+	if s.lifetimeFile == "" {
+		return nil
+	}
+	s.mu.Lock()
+	totals := s.lifetime(s.current())
+	s.mu.Unlock()
+
+	data, err := json.MarshalIndent(totals, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(s.lifetimeFile), "."+filepath.Base(s.lifetimeFile)+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.lifetimeFile)
+}
+
+// run は集計間隔ごとにサマリをログ出力し、ファイルへ書き出す関数
+func (s *statsCollector) run() {
+	logf("[INFO]", "Stats summary every %v", s.interval)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		r := s.collect(now)
+		logSummary(r)
+		if s.file != "" {
+			if err := s.appendRecord(r); err != nil {
+				logf("[WARN]", "Failed to write stats %s: %v", s.file, err)
+			}
+		}
+		if err := s.saveLifetime(); err != nil {
+			logf("[WARN]", "Failed to save stats lifetime totals %s: %v", s.lifetimeFile, err)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// vlanCount はVLAN IDの数（0はタグなし）
+const vlanCount = 4096
+
+// vlanStatsはTAP側のVLAN IDごとの転送フレーム数・バイト数・破棄数を保持する
+//
+// VIDはVLANの書き換え（vlan.map）前のローカルVID、QinQは外側のタグで数える。
+type vlanStats struct {
+	frames  [2][vlanCount]atomic.Uint64
+	bytes   [2][vlanCount]atomic.Uint64
+	dropped [2][vlanCount]atomic.Uint64
+}
+
+// vid はフレームのVLAN ID（タグなしは0）を返す関数（無効時は0）
+func (s *vlanStats) vid(frame []byte) uint16 {
+	if s == nil {
+		return 0
+	}
+	vid, _ := frameVLAN(frame)
+	return vid
+}
+
+// add は転送した1フレームをVLAN IDごとに数える関数（無効時は何もしない）
+func (s *vlanStats) add(dir Direction, vid uint16, n int) {
+	if s == nil {
+		return
+	}
+	s.frames[dir][vid].Add(1)
+	s.bytes[dir][vid].Add(uint64(n))
+}
+
+// drop はフィルタ・検証で破棄した1フレームをVLAN IDごとに数える関数（無効時は何もしない）
+func (s *vlanStats) drop(dir Direction, vid uint16) {
+	if s == nil {
+		return
+	}
+	s.dropped[dir][vid].Add(1)
+}
+
+// PeerTrafficはピアごとの転送統計（制御APIで表示する）
+type PeerTraffic struct {
+	Peer      string `json:"peer"`
+	TxFrames  uint64 `json:"tx_frames"`
+	TxBytes   uint64 `json:"tx_bytes"`
+	TxErrors  uint64 `json:"tx_errors"`
+	RxFrames  uint64 `json:"rx_frames"`
+	RxBytes   uint64 `json:"rx_bytes"`
+	RxErrors  uint64 `json:"rx_errors"`
+	RxDropped uint64 `json:"rx_dropped"`
+
+	RxChecksumChecked uint64 `json:"rx_csum_checked,omitempty"` // telemetry.inner_checksums有効時のみ
+	RxChecksumBadIP   uint64 `json:"rx_csum_bad_ip,omitempty"`
+	RxChecksumBadL4   uint64 `json:"rx_csum_bad_l4,omitempty"`
+}
+
+// VLANTrafficはVLAN IDごとの転送統計（制御APIで表示する）
+type VLANTraffic struct {
+	VLAN      uint16 `json:"vlan"` // 0はタグなし
+	TxFrames  uint64 `json:"tx_frames"`
+	TxBytes   uint64 `json:"tx_bytes"`
+	TxDropped uint64 `json:"tx_dropped"`
+	RxFrames  uint64 `json:"rx_frames"`
+	RxBytes   uint64 `json:"rx_bytes"`
+	RxDropped uint64 `json:"rx_dropped"`
+}
+
+// TrafficBreakdownはピア・VLAN IDごとの転送統計
+type TrafficBreakdown struct {
+	Peers []PeerTraffic `json:"peers"`
+	VLANs []VLANTraffic `json:"vlans,omitempty"` // stats.per_vlan有効時のみ、転送・破棄のあったVLANのみ
+}
+
+// trafficBreakdown はピア・VLAN IDごとの転送統計を返す関数
+func (t *Tunnel) trafficBreakdown() TrafficBreakdown {
+	b := TrafficBreakdown{Peers: []PeerTraffic{}}
+	for _, peer := range t.peers {
+		b.Peers = append(b.Peers, PeerTraffic{
+			Peer:      peer.Host,
+			TxFrames:  peer.traffic[DirTX].frames.Load(),
+			TxBytes:   peer.traffic[DirTX].bytes.Load(),
+			TxErrors:  peer.traffic[DirTX].errors.Load(),
+			RxFrames:  peer.traffic[DirRX].frames.Load(),
+			RxBytes:   peer.traffic[DirRX].bytes.Load(),
+			RxErrors:  peer.traffic[DirRX].errors.Load(),
+			RxDropped: peer.dropped.Load(),
+
+			RxChecksumChecked: peer.csum.checked.Load(),
+			RxChecksumBadIP:   peer.csum.bad[csumIP].Load(),
+			RxChecksumBadL4:   peer.csum.bad[csumL4].Load(),
+		})
+	}
+	if s := t.vlanStats; s != nil {
+		b.VLANs = []VLANTraffic{}
+		for vid := range vlanCount {
+			v := VLANTraffic{
+				VLAN:      uint16(vid),
+				TxFrames:  s.frames[DirTX][vid].Load(),
+				TxBytes:   s.bytes[DirTX][vid].Load(),
+				TxDropped: s.dropped[DirTX][vid].Load(),
+				RxFrames:  s.frames[DirRX][vid].Load(),
+				RxBytes:   s.bytes[DirRX][vid].Load(),
+				RxDropped: s.dropped[DirRX][vid].Load(),
+			}
+			if v.TxFrames+v.TxDropped+v.RxFrames+v.RxDropped > 0 {
+				b.VLANs = append(b.VLANs, v)
+			}
+		}
+	}
+	return b
+}
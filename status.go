@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// cliSchemaVersion はサブコマンドの -json 出力の形式の版（互換性のない変更時のみ上げる）
+const cliSchemaVersion = 1
+
+// StatusOutputは"status -json"で出力する全トンネルの状態
+type StatusOutput struct {
+	Schema  int            `json:"schema"`
+	Tunnels []TunnelStatus `json:"tunnels"`
+}
+
+// TunnelStatusはトンネル1本分の概要とカウンタ
+type TunnelStatus struct {
+	TunnelInfo
+	Counters map[string]uint64 `json:"counters"`
+}
+
+// CheckOutputは"check -json"で出力する検証結果
+type CheckOutput struct {
+	Schema  int           `json:"schema"`
+	OK      bool          `json:"ok"`
+	Error   string        `json:"error,omitempty"` // 設定ファイルを読めなかった場合
+	Tunnels []CheckTunnel `json:"tunnels"`
+}
+
+// CheckTunnelはトンネル1本分の検証結果
+type CheckTunnel struct {
+	Tap      string   `json:"tap"`
+	Errors   []string `json:"errors"`
+	Warnings []string `json:"warnings"`
+}
+
+// VersionOutputは"version -json"で出力する自身のソフトウェア情報
+type VersionOutput struct {
+	Schema int `json:"schema"`
+	PeerSoftware
+}
+
+// printJSON は値を整形したJSONで標準出力へ書き出す関数
+//
+// JSONを読むスクリプトを壊さないよう、呼び出し元はログを標準エラー出力へ切り替えておくこと。
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// runVersion は"version"サブコマンドを実行し、終了コードを返す関数
+func runVersion(args []string) int {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "JSONで出力する")
+	fs.Parse(args)
+
+	if *asJSON {
+		printJSON(VersionOutput{Schema: cliSchemaVersion, PeerSoftware: PeerSoftware{
+			Version:   daemonVersion(),
+			Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+			GoVersion: runtime.Version(),
+		}})
+		return 0
+	}
+	fmt.Printf("etherip %s (%s/%s, %s)\n", daemonVersion(), runtime.GOOS, runtime.GOARCH, runtime.Version())
+	return 0
+}
+
+// apiClient は制御APIのアドレス（"unix:/path"可）へ接続するHTTPクライアントを返す関数
+func apiClient(addr string) (*http.Client, string) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		tr := &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}}
+		return &http.Client{Transport: tr, Timeout: 5 * time.Second}, "http://localhost"
+	}
+	return &http.Client{Timeout: 5 * time.Second}, "http://" + addr
+}
+
+// apiGet は制御APIからJSONを取得する関数
+func apiGet(client *http.Client, base, token, path string, v interface{}) error {
+	return apiDo(client, http.MethodGet, base, token, path, v)
+}
+
+// apiDo は制御APIへリクエストを送り、応答のJSONを読む関数
+func apiDo(client *http.Client, method, base, token, path string, v interface{}) error {
+	req, err := http.NewRequest(method, base+path, nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// statusToken はトークン未指定時に設定ファイルのapi_tokensから使うものを選ぶ関数（全テナントを優先）
+func statusToken(tokens []APIToken) string {
+	for _, tok := range tokens {
+		if tok.Tenant == "*" {
+			return tok.Token
+		}
+	}
+	if len(tokens) > 0 {
+		return tokens[0].Token
+	}
+	return ""
+}
+
+// resolveAPI は制御APIのアドレス・トークンが未指定なら設定ファイルから補う関数
+func resolveAPI(path string, addr, token *string) error {
+	if *addr != "" {
+		return nil
+	}
+	cfgs, err := loadConfigs(path)
+	if err != nil {
+		return fmt.Errorf("%v (use -api to name the control API)", err)
+	}
+	if *addr = cfgs[0].APIListen; *addr == "" {
+		return fmt.Errorf("api_listen is not set in %s", path)
+	}
+	if *token == "" {
+		*token = statusToken(cfgs[0].APITokens)
+	}
+	return nil
+}
+
+// runStatus は"status"サブコマンドを実行し、動作中のデーモンの状態を制御API経由で表示する関数
+func runStatus(args []string) int {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	path := fs.String("c", "config.yaml", "設定ファイルのパス（api_listen・api_tokensを読む）")
+	addr := fs.String("api", "", "制御APIのアドレス（空で設定ファイルのapi_listen）")
+	token := fs.String("token", os.Getenv("ETHERIP_API_TOKEN"), "制御APIのトークン（空で設定ファイルのapi_tokens）")
+	tap := fs.String("tap", "", "表示するトンネル（空で全トンネル）")
+	asJSON := fs.Bool("json", false, "JSONで出力する")
+	fs.Parse(args)
+	if *asJSON {
+		logOutput = os.Stderr
+	}
+
+	fail := func(format string, a ...interface{}) int {
+		fmt.Fprintf(os.Stderr, "ERROR: "+format+"\n", a...)
+		return 1
+	}
+	if err := resolveAPI(*path, addr, token); err != nil {
+		return fail("%v", err)
+	}
+
+	client, base := apiClient(*addr)
+	var infos []TunnelInfo
+	if err := apiGet(client, base, *token, "/tunnels", &infos); err != nil {
+		return fail("%v (is the tunnel running?)", err)
+	}
+	out := StatusOutput{Schema: cliSchemaVersion, Tunnels: []TunnelStatus{}}
+	for _, info := range infos {
+		if *tap != "" && info.Tap != *tap {
+			continue
+		}
+		ts := TunnelStatus{TunnelInfo: info}
+		if err := apiGet(client, base, *token, "/tunnels/"+info.Tap+"/counters", &ts.Counters); err != nil {
+			return fail("%v", err)
+		}
+		out.Tunnels = append(out.Tunnels, ts)
+	}
+	if *tap != "" && len(out.Tunnels) == 0 {
+		return fail("tunnel %s not found", *tap)
+	}
+
+	if *asJSON {
+		printJSON(out)
+		return 0
+	}
+	for _, ts := range out.Tunnels {
+		fmt.Printf("%s (mtu %d)", ts.Tap, ts.MTU)
+		if ts.Tenant != "" {
+			fmt.Printf(" tenant %s", ts.Tenant)
+		}
+		fmt.Println()
+		for _, p := range ts.Peers {
+			state := "down"
+			switch {
+			case p.Up && p.Degraded:
+				state = "degraded"
+			case p.Up:
+				state = "up"
+			}
+			fmt.Printf("  peer %-20s %-8s IPv%d %s", p.Host, state, p.Version, p.Dst)
+			if p.RTTMs > 0 {
+				fmt.Printf("  rtt %.2fms", p.RTTMs)
+			}
+			if p.Software != nil {
+				fmt.Printf("  etherip %s (%s)", p.Software.Version, p.Software.Platform)
+			}
+			fmt.Println()
+			if p.Mismatch != "" {
+				fmt.Printf("    capability mismatch: %s\n", p.Mismatch)
+			}
+		}
+		c := ts.Counters
+		fmt.Printf("  tx %d frames %s, %d errors, %d dropped\n", c["tx_frames"], formatBytes(c["tx_bytes"]), c["tx_errors"], c["tx_dropped"])
+		fmt.Printf("  rx %d frames %s, %d errors, %d dropped\n", c["rx_frames"], formatBytes(c["rx_bytes"]), c["rx_errors"], c["rx_dropped"])
+		for _, d := range []string{"tx", "rx"} {
+			if s, ok := ts.FrameSizes[d]; ok && s.Count > 0 {
+				fmt.Printf("  %s frame size avg %.0f, p50 %s, p99 %s (%d sampled)\n", d, s.mean(), sizeBucket(s, 0.5), sizeBucket(s, 0.99), s.Count)
+			}
+		}
+	}
+	return 0
+}
+
+// sizeBucket はフレーム長の分位が入るバケットを"<=1518"の形式で返す関数
+func sizeBucket(s HistogramSnapshot, q float64) string {
+	if bound, ok := s.quantile(q); ok {
+		return fmt.Sprintf("<=%d", bound)
+	}
+	return fmt.Sprintf(">%d", s.Bounds[len(s.Bounds)-1])
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ストーム抑制関連の定数定義
+const (
+	stormBroadcast      = 0
+	stormMulticast      = 1
+	stormUnknownUnicast = 2
+
+	stormLearnAging  = 5 * time.Minute  // 対向側で見たMACアドレスを既知とみなす時間
+	stormLearnMax    = 65536            // 対向側のMACアドレスの最大記録数
+	stormLogInterval = 10 * time.Second // 破棄中の警告ログの最短間隔
+)
+
+// stormClassNames はフレーム種別の表示名（ログ・カウンタ名に使用）
+var stormClassNames = [3]string{"broadcast", "multicast", "unknown_unicast"}
+
+// StormControlConfigはトンネルへ送るブロードキャスト・マルチキャスト・未知ユニキャストの上限を保持する
+type StormControlConfig struct {
+	Broadcast      int `yaml:"broadcast"`       // ブロードキャストの毎秒フレーム数の上限（0で無制限）
+	Multicast      int `yaml:"multicast"`       // マルチキャストの毎秒フレーム数の上限（0で無制限）
+	UnknownUnicast int `yaml:"unknown_unicast"` // 対向側で見たことのない宛先MACへのユニキャストの上限（0で無制限）
+}
+
+// stormControlはTAP → トンネル方向のフラッディングされるフレームを種別ごとの毎秒フレーム数で制限するフィルタ
+//
+// 未知ユニキャストの判定には、トンネルから受信したフレームの送信元MACを記録して使う。
+type stormControl struct {
+	buckets [3]*tokenBucket // 種別ごとのトークンバケット（1フレーム = 1トークン、無制限ならnil）
+	limits  [3]int
+
+	mu      sync.Mutex
+	learned map[[6]byte]int64 // 対向側で見たMACアドレス → 最終確認時刻(UnixNano)
+
+	dropped [3]atomic.Uint64 // 種別ごとの破棄数
+	logged  [3]atomic.Int64  // 種別ごとの最後に警告した時刻(UnixNano)
+}
+
+// newStormControl はストーム抑制の設定からフィルタを生成する関数（すべて無制限ならnilを返す）
+func newStormControl(cfg StormControlConfig) (*stormControl, error) {
+	s := &stormControl{limits: [3]int{cfg.Broadcast, cfg.Multicast, cfg.UnknownUnicast}}
+	enabled := false
+	for class, limit := range s.limits {
+		if limit < 0 {
+			return nil, fmt.Errorf("%s %d must not be negative", stormClassNames[class], limit)
+		}
+		if limit == 0 {
+			continue
+		}
+		// 1秒分のバーストを許容する
+		s.buckets[class] = &tokenBucket{rate: float64(limit), burst: float64(limit), tokens: float64(limit), last: time.Now()}
+		logf("[INFO]", "Storm control: %s limited to %d frames/s", stormClassNames[class], limit)
+		enabled = true
+	}
+	if !enabled {
+		return nil, nil
+	}
+	if s.buckets[stormUnknownUnicast] != nil {
+		s.learned = make(map[[6]byte]int64)
+	}
+	return s, nil
+}
+
+// classify はTAPから読んだフレームの種別を返す関数（既知のユニキャストなら-1）
+func (s *stormControl) classify(frame []byte, now int64) int {
+	switch {
+	case frame[0] == 0xff && frame[1] == 0xff && frame[2] == 0xff && frame[3] == 0xff && frame[4] == 0xff && frame[5] == 0xff:
+		return stormBroadcast
+	case frame[0]&0x01 != 0:
+		return stormMulticast
+	case s.learned == nil:
+		return -1
+	}
+	var mac [6]byte
+	copy(mac[:], frame[0:6])
+	s.mu.Lock()
+	seen, ok := s.learned[mac]
+	s.mu.Unlock()
+	if ok && time.Duration(now-seen) < stormLearnAging {
+		return -1
+	}
+	return stormUnknownUnicast
+}
+
+// learn はトンネルから受信したフレームの送信元MACを対向側のアドレスとして記録する関数
+func (s *stormControl) learn(frame []byte, now int64) {
+	if frame[6]&0x01 != 0 {
+		return
+	}
+	var mac [6]byte
+	copy(mac[:], frame[6:12])
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.learned[mac]; !ok && len(s.learned) >= stormLearnMax {
+		// 満杯なら期限切れを掃除し、それでも空きがなければ記録しない（未知ユニキャスト扱いのまま）
+		for m, seen := range s.learned {
+			if time.Duration(now-seen) >= stormLearnAging {
+				delete(s.learned, m)
+			}
+		}
+		if len(s.learned) >= stormLearnMax {
+			return
+		}
+	}
+	s.learned[mac] = now
+}
+
+// Filter は上限を超えたブロードキャスト・マルチキャスト・未知ユニキャストを破棄する
+func (s *stormControl) Filter(dir Direction, frame []byte) ([]byte, Verdict) {
+	if len(frame) < 14 {
+		return frame, VerdictPass
+	}
+	now := time.Now().UnixNano()
+	if dir == DirRX {
+		if s.learned != nil {
+			s.learn(frame, now)
+		}
+		return frame, VerdictPass
+	}
+
+	class := s.classify(frame, now)
+	if class < 0 || s.buckets[class] == nil {
+		return frame, VerdictPass
+	}
+	if _, ok := s.buckets[class].reserve(1, 0); ok {
+		return frame, VerdictPass
+	}
+	s.dropped[class].Add(1)
+	if last := s.logged[class].Load(); time.Duration(now-last) >= stormLogInterval && s.logged[class].CompareAndSwap(last, now) {
+		logf("[WARN]", "Storm control: dropping %s frames over %d/s (%d dropped so far)", stormClassNames[class], s.limits[class], s.dropped[class].Load())
+	}
+	return nil, VerdictDrop
+}
+
+// Counters は種別ごとの破棄数を返す
+func (s *stormControl) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"storm_broadcast_dropped":       s.dropped[stormBroadcast].Load(),
+		"storm_multicast_dropped":       s.dropped[stormMulticast].Load(),
+		"storm_unknown_unicast_dropped": s.dropped[stormUnknownUnicast].Load(),
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// STPコスト調整関連の定数定義
+const (
+	stpDefaultInterval    = 30 * time.Second // 評価間隔の既定値
+	stpDefaultBaseCost    = 100              // 遅延・損失がない場合のコストの既定値
+	stpDefaultPerMs       = 10               // 遅延1msあたりの加算の既定値
+	stpDefaultPerLossPct  = 200              // 損失率1%あたりの加算の既定値
+	stpMaxCost            = 65535            // 経路断時のコスト（STPの上限）
+	stpHysteresisFraction = 0.1              // 現在値からこの割合以上変わった場合のみ更新する
+)
+
+// STPCostConfigはトンネルの遅延・損失に応じたブリッジポートのコスト調整の設定を保持する
+//
+// cost = base_cost + p50遅延(ms)×per_ms + 損失率(%)×per_loss_percent（経路断時は65535）
+type STPCostConfig struct {
+	Enabled        bool    `yaml:"enabled"`
+	Interval       string  `yaml:"interval"`         // 評価間隔
+	BaseCost       int     `yaml:"base_cost"`        // 遅延・損失がない場合のコスト
+	PerMs          float64 `yaml:"per_ms"`           // 遅延1msあたりの加算
+	PerLossPercent float64 `yaml:"per_loss_percent"` // 損失率1%あたりの加算
+}
+
+// stpCosterはキープアライブの測定値からTAPのブリッジポートコストを更新する
+type stpCoster struct {
+	t        *Tunnel
+	interval time.Duration
+	base     float64
+	perMs    float64
+	perLoss  float64
+	path     string // brport/path_cost のsysfsパス
+
+	cost    atomic.Uint64 // 現在設定しているコスト
+	updates atomic.Uint64 // コストを変更した回数
+}
+
+// newSTPCoster はSTPコスト調整の設定を検証して生成する関数
+func newSTPCoster(t *Tunnel, cfg STPCostConfig) (*stpCoster, error) {
+	if t.keepaliveInterval == 0 {
+		return nil, errors.New("stp_cost requires keepalive_interval")
+	}
+	if t.cfg.BrName == "off" {
+		return nil, errors.New("stp_cost requires br_name to be set")
+	}
+
+	c := &stpCoster{
+		t:        t,
+		interval: stpDefaultInterval,
+		base:     stpDefaultBaseCost,
+		perMs:    stpDefaultPerMs,
+		perLoss:  stpDefaultPerLossPct,
+		path:     fmt.Sprintf("/sys/class/net/%s/brport/path_cost", t.cfg.TapName),
+	}
+	var err error
+	if cfg.Interval != "" {
+		if c.interval, err = time.ParseDuration(cfg.Interval); err != nil {
+			return nil, err
+		}
+		if c.interval <= 0 {
+			return nil, errors.New("interval must be positive")
+		}
+	}
+	if cfg.BaseCost != 0 {
+		if cfg.BaseCost < 1 || cfg.BaseCost > stpMaxCost {
+			return nil, fmt.Errorf("base_cost %d out of range (1-%d)", cfg.BaseCost, stpMaxCost)
+		}
+		c.base = float64(cfg.BaseCost)
+	}
+	if cfg.PerMs != 0 {
+		c.perMs = cfg.PerMs
+	}
+	if cfg.PerLossPercent != 0 {
+		c.perLoss = cfg.PerLossPercent
+	}
+
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", c.path, err)
+	}
+	cur, _ := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	c.cost.Store(cur)
+	return c, nil
+}
+
+// compute は区間内の遅延・損失からコストを求める関数（全ピアのうち最も悪い値を使う）
+func (c *stpCoster) compute(prev map[*Peer]slaMonth) uint64 {
+	worst := 0.0
+	for _, peer := range c.t.peers {
+		if !peer.up.Load() {
+			return stpMaxCost
+		}
+		cur := peer.sla.snapshot()
+		d, ok := cur.since(prev[peer])
+		prev[peer] = cur
+		if !ok || d.Sent == 0 {
+			continue
+		}
+
+		cost := c.base
+		if p50, samples := d.percentile(0.50); samples > 0 {
+			cost += p50 * c.perMs
+		}
+		if d.Received <= d.Sent {
+			cost += float64(d.Sent-d.Received) / float64(d.Sent) * 100 * c.perLoss
+		}
+		worst = max(worst, cost)
+	}
+	if worst == 0 {
+		return c.cost.Load()
+	}
+	return uint64(min(math.Round(worst), stpMaxCost))
+}
+
+// run は評価間隔ごとにコストを計算し、変化が大きければsysfsへ書き込む関数
+func (c *stpCoster) run() {
+	logf("[INFO]", "STP path cost adjustment enabled on %s (interval %v)", c.t.cfg.TapName, c.interval)
+
+	prev := make(map[*Peer]slaMonth)
+	for _, peer := range c.t.peers {
+		prev[peer] = peer.sla.snapshot()
+	}
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		next, cur := c.compute(prev), c.cost.Load()
+		if next == cur || (next != stpMaxCost && cur != stpMaxCost &&
+			math.Abs(float64(next)-float64(cur)) < float64(cur)*stpHysteresisFraction) {
+			continue
+		}
+		if err := os.WriteFile(c.path, []byte(strconv.FormatUint(next, 10)), 0644); err != nil {
+			logf("[WARN]", "Failed to set path cost of %s: %v", c.t.cfg.TapName, err)
+			continue
+		}
+		c.cost.Store(next)
+		c.updates.Add(1)
+		logf("[UPDATE]", "STP path cost of %s: %d → %d", c.t.cfg.TapName, cur, next)
+	}
+}
+
+// Counters は現在のコストと変更回数を返す
+func (c *stpCoster) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"stp_path_cost":         c.cost.Load(),
+		"stp_path_cost_updates": c.updates.Load(),
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sysctlRoot はカーネルパラメータのファイルを置くディレクトリ
+const sysctlRoot = "/proc/sys"
+
+// sysctlProfiles は名前付きのカーネルパラメータの組
+//
+// RAWソケットの受信バッファはSO_RCVBUFを指定しないためrmem_defaultで決まり、取りこぼしはnetdev_max_backlogで決まる。
+var sysctlProfiles = map[string]map[string]string{
+	"throughput": { // 10Gbps級、外側パケットの取りこぼしを防ぐ
+		"net.core.rmem_max":           "67108864",
+		"net.core.wmem_max":           "67108864",
+		"net.core.rmem_default":       "16777216",
+		"net.core.wmem_default":       "16777216",
+		"net.core.netdev_max_backlog": "250000",
+		"net.core.netdev_budget":      "600",
+	},
+	"balanced": { // 1Gbps級
+		"net.core.rmem_max":           "16777216",
+		"net.core.wmem_max":           "16777216",
+		"net.core.rmem_default":       "4194304",
+		"net.core.wmem_default":       "4194304",
+		"net.core.netdev_max_backlog": "10000",
+	},
+}
+
+// SysctlConfigは起動時に設定し終了時に戻すカーネルパラメータを保持する（トップレベルのみ）
+type SysctlConfig struct {
+	Profile  string            `yaml:"profile"`  // 名前付きの組（throughput, balanced、空で使わない）
+	Settings map[string]string `yaml:"settings"` // 追加・上書きするパラメータ（net.core.rmem_max: "134217728" 等）
+	Restore  *bool             `yaml:"restore"`  // 終了時に元の値へ戻す（既定true）
+}
+
+// sysctlSettingは設定するカーネルパラメータ1つ
+type sysctlSetting struct {
+	key   string
+	value string
+	raise bool // プロファイル由来（現在値の方が大きければ下げない）
+}
+
+// sysctlPath はnet.core.rmem_max 形式のキーを/proc/sys以下のパスに変換する関数
+func sysctlPath(key string) (string, error) {
+	if key == "" || strings.ContainsAny(key, "/ ") || strings.Contains(key, "..") {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(sysctlRoot, strings.ReplaceAll(key, ".", "/")), nil
+}
+
+// parseSysctl はプロファイルと個別の設定をキー順の一覧にまとめる関数（個別の設定が優先）
+func parseSysctl(cfg SysctlConfig) ([]sysctlSetting, error) {
+	merged := make(map[string]sysctlSetting)
+	if cfg.Profile != "" {
+		profile, ok := sysctlProfiles[cfg.Profile]
+		if !ok {
+			return nil, fmt.Errorf("unknown profile %q (throughput, balanced)", cfg.Profile)
+		}
+		for k, v := range profile {
+			merged[k] = sysctlSetting{key: k, value: v, raise: true}
+		}
+	}
+	for k, v := range cfg.Settings {
+		if _, err := sysctlPath(k); err != nil {
+			return nil, err
+		}
+		merged[k] = sysctlSetting{key: k, value: strings.TrimSpace(v)}
+	}
+
+	list := make([]sysctlSetting, 0, len(merged))
+	for _, s := range merged {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].key < list[j].key })
+	return list, nil
+}
+
+// readSysctl はカーネルパラメータの現在値を読む関数
+func readSysctl(key string) (string, error) {
+	path, err := sysctlPath(key)
+	if err != nil {
+		return "", err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// writeSysctl はカーネルパラメータを書き込む関数
+func writeSysctl(key, value string) error {
+	path, err := sysctlPath(key)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(value+"\n"), 0o644)
+}
+
+// applySysctl はカーネルパラメータを設定し、restore有効時は終了時に元の値へ戻すよう登録する関数
+//
+// プロファイルの値は現在値より小さければ書き込まない（ホストで既に大きくしている値を下げない）。
+// 1つでも書き込めなければ、それまでに変えた値を戻してエラーを返す。
+// 無停止の再起動では、引き継ぎ元が変える前の値を停止時に戻す値として引き継ぐ。
+func applySysctl(cfg SysctlConfig) error {
+	settings, err := parseSysctl(cfg)
+	if err != nil || len(settings) == 0 {
+		return err
+	}
+	restore := cfg.Restore == nil || *cfg.Restore
+
+	type saved struct{ key, value string }
+	var changed, inheritedOrig []saved
+	undo := func() {
+		for i := len(changed) - 1; i >= 0; i-- {
+			if err := writeSysctl(changed[i].key, changed[i].value); err != nil {
+				logf("[WARN]", "Failed to restore sysctl %s=%s: %v", changed[i].key, changed[i].value, err)
+			}
+		}
+	}
+	for _, s := range settings {
+		old, err := readSysctl(s.key)
+		if err != nil {
+			undo()
+			return fmt.Errorf("%s: %w", s.key, err)
+		}
+		if orig, ok := inheritedSysctl(s.key); ok {
+			inheritedOrig = append(inheritedOrig, saved{s.key, orig})
+		}
+		if old == s.value {
+			continue
+		}
+		if s.raise {
+			cur, err1 := strconv.ParseInt(old, 10, 64)
+			want, err2 := strconv.ParseInt(s.value, 10, 64)
+			if err1 == nil && err2 == nil && cur >= want {
+				continue
+			}
+		}
+		if err := writeSysctl(s.key, s.value); err != nil {
+			undo()
+			return fmt.Errorf("%s: %w", s.key, err)
+		}
+		logf("[INFO]", "sysctl %s: %s -> %s", s.key, old, s.value)
+		changed = append(changed, saved{s.key, old})
+	}
+	// 引き継ぎ元が変えた値は最後に元の値へ戻す
+	changed = append(inheritedOrig, changed...)
+	if restore && len(changed) > 0 {
+		for _, c := range changed {
+			offerSysctl(c.key, c.value)
+		}
+		registerShutdown(func() {
+			logf("[INFO]", "Restoring %d sysctl settings", len(changed))
+			undo()
+		})
+	}
+	return nil
+}
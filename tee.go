@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// teeプロトコル関連の定数定義
+const (
+	teeProtoVersion  = 1                      // プロトコルバージョン
+	teeMsgFrame      = 1                      // フレーム通知メッセージ
+	teeFlagVerdict   = 0x01                   // 判定結果の返信を要求
+	teeQueueSize     = 1024                   // 非同期送信キューの長さ
+	teeReconnectWait = 1 * time.Second        // 再接続間隔
+	teeDefaultWait   = 5 * time.Millisecond   // 判定待ちタイムアウトの既定値
+	teeVerdictLen    = 9                      // 判定メッセージ本体長（seq + verdict）
+	teeMaxMsgLen     = bufferSize + 64        // 1メッセージの最大長
+	teeWriteTimeout  = 100 * time.Millisecond // 非同期送信時の書き込みタイムアウト
+)
+
+// TeeConfigは外部プロセスへのフレーム複製（tee）の設定を保持する
+type TeeConfig struct {
+	Socket    string `yaml:"socket"`    // 接続先Unixソケットのパス（空で無効）
+	Direction string `yaml:"direction"` // 対象方向（tx, rx, both）
+	Verdicts  bool   `yaml:"verdicts"`  // 外部プロセスの判定結果に従うか
+	Timeout   string `yaml:"timeout"`   // 判定待ちタイムアウト
+	FailOpen  bool   `yaml:"fail_open"` // 未接続・タイムアウト時にフレームを通過させるか
+}
+
+// teeClientはUnixソケット経由でフレームを外部プロセス（DPI/IDS等）へ複製送信する
+//
+// 送信メッセージ（ビッグエンディアン）
+//
+//	u32 length | u8 version | u8 type | u8 direction | u8 flags |
+//	u64 seq | i64 timestamp(UnixNano) | u8 ifname_len | ifname | frame
+//
+// 判定メッセージ（外部プロセス → デーモン、verdicts有効時のみ）
+//
+//	u32 length(=9) | u64 seq | u8 verdict (0=pass, 1=drop)
+type teeClient struct {
+	cfg      TeeConfig
+	ifname   string
+	tx, rx   bool
+	timeout  time.Duration
+	failOpen Verdict
+
+	mu   sync.Mutex // connへの書き込みを排他
+	conn net.Conn
+
+	seq       atomic.Uint64
+	pendingMu sync.Mutex
+	pending   map[uint64]chan Verdict // 判定待ちのフレーム
+	queue     chan []byte             // 判定不要時の非同期送信キュー
+
+	sent     atomic.Uint64 // 送信済みメッセージ数
+	dropped  atomic.Uint64 // 未接続・キュー溢れで送れなかった数
+	timeouts atomic.Uint64 // 判定待ちタイムアウト数
+}
+
+// newTeeClient はtee設定からクライアントを生成し、接続goroutineを起動する関数
+func newTeeClient(cfg TeeConfig, ifname string) (*teeClient, error) {
+	tx, rx, ok := parseDirections(cfg.Direction)
+	if !ok {
+		return nil, fmt.Errorf("invalid direction %q (tx, rx or both)", cfg.Direction)
+	}
+
+	timeout := teeDefaultWait
+	if cfg.Timeout != "" {
+		d, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		timeout = d
+	}
+
+	c := &teeClient{
+		cfg:      cfg,
+		ifname:   ifname,
+		tx:       tx,
+		rx:       rx,
+		timeout:  timeout,
+		failOpen: VerdictDrop,
+		pending:  make(map[uint64]chan Verdict),
+		queue:    make(chan []byte, teeQueueSize),
+	}
+	if cfg.FailOpen {
+		c.failOpen = VerdictPass
+	}
+
+	go c.connectLoop()
+	if !cfg.Verdicts {
+		go c.writeLoop()
+	}
+
+	logf("[INFO]", "Tee to %s enabled (tx=%v rx=%v verdicts=%v)", cfg.Socket, tx, rx, cfg.Verdicts)
+	return c, nil
+}
+
+// connectLoop は外部プロセスへの接続を維持し、切断時は再接続する関数
+func (c *teeClient) connectLoop() {
+	for {
+		conn, err := net.Dial("unix", c.cfg.Socket)
+		if err != nil {
+			time.Sleep(teeReconnectWait)
+			continue
+		}
+		logf("[INFO]", "Tee connected to %s", c.cfg.Socket)
+
+		c.mu.Lock()
+		c.conn = conn
+		c.mu.Unlock()
+
+		err = c.readVerdicts(conn)
+		logf("[WARN]", "Tee connection to %s lost: %v", c.cfg.Socket, err)
+
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+		conn.Close()
+		c.failPending()
+		time.Sleep(teeReconnectWait)
+	}
+}
+
+// readVerdicts は外部プロセスからの判定メッセージを読み取り、待機中のフレームへ通知する関数
+func (c *teeClient) readVerdicts(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+	msg := make([]byte, 4+teeVerdictLen)
+	for {
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return err
+		}
+		if binary.BigEndian.Uint32(msg[0:4]) != teeVerdictLen {
+			return fmt.Errorf("invalid verdict message length")
+		}
+		seq := binary.BigEndian.Uint64(msg[4:12])
+		v := VerdictPass
+		if msg[12] != 0 {
+			v = VerdictDrop
+		}
+
+		c.pendingMu.Lock()
+		ch, ok := c.pending[seq]
+		delete(c.pending, seq)
+		c.pendingMu.Unlock()
+		if ok {
+			ch <- v
+		}
+	}
+}
+
+// failPending は切断時に判定待ちのフレームへ既定の判定を通知する関数
+func (c *teeClient) failPending() {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	for seq, ch := range c.pending {
+		ch <- c.failOpen
+		delete(c.pending, seq)
+	}
+}
+
+// writeLoop は判定不要モードで非同期送信キューを書き出す関数
+func (c *teeClient) writeLoop() {
+	for msg := range c.queue {
+		if err := c.write(msg, teeWriteTimeout); err != nil {
+			c.dropped.Add(1)
+		}
+	}
+}
+
+// write は接続中のソケットへメッセージを1件書き込む関数
+func (c *teeClient) write(msg []byte, timeout time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return fmt.Errorf("not connected")
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := c.conn.Write(msg); err != nil {
+		// 書き込み失敗時は読み取り側にも切断を伝える
+		c.conn.Close()
+		return err
+	}
+	c.sent.Add(1)
+	return nil
+}
+
+// buildMessage はフレームとメタデータからteeメッセージを生成する関数
+func (c *teeClient) buildMessage(dir Direction, seq uint64, frame []byte) []byte {
+	flags := byte(0)
+	if c.cfg.Verdicts {
+		flags |= teeFlagVerdict
+	}
+
+	bodyLen := 4 + 8 + 8 + 1 + len(c.ifname) + len(frame)
+	msg := make([]byte, 4+bodyLen)
+	binary.BigEndian.PutUint32(msg[0:4], uint32(bodyLen))
+	msg[4] = teeProtoVersion
+	msg[5] = teeMsgFrame
+	msg[6] = byte(dir)
+	msg[7] = flags
+	binary.BigEndian.PutUint64(msg[8:16], seq)
+	binary.BigEndian.PutUint64(msg[16:24], uint64(time.Now().UnixNano()))
+	msg[24] = byte(len(c.ifname))
+	n := copy(msg[25:], c.ifname)
+	copy(msg[25+n:], frame)
+	return msg
+}
+
+// Filter はフレームを外部プロセスへ複製し、verdicts有効時はその判定に従う
+func (c *teeClient) Filter(dir Direction, frame []byte) ([]byte, Verdict) {
+	if (dir == DirTX && !c.tx) || (dir == DirRX && !c.rx) || len(frame) > teeMaxMsgLen {
+		return frame, VerdictPass
+	}
+
+	seq := c.seq.Add(1)
+	msg := c.buildMessage(dir, seq, frame)
+
+	// 判定不要の場合はキューへ積むだけでデータパスを止めない
+	if !c.cfg.Verdicts {
+		select {
+		case c.queue <- msg:
+		default:
+			c.dropped.Add(1)
+		}
+		return frame, VerdictPass
+	}
+
+	ch := make(chan Verdict, 1)
+	c.pendingMu.Lock()
+	c.pending[seq] = ch
+	c.pendingMu.Unlock()
+
+	if err := c.write(msg, c.timeout); err != nil {
+		c.pendingMu.Lock()
+		delete(c.pending, seq)
+		c.pendingMu.Unlock()
+		c.dropped.Add(1)
+		return frame, c.failOpen
+	}
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case v := <-ch:
+		return frame, v
+	case <-timer.C:
+		c.pendingMu.Lock()
+		delete(c.pending, seq)
+		c.pendingMu.Unlock()
+		c.timeouts.Add(1)
+		return frame, c.failOpen
+	}
+}
+
+// Counters はteeのカウンタを返す
+func (c *teeClient) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"tee_sent":     c.sent.Load(),
+		"tee_dropped":  c.dropped.Load(),
+		"tee_timeouts": c.timeouts.Load(),
+	}
+}
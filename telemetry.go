@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// テレメトリ関連の定数定義
+const (
+	flowDefaultMax  = 1024            // フローテーブルの最大エントリ数の既定値
+	flowIdleTimeout = 5 * time.Minute // この間観測されなかったフローは削除する
+	flowAPILimit    = 100             // APIで返す上位フロー数
+)
+
+// SamplingConfigは観測機能1つ分の有効化とサンプリング率を保持する
+type SamplingConfig struct {
+	Enabled *bool `yaml:"enabled"` // 省略時は機能ごとの既定値
+	Sample  int   `yaml:"sample"`  // N件に1件だけ記録する（0と1は全件）
+}
+
+// FlowConfigはフローテーブルの設定を保持する
+type FlowConfig struct {
+	SamplingConfig `yaml:",inline"`
+	MaxEntries     int `yaml:"max_entries"`
+}
+
+// TelemetryConfigは観測機能ごとの有効化・サンプリング設定を保持する
+type TelemetryConfig struct {
+	RTTHistogram SamplingConfig `yaml:"rtt_histogram"`      // SLAのRTTヒストグラム（既定で有効）
+	EtherTypes   SamplingConfig `yaml:"ethertype_counters"` // EtherType別フレーム数（既定で無効）
+	Flows        FlowConfig     `yaml:"flows"`              // MACアドレス・EtherType別のフローテーブル（既定で無効）
+	Checksums    SamplingConfig `yaml:"inner_checksums"`    // 受信した内側パケットのL3/L4チェックサムの検証（既定で無効）
+	FrameSizes   SamplingConfig `yaml:"frame_sizes"`        // 方向別のフレーム長ヒストグラム（既定で無効）
+}
+
+// samplerはN件に1件を選ぶ
+type sampler struct {
+	every uint64
+	n     atomic.Uint64
+}
+
+// newSampler はサンプリング設定からサンプラーを生成する関数（無効ならnilを返す）
+func newSampler(cfg SamplingConfig, def bool) *sampler {
+	enabled := def
+	if cfg.Enabled != nil {
+		enabled = *cfg.Enabled
+	}
+	if !enabled {
+		return nil
+	}
+	return &sampler{every: uint64(max(cfg.Sample, 1))}
+}
+
+// hit は今回のイベントを記録すべきかを返す（nilなら常にfalse）
+func (s *sampler) hit() bool {
+	if s == nil {
+		return false
+	}
+	if s.every == 1 {
+		return true
+	}
+	return s.n.Add(1)%s.every == 0
+}
+
+// flowKeyはフローの識別子
+type flowKey struct {
+	dir       Direction
+	src, dst  [6]byte
+	etherType uint16
+}
+
+// flowStatsはフロー1件分の観測値
+type flowStats struct {
+	frames   atomic.Uint64
+	bytes    atomic.Uint64
+	lastSeen atomic.Int64
+}
+
+// FlowEntryはAPI出力用のフロー情報（サンプリング時は推定値）
+type FlowEntry struct {
+	Direction string `json:"direction"`
+	Src       string `json:"src"`
+	Dst       string `json:"dst"`
+	EtherType string `json:"ethertype"`
+	Frames    uint64 `json:"frames"`
+	Bytes     uint64 `json:"bytes"`
+	LastSeen  int64  `json:"last_seen"`
+
+	Labels map[string]string `json:"labels,omitempty"` // トンネルのlabels（集約時にフローの拠点を区別する）
+}
+
+// telemetryはフィルタチェーンの末尾で転送されるフレームを観測する（判定は常にPass）
+type telemetry struct {
+	etherTypes *sampler
+	flows      *sampler
+	sizes      *sampler
+	flowMax    int
+
+	sizeHist [2]*histogram // 方向ごとのフレーム長（サンプリングした件数のまま）
+
+	etMu  sync.RWMutex
+	etCnt [2]map[uint16]*atomic.Uint64 // 方向ごとのEtherType別フレーム数
+
+	flowMu   sync.RWMutex
+	flowTab  map[flowKey]*flowStats
+	flowFull atomic.Uint64 // テーブル満杯で記録できなかったフレーム数
+}
+
+// newTelemetry はテレメトリ設定から観測フィルタを生成する関数（観測対象がなければnilを返す）
+func newTelemetry(cfg TelemetryConfig) *telemetry {
+	tm := &telemetry{
+		etherTypes: newSampler(cfg.EtherTypes, false),
+		flows:      newSampler(cfg.Flows.SamplingConfig, false),
+		sizes:      newSampler(cfg.FrameSizes, false),
+		flowMax:    flowDefaultMax,
+		flowTab:    make(map[flowKey]*flowStats),
+	}
+	if tm.etherTypes == nil && tm.flows == nil && tm.sizes == nil {
+		return nil
+	}
+	for i := range tm.sizeHist {
+		tm.sizeHist[i] = newHistogram(frameSizeBounds)
+	}
+	if cfg.Flows.MaxEntries > 0 {
+		tm.flowMax = cfg.Flows.MaxEntries
+	}
+	for i := range tm.etCnt {
+		tm.etCnt[i] = make(map[uint16]*atomic.Uint64)
+	}
+	if tm.flows != nil {
+		go tm.flowAgeLoop()
+	}
+	return tm
+}
+
+// frameEtherType はVLANタグを1段読み飛ばしたEtherTypeを返す関数
+func frameEtherType(frame []byte) uint16 {
+	et := binary.BigEndian.Uint16(frame[12:14])
+	if (et == 0x8100 || et == 0x88A8) && len(frame) >= 18 {
+		et = binary.BigEndian.Uint16(frame[16:18])
+	}
+	return et
+}
+
+// Filter はフレームを観測して常に通過させる
+func (tm *telemetry) Filter(dir Direction, frame []byte) ([]byte, Verdict) {
+	if len(frame) < 14 {
+		return frame, VerdictPass
+	}
+
+	if tm.sizes.hit() {
+		tm.sizeHist[dir].observe(uint64(len(frame)))
+	}
+
+	if tm.etherTypes.hit() {
+		et := frameEtherType(frame)
+		tm.etMu.RLock()
+		c, ok := tm.etCnt[dir][et]
+		tm.etMu.RUnlock()
+		if !ok {
+			tm.etMu.Lock()
+			if c, ok = tm.etCnt[dir][et]; !ok {
+				c = &atomic.Uint64{}
+				tm.etCnt[dir][et] = c
+			}
+			tm.etMu.Unlock()
+		}
+		c.Add(1)
+	}
+
+	if tm.flows.hit() {
+		var key flowKey
+		key.dir = dir
+		copy(key.dst[:], frame[0:6])
+		copy(key.src[:], frame[6:12])
+		key.etherType = frameEtherType(frame)
+
+		tm.flowMu.RLock()
+		fs, ok := tm.flowTab[key]
+		tm.flowMu.RUnlock()
+		if !ok {
+			tm.flowMu.Lock()
+			if fs, ok = tm.flowTab[key]; !ok && len(tm.flowTab) < tm.flowMax {
+				fs = &flowStats{}
+				tm.flowTab[key] = fs
+				ok = true
+			}
+			tm.flowMu.Unlock()
+		}
+		if ok {
+			fs.frames.Add(1)
+			fs.bytes.Add(uint64(len(frame)))
+			fs.lastSeen.Store(time.Now().Unix())
+		} else {
+			tm.flowFull.Add(1)
+		}
+	}
+	return frame, VerdictPass
+}
+
+// FrameSizes は方向別のフレーム長ヒストグラムを返す関数（無効ならnil）
+func (tm *telemetry) FrameSizes() map[string]HistogramSnapshot {
+	if tm == nil || tm.sizes == nil {
+		return nil
+	}
+	return map[string]HistogramSnapshot{
+		DirTX.String(): tm.sizeHist[DirTX].snapshot(),
+		DirRX.String(): tm.sizeHist[DirRX].snapshot(),
+	}
+}
+
+// flowAgeLoop は一定時間観測されなかったフローを削除する
+func (tm *telemetry) flowAgeLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		deadline := now.Add(-flowIdleTimeout).Unix()
+		tm.flowMu.Lock()
+		for k, fs := range tm.flowTab {
+			if fs.lastSeen.Load() < deadline {
+				delete(tm.flowTab, k)
+			}
+		}
+		tm.flowMu.Unlock()
+	}
+}
+
+// Flows はバイト数の多い順にフローを返す（サンプリング率で補正した推定値）
+func (tm *telemetry) Flows() []FlowEntry {
+	if tm.flows == nil {
+		return nil
+	}
+	scale := tm.flows.every
+
+	tm.flowMu.RLock()
+	list := make([]FlowEntry, 0, len(tm.flowTab))
+	for k, fs := range tm.flowTab {
+		list = append(list, FlowEntry{
+			Direction: k.dir.String(),
+			Src:       net.HardwareAddr(k.src[:]).String(),
+			Dst:       net.HardwareAddr(k.dst[:]).String(),
+			EtherType: fmt.Sprintf("0x%04x", k.etherType),
+			Frames:    fs.frames.Load() * scale,
+			Bytes:     fs.bytes.Load() * scale,
+			LastSeen:  fs.lastSeen.Load(),
+		})
+	}
+	tm.flowMu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Bytes > list[j].Bytes })
+	if len(list) > flowAPILimit {
+		list = list[:flowAPILimit]
+	}
+	return list
+}
+
+// Counters はEtherType別フレーム数（サンプリング率で補正した推定値）とフローテーブルのカウンタを返す
+func (tm *telemetry) Counters() map[string]uint64 {
+	counters := make(map[string]uint64)
+	if tm.etherTypes != nil {
+		tm.etMu.RLock()
+		for dir, m := range tm.etCnt {
+			for et, c := range m {
+				counters[fmt.Sprintf("ethertype_%s_%04x", Direction(dir), et)] = c.Load() * tm.etherTypes.every
+			}
+		}
+		tm.etMu.RUnlock()
+	}
+	if tm.flows != nil {
+		tm.flowMu.RLock()
+		counters["flow_entries"] = uint64(len(tm.flowTab))
+		tm.flowMu.RUnlock()
+		counters["flow_table_full"] = tm.flowFull.Load()
+	}
+	return counters
+}
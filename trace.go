@@ -0,0 +1,346 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// トレース関連の定数定義
+const (
+	traceDefaultCount = 10
+	traceMaxCount     = 1000
+	traceMarkerLen    = 4 + 4 + 8 + 2    // トレースID + 通番 + フレームの指紋 + フレーム長
+	tracePendingTTL   = 5 * time.Second  // 受信側で印の付いたフレームを待つ時間
+	tracePendingMax   = traceMaxCount    // 受信側で待つ印の最大数
+	traceIdleTimeout  = 10 * time.Minute // 印を付け終わらないトレースを打ち切るまでの時間
+)
+
+// TraceStatusは実行中（または直近）のトレースの状態
+type TraceStatus struct {
+	ID        string `json:"id"`
+	Filter    string `json:"filter,omitempty"`
+	Count     int    `json:"count"`  // 印を付けるフレーム数
+	Marked    int    `json:"marked"` // 印を付けたフレーム数
+	Started   int64  `json:"started"`
+	Active    bool   `json:"active"`
+	Cancelled bool   `json:"cancelled,omitempty"`
+}
+
+// traceSessionは送信するフレームに印を付けるトレース1回分の状態
+type traceSession struct {
+	id    [4]byte
+	match captureFilter
+
+	mu     sync.Mutex
+	status TraceStatus
+}
+
+// tracePendingは対向から印を予告され、受信を待っているフレーム
+type tracePending struct {
+	id      [4]byte
+	seq     uint32
+	length  int
+	expires int64 // UnixNano
+}
+
+// tracerはフィルタに一致する次のN個のフレームに印を付け、両端のログで同じフレームを追跡できるようにする
+//
+// 送信側は印を付けたフレームの直前に、トレースID・通番・フレームの指紋を載せたOAMフレームを同じ経路で送る。
+// 受信側はOAMフレームで予告された指紋に一致するフレームを受信したときと、TAPへ渡したか破棄したかをログ出力する。
+// フレーム自体は変更しないため、対向がトレースに対応していなくても転送に影響しない。
+type tracer struct {
+	t       *Tunnel
+	session atomic.Pointer[traceSession]
+
+	mu      sync.Mutex
+	pending map[uint64]tracePending // フレームの指紋 → 予告された印
+	waiting atomic.Int32            // pendingの数（受信時に指紋を計算するかの判定用）
+
+	marked  atomic.Uint64 // 印を付けて送ったフレーム数
+	matched atomic.Uint64 // 予告どおりに受信したフレーム数
+	expired atomic.Uint64 // 予告されたが受信しなかったフレーム数
+}
+
+// newTracer はトレース機能を生成する関数
+func newTracer(t *Tunnel) *tracer {
+	return &tracer{t: t, pending: make(map[uint64]tracePending)}
+}
+
+// frameFingerprint はフレームを識別する指紋を計算する関数
+func frameFingerprint(frame []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(frame)
+	return h.Sum64()
+}
+
+// describeFrame はフレームの概要をログ用の文字列にする関数
+func describeFrame(frame []byte) string {
+	f, ok := parseFrameFields(frame)
+	if !ok {
+		return fmt.Sprintf("len %d", len(frame))
+	}
+	s := fmt.Sprintf("%s > %s", f.src, f.dst)
+	for _, vid := range f.vlans {
+		s += fmt.Sprintf(" vlan %d", vid)
+	}
+	switch {
+	case f.hasPorts:
+		s += fmt.Sprintf(" %s:%d > %s:%d proto %d", f.srcIP, f.srcPort, f.dstIP, f.dstPort, f.proto)
+	case f.srcIP.IsValid():
+		s += fmt.Sprintf(" %s > %s proto %d", f.srcIP, f.dstIP, f.proto)
+	default:
+		s += fmt.Sprintf(" ethertype 0x%04x", f.etherType)
+	}
+	return fmt.Sprintf("%s len %d", s, len(frame))
+}
+
+// start はクエリ（count, filter）で指定されたトレースを開始する関数
+func (tr *tracer) start(q url.Values) (*traceSession, error) {
+	s := &traceSession{status: TraceStatus{
+		Filter:  q.Get("filter"),
+		Count:   traceDefaultCount,
+		Started: time.Now().Unix(),
+		Active:  true,
+	}}
+	var err error
+	if s.match, err = compileCaptureFilter(s.status.Filter); err != nil {
+		return nil, fmt.Errorf("filter: %w", err)
+	}
+	if v := q.Get("count"); v != "" {
+		if s.status.Count, err = strconv.Atoi(v); err != nil || s.status.Count <= 0 || s.status.Count > traceMaxCount {
+			return nil, fmt.Errorf("count: invalid %q (1-%d)", v, traceMaxCount)
+		}
+	}
+	if _, err := rand.Read(s.id[:]); err != nil {
+		return nil, err
+	}
+	s.status.ID = hex.EncodeToString(s.id[:])
+
+	old := tr.session.Load()
+	if old != nil && old.Status().Active || !tr.session.CompareAndSwap(old, s) {
+		return nil, errors.New("a trace is already running")
+	}
+	logf("[TRACE]", "%s: marking next %d frames on %s (filter %q)", s.status.ID, s.status.Count, tr.t.cfg.TapName, s.status.Filter)
+	time.AfterFunc(traceIdleTimeout, func() { s.finish(false) })
+	return s, nil
+}
+
+// stop は実行中のトレースを打ち切る関数（実行中でなければnilを返す）
+func (tr *tracer) stop() *traceSession {
+	s := tr.session.Load()
+	if s == nil || !s.finish(true) {
+		return nil
+	}
+	logf("[TRACE]", "%s: cancelled after %d frames", s.status.ID, s.Status().Marked)
+	return s
+}
+
+// finish はトレースを終了状態にする関数（既に終了していればfalse）
+func (s *traceSession) finish(cancelled bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.status.Active {
+		return false
+	}
+	s.status.Active = false
+	s.status.Cancelled = cancelled
+	return true
+}
+
+// Status はトレースの状態を返す
+func (s *traceSession) Status() TraceStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// next はフレームがトレースの対象なら通番を割り当てる関数（対象外・終了済みならfalse）
+func (s *traceSession) next(frame []byte) (uint32, bool) {
+	if s.match != nil {
+		f, ok := parseFrameFields(frame)
+		if !ok || !s.match(f) {
+			return 0, false
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.status.Active {
+		return 0, false
+	}
+	s.status.Marked++
+	if s.status.Marked >= s.status.Count {
+		s.status.Active = false
+	}
+	return uint32(s.status.Marked), true
+}
+
+// mark は送信するフレームがトレースの対象であれば、印を予告するOAMフレームを全ピアへ送る関数
+//
+// 送信ワーカーがフィルタチェーンの適用後、フレームを送る直前に呼ぶ。
+func (tr *tracer) mark(frame []byte) {
+	s := tr.session.Load()
+	if s == nil {
+		return
+	}
+	seq, ok := s.next(frame)
+	if !ok {
+		return
+	}
+	body := make([]byte, 0, traceMarkerLen)
+	body = append(body, s.id[:]...)
+	body = binary.BigEndian.AppendUint32(body, seq)
+	body = binary.BigEndian.AppendUint64(body, frameFingerprint(frame))
+	body = binary.BigEndian.AppendUint16(body, uint16(len(frame)))
+	packet := buildEtherIPPacket(buildOAMFrame(tr.t.mac, oamTrace, body))
+	for _, peer := range tr.t.peers {
+		tr.t.sendTo(peer, packet, -1)
+	}
+	tr.marked.Add(1)
+	logf("[TRACE]", "%s#%d tx %s", s.status.ID, seq, describeFrame(frame))
+	if st := s.Status(); !st.Active && !st.Cancelled {
+		logf("[TRACE]", "%s: done, %d frames marked", st.ID, st.Marked)
+	}
+}
+
+// expect は対向から予告された印を記録する関数（OAMフレームの受信時に呼ぶ）
+func (tr *tracer) expect(peer *Peer, body []byte) {
+	if len(body) < traceMarkerLen {
+		return
+	}
+	var pd tracePending
+	copy(pd.id[:], body[0:4])
+	pd.seq = binary.BigEndian.Uint32(body[4:8])
+	fp := binary.BigEndian.Uint64(body[8:16])
+	pd.length = int(binary.BigEndian.Uint16(body[16:18]))
+	now := time.Now().UnixNano()
+	pd.expires = now + int64(tracePendingTTL)
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.purgeLocked(now)
+	if len(tr.pending) >= tracePendingMax {
+		return
+	}
+	tr.pending[fp] = pd
+	tr.waiting.Store(int32(len(tr.pending)))
+	logf("[TRACE]", "%x#%d announced by %s", pd.id, pd.seq, peer.Host)
+}
+
+// purgeLocked は期限までに受信しなかった印を削除する関数（tr.muを保持して呼ぶ）
+func (tr *tracer) purgeLocked(now int64) {
+	for k, old := range tr.pending {
+		if old.expires <= now {
+			delete(tr.pending, k)
+			tr.expired.Add(1)
+			logf("[TRACE]", "%x#%d not received within %v", old.id, old.seq, tracePendingTTL)
+		}
+	}
+	tr.waiting.Store(int32(len(tr.pending)))
+}
+
+// received は受信したフレームが予告された印に一致すればログ出力し、追跡用の名前を返す関数（一致しなければ空）
+//
+// 受信ワーカーがフィルタチェーンの適用前に呼ぶ。
+func (tr *tracer) received(peer *Peer, frame []byte) string {
+	if tr.waiting.Load() == 0 {
+		return ""
+	}
+	fp := frameFingerprint(frame)
+	tr.mu.Lock()
+	pd, ok := tr.pending[fp]
+	if ok && pd.length == len(frame) {
+		delete(tr.pending, fp)
+	}
+	tr.purgeLocked(time.Now().UnixNano())
+	tr.mu.Unlock()
+	if !ok || pd.length != len(frame) {
+		return ""
+	}
+	tr.matched.Add(1)
+	name := fmt.Sprintf("%x#%d", pd.id, pd.seq)
+	logf("[TRACE]", "%s rx from %s %s", name, peer.Host, describeFrame(frame))
+	return name
+}
+
+// Counters は印を付けた・受信した・受信しなかったフレーム数を返す
+func (tr *tracer) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"trace_marked":  tr.marked.Load(),
+		"trace_matched": tr.matched.Load(),
+		"trace_expired": tr.expired.Load(),
+	}
+}
+
+// runTrace は"trace"サブコマンドを実行し、動作中のデーモンにトレースを開始・確認・中止させる関数
+func runTrace(args []string) int {
+	fs := flag.NewFlagSet("trace", flag.ExitOnError)
+	path := fs.String("c", "config.yaml", "設定ファイルのパス（api_listen・api_tokensを読む）")
+	addr := fs.String("api", "", "制御APIのアドレス（空で設定ファイルのapi_listen）")
+	token := fs.String("token", os.Getenv("ETHERIP_API_TOKEN"), "制御APIのトークン（空で設定ファイルのapi_tokens）")
+	tap := fs.String("tap", "", "トレースするトンネル（トンネルが1本なら省略可）")
+	count := fs.Int("count", traceDefaultCount, "印を付けるフレーム数")
+	filter := fs.String("filter", "", "印を付けるフレームのフィルタ（キャプチャと同じ式、空で全フレーム）")
+	show := fs.Bool("show", false, "開始せず、直近のトレースの状態を表示する")
+	cancel := fs.Bool("cancel", false, "実行中のトレースを中止する")
+	fs.Parse(args)
+
+	fail := func(format string, a ...interface{}) int {
+		fmt.Fprintf(os.Stderr, "ERROR: "+format+"\n", a...)
+		return 1
+	}
+	if err := resolveAPI(*path, addr, token); err != nil {
+		return fail("%v", err)
+	}
+	client, base := apiClient(*addr)
+	endpoint := "/trace"
+	if *tap != "" {
+		endpoint = "/tunnels/" + *tap + "/trace"
+	}
+
+	var st TraceStatus
+	var err error
+	switch {
+	case *cancel:
+		err = apiDo(client, http.MethodDelete, base, *token, endpoint, &st)
+	case *show:
+		err = apiGet(client, base, *token, endpoint, &st)
+	default:
+		q := url.Values{"count": {strconv.Itoa(*count)}}
+		if *filter != "" {
+			q.Set("filter", *filter)
+		}
+		err = apiDo(client, http.MethodPost, base, *token, endpoint+"?"+q.Encode(), &st)
+	}
+	if err != nil {
+		return fail("%v", err)
+	}
+
+	state := "done"
+	switch {
+	case st.Active:
+		state = "running"
+	case st.Cancelled:
+		state = "cancelled"
+	}
+	fmt.Printf("trace %s %s: %d/%d frames marked", st.ID, state, st.Marked, st.Count)
+	if st.Filter != "" {
+		fmt.Printf(" (filter %q)", st.Filter)
+	}
+	fmt.Println()
+	if st.Active {
+		fmt.Printf("Follow \"[TRACE] %s#\" in the logs of both ends\n", st.ID)
+	}
+	return 0
+}
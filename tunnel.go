@@ -0,0 +1,444 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/songgao/water"
+)
+
+// Tunnelは1本のEtherIPトンネルの実行時状態を保持する
+type Tunnel struct {
+	cfg       *Config
+	ifce      *water.Interface
+	mac       net.HardwareAddr // TAPインターフェースのMACアドレス
+	socks     []*Socket        // アドレスファミリごとのRAWソケット（先頭が優先ファミリ）
+	peers     []*Peer          // 対向ピア一覧
+	fdb       *fdb             // マルチポイント時のMAC学習テーブル（ピアが1台ならnil）
+	hostRoute *hostRouter      // ピアの宛先へのホスト経路（無効時はnil）
+	pmtud     *pmtud           // Path MTU探索（無効時はnil）
+	oversize  *oversizeHandler // 経路MTUを超えるパケットの扱い（kernel時はnil）
+	reasm     *reassembler     // 対向が分割したパケットの再構成（oversize.action: split以外ではnil）
+	canary    *canaryChecker   // カナリアフレームによる完全性検査（無効時はnil）
+	silence   *silenceWatcher  // ピアの無受信時の対処（無効時はnil）
+	srcSelect *srcSelector     // 宛先ごとの送信元の自動選択（src_auto無効時はnil）
+	local     *localDelivery   // 自身のMAC宛てフレームの管理用TAPへの折り返し（無効時はnil）
+	trace     *tracer          // 指定したフレームの両端のログでの追跡
+	rxCheck   *rxValidator     // TAPへ書き込む前の受信フレームの検証
+	tunMode   *tunFilter       // ifmode: tun時のIP以外のフレームの破棄（TAP時はnil）
+	macLimit  *macLimiter      // 送信元MACごとのフレームレート制限（無効時はnil）
+	stpCost   *stpCoster       // ブリッジポートのコスト調整（無効時はnil）
+	evpn      *evpnSpeaker     // BGP EVPNによるMAC広告・学習（無効時はnil）
+	fdbSync   *fdbSyncer       // ブリッジFDBの対向との同期（無効時はnil）
+	routes    *routeWatcher    // 経路の取り消しによるフェイルオーバー（無効時はnil）
+	recursion *recursionGuard  // 宛先への再帰経路の検出（無効時はnil）
+	negotiate *negotiator      // 対向との能力の照合（negotiate: off時はnil）
+	iperf     *iperfResponder  // オーバーレイ上のiperf3応答機能（無効時はnil）
+	comp      *compressor      // ペイロード圧縮（無効時はnil）
+	auth      *authenticator   // ペイロード認証（無効時はnil）
+	seq       *sequencer       // シーケンス番号の付与・照合（無効時はnil）
+	qos       *qosMarker       // 外側ヘッダのDSCP・フローラベル（無効時はnil）
+	header    *headerChecker   // 受信ヘッダの検証
+	loopGuard *loopGuard       // デーモン間中継のホップ数制限（無効時はnil）
+
+	telemetry *telemetry        // EtherType別カウンタ・フローテーブル（無効時はnil）
+	csum      *checksumVerifier // 受信した内側パケットのチェックサムの検証（無効時はnil）
+	offload   *offloader        // eBPFによるカーネル内転送（無効時はnil）
+	firewall  *firewallManager  // nftablesルールの管理（無効時はnil）
+	capture   *capturer         // 制御APIから開始するパケットキャプチャ（無効時はnil）
+	stats     *statsCollector   // 転送統計の定期集計（無効時はnil）
+	vlanStats *vlanStats        // VLAN IDごとの転送統計（無効時はnil）
+	events    *eventSink        // ライフサイクルイベントの送信先
+
+	// 同一プロセス内に他のトンネルがある場合は、未知の送信元を単一ピアとみなさない
+	strictPeers bool
+	isolation   *domainIsolation // 他のトンネルのピアからのパケットの破棄（単一トンネルならnil）
+	allow       *peerAllowlist   // 宛先以外に受け入れる送信元（未設定ならnil）
+
+	linkSpeed int // link_speedで設定したTAPの速度（Mb/s、0で未設定）
+
+	roaming bool          // 認証済みパケットの送信元アドレスへ宛先を追従させる
+	roamed  atomic.Uint64 // 宛先を追従させた回数
+
+	hopDropped atomic.Uint64 // outer_hop_limit.rx_min未満で届いたため破棄した外側パケット数
+
+	filters []FrameFilter // データパス上で適用するフィルタチェーン
+
+	workers   workerSizing      // ワーカー数・キュー長・CPU固定
+	buffers   bufferSizing      // バッファの大きさ・確保数・キューが満杯のときの動作
+	txBufs    *bufferPool       // TAPから読み取るバッファ
+	rxBufs    *bufferPool       // RAWソケット・受信リングから読み取るバッファ
+	plainBufs *bufferPool       // 圧縮フレームの展開先（max_outstandingで待つと受信ワーカーが詰まるため上限なし）
+	ring      *packetRing       // af_packet時の外側パケットの受信リング（標準時はnil）
+	sendChan  chan Packet       // 送信キュー（TAP → ワーカー）
+	pacer     *readPacer        // 送信キューの混雑時にTAPの読み取りを止める（queue_full: pace以外はnil）
+	recvChans []chan Packet     // 受信キュー（RAWソケット → ワーカー、フロー順序保証時はワーカーごと）
+	dropped   [2]atomic.Uint64  // フィルタチェーンで破棄したフレーム数（方向別）
+	traffic   [2]trafficCounter // 転送したフレーム数・バイト数・エラー数（方向別）
+
+	keepaliveInterval time.Duration // キープアライブ送信間隔（無効時は0）
+	keepaliveMax      time.Duration // 通信中に緩めるキープアライブ送信間隔の上限（適応制御の無効時は0）
+	kaSuppressed      atomic.Uint64 // 受信中のため送信を省略したキープアライブの数
+}
+
+// newTunnel はTAPとソケット・ピア一覧からTunnelを生成する関数
+func newTunnel(cfg *Config, ifce *water.Interface, socks []*Socket, peers []*Peer, workers workerSizing, buffers bufferSizing) *Tunnel {
+	strict, _ := newHeaderChecker("strict", false, false, false) // 拡張を解釈しないstrict（設定に従った検証器は起動時に差し替える）
+	t := &Tunnel{
+		cfg:       cfg,
+		ifce:      ifce,
+		socks:     socks,
+		peers:     peers,
+		header:    strict,
+		rxCheck:   &rxValidator{},
+		workers:   workers,
+		buffers:   buffers,
+		txBufs:    newBufferPool(DirTX, buffers),
+		rxBufs:    newBufferPool(DirRX, buffers),
+		plainBufs: newBufferPool(DirRX, bufferSizing{size: buffers.size}),
+		sendChan:  make(chan Packet, workers.sendQueue),
+	}
+	t.trace = newTracer(t)
+	if buffers.paceReads {
+		t.pacer = newReadPacer(func() int { return len(t.sendChan) }, workers.sendQueue, buffers.paceThreshold)
+	}
+	if cfg.IfMode == ifModeTUN {
+		t.tunMode = &tunFilter{}
+		t.filters = append(t.filters, t.tunMode)
+	}
+	if workers.flowOrder {
+		size := max(1, (workers.recvQueue+workers.recvWorkers-1)/workers.recvWorkers)
+		for i := 0; i < workers.recvWorkers; i++ {
+			t.recvChans = append(t.recvChans, make(chan Packet, size))
+		}
+	} else {
+		t.recvChans = []chan Packet{make(chan Packet, workers.recvQueue)}
+	}
+	if iface, err := net.InterfaceByName(cfg.TapName); err == nil {
+		t.mac = iface.HardwareAddr
+	}
+	return t
+}
+
+// forward はフレームを宛先MACに応じたピア（不明なら全ピア）へ送る関数
+func (t *Tunnel) forward(frame []byte) {
+	t.traffic[DirTX].add(len(frame))
+	var packet []byte
+	if t.comp != nil {
+		packet = t.comp.encode(frame)
+	} else {
+		packet = buildEtherIPPacket(frame)
+	}
+	dscp := t.qos.classify(frame)
+	send := func(peer *Peer) {
+		if t.negotiate.blocks(peer, DirTX) {
+			return
+		}
+		if t.oversize != nil {
+			if done, err := t.oversize.intercept(peer, frame, packet, dscp); done {
+				if err == nil {
+					peer.traffic[DirTX].add(len(frame))
+				}
+				return
+			}
+		}
+		if t.sendTo(peer, packet, dscp) == nil {
+			peer.traffic[DirTX].add(len(frame))
+		}
+	}
+	if t.fdb == nil {
+		send(t.peers[0])
+		return
+	}
+	if t.evpn != nil {
+		t.evpn.noteLocal(frame)
+	}
+
+	if peer := t.fdb.lookup(frame); peer != nil {
+		send(peer)
+		return
+	}
+	for _, peer := range t.peers {
+		send(peer)
+	}
+}
+
+// sendTo は現在の送信経路でピアへパケットを送り、送信エラーを各サブシステムへ通知する関数（dscpが負ならソケットの既定値）
+//
+// packetはsealする前のEtherIPパケットで、送信経路のシーケンス番号・認証トレーラを付けて送る。
+func (t *Tunnel) sendTo(peer *Peer, packet []byte, dscp int) error {
+	p := peer.active.Load()
+	packet = t.seal(p, packet)
+	err := p.write(packet, t.qos.oob(p.Version, dscp))
+	if err == nil {
+		t.capture.outer(DirTX, p.SrcIP.Load().(net.IP), p.Dst.Load().(net.IP), packet)
+	}
+	switch {
+	case err == errRecursiveRoute:
+		t.recursion.dropped.Add(1)
+	case err == errClusterStandby:
+		cluster.dropped.Add(1)
+	case err != nil:
+		t.traffic[DirTX].errors.Add(1)
+		peer.traffic[DirTX].errors.Add(1)
+		if t.pmtud != nil {
+			t.pmtud.noteSendError(err)
+		}
+		t.oversize.noteSendError(err)
+		t.pacer.noteSendError(err)
+	}
+	return err
+}
+
+// Run はTAPとRAWソケット間の転送goroutineを起動し、終了まで待機する
+func (t *Tunnel) Run() {
+	// 送信/受信用チャネル
+	sendChan := t.sendChan
+
+	// TAPから読み取り、送信チャネルへ送る
+	go func() {
+		for {
+			t.pacer.wait()
+			buf := t.txBufs.get()
+			n, err := t.readFrame(buf)
+			if errors.Is(err, os.ErrClosed) {
+				t.txBufs.put(buf)
+				return // 終了・引き継ぎの後片付けでTAPを閉じた
+			}
+			if err != nil || n == 0 {
+				if err != nil {
+					logf("[ERROR]", "TAP read: %v", err)
+				}
+				t.txBufs.put(buf)
+				continue
+			}
+			t.enqueue(sendChan, Packet{Data: buf, Offset: 0, Length: n, Pool: t.txBufs})
+		}
+	}()
+
+	// 管理用TAPから読み取り、同じ送信チャネルへ送る
+	if t.local != nil {
+		go t.local.run(t)
+	}
+
+	// アドレスファミリごとにRAWソケットから受信チャネルへ送る（af_packet時は受信リングから）
+	if t.ring != nil {
+		go t.ring.run()
+	} else {
+		for _, s := range t.socks {
+			go func(s *Socket) {
+				oob := make([]byte, 64)
+				for {
+					buf := t.rxBufs.get()
+					n, from, hops, err := s.read(buf, oob)
+					if errors.Is(err, net.ErrClosed) {
+						t.rxBufs.put(buf)
+						return // 終了・引き継ぎの後片付けでソケットを閉じた
+					}
+					if err != nil || n == 0 {
+						t.rxBufs.put(buf)
+						continue
+					}
+					t.receive(s, buf, n, from, hops)
+				}
+			}(s)
+		}
+	}
+
+	// 送信処理ワーカーgoroutine
+	var wg sync.WaitGroup
+	for i := 0; i < t.workers.sendWorkers; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			t.workers.pin(t.cfg.TapName, n)
+			for pkt := range sendChan {
+				vid := t.vlanStats.vid(pkt.Data[:pkt.Length])
+				frame, ok := t.process(DirTX, pkt.Data[:pkt.Length])
+				if ok {
+					t.vlanStats.add(DirTX, vid, len(frame))
+					hexdumpFrame(t.cfg.TapName, DirTX, frame)
+					t.trace.mark(frame)
+					t.forward(frame)
+				} else {
+					t.vlanStats.drop(DirTX, vid)
+				}
+				pkt.Pool.put(pkt.Data)
+			}
+		}(i)
+	}
+
+	// 受信処理ワーカーgoroutine
+	for i := 0; i < t.workers.recvWorkers; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			t.workers.pin(t.cfg.TapName, t.workers.sendWorkers+n)
+			for pkt := range t.recvChans[n%len(t.recvChans)] {
+				frame := pkt.Data[pkt.Offset : pkt.Offset+pkt.Length]
+				var plain []byte
+				if pkt.Comp != 0 {
+					plain = t.plainBufs.get()
+					var err error
+					if frame, err = t.comp.decode(pkt.Comp, frame, plain); err != nil {
+						debugf(debugDatapath, "drop from %s: decompression failed: %v", pkt.Peer.Host, err)
+						t.plainBufs.put(plain)
+						pkt.Pool.put(pkt.Data)
+						continue
+					}
+				}
+
+				traced := t.trace.received(pkt.Peer, frame)
+				t.csum.check(pkt.Peer, frame)
+				vid := t.vlanStats.vid(frame)
+				var desc string // 破棄理由のDEBUGログ用（フィルタは破棄したフレームを返さない）
+				if debugEnabled(debugDatapath) {
+					desc = describeFrame(frame)
+				}
+				frame, ok := t.process(DirRX, frame)
+				if ok && !t.rxCheck.valid(frame) {
+					t.dropped[DirRX].Add(1)
+					ok = false
+				}
+				if traced != "" {
+					if ok {
+						logf("[TRACE]", "%s delivered to %s", traced, t.cfg.TapName)
+					} else {
+						logf("[TRACE]", "%s dropped by filters or validation", traced)
+					}
+				}
+				if ok {
+					if t.fdb != nil {
+						t.fdb.learn(frame, pkt.Peer)
+					}
+					delivered := t.local != nil && t.local.deliver(frame)
+					if !delivered {
+						if _, err := t.writeFrame(frame); err != nil {
+							t.traffic[DirRX].errors.Add(1)
+							pkt.Peer.traffic[DirRX].errors.Add(1)
+						} else {
+							delivered = true
+						}
+					}
+					if delivered {
+						hexdumpFrame(t.cfg.TapName, DirRX, frame)
+						t.traffic[DirRX].add(len(frame))
+						pkt.Peer.traffic[DirRX].add(len(frame))
+						// 受信時は書き換え（vlan.map）後のローカルVIDで数える
+						t.vlanStats.add(DirRX, t.vlanStats.vid(frame), len(frame))
+					}
+				} else {
+					debugf(debugDatapath, "drop from %s: %s rejected by filters or validation", pkt.Peer.Host, desc)
+					pkt.Peer.dropped.Add(1)
+					t.vlanStats.drop(DirRX, vid)
+				}
+				if plain != nil {
+					t.plainBufs.put(plain)
+				}
+				pkt.Pool.put(pkt.Data)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+// receive は受信した外側パケット（EtherIPヘッダ以降）を検証し、受信キューへ渡す関数
+//
+// bufの所有権を受け取り、破棄・処理した場合はプールへ返す。hopsは外側パケットのTTL・ホップリミット（不明なら-1）。
+func (t *Tunnel) receive(s *Socket, buf []byte, n int, from net.Addr, hops int) {
+	// 経路上のルータを経由して届いたパケット（送信元を偽装した遠方からの注入を含む）は破棄
+	if hops >= 0 && hops < t.cfg.OuterHopLimit.RXMin {
+		t.hopDropped.Add(1)
+		debugf(debugDatapath, "drop from %s: hop limit %d < %d", from, hops, t.cfg.OuterHopLimit.RXMin)
+		t.rxBufs.put(buf)
+		return
+	}
+
+	// GRE・L2TPv3のヘッダはEtherIPヘッダに付け替えてから検証する
+	n, ok := s.Encap.unwrap(buf, n)
+	if !ok {
+		debugf(debugDatapath, "drop from %s: invalid encapsulation header", from)
+		t.rxBufs.put(buf)
+		return
+	}
+	alg, ok := t.header.Check(buf[:n])
+	if !ok {
+		debugf(debugDatapath, "drop from %s: invalid EtherIP header % x", from, buf[:min(n, etherIPHeaderLen)])
+		t.rxBufs.put(buf)
+		return
+	}
+
+	// 未知の送信元からのパケットは破棄
+	peer, p := t.lookupPeer(from, s.Version)
+	if peer == nil {
+		debugf(debugDatapath, "drop from %s: unknown source", from)
+		t.rxBufs.put(buf)
+		return
+	}
+	t.capture.outer(DirRX, p.Dst.Load().(net.IP), p.SrcIP.Load().(net.IP), buf[:n])
+	if t.auth != nil {
+		if n, ok = t.auth.open(p, buf[:n]); !ok {
+			debugf(debugDatapath, "drop from %s: authentication failed", from)
+			t.rxBufs.put(buf)
+			return
+		}
+	}
+	if t.seq != nil {
+		if n, ok = t.seq.open(p, buf[:n]); !ok {
+			debugf(debugDatapath, "drop from %s: sequence number rejected", from)
+			t.rxBufs.put(buf)
+			return
+		}
+	}
+
+	// 対向が経路MTUに合わせて分割したパケットは全ての断片が揃ってから処理する
+	if t.reasm != nil && isFragment(buf[:n]) {
+		whole := t.reasm.add(peer, buf[:n])
+		if whole == nil {
+			t.rxBufs.put(buf)
+			return
+		}
+		n = copy(buf, whole)
+	}
+
+	// 認証とシーケンス番号の照合を通ったパケットの送信元が変わっていれば宛先を追従させる
+	if t.roaming {
+		if addr, ok := from.(*net.IPAddr); ok && !addr.IP.Equal(p.Dst.Load().(net.IP)) {
+			t.roam(peer, p, addr.IP)
+		}
+	}
+
+	// 無受信の監視・キープアライブの適応制御のために受信時刻を記録する
+	if t.silence != nil || t.keepaliveMax > 0 {
+		now := time.Now().UnixNano()
+		peer.lastHeard.Store(now)
+		if alg != 0 || !isOAMFrame(buf[2:n]) {
+			p.lastData.Store(now)
+		}
+	}
+
+	// 能力が一致しないピアのフレームはTAPへ渡さない（OAMは処理してハンドシェイクを続ける）
+	if (alg != 0 || !isOAMFrame(buf[2:n])) && t.negotiate.blocks(peer, DirRX) {
+		t.rxBufs.put(buf)
+		return
+	}
+
+	// 圧縮フレームはワーカーで展開する
+	if alg != 0 {
+		t.enqueue(t.recvQueue(peer, nil, true), Packet{Data: buf, Offset: 2, Length: n - 2, Pool: t.rxBufs, Peer: peer, Comp: alg})
+		return
+	}
+
+	// OAMフレームはTAPへ渡さずデーモン内で処理する
+	if isOAMFrame(buf[2:n]) {
+		t.handleOAM(peer, p, from, buf[2:n])
+		t.rxBufs.put(buf)
+		return
+	}
+	t.enqueue(t.recvQueue(peer, buf[2:n], false), Packet{Data: buf, Offset: 2, Length: n - 2, Pool: t.rxBufs, Peer: peer})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+)
+
+// アンダーレイ（src_iface）の種類
+const (
+	underlayAuto      = "auto"      // src_ifaceの種類から判定する
+	underlayPlain     = "plain"     // 暗号化のない通常のインターフェース
+	underlayWireGuard = "wireguard" // WireGuardのインターフェース（wg0 等）
+	underlayIPsec     = "ipsec"     // ルートベースIPsecのインターフェース（xfrm, vti, vti6）
+)
+
+// スタックしたトンネルのヘッダ予算
+//
+// 外側パケット（IPヘッダ + EtherIPヘッダ + 内側Ethernetヘッダ + 内側ペイロード）はさらにアンダーレイのトンネルで包まれる。
+// TAPのMTUは「src_ifaceのMTU - アンダーレイの追加分 - 外側IPヘッダ - EtherIP(2) - 内側Ethernet(14) - auth・sequence・encapの追加分」以下でないと、
+// 外側パケットが断片化されるか、DFを立てている場合は捨てられる。
+const (
+	// WireGuard: 外側IP + UDP(8) + 種別・受信者インデックス・カウンタ(16) + Poly1305タグ(16)
+	// wgインターフェースのMTU（既定1420 = 1500 - IPv6 40 - 40）は差し引き済みのため追加の控除は不要
+	wireGuardOverhead = 8 + 16 + 16
+	// ESP（トンネルモード、AES-GCM、NAT-T）の最悪値: 外側IPv6(40) + UDP(8) + SPI・シーケンス番号(8) + IV(8)
+	// + パディング(3) + Pad Length・Next Header(2) + ICV(16)
+	// xfrm・vtiインターフェースのMTUはESPを差し引かないため、インターフェースのMTUからさらに控除する
+	espOverhead = 40 + 8 + 8 + 8 + 3 + 2 + 16
+)
+
+// parseUnderlay はunderlayの設定値を検証し、autoならsrc_ifaceから判定した種類を返す関数
+func parseUnderlay(cfg *Config) (string, error) {
+	switch cfg.Underlay {
+	case "", underlayAuto:
+		if cfg.SrcIface == "" {
+			return underlayPlain, nil
+		}
+		return detectUnderlay(cfg.SrcIface), nil
+	case underlayPlain, underlayWireGuard, underlayIPsec:
+		return cfg.Underlay, nil
+	}
+	return "", fmt.Errorf("unknown underlay %q (auto, plain, wireguard, ipsec)", cfg.Underlay)
+}
+
+// detectUnderlay はインターフェースの種類（ip -d link のinfo_kind）からアンダーレイの種類を判定する関数
+//
+// ポリシーベースIPsec（インターフェースを作らない構成）は判定できないため、underlay: ipsec を指定する。
+func detectUnderlay(ifname string) string {
+	out, err := exec.Command("ip", "-j", "-d", "link", "show", "dev", ifname).Output()
+	if err != nil {
+		return underlayPlain
+	}
+	var links []struct {
+		LinkInfo struct {
+			Kind string `json:"info_kind"`
+		} `json:"linkinfo"`
+	}
+	if json.Unmarshal(out, &links) != nil || len(links) == 0 {
+		return underlayPlain
+	}
+	switch links[0].LinkInfo.Kind {
+	case "wireguard":
+		return underlayWireGuard
+	case "xfrm", "vti", "vti6":
+		return underlayIPsec
+	}
+	return underlayPlain
+}
+
+// underlayOverhead はsrc_ifaceのMTUからさらに差し引くアンダーレイの追加分を返す関数
+func underlayOverhead(kind string) int {
+	if kind == underlayIPsec {
+		return espOverhead
+	}
+	return 0
+}
+
+// configSealOverhead はauth・sequence・encapの設定によって増える外側パケットのバイト数を返す関数
+func configSealOverhead(cfg *Config) int {
+	n := 0
+	if cfg.Auth.Enabled {
+		n += authTrailerLen
+	}
+	if cfg.Sequence.Enabled {
+		n += seqHeaderLen
+	}
+	if e, err := newEncapsulation(cfg); err == nil {
+		n += e.overhead()
+	}
+	return n
+}
+
+// underlayMTU はアンダーレイのMTUに収まるTAPのMTUの上限を返す関数（dual_stack時は大きい方の外側IPヘッダで計算）
+func underlayMTU(cfg *Config, kind string, ifaceMTU int) int {
+	ipHdr := ipHeaderLen(cfg.Version)
+	if cfg.DualStack {
+		ipHdr = ipHeaderLen(6)
+	}
+	return ifaceMTU - underlayOverhead(kind) - ipHdr - etherIPOverhead - configSealOverhead(cfg)
+}
+
+// applyUnderlay はsrc_ifaceがWireGuard・IPsecのインターフェースなら、TAPのMTUをヘッダ予算に収まるよう下げる関数
+//
+// 暗号化されたトンネルの上にEtherIPを重ねるとMTUの計算を誤りやすく、外側パケットの断片化・破棄の原因になるため、
+// 通常のインターフェースでは設定どおりとし、アンダーレイがトンネルの場合だけ自動で調整する。
+func applyUnderlay(cfg *Config) (string, error) {
+	kind, err := parseUnderlay(cfg)
+	if err != nil || kind == underlayPlain {
+		return kind, err
+	}
+	if cfg.SrcIface == "" {
+		return kind, fmt.Errorf("underlay %s requires src_iface", kind)
+	}
+	ifi, err := net.InterfaceByName(cfg.SrcIface)
+	if err != nil {
+		return kind, fmt.Errorf("src_iface %s: %w", cfg.SrcIface, err)
+	}
+	limit := underlayMTU(cfg, kind, ifi.MTU)
+	if limit < 68 {
+		return kind, fmt.Errorf("src_iface %s MTU %d leaves no room for the tunnel over %s", cfg.SrcIface, ifi.MTU, kind)
+	}
+	logf("[INFO]", "Underlay %s on %s (MTU %d, extra overhead %d); TAP MTU budget is %d", kind, cfg.SrcIface, ifi.MTU, underlayOverhead(kind), limit)
+	if cfg.MTU > limit {
+		logf("[WARN]", "mtu %d does not fit the %s underlay on %s; lowering TAP MTU to %d", cfg.MTU, kind, cfg.SrcIface, limit)
+		cfg.MTU = limit
+	}
+	return kind, nil
+}
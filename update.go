@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// 自己更新関連の定数定義
+const (
+	updateMaxBinary     = 256 << 20        // ダウンロードするバイナリの上限
+	updateMaxManifest   = 4096             // マニフェストの上限
+	updateMaxSignature  = 1024             // 署名ファイルの上限
+	updateTimeout       = 5 * time.Minute  // ダウンロードのタイムアウト
+	updateProbeTimeout  = 10 * time.Second // 新しいバイナリの起動確認のタイムアウト
+	updateMinInterval   = 10 * time.Minute // intervalの下限
+	updateManifestExt   = ".json"          // バイナリのURLに付けるとマニフェスト、さらに.sigを付けると署名
+	updateSignatureExt  = ".sig"
+	updateUnchangedNote = "already up to date"
+)
+
+// UpdateConfigは署名付きリリースによる自己更新の設定を保持する（トップレベルのみ）
+type UpdateConfig struct {
+	URL       string `yaml:"url"`        // リリースのバイナリのURL（{os}・{arch}を置換、https://のみ。マニフェストは.json、その署名は.json.sigを付けたもの）
+	PublicKey string `yaml:"public_key"` // 署名を検証するEd25519公開鍵（base64）
+	Interval  string `yaml:"interval"`   // デーモンが更新を確認する間隔（空で確認しない、updateサブコマンドのみ）
+}
+
+// updateManifestはリリースの署名対象（バイナリ自体ではなく、バージョン・プラットフォーム・ハッシュに署名する）
+type updateManifest struct {
+	Version string `json:"version"` // セマンティックバージョン（例: v1.2.3）
+	OS      string `json:"os"`
+	Arch    string `json:"arch"`
+	SHA256  string `json:"sha256"` // バイナリのSHA-256（16進）
+}
+
+// errUpToDate は配布中のリリースが実行中のバイナリより新しくないことを表す
+var errUpToDate = errors.New(updateUnchangedNote)
+
+// parseUpdateConfig は自己更新の設定を検証する関数（URLが空なら無効でnilの鍵を返す）
+func parseUpdateConfig(cfg UpdateConfig) (ed25519.PublicKey, time.Duration, error) {
+	if cfg.URL == "" {
+		if cfg.Interval != "" || cfg.PublicKey != "" {
+			return nil, 0, fmt.Errorf("url is required")
+		}
+		return nil, 0, nil
+	}
+	if !strings.HasPrefix(cfg.URL, "https://") {
+		return nil, 0, fmt.Errorf("url must be https://")
+	}
+	key, err := base64.StdEncoding.DecodeString(cfg.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, 0, fmt.Errorf("public_key must be a base64 Ed25519 public key (%d bytes)", ed25519.PublicKeySize)
+	}
+	var interval time.Duration
+	if cfg.Interval != "" {
+		if interval, err = time.ParseDuration(cfg.Interval); err != nil {
+			return nil, 0, fmt.Errorf("interval: %w", err)
+		}
+		if interval < updateMinInterval {
+			return nil, 0, fmt.Errorf("interval %v must be at least %v", interval, updateMinInterval)
+		}
+	}
+	return ed25519.PublicKey(key), interval, nil
+}
+
+// checkUnattendedUpdate はデーモン自身による定期的な更新とrun_as_userの併用を拒否する関数
+//
+// 権限を落としたデーモンは実行ファイルを置き換えられず、再起動してもTAP・ソケットを作り直せないため、
+// etherip update をrootで実行してサービスマネージャから再起動する。
+func checkUnattendedUpdate(cfg *Config) error {
+	if cfg.Update.Interval != "" && cfg.RunAsUser != "" {
+		return fmt.Errorf("interval cannot be used with run_as_user %s; run etherip update as root and restart the daemon from the service manager", cfg.RunAsUser)
+	}
+	return nil
+}
+
+// updateURL はURLの{os}・{arch}を実行中のプラットフォームに置き換える関数
+func updateURL(cfg UpdateConfig) string {
+	return strings.NewReplacer("{os}", runtime.GOOS, "{arch}", runtime.GOARCH).Replace(cfg.URL)
+}
+
+// fetchLimited はURLの内容を上限付きで読み込む関数
+func fetchLimited(ctx context.Context, url string, limit int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "etherip/"+daemonVersion())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("GET %s: larger than %d bytes", url, limit)
+	}
+	return data, nil
+}
+
+// decodeSignature は署名ファイル（64バイトの生の署名、またはそのbase64）を読む関数
+func decodeSignature(data []byte) ([]byte, error) {
+	if len(data) == ed25519.SignatureSize {
+		return data, nil
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("signature must be %d bytes (raw or base64)", ed25519.SignatureSize)
+	}
+	return sig, nil
+}
+
+// parseSemver はv1.2.3[-pre][+build]の形式のバージョンを数値部とプレリリース部に分ける関数
+func parseSemver(v string) ([3]uint64, []string, bool) {
+	var core [3]uint64
+	v, ok := strings.CutPrefix(v, "v")
+	if !ok {
+		return core, nil, false
+	}
+	v, _, _ = strings.Cut(v, "+")
+	v, pre, hasPre := strings.Cut(v, "-")
+	parts := strings.Split(v, ".")
+	if len(parts) != 3 {
+		return core, nil, false
+	}
+	for i, p := range parts {
+		n, err := strconv.ParseUint(p, 10, 64)
+		if err != nil {
+			return core, nil, false
+		}
+		core[i] = n
+	}
+	if !hasPre {
+		return core, nil, true
+	}
+	if pre == "" {
+		return core, nil, false
+	}
+	return core, strings.Split(pre, "."), true
+}
+
+// compareVersions はセマンティックバージョンを比べる関数（a<bで負、a>bで正、どちらかが不正ならokはfalse）
+//
+// プレリリース（-rc.1等、Goの疑似バージョンを含む）は同じ数値部のリリースより古い。
+func compareVersions(a, b string) (int, bool) {
+	ca, pa, okA := parseSemver(a)
+	cb, pb, okB := parseSemver(b)
+	if !okA || !okB {
+		return 0, false
+	}
+	for i := range ca {
+		if ca[i] != cb[i] {
+			if ca[i] < cb[i] {
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	switch {
+	case len(pa) == 0 && len(pb) == 0:
+		return 0, true
+	case len(pa) == 0:
+		return 1, true
+	case len(pb) == 0:
+		return -1, true
+	}
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		na, errA := strconv.ParseUint(pa[i], 10, 64)
+		nb, errB := strconv.ParseUint(pb[i], 10, 64)
+		switch {
+		case errA == nil && errB == nil && na != nb:
+			if na < nb {
+				return -1, true
+			}
+			return 1, true
+		case errA == nil && errB != nil:
+			return -1, true // 数値の識別子は英数字より前
+		case errA != nil && errB == nil:
+			return 1, true
+		case errA != nil && pa[i] != pb[i]:
+			return strings.Compare(pa[i], pb[i]), true
+		}
+	}
+	return len(pa) - len(pb), true
+}
+
+// checkManifest はマニフェストが実行中のプラットフォーム向けで、実行中のバージョンより新しいかを確かめる関数
+//
+// 実行中のバイナリがリリースでない（devel）場合はバージョンを比べられず、古いリリースへの差し替えを防げないため、
+// ダウングレードを許可（-allow-downgrade）したときだけ置き換える。許可すれば実行中より古いリリースも置き換える。
+func checkManifest(m *updateManifest, current string, allowDowngrade bool) error {
+	if m.OS != runtime.GOOS || m.Arch != runtime.GOARCH {
+		return fmt.Errorf("release is for %s/%s, not %s/%s", m.OS, m.Arch, runtime.GOOS, runtime.GOARCH)
+	}
+	if sum, err := hex.DecodeString(m.SHA256); err != nil || len(sum) != sha256.Size {
+		return fmt.Errorf("manifest sha256 %q is not a SHA-256 hex digest", m.SHA256)
+	}
+	if _, _, ok := parseSemver(m.Version); !ok {
+		return fmt.Errorf("manifest version %q is not a semantic version", m.Version)
+	}
+	cmp, ok := compareVersions(m.Version, current)
+	switch {
+	case !ok && !allowDowngrade:
+		return fmt.Errorf("running version %q is not a release and cannot be compared with %s; refusing to replace it without -allow-downgrade", current, m.Version)
+	case !ok:
+		return nil
+	case cmp == 0:
+		return errUpToDate
+	case cmp < 0 && !allowDowngrade:
+		return fmt.Errorf("release %s is older than the running %s; refusing to downgrade without -allow-downgrade", m.Version, current)
+	}
+	return nil
+}
+
+// fetchUpdate は署名付きのマニフェストを取得し、実行中のバイナリより新しいリリースなら検証済みのバイナリを返す関数
+//
+// 署名はマニフェスト（バージョン・OS・アーキテクチャ・SHA-256）に対して検証するため、
+// 古いリリースや別プラットフォームのバイナリへの差し替えも拒否できる。
+// 新しくなければ（errUpToDate）バイナリはダウンロードしない。
+func fetchUpdate(cfg UpdateConfig, key ed25519.PublicKey, allowDowngrade bool) ([]byte, *updateManifest, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), updateTimeout)
+	defer cancel()
+	url := updateURL(cfg)
+
+	body, err := fetchLimited(ctx, url+updateManifestExt, updateMaxManifest)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := fetchLimited(ctx, url+updateManifestExt+updateSignatureExt, updateMaxSignature)
+	if err != nil {
+		return nil, nil, err
+	}
+	sig, err := decodeSignature(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ed25519.Verify(key, body, sig) {
+		return nil, nil, fmt.Errorf("signature verification failed for %s", url+updateManifestExt)
+	}
+	var m updateManifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, nil, fmt.Errorf("manifest: %w", err)
+	}
+	if err := checkManifest(&m, daemonVersion(), allowDowngrade); err != nil {
+		return nil, nil, err
+	}
+
+	bin, err := fetchLimited(ctx, url, updateMaxBinary)
+	if err != nil {
+		return nil, nil, err
+	}
+	sum := sha256.Sum256(bin)
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), m.SHA256) {
+		return nil, nil, fmt.Errorf("sha256 of %s does not match the signed manifest", url)
+	}
+	return bin, &m, nil
+}
+
+// installUpdate は検証済みのバイナリが起動でき、マニフェストのバージョンを名乗ることを確かめ、実行中のバイナリと置き換える関数
+//
+// 同じディレクトリに書いてからrenameするため、途中で失敗しても元のバイナリは壊れない。
+// 実行中のプロセスは置き換え前のファイルを使い続ける。
+func installUpdate(bin []byte, m *updateManifest) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	fi, err := os.Stat(exe)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(exe), "."+filepath.Base(exe)+".new")
+	if err := os.WriteFile(tmp, bin, fi.Mode().Perm()); err != nil {
+		return fmt.Errorf("cannot write next to %s (run as a user that can replace it): %w", exe, err)
+	}
+	defer os.Remove(tmp)
+
+	// 壊れたリリース・マニフェストと異なるバイナリで起動できなくなるのを防ぐ
+	ctx, cancel := context.WithTimeout(context.Background(), updateProbeTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, tmp, "version", "-json").Output()
+	if err != nil {
+		return fmt.Errorf("new binary does not run: %v", err)
+	}
+	var v VersionOutput
+	if err := json.NewDecoder(bytes.NewReader(out)).Decode(&v); err != nil {
+		return fmt.Errorf("new binary version: %v", err)
+	}
+	if v.Version != m.Version || v.Platform != m.OS+"/"+m.Arch {
+		return fmt.Errorf("new binary reports %s (%s), manifest says %s (%s/%s)", v.Version, v.Platform, m.Version, m.OS, m.Arch)
+	}
+
+	return os.Rename(tmp, exe)
+}
+
+// restartSelf は同じ引数で新しいバイナリを起動してTAP・ソケットを引き継ぎ、新しいプロセスが転送を始めたら終了する関数
+//
+// 新しいプロセスが起動に失敗した時は、そのまま動作を続ける。PIDは新しいプロセスのものに変わり、
+// サービスマネージャへはsd_notifyのMAINPIDで知らせる。引き継ぎに対応しない構成（cluster等）では、
+// 後片付けをしてから同じPIDで実行し直す（その間はフレームを転送しない）。
+func restartSelf(reason string, tunnels []*Tunnel) {
+	exe, err := os.Executable()
+	if err != nil {
+		logf("[ERROR]", "Cannot restart: %v", err)
+		return
+	}
+	logf("[INFO]", "Restarting %s (%s)", exe, reason)
+	pid, err := handOver(exe, tunnels)
+	if err == nil {
+		logf("[INFO]", "Handed over to pid %d; exiting", pid)
+		sdNotify(fmt.Sprintf("MAINPID=%d", pid))
+		runHandoverCleanups()
+		os.Exit(0)
+	}
+	if !errors.Is(err, errHandoverUnsupported) {
+		logf("[ERROR]", "Handover to %s failed; keeping the running process: %v", exe, err)
+		return
+	}
+	logf("[WARN]", "%v; restarting after cleanup", err)
+	runCleanups()
+	err = syscall.Exec(exe, os.Args, os.Environ())
+	logf("[ERROR]", "Restart failed: %v", err)
+	os.Exit(1)
+}
+
+// runUpdateChecks はintervalごとに更新を確認し、更新したら自身を再起動する関数
+func runUpdateChecks(cfg UpdateConfig, key ed25519.PublicKey, interval time.Duration, tunnels []*Tunnel) {
+	logf("[INFO]", "Checking for updates every %v (%s)", interval, updateURL(cfg))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		bin, m, err := fetchUpdate(cfg, key, false)
+		if errors.Is(err, errUpToDate) {
+			continue
+		}
+		if err != nil {
+			logf("[WARN]", "Update check failed: %v", err)
+			continue
+		}
+		if err := installUpdate(bin, m); err != nil {
+			logf("[ERROR]", "Update install failed: %v", err)
+			continue
+		}
+		logf("[UPDATE]", "Installed %s (was %s)", m.Version, daemonVersion())
+		restartSelf("update", tunnels)
+	}
+}
+
+// runUpdate は"update"サブコマンドを実行し、署名付きリリースを検証して置き換え、動作中のデーモンを再起動する関数
+func runUpdate(args []string) int {
+	fs := flag.NewFlagSet("update", flag.ExitOnError)
+	path := fs.String("c", "config.yaml", "設定ファイルのパス（update・pid_fileを読む）")
+	checkOnly := fs.Bool("check", false, "更新の有無だけを表示する（更新があれば終了コード10）")
+	restart := fs.Bool("restart", true, "置き換え後にpid_fileのデーモンへSIGUSR2を送って再起動させる")
+	allowDowngrade := fs.Bool("allow-downgrade", false, "実行中より古いリリース、または実行中のバイナリがリリースでない（devel）場合も置き換える")
+	fs.Parse(args)
+
+	fail := func(format string, a ...interface{}) int {
+		fmt.Fprintf(os.Stderr, "ERROR: "+format+"\n", a...)
+		return 1
+	}
+	cfgs, err := loadConfigs(*path)
+	if err != nil {
+		return fail("%v", err)
+	}
+	cfg := cfgs[0].Update
+	key, _, err := parseUpdateConfig(cfg)
+	if err != nil {
+		return fail("update: %v", err)
+	}
+	if key == nil {
+		return fail("update.url is not set in %s", *path)
+	}
+
+	bin, m, err := fetchUpdate(cfg, key, *allowDowngrade)
+	if errors.Is(err, errUpToDate) {
+		fmt.Printf("etherip %s is %s\n", daemonVersion(), updateUnchangedNote)
+		return 0
+	}
+	if err != nil {
+		return fail("%v", err)
+	}
+	if *checkOnly {
+		fmt.Printf("update available: %s (%d bytes, signature verified)\n", m.Version, len(bin))
+		return 10
+	}
+	if err := installUpdate(bin, m); err != nil {
+		return fail("%v", err)
+	}
+	fmt.Printf("installed %s (was %s)\n", m.Version, daemonVersion())
+
+	if !*restart {
+		return 0
+	}
+	if cfgs[0].RunAsUser != "" {
+		// 権限を落としたデーモンはSIGUSR2で再起動できない
+		fmt.Printf("run_as_user is set; restart the daemon from the service manager to use the new version\n")
+		return 0
+	}
+	pidFile := cfgs[0].PIDFile
+	if pidFile == "" {
+		fmt.Println("pid_file is not set; restart the daemon to use the new version")
+		return 0
+	}
+	owner, held := lockHolder(pidFile)
+	if !held {
+		fmt.Println("daemon is not running")
+		return 0
+	}
+	pid, err := strconv.Atoi(owner)
+	if err != nil {
+		return fail("invalid pid %q in %s", owner, pidFile)
+	}
+	if err := signalRestart(pid); err != nil {
+		return fail("signal pid %d: %v", pid, err)
+	}
+	fmt.Printf("restarting daemon (pid %d)\n", pid)
+	return 0
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestCheckManifest(t *testing.T) {
+	manifest := func(version string) *updateManifest {
+		return &updateManifest{Version: version, OS: runtime.GOOS, Arch: runtime.GOARCH, SHA256: strings.Repeat("ab", 32)}
+	}
+	tests := []struct {
+		name           string
+		m              *updateManifest
+		current        string
+		allowDowngrade bool
+		err            string // 空で成功
+	}{
+		{"newer", manifest("v1.2.4"), "v1.2.3", false, ""},
+		{"newer than prerelease", manifest("v1.2.3"), "v1.2.3-rc.1", false, ""},
+		{"same", manifest("v1.2.3"), "v1.2.3", false, updateUnchangedNote},
+		{"same with allow-downgrade", manifest("v1.2.3"), "v1.2.3", true, updateUnchangedNote},
+		{"older", manifest("v1.2.2"), "v1.2.3", false, "refusing to downgrade"},
+		{"older with allow-downgrade", manifest("v1.2.2"), "v1.2.3", true, ""},
+		{"running devel", manifest("v1.2.3"), "devel", false, "not a release"},
+		{"running devel with allow-downgrade", manifest("v1.2.3"), "devel", true, ""},
+		{"not semver", manifest("latest"), "v1.2.3", true, "not a semantic version"},
+		{"other platform", &updateManifest{Version: "v1.2.4", OS: "plan9", Arch: runtime.GOARCH, SHA256: strings.Repeat("ab", 32)}, "v1.2.3", true, "plan9"},
+		{"bad sha256", &updateManifest{Version: "v1.2.4", OS: runtime.GOOS, Arch: runtime.GOARCH, SHA256: "abcd"}, "v1.2.3", true, "sha256"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkManifest(tt.m, tt.current, tt.allowDowngrade)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("err = %v, want %q", err, tt.err)
+			}
+			if tt.err == updateUnchangedNote && !errors.Is(err, errUpToDate) {
+				t.Errorf("err = %v, want errUpToDate", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+)
+
+// VLANタグ関連の定数定義
+const (
+	tpid8021Q  = 0x8100 // IEEE 802.1Q
+	tpid8021AD = 0x88A8 // IEEE 802.1ad (QinQ外側タグ)
+	vlanTagLen = 4      // TPID + TCI
+)
+
+// VLANFilterConfigはVLANによるフレーム選別の設定を保持する
+type VLANFilterConfig struct {
+	VLANs    []int       `yaml:"vlans"`    // トンネルへ転送するVLAN ID（空で無効）
+	Untagged bool        `yaml:"untagged"` // タグなしフレームも転送するか
+	Strip    bool        `yaml:"strip"`    // 送信時にタグを外し受信時に付け直す（VLANが1つの場合のみ）
+	Map      map[int]int `yaml:"map"`      // 送信時のVID書き換え（ローカルVID: リモートVID、受信時は逆変換）
+}
+
+// vlanFilterはTAPのトランクから指定VLANのみをトンネルへ延伸するフィルタ
+type vlanFilter struct {
+	allowed  map[uint16]bool   // 許可するローカルVID
+	untagged bool              // タグなしフレームを通すか
+	strip    uint16            // タグを外す場合のVID（0で無効）
+	toRemote map[uint16]uint16 // ローカルVID → リモートVID
+	toLocal  map[uint16]uint16 // リモートVID → ローカルVID
+
+	dropped [2]atomic.Uint64 // 方向ごとの破棄数
+}
+
+// newVLANFilter はVLAN設定からフィルタを生成する関数（無効ならnilを返す）
+func newVLANFilter(cfg VLANFilterConfig) (*vlanFilter, error) {
+	if len(cfg.VLANs) == 0 {
+		return nil, nil
+	}
+
+	f := &vlanFilter{
+		allowed:  make(map[uint16]bool),
+		untagged: cfg.Untagged,
+		toRemote: make(map[uint16]uint16),
+		toLocal:  make(map[uint16]uint16),
+	}
+	for _, vid := range cfg.VLANs {
+		if vid < 1 || vid > 4094 {
+			return nil, fmt.Errorf("invalid VLAN ID %d", vid)
+		}
+		f.allowed[uint16(vid)] = true
+	}
+
+	for local, remote := range cfg.Map {
+		if !f.allowed[uint16(local)] {
+			return nil, fmt.Errorf("mapped VLAN %d is not in vlans", local)
+		}
+		if remote < 1 || remote > 4094 {
+			return nil, fmt.Errorf("invalid remote VLAN ID %d", remote)
+		}
+		if _, dup := f.toLocal[uint16(remote)]; dup {
+			return nil, fmt.Errorf("remote VLAN %d is mapped more than once", remote)
+		}
+		f.toRemote[uint16(local)] = uint16(remote)
+		f.toLocal[uint16(remote)] = uint16(local)
+	}
+
+	if cfg.Strip {
+		if len(cfg.VLANs) != 1 || cfg.Untagged {
+			return nil, fmt.Errorf("strip requires exactly one VLAN and untagged: false")
+		}
+		f.strip = uint16(cfg.VLANs[0])
+	}
+
+	logf("[INFO]", "VLAN filter enabled: %v (untagged=%v strip=%v map=%v)", cfg.VLANs, cfg.Untagged, cfg.Strip, cfg.Map)
+	return f, nil
+}
+
+// frameVLAN はフレームの最外側VLANタグのVIDを返す関数（タグなしはok=false）
+func frameVLAN(frame []byte) (vid uint16, ok bool) {
+	if len(frame) < 14+vlanTagLen {
+		return 0, false
+	}
+	tpid := binary.BigEndian.Uint16(frame[12:14])
+	if tpid != tpid8021Q && tpid != tpid8021AD {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(frame[14:16]) & 0x0FFF, true
+}
+
+// setFrameVLAN はタグ付きフレームのVIDを書き換える関数（PCP/DEIは保持）
+func setFrameVLAN(frame []byte, vid uint16) {
+	tci := binary.BigEndian.Uint16(frame[14:16])
+	binary.BigEndian.PutUint16(frame[14:16], tci&0xF000|vid)
+}
+
+// Filter はVLAN IDに基づいてフレームを通過・破棄し、必要に応じてタグを加工する
+func (f *vlanFilter) Filter(dir Direction, frame []byte) ([]byte, Verdict) {
+	if len(frame) < 14 {
+		f.dropped[dir].Add(1)
+		return nil, VerdictDrop
+	}
+
+	vid, tagged := frameVLAN(frame)
+	if dir == DirTX {
+		return f.egress(frame, vid, tagged)
+	}
+	return f.ingress(frame, vid, tagged)
+}
+
+// egress はTAPから読んだフレームをトンネルへ送る前に選別・加工する
+func (f *vlanFilter) egress(frame []byte, vid uint16, tagged bool) ([]byte, Verdict) {
+	if !tagged {
+		if f.untagged {
+			return frame, VerdictPass
+		}
+		f.dropped[DirTX].Add(1)
+		return nil, VerdictDrop
+	}
+	if !f.allowed[vid] {
+		f.dropped[DirTX].Add(1)
+		return nil, VerdictDrop
+	}
+
+	if f.strip != 0 {
+		copy(frame[12:], frame[12+vlanTagLen:])
+		return frame[:len(frame)-vlanTagLen], VerdictPass
+	}
+	if remote, ok := f.toRemote[vid]; ok {
+		setFrameVLAN(frame, remote)
+	}
+	return frame, VerdictPass
+}
+
+// ingress はトンネルから受信したフレームをTAPへ書き込む前に選別・加工する
+func (f *vlanFilter) ingress(frame []byte, vid uint16, tagged bool) ([]byte, Verdict) {
+	if f.strip != 0 {
+		// タグなしで届いたフレームにローカルVIDのタグを付け直す
+		if tagged || len(frame)+vlanTagLen > cap(frame) {
+			f.dropped[DirRX].Add(1)
+			return nil, VerdictDrop
+		}
+		n := len(frame)
+		frame = frame[:n+vlanTagLen]
+		copy(frame[12+vlanTagLen:], frame[12:n])
+		binary.BigEndian.PutUint16(frame[12:14], tpid8021Q)
+		binary.BigEndian.PutUint16(frame[14:16], f.strip)
+		return frame, VerdictPass
+	}
+
+	if !tagged {
+		if f.untagged {
+			return frame, VerdictPass
+		}
+		f.dropped[DirRX].Add(1)
+		return nil, VerdictDrop
+	}
+
+	local := vid
+	if l, ok := f.toLocal[vid]; ok {
+		local = l
+	} else if _, mapped := f.toRemote[vid]; mapped {
+		// 書き換え対象のローカルVIDがそのまま届いた場合は対応が崩れるため破棄
+		f.dropped[DirRX].Add(1)
+		return nil, VerdictDrop
+	}
+	if !f.allowed[local] {
+		f.dropped[DirRX].Add(1)
+		return nil, VerdictDrop
+	}
+	if local != vid {
+		setFrameVLAN(frame, local)
+	}
+	return frame, VerdictPass
+}
+
+// Counters はVLANフィルタのカウンタを返す
+func (f *vlanFilter) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"vlan_tx_dropped": f.dropped[DirTX].Load(),
+		"vlan_rx_dropped": f.dropped[DirRX].Load(),
+	}
+}
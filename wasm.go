@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// WASMプラグイン関連の定数定義
+const (
+	wasmMemoryLimitPages  = 256                    // プラグインのメモリ上限（64KiBページ単位、16MiB）
+	wasmFrameTimeout      = 10 * time.Millisecond  // 1フレームの判定の上限（超えたら中断して破棄）
+	wasmRebuildBackoff    = 100 * time.Millisecond // 中断したインスタンスの作り直しに失敗した時の最初の待ち時間（失敗のたびに倍）
+	wasmRebuildMaxBackoff = 10 * time.Second       // 作り直しの待ち時間の上限
+
+	// プラグインが公開すべき関数（ABI）
+	wasmExportBuffer     = "etherip_buffer"      // () -> i32 : フレーム受け渡し用バッファのアドレス
+	wasmExportBufferSize = "etherip_buffer_size" // () -> i32 : バッファサイズ
+	wasmExportFilter     = "etherip_filter"      // (dir i32, len i32) -> i32 : 新しい長さ、負数で破棄
+)
+
+// WasmPluginConfigはWASMポリシープラグインの設定を保持する
+type WasmPluginConfig struct {
+	Path      string `yaml:"path"`      // .wasmファイルのパス
+	Direction string `yaml:"direction"` // 適用方向（tx, rx, both）
+	Bypass    bool   `yaml:"bypass"`    // 空いているインスタンスがない場合に判定せず通過させるか（既定は破棄）
+}
+
+// wasmPluginはサンドボックス化されたWASMポリシープラグイン
+//
+// プラグインは以下の狭いABIのみを通じてフレームを検査・加工・破棄できる。
+//   - etherip_buffer() -> i32       : ホストがフレームを書き込むバッファのアドレス
+//   - etherip_buffer_size() -> i32  : 上記バッファのサイズ
+//   - etherip_filter(dir, len) -> i32 : dir は 0=tx, 1=rx。バッファ内のフレームを
+//     その場で書き換えてよく、戻り値が新しい長さ。負数を返すとフレームを破棄する
+//
+// ホストからは etherip.log(ptr, len) のみをインポートとして提供する。
+// WASIやファイル・ネットワークへのアクセスは一切提供しない。
+// 無限ループ等でwasmFrameTimeoutを超えた呼び出しは中断し、そのインスタンスは捨てて裏で作り直す。
+// データパスを止めないよう空いているインスタンスは待たずに取り、なければbypassに従って通過・破棄する。
+type wasmPlugin struct {
+	name      string
+	tx, rx    bool
+	bypass    bool
+	ctx       context.Context // Closeで取り消し、作り直しをやめる
+	cancel    context.CancelFunc
+	runtime   wazero.Runtime
+	compiled  wazero.CompiledModule
+	instances chan *wasmInstance // ワーカー間で共有するインスタンスプール
+	traps     atomic.Uint64      // 実行時エラーの発生回数
+	timeouts  atomic.Uint64      // 時間切れで中断した回数
+	busy      atomic.Uint64      // 空いているインスタンスがなく判定しなかった回数
+	rebuilds  atomic.Uint64      // 中断したインスタンスの作り直しに失敗した回数
+}
+
+// wasmInstanceはプラグインの1インスタンス（goroutine間で同時使用しない）
+type wasmInstance struct {
+	mod     api.Module
+	filter  api.Function
+	bufPtr  uint32
+	bufSize uint32
+	stack   []uint64
+}
+
+// loadWasmPlugin はWASMモジュールを読み込み、インスタンスプールを作成する関数
+func loadWasmPlugin(pc WasmPluginConfig, poolSize int) (*wasmPlugin, error) {
+	tx, rx, ok := parseDirections(pc.Direction)
+	if !ok {
+		return nil, fmt.Errorf("invalid direction %q (tx, rx or both)", pc.Direction)
+	}
+
+	bin, err := os.ReadFile(pc.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &wasmPlugin{
+		name:      filepath.Base(pc.Path),
+		tx:        tx,
+		rx:        rx,
+		bypass:    pc.Bypass,
+		ctx:       ctx,
+		cancel:    cancel,
+		runtime:   wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithMemoryLimitPages(wasmMemoryLimitPages).WithCloseOnContextDone(true)),
+		instances: make(chan *wasmInstance, poolSize),
+	}
+
+	// プラグインへ公開するホスト関数（ログ出力のみ）
+	_, err = p.runtime.NewHostModuleBuilder("etherip").
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, m api.Module, ptr, length uint32) {
+			if msg, ok := m.Memory().Read(ptr, length); ok {
+				logf("[INFO]", "[wasm:%s] %s", p.name, msg)
+			}
+		}).
+		Export("log").
+		Instantiate(ctx)
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+
+	compiled, err := p.runtime.CompileModule(ctx, bin)
+	if err != nil {
+		p.Close()
+		return nil, fmt.Errorf("compile %s: %w", p.name, err)
+	}
+	p.compiled = compiled
+	exports := compiled.ExportedFunctions()
+	for _, name := range []string{wasmExportBuffer, wasmExportBufferSize, wasmExportFilter} {
+		if _, ok := exports[name]; !ok {
+			p.Close()
+			return nil, fmt.Errorf("%s does not export %s", p.name, name)
+		}
+	}
+
+	// ワーカー数分のインスタンスを事前に生成
+	for i := 0; i < poolSize; i++ {
+		inst, err := p.instantiate(ctx, compiled)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.instances <- inst
+	}
+
+	logf("[INFO]", "WASM plugin %s loaded (direction: tx=%v rx=%v)", p.name, tx, rx)
+	return p, nil
+}
+
+// instantiate はコンパイル済みモジュールから匿名インスタンスを生成する関数
+func (p *wasmPlugin) instantiate(ctx context.Context, compiled wazero.CompiledModule) (*wasmInstance, error) {
+	mod, err := p.runtime.InstantiateModule(ctx, compiled, wazero.NewModuleConfig().WithName(""))
+	if err != nil {
+		return nil, fmt.Errorf("instantiate %s: %w", p.name, err)
+	}
+
+	ptr, err := mod.ExportedFunction(wasmExportBuffer).Call(ctx)
+	if err != nil {
+		return nil, err
+	}
+	size, err := mod.ExportedFunction(wasmExportBufferSize).Call(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &wasmInstance{
+		mod:     mod,
+		filter:  mod.ExportedFunction(wasmExportFilter),
+		bufPtr:  api.DecodeU32(ptr[0]),
+		bufSize: api.DecodeU32(size[0]),
+		stack:   make([]uint64, 2),
+	}, nil
+}
+
+// Filter はプラグインの etherip_filter を呼び出してフレームを判定する
+func (p *wasmPlugin) Filter(dir Direction, frame []byte) ([]byte, Verdict) {
+	if (dir == DirTX && !p.tx) || (dir == DirRX && !p.rx) {
+		return frame, VerdictPass
+	}
+
+	var inst *wasmInstance
+	select {
+	case inst = <-p.instances:
+	default:
+		// 全インスタンスが使用中・作り直し中でも待たない
+		p.busy.Add(1)
+		if p.bypass {
+			return frame, VerdictPass
+		}
+		return nil, VerdictDrop
+	}
+	defer func() {
+		if inst != nil {
+			p.instances <- inst
+		}
+	}()
+
+	// バッファに収まらないフレームはプラグインで判定できないため破棄（fail-closed）
+	if uint32(len(frame)) > inst.bufSize || !inst.mod.Memory().Write(inst.bufPtr, frame) {
+		return nil, VerdictDrop
+	}
+
+	inst.stack[0] = api.EncodeI32(int32(dir))
+	inst.stack[1] = api.EncodeI32(int32(len(frame)))
+	ctx, cancel := context.WithTimeout(context.Background(), wasmFrameTimeout)
+	err := inst.filter.CallWithStack(ctx, inst.stack)
+	cancel()
+	if err != nil && ctx.Err() != nil {
+		// 中断したインスタンスは閉じられているためプールへ戻さず、裏で作り直す
+		if p.timeouts.Add(1) == 1 {
+			logf("[ERROR]", "WASM plugin %s exceeded %v, dropping frame", p.name, wasmFrameTimeout)
+		}
+		inst = nil
+		go p.rebuild()
+		return nil, VerdictDrop
+	}
+	if err != nil {
+		if p.traps.Add(1) == 1 {
+			logf("[ERROR]", "WASM plugin %s trapped, dropping frame: %v", p.name, err)
+		}
+		return nil, VerdictDrop
+	}
+
+	n := api.DecodeI32(inst.stack[0])
+	if n < 0 {
+		return nil, VerdictDrop
+	}
+	if uint32(n) > inst.bufSize || int(n) > cap(frame) {
+		return nil, VerdictDrop
+	}
+
+	out, ok := inst.mod.Memory().Read(inst.bufPtr, uint32(n))
+	if !ok {
+		return nil, VerdictDrop
+	}
+	frame = frame[:n]
+	copy(frame, out)
+	return frame, VerdictPass
+}
+
+// rebuild は中断したインスタンスの代わりを作ってプールへ戻す関数（失敗したら間隔を空けて再試行し、Close後はやめる）
+func (p *wasmPlugin) rebuild() {
+	delay := wasmRebuildBackoff
+	for {
+		inst, err := p.instantiate(p.ctx, p.compiled)
+		if err == nil {
+			p.instances <- inst
+			return
+		}
+		if p.ctx.Err() != nil {
+			return
+		}
+		if p.rebuilds.Add(1) == 1 {
+			logf("[ERROR]", "WASM plugin %s: %v (retrying)", p.name, err)
+		}
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, wasmRebuildMaxBackoff)
+	}
+}
+
+// Counters はプラグインのカウンタを返す
+func (p *wasmPlugin) Counters() map[string]uint64 {
+	return map[string]uint64{
+		"wasm_traps":          p.traps.Load(),
+		"wasm_timeouts":       p.timeouts.Load(),
+		"wasm_busy":           p.busy.Load(),
+		"wasm_rebuild_errors": p.rebuilds.Load(),
+	}
+}
+
+// Close はプラグインのランタイムと全インスタンスを解放する
+func (p *wasmPlugin) Close() error {
+	p.cancel()
+	return p.runtime.Close(context.Background())
+}
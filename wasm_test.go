@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// wasmTestModule はetherip_filterの本体だけを差し替えた最小のプラグイン（メモリ1ページ、バッファは先頭1024バイト）を組み立てる
+func wasmTestModule(filter []byte) []byte {
+	b := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+	b = append(b, 0x01, 0x0b, 0x02, 0x60, 0x00, 0x01, 0x7f, 0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7f) // () -> i32, (i32, i32) -> i32
+	b = append(b, 0x03, 0x04, 0x03, 0x00, 0x00, 0x01)
+	b = append(b, 0x05, 0x03, 0x01, 0x00, 0x01)
+
+	var exports []byte
+	for i, name := range []string{wasmExportBuffer, wasmExportBufferSize, wasmExportFilter} {
+		exports = append(exports, byte(len(name)))
+		exports = append(exports, name...)
+		exports = append(exports, 0x00, byte(i))
+	}
+	b = append(b, 0x07, byte(1+len(exports)), 0x03)
+	b = append(b, exports...)
+
+	code := []byte{0x03}
+	code = append(code, 0x04, 0x00, 0x41, 0x00, 0x0b)       // etherip_buffer: 0
+	code = append(code, 0x05, 0x00, 0x41, 0x80, 0x08, 0x0b) // etherip_buffer_size: 1024
+	code = append(code, byte(len(filter)))
+	code = append(code, filter...)
+	b = append(b, 0x0a, byte(len(code)))
+	return append(b, code...)
+}
+
+func TestWasmPluginFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		filter   []byte
+		verdict  Verdict
+		timeouts uint64
+	}{
+		{"pass", []byte{0x00, 0x20, 0x01, 0x0b}, VerdictPass, 0},                                       // lenをそのまま返す
+		{"drop", []byte{0x00, 0x41, 0x7f, 0x0b}, VerdictDrop, 0},                                       // -1
+		{"endless loop", []byte{0x00, 0x03, 0x40, 0x0c, 0x00, 0x0b, 0x41, 0x00, 0x0b}, VerdictDrop, 2}, // loop { br 0 }
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "policy.wasm")
+			if err := os.WriteFile(path, wasmTestModule(tt.filter), 0644); err != nil {
+				t.Fatal(err)
+			}
+			p, err := loadWasmPlugin(WasmPluginConfig{Path: path, Direction: "both"}, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+
+			// 2回目は時間切れの後に裏で作り直したインスタンスで判定する
+			for i := 0; i < 2; i++ {
+				waitWasmPool(t, p, 1)
+				frame := bytes.Repeat([]byte{0xab}, 64)
+				out, verdict := p.Filter(DirTX, frame)
+				if verdict != tt.verdict {
+					t.Fatalf("call %d: verdict = %v, want %v", i, verdict, tt.verdict)
+				}
+				if verdict == VerdictPass && !bytes.Equal(out, bytes.Repeat([]byte{0xab}, 64)) {
+					t.Fatalf("call %d: frame changed: % x", i, out)
+				}
+			}
+			if got := p.timeouts.Load(); got != tt.timeouts {
+				t.Errorf("timeouts = %d, want %d", got, tt.timeouts)
+			}
+			if got := p.traps.Load(); got != 0 {
+				t.Errorf("traps = %d, want 0", got)
+			}
+			if got := p.busy.Load(); got != 0 {
+				t.Errorf("busy = %d, want 0", got)
+			}
+		})
+	}
+}
+
+// waitWasmPool はプールの空きインスタンスがn個になるまで待つ
+func waitWasmPool(t *testing.T, p *wasmPlugin, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(p.instances) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("pool has %d idle instances, want %d", len(p.instances), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWasmPluginBusy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.wasm")
+	if err := os.WriteFile(path, wasmTestModule([]byte{0x00, 0x41, 0x7f, 0x0b}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, bypass := range []bool{false, true} {
+		p, err := loadWasmPlugin(WasmPluginConfig{Path: path, Direction: "both", Bypass: bypass}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 唯一のインスタンスを使用中にしても待たずにbypassに従う
+		inst := <-p.instances
+		want := VerdictDrop
+		if bypass {
+			want = VerdictPass
+		}
+		done := make(chan Verdict, 1)
+		go func() {
+			_, verdict := p.Filter(DirTX, make([]byte, 64))
+			done <- verdict
+		}()
+		select {
+		case got := <-done:
+			if got != want {
+				t.Errorf("bypass=%v: verdict = %v, want %v", bypass, got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("bypass=%v: Filter blocked on an empty pool", bypass)
+		}
+		if got := p.busy.Load(); got != 1 {
+			t.Errorf("bypass=%v: busy = %d, want 1", bypass, got)
+		}
+		p.instances <- inst
+		p.Close()
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// ワーカー・キューのサイズ関連の定数定義
+const (
+	minAutoWorkers   = 1
+	maxAutoWorkers   = 16
+	queuePerWorker   = 32 // 自動設定時のワーカー1つあたりのキュー長
+	minQueueSize     = 64
+	maxWorkerOrQueue = 1 << 16
+)
+
+// WorkerConfigは転送ワーカーとキューのサイズ、CPU固定の設定を保持する（0で自動）
+type WorkerConfig struct {
+	SendWorkers int   `yaml:"send_workers"` // 送信ワーカー数
+	RecvWorkers int   `yaml:"recv_workers"` // 受信ワーカー数
+	SendQueue   int   `yaml:"send_queue"`   // 送信キュー長
+	RecvQueue   int   `yaml:"recv_queue"`   // 受信キュー長
+	CPUs        []int `yaml:"cpus"`         // ワーカーを固定するCPU番号（送信→受信の順に巡回して割り当て、空で固定しない）
+
+	// 受信フレームのTAPへの書き込み順序
+	//   "flow" 同じフローのフレームを同じワーカーで処理し、到着順に書き込む（既定）
+	//   "none" 全ワーカーで1つのキューを共有する（フロー内で順序が入れ替わることがある）
+	RecvOrder string `yaml:"recv_order"`
+}
+
+// workerSizingは自動設定を反映したワーカー数・キュー長
+type workerSizing struct {
+	sendWorkers, recvWorkers int
+	sendQueue, recvQueue     int
+	cpus                     []int
+	flowOrder                bool // 受信キューをワーカーごとに分けてフロー順序を保つ
+}
+
+// resolveWorkers はワーカー設定を検証し、未指定の値をCPU数から決める関数
+//
+// 既定のワーカー数は方向ごとにCPU数の半分（1〜16）、キュー長はワーカー数×32（最小64）。
+func resolveWorkers(cfg WorkerConfig) (workerSizing, error) {
+	for name, v := range map[string]int{
+		"send_workers": cfg.SendWorkers, "recv_workers": cfg.RecvWorkers,
+		"send_queue": cfg.SendQueue, "recv_queue": cfg.RecvQueue,
+	} {
+		if v < 0 || v > maxWorkerOrQueue {
+			return workerSizing{}, fmt.Errorf("%s %d out of range (0-%d)", name, v, maxWorkerOrQueue)
+		}
+	}
+	for _, cpu := range cfg.CPUs {
+		if cpu < 0 || cpu >= runtime.NumCPU() {
+			return workerSizing{}, fmt.Errorf("cpu %d out of range (0-%d)", cpu, runtime.NumCPU()-1)
+		}
+	}
+
+	var flowOrder bool
+	switch cfg.RecvOrder {
+	case "", "flow":
+		flowOrder = true
+	case "none":
+	default:
+		return workerSizing{}, fmt.Errorf("unknown recv_order %q (flow or none)", cfg.RecvOrder)
+	}
+
+	auto := max(minAutoWorkers, min(runtime.NumCPU()/2, maxAutoWorkers))
+	w := workerSizing{
+		sendWorkers: cfg.SendWorkers,
+		recvWorkers: cfg.RecvWorkers,
+		sendQueue:   cfg.SendQueue,
+		recvQueue:   cfg.RecvQueue,
+		cpus:        cfg.CPUs,
+		flowOrder:   flowOrder,
+	}
+	if w.sendWorkers == 0 {
+		w.sendWorkers = auto
+	}
+	if w.recvWorkers == 0 {
+		w.recvWorkers = auto
+	}
+	if w.sendQueue == 0 {
+		w.sendQueue = max(minQueueSize, w.sendWorkers*queuePerWorker)
+	}
+	if w.recvQueue == 0 {
+		w.recvQueue = max(minQueueSize, w.recvWorkers*queuePerWorker)
+	}
+	return w, nil
+}
+
+// total は送受信ワーカーの合計数を返す
+func (w workerSizing) total() int {
+	return w.sendWorkers + w.recvWorkers
+}
+
+// pin はn番目のワーカー（送信→受信の通し番号）を割り当てCPUに固定する（CPU指定がなければ何もしない）
+func (w workerSizing) pin(tap string, n int) {
+	if len(w.cpus) == 0 {
+		return
+	}
+	cpu := w.cpus[n%len(w.cpus)]
+	if err := pinThread(cpu); err != nil {
+		logf("[WARN]", "%s: failed to pin worker %d to CPU %d: %v", tap, n, cpu, err)
+	}
+}